@@ -18,9 +18,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -31,6 +29,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/mholt/acmez/v3/acme"
 	"go.uber.org/zap"
@@ -79,16 +78,24 @@ func (am *ACMEIssuer) loadAccount(ctx context.Context, ca, email string) (acme.A
 
 // newAccount generates a new private key for a new ACME account, but
 // it does not register or save the account.
-func (*ACMEIssuer) newAccount(email string) (acme.Account, error) {
+func (am *ACMEIssuer) newAccount(email string) (acme.Account, error) {
 	var acct acme.Account
 	if email != "" {
 		acct.Contact = []string{"mailto:" + email} // TODO: should we abstract the contact scheme?
 	}
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var keySource KeyGenerator = StandardKeyGenerator{KeyType: P256}
+	if am.AccountKeySource != nil {
+		keySource = am.AccountKeySource
+	}
+	privateKey, err := keySource.GenerateKey()
 	if err != nil {
 		return acct, fmt.Errorf("generating private key: %v", err)
 	}
-	acct.PrivateKey = privateKey
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return acct, fmt.Errorf("private key of type %T is not a crypto.Signer", privateKey)
+	}
+	acct.PrivateKey = signer
 	return acct, nil
 }
 
@@ -337,6 +344,10 @@ func (am *ACMEIssuer) storageKeyUserPrivateKey(caURL, email string) string {
 	return am.storageSafeUserKey(caURL, email, "private", ".key")
 }
 
+func (am *ACMEIssuer) storageKeyUserTerms(caURL, email string) string {
+	return am.storageSafeUserKey(caURL, email, "terms", ".terms.json")
+}
+
 // storageSafeUserKey returns a key for the given email, with the default
 // filename, and the filename ending in the given extension.
 func (am *ACMEIssuer) storageSafeUserKey(ca, email, defaultFilename, extension string) string {
@@ -415,6 +426,142 @@ func (am *ACMEIssuer) mostRecentAccountEmail(ctx context.Context, caURL string)
 	return getPrimaryContact(account), true
 }
 
+// syncAccount reconciles an already-registered account with the
+// issuer's configuration and the CA: if the primary contact differs
+// from the configured email address, the account is updated with the
+// CA, keeping its other contacts; and if the CA's terms of service
+// changed since the account agreed to them, an event is emitted.
+// Errors are logged but not returned, since the account is still usable.
+func (am *ACMEIssuer) syncAccount(ctx context.Context, client *acme.Client, account acme.Account) acme.Account {
+	logger := am.Logger.With(
+		zap.String("ca", client.Directory),
+		zap.Strings("contact", account.Contact))
+
+	email := am.getEmail()
+	if contacts := syncedContacts(account, email); contacts != nil {
+		previous := account.Contact
+		account.Contact = contacts
+		updated, err := client.UpdateAccount(ctx, account)
+		if err != nil {
+			logger.Error("unable to update ACME account contact",
+				zap.String("email", email),
+				zap.Error(err))
+			account.Contact = previous
+		} else {
+			// the CA need not echo the contacts, and the account
+			// URL is not in the response of an account update
+			if len(updated.Contact) == 0 {
+				updated.Contact = account.Contact
+			}
+			if updated.Location == "" {
+				updated.Location = account.Location
+			}
+			account = updated
+			if err := am.saveAccount(ctx, client.Directory, account); err != nil {
+				logger.Error("unable to save updated ACME account", zap.Error(err))
+			}
+			logger.Info("updated ACME account contact",
+				zap.Strings("previous_contact", previous),
+				zap.Strings("new_contact", account.Contact))
+		}
+	}
+
+	if err := am.checkTermsOfService(ctx, client, account); err != nil {
+		logger.Error("unable to check CA terms of service", zap.Error(err))
+	}
+
+	return account
+}
+
+// syncedContacts returns the contacts account should have for email to
+// be its primary contact: email, followed by the contacts of account
+// other than its current primary contact. It returns nil if email is
+// empty or already the primary contact, i.e. no update is needed.
+func syncedContacts(account acme.Account, email string) []string {
+	if email == "" || strings.EqualFold(getPrimaryContact(account), email) {
+		return nil
+	}
+	contacts := []string{"mailto:" + email}
+	for i, contact := range account.Contact {
+		if i == 0 || strings.EqualFold(contact, contacts[0]) {
+			continue
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts
+}
+
+// checkTermsOfService compares the CA's current terms of service with
+// the terms recorded for account, and emits an acme_terms_changed event
+// if they differ. If the issuer is configured to agree to the CA's terms
+// (Agreed), the new terms are recorded as agreed; otherwise the event is
+// emitted on every check until the terms are agreed to, since the CA may
+// require explicit re-agreement before it issues more certificates.
+func (am *ACMEIssuer) checkTermsOfService(ctx context.Context, client *acme.Client, account acme.Account) error {
+	dir, err := client.GetDirectory(ctx)
+	if err != nil {
+		return fmt.Errorf("getting directory: %w", err)
+	}
+	if dir.Meta == nil || dir.Meta.TermsOfService == "" {
+		return nil
+	}
+	current := dir.Meta.TermsOfService
+
+	termsKey := am.storageKeyUserTerms(client.Directory, getPrimaryContact(account))
+	var recorded accountTerms
+	termsBytes, err := am.config.Storage.Load(ctx, termsKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		// the account predates terms tracking, so this is our baseline
+		return am.recordTermsOfService(ctx, client.Directory, account, current)
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(termsBytes, &recorded); err != nil {
+		return fmt.Errorf("decoding recorded terms of service: %v", err)
+	}
+	if recorded.TermsOfService == current {
+		return nil
+	}
+
+	agreed := am.Agreed
+	am.Logger.Warn("CA terms of service have changed",
+		zap.String("ca", client.Directory),
+		zap.Strings("contact", account.Contact),
+		zap.String("previous_terms", recorded.TermsOfService),
+		zap.String("terms", current),
+		zap.Bool("agreed", agreed))
+	am.config.emit(ctx, "acme_terms_changed", map[string]any{
+		"ca":             client.Directory,
+		"contact":        account.Contact,
+		"previous_terms": recorded.TermsOfService,
+		"terms":          current,
+		"agreed":         agreed,
+	})
+	if !agreed {
+		return nil
+	}
+	return am.recordTermsOfService(ctx, client.Directory, account, current)
+}
+
+// recordTermsOfService records in storage that account agreed to terms.
+func (am *ACMEIssuer) recordTermsOfService(ctx context.Context, ca string, account acme.Account, terms string) error {
+	termsBytes, err := json.MarshalIndent(accountTerms{
+		TermsOfService: terms,
+		Recorded:       time.Now(),
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return am.config.Storage.Store(ctx, am.storageKeyUserTerms(ca, getPrimaryContact(account)), termsBytes)
+}
+
+// accountTerms records the terms of service an account agreed to.
+type accountTerms struct {
+	TermsOfService string    `json:"terms_of_service"`
+	Recorded       time.Time `json:"recorded"`
+}
+
 func accountRegLockKey(acc acme.Account) string {
 	key := "register_acme_account"
 	if len(acc.Contact) == 0 {
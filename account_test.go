@@ -17,7 +17,13 @@ package certmagic
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"io/fs"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
@@ -26,6 +32,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mholt/acmez/v3/acme"
 	"go.uber.org/zap"
 )
 
@@ -521,3 +528,156 @@ func TestGetEmailFromRecent(t *testing.T) {
 // agreementTestURL is set during tests to skip requiring
 // setting up an entire ACME CA endpoint.
 var agreementTestURL string
+
+func TestCheckTermsOfService(t *testing.T) {
+	ctx := context.Background()
+	const terms = "https://ca.example.com/terms/v2"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"newNonce":"%[1]s/nonce","newAccount":"%[1]s/account","newOrder":"%[1]s/order","meta":{"termsOfService":%[2]q}}`, "http://"+r.Host, terms)
+	}))
+	defer srv.Close()
+
+	var events []map[string]any
+	am := &ACMEIssuer{CA: srv.URL, Agreed: true, Logger: zap.NewNop(), mu: new(sync.Mutex)}
+	am.config = &Config{
+		Issuers: []Issuer{am},
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "acme_terms_changed" {
+				events = append(events, data)
+			}
+			return nil
+		},
+		certCache: new(Cache),
+	}
+	client := &acme.Client{Directory: srv.URL, HTTPClient: srv.Client()}
+	account := acme.Account{Contact: []string{"mailto:me@example.com"}}
+	termsKey := am.storageKeyUserTerms(srv.URL, "me@example.com")
+
+	recorded := func() string {
+		t.Helper()
+		b, err := am.config.Storage.Load(ctx, termsKey)
+		if err != nil {
+			t.Fatalf("loading recorded terms: %v", err)
+		}
+		var at accountTerms
+		if err := json.Unmarshal(b, &at); err != nil {
+			t.Fatalf("decoding recorded terms: %v", err)
+		}
+		return at.TermsOfService
+	}
+	recordOld := func() {
+		t.Helper()
+		if err := am.recordTermsOfService(ctx, srv.URL, account, "https://ca.example.com/terms/v1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first check records a baseline without emitting an event
+	if err := am.checkTermsOfService(ctx, client, account); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 0 || recorded() != terms {
+		t.Fatalf("expected baseline %s to be recorded without events, got %q and %d events", terms, recorded(), len(events))
+	}
+
+	// when the terms change and the issuer agrees to them, they are recorded
+	recordOld()
+	if err := am.checkTermsOfService(ctx, client, account); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 1 || events[0]["terms"] != terms || events[0]["agreed"] != true {
+		t.Fatalf("expected one acme_terms_changed event, got %v", events)
+	}
+	if recorded() != terms {
+		t.Errorf("expected new terms to be recorded, got %s", recorded())
+	}
+
+	// if the issuer does not agree, the old terms remain recorded
+	am.Agreed = false
+	recordOld()
+	if err := am.checkTermsOfService(ctx, client, account); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 2 || events[1]["agreed"] != false {
+		t.Fatalf("expected second acme_terms_changed event without agreement, got %v", events)
+	}
+	if recorded() == terms {
+		t.Error("expected unagreed terms not to be recorded")
+	}
+}
+
+func TestSyncAccount(t *testing.T) {
+	ctx := context.Background()
+	var updates [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/nonce":
+		case "/account/1":
+			var jws struct{ Payload string }
+			if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+				t.Errorf("decoding request: %v", err)
+			}
+			payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+			var update acme.Account
+			if err := json.Unmarshal(payload, &update); err != nil {
+				t.Errorf("decoding update: %v", err)
+			}
+			updates = append(updates, update.Contact)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"status":"valid"}`)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"newNonce":"%[1]s/nonce","newAccount":"%[1]s/account","newOrder":"%[1]s/order"}`, "http://"+r.Host)
+		}
+	}))
+	defer srv.Close()
+
+	am := &ACMEIssuer{CA: srv.URL, Logger: zap.NewNop(), mu: new(sync.Mutex)}
+	am.config = &Config{
+		Issuers:   []Issuer{am},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		Logger:    defaultTestLogger,
+		certCache: new(Cache),
+	}
+	key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &acme.Client{Directory: srv.URL, HTTPClient: srv.Client()}
+	account := acme.Account{
+		Status:     "valid",
+		Contact:    []string{"mailto:me@example.com", "mailto:ops@example.com"},
+		Location:   srv.URL + "/account/1",
+		PrivateKey: key.(crypto.Signer),
+	}
+
+	// nothing to update if the configured email is the primary contact
+	am.email = "Me@example.com"
+	if synced := am.syncAccount(ctx, client, account); len(updates) != 0 || !reflect.DeepEqual(synced.Contact, account.Contact) {
+		t.Fatalf("expected no update, got %v and contacts %v", updates, synced.Contact)
+	}
+
+	// a different email replaces the primary contact but keeps the others
+	am.email = "new@example.com"
+	synced := am.syncAccount(ctx, client, account)
+	expected := []string{"mailto:new@example.com", "mailto:ops@example.com"}
+	if len(updates) != 1 || !reflect.DeepEqual(updates[0], expected) {
+		t.Fatalf("expected one update to %v, got %v", expected, updates)
+	}
+	if !reflect.DeepEqual(synced.Contact, expected) || synced.Location != account.Location {
+		t.Errorf("expected updated account with contacts %v at %s, got %v at %s", expected, account.Location, synced.Contact, synced.Location)
+	}
+	if _, err := am.loadAccount(ctx, srv.URL, "new@example.com"); err != nil {
+		t.Errorf("expected updated account to be saved: %v", err)
+	}
+
+	// the updated account is in sync
+	am.syncAccount(ctx, client, synced)
+	if len(updates) != 1 {
+		t.Errorf("expected no more updates, got %v", updates)
+	}
+}
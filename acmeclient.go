@@ -51,6 +51,7 @@ func (iss *ACMEIssuer) newACMEClientWithAccount(ctx context.Context, useTestCA,
 	if err != nil {
 		return nil, err
 	}
+	client.Client.HTTPClient = iss.httpClientFor(ctx)
 
 	// we try loading the account from storage before a potential
 	// lock, and after obtaining the lock as well, to ensure we don't
@@ -164,12 +165,21 @@ func (iss *ACMEIssuer) newACMEClientWithAccount(ctx context.Context, useTestCA,
 			if err != nil {
 				return nil, fmt.Errorf("could not save account %v: %v", account.Contact, err)
 			}
+
+			// remember which terms were agreed to, so we can tell when they change
+			if dir, err := client.GetDirectory(ctx); err == nil && dir.Meta != nil && dir.Meta.TermsOfService != "" {
+				if err := iss.recordTermsOfService(ctx, client.Directory, account, dir.Meta.TermsOfService); err != nil {
+					iss.Logger.Error("unable to record agreed terms of service", zap.Error(err))
+				}
+			}
 		} else {
 			iss.Logger.Info("account has already been registered; reloaded",
 				zap.Strings("contact", account.Contact),
 				zap.String("status", account.Status),
 				zap.String("location", account.Location))
 		}
+	} else {
+		account = iss.syncAccount(ctx, client.Client, account)
 	}
 
 	c := &acmeClient{
@@ -212,20 +222,24 @@ func (iss *ACMEIssuer) newACMEClient(useTestCA bool) (*acmez.Client, error) {
 				storageKeyIssuerPrefix: iss.storageKeyCAPrefix(client.Directory),
 				solver: &httpSolver{
 					handler: iss.HTTPChallengeHandler(http.NewServeMux()),
-					address: net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getHTTPPort())),
+					address: iss.httpChallengeAddress(),
 				},
 			}
 		}
 
 		// enable TLS-ALPN-01 challenge
 		if !iss.DisableTLSALPNChallenge {
+			var solver acmez.Solver = &tlsALPNSolver{
+				config:  iss.config,
+				address: iss.tlsALPNChallengeAddress(),
+			}
+			if iss.TLSALPN01Solver != nil {
+				solver = iss.TLSALPN01Solver
+			}
 			client.ChallengeSolvers[acme.ChallengeTypeTLSALPN01] = distributedSolver{
 				storage:                iss.config.Storage,
 				storageKeyIssuerPrefix: iss.storageKeyCAPrefix(client.Directory),
-				solver: &tlsALPNSolver{
-					config:  iss.config,
-					address: net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getTLSALPNPort())),
-				},
+				solver:                 solver,
 			}
 		}
 	} else {
@@ -289,6 +303,10 @@ func (iss *ACMEIssuer) GetRenewalInfo(ctx context.Context, cert Certificate) (ac
 	if err != nil {
 		return acme.RenewalInfo{}, err
 	}
+	if iss.config != nil {
+		ctx = iss.config.egressContext(ctx, cert.Names, cert.Tags)
+		acmeClient.Client.HTTPClient = iss.httpClientFor(ctx)
+	}
 	return acmeClient.GetRenewalInfo(ctx, cert.Certificate.Leaf)
 }
 
@@ -303,6 +321,22 @@ func (iss *ACMEIssuer) getHTTPPort() int {
 	return useHTTPPort
 }
 
+// httpChallengeAddress returns the address on
+// which to serve the HTTP challenge.
+func (iss *ACMEIssuer) httpChallengeAddress() string {
+	if iss.HTTPChallengeAddress != "" {
+		return iss.HTTPChallengeAddress
+	}
+	return net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getHTTPPort()))
+}
+
+func (iss *ACMEIssuer) tlsALPNChallengeAddress() string {
+	if iss.TLSALPNChallengeAddress != "" {
+		return iss.TLSALPNChallengeAddress
+	}
+	return net.JoinHostPort(iss.ListenHost, strconv.Itoa(iss.getTLSALPNPort()))
+}
+
 func (iss *ACMEIssuer) getTLSALPNPort() int {
 	useTLSALPNPort := TLSALPNChallengePort
 	if HTTPSPort > 0 && HTTPSPort != TLSALPNChallengePort {
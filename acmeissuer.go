@@ -18,8 +18,10 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
@@ -63,6 +65,13 @@ type ACMEIssuer struct {
 	// can be looked up with the ACME protocol
 	AccountKeyPEM string
 
+	// The source of private keys for new ACME accounts,
+	// for example to generate them in hardware.
+	// Default: P-256 keys generated in memory.
+	//
+	// EXPERIMENTAL: Subject to change or removal.
+	AccountKeySource KeyGenerator
+
 	// Set to true if agreed to the CA's
 	// subscriber agreement
 	Agreed bool
@@ -110,6 +119,32 @@ type ACMEIssuer struct {
 	// challenge to succeed
 	AltTLSALPNPort int
 
+	// The address on which to listen to solve the
+	// ACME HTTP challenge, in any format accepted by
+	// ListenAddress, such as "unix:/run/acme.sock"
+	// or "fdname:http" for a socket passed by systemd;
+	// if set, ListenHost and AltHTTPPort are ignored
+	// for the HTTP challenge. This is not needed if
+	// HTTP is served with the HTTPChallengeHandler.
+	// EXPERIMENTAL: Subject to change or removal.
+	HTTPChallengeAddress string
+
+	// The address on which to listen to solve the
+	// ACME TLS-ALPN challenge, in any format accepted
+	// by ListenAddress; if set, ListenHost and
+	// AltTLSALPNPort are ignored for the TLS-ALPN
+	// challenge. The system must forward connections
+	// to TLSALPNChallengePort to this address.
+	// EXPERIMENTAL: Subject to change or removal.
+	TLSALPNChallengeAddress string
+
+	// The solver for the tls-alpn-01 challenge, instead
+	// of serving it from a listener of this process, such
+	// as an ExternalTLSALPNSolver when another process
+	// terminates TLS for the names.
+	// EXPERIMENTAL: Subject to change or removal.
+	TLSALPN01Solver acmez.Solver
+
 	// The solver for the dns-01 challenge;
 	// usually this is a DNS01Solver value
 	// from this package
@@ -153,6 +188,7 @@ type ACMEIssuer struct {
 
 	config     *Config
 	httpClient *http.Client
+	dialer     *net.Dialer
 
 	// Some fields are changed on-the-fly during
 	// certificate management. For example, the
@@ -195,6 +231,9 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.AccountKeyPEM == "" {
 		template.AccountKeyPEM = DefaultACME.AccountKeyPEM
 	}
+	if template.AccountKeySource == nil {
+		template.AccountKeySource = DefaultACME.AccountKeySource
+	}
 	if !template.Agreed {
 		template.Agreed = DefaultACME.Agreed
 	}
@@ -222,6 +261,15 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 	if template.AltTLSALPNPort == 0 {
 		template.AltTLSALPNPort = DefaultACME.AltTLSALPNPort
 	}
+	if template.HTTPChallengeAddress == "" {
+		template.HTTPChallengeAddress = DefaultACME.HTTPChallengeAddress
+	}
+	if template.TLSALPNChallengeAddress == "" {
+		template.TLSALPNChallengeAddress = DefaultACME.TLSALPNChallengeAddress
+	}
+	if template.TLSALPN01Solver == nil {
+		template.TLSALPN01Solver = DefaultACME.TLSALPN01Solver
+	}
 	if template.DNS01Solver == nil {
 		template.DNS01Solver = DefaultACME.DNS01Solver
 	}
@@ -288,6 +336,7 @@ func NewACMEIssuer(cfg *Config, template ACMEIssuer) *ACMEIssuer {
 		Transport: transport,
 		Timeout:   HTTPTimeout,
 	}
+	template.dialer = dialer
 
 	return &template
 }
@@ -298,6 +347,40 @@ func (am *ACMEIssuer) IssuerKey() string {
 	return am.issuerKey(am.CA)
 }
 
+// CheckHealth implements IssuerHealthChecker by fetching
+// the directory of the CA, bypassing any cached copy.
+func (am *ACMEIssuer) CheckHealth(ctx context.Context) error {
+	client, err := am.newBasicACMEClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, client.Directory, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", buildUAString())
+	httpClient := am.httpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching ACME directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching ACME directory %s: HTTP %d", client.Directory, resp.StatusCode)
+	}
+	var dir acme.Directory
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&dir); err != nil {
+		return fmt.Errorf("decoding ACME directory %s: %v", client.Directory, err)
+	}
+	if dir.NewOrder == "" {
+		return fmt.Errorf("ACME directory %s has no newOrder endpoint", client.Directory)
+	}
+	return nil
+}
+
 func (*ACMEIssuer) issuerKey(ca string) string {
 	key := ca
 	if caURL, err := url.Parse(key); err == nil {
@@ -372,6 +455,7 @@ func (am *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (
 	if am.config == nil {
 		panic("missing config pointer (must use NewACMEIssuer)")
 	}
+	ctx = am.config.egressContext(ctx, namesFromCSR(csr), nil)
 
 	var attempts int
 	if attemptsPtr, ok := ctx.Value(AttemptsCtxKey).(*int); ok {
@@ -461,6 +545,15 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 	if am.NotAfter != 0 {
 		params.NotAfter = time.Now().Add(am.NotAfter)
 	}
+	if lifetime, ok := RequestedLifetime(ctx); ok {
+		// the lifetime requested for this certificate is more
+		// specific than the issuer's configured validity period
+		if params.NotBefore.IsZero() {
+			params.NotAfter = time.Now().Add(lifetime)
+		} else {
+			params.NotAfter = params.NotBefore.Add(lifetime)
+		}
+	}
 	params.Profile = am.Profile
 
 	// Notify the ACME server we are replacing a certificate (if the caller says we are),
@@ -486,7 +579,9 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 			zap.String("account_id", params.Account.Location),
 			zap.Strings("account_contact", params.Account.Contact))
 
-		certChains, err = client.acmeClient.ObtainCertificate(ctx, params)
+		orderCtx, challenges := withChallengeRecorder(ctx)
+		certChains, err = client.acmeClient.ObtainCertificate(orderCtx, params)
+		challenges.record(am.config.Metrics, err)
 		if err != nil {
 			var prob acme.Problem
 			if errors.As(err, &prob) && prob.Type == acme.ProblemTypeAccountDoesNotExist {
@@ -512,6 +607,21 @@ func (am *ACMEIssuer) doIssue(ctx context.Context, csr *x509.CertificateRequest,
 				}
 				continue
 			}
+			if errors.As(err, &prob) && prob.Type == acme.ProblemTypeUserActionRequired {
+				// usually the CA's terms of service changed and must be agreed to again
+				am.Logger.Error("ACME server requires user action on account",
+					zap.String("account_id", client.account.Location),
+					zap.Strings("account_contact", client.account.Contact),
+					zap.String("instance", prob.Instance),
+					zap.String("detail", prob.Detail))
+				am.config.emit(ctx, "acme_user_action_required", map[string]any{
+					"ca":       client.acmeClient.Directory,
+					"account":  client.account.Location,
+					"contact":  client.account.Contact,
+					"instance": prob.Instance,
+					"detail":   prob.Detail,
+				})
+			}
 			return nil, usingTestCA, fmt.Errorf("%v %w (ca=%s)", nameSet, err, client.acmeClient.Directory)
 		}
 		if len(certChains) == 0 {
@@ -606,6 +716,9 @@ func (am *ACMEIssuer) selectPreferredChain(certChains []acme.Certificate) acme.C
 
 // Revoke implements the Revoker interface. It revokes the given certificate.
 func (am *ACMEIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	if am.config != nil {
+		ctx = am.config.egressContext(ctx, cert.SANs, nil)
+	}
 	client, err := am.newACMEClientWithAccount(ctx, false, false)
 	if err != nil {
 		return err
@@ -663,11 +776,20 @@ const prefixACME = "acme"
 
 type ctxKey string
 
-const ctxKeyARIReplaces = ctxKey("ari_replaces")
+const (
+	ctxKeyARIReplaces     = ctxKey("ari_replaces")
+	ctxKeyCertTemplate    = ctxKey("cert_template")
+	ctxKeyLifetime        = ctxKey("lifetime")
+	ctxKeyOCSPStorageOnly = ctxKey("ocsp_storage_only")
+	ctxKeyReplacedCert    = ctxKey("replaced_cert")
+	ctxKeyStaleLock       = ctxKey("stale_lock")
+	ctxKeyWarnings        = ctxKey("warnings")
+)
 
 // Interface guards
 var (
-	_ PreChecker = (*ACMEIssuer)(nil)
-	_ Issuer     = (*ACMEIssuer)(nil)
-	_ Revoker    = (*ACMEIssuer)(nil)
+	_ PreChecker          = (*ACMEIssuer)(nil)
+	_ Issuer              = (*ACMEIssuer)(nil)
+	_ Revoker             = (*ACMEIssuer)(nil)
+	_ IssuerHealthChecker = (*ACMEIssuer)(nil)
 )
@@ -0,0 +1,268 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// TLSALPNProblem identifies why the tls-alpn-01 challenge
+// cannot be solved, as diagnosed by CheckTLSALPN.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TLSALPNProblem string
+
+// Problems diagnosed by CheckTLSALPN.
+const (
+	// The TLS config does not let certmagic serve challenge
+	// certificates, e.g. because acme-tls/1 is not in its
+	// NextProtos or it does not use certmagic's GetCertificate.
+	TLSALPNMisconfigured TLSALPNProblem = "misconfigured"
+
+	// The server could not be reached.
+	TLSALPNUnreachable TLSALPNProblem = "unreachable"
+
+	// The server refused the acme-tls/1 protocol or failed the
+	// handshake for which it should serve the challenge certificate.
+	TLSALPNRefused TLSALPNProblem = "refused"
+
+	// The handshake succeeded, but acme-tls/1 was not negotiated;
+	// typically, ALPN is stripped by a proxy in front of the server.
+	TLSALPNProtocolStripped TLSALPNProblem = "protocol_stripped"
+
+	// acme-tls/1 was negotiated, but the server did not present
+	// a challenge certificate; typically, a proxy in front of the
+	// server terminates TLS with its own certificate.
+	TLSALPNNotChallengeCert TLSALPNProblem = "not_challenge_certificate"
+
+	// A challenge certificate was presented, but not the one of the
+	// self-test challenge; typically, the address is served by another
+	// process or instance that does not share the challenge.
+	TLSALPNWrongChallenge TLSALPNProblem = "wrong_challenge"
+)
+
+// TLSALPNCheckError is returned by CheckTLSALPN when the
+// tls-alpn-01 challenge would fail.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TLSALPNCheckError struct {
+	// The address that was checked, if it got that far.
+	Addr string
+
+	// What is wrong.
+	Problem TLSALPNProblem
+
+	// A precise description of the problem.
+	Detail string
+
+	// The underlying error, if any.
+	Err error
+}
+
+func (e *TLSALPNCheckError) Error() string {
+	msg := "tls-alpn-01 self-test"
+	if e.Addr != "" {
+		msg += " of " + e.Addr
+	}
+	msg += fmt.Sprintf(" (%s): %s", e.Problem, e.Detail)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *TLSALPNCheckError) Unwrap() error { return e.Err }
+
+// CheckTLSALPN checks whether the tls-alpn-01 challenge can be solved
+// by the TLS server that uses tlsConfig and listens at addr; it is meant
+// to be called at startup, once the server is listening, so that a setup
+// which breaks the challenge is reported precisely, rather than by failed
+// challenges later on. If the challenge would fail, the returned error is
+// a *TLSALPNCheckError.
+//
+// First, tlsConfig is checked for settings that prevent serving challenge
+// certificates; if it is nil, this step is skipped. Then, if addr is not
+// empty, a challenge is made up for a reserved name, and a handshake is
+// performed with addr as a validation server would, to check that its
+// challenge certificate is presented. For this to work, addr must reach
+// this process, through any proxies or load balancers in front of it, as
+// the CA would.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) CheckTLSALPN(ctx context.Context, tlsConfig *tls.Config, addr string) error {
+	if tlsConfig != nil {
+		if err := checkTLSALPNConfig(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if addr == "" {
+		return nil
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+	}
+
+	chal, err := newSelfTestChallenge(acme.ChallengeTypeTLSALPN01)
+	if err != nil {
+		return err
+	}
+	key := challengeKey(chal)
+	activeChallengesMu.Lock()
+	activeChallenges[key] = Challenge{Challenge: chal}
+	activeChallengesMu.Unlock()
+	defer func() {
+		activeChallengesMu.Lock()
+		delete(activeChallenges, key)
+		activeChallengesMu.Unlock()
+	}()
+
+	err = verifyTLSALPNChallenge(ctx, addr, chal)
+	if err != nil {
+		cfg.Logger.Error("tls-alpn-01 challenge would fail", zap.String("addr", addr), zap.Error(err))
+		return err
+	}
+	cfg.Logger.Debug("tls-alpn-01 self-test succeeded", zap.String("addr", addr))
+	return nil
+}
+
+// checkTLSALPNConfig returns an error if tlsConfig cannot serve
+// tls-alpn-01 challenge certificates.
+func checkTLSALPNConfig(tlsConfig *tls.Config) error {
+	misconfigured := func(detail string) error {
+		return &TLSALPNCheckError{Problem: TLSALPNMisconfigured, Detail: detail}
+	}
+	if tlsConfig.GetConfigForClient != nil {
+		// the config used for handshakes is not known in advance;
+		// only the self-test handshake can tell
+		return nil
+	}
+	if tlsConfig.GetCertificate == nil {
+		return misconfigured("GetCertificate is not set, so challenge certificates cannot be served")
+	}
+	if !slices.Contains(tlsConfig.NextProtos, acmez.ACMETLS1Protocol) {
+		return misconfigured(fmt.Sprintf("NextProtos %q does not contain %q, so the protocol will be refused",
+			tlsConfig.NextProtos, acmez.ACMETLS1Protocol))
+	}
+	return nil
+}
+
+// newSelfTestChallenge returns a challenge of the given type for a
+// random name under the reserved .invalid TLD (RFC 2606), so that it
+// cannot interfere with real challenges.
+func newSelfTestChallenge(chalType string) (acme.Challenge, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return acme.Challenge{}, err
+	}
+	token := hex.EncodeToString(random)
+	return acme.Challenge{
+		Type:             chalType,
+		Identifier:       acme.Identifier{Type: "dns", Value: strings.TrimSuffix(chalType, "-01") + "-self-test-" + token[:8] + ".invalid"},
+		Token:            token,
+		KeyAuthorization: token + ".self-test",
+	}, nil
+}
+
+// verifyTLSALPNChallenge performs the tls-alpn-01 validation of chal
+// against addr (RFC 8737 §3), and diagnoses where it fails.
+func verifyTLSALPNChallenge(ctx context.Context, addr string, chal acme.Challenge) error {
+	fail := func(problem TLSALPNProblem, detail string, err error) error {
+		return &TLSALPNCheckError{Addr: addr, Problem: problem, Detail: detail, Err: err}
+	}
+
+	dialer := &tls.Dialer{
+		Config: &tls.Config{
+			ServerName: chal.Identifier.Value,
+			NextProtos: []string{acmez.ACMETLS1Protocol},
+			// the challenge certificate is self-signed
+			InsecureSkipVerify: true, //nolint:gosec
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if isConnectError(err) {
+			return fail(TLSALPNUnreachable, "could not connect", err)
+		}
+		if strings.Contains(err.Error(), "no application protocol") {
+			return fail(TLSALPNRefused, fmt.Sprintf("the server does not support %q; add it to the NextProtos of its TLS config",
+				acmez.ACMETLS1Protocol), err)
+		}
+		return fail(TLSALPNRefused, "the handshake failed; the server may not use certmagic's GetCertificate, "+
+			"or a proxy in front of it may not pass TLS through", err)
+	}
+	defer conn.Close()
+
+	state := conn.(*tls.Conn).ConnectionState()
+	if state.NegotiatedProtocol != acmez.ACMETLS1Protocol {
+		return fail(TLSALPNProtocolStripped, fmt.Sprintf("the server negotiated protocol %q instead of %q; the protocol "+
+			"may be stripped by a proxy or load balancer in front of the server, or the server's TLS config does not "+
+			"offer it", state.NegotiatedProtocol, acmez.ACMETLS1Protocol), nil)
+	}
+	if len(state.PeerCertificates) == 0 {
+		return fail(TLSALPNNotChallengeCert, "the server presented no certificate", nil)
+	}
+	leaf := state.PeerCertificates[0]
+	ext, ok := acmeIdentifierExtension(leaf)
+	if !ok {
+		return fail(TLSALPNNotChallengeCert, fmt.Sprintf("the server presented a certificate for %v without the acmeIdentifier "+
+			"extension; a proxy in front of the server may terminate TLS instead of passing it through", leaf.DNSNames), nil)
+	}
+	var digest []byte
+	if _, err := asn1.Unmarshal(ext, &digest); err != nil {
+		return fail(TLSALPNWrongChallenge, "the acmeIdentifier extension of the certificate is malformed", err)
+	}
+	want := sha256.Sum256([]byte(chal.KeyAuthorization))
+	if !slices.Equal(digest, want[:]) || !slices.Contains(leaf.DNSNames, chal.Identifier.Value) {
+		return fail(TLSALPNWrongChallenge, "the server presented the challenge certificate of another challenge; the "+
+			"address may be served by another process or instance which does not share challenges with this one", nil)
+	}
+	return nil
+}
+
+// acmeIdentifierExtension returns the value of the acmeIdentifier
+// extension of cert, if it has one.
+func acmeIdentifierExtension(cert *x509.Certificate) ([]byte, bool) {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(idPEACMEIdentifierV1) {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+// isConnectError returns true if err occurred while
+// establishing the TCP connection, before the handshake.
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// serveTLS serves TLS handshakes with tlsConfig on a local
+// address until the test ends, and returns the address.
+func serveTLS(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestCheckTLSALPNConfig(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	ctx := context.Background()
+
+	if err := cfg.CheckTLSALPN(ctx, cfg.TLSConfig(), ""); err != nil {
+		t.Errorf("expected certmagic's TLS config to pass, got %v", err)
+	}
+
+	noALPN := cfg.TLSConfig()
+	noALPN.NextProtos = []string{"h2", "http/1.1"}
+	noGetCert := cfg.TLSConfig()
+	noGetCert.GetCertificate = nil
+	for i, tlsConfig := range []*tls.Config{noALPN, noGetCert} {
+		var checkErr *TLSALPNCheckError
+		if err := cfg.CheckTLSALPN(ctx, tlsConfig, ""); !errors.As(err, &checkErr) || checkErr.Problem != TLSALPNMisconfigured {
+			t.Errorf("test %d: expected %s problem, got %v", i, TLSALPNMisconfigured, err)
+		}
+	}
+}
+
+func TestCheckTLSALPNSelfTest(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	ctx := context.Background()
+
+	if err := cfg.CheckTLSALPN(ctx, nil, serveTLS(t, cfg.TLSConfig())); err != nil {
+		t.Errorf("expected self-test to succeed, got %v", err)
+	}
+	activeChallengesMu.Lock()
+	remaining := len(activeChallenges)
+	activeChallengesMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("expected self-test challenge to be removed, got %d active challenges", remaining)
+	}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	otherChal, err := newSelfTestChallenge(acme.ChallengeTypeTLSALPN01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherChalCert, err := tlsALPNChallengeCert(otherChal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	regular, _ := issueFakeCertificate(t, new(FakeIssuer), "example.com")
+
+	refusing := cfg.TLSConfig()
+	refusing.NextProtos = []string{"h2"}
+	stripping := cfg.TLSConfig()
+	stripping.NextProtos = nil
+	terminating := &tls.Config{
+		Certificates: []tls.Certificate{regular.Certificate},
+		NextProtos:   []string{acmez.ACMETLS1Protocol},
+	}
+	impostor := &tls.Config{
+		Certificates: []tls.Certificate{*otherChalCert},
+		NextProtos:   []string{acmez.ACMETLS1Protocol},
+	}
+
+	for i, test := range []struct {
+		addr   string
+		expect TLSALPNProblem
+	}{
+		{closed.Addr().String(), TLSALPNUnreachable},
+		{serveTLS(t, refusing), TLSALPNRefused},
+		{serveTLS(t, stripping), TLSALPNProtocolStripped},
+		{serveTLS(t, terminating), TLSALPNNotChallengeCert},
+		{serveTLS(t, impostor), TLSALPNWrongChallenge},
+	} {
+		var checkErr *TLSALPNCheckError
+		err := cfg.CheckTLSALPN(ctx, nil, test.addr)
+		if !errors.As(err, &checkErr) || checkErr.Problem != test.expect {
+			t.Errorf("test %d: expected %s problem, got %v", i, test.expect, err)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package certmagic
 
 import (
+	"container/heap"
 	"context"
 	"errors"
-	"log"
-	"runtime"
+	"math"
 	"sync"
 	"time"
 
@@ -13,18 +13,67 @@ import (
 
 var jm = &jobManager{maxConcurrentJobs: 1000}
 
+// SetMaxConcurrentJobs sets the maximum number of certificate
+// jobs (obtains and renewals) that may run at the same time
+// across all configs in this process. Jobs beyond this limit
+// wait in a queue, where the background jobs for the
+// certificates that expire soonest run first. Jobs that a
+// client is waiting on (e.g. on-demand issuance during a
+// handshake) are not subject to this limit; they run right
+// away, so that clients do not wait behind background work.
+// Values less than 1 are ignored. Default: 1000.
+func SetMaxConcurrentJobs(n int) {
+	if n < 1 {
+		return
+	}
+	jm.mu.Lock()
+	jm.maxConcurrentJobs = n
+	jm.mu.Unlock()
+}
+
+// SetMaxQueuedJobs sets the maximum number of background
+// certificate jobs that may wait in the queue for a free
+// worker; further background jobs are dropped (and logged)
+// until the queue drains, and are submitted again by a later
+// maintenance pass. Jobs that a client is waiting on are never
+// dropped. Values less than 1 remove the limit. Default: no
+// limit.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func SetMaxQueuedJobs(n int) {
+	jm.mu.Lock()
+	jm.maxQueuedJobs = max(n, 0)
+	jm.mu.Unlock()
+}
+
 type jobManager struct {
 	mu                sync.Mutex
 	maxConcurrentJobs int
+	maxQueuedJobs     int
 	activeWorkers     int
-	queue             []namedJob
+	queue             jobQueue
 	names             map[string]struct{}
+	seq               uint64
 }
 
 type namedJob struct {
-	name   string
-	job    func() error
-	logger *zap.Logger
+	name     string
+	job      func() error
+	logger   *zap.Logger
+	priority jobPriority
+	seq      uint64 // preserves submission order among equal priorities
+}
+
+// jobPriority determines the order in which queued jobs are run.
+type jobPriority struct {
+	// interactive jobs have a client waiting on them,
+	// so they run right away instead of being queued
+	interactive bool
+
+	// the time at which the job's certificate expires;
+	// jobs with earlier deadlines are run first, and
+	// the zero value sorts after all known deadlines
+	deadline time.Time
 }
 
 // Submit enqueues the given job with the given name. If name is non-empty
@@ -32,45 +81,91 @@ type namedJob struct {
 // no-op. If name is empty, no duplicate prevention will occur. The job
 // manager will then run this job as soon as it is able.
 func (jm *jobManager) Submit(logger *zap.Logger, name string, job func() error) {
+	jm.SubmitPriority(logger, name, jobPriority{}, job)
+}
+
+// SubmitPriority is like Submit, but orders the job in the queue according
+// to priority. It returns false if the job was not enqueued, because a job
+// with the same name is already enqueued or running, or because the queue
+// is full.
+func (jm *jobManager) SubmitPriority(logger *zap.Logger, name string, priority jobPriority, job func() error) bool {
 	jm.mu.Lock()
 	defer jm.mu.Unlock()
 	if jm.names == nil {
 		jm.names = make(map[string]struct{})
 	}
+	if !priority.interactive && jm.maxQueuedJobs > 0 && len(jm.queue) >= jm.maxQueuedJobs {
+		if _, ok := jm.names[name]; !ok || name == "" {
+			logger.Warn("job queue is full; dropping background job",
+				zap.String("name", name),
+				zap.Int("queued", len(jm.queue)))
+		}
+		return false
+	}
 	if name != "" {
 		// prevent duplicate jobs
 		if _, ok := jm.names[name]; ok {
-			return
+			return false
 		}
 		jm.names[name] = struct{}{}
 	}
-	jm.queue = append(jm.queue, namedJob{name, job, logger})
+	if priority.interactive {
+		go jm.runInteractive(logger, name, job)
+		return true
+	}
+	jm.seq++
+	heap.Push(&jm.queue, namedJob{name, job, logger, priority, jm.seq})
 	if jm.activeWorkers < jm.maxConcurrentJobs {
 		jm.activeWorkers++
 		go jm.worker()
 	}
+	return true
 }
 
-func (jm *jobManager) worker() {
-	defer func() {
-		if err := recover(); err != nil {
-			buf := make([]byte, stackTraceBufferSize)
-			buf = buf[:runtime.Stack(buf, false)]
-			log.Printf("panic: certificate worker: %v\n%s", err, buf)
-		}
-	}()
+// runInteractive runs the interactive job with the given name outside
+// the limit of concurrent jobs, since a client is waiting on it.
+func (jm *jobManager) runInteractive(logger *zap.Logger, name string, job func() error) {
+	if err := runJob(logger, job); err != nil {
+		logger.Error("job failed", zap.Error(err))
+	}
+	if name != "" {
+		jm.mu.Lock()
+		delete(jm.names, name)
+		jm.mu.Unlock()
+	}
+}
+
+// Run submits job as an interactive job, which runs right away even if
+// all workers are busy, and waits for it to finish, returning its
+// error. If ctx is done first, Run returns the context error; since the
+// job's own context is typically derived from ctx, it should return
+// quickly once it starts.
+func (jm *jobManager) Run(ctx context.Context, logger *zap.Logger, job func() error) error {
+	done := make(chan error, 1)
+	jm.SubmitPriority(logger, "", jobPriority{interactive: true}, func() error {
+		err := runJob(logger, job)
+		done <- err
+		return err
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+func (jm *jobManager) worker() {
 	for {
 		jm.mu.Lock()
-		if len(jm.queue) == 0 {
+		if len(jm.queue) == 0 || jm.activeWorkers > jm.maxConcurrentJobs {
 			jm.activeWorkers--
 			jm.mu.Unlock()
 			return
 		}
-		next := jm.queue[0]
-		jm.queue = jm.queue[1:]
+		next := heap.Pop(&jm.queue).(namedJob)
 		jm.mu.Unlock()
-		if err := next.job(); err != nil {
+		if err := runJob(next.logger, next.job); err != nil {
 			next.logger.Error("job failed", zap.Error(err))
 		}
 		if next.name != "" {
@@ -81,57 +176,118 @@ func (jm *jobManager) worker() {
 	}
 }
 
-func doWithRetry(ctx context.Context, log *zap.Logger, f func(context.Context) error) error {
+// runJob runs job, recovering a panic as an error, so that a
+// panicking job neither stops its worker (which would leave the
+// job's name reserved and the worker count off) nor the process.
+func runJob(logger *zap.Logger, job func() error) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = reportPanic(context.Background(), logger, nil, "job", recovered)
+		}
+	}()
+	return job()
+}
+
+// jobQueue is a priority queue of jobs; it implements heap.Interface.
+type jobQueue []namedJob
+
+func (q jobQueue) Len() int      { return len(q) }
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q jobQueue) Less(i, j int) bool {
+	a, b := q[i].priority, q[j].priority
+	if a.interactive != b.interactive {
+		return a.interactive
+	}
+	if !a.deadline.Equal(b.deadline) {
+		if a.deadline.IsZero() || b.deadline.IsZero() {
+			return b.deadline.IsZero()
+		}
+		return a.deadline.Before(b.deadline)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q *jobQueue) Push(x any) { *q = append(*q, x.(namedJob)) }
+func (q *jobQueue) Pop() any {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = namedJob{} // allow the job's closure to be garbage collected
+	*q = old[:n-1]
+	return item
+}
+
+func doWithRetry(ctx context.Context, log *zap.Logger, policy RetryPolicy, f func(context.Context) error) error {
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+
 	var attempts int
 	ctx = context.WithValue(ctx, AttemptsCtxKey, &attempts)
 
-	// the initial intervalIndex is -1, signaling
-	// that we should not wait for the first attempt
-	start, intervalIndex := time.Now(), -1
-	var err error
+	// no need to wait before the first attempt
+	start := time.Now()
+	var wait time.Duration
 
-	for time.Since(start) < maxRetryDuration {
-		var wait time.Duration
-		if intervalIndex >= 0 {
-			wait = retryIntervals[intervalIndex]
+	// if this is a persisted job, resume its retry schedule
+	pj, _ := ctx.Value(persistentJobCtxKey{}).(*persistentJob)
+	if pj != nil {
+		var next, created time.Time
+		attempts, next, created = pj.resumePoint()
+		if attempts > 0 {
+			start = created
+			if _, retry := policy.RetryIn(attempts, time.Since(start)); !retry {
+				return nil
+			}
+			wait = max(time.Until(next), 0)
 		}
+	}
+
+	for {
 		timer := time.NewTimer(wait)
 		select {
 		case <-ctx.Done():
 			timer.Stop()
 			return context.Canceled
 		case <-timer.C:
-			err = f(ctx)
-			attempts++
-			if err == nil || errors.Is(err, context.Canceled) {
-				return err
-			}
-			var errNoRetry ErrNoRetry
-			if errors.As(err, &errNoRetry) {
-				return err
+		}
+
+		err := f(ctx)
+		attempts++
+		if err == nil || errors.Is(err, context.Canceled) {
+			if pj != nil && err == nil {
+				pj.recordAttempt(ctx, attempts, nil, 0)
 			}
-			if intervalIndex < len(retryIntervals)-1 {
-				intervalIndex++
+			return err
+		}
+		var errNoRetry ErrNoRetry
+		if errors.As(err, &errNoRetry) {
+			if pj != nil {
+				pj.recordAttempt(ctx, attempts, err, 0)
 			}
-			if time.Since(start) < maxRetryDuration {
-				log.Error("will retry",
-					zap.Error(err),
-					zap.Int("attempt", attempts),
-					zap.Duration("retrying_in", retryIntervals[intervalIndex]),
-					zap.Duration("elapsed", time.Since(start)),
-					zap.Duration("max_duration", maxRetryDuration))
-
-			} else {
-				log.Error("final attempt; giving up",
-					zap.Error(err),
-					zap.Int("attempt", attempts),
-					zap.Duration("elapsed", time.Since(start)),
-					zap.Duration("max_duration", maxRetryDuration))
-				return nil
+			return err
+		}
+
+		retryIn, retry := policy.RetryIn(attempts, time.Since(start))
+		if !retry {
+			if pj != nil {
+				pj.recordAttempt(ctx, attempts, err, 0)
 			}
+			log.Error("final attempt; giving up",
+				zap.Error(err),
+				zap.Int("attempt", attempts),
+				zap.Duration("elapsed", time.Since(start)))
+			return nil
+		}
+		if pj != nil {
+			pj.recordAttempt(ctx, attempts, err, retryIn)
 		}
+		log.Error("will retry",
+			zap.Error(err),
+			zap.Int("attempt", attempts),
+			zap.Duration("retrying_in", retryIn),
+			zap.Duration("elapsed", time.Since(start)))
+		wait = retryIn
 	}
-	return err
 }
 
 // ErrNoRetry is an error type which signals
@@ -193,3 +349,75 @@ var retryIntervals = []time.Duration{
 // maxRetryDuration is the maximum duration to try
 // doing retries using the above intervals.
 const maxRetryDuration = 24 * time.Hour * 30
+
+// RetryPolicy determines when failed background operations, such as
+// obtaining or renewing certificates, are retried.
+type RetryPolicy interface {
+	// RetryIn returns how long to wait before the next attempt,
+	// given the number of attempts made so far (at least 1) and
+	// the time elapsed since the first attempt. It returns false
+	// if no more attempts should be made.
+	RetryIn(attempts int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// RetryIntervals is a RetryPolicy that waits for each interval in turn
+// between attempts. The last interval is repeated until MaxDuration has
+// elapsed since the first attempt (or forever, if MaxDuration is 0).
+type RetryIntervals struct {
+	Intervals   []time.Duration
+	MaxDuration time.Duration
+}
+
+// RetryIn implements RetryPolicy.
+func (ri RetryIntervals) RetryIn(attempts int, elapsed time.Duration) (time.Duration, bool) {
+	if len(ri.Intervals) == 0 || (ri.MaxDuration > 0 && elapsed >= ri.MaxDuration) {
+		return 0, false
+	}
+	return ri.Intervals[min(max(attempts-1, 0), len(ri.Intervals)-1)], true
+}
+
+// ExponentialBackoff is a RetryPolicy that waits Initial after the first
+// failed attempt, and Multiplier times longer after each subsequent one,
+// up to Max per wait. Attempts stop after MaxAttempts, or once MaxDuration
+// has elapsed since the first attempt, whichever comes first (a zero value
+// for either means no limit). There is no jitter, so the schedule is
+// deterministic.
+type ExponentialBackoff struct {
+	Initial     time.Duration
+	Multiplier  float64 // default: 2
+	Max         time.Duration
+	MaxAttempts int
+	MaxDuration time.Duration
+}
+
+// RetryIn implements RetryPolicy.
+func (eb ExponentialBackoff) RetryIn(attempts int, elapsed time.Duration) (time.Duration, bool) {
+	if eb.Initial <= 0 ||
+		(eb.MaxAttempts > 0 && attempts >= eb.MaxAttempts) ||
+		(eb.MaxDuration > 0 && elapsed >= eb.MaxDuration) {
+		return 0, false
+	}
+	multiplier := eb.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	wait := float64(eb.Initial)
+	for i := 1; i < attempts; i++ {
+		wait *= multiplier
+		if eb.Max > 0 && wait >= float64(eb.Max) {
+			return eb.Max, true
+		}
+		if wait >= math.MaxInt64 {
+			return math.MaxInt64, true
+		}
+	}
+	return time.Duration(wait), true
+}
+
+// DefaultRetryPolicy is the retry policy used when a Config does
+// not specify one; it waits according to retryIntervals for up to
+// maxRetryDuration.
+var DefaultRetryPolicy RetryPolicy = RetryIntervals{
+	Intervals:   retryIntervals,
+	MaxDuration: maxRetryDuration,
+}
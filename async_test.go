@@ -0,0 +1,197 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJobManagerPriority(t *testing.T) {
+	manager := &jobManager{maxConcurrentJobs: 1}
+
+	// occupy the only worker until all jobs are queued
+	started, block := make(chan struct{}), make(chan struct{})
+	manager.Submit(defaultTestLogger, "blocker", func() error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var order []string
+	record := func(name string) func() error {
+		return func() error {
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+
+	now := time.Now()
+	manager.Submit(defaultTestLogger, "unknown", record("unknown"))
+	manager.SubmitPriority(defaultTestLogger, "later", jobPriority{deadline: now.Add(48 * time.Hour)}, record("later"))
+	manager.SubmitPriority(defaultTestLogger, "sooner", jobPriority{deadline: now.Add(time.Hour)}, record("sooner"))
+	manager.SubmitPriority(defaultTestLogger, "sooner", jobPriority{deadline: now}, record("duplicate"))
+
+	// interactive jobs do not wait for the busy worker
+	err := manager.Run(context.Background(), defaultTestLogger, record("interactive"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	close(block)
+	for {
+		manager.mu.Lock()
+		idle := manager.activeWorkers == 0
+		manager.mu.Unlock()
+		if idle {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	expected := []string{"interactive", "sooner", "later", "unknown"}
+	if len(order) != len(expected) {
+		t.Fatalf("expected jobs %v, got %v", expected, order)
+	}
+	for i := range expected {
+		if order[i] != expected[i] {
+			t.Errorf("expected jobs %v, got %v", expected, order)
+			break
+		}
+	}
+}
+
+func TestJobManagerMaxQueuedJobs(t *testing.T) {
+	manager := &jobManager{maxConcurrentJobs: 1, maxQueuedJobs: 1}
+
+	started, block := make(chan struct{}), make(chan struct{})
+	manager.Submit(defaultTestLogger, "blocker", func() error {
+		close(started)
+		<-block
+		return nil
+	})
+	<-started
+
+	var mu sync.Mutex
+	var ran []string
+	record := func(name string) func() error {
+		return func() error {
+			mu.Lock()
+			ran = append(ran, name)
+			mu.Unlock()
+			return nil
+		}
+	}
+	manager.Submit(defaultTestLogger, "queued", record("queued"))
+	manager.Submit(defaultTestLogger, "dropped", record("dropped"))
+	if err := manager.Run(context.Background(), defaultTestLogger, record("interactive")); err != nil {
+		t.Fatal(err)
+	}
+
+	manager.mu.Lock()
+	_, reserved := manager.names["dropped"]
+	manager.mu.Unlock()
+	if reserved {
+		t.Error("expected dropped job's name not to be reserved")
+	}
+
+	close(block)
+	for {
+		manager.mu.Lock()
+		idle := manager.activeWorkers == 0
+		manager.mu.Unlock()
+		if idle {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(ran) != 2 || ran[0] != "interactive" || ran[1] != "queued" {
+		t.Errorf("expected interactive and queued jobs to run, got %v", ran)
+	}
+}
+
+func TestRetryIntervals(t *testing.T) {
+	policy := RetryIntervals{
+		Intervals:   []time.Duration{time.Minute, 5 * time.Minute},
+		MaxDuration: time.Hour,
+	}
+	for i, tc := range []struct {
+		attempts int
+		elapsed  time.Duration
+		wait     time.Duration
+		retry    bool
+	}{
+		{attempts: 1, wait: time.Minute, retry: true},
+		{attempts: 2, wait: 5 * time.Minute, retry: true},
+		{attempts: 10, elapsed: 59 * time.Minute, wait: 5 * time.Minute, retry: true},
+		{attempts: 11, elapsed: time.Hour, retry: false},
+	} {
+		wait, retry := policy.RetryIn(tc.attempts, tc.elapsed)
+		if wait != tc.wait || retry != tc.retry {
+			t.Errorf("Test %d: expected (%s, %t), got (%s, %t)", i, tc.wait, tc.retry, wait, retry)
+		}
+	}
+
+	// the default policy keeps its historical schedule
+	if wait, _ := DefaultRetryPolicy.RetryIn(1, 0); wait != time.Minute {
+		t.Errorf("expected default first retry after 1m, got %s", wait)
+	}
+	if wait, _ := DefaultRetryPolicy.RetryIn(1000, 0); wait != 6*time.Hour {
+		t.Errorf("expected default retries to settle at 6h, got %s", wait)
+	}
+	if _, retry := DefaultRetryPolicy.RetryIn(1000, maxRetryDuration); retry {
+		t.Error("expected default policy to give up after max duration")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	policy := ExponentialBackoff{
+		Initial:     time.Second,
+		Max:         10 * time.Second,
+		MaxAttempts: 6,
+	}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second}
+	for i, expect := range expected {
+		wait, retry := policy.RetryIn(i+1, 0)
+		if wait != expect || !retry {
+			t.Errorf("attempt %d: expected (%s, true), got (%s, %t)", i+1, expect, wait, retry)
+		}
+	}
+	if _, retry := policy.RetryIn(6, 0); retry {
+		t.Error("expected no retry after max attempts")
+	}
+}
+
+func TestDoWithRetryPolicy(t *testing.T) {
+	var calls int
+	policy := ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3}
+	err := doWithRetry(context.Background(), defaultTestLogger, policy, func(context.Context) error {
+		calls++
+		return errors.New("failing on purpose")
+	})
+	if err != nil {
+		t.Errorf("expected nil error after giving up, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", calls)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AzureKeyVault is the part of the Azure Key Vault API needed for keys
+// that never leave the vault and for syncing certificates into it. It
+// is typically implemented with the azkeys and azcertificates clients
+// of the Azure SDK, which certmagic does not depend on.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AzureKeyVault interface {
+	// CreateKey creates a new key of the given type with the given
+	// name, and returns its key ID (the URL of its version) and
+	// public key. Ed25519 and ML-DSA keys are not supported by
+	// Key Vault.
+	CreateKey(ctx context.Context, name string, keyType KeyType) (keyID string, public crypto.PublicKey, err error)
+
+	// PublicKey returns the public key of the key with the given ID.
+	PublicKey(ctx context.Context, keyID string) (crypto.PublicKey, error)
+
+	// Sign signs digest with the key with the given ID, using the
+	// JWS algorithm, such as "ES256" or "PS256", and returns the
+	// signature as returned by Key Vault; for ECDSA, it is the
+	// concatenation of R and S.
+	Sign(ctx context.Context, keyID, algorithm string, digest []byte) ([]byte, error)
+
+	// ImportCertificate imports the PEM-encoded certificate chain
+	// and private key as a new version of the certificate with the
+	// given name.
+	ImportCertificate(ctx context.Context, name string, pemBundle []byte) error
+}
+
+// AzureKeyVaultKeyPEMType is the PEM block type of keys held by Azure
+// Key Vault; the block contains the key ID.
+const AzureKeyVaultKeyPEMType = "AZURE KEY VAULT KEY"
+
+// AzureKeyVaultKeySource is a KeyGenerator that generates keys inside
+// Azure Key Vault. It can be used as a Config's KeySource, and as an
+// ACMEIssuer's AccountKeySource; like for TPMKeySource, only the IDs of
+// the keys are stored, and the vault must be registered with
+// RegisterAzureKeyVault before they are loaded.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AzureKeyVaultKeySource struct {
+	// The vault in which to generate keys. Required.
+	Vault AzureKeyVault
+
+	// The type of keys to generate. Default: P256.
+	KeyType KeyType
+
+	// The prefix of the names of keys in the vault.
+	// Default: "certmagic".
+	NamePrefix string
+}
+
+// GenerateKey generates a new *AzureKeyVaultKey.
+func (ks AzureKeyVaultKeySource) GenerateKey() (crypto.PrivateKey, error) {
+	keyType := ks.KeyType
+	switch keyType {
+	case "":
+		keyType = P256
+	case ED25519, MLDSA44, MLDSA65, MLDSA87:
+		return nil, fmt.Errorf("key type not supported by Azure Key Vault: %s", keyType)
+	}
+	prefix := ks.NamePrefix
+	if prefix == "" {
+		prefix = "certmagic"
+	}
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	keyID, public, err := ks.Vault.CreateKey(ctx, prefix+"-"+hex.EncodeToString(suffix), keyType)
+	if err != nil {
+		return nil, fmt.Errorf("creating key in Azure Key Vault: %v", err)
+	}
+	return &AzureKeyVaultKey{vault: ks.Vault, id: keyID, public: public}, nil
+}
+
+// RegisterAzureKeyVault registers vault for loading the keys of
+// AzureKeyVaultKeySource from storage. Only one vault can be registered.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func RegisterAzureKeyVault(vault AzureKeyVault) {
+	RegisterPrivateKeyDecoder(AzureKeyVaultKeyPEMType, func(der []byte) (crypto.Signer, error) {
+		return NewAzureKeyVaultKey(vault, string(der))
+	})
+}
+
+// AzureKeyVaultKey is a private key held by Azure Key Vault. It
+// implements crypto.Signer and PEMPrivateKey.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AzureKeyVaultKey struct {
+	vault  AzureKeyVault
+	id     string
+	public crypto.PublicKey
+}
+
+// NewAzureKeyVaultKey returns the key with the given ID in vault.
+func NewAzureKeyVaultKey(vault AzureKeyVault, keyID string) (*AzureKeyVaultKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	public, err := vault.PublicKey(ctx, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("getting public key from Azure Key Vault: %v", err)
+	}
+	return &AzureKeyVaultKey{vault: vault, id: keyID, public: public}, nil
+}
+
+// Public implements crypto.Signer.
+func (k *AzureKeyVaultKey) Public() crypto.PublicKey { return k.public }
+
+// ID returns the key ID of the key.
+func (k *AzureKeyVaultKey) ID() string { return k.id }
+
+// Sign implements crypto.Signer. The rand argument is ignored;
+// the vault uses its own random number generator.
+func (k *AzureKeyVaultKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	alg, err := azureSignatureAlgorithm(k.public, opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	sig, err := k.vault.Sign(ctx, k.id, alg, digest)
+	if err != nil {
+		return nil, fmt.Errorf("signing with Azure Key Vault: %v", err)
+	}
+	if _, ok := k.public.(*ecdsa.PublicKey); ok {
+		// crypto.Signer returns ASN.1 signatures
+		half := len(sig) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(sig[:half]),
+			new(big.Int).SetBytes(sig[half:]),
+		})
+	}
+	return sig, nil
+}
+
+// MarshalPEM implements PEMPrivateKey.
+func (k *AzureKeyVaultKey) MarshalPEM() (*pem.Block, error) {
+	return &pem.Block{Type: AzureKeyVaultKeyPEMType, Bytes: []byte(k.id)}, nil
+}
+
+// azureSignatureAlgorithm returns the JWS algorithm for signing
+// with a key with the given public key and options.
+func azureSignatureAlgorithm(public crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	bits := map[crypto.Hash]string{crypto.SHA256: "256", crypto.SHA384: "384", crypto.SHA512: "512"}[opts.HashFunc()]
+	if bits == "" {
+		return "", fmt.Errorf("hash function not supported by Azure Key Vault: %v", opts.HashFunc())
+	}
+	switch public.(type) {
+	case *ecdsa.PublicKey:
+		return "ES" + bits, nil
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return "PS" + bits, nil
+		}
+		return "RS" + bits, nil
+	}
+	return "", fmt.Errorf("key type not supported by Azure Key Vault: %T", public)
+}
+
+// AzureKeyVaultCertSync imports managed certificates into Azure Key
+// Vault as they are obtained and renewed, so that Azure services such as
+// Application Gateway and App Service can use them. To use it, call
+// HandleEvent from Config.OnEvent.
+//
+// Key Vault only imports certificates with their private key, so
+// certificates whose keys are held by Key Vault (see
+// AzureKeyVaultKeySource) are not synced.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AzureKeyVaultCertSync struct {
+	// The storage from which to load certificates
+	// and keys when handling events. Required.
+	Storage Storage
+
+	// The vault to import certificates into. Required.
+	Vault AzureKeyVault
+
+	// Optionally returns the name of the certificate in
+	// the vault for a managed name. Default: "certmagic-"
+	// followed by the name, with dots replaced by hyphens
+	// and a wildcard label replaced by "wildcard".
+	CertName func(name string) string
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+}
+
+// HandleEvent imports the certificate of each "cert_obtained" event
+// into the vault; other events are ignored. It can be called from
+// Config.OnEvent.
+func (s *AzureKeyVaultCertSync) HandleEvent(ctx context.Context, event string, data map[string]any) error {
+	if event != "cert_obtained" {
+		return nil
+	}
+	name, _ := data["identifier"].(string)
+	certPath, _ := data["certificate_path"].(string)
+	keyPath, _ := data["private_key_path"].(string)
+	if name == "" || certPath == "" || keyPath == "" {
+		return fmt.Errorf("event is missing certificate information")
+	}
+	certPEM, err := s.Storage.Load(ctx, certPath)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+	keyPEM, err := s.Storage.Load(ctx, keyPath)
+	if err != nil {
+		return fmt.Errorf("loading private key: %v", err)
+	}
+	if block, _ := pem.Decode(keyPEM); block != nil && block.Type == AzureKeyVaultKeyPEMType {
+		s.logger().Warn("not syncing certificate with key held by Azure Key Vault",
+			zap.String("identifier", name))
+		return nil
+	}
+	if err := s.Import(ctx, name, certPEM, keyPEM); err != nil {
+		s.logger().Error("unable to import certificate into Azure Key Vault",
+			zap.String("identifier", name),
+			zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Import imports the PEM-encoded certificate chain and private key for
+// name into the vault, as a new version of its certificate.
+func (s *AzureKeyVaultCertSync) Import(ctx context.Context, name string, certPEM, keyPEM []byte) error {
+	key, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("decoding private key: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding private key: %v", err)
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	bundle = append(bundle, certPEM...)
+	certName := s.certName(name)
+	if err := s.Vault.ImportCertificate(ctx, certName, bundle); err != nil {
+		return err
+	}
+	s.logger().Info("imported certificate into Azure Key Vault",
+		zap.String("identifier", name),
+		zap.String("certificate_name", certName))
+	return nil
+}
+
+func (s *AzureKeyVaultCertSync) certName(name string) string {
+	if s.CertName != nil {
+		return s.CertName(name)
+	}
+	name = strings.Replace(name, "*.", "wildcard.", 1)
+	return "certmagic-" + strings.NewReplacer(".", "-", ":", "-", "_", "-").Replace(name)
+}
+
+func (s *AzureKeyVaultCertSync) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
+}
+
+// Interface guards
+var (
+	_ KeyGenerator  = AzureKeyVaultKeySource{}
+	_ PEMPrivateKey = (*AzureKeyVaultKey)(nil)
+)
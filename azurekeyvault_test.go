@@ -0,0 +1,206 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memKeyVault is an AzureKeyVault that keeps its keys in memory.
+type memKeyVault struct {
+	mu       sync.Mutex
+	keys     map[string]crypto.Signer
+	imported map[string][]byte
+}
+
+func (kv *memKeyVault) CreateKey(_ context.Context, name string, keyType KeyType) (string, crypto.PublicKey, error) {
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return "", nil, err
+	}
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.keys == nil {
+		kv.keys = make(map[string]crypto.Signer)
+	}
+	id := "https://vault.example/keys/" + name + "/1"
+	kv.keys[id] = key.(crypto.Signer)
+	return id, kv.keys[id].Public(), nil
+}
+
+func (kv *memKeyVault) key(keyID string) (crypto.Signer, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	key, ok := kv.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("key not found: %s", keyID)
+	}
+	return key, nil
+}
+
+func (kv *memKeyVault) PublicKey(_ context.Context, keyID string) (crypto.PublicKey, error) {
+	key, err := kv.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public(), nil
+}
+
+func (kv *memKeyVault) Sign(_ context.Context, keyID, algorithm string, digest []byte) ([]byte, error) {
+	key, err := kv.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[algorithm[2:]]
+	var opts crypto.SignerOpts = hash
+	if strings.HasPrefix(algorithm, "PS") {
+		opts = &rsa.PSSOptions{Hash: hash, SaltLength: rsa.PSSSaltLengthEqualsHash}
+	}
+	sig, err := key.Sign(rand.Reader, digest, opts)
+	if err != nil || !strings.HasPrefix(algorithm, "ES") {
+		return sig, err
+	}
+	// convert to the JWS format
+	var rs struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &rs); err != nil {
+		return nil, err
+	}
+	size := (key.Public().(*ecdsa.PublicKey).Curve.Params().BitSize + 7) / 8
+	return append(rs.R.FillBytes(make([]byte, size)), rs.S.FillBytes(make([]byte, size))...), nil
+}
+
+func (kv *memKeyVault) ImportCertificate(_ context.Context, name string, pemBundle []byte) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	if kv.imported == nil {
+		kv.imported = make(map[string][]byte)
+	}
+	kv.imported[name] = pemBundle
+	return nil
+}
+
+func TestAzureKeyVaultKey(t *testing.T) {
+	vault := new(memKeyVault)
+	RegisterAzureKeyVault(vault)
+
+	for _, keyType := range []KeyType{P256, P384, RSA2048} {
+		privKey, err := AzureKeyVaultKeySource{Vault: vault, KeyType: keyType}.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := privKey.(*AzureKeyVaultKey)
+		if !strings.HasPrefix(key.ID(), "https://vault.example/keys/certmagic-") {
+			t.Errorf("unexpected key ID %s", key.ID())
+		}
+
+		keyPEM, err := PEMEncodePrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block, _ := pem.Decode(keyPEM); block == nil || block.Type != AzureKeyVaultKeyPEMType {
+			t.Fatalf("expected %s PEM block, got %q", AzureKeyVaultKeyPEMType, keyPEM)
+		}
+		decoded, err := PEMDecodePrivateKey(keyPEM)
+		if err != nil {
+			t.Fatalf("decoding key: %v", err)
+		}
+
+		digest := sha256.Sum256([]byte("hello"))
+		sig, err := decoded.Sign(nil, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch pub := key.Public().(type) {
+		case *ecdsa.PublicKey:
+			if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+				t.Errorf("%s: expected valid ASN.1 signature", keyType)
+			}
+		case *rsa.PublicKey:
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+				t.Errorf("%s: expected valid signature: %v", keyType, err)
+			}
+			pssOpts := &rsa.PSSOptions{Hash: crypto.SHA256, SaltLength: rsa.PSSSaltLengthEqualsHash}
+			sig, err := decoded.Sign(nil, digest[:], pssOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := rsa.VerifyPSS(pub, crypto.SHA256, digest[:], sig, pssOpts); err != nil {
+				t.Errorf("%s: expected valid PSS signature: %v", keyType, err)
+			}
+		}
+	}
+
+	if _, err := (AzureKeyVaultKeySource{Vault: vault, KeyType: ED25519}).GenerateKey(); err == nil {
+		t.Error("expected error for Ed25519 keys")
+	}
+}
+
+func TestAzureKeyVaultCertSync(t *testing.T) {
+	ctx := context.Background()
+	vault := new(memKeyVault)
+	RegisterAzureKeyVault(vault)
+
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	certSync := &AzureKeyVaultCertSync{Storage: cfg.Storage, Vault: vault}
+	if err := cfg.ObtainCertSync(ctx, "*.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	issuerKey := cfg.Issuers[0].IssuerKey()
+	data := map[string]any{
+		"identifier":       "*.example.com",
+		"certificate_path": StorageKeys.SiteCert(issuerKey, "*.example.com"),
+		"private_key_path": StorageKeys.SitePrivateKey(issuerKey, "*.example.com"),
+	}
+	if err := certSync.HandleEvent(ctx, "cert_obtaining", data); err != nil || len(vault.imported) != 0 {
+		t.Errorf("expected other events to be ignored, got %v", err)
+	}
+	if err := certSync.HandleEvent(ctx, "cert_obtained", data); err != nil {
+		t.Fatal(err)
+	}
+	bundle, ok := vault.imported["certmagic-wildcard-example-com"]
+	if !ok {
+		t.Fatalf("expected certificate to be imported, got %v", vault.imported)
+	}
+	if block, rest := pem.Decode(bundle); block == nil || block.Type != "PRIVATE KEY" || !strings.Contains(string(rest), "CERTIFICATE") {
+		t.Error("expected PKCS#8 key followed by certificate chain")
+	}
+
+	// certificates with keys in the vault are not synced
+	cfg.KeySource = AzureKeyVaultKeySource{Vault: vault}
+	data["identifier"] = "vault.example.com"
+	data["certificate_path"] = StorageKeys.SiteCert(issuerKey, "vault.example.com")
+	data["private_key_path"] = StorageKeys.SitePrivateKey(issuerKey, "vault.example.com")
+	if err := cfg.ObtainCertSync(ctx, "vault.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := certSync.HandleEvent(ctx, "cert_obtained", data); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vault.imported["certmagic-vault-example-com"]; ok {
+		t.Error("expected certificate with vault key not to be imported")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RenewalBlackout is a recurring window of time during which managed
+// certificates are not renewed automatically, and renewed certificates
+// are not swapped in, such as a change freeze. Renewals that come due
+// during the window are deferred until it ends, unless the certificate
+// would expire (or have less than MinRemaining validity left) by then.
+// Renewals to replace revoked certificates are never deferred, nor are
+// renewals requested explicitly, such as with Config.RenewCertSync.
+//
+// For example, a change freeze on weekend nights from 22:00 to 06:00:
+//
+//	certmagic.RenewalBlackout{
+//		Schedule: "0 22 * * FRI,SAT",
+//		Duration: 8 * time.Hour,
+//	}
+//
+// EXPERIMENTAL: Subject to change or removal.
+type RenewalBlackout struct {
+	// When the window starts, as a cron expression with
+	// five fields: minute, hour, day of month, month, and
+	// day of week. Fields may be "*", numbers, ranges like
+	// "1-5", lists like "1,15", and steps like "*/15";
+	// months and days of the week may also be given by
+	// their first three letters, like "JAN" or "MON". As
+	// with cron, if both the day of month and the day of
+	// week are restricted, either one may match.
+	Schedule string
+
+	// How long the window lasts from each start.
+	Duration time.Duration
+
+	// The time zone of Schedule. Default: UTC.
+	Location *time.Location
+
+	// How much validity a certificate must have left at
+	// the end of the window for its renewal to be deferred.
+	// Default: DefaultBlackoutMinRemaining.
+	MinRemaining time.Duration
+}
+
+// DefaultBlackoutMinRemaining is how much validity a certificate must
+// have left at the end of a RenewalBlackout for its renewal to be
+// deferred, by default; this leaves time to retry failed renewals.
+const DefaultBlackoutMinRemaining = 72 * time.Hour
+
+// Validate returns an error if the blackout is invalid.
+func (b RenewalBlackout) Validate() error {
+	if b.Duration <= 0 {
+		return fmt.Errorf("blackout duration must be positive")
+	}
+	_, err := parseCronSchedule(b.Schedule)
+	return err
+}
+
+// ActiveAt returns when the blackout window that t falls in ends, or
+// the zero time if t is not in a window. Windows that overlap or follow
+// each other without a gap are merged into one.
+func (b RenewalBlackout) ActiveAt(t time.Time) (time.Time, error) {
+	if b.Duration <= 0 {
+		return time.Time{}, fmt.Errorf("blackout duration must be positive")
+	}
+	sched, err := parseCronSchedule(b.Schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	loc := b.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	var end time.Time
+	for start := sched.next(t.Add(-b.Duration).In(loc)); !start.IsZero() && !start.After(t); start = sched.next(start) {
+		end = start.Add(b.Duration)
+	}
+	if end.IsZero() {
+		return time.Time{}, nil
+	}
+	// windows that start before this one ends extend it; keep this
+	// bounded for schedules like every minute of the year
+	limit := t.Add(maxBlackoutSpan)
+	for start := sched.next(t.In(loc)); !start.IsZero() && !start.After(end) && end.Before(limit); start = sched.next(start) {
+		end = start.Add(b.Duration)
+	}
+	return end, nil
+}
+
+// maxBlackoutSpan is the longest a blackout can suppress renewals at once.
+const maxBlackoutSpan = 366 * 24 * time.Hour
+
+// renewalBlackoutEnd returns when the renewal blackouts that t falls
+// in end, or the zero time if there are none, and the greatest
+// MinRemaining among them. Invalid blackouts are logged and ignored.
+func (cfg *Config) renewalBlackoutEnd(t time.Time) (end time.Time, minRemaining time.Duration) {
+	for _, b := range cfg.RenewalBlackouts {
+		blackoutEnd, err := b.ActiveAt(t)
+		if err != nil {
+			cfg.Logger.Error("invalid renewal blackout; ignoring",
+				zap.String("schedule", b.Schedule),
+				zap.Duration("duration", b.Duration),
+				zap.Error(err))
+			continue
+		}
+		if blackoutEnd.IsZero() {
+			continue
+		}
+		if blackoutEnd.After(end) {
+			end = blackoutEnd
+		}
+		remaining := b.MinRemaining
+		if remaining <= 0 {
+			remaining = DefaultBlackoutMinRemaining
+		}
+		minRemaining = max(minRemaining, remaining)
+	}
+	return end, minRemaining
+}
+
+// renewalDeferredUntil returns until when the automatic renewal (or
+// reloading of a renewed certificate) of cert is deferred because of a
+// renewal blackout, or the zero time if it may happen now.
+func (cfg *Config) renewalDeferredUntil(cert Certificate) time.Time {
+	if len(cfg.RenewalBlackouts) == 0 || cert.Leaf == nil || cert.Revoked() {
+		return time.Time{}
+	}
+	end, minRemaining := cfg.renewalBlackoutEnd(timeNow())
+	if end.IsZero() {
+		return time.Time{}
+	}
+	// the certificate would have too little validity left by the end
+	// of the blackout, so it has to be renewed anyway
+	if !expiresAt(cert.Leaf).Add(-minRemaining).After(end) {
+		return time.Time{}
+	}
+	return end
+}
+
+// cronSchedule is a parsed cron expression; each field
+// is a bit set of the values that match.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+// parseCronSchedule parses a cron expression with five fields;
+// see RenewalBlackout.Schedule.
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule %q must have 5 fields, got %d", expr, len(fields))
+	}
+	var sched cronSchedule
+	var err error
+	if sched.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("minute: %v", err)
+	}
+	if sched.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("hour: %v", err)
+	}
+	if sched.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("day of month: %v", err)
+	}
+	if sched.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("month: %v", err)
+	}
+	if sched.dow, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("day of week: %v", err)
+	}
+	if sched.dow&(1<<7) != 0 {
+		sched.dow |= 1 // 7 is also Sunday
+	}
+	sched.domStar = strings.HasPrefix(fields[2], "*")
+	sched.dowStar = strings.HasPrefix(fields[4], "*")
+	return &sched, nil
+}
+
+var (
+	cronMonths   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCronField parses one field of a cron expression into a bit set
+// of the values between lo and hi that it matches.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if name != "" && strings.EqualFold(s, name) {
+				return i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid value %q", s)
+		}
+		if n < lo || n > hi {
+			return 0, fmt.Errorf("value %d out of range %d-%d", n, lo, hi)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = value(first); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = hi
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// matchesDay returns whether the schedule matches the day of t.
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<t.Day()) != 0
+	dow := s.dow&(1<<t.Weekday()) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first time after t that matches the schedule, in
+// the location of t, or the zero time if there is none within 5 years.
+func (s *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<t.Month()) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case s.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case s.minute&(1<<t.Minute()) == 0:
+			t = t.Truncate(time.Minute).Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
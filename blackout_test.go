@@ -0,0 +1,202 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	for _, expr := range []string{
+		"* * * * *",
+		"0 22 * * FRI,SAT",
+		"*/15 0-6 1,15 jan-mar 1-5",
+		"30 2 * DEC 7",
+		"5/10 * * * *",
+	} {
+		if _, err := parseCronSchedule(expr); err != nil {
+			t.Errorf("expected %q to be valid, got: %v", expr, err)
+		}
+	}
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"* * * FOO *",
+	} {
+		if _, err := parseCronSchedule(expr); err == nil {
+			t.Errorf("expected %q to be invalid", expr)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	date := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.March, day, hour, minute, 0, 0, time.UTC) // March 1, 2024 is a Friday
+	}
+	for i, tc := range []struct {
+		expr   string
+		after  time.Time
+		expect time.Time
+	}{
+		{expr: "* * * * *", after: date(1, 10, 0).Add(30 * time.Second), expect: date(1, 10, 1)},
+		{expr: "0 22 * * FRI,SAT", after: date(1, 22, 0), expect: date(2, 22, 0)},
+		{expr: "0 22 * * 0", after: date(1, 0, 0), expect: date(3, 22, 0)},
+		{expr: "0 22 * * 7", after: date(1, 0, 0), expect: date(3, 22, 0)},
+		{expr: "*/20 9 * * *", after: date(1, 9, 41), expect: date(2, 9, 0)},
+		// either the day of month or the day of week may match
+		{expr: "0 0 10 * MON", after: date(1, 0, 0), expect: date(4, 0, 0)},
+		{expr: "0 0 1 1 *", after: date(1, 0, 0), expect: time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		sched, err := parseCronSchedule(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sched.next(tc.after); !got.Equal(tc.expect) {
+			t.Errorf("test %d (%s): expected %s, got %s", i, tc.expr, tc.expect, got)
+		}
+	}
+	if sched, _ := parseCronSchedule("0 0 30 2 *"); !sched.next(time.Now()).IsZero() {
+		t.Error("expected schedule for February 30 never to match")
+	}
+}
+
+func TestRenewalBlackoutActiveAt(t *testing.T) {
+	date := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.March, day, hour, minute, 0, 0, time.UTC) // March 1, 2024 is a Friday
+	}
+	weekendNights := RenewalBlackout{Schedule: "0 22 * * FRI,SAT", Duration: 8 * time.Hour}
+	everyNight := RenewalBlackout{Schedule: "* 22-23 * * *", Duration: time.Minute}
+	for i, tc := range []struct {
+		blackout RenewalBlackout
+		at       time.Time
+		expect   time.Time
+	}{
+		{blackout: weekendNights, at: date(1, 21, 59), expect: time.Time{}},
+		{blackout: weekendNights, at: date(1, 22, 0), expect: date(2, 6, 0)},
+		{blackout: weekendNights, at: date(2, 5, 59), expect: date(2, 6, 0)},
+		{blackout: weekendNights, at: date(2, 6, 0), expect: time.Time{}},
+		{blackout: weekendNights, at: date(3, 1, 0), expect: date(3, 6, 0)},
+		{blackout: weekendNights, at: date(4, 1, 0), expect: time.Time{}},
+		// windows that follow each other are merged
+		{blackout: everyNight, at: date(1, 22, 30), expect: date(2, 0, 0)},
+		{blackout: everyNight, at: date(2, 0, 0), expect: time.Time{}},
+		// in another time zone
+		{
+			blackout: RenewalBlackout{Schedule: "0 22 * * *", Duration: time.Hour, Location: time.FixedZone("UTC-5", -5*3600)},
+			at:       date(2, 3, 30),
+			expect:   date(2, 4, 0),
+		},
+	} {
+		end, err := tc.blackout.ActiveAt(tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !end.Equal(tc.expect) {
+			t.Errorf("test %d: expected blackout at %s to end at %s, got %s", i, tc.at, tc.expect, end)
+		}
+	}
+
+	if err := (RenewalBlackout{Schedule: "0 22 * * *"}).Validate(); err == nil {
+		t.Error("expected blackout without duration to be invalid")
+	}
+	if _, err := (RenewalBlackout{Schedule: "bogus", Duration: time.Hour}).ActiveAt(date(1, 0, 0)); err == nil {
+		t.Error("expected error for invalid schedule")
+	}
+}
+
+// activeBlackout returns a blackout that started a minute
+// ago and lasts for about two hours from now.
+func activeBlackout() RenewalBlackout {
+	start := time.Now().UTC().Add(-time.Minute)
+	return RenewalBlackout{
+		Schedule: fmt.Sprintf("%d %d * * *", start.Minute(), start.Hour()),
+		Duration: 2 * time.Hour,
+	}
+}
+
+func TestRenewalBlackoutDefersRenewals(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.RenewalWindowRatio = 1 // always due
+	soon, later := testSubject(t, "soon"), testSubject(t, "later")
+	cfg.CertLifetimeFunc = func(_ context.Context, name string) time.Duration {
+		if name == soon {
+			return 2 * 24 * time.Hour
+		}
+		return 20 * 24 * time.Hour
+	}
+	for _, name := range []string{soon, later} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg.RenewalBlackouts = []RenewalBlackout{activeBlackout()}
+
+	// renewals are deferred when managing too, unless they are urgent
+	if err := cfg.ManageSync(ctx, []string{soon, later}); err != nil {
+		t.Fatal(err)
+	}
+	issued := fi.Issued()
+	if len(issued) != 3 || issued[2].DNSNames[0] != soon {
+		t.Fatalf("expected only %s to be renewed, got %d issuances", soon, len(issued))
+	}
+
+	// maintenance defers the renewal until the blackout ends
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := issuancesFor(fi, later); n != 1 {
+		t.Errorf("expected no renewal of %s during blackout, got %d issuances", later, n)
+	}
+	laterCert := cfg.certCache.getAllMatchingCerts(later)[0]
+	end, _ := cfg.RenewalBlackouts[0].ActiveAt(time.Now())
+	cfg.certCache.mu.RLock()
+	scheduled := cfg.certCache.reviews.scheduled[laterCert.hash]
+	expected := cfg.certCache.reviews.bucket(end)
+	cfg.certCache.mu.RUnlock()
+	if scheduled != expected {
+		t.Errorf("expected deferred certificate to be examined when the blackout ends")
+	}
+
+	// and renews it once the blackout is over
+	cfg.RenewalBlackouts = nil
+	if err := cfg.certCache.queueRenewalTask(ctx, laterCert, cfg); err != nil {
+		t.Fatal(err)
+	}
+	waitForRenewal(t, cfg, fi, later, 2)
+}
+
+func issuancesFor(fi *FakeIssuer, name string) int {
+	var n int
+	for _, leaf := range fi.Issued() {
+		if leaf.DNSNames[0] == name {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// BulkManageOptions configures a call to ManageBulk.
+type BulkManageOptions struct {
+	// The maximum number of names to process at once.
+	// Default: DefaultBulkManageConcurrency.
+	Concurrency int
+
+	// If true, ACME operations are performed in the
+	// background as with ManageAsync; a successful result
+	// then only means that management was started. If
+	// false, certificates are obtained or renewed before
+	// their result is reported, as with ManageSync.
+	Async bool
+
+	// If set, Progress is called after each name has been
+	// processed. Calls are serialized, so the callback
+	// need not be safe for concurrent use, but it should
+	// return quickly since it blocks other reports.
+	Progress func(BulkManageProgress)
+}
+
+// BulkManageProgress describes the progress of a
+// ManageBulk call after a single name was processed.
+type BulkManageProgress struct {
+	// The result for the name that was just processed.
+	BulkManageNameResult
+
+	// How many names have been processed so far,
+	// including this one, out of Total.
+	Completed int
+	Total     int
+}
+
+// BulkManageNameResult is the outcome of managing a single name.
+type BulkManageNameResult struct {
+	// The name as it was given to ManageBulk.
+	Name string
+
+	// The error, if management failed for this name.
+	Err error
+
+	// How long it took to process the name.
+	Duration time.Duration
+}
+
+// BulkManageResult is the structured result of a ManageBulk call.
+type BulkManageResult struct {
+	// One entry per input name, in the same order as the input.
+	Results []BulkManageNameResult
+}
+
+// Succeeded returns the names that were managed successfully.
+func (r BulkManageResult) Succeeded() []string {
+	var names []string
+	for _, res := range r.Results {
+		if res.Err == nil {
+			names = append(names, res.Name)
+		}
+	}
+	return names
+}
+
+// Failed returns the results of the names that could not be managed.
+func (r BulkManageResult) Failed() []BulkManageNameResult {
+	var failed []BulkManageNameResult
+	for _, res := range r.Results {
+		if res.Err != nil {
+			failed = append(failed, res)
+		}
+	}
+	return failed
+}
+
+// ManageBulk is like ManageSync or ManageAsync (depending on opts.Async),
+// but it is designed for managing large numbers of names at once. Instead
+// of returning on the first error, every name is processed using up to
+// opts.Concurrency workers, and the outcome for each name is recorded in
+// the returned result. If opts.Progress is set, it is called as each name
+// finishes so that callers can report progress.
+//
+// A failure for one name does not affect the others. The returned error
+// is only non-nil if ctx is canceled before all names were processed; in
+// that case, the unprocessed names have the context error as their result.
+func (cfg *Config) ManageBulk(ctx context.Context, domainNames []string, opts BulkManageOptions) (BulkManageResult, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	result := BulkManageResult{Results: make([]BulkManageNameResult, len(domainNames))}
+	for i, name := range domainNames {
+		result.Results[i].Name = name
+	}
+
+	// on-demand management only requires updating the allowlist, which
+	// is not safe for concurrent use, so there is nothing to parallelize
+	if cfg.OnDemand != nil {
+		for i, name := range domainNames {
+			if err := ctx.Err(); err != nil {
+				for j := i; j < len(domainNames); j++ {
+					result.Results[j].Err = err
+				}
+				return result, err
+			}
+			start := time.Now()
+			err := cfg.manageAll(ctx, []string{name}, opts.Async)
+			result.Results[i].Err = err
+			result.Results[i].Duration = time.Since(start)
+			opts.report(result.Results[i], i+1, len(domainNames))
+		}
+		return result, nil
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultBulkManageConcurrency
+	}
+
+	logger := cfg.Logger.Named("bulk_manage")
+	logger.Info("managing certificates in bulk",
+		zap.Int("count", len(domainNames)),
+		zap.Int("concurrency", concurrency),
+		zap.Bool("async", opts.Async))
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		completed int
+	)
+	indexes := make(chan int)
+
+	for w := 0; w < concurrency && w < len(domainNames); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				start := time.Now()
+				err := cfg.manageOne(ctx, normalizedName(domainNames[i]), opts.Async)
+
+				mu.Lock()
+				result.Results[i].Err = err
+				result.Results[i].Duration = time.Since(start)
+				completed++
+				opts.report(result.Results[i], completed, len(domainNames))
+				mu.Unlock()
+
+				if err != nil {
+					logger.Error("unable to manage certificate",
+						zap.String("identifier", domainNames[i]),
+						zap.Error(err))
+				}
+			}
+		}()
+	}
+
+	var sent int
+feed:
+	for sent < len(domainNames) {
+		select {
+		case indexes <- sent:
+			sent++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if sent < len(domainNames) {
+		for i := sent; i < len(domainNames); i++ {
+			result.Results[i].Err = ctx.Err()
+		}
+		return result, ctx.Err()
+	}
+
+	failed := len(result.Failed())
+	logger.Info("finished managing certificates in bulk",
+		zap.Int("succeeded", len(domainNames)-failed),
+		zap.Int("failed", failed))
+
+	return result, nil
+}
+
+func (opts BulkManageOptions) report(res BulkManageNameResult, completed, total int) {
+	if opts.Progress == nil {
+		return
+	}
+	opts.Progress(BulkManageProgress{
+		BulkManageNameResult: res,
+		Completed:            completed,
+		Total:                total,
+	})
+}
+
+// DefaultBulkManageConcurrency is the default number of
+// names that ManageBulk processes concurrently.
+const DefaultBulkManageConcurrency = 10
@@ -0,0 +1,126 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type failingIssuer struct{}
+
+func (failingIssuer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	return nil, fmt.Errorf("failing on purpose")
+}
+
+func (failingIssuer) IssuerKey() string { return "failing" }
+
+func TestManageBulk(t *testing.T) {
+	cfg := &Config{
+		Issuers:   []Issuer{failingIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		Logger:    defaultTestLogger,
+		certCache: &Cache{
+			cache:      make(map[string]Certificate),
+			cacheIndex: make(map[string][]string),
+			logger:     defaultTestLogger,
+		},
+	}
+
+	// a name that is already managed in the cache is a no-op
+	cfg.certCache.cacheCertificate(Certificate{Names: []string{"managed.example.com"}, hash: "abc", managed: true})
+
+	names := []string{"a.example.com", "managed.example.com", "b.example.com", "c.example.com"}
+
+	var progress []BulkManageProgress
+	result, err := cfg.ManageBulk(context.Background(), names, BulkManageOptions{
+		Concurrency: 2,
+		Progress:    func(p BulkManageProgress) { progress = append(progress, p) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(result.Results) != len(names) {
+		t.Fatalf("expected %d results, got %d", len(names), len(result.Results))
+	}
+	for i, res := range result.Results {
+		if res.Name != names[i] {
+			t.Errorf("result %d: expected name %s, got %s", i, names[i], res.Name)
+		}
+	}
+	if succeeded := result.Succeeded(); len(succeeded) != 1 || succeeded[0] != "managed.example.com" {
+		t.Errorf("expected only managed.example.com to succeed, got %v", succeeded)
+	}
+	if failed := result.Failed(); len(failed) != 3 {
+		t.Errorf("expected 3 failures, got %d", len(failed))
+	}
+
+	if len(progress) != len(names) {
+		t.Fatalf("expected %d progress reports, got %d", len(names), len(progress))
+	}
+	for i, p := range progress {
+		if p.Completed != i+1 || p.Total != len(names) {
+			t.Errorf("progress %d: expected %d/%d, got %d/%d", i, i+1, len(names), p.Completed, p.Total)
+		}
+	}
+}
+
+func TestManageBulkCanceled(t *testing.T) {
+	cfg := &Config{
+		Logger:    defaultTestLogger,
+		certCache: new(Cache),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	names := []string{"a.example.com", "b.example.com"}
+	result, err := cfg.ManageBulk(ctx, names, BulkManageOptions{})
+	if err == nil {
+		t.Fatal("expected error from canceled context")
+	}
+	for _, res := range result.Results {
+		if res.Err == nil {
+			t.Errorf("expected error for %s", res.Name)
+		}
+	}
+}
+
+func TestManageBulkOnDemandCanceled(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel after the first name
+	names := []string{"a.example.com", "b.example.com", "c.example.com"}
+	result, err := cfg.ManageBulk(ctx, names, BulkManageOptions{
+		Progress: func(BulkManageProgress) { cancel() },
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context error, got %v", err)
+	}
+	if first := result.Results[0]; first.Err != nil || first.Duration <= 0 {
+		t.Errorf("expected first name to be managed with its duration recorded, got %+v", first)
+	}
+	for _, res := range result.Results[1:] {
+		if !errors.Is(res.Err, context.Canceled) {
+			t.Errorf("expected context error for %s, got %v", res.Name, res.Err)
+		}
+	}
+}
@@ -15,10 +15,11 @@
 package certmagic
 
 import (
+	"context"
 	"fmt"
-	weakrand "math/rand"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -57,7 +58,13 @@ type Cache struct {
 	// cacheIndex is a map of SAN to cache key (cert hash)
 	cacheIndex map[string][]string
 
-	// Protects the cache and cacheIndex maps
+	// wildcardIndex maps the non-wildcard suffix of each
+	// wildcard name in cacheIndex (e.g. "example.com" for
+	// "*.example.com") to those names, so that wildcard
+	// matches can be found without building candidates
+	wildcardIndex map[string][]wildcardName
+
+	// Protects the cache and index maps
 	mu sync.RWMutex
 
 	// Close this channel to cancel asset maintenance
@@ -66,6 +73,55 @@ type Cache struct {
 	// Used to signal when stopping is completed
 	doneChan chan struct{}
 
+	// Consecutive failed permission checks of expired
+	// certificates, by cert hash (see ExpiredCertGC)
+	gcPermissionFailures map[string]int
+	gcMu                 sync.Mutex
+
+	// Whether the maintenance goroutine is running, and when
+	// it last finished a task, in Unix nanoseconds (see Liveness)
+	maintenanceRunning atomic.Bool
+	maintenanceBeat    atomic.Int64
+
+	// When the running renewal pass started, in Unix nanoseconds,
+	// or 0; and whether a pass was skipped because it overran
+	renewalPassStarted atomic.Int64
+	catchUpPending     atomic.Bool
+
+	// When each managed certificate is next examined by
+	// maintenance; protected by mu (see expiryBuckets)
+	reviews expiryBuckets
+
+	// Number of managed certificates in the cache; protected by mu
+	managedCount int
+
+	// Approximate memory used by the certificates in the
+	// cache; protected by mu (see CacheOptions.MaxBytes)
+	bytes int64
+
+	// The certificates in the orders of the eviction
+	// policies (see CacheOptions.EvictionPolicy)
+	evictionOrder evictionOrder
+
+	// Statistics of handshakes and evictions (see Stats)
+	hits, misses, evictions atomic.Uint64
+
+	// Unmanaged certificates loaded from files, by the
+	// names of the files (see ReloadUnmanaged)
+	unmanagedFiles map[[2]string]*unmanagedFile
+	unmanagedMu    sync.Mutex
+
+	// The names of the certificates of services, by the
+	// name they are managed under (see ManageService)
+	serviceSANs   map[string][]string
+	serviceSANsMu sync.RWMutex
+
+	// Subscribers to events of the cache and its configs
+	events eventBus
+
+	// Incremented to invalidate all TLS sessions (see SessionPolicy)
+	sessionEpoch atomic.Uint64
+
 	logger *zap.Logger
 }
 
@@ -102,6 +158,12 @@ func NewCache(opts CacheOptions) *Cache {
 	if opts.Capacity < 0 {
 		opts.Capacity = 0
 	}
+	if opts.MaxBytes < 0 {
+		opts.MaxBytes = 0
+	}
+	if opts.CatchUpLimit <= 0 {
+		opts.CatchUpLimit = DefaultCatchUpLimit
+	}
 
 	// this must be set, because we cannot not
 	// safely assume that the Default Config
@@ -116,6 +178,7 @@ func NewCache(opts CacheOptions) *Cache {
 		cacheIndex: make(map[string][]string),
 		stopChan:   make(chan struct{}),
 		doneChan:   make(chan struct{}),
+		reviews:    expiryBuckets{width: opts.RenewCheckInterval},
 		logger:     opts.Logger,
 	}
 
@@ -124,7 +187,7 @@ func NewCache(opts CacheOptions) *Cache {
 		c.logger = defaultLogger
 	}
 
-	go c.maintainAssets(0)
+	go c.maintainAssets()
 
 	return c
 }
@@ -175,11 +238,95 @@ type CacheOptions struct {
 	// if unset, DefaultRenewCheckInterval will be used.
 	RenewCheckInterval time.Duration
 
+	// If set, certificates loaded with Config.
+	// CacheUnmanagedCertificatePEMFile are reloaded
+	// from their files this often if the files changed,
+	// for example after they were rotated by an external
+	// tool; see Cache.ReloadUnmanaged.
+	// EXPERIMENTAL: Subject to change or removal.
+	UnmanagedReloadInterval time.Duration
+
 	// Maximum number of certificates to allow in the cache.
-	// If reached, certificates will be randomly evicted to
-	// make room for new ones. 0 means unlimited.
+	// If reached, certificates will be evicted according to
+	// EvictionPolicy to make room for new ones. 0 means
+	// unlimited.
 	Capacity int
 
+	// Maximum approximate memory, in bytes, that the
+	// certificates in the cache may use, in addition to
+	// Capacity. If reached, certificates will be evicted
+	// according to EvictionPolicy to make room for new
+	// ones. A certificate with an ECDSA key and a short
+	// chain uses about 4 KB. 0 means unlimited.
+	// EXPERIMENTAL: Subject to change or removal.
+	MaxBytes int64
+
+	// Which certificates to evict when the cache is full;
+	// EvictRandom by default. Only on-demand certificates
+	// are loaded again when they are needed, so caches of
+	// other certificates should not be allowed to fill up.
+	// EXPERIMENTAL: Subject to change or removal.
+	EvictionPolicy EvictionPolicy
+
+	// How many of the most urgent certificates to renew in
+	// a catch-up pass, which runs when a renewal pass took
+	// longer than RenewCheckInterval and the next one was
+	// skipped. If unset, DefaultCatchUpLimit will be used.
+	// EXPERIMENTAL: Subject to change or removal.
+	CatchUpLimit int
+
+	// How many certificates to refresh OCSP staples and
+	// check CRLs for concurrently during maintenance. If
+	// unset, DefaultOCSPWorkers() will be used.
+	// EXPERIMENTAL: Subject to change or removal.
+	OCSPWorkers int
+
+	// How many certificates WarmCache loads concurrently
+	// when its options do not say otherwise. If unset,
+	// DefaultLoadWorkers() will be used.
+	// EXPERIMENTAL: Subject to change or removal.
+	LoadWorkers int
+
+	// If set, and the Go runtime has a memory limit (see
+	// runtime/debug.SetMemoryLimit and GOMEMLIMIT), the
+	// cache relieves memory pressure when the memory used
+	// by the runtime exceeds this fraction of the limit,
+	// such as 0.9; see Cache.RelieveMemoryPressure.
+	// EXPERIMENTAL: Subject to change or removal.
+	MemoryPressureThreshold float64
+
+	// If set, maintenance is coordinated with other
+	// processes on the same host that share the same
+	// storage, so that only one of them renews
+	// certificates and refreshes OCSP staples.
+	// EXPERIMENTAL: Subject to change or removal.
+	LocalCoordinator *LocalCoordinator
+
+	// If set, maintenance is coordinated with the other
+	// instances of the cluster that share the same storage,
+	// so that only the elected leader renews certificates
+	// and refreshes OCSP staples.
+	// EXPERIMENTAL: Subject to change or removal.
+	LeaderElection *LeaderElection
+
+	// If set, maintenance is divided among the instances
+	// of the cluster that share the same storage, so that
+	// each instance renews certificates and refreshes OCSP
+	// staples only for its shard of the names.
+	// EXPERIMENTAL: Subject to change or removal.
+	Sharding *Sharding
+
+	// Called when maintenance of the cache emits an event,
+	// such as "panic_recovered". The error is ignored.
+	// EXPERIMENTAL: Subject to change or removal.
+	OnEvent func(ctx context.Context, event string, data map[string]any) error
+
+	// Receives the number of managed certificates in the
+	// cache as the certmagic_managed_certificates gauge.
+	// For other metrics, see Config.Metrics.
+	// EXPERIMENTAL: Subject to change or removal.
+	Metrics MetricsSink
+
 	// Set a logger to enable logging
 	Logger *zap.Logger
 }
@@ -231,39 +378,30 @@ func (certCache *Cache) unsyncedCacheCertificate(cert Certificate) {
 		return
 	}
 
-	// if the cache is at capacity, make room for new cert
-	cacheSize := len(certCache.cache)
-	certCache.optionsMu.RLock()
-	atCapacity := certCache.options.Capacity > 0 && cacheSize >= certCache.options.Capacity
-	certCache.optionsMu.RUnlock()
-
-	if atCapacity {
-		// Go maps are "nondeterministic" but not actually random,
-		// so although we could just chop off the "front" of the
-		// map with less code, that is a heavily skewed eviction
-		// strategy; generating random numbers is cheap and
-		// ensures a much better distribution.
-		rnd := weakrand.Intn(cacheSize)
-		i := 0
-		for _, randomCert := range certCache.cache {
-			if i == rnd {
-				certCache.logger.Debug("cache full; evicting random certificate",
-					zap.Strings("removing_subjects", randomCert.Names),
-					zap.String("removing_hash", randomCert.hash),
-					zap.Strings("inserting_subjects", cert.Names),
-					zap.String("inserting_hash", cert.hash))
-				certCache.removeCertificate(randomCert)
-				break
-			}
-			i++
-		}
-	}
+	// if the cache is full, make room for new cert
+	certCache.makeRoom(cert)
 
 	// store the certificate
+	if cert.usage == nil {
+		cert.usage = new(certUsage)
+		cert.usage.cached.Store(timeNow().UnixNano())
+	}
 	certCache.cache[cert.hash] = cert
+	certCache.bytes += certMemorySize(cert)
+	certCache.evictionOrder.add(cert)
+
+	// new certificates are examined by the next renewal pass
+	if cert.managed {
+		certCache.reviews.schedule(cert.hash, timeNow())
+		certCache.managedCount++
+		certCache.reportManagedCount()
+	}
 
 	// update the index so we can access it by name
 	for _, name := range cert.Names {
+		if _, ok := certCache.cacheIndex[name]; !ok {
+			certCache.addWildcardName(name)
+		}
 		certCache.cacheIndex[name] = append(certCache.cacheIndex[name], cert.hash)
 	}
 
@@ -275,6 +413,7 @@ func (certCache *Cache) unsyncedCacheCertificate(cert Certificate) {
 		zap.String("issuer_key", cert.issuerKey),
 		zap.String("hash", cert.hash),
 		zap.Int("cache_size", len(certCache.cache)),
+		zap.Int64("cache_bytes", certCache.bytes),
 		zap.Int("cache_capacity", certCache.options.Capacity))
 	certCache.optionsMu.RUnlock()
 }
@@ -295,13 +434,24 @@ func (certCache *Cache) removeCertificate(cert Certificate) {
 		}
 		if len(keyList) == 0 {
 			delete(certCache.cacheIndex, name)
+			certCache.removeWildcardName(name)
 		} else {
 			certCache.cacheIndex[name] = keyList
 		}
 	}
 
 	// delete the actual cert from the cache
+	cached, ok := certCache.cache[cert.hash]
 	delete(certCache.cache, cert.hash)
+	certCache.reviews.unschedule(cert.hash)
+	if ok {
+		certCache.bytes -= certMemorySize(cached)
+		certCache.evictionOrder.remove(cert.hash)
+	}
+	if ok && cached.managed {
+		certCache.managedCount--
+		certCache.reportManagedCount()
+	}
 
 	certCache.optionsMu.RLock()
 	certCache.logger.Debug("removed certificate from cache",
@@ -311,10 +461,23 @@ func (certCache *Cache) removeCertificate(cert Certificate) {
 		zap.String("issuer_key", cert.issuerKey),
 		zap.String("hash", cert.hash),
 		zap.Int("cache_size", len(certCache.cache)),
+		zap.Int64("cache_bytes", certCache.bytes),
 		zap.Int("cache_capacity", certCache.options.Capacity))
 	certCache.optionsMu.RUnlock()
 }
 
+// reportManagedCount sets the gauge of managed certificates,
+// if the cache has a metrics sink. Callers MUST hold a write
+// lock on certCache.mu.
+func (certCache *Cache) reportManagedCount() {
+	certCache.optionsMu.RLock()
+	sink := certCache.options.Metrics
+	certCache.optionsMu.RUnlock()
+	if sink != nil {
+		sink.SetGauge(metricManagedCertificates, float64(certCache.managedCount))
+	}
+}
+
 // replaceCertificate atomically replaces oldCert with newCert in
 // the cache.
 //
@@ -327,6 +490,7 @@ func (certCache *Cache) replaceCertificate(oldCert, newCert Certificate) {
 	certCache.logger.Info("replaced certificate in cache",
 		zap.Strings("subjects", newCert.Names),
 		zap.Time("new_expiration", expiresAt(newCert.Leaf)))
+	certCache.signalLocalFollowers()
 }
 
 // getAllMatchingCerts returns all certificates with exactly this subject
@@ -384,16 +548,95 @@ func (certCache *Cache) AllMatchingCertificates(name string) []Certificate {
 
 	// then look for wildcard matches by replacing each
 	// label of the domain name with wildcards
-	labels := strings.Split(name, ".")
-	for i := range labels {
-		labels[i] = "*"
-		candidate := strings.Join(labels, ".")
-		certs = append(certs, certCache.getAllMatchingCerts(candidate)...)
+	for stars, rest, more := 1, name, true; more; stars++ {
+		rest, more = trimFirstLabel(rest)
+		if candidate, ok := certCache.lookupWildcard(rest, stars); ok {
+			certs = append(certs, certCache.getAllMatchingCerts(candidate)...)
+		}
 	}
 
 	return certs
 }
 
+// wildcardName is a name in the cache index whose
+// first labels are wildcards, like "*.example.com".
+type wildcardName struct {
+	name  string
+	stars int // number of leading wildcard labels
+}
+
+// splitWildcard returns the part of name following its leading wildcard
+// labels, and how many leading wildcard labels there are. For example,
+// "*.*.example.com" yields "example.com" and 2, and "*.*" yields "" and 2.
+func splitWildcard(name string) (suffix string, stars int) {
+	for strings.HasPrefix(name, "*.") {
+		name = name[2:]
+		stars++
+	}
+	if name == "*" {
+		name = ""
+		stars++
+	}
+	return name, stars
+}
+
+// trimFirstLabel returns name without its first label, and whether
+// name had more than one label.
+func trimFirstLabel(name string) (string, bool) {
+	if dot := strings.IndexByte(name, '.'); dot >= 0 {
+		return name[dot+1:], true
+	}
+	return "", false
+}
+
+// addWildcardName adds name to the wildcard index if it is a wildcard name.
+// The cache's write lock must be held.
+func (certCache *Cache) addWildcardName(name string) {
+	suffix, stars := splitWildcard(name)
+	if stars == 0 {
+		return
+	}
+	if certCache.wildcardIndex == nil {
+		certCache.wildcardIndex = make(map[string][]wildcardName)
+	}
+	certCache.wildcardIndex[suffix] = append(certCache.wildcardIndex[suffix], wildcardName{name, stars})
+}
+
+// removeWildcardName removes name from the wildcard index, if present.
+// The cache's write lock must be held.
+func (certCache *Cache) removeWildcardName(name string) {
+	suffix, stars := splitWildcard(name)
+	if stars == 0 {
+		return
+	}
+	names := certCache.wildcardIndex[suffix]
+	for i := range names {
+		if names[i].name == name {
+			names = append(names[:i], names[i+1:]...)
+			break
+		}
+	}
+	if len(names) == 0 {
+		delete(certCache.wildcardIndex, suffix)
+	} else {
+		certCache.wildcardIndex[suffix] = names
+	}
+}
+
+// lookupWildcard returns the wildcard name in the cache with the given
+// number of leading wildcard labels followed by suffix, if there is one.
+// This does not allocate, so it is suitable for use during handshakes.
+func (certCache *Cache) lookupWildcard(suffix string, stars int) (string, bool) {
+	certCache.mu.RLock()
+	defer certCache.mu.RUnlock()
+	for _, wn := range certCache.wildcardIndex[suffix] {
+		if wn.stars == stars {
+			return wn.name, true
+		}
+	}
+	return "", false
+}
+
 // SubjectIssuer pairs a subject name with an issuer ID/key.
 type SubjectIssuer struct {
 	Subject, IssuerKey string
@@ -428,6 +671,7 @@ func (certCache *Cache) Remove(hashes []string) {
 		certCache.removeCertificate(cert)
 	}
 	certCache.mu.Unlock()
+	certCache.forgetUnmanagedFiles(hashes)
 }
 
 var (
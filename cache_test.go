@@ -40,3 +40,49 @@ func TestNewCache(t *testing.T) {
 		t.Error("Expected stopChan to be set, but it was nil")
 	}
 }
+
+func TestWildcardIndex(t *testing.T) {
+	c := &Cache{
+		cache:      make(map[string]Certificate),
+		cacheIndex: make(map[string][]string),
+		logger:     defaultTestLogger,
+	}
+	c.cacheCertificate(Certificate{Names: []string{"*.example.com", "example.com"}, hash: "a"})
+	c.cacheCertificate(Certificate{Names: []string{"*.example.com"}, hash: "b"})
+	c.cacheCertificate(Certificate{Names: []string{"*.*.example.net", "*"}, hash: "c"})
+
+	for _, tc := range []struct {
+		suffix   string
+		stars    int
+		expected string
+	}{
+		{suffix: "example.com", stars: 1, expected: "*.example.com"},
+		{suffix: "example.com", stars: 2, expected: ""},
+		{suffix: "example.net", stars: 2, expected: "*.*.example.net"},
+		{suffix: "", stars: 1, expected: "*"},
+		{suffix: "com", stars: 1, expected: ""},
+	} {
+		actual, ok := c.lookupWildcard(tc.suffix, tc.stars)
+		if actual != tc.expected || ok != (tc.expected != "") {
+			t.Errorf("lookupWildcard(%q, %d): expected %q, got %q (ok=%t)", tc.suffix, tc.stars, tc.expected, actual, ok)
+		}
+	}
+
+	if matches := c.AllMatchingCertificates("sub.example.com"); len(matches) != 2 {
+		t.Errorf("expected 2 wildcard matches for sub.example.com, got %d", len(matches))
+	}
+
+	// the wildcard name stays indexed until no certificate has it
+	c.mu.Lock()
+	c.removeCertificate(c.cache["a"])
+	c.mu.Unlock()
+	if _, ok := c.lookupWildcard("example.com", 1); !ok {
+		t.Error("expected *.example.com to still be indexed")
+	}
+	c.mu.Lock()
+	c.removeCertificate(c.cache["b"])
+	c.mu.Unlock()
+	if _, ok := c.lookupWildcard("example.com", 1); ok {
+		t.Error("expected *.example.com to be removed from the index")
+	}
+}
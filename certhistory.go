@@ -0,0 +1,277 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertificateVersion is a previous version of a certificate that is
+// kept in storage; see Config.CertificateHistory.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CertificateVersion struct {
+	// Identifies the version; versions of a certificate
+	// from the same issuer sort in the order they were
+	// issued.
+	ID string
+
+	// The key of the issuer of the version.
+	IssuerKey string
+
+	// The names on the certificate.
+	SANs []string
+
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+// CertHistoryPrefix returns the key prefix for the previous versions of
+// the certificate for domain that is associated with the issuer with the
+// given issuerKey.
+func (keys KeyBuilder) CertHistoryPrefix(issuerKey, domain string) string {
+	return path.Join(prefixCertHistory, keys.Safe(issuerKey), keys.safeSite(domain))
+}
+
+const prefixCertHistory = "certificate_history"
+
+// certVersionKeys returns the keys of the certificate, private key, and
+// metadata of the version of the certificate for domain.
+func certVersionKeys(issuerKey, domain, version string) (certKey, privateKey, metaKey string) {
+	prefix := path.Join(StorageKeys.CertHistoryPrefix(issuerKey, domain), StorageKeys.Safe(version))
+	safeDomain := StorageKeys.safeSite(domain)
+	return path.Join(prefix, safeDomain+".crt"),
+		path.Join(prefix, safeDomain+".key"),
+		path.Join(prefix, safeDomain+".json")
+}
+
+// archiveCertResource keeps the certificate resource from issuer for
+// certNamesKey that is currently in storage as a previous version,
+// unless it is the same as replacement, and deletes the oldest versions
+// in excess of cfg.CertificateHistory.
+func (cfg *Config) archiveCertResource(ctx context.Context, issuer Issuer, certNamesKey string, replacement CertificateResource) error {
+	current, err := cfg.loadCertResource(ctx, issuer, certNamesKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("loading current certificate: %v", err)
+	}
+	if string(current.CertificatePEM) == string(replacement.CertificatePEM) {
+		return nil
+	}
+	version, err := certResourceVersion(current)
+	if err != nil {
+		return err
+	}
+
+	issuerKey := issuer.IssuerKey()
+	metaBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteMeta(issuerKey, certNamesKey))
+	if err != nil {
+		return fmt.Errorf("loading current certificate metadata: %v", err)
+	}
+	certKey, privateKey, metaKey := certVersionKeys(issuerKey, certNamesKey, version.ID)
+	err = storeTx(ctx, cfg.Storage, []keyValue{
+		{key: privateKey, value: current.PrivateKeyPEM},
+		{key: certKey, value: current.CertificatePEM},
+		{key: metaKey, value: metaBytes},
+	})
+	if err != nil {
+		return fmt.Errorf("storing previous version: %v", err)
+	}
+
+	versions, err := cfg.Storage.List(ctx, StorageKeys.CertHistoryPrefix(issuerKey, certNamesKey), false)
+	if err != nil {
+		return fmt.Errorf("listing previous versions: %v", err)
+	}
+	sort.Strings(versions)
+	for i := 0; i < len(versions)-cfg.CertificateHistory; i++ {
+		if err := cfg.Storage.Delete(ctx, versions[i]); err != nil {
+			return fmt.Errorf("deleting old version: %v", err)
+		}
+	}
+	return nil
+}
+
+// certResourceVersion returns the version of certRes.
+func certResourceVersion(certRes CertificateResource) (CertificateVersion, error) {
+	certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		return CertificateVersion{}, err
+	}
+	leaf := certs[0]
+	return CertificateVersion{
+		// serial numbers have at most 20 octets (RFC 5280 section 4.1.2.2);
+		// padding them makes IDs with the same NotBefore sort correctly
+		// (IDs are lowercase, since they are used in storage keys)
+		ID:        fmt.Sprintf("%s-%040x", leaf.NotBefore.UTC().Format("20060102t150405z"), leaf.SerialNumber),
+		IssuerKey: certRes.issuerKey,
+		SANs:      certRes.SANs,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  expiresAt(leaf),
+	}, nil
+}
+
+// CertificateVersions returns the previous versions of the certificate for
+// name that are kept in storage, across all of cfg's issuers, newest first.
+// Versions are only kept if Config.CertificateHistory is set.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) CertificateVersions(ctx context.Context, name string) ([]CertificateVersion, error) {
+	name = normalizedName(name)
+	var versions []CertificateVersion
+	for _, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		versionKeys, err := cfg.Storage.List(ctx, StorageKeys.CertHistoryPrefix(issuerKey, name), false)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing versions from issuer %s: %v", issuerKey, err)
+		}
+		for _, versionKey := range versionKeys {
+			certRes, err := cfg.loadCertVersion(ctx, issuer, name, path.Base(versionKey))
+			if err != nil {
+				cfg.Logger.Error("unable to load previous certificate version",
+					zap.String("storage_key", versionKey),
+					zap.Error(err))
+				continue
+			}
+			version, err := certResourceVersion(certRes)
+			if err != nil {
+				cfg.Logger.Error("unable to decode previous certificate version",
+					zap.String("storage_key", versionKey),
+					zap.Error(err))
+				continue
+			}
+			version.ID = path.Base(versionKey)
+			versions = append(versions, version)
+		}
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+	return versions, nil
+}
+
+// loadCertVersion loads the version of the certificate for name from issuer.
+func (cfg *Config) loadCertVersion(ctx context.Context, issuer Issuer, name, version string) (CertificateResource, error) {
+	certRes := CertificateResource{issuerKey: issuer.IssuerKey()}
+	certKey, privateKey, metaKey := certVersionKeys(certRes.issuerKey, name, version)
+	keyBytes, err := cfg.Storage.Load(ctx, privateKey)
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	certRes.PrivateKeyPEM = keyBytes
+	certBytes, err := cfg.Storage.Load(ctx, certKey)
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	certRes.CertificatePEM = certBytes
+	metaBytes, err := cfg.Storage.Load(ctx, metaKey)
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	if err := json.Unmarshal(metaBytes, &certRes); err != nil {
+		return CertificateResource{}, fmt.Errorf("decoding certificate metadata: %v", err)
+	}
+	return certRes, nil
+}
+
+// RollbackCertificate restores the previous version of the certificate for
+// name, as returned by CertificateVersions, and replaces the certificate in
+// the cache with it, so it is served right away. This is useful if a renewal
+// turned out to be broken, for example because of a bad chain. The certificate
+// that is replaced is kept as a previous version, so the rollback can be undone.
+//
+// Note that the restored certificate is managed as usual: if it is due for
+// renewal, it will be renewed during the next maintenance. Other instances
+// sharing the storage load it when they next reload the certificate. If other
+// issuers have newer certificates for name, those take precedence when the
+// certificate is loaded from storage again.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) RollbackCertificate(ctx context.Context, name, version string) error {
+	log := cfg.Logger.Named("rollback").With(zap.String("identifier", name), zap.String("version", version))
+	name = normalizedName(name)
+	if version == "" || strings.ContainsAny(version, "/\\") {
+		return fmt.Errorf("invalid certificate version: %q", version)
+	}
+
+	// make sure the certificate isn't renewed while we're at it
+	lockKey := cfg.lockKey(certIssueLockOp, name)
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			log.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	for _, issuer := range cfg.Issuers {
+		certRes, err := cfg.loadCertVersion(ctx, issuer, name, version)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("loading version %s of certificate for %s: %v", version, name, err)
+		}
+		cert, err := cfg.makeCertificateWithOCSP(ctx, certRes.CertificatePEM, certRes.PrivateKeyPEM)
+		if err != nil {
+			return fmt.Errorf("making certificate from version %s: %v", version, err)
+		}
+		cert.managed = true
+		cert.issuerKey = certRes.issuerKey
+		cert.namesKey = certRes.NamesKey()
+		if ari, err := certRes.getARI(); err == nil && ari != nil {
+			cert.ari = *ari
+		}
+
+		if err := cfg.saveCertResource(ctx, issuer, certRes); err != nil {
+			return fmt.Errorf("restoring version %s of certificate for %s: %v", version, name, err)
+		}
+
+		replaced := false
+		for _, oldCert := range cfg.certCache.getAllMatchingCerts(name) {
+			if oldCert.managed {
+				cfg.certCache.replaceCertificate(oldCert, cert)
+				replaced = true
+			}
+		}
+		if !replaced {
+			cfg.certCache.cacheCertificate(cert)
+		}
+
+		log.Info("rolled back certificate", zap.String("issuer", certRes.issuerKey))
+		cfg.emit(ctx, "cert_rolled_back", map[string]any{
+			"identifier": name,
+			"issuer":     certRes.issuerKey,
+			"version":    version,
+		})
+		return nil
+	}
+	return fmt.Errorf("no version %s of certificate for %s: %w", version, name, fs.ErrNotExist)
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestRollbackCertificate(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.CertificateHistory = 2
+
+	const name = "example.com"
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := cfg.CertificateVersions(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions to be kept, got %d", len(versions))
+	}
+	if versions[0].ID <= versions[1].ID {
+		t.Errorf("expected newest version first, got %s before %s", versions[0].ID, versions[1].ID)
+	}
+	if versions[0].IssuerKey != fi.IssuerKey() || len(versions[0].SANs) != 1 || versions[0].SANs[0] != name {
+		t.Errorf("unexpected version: %+v", versions[0])
+	}
+
+	restore := versions[1]
+	if err := cfg.RollbackCertificate(ctx, name, restore.ID); err != nil {
+		t.Fatalf("rolling back: %v", err)
+	}
+	cached := cfg.certCache.getAllMatchingCerts(name)
+	if len(cached) != 1 {
+		t.Fatalf("expected 1 cached certificate, got %d", len(cached))
+	}
+	if !cached[0].Leaf.NotBefore.Equal(restore.NotBefore) || !cached[0].managed {
+		t.Errorf("expected restored version to be served, got certificate from %s", cached[0].Leaf.NotBefore)
+	}
+	certRes, err := cfg.loadCertResource(ctx, fi, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if storedVersion, _ := certResourceVersion(certRes); storedVersion.ID != restore.ID {
+		t.Errorf("expected restored version %s in storage, got %s", restore.ID, storedVersion.ID)
+	}
+
+	// the replaced certificate was kept, so the rollback can be undone
+	versions, err = cfg.CertificateVersions(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].ID == restore.ID {
+		t.Errorf("expected replaced certificate to be the newest version, got %+v", versions)
+	}
+
+	if err := cfg.RollbackCertificate(ctx, name, "nonexistent"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error for unknown version, got %v", err)
+	}
+}
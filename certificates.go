@@ -20,7 +20,6 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"net"
 	"os"
 	"strings"
@@ -51,6 +50,10 @@ type Certificate struct {
 	// most recent OCSP response we have for this certificate.
 	ocsp *ocsp.Response
 
+	// The certificate's entry on the CRL of its issuer,
+	// if CRL checking found it to be revoked.
+	crl *x509.RevocationListEntry
+
 	// The hex-encoded hash of this cert's chain's DER bytes.
 	hash string
 
@@ -60,8 +63,15 @@ type Certificate struct {
 	// The unique string identifying the issuer of this certificate.
 	issuerKey string
 
+	// The key its assets are stored under, if it is managed
+	// (see CertificateResource.NamesKey).
+	namesKey string
+
 	// ACME Renewal Information, if available
 	ari acme.RenewalInfo
+
+	// How the certificate is used; set when it is cached
+	usage *certUsage
 }
 
 // Empty returns true if the certificate struct is not filled out; at
@@ -127,7 +137,7 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 		if selectedTime.IsZero() &&
 			(!ari.SuggestedWindow.Start.IsZero() && !ari.SuggestedWindow.End.IsZero()) {
 			start, end := ari.SuggestedWindow.Start.Unix()+1, ari.SuggestedWindow.End.Unix()
-			selectedTime = time.Unix(rand.Int63n(end-start)+start, 0).UTC()
+			selectedTime = time.Unix(randInt63n(cfg.randReader(), end-start)+start, 0).UTC()
 			logger.Warn("no renewal time had been selected with ARI; chose an ephemeral one for now",
 				zap.Time("ephemeral_selected_time", selectedTime))
 		}
@@ -139,7 +149,7 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 			// cutoff can actually be before the start of the renewal window, but the spec
 			// author says that's OK: https://github.com/aarongable/draft-acme-ari/issues/71
 			cutoff := ari.SelectedTime.Add(-cfg.certCache.options.RenewCheckInterval)
-			if time.Now().After(cutoff) {
+			if timeNow().After(cutoff) {
 				logger.Info("certificate needs renewal based on ARI window",
 					zap.Time("selected_time", selectedTime),
 					zap.Time("renewal_cutoff", cutoff))
@@ -175,9 +185,9 @@ func (cfg *Config) certNeedsRenewal(leaf *x509.Certificate, ari acme.RenewalInfo
 	// routine to check for renewals, to accommodate both exceptionally long and short
 	// cert lifetimes
 	if currentlyInRenewalWindow(leaf.NotBefore, expiration, 1.0/50.0) ||
-		time.Until(expiration) < cfg.certCache.options.RenewCheckInterval*5 {
+		expiration.Sub(timeNow()) < cfg.certCache.options.RenewCheckInterval*5 {
 		logger.Warn("certificate is in emergency renewal window; expiration imminent",
-			zap.Duration("remaining", time.Until(expiration)))
+			zap.Duration("remaining", expiration.Sub(timeNow())))
 		return true
 	}
 
@@ -193,7 +203,7 @@ func (cert Certificate) Expired() bool {
 		// tls.X509KeyPair() discards the leaf; oh well
 		return false
 	}
-	return time.Now().After(expiresAt(cert.Leaf))
+	return timeNow().After(expiresAt(cert.Leaf))
 }
 
 // Lifetime returns the duration of the certificate's validity.
@@ -220,7 +230,7 @@ func currentlyInRenewalWindow(notBefore, notAfter time.Time, renewalWindowRatio
 	}
 	renewalWindow := time.Duration(float64(lifetime) * renewalWindowRatio)
 	renewalWindowStart := notAfter.Add(-renewalWindow)
-	return time.Now().After(renewalWindowStart)
+	return timeNow().After(renewalWindowStart)
 }
 
 // HasTag returns true if cert.Tags has tag.
@@ -233,6 +243,73 @@ func (cert Certificate) HasTag(tag string) bool {
 	return false
 }
 
+// OCSPStatus describes the most recent OCSP response for a certificate.
+type OCSPStatus struct {
+	// The status of the certificate: one of ocsp.Good,
+	// ocsp.Revoked, ocsp.Unknown, or ocsp.ServerFailed.
+	Status int
+
+	// The validity period of the response.
+	ThisUpdate time.Time
+	NextUpdate time.Time
+
+	// When the certificate was revoked and why (one of the
+	// ocsp reason codes, e.g. ocsp.KeyCompromise); only set
+	// if Status is ocsp.Revoked.
+	RevokedAt        time.Time
+	RevocationReason int
+
+	// The DER-encoded response.
+	Raw []byte
+
+	// Whether the response is stapled to the certificate
+	// in TLS handshakes (which it is only if Good).
+	Stapled bool
+}
+
+// OCSPStatus returns the most recent OCSP response for the certificate,
+// which is not necessarily the stapled response (for example, if the
+// certificate is revoked). The second return value is false if there
+// is no OCSP response for the certificate, for example because stapling
+// is disabled or the certificate has no OCSP responder.
+func (cert Certificate) OCSPStatus() (OCSPStatus, bool) {
+	if cert.ocsp == nil {
+		return OCSPStatus{}, false
+	}
+	status := OCSPStatus{
+		Status:     cert.ocsp.Status,
+		ThisUpdate: cert.ocsp.ThisUpdate,
+		NextUpdate: cert.ocsp.NextUpdate,
+		Raw:        cert.ocsp.Raw,
+		Stapled:    len(cert.Certificate.OCSPStaple) > 0,
+	}
+	if cert.ocsp.Status == ocsp.Revoked {
+		status.RevokedAt = cert.ocsp.RevokedAt
+		status.RevocationReason = cert.ocsp.RevocationReason
+	}
+	return status, true
+}
+
+// Revoked returns true if the most recent OCSP response
+// for the certificate, or the CRL of its issuer (see
+// CRLConfig), says that it has been revoked.
+func (cert Certificate) Revoked() bool {
+	_, _, revoked := cert.revocation()
+	return revoked
+}
+
+// revocation returns when and why the certificate was revoked according
+// to its OCSP response or CRL entry, and whether it was revoked at all.
+func (cert Certificate) revocation() (revokedAt time.Time, reason int, revoked bool) {
+	if cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
+		return cert.ocsp.RevokedAt, cert.ocsp.RevocationReason, true
+	}
+	if cert.crl != nil {
+		return cert.crl.RevocationTime, cert.crl.ReasonCode, true
+	}
+	return time.Time{}, 0, false
+}
+
 // expiresAt return the time that a certificate expires. Account for the 1s
 // resolution of ASN.1 UTCTime/GeneralizedTime by including the extra fraction
 // of a second of certificate validity beyond the NotAfter value.
@@ -258,6 +335,7 @@ func (cfg *Config) CacheManagedCertificate(ctx context.Context, domain string) (
 	}
 	cfg.certCache.cacheCertificate(cert)
 	cfg.emit(ctx, "cached_managed_cert", map[string]any{"sans": cert.Names})
+	cfg.evictCachedDuplicates(ctx, cert)
 	return cert, nil
 }
 
@@ -275,6 +353,7 @@ func (cfg *Config) loadManagedCertificate(ctx context.Context, domain string) (C
 	}
 	cert.managed = true
 	cert.issuerKey = certRes.issuerKey
+	cert.namesKey = certRes.NamesKey()
 	if ari, err := certRes.getARI(); err == nil && ari != nil {
 		cert.ari = *ari
 	}
@@ -309,15 +388,32 @@ func (certRes CertificateResource) getACMEData() (acme.Certificate, error) {
 // CacheUnmanagedCertificatePEMFile loads a certificate for host using certFile
 // and keyFile, which must be in PEM format. It stores the certificate in
 // the in-memory cache and returns the hash, useful for removing from the cache.
+// The certificate is loaded from the files again when they change; see
+// Cache.ReloadUnmanaged.
 //
 // This method is safe for concurrent use.
 func (cfg *Config) CacheUnmanagedCertificatePEMFile(ctx context.Context, certFile, keyFile string, tags []string) (string, error) {
+	// note the state of the files before reading them, so
+	// that changes while reading are noticed when reloading
+	certStat, certStatErr := statFile(certFile)
+	keyStat, keyStatErr := statFile(keyFile)
+
 	cert, err := cfg.makeCertificateFromDiskWithOCSP(ctx, certFile, keyFile)
 	if err != nil {
 		return "", err
 	}
 	cert.Tags = tags
 	cfg.certCache.cacheCertificate(cert)
+	if certStatErr == nil && keyStatErr == nil {
+		cfg.certCache.watchUnmanagedFiles(&unmanagedFile{
+			certFile: certFile,
+			keyFile:  keyFile,
+			cfg:      cfg,
+			hash:     cert.hash,
+			certStat: certStat,
+			keyStat:  keyStat,
+		})
+	}
 	cfg.emit(ctx, "cached_unmanaged_cert", map[string]any{"sans": cert.Names})
 	return cert.hash, nil
 }
@@ -344,9 +440,9 @@ func (cfg *Config) CacheUnmanagedTLSCertificate(ctx context.Context, tlsCert tls
 			zap.Time("not_after", cert.Leaf.NotAfter),
 			zap.Strings("sans", cert.Names))
 	}
-	err = stapleOCSP(ctx, cfg.OCSP, cfg.Storage, &cert, nil)
+	err = cfg.stapleOCSP(ctx, &cert, nil)
 	if err != nil {
-		cfg.Logger.Warn("stapling OCSP", zap.Error(err))
+		cfg.warnStapling(ctx, cert, err)
 	}
 	cfg.emit(ctx, "cached_unmanaged_cert", map[string]any{"sans": cert.Names})
 	cert.Tags = tags
@@ -393,9 +489,9 @@ func (cfg Config) makeCertificateWithOCSP(ctx context.Context, certPEMBlock, key
 	if err != nil {
 		return cert, err
 	}
-	err = stapleOCSP(ctx, cfg.OCSP, cfg.Storage, &cert, certPEMBlock)
+	err = cfg.stapleOCSP(ctx, &cert, certPEMBlock)
 	if err != nil {
-		cfg.Logger.Warn("stapling OCSP", zap.Error(err), zap.Strings("identifiers", cert.Names))
+		cfg.warnStapling(ctx, cert, err)
 	}
 	return cert, nil
 }
@@ -409,7 +505,7 @@ func makeCertificate(certPEMBlock, keyPEMBlock []byte) (Certificate, error) {
 	var cert Certificate
 
 	// Convert to a tls.Certificate
-	tlsCert, err := tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	tlsCert, err := x509KeyPair(certPEMBlock, keyPEMBlock)
 	if err != nil {
 		return cert, err
 	}
@@ -469,6 +565,7 @@ func fillCertFromLeaf(cert *Certificate, tlsCert tls.Certificate) error {
 			cert.Names = append(cert.Names, u.String())
 		}
 	}
+	cert.Names = append(cert.Names, otherNamesFromExtensions(leaf.Extensions)...)
 	if len(cert.Names) == 0 {
 		return fmt.Errorf("certificate has no names")
 	}
@@ -518,7 +615,14 @@ func (cfg *Config) reloadManagedCertificate(ctx context.Context, oldCert Certifi
 // - must not be empty
 // - must not start or end with a dot (RFC 1034; RFC 6066 section 3)
 // - must not contain common accidental special characters
+//
+// URIs and otherName subjects (see OtherNameSubject) only need
+// to be well-formed and free of whitespace.
 func SubjectQualifiesForCert(subj string) bool {
+	if subjectIsIdentity(subj) {
+		return !strings.ContainsAny(subj, " \t\n")
+	}
+
 	// must not be empty
 	return strings.TrimSpace(subj) != "" &&
 
@@ -545,6 +649,9 @@ func SubjectQualifiesForPublicCert(subj string) bool {
 	// must at least qualify for a certificate
 	return SubjectQualifiesForCert(subj) &&
 
+		// URIs and otherNames are only issued by internal CAs
+		!subjectIsIdentity(subj) &&
+
 		// loopback hosts and internal IPs are ineligible
 		!SubjectIsInternal(subj) &&
 
@@ -20,6 +20,8 @@ import (
 	"reflect"
 	"testing"
 	"time"
+
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestUnexportedGetCertificate(t *testing.T) {
@@ -42,6 +44,7 @@ func TestUnexportedGetCertificate(t *testing.T) {
 	// When retrieving wildcard certificate
 	certCache.cache["0xb01dface"] = Certificate{Names: []string{"*.example.com"}}
 	certCache.cacheIndex["*.example.com"] = []string{"0xb01dface"}
+	certCache.addWildcardName("*.example.com")
 	if cert, matched, defaulted := cfg.getCertificateFromCache(&tls.ClientHelloInfo{ServerName: "sub.example.com"}); !matched || defaulted || cert.Names[0] != "*.example.com" {
 		t.Errorf("Didn't get wildcard cert for 'sub.example.com' or got the wrong one: %v, matched=%v, defaulted=%v", cert, matched, defaulted)
 	}
@@ -225,3 +228,46 @@ func TestMatchWildcard(t *testing.T) {
 		}
 	}
 }
+
+func TestCertificateOCSPStatus(t *testing.T) {
+	var cert Certificate
+	if _, ok := cert.OCSPStatus(); ok {
+		t.Error("expected no OCSP status for certificate without OCSP response")
+	}
+	if cert.Revoked() {
+		t.Error("certificate without OCSP response should not be revoked")
+	}
+
+	now := time.Now().Truncate(time.Second)
+	cert.ocsp = &ocsp.Response{
+		Raw:              []byte("raw"),
+		Status:           ocsp.Revoked,
+		ThisUpdate:       now,
+		NextUpdate:       now.Add(time.Hour),
+		RevokedAt:        now.Add(-time.Hour),
+		RevocationReason: ocsp.KeyCompromise,
+	}
+	status, ok := cert.OCSPStatus()
+	if !ok {
+		t.Fatal("expected OCSP status")
+	}
+	if status.Status != ocsp.Revoked || !cert.Revoked() {
+		t.Errorf("expected revoked status, got %d", status.Status)
+	}
+	if !status.ThisUpdate.Equal(now) || !status.NextUpdate.Equal(now.Add(time.Hour)) {
+		t.Errorf("unexpected validity period: %s - %s", status.ThisUpdate, status.NextUpdate)
+	}
+	if status.RevocationReason != ocsp.KeyCompromise || !status.RevokedAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("unexpected revocation details: %d at %s", status.RevocationReason, status.RevokedAt)
+	}
+	if string(status.Raw) != "raw" || status.Stapled {
+		t.Errorf("unexpected raw/stapled: %q/%t", status.Raw, status.Stapled)
+	}
+
+	cert.ocsp.Status = ocsp.Good
+	cert.Certificate.OCSPStaple = cert.ocsp.Raw
+	status, _ = cert.OCSPStatus()
+	if !status.Stapled || !status.RevokedAt.IsZero() || status.RevocationReason != 0 {
+		t.Errorf("expected stapled good status without revocation details, got %+v", status)
+	}
+}
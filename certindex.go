@@ -0,0 +1,243 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CertificateIndexEntry describes a certificate found in the storage
+// index, which maps the serial numbers and SHA-256 fingerprints of all
+// certificates stored by a Config to where they are stored. The index
+// answers questions such as "is serial X ours?" during incident response
+// without scanning every stored certificate.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CertificateIndexEntry struct {
+	// The serial number of the certificate, in lowercase hex.
+	Serial string `json:"serial"`
+
+	// The SHA-256 fingerprint of the certificate, in lowercase hex.
+	SHA256 string `json:"sha256"`
+
+	// The names on the certificate.
+	Names []string `json:"names"`
+
+	// The issuer key of the certificate, and the storage
+	// key of its PEM bundle.
+	IssuerKey string `json:"issuer_key"`
+	CertKey   string `json:"cert_key"`
+
+	// The validity period of the certificate.
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// Set by lookups if the certificate is no longer stored at
+	// CertKey, because it was renewed or deleted since. The
+	// certificate was ours, but whoever has it now does not get
+	// it from us anymore.
+	Superseded bool `json:"-"`
+}
+
+// LookupCertificateBySerial returns the index entry for the certificate
+// with the given serial number, in hex (case, colons, and leading zeros
+// do not matter). If the certificate is not in the index, the error
+// wraps fs.ErrNotExist. Certificates stored before the index existed
+// are only found after calling RebuildCertificateIndex.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) LookupCertificateBySerial(ctx context.Context, serial string) (CertificateIndexEntry, error) {
+	return cfg.lookupCertificateIndex(ctx, StorageKeys.SerialIndex(normalizeSerial(serial)))
+}
+
+// LookupCertificateByFingerprint is like LookupCertificateBySerial, but
+// it looks up the certificate by its SHA-256 fingerprint, in hex.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) LookupCertificateByFingerprint(ctx context.Context, sha256Hex string) (CertificateIndexEntry, error) {
+	fingerprint := strings.ToLower(strings.ReplaceAll(sha256Hex, ":", ""))
+	return cfg.lookupCertificateIndex(ctx, StorageKeys.FingerprintIndex(fingerprint))
+}
+
+func (cfg *Config) lookupCertificateIndex(ctx context.Context, indexKey string) (CertificateIndexEntry, error) {
+	data, err := cfg.Storage.Load(ctx, indexKey)
+	if err != nil {
+		return CertificateIndexEntry{}, err
+	}
+	var entry CertificateIndexEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return CertificateIndexEntry{}, fmt.Errorf("decoding certificate index entry %s: %v", indexKey, err)
+	}
+	certPEM, err := cfg.Storage.Load(ctx, entry.CertKey)
+	if errors.Is(err, fs.ErrNotExist) {
+		entry.Superseded = true
+		return entry, nil
+	}
+	if err != nil {
+		return entry, fmt.Errorf("loading indexed certificate: %v", err)
+	}
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	entry.Superseded = err != nil || certFingerprint(certs[0]) != entry.SHA256
+	return entry, nil
+}
+
+// RebuildCertificateIndex adds all certificates in storage to the
+// index, such as ones stored before the index existed, or by other
+// software. It returns the number of certificates that were indexed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) RebuildCertificateIndex(ctx context.Context) (int, error) {
+	issuerPrefixes, err := cfg.Storage.List(ctx, prefixCerts, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	for _, issuerPrefix := range issuerPrefixes {
+		sitePrefixes, err := cfg.Storage.List(ctx, issuerPrefix, false)
+		if err != nil {
+			return count, fmt.Errorf("listing %s: %v", issuerPrefix, err)
+		}
+		for _, sitePrefix := range sitePrefixes {
+			if err := ctx.Err(); err != nil {
+				return count, err
+			}
+			certKey := path.Join(sitePrefix, path.Base(sitePrefix)+".crt")
+			certPEM, err := cfg.Storage.Load(ctx, certKey)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return count, fmt.Errorf("loading %s: %v", certKey, err)
+			}
+			if err := cfg.indexCertificate(ctx, path.Base(issuerPrefix), certKey, certPEM); err != nil {
+				cfg.Logger.Error("unable to index certificate", zap.String("cert_key", certKey), zap.Error(err))
+				continue
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// indexCertificate adds the leaf certificate of certPEM, which is
+// stored at certKey, to the index.
+func (cfg *Config) indexCertificate(ctx context.Context, issuerKey, certKey string, certPEM []byte) error {
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return err
+	}
+	leaf := certs[0]
+	entry := CertificateIndexEntry{
+		Serial:    leaf.SerialNumber.Text(16),
+		SHA256:    certFingerprint(leaf),
+		Names:     certNames(leaf),
+		IssuerKey: issuerKey,
+		CertKey:   certKey,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  expiresAt(leaf),
+	}
+	entryJSON, err := json.MarshalIndent(entry, "", "\t")
+	if err != nil {
+		return err
+	}
+	return storeTx(ctx, cfg.Storage, []keyValue{
+		{key: StorageKeys.SerialIndex(entry.Serial), value: entryJSON},
+		{key: StorageKeys.FingerprintIndex(entry.SHA256), value: entryJSON},
+	})
+}
+
+// deleteExpiredIndexEntries deletes the index entries of certificates
+// that expired more than gracePeriod ago.
+func deleteExpiredIndexEntries(ctx context.Context, storage Storage, logger *zap.Logger, gracePeriod time.Duration) error {
+	for _, prefix := range []string{path.Join(prefixIndex, "serial"), path.Join(prefixIndex, "sha256")} {
+		keys, err := storage.List(ctx, prefix, false)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			data, err := storage.Load(ctx, key)
+			if err != nil {
+				continue // deleted in the meantime, probably
+			}
+			var entry CertificateIndexEntry
+			if err := json.Unmarshal(data, &entry); err == nil && timeNow().Sub(entry.NotAfter) < gracePeriod {
+				continue
+			}
+			logger.Info("deleting index entry of expired certificate", zap.String("key", key))
+			if err := storage.Delete(ctx, key); err != nil {
+				logger.Error("unable to delete index entry", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// certNames returns the names on cert for the certificate index.
+func certNames(cert *x509.Certificate) []string {
+	names := append([]string(nil), cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, email)
+	}
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	if len(names) == 0 && cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// SerialIndex returns the storage key for the index entry of
+// the certificate with the given serial number, in hex.
+func (keys KeyBuilder) SerialIndex(serial string) string {
+	return path.Join(prefixIndex, "serial", keys.Safe(serial)+".json")
+}
+
+// FingerprintIndex returns the storage key for the index entry of
+// the certificate with the given SHA-256 fingerprint, in hex.
+func (keys KeyBuilder) FingerprintIndex(sha256Hex string) string {
+	return path.Join(prefixIndex, "sha256", keys.Safe(sha256Hex)+".json")
+}
+
+const prefixIndex = "index"
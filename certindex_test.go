@@ -0,0 +1,93 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateIndex(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := cert.Leaf.SerialNumber.Text(16)
+	fingerprint := certFingerprint(cert.Leaf)
+
+	entry, err := cfg.LookupCertificateBySerial(ctx, "00:"+strings.ToUpper(serial))
+	if err != nil {
+		t.Fatalf("looking up serial: %v", err)
+	}
+	if entry.SHA256 != fingerprint || !slices.Equal(entry.Names, []string{"example.com"}) ||
+		entry.IssuerKey != "fake" || entry.CertKey != StorageKeys.SiteCert("fake", "example.com") || entry.Superseded {
+		t.Errorf("unexpected index entry: %+v", entry)
+	}
+	if entry, err := cfg.LookupCertificateByFingerprint(ctx, strings.ToUpper(fingerprint)); err != nil || entry.Serial != serial {
+		t.Errorf("expected entry by fingerprint, got %+v (err=%v)", entry, err)
+	}
+	if _, err := cfg.LookupCertificateBySerial(ctx, "abcdef"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error for unknown serial, got %v", err)
+	}
+
+	// after renewal, the old certificate is superseded
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := cfg.LookupCertificateBySerial(ctx, serial); err != nil || !entry.Superseded {
+		t.Errorf("expected superseded entry, got %+v (err=%v)", entry, err)
+	}
+
+	// rebuilding indexes certificates that are not in the index
+	if err := cfg.Storage.Delete(ctx, prefixIndex); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := cfg.RebuildCertificateIndex(ctx); err != nil || count != 1 {
+		t.Errorf("expected 1 certificate to be indexed, got %d (err=%v)", count, err)
+	}
+	renewed, err := cfg.loadCertResource(ctx, new(FakeIssuer), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := parseCertsFromPEMBundle(renewed.CertificatePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := cfg.LookupCertificateBySerial(ctx, certs[0].SerialNumber.Text(16)); err != nil || entry.Superseded {
+		t.Errorf("expected current entry after rebuild, got %+v (err=%v)", entry, err)
+	}
+
+	// cleaning storage deletes entries of expired certificates
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	faults.set(200*24*time.Hour, false)
+	if err := CleanStorage(ctx, cfg.Storage, CleanStorageOptions{ExpiredCerts: true, Logger: cfg.Logger}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.LookupCertificateBySerial(ctx, certs[0].SerialNumber.Text(16)); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected index entry of expired certificate to be deleted, got %v", err)
+	}
+}
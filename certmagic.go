@@ -55,7 +55,8 @@ import (
 )
 
 // HTTPS serves mux for all domainNames using the HTTP
-// and HTTPS ports, redirecting all HTTP requests to HTTPS.
+// and HTTPS ports (or HTTPAddress and HTTPSAddress),
+// redirecting all HTTP requests to HTTPS.
 // It uses the Default config and a background context.
 //
 // This high-level convenience function is opinionated and
@@ -92,7 +93,7 @@ func HTTPS(domainNames []string, mux http.Handler) error {
 	// and clean them up when all servers are done
 	lnMu.Lock()
 	if httpLn == nil && httpsLn == nil {
-		httpLn, err = net.Listen("tcp", fmt.Sprintf(":%d", HTTPPort))
+		httpLn, err = takeBoundListener(&boundHTTPLn, httpListenAddress())
 		if err != nil {
 			lnMu.Unlock()
 			return err
@@ -101,13 +102,14 @@ func HTTPS(domainNames []string, mux http.Handler) error {
 		tlsConfig := cfg.TLSConfig()
 		tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
 
-		httpsLn, err = tls.Listen("tcp", fmt.Sprintf(":%d", HTTPSPort), tlsConfig)
+		httpsLn, err = takeBoundListener(&boundHTTPSLn, httpsListenAddress())
 		if err != nil {
 			httpLn.Close()
 			httpLn = nil
 			lnMu.Unlock()
 			return err
 		}
+		httpsLn = tls.NewListener(httpsLn, tlsConfig)
 
 		go func() {
 			httpWg.Wait()
@@ -208,7 +210,11 @@ func Listen(domainNames []string) (net.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
-	return tls.Listen("tcp", fmt.Sprintf(":%d", HTTPSPort), cfg.TLSConfig())
+	ln, err := takeBoundListener(&boundHTTPSLn, httpsListenAddress())
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, cfg.TLSConfig()), nil
 }
 
 // ManageSync obtains certificates for domainNames and keeps them
@@ -259,11 +265,11 @@ func ManageAsync(ctx context.Context, domainNames []string) error {
 // config is used as a template), this struct regulates
 // certificate operations using an implicit whitelist
 // containing the names passed into those functions if
-// no DecisionFunc is set. This ensures some degree of
-// control by default to avoid certificate operations for
-// arbitrary domain names. To override this whitelist,
-// manually specify a DecisionFunc. To impose rate limits,
-// specify your own DecisionFunc.
+// no DecisionFunc or Permission is set. This ensures some
+// degree of control by default to avoid certificate
+// operations for arbitrary domain names. To override this
+// whitelist, manually specify a DecisionFunc or Permission.
+// To impose rate limits, use an OnDemandPolicy.
 type OnDemandConfig struct {
 	// If set, this function will be called to determine
 	// whether a certificate can be obtained or renewed
@@ -271,6 +277,15 @@ type OnDemandConfig struct {
 	// request will be denied.
 	DecisionFunc func(ctx context.Context, name string) error
 
+	// If set, it is asked whether a certificate can be
+	// obtained or renewed for a name, like DecisionFunc;
+	// if both are set, both must allow it. If it is an
+	// OnDemandObtainLimiter, it is also asked before a
+	// new certificate is obtained during a handshake.
+	// See OnDemandPolicy.
+	// EXPERIMENTAL: Subject to change or removal.
+	Permission OnDemandPermission
+
 	// Sources for getting new, unmanaged certificates.
 	// They will be invoked only during TLS handshakes
 	// before on-demand certificate management occurs,
@@ -381,6 +396,46 @@ const (
 	// configured issuers, then uses the first one
 	// that successfully returns a certificate.
 	UseFirstRandomIssuer = "first_random"
+
+	// UsePrimaryIssuer uses the first configured issuer that
+	// is healthy (the primary), and fails over to the next
+	// ones (the standbys) while it is not. Once the primary
+	// recovers, it is used again (see IssuerFailbackDelay).
+	// EXPERIMENTAL: Subject to change or removal.
+	UsePrimaryIssuer = "primary"
+
+	// UseWeightedRandomIssuer chooses among the healthy issuers
+	// at random, in proportion to their IssuerWeights, then fails
+	// over to the other healthy issuers in the same way, and to
+	// the unhealthy issuers last.
+	// EXPERIMENTAL: Subject to change or removal.
+	UseWeightedRandomIssuer = "weighted_random"
+)
+
+// RenewalIssuerPolicy enumerates how to choose the issuers
+// to renew a certificate with, given the issuer of the
+// certificate being renewed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type RenewalIssuerPolicy string
+
+// Supported renewal issuer policies.
+const (
+	// RenewWithConfiguredIssuers tries the configured issuers
+	// in order, regardless of which one issued the certificate
+	// being renewed. This is the default.
+	RenewWithConfiguredIssuers RenewalIssuerPolicy = "configured"
+
+	// RenewWithSameIssuer tries the issuer of the certificate
+	// being renewed first (issuer affinity), then the other
+	// configured issuers in order.
+	RenewWithSameIssuer RenewalIssuerPolicy = "same"
+
+	// RenewWithNextIssuer tries the configured issuer after the
+	// issuer of the certificate being renewed first (issuer
+	// rotation), then the others in order, wrapping around, so
+	// that the issuer of the certificate being renewed is last.
+	RenewWithNextIssuer RenewalIssuerPolicy = "rotate"
 )
 
 // IssuedCertificate represents a certificate that was just issued.
@@ -392,6 +447,14 @@ type IssuedCertificate struct {
 	// certificate in storage. It MUST be serializable
 	// as JSON in order to be preserved.
 	Metadata any
+
+	// The PEM-encoding of the private key of the certificate,
+	// for issuers that generate the key pair themselves
+	// rather than certifying the key of the CSR, such as
+	// the SPIFFE Workload API. If set, this key is stored
+	// with the certificate instead of the CSR's key.
+	// EXPERIMENTAL: Subject to change or removal.
+	PrivateKeyPEM []byte
 }
 
 // CertificateResource associates a certificate with its private
@@ -413,16 +476,32 @@ type CertificateResource struct {
 	// usually provided by the issuer implementation.
 	IssuerData json.RawMessage `json:"issuer_data,omitempty"`
 
+	// The keys of the issuers of this certificate and the
+	// ones it renewed, most recent first (so the first one
+	// issued this certificate), up to maxIssuerHistory.
+	// Empty for certificates stored by older versions.
+	IssuerHistory []string `json:"issuer_history,omitempty"`
+
 	// The unique string identifying the issuer of the
 	// certificate; internally useful for storage access.
 	issuerKey string
+
+	// The name the resource is stored under, if it is
+	// not the key of its SANs, as for certificates of
+	// groups of names (see Config.SubjectAltNames).
+	namesKey string
 }
 
 // NamesKey returns the list of SANs as a single string,
 // truncated to some ridiculously long size limit. It
 // can act as a key for the set of names on the resource.
+// Certificates of groups of names (see SubjectAltNames
+// in Config) are keyed by the name they are managed under.
 func (cr *CertificateResource) NamesKey() string {
 	sort.Strings(cr.SANs)
+	if cr.namesKey != "" {
+		return cr.namesKey
+	}
 	result := strings.Join(cr.SANs, ",")
 	if len(result) > 1024 {
 		const trunc = "_trunc"
@@ -489,6 +568,23 @@ var (
 	HTTPSPort = 443
 )
 
+// httpListenAddress returns the address on which HTTPS serves HTTP.
+func httpListenAddress() string {
+	if HTTPAddress != "" {
+		return HTTPAddress
+	}
+	return fmt.Sprintf(":%d", HTTPPort)
+}
+
+// httpsListenAddress returns the address on which HTTPS and
+// Listen serve HTTPS.
+func httpsListenAddress() string {
+	if HTTPSAddress != "" {
+		return HTTPSAddress
+	}
+	return fmt.Sprintf(":%d", HTTPSPort)
+}
+
 // Variables for conveniently serving HTTPS.
 var (
 	httpLn, httpsLn net.Listener
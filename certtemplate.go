@@ -0,0 +1,150 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CertificateTemplate defines the shape of certificates issued by an
+// InternalIssuer, so that one CA can issue, for example, certificates
+// for web servers, for mTLS clients, and for service meshes.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CertificateTemplate struct {
+	// The key usages of the certificate. For RSA keys,
+	// KeyEncipherment is added to the default.
+	// Default: x509.KeyUsageDigitalSignature.
+	KeyUsage x509.KeyUsage
+
+	// The extended key usages of the certificate.
+	// Default: server and client authentication.
+	ExtKeyUsage []x509.ExtKeyUsage
+
+	// The validity period of the certificate; if set, it
+	// takes precedence over the lifetime requested by the
+	// config and the default lifetime of the issuer.
+	Lifetime time.Duration
+
+	// Whether to set the first name as the common name of
+	// the subject, for clients that still require one.
+	CommonName bool
+
+	// The types of names the certificate can have: "dns",
+	// "ip", "email", "uri", and "othername". Default: all.
+	SANTypes []string
+
+	// The maximum number of names of the certificate.
+	// Default: no limit.
+	MaxNames int
+
+	// If set, names must also be permitted by these name
+	// constraints, in addition to those of the issuer.
+	NameConstraints *NameConstraints
+
+	// Extensions to add to the certificate.
+	ExtraExtensions []pkix.Extension
+}
+
+// WithCertificateTemplate returns a context that selects the template
+// with the given name for certificates issued by an InternalIssuer, for
+// example in calls to Config.ObtainCertSync. Renewals during maintenance
+// do not carry the context; to select the template of renewals, use
+// InternalIssuer.SelectTemplate.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func WithCertificateTemplate(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, ctxKeyCertTemplate, name)
+}
+
+// check returns an error if the template does not allow names.
+func (ct *CertificateTemplate) check(names []string) error {
+	if ct.MaxNames > 0 && len(names) > ct.MaxNames {
+		return fmt.Errorf("certificate template allows at most %d names, got %d", ct.MaxNames, len(names))
+	}
+	if len(ct.SANTypes) > 0 {
+		for _, name := range names {
+			if sanType := sanTypeOf(name); !slices.Contains(ct.SANTypes, sanType) {
+				return fmt.Errorf("certificate template does not allow %s names: %s", sanType, name)
+			}
+		}
+	}
+	return ct.NameConstraints.Check(names)
+}
+
+// apply sets the shape defined by the template on the certificate
+// template for names, whose public key is pub.
+func (ct *CertificateTemplate) apply(tpl *x509.Certificate, names []string, pub any) {
+	tpl.KeyUsage = ct.KeyUsage
+	if tpl.KeyUsage == 0 {
+		tpl.KeyUsage = x509.KeyUsageDigitalSignature
+		if _, ok := pub.(*rsa.PublicKey); ok {
+			tpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+	}
+	tpl.ExtKeyUsage = ct.ExtKeyUsage
+	if len(tpl.ExtKeyUsage) == 0 {
+		tpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	}
+	if ct.CommonName && len(names) > 0 {
+		tpl.Subject.CommonName = names[0]
+	}
+	tpl.ExtraExtensions = append(tpl.ExtraExtensions, ct.ExtraExtensions...)
+}
+
+// sanTypeOf returns the type of the name, as used by
+// CertificateTemplate.SANTypes.
+func sanTypeOf(name string) string {
+	if _, _, ok := ParseOtherNameSubject(name); ok {
+		return "othername"
+	}
+	switch {
+	case SubjectIsURI(name):
+		return "uri"
+	case net.ParseIP(name) != nil:
+		return "ip"
+	case strings.Contains(name, "@"):
+		return "email"
+	default:
+		return "dns"
+	}
+}
+
+// template returns the certificate template for an issuance for names.
+func (iss *InternalIssuer) template(ctx context.Context, names []string) (*CertificateTemplate, error) {
+	name, _ := ctx.Value(ctxKeyCertTemplate).(string)
+	if name == "" && iss.SelectTemplate != nil {
+		name = iss.SelectTemplate(ctx, names)
+	}
+	if name == "" {
+		name = iss.DefaultTemplate
+	}
+	if name == "" {
+		return new(CertificateTemplate), nil
+	}
+	tpl, ok := iss.Templates[name]
+	if !ok || tpl == nil {
+		return nil, fmt.Errorf("unknown certificate template: %s", name)
+	}
+	return tpl, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInternalIssuerTemplates(t *testing.T) {
+	ctx := context.Background()
+	iss := &InternalIssuer{
+		Storage: &FileStorage{Path: t.TempDir()},
+		Templates: map[string]*CertificateTemplate{
+			"web": {
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+				Lifetime:    24 * time.Hour,
+				SANTypes:    []string{"dns", "ip"},
+			},
+			"client": {
+				ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				Lifetime:    time.Hour,
+				CommonName:  true,
+				MaxNames:    1,
+			},
+		},
+		DefaultTemplate: "web",
+		SelectTemplate: func(_ context.Context, names []string) string {
+			if strings.HasSuffix(names[0], ".clients.internal") {
+				return "client"
+			}
+			return ""
+		},
+	}
+	issue := func(ctx context.Context, names ...string) (*x509.Certificate, error) {
+		issued, err := iss.Issue(ctx, newInternalTestCSR(t, names...))
+		if err != nil {
+			return nil, err
+		}
+		chain, err := parseCertsFromPEMBundle(issued.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain[0], nil
+	}
+
+	leaf, err := issue(ctx, "app.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(leaf.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) || leaf.Subject.CommonName != "" {
+		t.Errorf("expected default web template, got EKUs %v and CN %q", leaf.ExtKeyUsage, leaf.Subject.CommonName)
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime != 24*time.Hour {
+		t.Errorf("expected lifetime of template, got %s", lifetime)
+	}
+
+	leaf, err = issue(ctx, "bob.clients.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(leaf.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) || leaf.Subject.CommonName != "bob.clients.internal" {
+		t.Errorf("expected selected client template, got EKUs %v and CN %q", leaf.ExtKeyUsage, leaf.Subject.CommonName)
+	}
+	if _, err := issue(ctx, "bob.clients.internal", "alice.clients.internal"); err == nil {
+		t.Error("expected error for too many names")
+	}
+
+	// the template of the context takes precedence
+	leaf, err = issue(WithCertificateTemplate(ctx, "client"), "svc.internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaf.Subject.CommonName != "svc.internal" {
+		t.Error("expected template selected by context")
+	}
+	if _, err := issue(WithCertificateTemplate(ctx, "mesh"), "svc.internal"); err == nil {
+		t.Error("expected error for unknown template")
+	}
+	if err := iss.PreCheck(ctx, []string{"spiffe://internal/svc"}, false); err == nil {
+		t.Error("expected pre-check error for URI with web template")
+	}
+}
+
+func TestSANTypeOf(t *testing.T) {
+	for name, want := range map[string]string{
+		"example.com":            "dns",
+		"*.example.com":          "dns",
+		"10.0.0.1":               "ip",
+		"::1":                    "ip",
+		"me@example.com":         "email",
+		"spiffe://example/svc":   "uri",
+		"urn:uuid:1234":          "uri",
+		"othername:1.2.3:abcdef": "othername",
+	} {
+		if got := sanTypeOf(name); got != want {
+			t.Errorf("%s: expected %s, got %s", name, want, got)
+		}
+	}
+}
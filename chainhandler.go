@@ -0,0 +1,102 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ChainHandler returns an HTTP handler that serves the current public
+// certificate chain of the certificate for a name, as stored by cfg, so
+// that internal clients and provisioning scripts can fetch it, e.g. to
+// pin it or to update trust stores, without access to storage. The name
+// is the first segment of the request path (use http.StripPrefix to
+// mount the handler under a prefix), optionally followed by the part of
+// the chain to serve, named like the files of certbot:
+//
+//	/<name>                the leaf and intermediate certificates
+//	/<name>/fullchain.pem  the same
+//	/<name>/cert.pem       only the leaf certificate
+//	/<name>/chain.pem      only the CA bundle (the intermediates)
+//
+// Certificates are served PEM-encoded, with an ETag so that clients can
+// poll for changes cheaply with If-None-Match. Private keys are never
+// served. The certificates are public, but the handler reveals which
+// names are managed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) ChainHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name, part, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		name = normalizedName(name)
+		if name == "" {
+			http.Error(w, "missing name in path", http.StatusBadRequest)
+			return
+		}
+
+		certRes, err := cfg.loadCertResourceAnyIssuer(r.Context(), name)
+		if errors.Is(err, fs.ErrNotExist) {
+			http.Error(w, "no certificate for "+name, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		chain, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+		if err != nil {
+			http.Error(w, "decoding certificate: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch part {
+		case "", "fullchain.pem":
+		case "cert.pem":
+			chain = chain[:1]
+		case "chain.pem":
+			chain = chain[1:]
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if len(chain) == 0 {
+			http.Error(w, "the chain has no CA certificates", http.StatusNotFound)
+			return
+		}
+		var body bytes.Buffer
+		for _, cert := range chain {
+			pem.Encode(&body, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+		}
+
+		sum := sha256.Sum256(body.Bytes())
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body.Bytes()))
+	})
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChainHandler(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil || len(chain) != 2 {
+		t.Fatalf("expected chain of 2 certificates, got %d (error: %v)", len(chain), err)
+	}
+
+	handler := http.StripPrefix("/certs", cfg.ChainHandler())
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, tc := range []struct {
+		path   string
+		expect [][]byte
+	}{
+		{path: "/certs/example.com", expect: [][]byte{chain[0].Raw, chain[1].Raw}},
+		{path: "/certs/EXAMPLE.com/fullchain.pem", expect: [][]byte{chain[0].Raw, chain[1].Raw}},
+		{path: "/certs/example.com/cert.pem", expect: [][]byte{chain[0].Raw}},
+		{path: "/certs/example.com/chain.pem", expect: [][]byte{chain[1].Raw}},
+	} {
+		w := get(tc.path, nil)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d: %s", tc.path, w.Code, w.Body)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/pem-certificate-chain" {
+			t.Errorf("%s: unexpected content type %s", tc.path, ct)
+		}
+		if strings.Contains(w.Body.String(), "PRIVATE KEY") {
+			t.Fatalf("%s: served a private key", tc.path)
+		}
+		got, err := parseCertsFromPEMBundle(w.Body.Bytes())
+		if err != nil || len(got) != len(tc.expect) {
+			t.Errorf("%s: expected %d certificates, got %d (error: %v)", tc.path, len(tc.expect), len(got), err)
+			continue
+		}
+		for i := range got {
+			if !bytes.Equal(got[i].Raw, tc.expect[i]) {
+				t.Errorf("%s: unexpected certificate %d", tc.path, i)
+			}
+		}
+	}
+
+	etag := get("/certs/example.com", nil).Header().Get("ETag")
+	if w := get("/certs/example.com", http.Header{"If-None-Match": {etag}}); w.Code != http.StatusNotModified {
+		t.Errorf("expected status 304 for unchanged chain, got %d", w.Code)
+	}
+	for path, status := range map[string]int{
+		"/certs/other.example.com":   http.StatusNotFound,
+		"/certs/example.com/key.pem": http.StatusNotFound,
+		"/certs/":                    http.StatusBadRequest,
+	} {
+		if w := get(path, nil); w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", path, status, w.Code)
+		}
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/certs/example.com", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status 405 for POST, got %d", w.Code)
+	}
+}
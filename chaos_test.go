@@ -0,0 +1,276 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// faultInjector injects faults into maintenance, so that tests can
+// verify how it recovers from them. It takes effect through the hooks
+// that production code calls (timeNow and ocspHTTPClient), which are
+// replaced below; regular builds contain no fault injection.
+//
+// Storage faults (corruption, partial writes, errors) are injected
+// by using a FaultyStorage, so they are not part of this interface.
+type faultInjector interface {
+	// now returns the current time; it can jump
+	// around to simulate clock changes.
+	now() time.Time
+
+	// ocspTransport wraps the transport used for requests
+	// to OCSP responders and issuer certificate URLs, to
+	// simulate responder errors.
+	ocspTransport(next http.RoundTripper) http.RoundTripper
+}
+
+// activeFaults holds the faultInjector, if any.
+var activeFaults atomic.Pointer[faultInjector]
+
+// The hooks are installed once, before any test runs; tests
+// only swap the injector, so that background goroutines of
+// other tests do not race with them.
+func init() {
+	timeNow = func() time.Time {
+		if fi := activeFaults.Load(); fi != nil {
+			return (*fi).now()
+		}
+		return time.Now()
+	}
+	ocspHTTPClient = func(client *http.Client) *http.Client {
+		fi := activeFaults.Load()
+		if fi == nil {
+			return client
+		}
+		wrapped := *client
+		next := wrapped.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		wrapped.Transport = (*fi).ocspTransport(next)
+		return &wrapped
+	}
+}
+
+// testFaults is a faultInjector with a clock that can be
+// moved and OCSP responders that can be taken down.
+type testFaults struct {
+	mu            sync.Mutex
+	clockOffset   time.Duration
+	responderDown bool
+}
+
+func (tf *testFaults) now() time.Time {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	return time.Now().Add(tf.clockOffset)
+}
+
+func (tf *testFaults) ocspTransport(next http.RoundTripper) http.RoundTripper {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		tf.mu.Lock()
+		down := tf.responderDown
+		tf.mu.Unlock()
+		if down {
+			return &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Body:       io.NopCloser(strings.NewReader("unavailable")),
+				Request:    req,
+			}, nil
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+func (tf *testFaults) set(clockOffset time.Duration, responderDown bool) {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	tf.clockOffset = clockOffset
+	tf.responderDown = responderDown
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+// setFaultInjector sets the fault injector for the duration of the test.
+func setFaultInjector(t *testing.T, fi faultInjector) {
+	activeFaults.Store(&fi)
+	t.Cleanup(func() { activeFaults.Store(nil) })
+}
+
+// newFakeOCSPResponder starts a responder that answers for
+// certificates issued by fi with responses valid for a day.
+func newFakeOCSPResponder(t *testing.T, fi *FakeIssuer) {
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("parsing OCSP request: %v", err)
+			return
+		}
+		for _, leaf := range fi.Issued() {
+			if leaf.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				resp, err := fi.OCSPResponse(leaf, 24*time.Hour)
+				if err != nil {
+					t.Errorf("making OCSP response: %v", err)
+				}
+				w.Write(resp)
+				return
+			}
+		}
+		w.Write(ocsp.UnauthorizedErrorResponse)
+	}))
+	t.Cleanup(responder.Close)
+	fi.OCSPServer = responder.URL
+}
+
+func TestMaintenanceRecoversFromFaults(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	newFakeOCSPResponder(t, fi)
+	storage := &FaultyStorage{Storage: &FileStorage{Path: t.TempDir()}, PartialWrites: true}
+
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           zap.NewNop(),
+	})
+	t.Cleanup(cache.Stop)
+	cfg = New(cache, Config{Issuers: []Issuer{fi}, Storage: storage, Logger: zap.NewNop()})
+
+	cert, bundle := issueFakeCertificate(t, fi, "example.com")
+	if err := stapleOCSP(ctx, cfg.OCSP, storage, &cert, bundle); err != nil {
+		t.Fatalf("stapling OCSP: %v", err)
+	}
+	cache.cacheCertificate(cert)
+	stapleKey := StorageKeys.OCSPStaple(&cert, bundle)
+	original := cert.Certificate.OCSPStaple
+
+	cached := func() Certificate {
+		t.Helper()
+		certs := cache.getAllMatchingCerts("example.com")
+		if len(certs) != 1 {
+			t.Fatalf("expected 1 cached certificate, got %d", len(certs))
+		}
+		return certs[0]
+	}
+
+	// the clock jumps past the refresh time while the responder is
+	// down: the old staple is still valid, so it should be kept
+	faults.set(13*time.Hour, true)
+	cache.updateOCSPStaples(ctx)
+	if !bytes.Equal(cached().Certificate.OCSPStaple, original) {
+		t.Error("expected valid staple to be kept while responder is down")
+	}
+
+	// the clock jumps past the staple's expiration: it must not be served anymore
+	faults.set(25*time.Hour, true)
+	cache.updateOCSPStaples(ctx)
+	if c := cached(); c.Certificate.OCSPStaple != nil || c.ocsp != nil {
+		t.Error("expected expired staple to be removed")
+	}
+
+	// expired staples are purged from storage, too
+	if err := deleteOldOCSPStaples(ctx, storage, zap.NewNop()); err != nil {
+		t.Fatalf("deleting old staples: %v", err)
+	}
+	if storage.Exists(ctx, stapleKey) {
+		t.Error("expected expired staple to be deleted from storage")
+	}
+
+	// the clock is corrected and the responder comes back, but
+	// writing the new staple is interrupted: the partial file
+	// must not break the next maintenance run
+	faults.set(0, false)
+	storage.Fault = func(op StorageOp, key string) error {
+		if op == StorageOpStore && key == stapleKey {
+			return errors.New("interrupted")
+		}
+		return nil
+	}
+	cache.updateOCSPStaples(ctx)
+	if partial, err := storage.Storage.Load(ctx, stapleKey); err != nil || len(partial) == 0 {
+		t.Fatalf("expected partially written staple in storage (err=%v)", err)
+	}
+
+	storage.Fault = nil
+	cache.updateOCSPStaples(ctx)
+	c := cached()
+	if c.Certificate.OCSPStaple == nil || c.ocsp == nil || c.ocsp.Status != ocsp.Good {
+		t.Fatal("expected staple to be restored")
+	}
+	stored, err := storage.Load(ctx, stapleKey)
+	if err != nil || !bytes.Equal(stored, c.Certificate.OCSPStaple) {
+		t.Errorf("expected partial staple to be replaced in storage (err=%v)", err)
+	}
+
+	// a corrupted staple in storage is replaced, even when the cached one is stale
+	storage.Corrupt = func(key string, value []byte) []byte {
+		if key == stapleKey {
+			return value[:len(value)/3]
+		}
+		return value
+	}
+	faults.set(13*time.Hour, false)
+	cache.updateOCSPStaples(ctx)
+	storage.Corrupt = nil
+	if c := cached(); c.Certificate.OCSPStaple == nil {
+		t.Error("expected staple to be refreshed despite corrupted storage")
+	}
+	if stored, err := storage.Load(ctx, stapleKey); err != nil {
+		t.Errorf("expected refreshed staple in storage: %v", err)
+	} else if _, err := ocsp.ParseResponse(stored, nil); err != nil {
+		t.Errorf("expected valid staple in storage: %v", err)
+	}
+}
+
+func TestRenewalWindowWithClockJump(t *testing.T) {
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	cert, _ := issueFakeCertificate(t, fi, "example.com")
+	cfg := newOnDemandTestConfig(t, fi)
+
+	if cert.Expired() || cfg.certNeedsRenewal(cert.Leaf, acme.RenewalInfo{}, false) {
+		t.Fatal("fresh certificate should neither be expired nor need renewal")
+	}
+	faults.set(80*24*time.Hour, false)
+	if cert.Expired() || !cfg.certNeedsRenewal(cert.Leaf, acme.RenewalInfo{}, false) {
+		t.Error("expected certificate to need renewal after clock jump into renewal window")
+	}
+	faults.set(91*24*time.Hour, false)
+	if !cert.Expired() {
+		t.Error("expected certificate to be expired after clock jump past expiration")
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultCloudCALifetime is the validity period of certificates issued
+// by cloud CA services, unless the config requests a lifetime; their
+// APIs require one. Certificates are renewed as usual, according to
+// the renewal window of the config.
+const DefaultCloudCALifetime = 30 * 24 * time.Hour
+
+// AWSPrivateCAClient is the part of the AWS Private CA API (ACM PCA) that
+// AWSPrivateCAIssuer needs. It is typically implemented with the acmpca
+// client of the AWS SDK, which certmagic does not depend on.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AWSPrivateCAClient interface {
+	// IssueCertificate calls the IssueCertificate API,
+	// and returns the ARN of the certificate.
+	IssueCertificate(ctx context.Context, req AWSIssueCertificateRequest) (certificateARN string, err error)
+
+	// GetCertificate calls the GetCertificate API, and returns
+	// the PEM-encoded certificate and chain. While the CA is
+	// still issuing the certificate (RequestInProgressException),
+	// the error must wrap ErrCertificatePending.
+	GetCertificate(ctx context.Context, caARN, certificateARN string) (certificate, chain []byte, err error)
+
+	// RevokeCertificate calls the RevokeCertificate API; reason
+	// is the RFC 5280 reason code, to be mapped to the name of
+	// the corresponding RevocationReason.
+	RevokeCertificate(ctx context.Context, caARN, serialHex string, reason int) error
+}
+
+// AWSIssueCertificateRequest is the input of the IssueCertificate API.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AWSIssueCertificateRequest struct {
+	CertificateAuthorityARN string
+	CSR                     []byte // PEM-encoded
+	SigningAlgorithm        string
+	TemplateARN             string
+
+	// The end of the validity period, as an ABSOLUTE validity.
+	NotAfter time.Time
+
+	// Identical requests within five minutes return the same
+	// certificate, so retries do not issue duplicates.
+	IdempotencyToken string
+}
+
+// ErrCertificatePending is returned by cloud CA clients while a
+// certificate is still being issued.
+var ErrCertificatePending = errors.New("certificate is pending")
+
+// AWSPrivateCAIssuer is an Issuer that gets certificates from a CA of
+// AWS Private CA.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AWSPrivateCAIssuer struct {
+	// The API client. Required.
+	Client AWSPrivateCAClient
+
+	// The ARN of the CA. Required.
+	CertificateAuthorityARN string
+
+	// The signing algorithm of the CA, such as "SHA256WITHECDSA".
+	// It must match the key type of the CA, not of certificates.
+	// Required.
+	SigningAlgorithm string
+
+	// The ARN of the certificate template. Default: the
+	// end-entity template of AWS Private CA.
+	TemplateARN string
+
+	// The validity period of certificates, unless the config
+	// requests a lifetime. Default: DefaultCloudCALifetime.
+	Lifetime time.Duration
+
+	// How often to poll for the certificate while it is
+	// being issued. Default: 1s.
+	PollInterval time.Duration
+
+	Logger *zap.Logger
+}
+
+// AWSPrivateCAMetadata is the metadata of certificates issued by
+// AWSPrivateCAIssuer.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AWSPrivateCAMetadata struct {
+	CertificateARN string `json:"certificate_arn"`
+}
+
+// IssuerKey returns the unique issuer key for the CA.
+func (iss *AWSPrivateCAIssuer) IssuerKey() string {
+	// the last part of the ARN is "certificate-authority/<id>"
+	return "aws_pca_" + StorageKeys.Safe(iss.CertificateAuthorityARN[strings.LastIndex(iss.CertificateAuthorityARN, "/")+1:])
+}
+
+// Issue requests a certificate for csr and waits until it is issued.
+func (iss *AWSPrivateCAIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	if iss.SigningAlgorithm == "" {
+		return nil, ErrNoRetry{fmt.Errorf("AWS Private CA issuer: no signing algorithm")}
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})
+	token := sha256.Sum256(csr.Raw)
+	certARN, err := iss.Client.IssueCertificate(ctx, AWSIssueCertificateRequest{
+		CertificateAuthorityARN: iss.CertificateAuthorityARN,
+		CSR:                     csrPEM,
+		SigningAlgorithm:        iss.SigningAlgorithm,
+		TemplateARN:             iss.TemplateARN,
+		NotAfter:                timeNow().Add(cloudCALifetime(ctx, iss.Lifetime)).Truncate(time.Second),
+		IdempotencyToken:        hex.EncodeToString(token[:])[:36],
+	})
+	if err != nil {
+		return nil, fmt.Errorf("AWS Private CA: issuing certificate: %w", err)
+	}
+
+	interval := iss.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	for {
+		cert, chain, err := iss.Client.GetCertificate(ctx, iss.CertificateAuthorityARN, certARN)
+		if err == nil {
+			if iss.Logger != nil {
+				iss.Logger.Debug("AWS Private CA issued certificate",
+					zap.Strings("identifiers", namesFromCSR(csr)),
+					zap.String("certificate_arn", certARN))
+			}
+			return &IssuedCertificate{
+				Certificate: joinPEM(cert, chain),
+				Metadata:    AWSPrivateCAMetadata{CertificateARN: certARN},
+			}, nil
+		}
+		if !errors.Is(err, ErrCertificatePending) {
+			return nil, fmt.Errorf("AWS Private CA: getting certificate %s: %w", certARN, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Revoke revokes the certificate with AWS Private CA.
+func (iss *AWSPrivateCAIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
+	if err != nil {
+		return err
+	}
+	return iss.Client.RevokeCertificate(ctx, iss.CertificateAuthorityARN, hex.EncodeToString(certs[0].SerialNumber.Bytes()), reason)
+}
+
+// GCPCASClient is the part of the Google Cloud Certificate Authority
+// Service API that GCPCASIssuer needs. It is typically implemented
+// with the privateca client of the Google Cloud SDK, which certmagic
+// does not depend on.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type GCPCASClient interface {
+	// CreateCertificate calls the CreateCertificate API, and
+	// returns the name of the certificate resource and the
+	// PEM-encoded certificate and chain.
+	CreateCertificate(ctx context.Context, req GCPCreateCertificateRequest) (name string, certificate, chain []byte, err error)
+
+	// RevokeCertificate calls the RevokeCertificate API for the
+	// certificate resource with the given name; reason is the
+	// RFC 5280 reason code, to be mapped to RevocationReason.
+	RevokeCertificate(ctx context.Context, name string, reason int) error
+}
+
+// GCPCreateCertificateRequest is the input of the CreateCertificate API.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type GCPCreateCertificateRequest struct {
+	Parent                        string // the CA pool
+	CertificateID                 string
+	CSR                           []byte // PEM-encoded
+	Lifetime                      time.Duration
+	IssuingCertificateAuthorityID string
+	CertificateTemplate           string
+
+	// Identical requests return the same certificate,
+	// so retries do not issue duplicates.
+	RequestID string
+}
+
+// GCPCASIssuer is an Issuer that gets certificates from a CA pool of
+// Google Cloud Certificate Authority Service.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type GCPCASIssuer struct {
+	// The API client. Required.
+	Client GCPCASClient
+
+	// The resource name of the CA pool, in the form
+	// "projects/*/locations/*/caPools/*". Required.
+	CAPool string
+
+	// The ID of the CA in the pool to issue from.
+	// Default: any enabled CA of the pool.
+	CertificateAuthority string
+
+	// The resource name of the certificate template.
+	CertificateTemplate string
+
+	// The validity period of certificates, unless the config
+	// requests a lifetime. Default: DefaultCloudCALifetime.
+	Lifetime time.Duration
+
+	Logger *zap.Logger
+}
+
+// GCPCASMetadata is the metadata of certificates issued by GCPCASIssuer.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type GCPCASMetadata struct {
+	Name string `json:"name"`
+}
+
+// IssuerKey returns the unique issuer key for the CA pool.
+func (iss *GCPCASIssuer) IssuerKey() string {
+	return "gcp_cas_" + StorageKeys.Safe(strings.ReplaceAll(iss.CAPool, "/", "_"))
+}
+
+// Issue creates a certificate for csr in the CA pool.
+func (iss *GCPCASIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	// IDs are the same for retries of the request, but not for later
+	// requests with the same CSR, as certificate IDs must be unique
+	hour := timeNow().Truncate(time.Hour).Unix()
+	sum := sha256.Sum256(fmt.Appendf(csr.Raw[:len(csr.Raw):len(csr.Raw)], "%d", hour))
+	id := hex.EncodeToString(sum[:])
+	name, cert, chain, err := iss.Client.CreateCertificate(ctx, GCPCreateCertificateRequest{
+		Parent:                        iss.CAPool,
+		CertificateID:                 "certmagic-" + id[:32],
+		CSR:                           pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}),
+		Lifetime:                      cloudCALifetime(ctx, iss.Lifetime),
+		IssuingCertificateAuthorityID: iss.CertificateAuthority,
+		CertificateTemplate:           iss.CertificateTemplate,
+		RequestID:                     fmt.Sprintf("%s-%s-%s-%s-%s", id[0:8], id[8:12], id[12:16], id[16:20], id[20:32]),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GCP CAS: creating certificate: %w", err)
+	}
+	if iss.Logger != nil {
+		iss.Logger.Debug("GCP CAS issued certificate",
+			zap.Strings("identifiers", namesFromCSR(csr)),
+			zap.String("name", name))
+	}
+	return &IssuedCertificate{
+		Certificate: joinPEM(cert, chain),
+		Metadata:    GCPCASMetadata{Name: name},
+	}, nil
+}
+
+// Revoke revokes the certificate with GCP CAS.
+func (iss *GCPCASIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	var meta GCPCASMetadata
+	if err := json.Unmarshal(cert.IssuerData, &meta); err != nil || meta.Name == "" {
+		return fmt.Errorf("GCP CAS: no certificate resource name in metadata of %v", cert.SANs)
+	}
+	return iss.Client.RevokeCertificate(ctx, meta.Name, reason)
+}
+
+// cloudCALifetime returns the validity period of a certificate: the
+// lifetime requested by the config, if any, else lifetime or the default.
+func cloudCALifetime(ctx context.Context, lifetime time.Duration) time.Duration {
+	if requested, ok := RequestedLifetime(ctx); ok {
+		return requested
+	}
+	if lifetime <= 0 {
+		return DefaultCloudCALifetime
+	}
+	return lifetime
+}
+
+// joinPEM joins a PEM-encoded certificate and its chain.
+func joinPEM(cert, chain []byte) []byte {
+	joined := append([]byte(nil), cert...)
+	if len(joined) > 0 && joined[len(joined)-1] != '\n' {
+		joined = append(joined, '\n')
+	}
+	return append(joined, chain...)
+}
+
+// Interface guards
+var (
+	_ Issuer  = (*AWSPrivateCAIssuer)(nil)
+	_ Revoker = (*AWSPrivateCAIssuer)(nil)
+	_ Issuer  = (*GCPCASIssuer)(nil)
+	_ Revoker = (*GCPCASIssuer)(nil)
+)
@@ -0,0 +1,181 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCloudCA signs the CSRs of cloud CA requests with an internal CA.
+type fakeCloudCA struct {
+	ca *InternalIssuer
+
+	mu      sync.Mutex
+	issued  map[string][]byte // by certificate ARN; nil while pending
+	polls   int
+	revoked []string
+	reqs    []AWSIssueCertificateRequest
+	gcpReqs []GCPCreateCertificateRequest
+}
+
+func (f *fakeCloudCA) sign(ctx context.Context, csrPEM []byte) ([]byte, error) {
+	block, _ := pem.Decode(csrPEM)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := f.ca.Issue(ctx, csr)
+	if err != nil {
+		return nil, err
+	}
+	return issued.Certificate, nil
+}
+
+func (f *fakeCloudCA) IssueCertificate(ctx context.Context, req AWSIssueCertificateRequest) (string, error) {
+	cert, err := f.sign(ctx, req.CSR)
+	if err != nil {
+		return "", err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.reqs = append(f.reqs, req)
+	arn := fmt.Sprintf("%s/certificate/%d", req.CertificateAuthorityARN, len(f.reqs))
+	if f.issued == nil {
+		f.issued = make(map[string][]byte)
+	}
+	f.issued[arn] = cert
+	return arn, nil
+}
+
+func (f *fakeCloudCA) GetCertificate(_ context.Context, _, certARN string) ([]byte, []byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.polls++
+	if f.polls == 1 {
+		return nil, nil, fmt.Errorf("RequestInProgressException: %w", ErrCertificatePending)
+	}
+	cert, ok := f.issued[certARN]
+	if !ok {
+		return nil, nil, fmt.Errorf("no certificate %s", certARN)
+	}
+	return cert, nil, nil
+}
+
+func (f *fakeCloudCA) RevokeCertificate(_ context.Context, _, serialHex string, _ int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = append(f.revoked, serialHex)
+	return nil
+}
+
+type fakeGCPCAS struct{ *fakeCloudCA }
+
+func (f fakeGCPCAS) CreateCertificate(ctx context.Context, req GCPCreateCertificateRequest) (string, []byte, []byte, error) {
+	cert, err := f.sign(ctx, req.CSR)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gcpReqs = append(f.gcpReqs, req)
+	return req.Parent + "/certificates/" + req.CertificateID, cert, nil, nil
+}
+
+func (f fakeGCPCAS) RevokeCertificate(_ context.Context, name string, _ int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = append(f.revoked, name)
+	return nil
+}
+
+func TestAWSPrivateCAIssuer(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeCloudCA{ca: &InternalIssuer{Storage: &FileStorage{Path: t.TempDir()}}}
+	iss := &AWSPrivateCAIssuer{
+		Client:                  fake,
+		CertificateAuthorityARN: "arn:aws:acm-pca:us-east-1:123456789012:certificate-authority/abcd-1234",
+		SigningAlgorithm:        "SHA256WITHECDSA",
+		PollInterval:            time.Millisecond,
+	}
+	if iss.IssuerKey() != "aws_pca_abcd-1234" {
+		t.Errorf("unexpected issuer key %s", iss.IssuerKey())
+	}
+	cfg := &Config{CertLifetime: 48 * time.Hour}
+	issued, err := iss.Issue(cfg.withRequestedLifetime(ctx, "app.internal"), newInternalTestCSR(t, "app.internal"))
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+	if fake.polls != 2 {
+		t.Errorf("expected to poll until issued, polled %d times", fake.polls)
+	}
+	req := fake.reqs[0]
+	if len(req.IdempotencyToken) != 36 {
+		t.Errorf("expected idempotency token of 36 characters, got %q", req.IdempotencyToken)
+	}
+	if lifetime := time.Until(req.NotAfter); lifetime < 47*time.Hour || lifetime > 48*time.Hour {
+		t.Errorf("expected requested lifetime, got %s", lifetime)
+	}
+	meta := issued.Metadata.(AWSPrivateCAMetadata)
+	if meta.CertificateARN != iss.CertificateAuthorityARN+"/certificate/1" {
+		t.Errorf("unexpected certificate ARN in metadata: %s", meta.CertificateARN)
+	}
+
+	certs, _ := parseCertsFromPEMBundle(issued.Certificate)
+	if err := iss.Revoke(ctx, CertificateResource{CertificatePEM: issued.Certificate}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.revoked) != 1 || fake.revoked[0] != hex.EncodeToString(certs[0].SerialNumber.Bytes()) {
+		t.Errorf("expected certificate to be revoked by serial, got %v", fake.revoked)
+	}
+}
+
+func TestGCPCASIssuer(t *testing.T) {
+	ctx := context.Background()
+	fake := fakeGCPCAS{&fakeCloudCA{ca: &InternalIssuer{Storage: &FileStorage{Path: t.TempDir()}}}}
+	iss := &GCPCASIssuer{Client: fake, CAPool: "projects/p/locations/us/caPools/pool"}
+	if iss.IssuerKey() != "gcp_cas_projects_p_locations_us_capools_pool" {
+		t.Errorf("unexpected issuer key %s", iss.IssuerKey())
+	}
+	issued, err := iss.Issue(ctx, newInternalTestCSR(t, "app.internal"))
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+	req := fake.gcpReqs[0]
+	if req.Lifetime != DefaultCloudCALifetime || len(req.CertificateID) > 63 || len(req.RequestID) != 36 {
+		t.Errorf("unexpected request: %+v", req)
+	}
+
+	metadata, err := json.Marshal(issued.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iss.Revoke(ctx, CertificateResource{CertificatePEM: issued.Certificate, IssuerData: metadata}, 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.revoked) != 1 || fake.revoked[0] != iss.CAPool+"/certificates/"+req.CertificateID {
+		t.Errorf("expected certificate to be revoked by name, got %v", fake.revoked)
+	}
+	if err := iss.Revoke(ctx, CertificateResource{CertificatePEM: issued.Certificate}, 4); err == nil {
+		t.Error("expected error revoking without metadata")
+	}
+}
@@ -27,11 +27,13 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	weakrand "math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -55,6 +57,14 @@ type Config struct {
 	// Ratio is remaining:total lifetime.
 	RenewalWindowRatio float64
 
+	// Optional windows of time, such as change freezes,
+	// during which certificates are not renewed or
+	// swapped automatically unless they would expire;
+	// deferred renewals happen after the windows end.
+	// See RenewalBlackout.
+	// EXPERIMENTAL: Subject to change or removal.
+	RenewalBlackouts []RenewalBlackout
+
 	// An optional event callback clients can set
 	// to subscribe to certain things happening
 	// internally by this config; invocations are
@@ -102,6 +112,49 @@ type Config struct {
 	// Default: UseFirstIssuer (subject to change).
 	IssuerPolicy IssuerPolicy
 
+	// The weights of issuers, by issuer key, for the
+	// UseWeightedRandomIssuer policy. Issuers without a
+	// weight have a weight of 1; issuers with a weight
+	// of 0 are only used if all others fail.
+	// EXPERIMENTAL: Subject to change or removal.
+	IssuerWeights map[string]int
+
+	// How long an issuer that failed to issue a certificate
+	// is considered unhealthy by the UsePrimaryIssuer and
+	// UseWeightedRandomIssuer policies; afterwards, it is
+	// used again if it passes its health check, in case it
+	// is an IssuerHealthChecker. Issuers that fail for reasons
+	// specific to a name are considered unhealthy, too.
+	// Default: DefaultIssuerFailbackDelay.
+	// EXPERIMENTAL: Subject to change or removal.
+	IssuerFailbackDelay time.Duration
+
+	// How to select which issuers to renew a certificate
+	// with, given the issuer of the certificate being
+	// renewed. Default: RenewWithConfiguredIssuers.
+	// EXPERIMENTAL: Subject to change or removal.
+	RenewalIssuerPolicy RenewalIssuerPolicy
+
+	// Optionally return the issuers to try, in order, to
+	// renew the certificate for a particular name, overriding
+	// RenewalIssuerPolicy if not empty; for example, to rotate
+	// among issuers on a schedule, or to pin names to an issuer.
+	// history has the keys of the issuers of the certificate
+	// being renewed and its predecessors, most recent first.
+	// The returned issuers should be among issuers, which are
+	// the configured issuers, or certificates they issue will
+	// not be found in storage.
+	// EXPERIMENTAL: Subject to change or removal.
+	RenewalIssuersFunc func(ctx context.Context, name string, history []string, issuers []Issuer) []Issuer
+
+	// How to choose which of several certificates with
+	// exactly the same names to keep, when a managed
+	// certificate is cached while an equivalent one is
+	// (see also RemoveDuplicateCertificates).
+	// Default: KeepLatestExpiringCert.
+	// EXPERIMENTAL: Subject to change or removal.
+	DuplicateCertPolicy DuplicateCertPolicy
+
 	// If true, private keys already existing in storage
 	// will be reused. Otherwise, a new key will be
 	// created for every new certificate to mitigate
@@ -127,6 +180,11 @@ type Config struct {
 	// risk and reduce their privacy.
 	OCSP OCSPConfig
 
+	// CRL configures revocation checking with CRLs,
+	// which is disabled by default.
+	// EXPERIMENTAL: Subject to change or removal.
+	CRL CRLConfig
+
 	// The storage to access when storing or loading
 	// TLS assets. Default is the local file system.
 	Storage Storage
@@ -149,6 +207,173 @@ type Config struct {
 	// EXPERIMENTAL: Subject to change or removal.
 	SubjectTransformer func(ctx context.Context, domain string) string
 
+	// If true, background obtain and renewal jobs are
+	// recorded in storage until they complete, along with
+	// their retry state, so that they can be inspected
+	// with Jobs, canceled with CancelJob, and resumed
+	// after a restart with ResumeJobs.
+	// EXPERIMENTAL: Subject to change or removal.
+	PersistJobs bool
+
+	// How to retry background obtain and renewal
+	// operations that fail. Short-lived certificates
+	// may need more frequent attempts than the default
+	// schedule, which is suited to 90-day certificates.
+	// Default: DefaultRetryPolicy.
+	// EXPERIMENTAL: Subject to change or removal.
+	RetryPolicy RetryPolicy
+
+	// The desired validity period of certificates,
+	// for issuers that support requesting one (for
+	// example, internal CAs, ZeroSSL, and some ACME
+	// CAs). Issuers that do not support it ignore it.
+	// Default: 0 (use the issuer's default).
+	// EXPERIMENTAL: Subject to change or removal.
+	CertLifetime time.Duration
+
+	// Optionally return the desired validity period for
+	// the certificate for a particular name, overriding
+	// CertLifetime if non-zero.
+	// EXPERIMENTAL: Subject to change or removal.
+	CertLifetimeFunc func(ctx context.Context, name string) time.Duration
+
+	// If set, certificates with less remaining validity
+	// than this are handled according to LowValidityAction
+	// when they would be served during a TLS handshake,
+	// so that certificates which failed to renew do not
+	// silently get served until they expire.
+	// EXPERIMENTAL: Subject to change or removal.
+	MinServingValidity time.Duration
+
+	// What to do when a certificate that would be served
+	// has less remaining validity than MinServingValidity.
+	// Default: LowValidityWarn.
+	// EXPERIMENTAL: Subject to change or removal.
+	LowValidityAction LowValidityAction
+
+	// Cross-signed CA certificates with which to extend
+	// the chains of served certificates, so that clients
+	// that only trust the root that cross-signed them can
+	// verify the chains, such as during a root transition.
+	// A cross-signed certificate is included in a chain if
+	// it signed the last certificate of the chain.
+	// EXPERIMENTAL: Subject to change or removal.
+	CrossSignedCertificates []*x509.Certificate
+
+	// Chooses which of the matching cross-signed certificates
+	// to include in a chain for a client. Default: all.
+	// EXPERIMENTAL: Subject to change or removal.
+	CrossSignPolicy CrossSignPolicy
+
+	// If set, expired certificates that are no longer
+	// needed are removed from the cache and storage
+	// during maintenance.
+	// EXPERIMENTAL: Subject to change or removal.
+	ExpiredCertGC *ExpiredCertGC
+
+	// How many previous versions of each certificate
+	// to keep in storage, so that a renewal that turns
+	// out to be broken can be undone with
+	// RollbackCertificate. Default: 0 (none).
+	// EXPERIMENTAL: Subject to change or removal.
+	CertificateHistory int
+
+	// Optionally return all the names that the certificate
+	// managed under name should have, such that a single
+	// certificate covers a group of names, for example a
+	// customer's domain and its subdomains. The returned
+	// names are normalized, and name is always included
+	// first. The certificate is stored, renewed, and
+	// looked up under name, but served for all of its
+	// names. Certificates get the new names at their next
+	// renewal; to reissue them right away when the names
+	// change, use ReissueIfSANsChanged.
+	// EXPERIMENTAL: Subject to change or removal.
+	SubjectAltNames func(ctx context.Context, name string) ([]string, error)
+
+	// Optionally inspect or modify each certificate
+	// request right before it is submitted to an
+	// issuer, for obtaining and renewing alike. It may
+	// replace req.CSR, for example to add extensions
+	// that are required by policy, or return an error
+	// to veto the issuance, for example during change
+	// freezes. Vetoed issuances are not tried with the
+	// other issuers, but are retried later when they
+	// run in the background, unless the error is an
+	// ErrNoRetry.
+	// EXPERIMENTAL: Subject to change or removal.
+	BeforeIssuance func(ctx context.Context, req *IssuanceRequest) error
+
+	// Optionally modify the chain of each certificate
+	// right after it was issued, before it is stored
+	// and cached: the returned chain is what gets
+	// stored and served. It may reorder, drop, or
+	// substitute the intermediate certificates, for
+	// example to drop a cross-signed intermediate or
+	// to append a private root for internal clients,
+	// but the leaf certificate must remain first.
+	// Returning an error fails the issuance, even
+	// though the issuer has issued the certificate.
+	// EXPERIMENTAL: Subject to change or removal.
+	AfterIssuance func(ctx context.Context, req *IssuanceRequest, chain []*x509.Certificate) ([]*x509.Certificate, error)
+
+	// Optionally requires issued certificates to have
+	// enough embedded SCTs for Certificate Transparency
+	// compliance; certificates that do not comply are
+	// rejected and issuance is tried with the next
+	// issuer, or retried later. See CTPolicy.
+	// EXPERIMENTAL: Subject to change or removal.
+	CTPolicy *CTPolicy
+
+	// Optionally called as soon as an OCSP response
+	// shows that a certificate was revoked, whether it
+	// was fetched while loading the certificate, during
+	// a handshake, or by maintenance, so that the
+	// application can alert, remove the certificate from
+	// rotation, or force its reissuance right away. It
+	// is called once per certificate in the cache, by
+	// every instance sharing the storage, and only when
+	// the status changes to Revoked. It is called
+	// synchronously, possibly during a handshake, so it
+	// should return quickly; defer slow work to a new
+	// goroutine. Managed certificates are renewed
+	// regardless.
+	// EXPERIMENTAL: Subject to change or removal.
+	OnOCSPRevoked func(ctx context.Context, cert Certificate, resp *ocsp.Response)
+
+	// Controls the resumption of TLS sessions in the TLS
+	// configurations returned by TLSConfig, e.g. to not
+	// resume sessions established with a certificate
+	// that was since renewed or revoked. If nil, sessions
+	// are resumed as usual.
+	// EXPERIMENTAL: Subject to change or removal.
+	SessionPolicy *SessionPolicy
+
+	// Routes the ACME and OCSP requests about certificates
+	// through different proxies or source addresses by
+	// their names or tags, e.g. so that the traffic of
+	// each tenant leaves through its own network path, or
+	// pins the IP version of connections to CAs. If nil,
+	// all requests are made the same way.
+	// EXPERIMENTAL: Subject to change or removal.
+	Egress *EgressRoutes
+
+	// Receives metrics about renewals, OCSP, on-demand
+	// decisions, and ACME challenges, e.g. a *Metrics
+	// to serve them to Prometheus. See MetricDescs. For
+	// the number of managed certificates, see
+	// CacheOptions.Metrics; for storage, MeteredStorage.
+	// EXPERIMENTAL: Subject to change or removal.
+	Metrics MetricsSink
+
+	// The source of randomness for randomized decisions,
+	// such as choosing a renewal time within the ARI
+	// window and the order of issuers with the
+	// UseFirstRandomIssuer policy. For private keys, see
+	// StandardKeyGenerator.Rand. Default: crypto/rand.
+	// EXPERIMENTAL: Subject to change or removal.
+	Rand io.Reader
+
 	// Disables both ARI fetching and the use of ARI for renewal decisions.
 	// TEMPORARY: Will likely be removed in the future.
 	DisableARI bool
@@ -247,6 +472,78 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 	if !cfg.MustStaple {
 		cfg.MustStaple = Default.MustStaple
 	}
+	if !cfg.PersistJobs {
+		cfg.PersistJobs = Default.PersistJobs
+	}
+	if cfg.RetryPolicy == nil {
+		cfg.RetryPolicy = Default.RetryPolicy
+	}
+	if cfg.CertLifetime == 0 {
+		cfg.CertLifetime = Default.CertLifetime
+	}
+	if cfg.CertLifetimeFunc == nil {
+		cfg.CertLifetimeFunc = Default.CertLifetimeFunc
+	}
+	if cfg.MinServingValidity == 0 {
+		cfg.MinServingValidity = Default.MinServingValidity
+	}
+	if cfg.LowValidityAction == "" {
+		cfg.LowValidityAction = Default.LowValidityAction
+	}
+	if cfg.CrossSignedCertificates == nil {
+		cfg.CrossSignedCertificates = Default.CrossSignedCertificates
+	}
+	if cfg.CrossSignPolicy == nil {
+		cfg.CrossSignPolicy = Default.CrossSignPolicy
+	}
+	if cfg.ExpiredCertGC == nil {
+		cfg.ExpiredCertGC = Default.ExpiredCertGC
+	}
+	if cfg.CertificateHistory == 0 {
+		cfg.CertificateHistory = Default.CertificateHistory
+	}
+	if cfg.SubjectAltNames == nil {
+		cfg.SubjectAltNames = Default.SubjectAltNames
+	}
+	if cfg.BeforeIssuance == nil {
+		cfg.BeforeIssuance = Default.BeforeIssuance
+	}
+	if cfg.AfterIssuance == nil {
+		cfg.AfterIssuance = Default.AfterIssuance
+	}
+	if cfg.CTPolicy == nil {
+		cfg.CTPolicy = Default.CTPolicy
+	}
+	if cfg.OnOCSPRevoked == nil {
+		cfg.OnOCSPRevoked = Default.OnOCSPRevoked
+	}
+	if cfg.SessionPolicy == nil {
+		cfg.SessionPolicy = Default.SessionPolicy
+	}
+	if cfg.DuplicateCertPolicy == "" {
+		cfg.DuplicateCertPolicy = Default.DuplicateCertPolicy
+	}
+	if cfg.Egress == nil {
+		cfg.Egress = Default.Egress
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = Default.Metrics
+	}
+	if cfg.Rand == nil {
+		cfg.Rand = Default.Rand
+	}
+	if cfg.IssuerWeights == nil {
+		cfg.IssuerWeights = Default.IssuerWeights
+	}
+	if cfg.IssuerFailbackDelay == 0 {
+		cfg.IssuerFailbackDelay = Default.IssuerFailbackDelay
+	}
+	if cfg.RenewalIssuerPolicy == "" {
+		cfg.RenewalIssuerPolicy = Default.RenewalIssuerPolicy
+	}
+	if cfg.RenewalIssuersFunc == nil {
+		cfg.RenewalIssuersFunc = Default.RenewalIssuersFunc
+	}
 	if cfg.Issuers == nil {
 		cfg.Issuers = Default.Issuers
 		if cfg.Issuers == nil {
@@ -257,6 +554,9 @@ func newWithCache(certCache *Cache, cfg Config) *Config {
 	if cfg.RenewalWindowRatio == 0 {
 		cfg.RenewalWindowRatio = Default.RenewalWindowRatio
 	}
+	if cfg.RenewalBlackouts == nil {
+		cfg.RenewalBlackouts = Default.RenewalBlackouts
+	}
 	if cfg.OnEvent == nil {
 		cfg.OnEvent = Default.OnEvent
 	}
@@ -356,7 +656,7 @@ func (cfg *Config) ClientCredentials(ctx context.Context, identifiers []string)
 		if err != nil {
 			return chains, err
 		}
-		chain, err := tls.X509KeyPair(certRes.CertificatePEM, certRes.PrivateKeyPEM)
+		chain, err := x509KeyPair(certRes.CertificatePEM, certRes.PrivateKeyPEM)
 		if err != nil {
 			return chains, err
 		}
@@ -409,7 +709,7 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 			return fmt.Errorf("%s: caching certificate: %v", domainName, err)
 		}
 		// if we don't have one in storage, obtain one
-		obtain := func() error {
+		obtain := func(ctx context.Context) error {
 			var err error
 			if async {
 				err = cfg.ObtainCertAsync(ctx, domainName)
@@ -438,17 +738,20 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 			// either the old one (or sometimes the new one) is about to be
 			// canceled. This seems like reasonable logic for any consumer
 			// of this lib. See https://github.com/caddyserver/caddy/issues/3202
-			jm.Submit(cfg.Logger, "", obtain)
+			//
+			// There is no certificate to serve at all, so the job is as
+			// urgent as one for an expired certificate.
+			cfg.submitJob(ctx, "", "obtain", domainName, jobPriority{deadline: time.Now()}, obtain)
 			return nil
 		}
-		return obtain()
+		return obtain(ctx)
 	}
 
 	// for an existing certificate, make sure it is renewed; or if it is revoked,
 	// force a renewal even if it's not expiring
-	renew := func() error {
+	renew := func(ctx context.Context) error {
 		// first, ensure status is not revoked (it was just refreshed in CacheManagedCertificate above)
-		if !cert.Expired() && cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
+		if !cert.Expired() && cert.Revoked() {
 			_, err = cfg.forceRenew(ctx, cfg.Logger, cert)
 			return err
 		}
@@ -462,8 +765,9 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 			}
 		}
 
-		// otherwise, simply renew the certificate if needed
-		if cert.NeedsRenewal(cfg) {
+		// otherwise, simply renew the certificate if needed,
+		// unless it is deferred by a renewal blackout
+		if cert.NeedsRenewal(cfg) && cfg.renewalDeferredUntil(cert).IsZero() {
 			var err error
 			if async {
 				err = cfg.RenewCertAsync(ctx, domainName, false)
@@ -484,10 +788,10 @@ func (cfg *Config) manageOne(ctx context.Context, domainName string, async bool)
 	}
 
 	if async {
-		jm.Submit(cfg.Logger, "renew_"+domainName, renew)
+		cfg.submitJob(ctx, "renew_"+domainName, "renew", domainName, jobPriority{deadline: expiresAt(cert.Leaf)}, renew)
 		return nil
 	}
-	return renew()
+	return renew(ctx)
 }
 
 // ObtainCertSync generates a new private key and obtains a certificate for
@@ -574,10 +878,11 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			copy(issuers, cfg.Issuers)
 		}
 		if cfg.IssuerPolicy == UseFirstRandomIssuer {
-			weakrand.Shuffle(len(issuers), func(i, j int) {
+			randShuffle(cfg.randReader(), len(issuers), func(i, j int) {
 				issuers[i], issuers[j] = issuers[j], issuers[i]
 			})
 		}
+		issuers = cfg.electIssuers(ctx, issuers)
 		if privKey == nil {
 			privKey, err = cfg.KeySource.GenerateKey()
 			if err != nil {
@@ -589,11 +894,17 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			}
 		}
 
-		csr, err := cfg.generateCSR(privKey, []string{name}, false)
+		sans, err := cfg.certificateSANs(ctx, name)
+		if err != nil {
+			return err
+		}
+		csr, err := cfg.generateCSR(privKey, sans, false)
 		if err != nil {
 			return err
 		}
 
+		ctx = cfg.withRequestedLifetime(ctx, name)
+
 		// try to obtain from each issuer until we succeed
 		var issuedCert *IssuedCertificate
 		var issuerUsed Issuer
@@ -605,7 +916,7 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 				zap.String("issuer", issuer.IssuerKey()))
 
 			if prechecker, ok := issuer.(PreChecker); ok {
-				err = prechecker.PreCheck(ctx, []string{name}, interactive)
+				err = prechecker.PreCheck(ctx, sans, interactive)
 				if err != nil {
 					continue
 				}
@@ -617,14 +928,35 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 			// and inefficiency for clients. CommonName has been deprecated for 25+ years.
 			useCSR := csr
 			if issuer.IssuerKey() == zerosslIssuerKey {
-				useCSR, err = cfg.generateCSR(privKey, []string{name}, true)
+				useCSR, err = cfg.generateCSR(privKey, sans, true)
 				if err != nil {
 					return err
 				}
 			}
+			useCSR, err = cfg.beforeIssuance(ctx, issuer, useCSR, sans, privKey, false)
+			if err != nil {
+				return fmt.Errorf("[%s] Obtain: %w", name, err)
+			}
 
-			issuedCert, err = issuer.Issue(ctx, useCSR)
+			// if this certificate replaces one from the same issuer (for example, because
+			// it was revoked for key compromise, so it could not be renewed with its key),
+			// tell the CA which certificate is being replaced, like when renewing
+			issueCtx := ctx
+			if replaced, ok := ctx.Value(ctxKeyReplacedCert).(Certificate); ok && !cfg.DisableARI &&
+				replaced.Leaf != nil && replaced.issuerKey == issuer.IssuerKey() {
+				issueCtx = context.WithValue(ctx, ctxKeyARIReplaces, replaced.Leaf)
+			}
+
+			issuedCert, err = issuer.Issue(issueCtx, useCSR)
+			if err == nil {
+				err = cfg.checkCTPolicy(issuedCert)
+			}
+			cfg.recordIssuance(ctx, issuer, err)
 			if err == nil {
+				issuedCert, err = cfg.afterIssuance(ctx, issuer, useCSR, sans, privKey, false, issuedCert)
+				if err != nil {
+					return fmt.Errorf("[%s] Obtain: %w", name, err)
+				}
 				issuerUsed = issuer
 				break
 			}
@@ -659,12 +991,17 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 		if err != nil {
 			log.Error("unable to encode certificate metadata", zap.Error(err))
 		}
+		if issuedCert.PrivateKeyPEM != nil {
+			privKeyPEM = issuedCert.PrivateKeyPEM
+		}
 		certRes := CertificateResource{
 			SANs:           namesFromCSR(csr),
 			CertificatePEM: issuedCert.Certificate,
 			PrivateKeyPEM:  privKeyPEM,
 			IssuerData:     metaJSON,
+			IssuerHistory:  []string{issuerUsed.IssuerKey()},
 			issuerKey:      issuerUsed.IssuerKey(),
+			namesKey:       groupNamesKey(name, sans),
 		}
 		err = cfg.saveCertResource(ctx, issuerUsed, certRes)
 		if err != nil {
@@ -697,7 +1034,7 @@ func (cfg *Config) obtainCert(ctx context.Context, name string, interactive bool
 	if interactive {
 		err = f(ctx)
 	} else {
-		err = doWithRetry(ctx, log, f)
+		err = doWithRetry(ctx, log, cfg.RetryPolicy, f)
 	}
 
 	return err
@@ -830,6 +1167,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			zap.String("identifier", name),
 			zap.Duration("remaining", timeLeft))
 
+		cfg.addMetric(metricRenewalAttempts, 1)
 		if err := cfg.emit(ctx, "cert_obtaining", map[string]any{
 			"renewal":    true,
 			"identifier": name,
@@ -859,23 +1197,34 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 			}
 		}
 
-		csr, err := cfg.generateCSR(privateKey, []string{name}, false)
+		sans, err := cfg.certificateSANs(ctx, name)
+		if err != nil {
+			return err
+		}
+		csr, err := cfg.generateCSR(privateKey, sans, false)
 		if err != nil {
 			return err
 		}
 
+		ctx = cfg.withRequestedLifetime(ctx, name)
+
 		// try to obtain from each issuer until we succeed
 		var issuedCert *IssuedCertificate
 		var issuerUsed Issuer
 		var issuerKeys []string
-		for _, issuer := range cfg.Issuers {
+		issuers := cfg.renewalIssuers(ctx, name, certRes.issuerHistory())
+		log.Debug("selected issuers for renewal",
+			zap.String("identifier", name),
+			zap.String("previous_issuer", certRes.issuerKey),
+			zap.Strings("issuers", issuerKeysOf(issuers)))
+		for _, issuer := range issuers {
 			// TODO: ZeroSSL's API currently requires CommonName to be set, and requires it be
 			// distinct from SANs. If this was a cert it would violate the BRs, but their certs
 			// are compliant, so their CSR requirements just needlessly add friction, complexity,
 			// and inefficiency for clients. CommonName has been deprecated for 25+ years.
 			useCSR := csr
 			if issuer.IssuerKey() == "zerossl" {
-				useCSR, err = cfg.generateCSR(privateKey, []string{name}, true)
+				useCSR, err = cfg.generateCSR(privateKey, sans, true)
 				if err != nil {
 					return err
 				}
@@ -883,7 +1232,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 
 			issuerKeys = append(issuerKeys, issuer.IssuerKey())
 			if prechecker, ok := issuer.(PreChecker); ok {
-				err = prechecker.PreCheck(ctx, []string{name}, interactive)
+				err = prechecker.PreCheck(ctx, sans, interactive)
 				if err != nil {
 					continue
 				}
@@ -903,8 +1252,21 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 				}
 			}
 
+			useCSR, err = cfg.beforeIssuance(ctx, issuer, useCSR, sans, privateKey, true)
+			if err != nil {
+				return fmt.Errorf("[%s] Renew: %w", name, err)
+			}
+
 			issuedCert, err = issuer.Issue(ctx, useCSR)
 			if err == nil {
+				err = cfg.checkCTPolicy(issuedCert)
+			}
+			cfg.recordIssuance(ctx, issuer, err)
+			if err == nil {
+				issuedCert, err = cfg.afterIssuance(ctx, issuer, useCSR, sans, privateKey, true, issuedCert)
+				if err != nil {
+					return fmt.Errorf("[%s] Renew: %w", name, err)
+				}
 				issuerUsed = issuer
 				break
 			}
@@ -922,6 +1284,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 				zap.Error(errToLog))
 		}
 		if err != nil {
+			cfg.addMetric(metricRenewals, 1, "failed")
 			cfg.emit(ctx, "cert_failed", map[string]any{
 				"renewal":    true,
 				"identifier": name,
@@ -940,12 +1303,17 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		if err != nil {
 			log.Error("unable to encode certificate metadata", zap.Error(err))
 		}
+		if issuedCert.PrivateKeyPEM != nil {
+			certRes.PrivateKeyPEM = issuedCert.PrivateKeyPEM
+		}
 		newCertRes := CertificateResource{
 			SANs:           namesFromCSR(csr),
 			CertificatePEM: issuedCert.Certificate,
 			PrivateKeyPEM:  certRes.PrivateKeyPEM,
 			IssuerData:     metaJSON,
+			IssuerHistory:  appendIssuerHistory(issuerKey, certRes.issuerHistory()),
 			issuerKey:      issuerKey,
+			namesKey:       groupNamesKey(name, sans),
 		}
 		err = cfg.saveCertResource(ctx, issuerUsed, newCertRes)
 		if err != nil {
@@ -955,14 +1323,16 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 		log.Info("certificate renewed successfully",
 			zap.String("identifier", name),
 			zap.String("issuer", issuerKey))
+		cfg.addMetric(metricRenewals, 1, "succeeded")
 
 		certKey := newCertRes.NamesKey()
 
-		cfg.emit(ctx, "cert_obtained", map[string]any{
+		renewedData := map[string]any{
 			"renewal":          true,
 			"remaining":        timeLeft,
 			"identifier":       name,
 			"issuer":           issuerKey,
+			"previous_issuer":  certRes.issuerKey,
 			"storage_path":     StorageKeys.CertsSitePrefix(issuerKey, certKey),
 			"private_key_path": StorageKeys.SitePrivateKey(issuerKey, certKey),
 			"certificate_path": StorageKeys.SiteCert(issuerKey, certKey),
@@ -971,7 +1341,9 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 				Type:  "CERTIFICATE REQUEST",
 				Bytes: csr.Raw,
 			}),
-		})
+		}
+		cfg.emit(ctx, "cert_obtained", renewedData)
+		cfg.emit(ctx, "cert_renewed", renewedData)
 
 		return nil
 	}
@@ -979,7 +1351,7 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 	if interactive {
 		err = f(ctx)
 	} else {
-		err = doWithRetry(ctx, log, f)
+		err = doWithRetry(ctx, log, cfg.RetryPolicy, f)
 	}
 
 	return err
@@ -988,8 +1360,23 @@ func (cfg *Config) renewCert(ctx context.Context, name string, force, interactiv
 // generateCSR generates a CSR for the given SANs. If useCN is true, CommonName will get the first SAN (TODO: this is only a temporary hack for ZeroSSL API support).
 func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useCN bool) (*x509.CertificateRequest, error) {
 	csrTemplate := new(x509.CertificateRequest)
+	var otherNames []string
 
 	for _, name := range sans {
+		// URIs and otherNames are used as they are
+		if _, _, ok := ParseOtherNameSubject(name); ok {
+			otherNames = append(otherNames, name)
+			continue
+		}
+		if SubjectIsURI(name) {
+			u, err := url.Parse(name)
+			if err != nil {
+				return nil, fmt.Errorf("parsing URI identifier '%s': %v", name, err)
+			}
+			csrTemplate.URIs = append(csrTemplate.URIs, u)
+			continue
+		}
+
 		// identifiers should be converted to punycode before going into the CSR
 		// (convert IDNs to ASCII according to RFC 5280 section 7)
 		normalizedName, err := idna.ToASCII(name)
@@ -1007,13 +1394,22 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 			csrTemplate.IPAddresses = append(csrTemplate.IPAddresses, ip)
 		} else if strings.Contains(normalizedName, "@") {
 			csrTemplate.EmailAddresses = append(csrTemplate.EmailAddresses, normalizedName)
-		} else if u, err := url.Parse(normalizedName); err == nil && strings.Contains(normalizedName, "/") {
-			csrTemplate.URIs = append(csrTemplate.URIs, u)
 		} else {
 			csrTemplate.DNSNames = append(csrTemplate.DNSNames, normalizedName)
 		}
 	}
 
+	// the x509 package does not support otherName SANs, so
+	// the whole extension has to be made for them
+	if len(otherNames) > 0 {
+		sanExt, err := marshalSANExtension(csrTemplate.DNSNames, csrTemplate.EmailAddresses,
+			csrTemplate.IPAddresses, csrTemplate.URIs, otherNames)
+		if err != nil {
+			return nil, err
+		}
+		csrTemplate.ExtraExtensions = append(csrTemplate.ExtraExtensions, sanExt)
+	}
+
 	if cfg.MustStaple {
 		csrTemplate.ExtraExtensions = append(csrTemplate.ExtraExtensions, mustStapleExtension)
 	}
@@ -1024,6 +1420,8 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 		zap.Strings("identifiers", sans),
 		zap.Strings("san_dns_names", csrTemplate.DNSNames),
 		zap.Strings("san_emails", csrTemplate.EmailAddresses),
+		zap.Int("san_uris", len(csrTemplate.URIs)),
+		zap.Strings("san_other_names", otherNames),
 		zap.String("common_name", csrTemplate.Subject.CommonName),
 		zap.Int("extra_extensions", len(csrTemplate.ExtraExtensions)),
 	)
@@ -1042,6 +1440,9 @@ func (cfg *Config) generateCSR(privateKey crypto.PrivateKey, sans []string, useC
 //
 // The certificate assets are deleted from storage after successful revocation
 // to prevent reuse.
+//
+// To find out beforehand which cached certificates and names would be
+// affected, use RevocationImpact.
 func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, interactive bool) error {
 	for i, issuer := range cfg.Issuers {
 		issuerKey := issuer.IssuerKey()
@@ -1097,20 +1498,22 @@ func (cfg *Config) RevokeCert(ctx context.Context, domain string, reason int, in
 // Unlike the package TLS() function, this method does not, by itself,
 // enable certificate management for any domain names.
 func (cfg *Config) TLSConfig() *tls.Config {
-	return &tls.Config{
+	tlsConfig := &tls.Config{
 		// these two fields necessary for TLS-ALPN challenge
 		GetCertificate: cfg.GetCertificate,
 		NextProtos:     []string{acmez.ACMETLS1Protocol},
 
 		// the rest recommended for modern TLS servers
 		MinVersion: tls.VersionTLS12,
-		CurvePreferences: []tls.CurveID{
+		CurvePreferences: append(slices.Clone(hybridCurvePreferences),
 			tls.X25519,
 			tls.CurveP256,
-		},
+		),
 		CipherSuites:             preferredDefaultCipherSuites(),
 		PreferServerCipherSuites: true,
 	}
+	cfg.applySessionPolicy(tlsConfig)
+	return tlsConfig
 }
 
 // getChallengeInfo loads the challenge info from either the internal challenge memory
@@ -1180,6 +1583,12 @@ func (cfg *Config) checkStorage(ctx context.Context) error {
 	if cfg.DisableStorageCheck {
 		return nil
 	}
+	return cfg.storageRoundTrip(ctx)
+}
+
+// storageRoundTrip stores a value in storage,
+// loads it, and deletes it.
+func (cfg *Config) storageRoundTrip(ctx context.Context) error {
 	key := fmt.Sprintf("rw_test_%d", weakrand.Int())
 	contents := make([]byte, 1024*10) // size sufficient for one or two ACME resources
 	_, err := weakrand.Read(contents)
@@ -1275,10 +1684,15 @@ func (cfg *Config) managedCertNeedsRenewal(certRes CertificateResource, emitLogs
 }
 
 func (cfg *Config) emit(ctx context.Context, eventName string, data map[string]any) error {
-	if cfg.OnEvent == nil {
-		return nil
+	if cfg.OnEvent != nil {
+		if err := cfg.OnEvent(ctx, eventName, data); err != nil {
+			return err
+		}
+	}
+	if cfg.certCache != nil {
+		cfg.certCache.events.publish(eventName, data)
 	}
-	return cfg.OnEvent(ctx, eventName, data)
+	return nil
 }
 
 // CertificateSelector is a type which can select a certificate to use given multiple choices.
@@ -1286,6 +1700,101 @@ type CertificateSelector interface {
 	SelectCertificate(*tls.ClientHelloInfo, []Certificate) (Certificate, error)
 }
 
+// renewalIssuers returns the issuers to try, in order, to renew the
+// certificate for name, according to RenewalIssuersFunc or
+// RenewalIssuerPolicy. history is as for RenewalIssuersFunc.
+func (cfg *Config) renewalIssuers(ctx context.Context, name string, history []string) []Issuer {
+	if cfg.RenewalIssuersFunc != nil {
+		if issuers := cfg.RenewalIssuersFunc(ctx, name, history, cfg.Issuers); len(issuers) > 0 {
+			return issuers
+		}
+	}
+	current := -1
+	if len(history) > 0 {
+		for i, issuer := range cfg.Issuers {
+			if issuer.IssuerKey() == history[0] {
+				current = i
+				break
+			}
+		}
+	}
+	if current < 0 {
+		return cfg.electIssuers(ctx, cfg.Issuers)
+	}
+	issuers := make([]Issuer, 0, len(cfg.Issuers))
+	switch cfg.RenewalIssuerPolicy {
+	case RenewWithSameIssuer:
+		issuers = append(issuers, cfg.Issuers[current])
+		issuers = append(issuers, cfg.Issuers[:current]...)
+		issuers = append(issuers, cfg.Issuers[current+1:]...)
+	case RenewWithNextIssuer:
+		issuers = append(issuers, cfg.Issuers[current+1:]...)
+		issuers = append(issuers, cfg.Issuers[:current+1]...)
+	default:
+		return cfg.electIssuers(ctx, cfg.Issuers)
+	}
+	return issuers
+}
+
+// maxIssuerHistory is the number of issuers kept in
+// the IssuerHistory of certificate resources.
+const maxIssuerHistory = 10
+
+// appendIssuerHistory returns the issuer history of a certificate issued
+// by issuerKey that renews a certificate with the given history.
+func appendIssuerHistory(issuerKey string, history []string) []string {
+	history = append([]string{issuerKey}, history...)
+	if len(history) > maxIssuerHistory {
+		history = history[:maxIssuerHistory]
+	}
+	return history
+}
+
+// issuerHistory returns cr.IssuerHistory, or, for resources stored
+// before it was tracked, the issuer under which cr was stored.
+func (cr CertificateResource) issuerHistory() []string {
+	if len(cr.IssuerHistory) > 0 {
+		return cr.IssuerHistory
+	}
+	if cr.issuerKey != "" {
+		return []string{cr.issuerKey}
+	}
+	return nil
+}
+
+func issuerKeysOf(issuers []Issuer) []string {
+	keys := make([]string, len(issuers))
+	for i, issuer := range issuers {
+		keys[i] = issuer.IssuerKey()
+	}
+	return keys
+}
+
+// withRequestedLifetime returns a context carrying the desired lifetime
+// of the certificate for name, if one is configured, which issuers may
+// retrieve with RequestedLifetime.
+func (cfg *Config) withRequestedLifetime(ctx context.Context, name string) context.Context {
+	lifetime := cfg.CertLifetime
+	if cfg.CertLifetimeFunc != nil {
+		if l := cfg.CertLifetimeFunc(ctx, name); l != 0 {
+			lifetime = l
+		}
+	}
+	if lifetime <= 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKeyLifetime, lifetime)
+}
+
+// RequestedLifetime returns the desired certificate lifetime (the
+// duration between NotBefore and NotAfter) for an issuance, if the
+// Config requested one. Issuers that can choose the validity period
+// of certificates should honor it.
+func RequestedLifetime(ctx context.Context) (time.Duration, bool) {
+	lifetime, ok := ctx.Value(ctxKeyLifetime).(time.Duration)
+	return lifetime, ok
+}
+
 // OCSPConfig configures how OCSP is handled.
 type OCSPConfig struct {
 	// Disable automatic OCSP stapling; strongly
@@ -1301,9 +1810,102 @@ type OCSPConfig struct {
 	// URL will disable OCSP from that responder.
 	ResponderOverrides map[string]string
 
+	// Rules for rewriting OCSP responder URLs that are
+	// not exactly matched by ResponderOverrides. Rules
+	// are evaluated in order and the first matching
+	// rule wins. This is useful for redirecting every
+	// responder of a CA family to an internal caching
+	// proxy without enumerating each URL.
+	// EXPERIMENTAL: Subject to change.
+	ResponderRules []OCSPResponderRule
+
 	// Optionally specify a function that can return the URL
 	// for an HTTP proxy to use for OCSP-related HTTP requests.
 	HTTPProxy func(*http.Request) (*url.URL, error)
+
+	// The HTTP client to use for OCSP-related HTTP requests,
+	// for example one with a custom transport for mTLS to an
+	// internal responder, custom DNS resolution, or limits on
+	// connection pooling. If set, HTTPProxy is ignored; the
+	// client's own Transport should configure the proxy, if
+	// any. The client's timeout should not be longer than a
+	// few seconds. Default: http.DefaultClient, or a client
+	// that uses HTTPProxy.
+	// EXPERIMENTAL: Subject to change.
+	HTTPClient *http.Client
+
+	// OCSP configs to use instead of this one for certificates
+	// obtained by certain issuers, keyed by issuer key. This is
+	// useful when certificates from an internal CA need a
+	// different responder or proxy than public certificates
+	// managed by the same Config. Overrides replace this config
+	// entirely (they are not merged), and their own overrides
+	// are ignored. EXPERIMENTAL: Subject to change.
+	IssuerOverrides map[string]OCSPConfig
+
+	// Optionally return the OCSP config to use for a particular
+	// certificate instead of this one; returning nil falls back
+	// to IssuerOverrides and then this config. This takes
+	// precedence over IssuerOverrides, and works for unmanaged
+	// certificates too. The returned config's own overrides are
+	// ignored. EXPERIMENTAL: Subject to change.
+	CertificateOverride func(Certificate) *OCSPConfig
+
+	// The maximum size, in bytes, of OCSP responses and of
+	// issuer certificates fetched to make OCSP requests.
+	// Default: DefaultOCSPMaxResponseSize.
+	// EXPERIMENTAL: Subject to change.
+	MaxResponseSize int64
+
+	// Make OCSP requests with the GET method (RFC 6960
+	// Appendix A.1) when they are small enough, so that
+	// responses can be cached by intermediary HTTP caches
+	// and CDNs; larger requests are still POSTed.
+	// EXPERIMENTAL: Subject to change.
+	UseGET bool
+
+	// Trust OCSP staples loaded from storage without
+	// verifying that they are for the certificate and
+	// signed by its issuer. By default, staples that
+	// fail verification are deleted and replaced, which
+	// protects against tampered storage and staples of
+	// other certificates. If the issuer certificate is
+	// not in the certificate bundle, stored staples can
+	// not be verified and new ones are always fetched,
+	// unless this is set.
+	// EXPERIMENTAL: Subject to change.
+	SkipStoredStapleVerification bool
+}
+
+// DefaultOCSPMaxResponseSize is the default maximum size
+// of OCSP responses and issuer certificates (1 MiB).
+const DefaultOCSPMaxResponseSize = 1024 * 1024
+
+func (ocspConfig OCSPConfig) maxResponseSize() int64 {
+	if ocspConfig.MaxResponseSize > 0 {
+		return ocspConfig.MaxResponseSize
+	}
+	return DefaultOCSPMaxResponseSize
+}
+
+// forCert returns the OCSP config that applies to cert,
+// taking any overrides into account.
+func (ocspConfig OCSPConfig) forCert(cert Certificate) OCSPConfig {
+	if ocspConfig.CertificateOverride != nil {
+		if override := ocspConfig.CertificateOverride(cert); override != nil {
+			return override.withoutOverrides()
+		}
+	}
+	if override, ok := ocspConfig.IssuerOverrides[cert.issuerKey]; ok && cert.issuerKey != "" {
+		return override.withoutOverrides()
+	}
+	return ocspConfig
+}
+
+func (ocspConfig OCSPConfig) withoutOverrides() OCSPConfig {
+	ocspConfig.IssuerOverrides = nil
+	ocspConfig.CertificateOverride = nil
+	return ocspConfig
 }
 
 // certIssueLockOp is the name of the operation used
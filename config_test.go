@@ -20,7 +20,9 @@ import (
 	"encoding/json"
 	"os"
 	"reflect"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/mholt/acmez/v3/acme"
 )
@@ -83,3 +85,118 @@ func mustJSON(val any) []byte {
 	}
 	return result
 }
+
+func TestRequestedLifetime(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(countingIssuer))
+
+	if _, ok := RequestedLifetime(cfg.withRequestedLifetime(ctx, "example.com")); ok {
+		t.Error("expected no requested lifetime by default")
+	}
+
+	cfg.CertLifetime = 7 * 24 * time.Hour
+	cfg.CertLifetimeFunc = func(_ context.Context, name string) time.Duration {
+		if name == "short.example.com" {
+			return 48 * time.Hour
+		}
+		return 0
+	}
+	if lifetime, _ := RequestedLifetime(cfg.withRequestedLifetime(ctx, "example.com")); lifetime != cfg.CertLifetime {
+		t.Errorf("expected config-wide lifetime %s, got %s", cfg.CertLifetime, lifetime)
+	}
+	if lifetime, _ := RequestedLifetime(cfg.withRequestedLifetime(ctx, "short.example.com")); lifetime != 48*time.Hour {
+		t.Errorf("expected per-name lifetime 48h, got %s", lifetime)
+	}
+
+	// the requested lifetime is plumbed through to the issuer
+	if err := cfg.ObtainCertSync(ctx, "short.example.com"); err != nil {
+		t.Fatalf("obtaining certificate: %v", err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "short.example.com")
+	if err != nil {
+		t.Fatalf("loading certificate: %v", err)
+	}
+	if lifetime := cert.Leaf.NotAfter.Sub(cert.Leaf.NotBefore); lifetime != 48*time.Hour {
+		t.Errorf("expected issued certificate to be valid for 48h, got %s", lifetime)
+	}
+}
+
+func TestRenewalIssuers(t *testing.T) {
+	ctx := context.Background()
+	a, b, c := &FakeIssuer{Key: "a"}, &FakeIssuer{Key: "b"}, &FakeIssuer{Key: "c"}
+	cfg := newOnDemandTestConfig(t, a)
+	cfg.Issuers = []Issuer{a, b, c}
+
+	for i, test := range []struct {
+		policy  RenewalIssuerPolicy
+		history []string
+		expect  []string
+	}{
+		{policy: "", history: []string{"b"}, expect: []string{"a", "b", "c"}},
+		{policy: RenewWithConfiguredIssuers, history: []string{"c"}, expect: []string{"a", "b", "c"}},
+		{policy: RenewWithSameIssuer, history: []string{"b", "a"}, expect: []string{"b", "a", "c"}},
+		{policy: RenewWithSameIssuer, history: []string{"unknown"}, expect: []string{"a", "b", "c"}},
+		{policy: RenewWithNextIssuer, history: []string{"a"}, expect: []string{"b", "c", "a"}},
+		{policy: RenewWithNextIssuer, history: []string{"c", "b"}, expect: []string{"a", "b", "c"}},
+		{policy: RenewWithNextIssuer, history: nil, expect: []string{"a", "b", "c"}},
+	} {
+		cfg.RenewalIssuerPolicy = test.policy
+		if actual := issuerKeysOf(cfg.renewalIssuers(ctx, "example.com", test.history)); !slices.Equal(actual, test.expect) {
+			t.Errorf("test %d: expected issuers %v, got %v", i, test.expect, actual)
+		}
+	}
+
+	// per-name choices override the policy
+	cfg.RenewalIssuersFunc = func(_ context.Context, name string, history []string, issuers []Issuer) []Issuer {
+		if name == "pinned.example.com" {
+			return []Issuer{c}
+		}
+		return nil
+	}
+	if actual := issuerKeysOf(cfg.renewalIssuers(ctx, "pinned.example.com", []string{"a"})); !slices.Equal(actual, []string{"c"}) {
+		t.Errorf("expected issuers from RenewalIssuersFunc, got %v", actual)
+	}
+	if actual := issuerKeysOf(cfg.renewalIssuers(ctx, "example.com", []string{"a"})); !slices.Equal(actual, []string{"b", "c", "a"}) {
+		t.Errorf("expected issuers from policy, got %v", actual)
+	}
+}
+
+func TestRenewWithNextIssuer(t *testing.T) {
+	ctx := context.Background()
+	a, b := &FakeIssuer{Key: "a"}, &FakeIssuer{Key: "b"}
+	cfg := newOnDemandTestConfig(t, a)
+	cfg.Issuers = []Issuer{a, b}
+	cfg.RenewalIssuerPolicy = RenewWithNextIssuer
+	var obtained []map[string]any
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "cert_obtained" {
+			obtained = append(obtained, data)
+		}
+		return nil
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	certRes, err := cfg.loadCertResource(ctx, a, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(certRes.IssuerHistory, []string{"a"}) {
+		t.Errorf("expected issuer history [a], got %v", certRes.IssuerHistory)
+	}
+
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	certRes, err = cfg.loadCertResource(ctx, b, "example.com")
+	if err != nil {
+		t.Fatalf("expected renewed certificate from the next issuer: %v", err)
+	}
+	if !slices.Equal(certRes.IssuerHistory, []string{"b", "a"}) {
+		t.Errorf("expected issuer history [b a], got %v", certRes.IssuerHistory)
+	}
+	if len(obtained) != 2 || obtained[1]["issuer"] != "b" || obtained[1]["previous_issuer"] != "a" {
+		t.Errorf("expected renewal event from b replacing a, got %v", obtained)
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ConfigChange describes a changed field of a Config.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ConfigChange struct {
+	// The name of the field, such as "Issuers".
+	Field string `json:"field"`
+
+	// Summaries of the old and new values. Simple values
+	// are spelled out; for others, only their type, or
+	// whether they are set, is described, so that no
+	// secrets end up in audit logs.
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// ConfigDiff is the difference between two Configs.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ConfigDiff struct {
+	// The changed fields, ordered by field name.
+	Changes []ConfigChange `json:"changes"`
+}
+
+// Empty returns true if there are no changes.
+func (diff ConfigDiff) Empty() bool { return len(diff.Changes) == 0 }
+
+// Fields returns the names of the changed fields.
+func (diff ConfigDiff) Fields() []string {
+	fields := make([]string, len(diff.Changes))
+	for i, change := range diff.Changes {
+		fields[i] = change.Field
+	}
+	return fields
+}
+
+// DiffConfigs returns the changes of the exported fields from
+// oldCfg to newCfg. Functions are compared by identity, so a
+// new closure is considered a change even if it behaves the
+// same; issuers are compared by their issuer keys.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func DiffConfigs(oldCfg, newCfg *Config) ConfigDiff {
+	var diff ConfigDiff
+	oldVal, newVal := reflect.ValueOf(oldCfg).Elem(), reflect.ValueOf(newCfg).Elem()
+	typ := oldVal.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		o, n := oldVal.Field(i), newVal.Field(i)
+		if field.Name == "Issuers" {
+			if oldKeys, newKeys := issuerKeys(oldCfg.Issuers), issuerKeys(newCfg.Issuers); oldKeys != newKeys {
+				diff.Changes = append(diff.Changes, ConfigChange{Field: field.Name, Old: oldKeys, New: newKeys})
+			}
+			continue
+		}
+		if configValuesEqual(o, n) {
+			continue
+		}
+		diff.Changes = append(diff.Changes, ConfigChange{
+			Field: field.Name,
+			Old:   summarizeConfigValue(o),
+			New:   summarizeConfigValue(n),
+		})
+	}
+	sort.Slice(diff.Changes, func(i, j int) bool { return diff.Changes[i].Field < diff.Changes[j].Field })
+	return diff
+}
+
+// configValuesEqual compares two values of a Config field like
+// reflect.DeepEqual, except that functions are compared by identity
+// (DeepEqual considers non-nil functions to be always different).
+func configValuesEqual(a, b reflect.Value) bool {
+	return valuesEqual(a, b, 0)
+}
+
+func valuesEqual(a, b reflect.Value, depth int) bool {
+	if a.IsValid() != b.IsValid() {
+		return false
+	}
+	if !a.IsValid() {
+		return true
+	}
+	if a.Type() != b.Type() {
+		return false
+	}
+	// values nested this deeply are likely cyclic; only compare identity
+	const maxDepth = 10
+	if depth > maxDepth {
+		switch a.Kind() {
+		case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+			return a.Pointer() == b.Pointer()
+		}
+	}
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.Complex64, reflect.Complex128:
+		return a.Complex() == b.Complex()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Func, reflect.Chan, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Pointer:
+		if a.Pointer() == b.Pointer() {
+			return true
+		}
+		if a.IsNil() || b.IsNil() {
+			return false
+		}
+		return valuesEqual(a.Elem(), b.Elem(), depth+1)
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return valuesEqual(a.Elem(), b.Elem(), depth+1)
+	case reflect.Slice:
+		if a.IsNil() != b.IsNil() {
+			return false
+		}
+		fallthrough
+	case reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !valuesEqual(a.Index(i), b.Index(i), depth+1) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.IsNil() != b.IsNil() || a.Len() != b.Len() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			bv := b.MapIndex(iter.Key())
+			if !bv.IsValid() || !valuesEqual(iter.Value(), bv, depth+1) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !valuesEqual(a.Field(i), b.Field(i), depth+1) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// summarizeConfigValue describes v for a ConfigChange.
+func summarizeConfigValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return fmt.Sprint(v.Interface())
+	case reflect.Int64:
+		if d, ok := v.Interface().(time.Duration); ok {
+			return d.String()
+		}
+		return fmt.Sprint(v.Interface())
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			return fmt.Sprint(v.Interface())
+		}
+		return fmt.Sprintf("%d elements", v.Len())
+	case reflect.Func, reflect.Map:
+		if v.IsNil() {
+			return "unset"
+		}
+		return "set"
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return "unset"
+		}
+		return fmt.Sprintf("%T", v.Interface())
+	}
+	return fmt.Sprintf("%T", v.Interface())
+}
+
+func issuerKeys(issuers []Issuer) string {
+	keys := make([]string, len(issuers))
+	for i, iss := range issuers {
+		keys[i] = iss.IssuerKey()
+	}
+	return "[" + strings.Join(keys, " ") + "]"
+}
+
+// ConfigChanged reports that cfg replaced old; for example, because
+// the configuration was reloaded and the cache's GetConfigForCert now
+// returns cfg instead of old. If the configs differ, a config_changed
+// event with the diff is emitted from cfg, listing the names of the
+// cached managed certificates that are now managed by cfg as affected;
+// changedBy optionally identifies who made the change, for auditing.
+// The diff is returned either way.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) ConfigChanged(ctx context.Context, old *Config, changedBy string) ConfigDiff {
+	diff := DiffConfigs(old, cfg)
+	if diff.Empty() {
+		return diff
+	}
+
+	var names []string
+	for _, cert := range cfg.certCache.getAllCerts() {
+		if !cert.managed {
+			continue
+		}
+		if certCfg, err := cfg.certCache.getConfig(cert); err == nil && certCfg == cfg {
+			names = append(names, cert.Names...)
+		}
+	}
+	sort.Strings(names)
+
+	cfg.Logger.Info("configuration changed",
+		zap.Strings("fields", diff.Fields()),
+		zap.Int("affected_names", len(names)),
+		zap.String("changed_by", changedBy))
+
+	data := map[string]any{
+		"changes":     diff.Changes,
+		"fields":      diff.Fields(),
+		"identifiers": names,
+	}
+	if changedBy != "" {
+		data["changed_by"] = changedBy
+	}
+	cfg.emit(ctx, "config_changed", data)
+
+	return diff
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDiffConfigs(t *testing.T) {
+	decide := func(context.Context, string) error { return nil }
+	oldCfg := &Config{
+		RenewalWindowRatio: 0.33,
+		MustStaple:         false,
+		Issuers:            []Issuer{&FakeIssuer{}},
+		KeySource:          StandardKeyGenerator{KeyType: P256},
+		OnDemand:           &OnDemandConfig{DecisionFunc: decide},
+	}
+	newCfg := &Config{
+		RenewalWindowRatio: 0.5,
+		MustStaple:         false,
+		Issuers:            []Issuer{&FakeIssuer{}},
+		KeySource:          StandardKeyGenerator{KeyType: P384},
+		OnDemand:           &OnDemandConfig{DecisionFunc: decide},
+		CertLifetime:       24 * time.Hour,
+	}
+
+	diff := DiffConfigs(oldCfg, newCfg)
+	expected := map[string][2]string{
+		"CertLifetime":       {"0s", "24h0m0s"},
+		"KeySource":          {"certmagic.StandardKeyGenerator", "certmagic.StandardKeyGenerator"},
+		"RenewalWindowRatio": {"0.33", "0.5"},
+	}
+	if len(diff.Changes) != len(expected) {
+		t.Fatalf("expected changes of %d fields, got %+v", len(expected), diff.Changes)
+	}
+	for _, change := range diff.Changes {
+		want, ok := expected[change.Field]
+		if !ok || change.Old != want[0] || change.New != want[1] {
+			t.Errorf("unexpected change: %+v", change)
+		}
+	}
+
+	// different issuers and functions are changes
+	newCfg.Issuers = append(newCfg.Issuers, &FakeIssuer{})
+	newCfg.OnDemand = &OnDemandConfig{DecisionFunc: func(context.Context, string) error { return nil }}
+	fields := DiffConfigs(oldCfg, newCfg).Fields()
+	if len(fields) != 5 || fields[1] != "Issuers" || fields[3] != "OnDemand" {
+		t.Errorf("expected issuers and on-demand config to be changed, got %v", fields)
+	}
+
+	if diff := DiffConfigs(oldCfg, oldCfg); !diff.Empty() {
+		t.Errorf("expected no changes, got %+v", diff.Changes)
+	}
+}
+
+func TestConfigChanged(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var events []map[string]any
+	old := *cfg
+	cfg.RenewalWindowRatio = 0.5
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "config_changed" {
+			events = append(events, data)
+		}
+		return nil
+	}
+
+	diff := cfg.ConfigChanged(ctx, &old, "admin")
+	if len(events) != 1 {
+		t.Fatalf("expected one config_changed event, got %d", len(events))
+	}
+	if fields := diff.Fields(); len(fields) != 2 || fields[0] != "OnEvent" || fields[1] != "RenewalWindowRatio" {
+		t.Errorf("unexpected changed fields: %v", fields)
+	}
+	if names := events[0]["identifiers"].([]string); len(names) != 1 || names[0] != "example.com" {
+		t.Errorf("expected example.com to be affected, got %v", names)
+	}
+	if events[0]["changed_by"] != "admin" {
+		t.Errorf("expected changed_by, got %v", events[0]["changed_by"])
+	}
+
+	if diff := cfg.ConfigChanged(ctx, cfg, ""); !diff.Empty() || len(events) != 1 {
+		t.Error("expected no event without changes")
+	}
+}
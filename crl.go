@@ -0,0 +1,282 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CRLConfig configures revocation checking with certificate revocation
+// lists (CRLs), which many CAs are adopting in place of OCSP.
+//
+// When enabled, the CRL referenced by the CRL distribution point of each
+// cached certificate is downloaded, verified against the certificate's
+// issuer, cached in storage, and refreshed when its next update is due.
+// The CRLs are checked as part of the OCSP maintenance (see
+// CacheOptions.OCSPCheckInterval), and managed certificates that appear
+// on a CRL are renewed, just like those whose OCSP status is Revoked.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CRLConfig struct {
+	// Check the revocation status of certificates
+	// with CRLs. Default: false.
+	Enabled bool
+
+	// The HTTP client to use for downloading CRLs. Like
+	// OCSPConfig.HTTPClient, it is used as the base of the
+	// client of an Egress, if one applies.
+	// Default: the HTTP client for OCSP requests (see OCSPConfig).
+	HTTPClient *http.Client
+
+	// The maximum size of CRLs, in bytes.
+	// Default: DefaultCRLMaxSize.
+	MaxSize int64
+}
+
+// DefaultCRLMaxSize is the default maximum size of CRLs (16 MiB).
+const DefaultCRLMaxSize = 16 * 1024 * 1024
+
+func (crlConfig CRLConfig) maxSize() int64 {
+	if crlConfig.MaxSize > 0 {
+		return crlConfig.MaxSize
+	}
+	return DefaultCRLMaxSize
+}
+
+// httpClient returns the HTTP client for downloading CRLs with ctx,
+// which is made like the one for OCSP requests with ocspConfig.
+func (crlConfig CRLConfig) httpClient(ctx context.Context, ocspConfig OCSPConfig) *http.Client {
+	if crlConfig.HTTPClient != nil {
+		ocspConfig.HTTPClient = crlConfig.HTTPClient
+	}
+	return ocspConfig.httpClient(ctx)
+}
+
+// errNoCRLDistributionPoint is returned when checking the CRL of
+// a certificate that does not have an HTTP(S) CRL distribution point.
+var errNoCRLDistributionPoint = errors.New("no CRL distribution point specified in certificate")
+
+// checkCRL returns the entry of cert on the CRL of its issuer, or nil if
+// cert is not on it. The CRL is loaded from memory or storage if it is
+// fresh, and is downloaded otherwise; if ctx is for storage only (see
+// ctxKeyOCSPStorageOnly), it is never downloaded, and otherwise it is
+// downloaded with the HTTP client for ocspConfig (see CRLConfig.HTTPClient).
+// The issuer certificate must be the second certificate in the chain.
+func checkCRL(ctx context.Context, crlConfig CRLConfig, ocspConfig OCSPConfig, storage Storage, cert Certificate, logger *zap.Logger) (*x509.RevocationListEntry, error) {
+	crlURL := crlDistributionPoint(cert.Leaf)
+	if crlURL == "" {
+		return nil, errNoCRLDistributionPoint
+	}
+	if len(cert.Certificate.Certificate) < 2 {
+		return nil, fmt.Errorf("no issuer certificate in chain to verify CRL with")
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate.Certificate[1])
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer certificate: %v", err)
+	}
+	if err := cert.Leaf.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("certificate not issued by next certificate in chain: %v", err)
+	}
+	crl, err := loadCRL(ctx, crlConfig, ocspConfig.forCert(cert), storage, crlURL, issuer, logger)
+	if err != nil {
+		return nil, err
+	}
+	return crl.revoked[cert.Leaf.SerialNumber.String()], nil
+}
+
+// crlDistributionPoint returns the first HTTP(S) CRL
+// distribution point of cert, or "" if it has none.
+func crlDistributionPoint(cert *x509.Certificate) string {
+	for _, dp := range cert.CRLDistributionPoints {
+		if u, err := url.Parse(dp); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			return dp
+		}
+	}
+	return ""
+}
+
+// cachedCRL is a verified CRL, indexed for lookups.
+type cachedCRL struct {
+	thisUpdate time.Time
+	nextUpdate time.Time
+	revoked    map[string]*x509.RevocationListEntry // by serial number
+}
+
+// fresh returns whether the CRL does not need to be refreshed yet. CRLs
+// without a next update are refreshed daily.
+func (crl *cachedCRL) fresh() bool {
+	if crl.nextUpdate.IsZero() {
+		return timeNow().Before(crl.thisUpdate.Add(24 * time.Hour))
+	}
+	return timeNow().Before(crl.nextUpdate)
+}
+
+// parseCRL parses the DER- or PEM-encoded CRL and verifies that it
+// was issued by issuer.
+func parseCRL(crlBytes []byte, issuer *x509.Certificate) (*cachedCRL, error) {
+	if block, _ := pem.Decode(crlBytes); block != nil && block.Type == "X509 CRL" {
+		crlBytes = block.Bytes
+	}
+	rl, err := x509.ParseRevocationList(crlBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := rl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("verifying CRL: %v", err)
+	}
+	crl := &cachedCRL{
+		thisUpdate: rl.ThisUpdate,
+		nextUpdate: rl.NextUpdate,
+		revoked:    make(map[string]*x509.RevocationListEntry, len(rl.RevokedCertificateEntries)),
+	}
+	for i := range rl.RevokedCertificateEntries {
+		entry := &rl.RevokedCertificateEntries[i]
+		crl.revoked[entry.SerialNumber.String()] = entry
+	}
+	return crl, nil
+}
+
+// loadCRL returns the CRL at crlURL, which must be issued by issuer.
+// Only one goroutine, and only one instance sharing storage, downloads
+// a CRL at a time; the others use the CRL it stores.
+func loadCRL(ctx context.Context, crlConfig CRLConfig, ocspConfig OCSPConfig, storage Storage, crlURL string, issuer *x509.Certificate, logger *zap.Logger) (*cachedCRL, error) {
+	if crl := cachedCRLFor(crlURL, issuer); crl != nil && crl.fresh() {
+		return crl, nil
+	}
+
+	crlKey := StorageKeys.CRL(crlURL)
+	unlock, err := lockFetch(ctx, storage, crlKey, "crl_"+path.Base(crlKey))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// the CRL may have been refreshed while we waited
+	if crl := cachedCRLFor(crlURL, issuer); crl != nil && crl.fresh() {
+		return crl, nil
+	}
+
+	var stored *cachedCRL
+	if crlBytes, err := storage.Load(ctx, crlKey); err == nil {
+		stored, err = parseCRL(crlBytes, issuer)
+		if err != nil {
+			warnCtx(ctx, Warning{
+				Kind:       WarningCorruptStorage,
+				Message:    "invalid CRL in storage; replacing",
+				StorageKey: crlKey,
+				Err:        err,
+			})
+		}
+	}
+	storageOnly, _ := ctx.Value(ctxKeyOCSPStorageOnly).(bool)
+	if stored != nil && (stored.fresh() || storageOnly) {
+		rememberCRL(crlURL, issuer, stored)
+		return stored, nil
+	}
+	if storageOnly {
+		return nil, fmt.Errorf("no CRL for %s in storage", crlURL)
+	}
+
+	crlBytes, err := fetchCRL(ctx, crlConfig.httpClient(ctx, ocspConfig), crlConfig.maxSize(), crlURL)
+	if err != nil {
+		return nil, fmt.Errorf("downloading CRL from %s: %w", crlURL, err)
+	}
+	crl, err := parseCRL(crlBytes, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("CRL from %s: %v", crlURL, err)
+	}
+	if err := storage.Store(ctx, crlKey, crlBytes); err != nil {
+		logger.Error("unable to store CRL",
+			zap.String("url", crlURL),
+			zap.String("storage_key", crlKey),
+			zap.Error(err))
+	}
+	rememberCRL(crlURL, issuer, crl)
+	return crl, nil
+}
+
+// fetchCRL downloads the CRL at crlURL, which may not be larger than maxSize.
+func fetchCRL(ctx context.Context, httpClient *http.Client, maxSize int64, crlURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, crlFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, crlURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return readOCSPFetch(resp, maxSize, crlContentTypes)
+}
+
+// crlFetchTimeout is how long downloading a CRL may take;
+// CRLs can be much larger than OCSP responses.
+const crlFetchTimeout = 2 * time.Minute
+
+// The content types of CRLs; RFC 5280 specifies application/pkix-crl.
+var crlContentTypes = []string{"application/pkix-crl", "application/x-pkcs7-crl"}
+
+// cachedCRLFor returns the CRL at crlURL from memory, if it is
+// issued by issuer.
+func cachedCRLFor(crlURL string, issuer *x509.Certificate) *cachedCRL {
+	crlCacheMu.Lock()
+	defer crlCacheMu.Unlock()
+	return crlCache[newCRLCacheKey(crlURL, issuer)]
+}
+
+func rememberCRL(crlURL string, issuer *x509.Certificate, crl *cachedCRL) {
+	crlCacheMu.Lock()
+	crlCache[newCRLCacheKey(crlURL, issuer)] = crl
+	crlCacheMu.Unlock()
+}
+
+// crlCacheKey identifies a CRL by its distribution point and its
+// issuer. The subject alone does not identify the issuer, since CAs
+// reuse subjects for new keys, so the key identifier is included.
+type crlCacheKey struct {
+	url, issuerSubject, issuerKeyID string
+}
+
+func newCRLCacheKey(crlURL string, issuer *x509.Certificate) crlCacheKey {
+	keyID := issuer.SubjectKeyId
+	if len(keyID) == 0 {
+		// like the method (1) of RFC 5280 section 4.2.1.2, but
+		// on all of the SubjectPublicKeyInfo, which is simpler
+		sum := sha1.Sum(issuer.RawSubjectPublicKeyInfo)
+		keyID = sum[:]
+	}
+	return crlCacheKey{url: crlURL, issuerSubject: string(issuer.RawSubject), issuerKeyID: string(keyID)}
+}
+
+// crlCache holds the most recent CRLs, keyed by
+// distribution point and issuer.
+var (
+	crlCache   = make(map[crlCacheKey]*cachedCRL)
+	crlCacheMu sync.Mutex
+)
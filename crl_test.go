@@ -0,0 +1,198 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCRLRevocationTriggersRenewal(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	otherCA := new(FakeIssuer)
+	var fetches atomic.Int32
+	var bogus atomic.Bool
+	crlServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		signer := fi
+		if bogus.Load() {
+			signer = otherCA
+		}
+		crl, err := signer.CRL(24 * time.Hour)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(crl)
+	}))
+	t.Cleanup(crlServer.Close)
+	fi.CRLDistributionPoint = crlServer.URL + "/crl"
+
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.CRL = CRLConfig{Enabled: true}
+	var eventsMu sync.Mutex
+	var events []map[string]any
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "cert_crl_revoked" {
+			eventsMu.Lock()
+			events = append(events, data)
+			eventsMu.Unlock()
+		}
+		return nil
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := func() Certificate {
+		t.Helper()
+		certs := cfg.certCache.getAllMatchingCerts("example.com")
+		if len(certs) != 1 {
+			t.Fatalf("expected 1 cached certificate, got %d", len(certs))
+		}
+		return certs[0]
+	}
+
+	// CRLs that are not signed by the issuer are rejected
+	bogus.Store(true)
+	certRes, err := cfg.loadCertResource(ctx, fi, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fi.Revoke(ctx, certRes, 4); err != nil {
+		t.Fatal(err)
+	}
+	cfg.certCache.updateOCSPStaples(ctx)
+	if cached().Revoked() || len(fi.Issued()) != 1 {
+		t.Fatal("expected CRL from other CA not to be trusted")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.CRL(fi.CRLDistributionPoint)) {
+		t.Error("expected untrusted CRL not to be stored")
+	}
+
+	// the revoked certificate is found on the CRL and renewed
+	bogus.Store(false)
+	fetches.Store(0)
+	cfg.certCache.updateOCSPStaples(ctx)
+	if fetches.Load() != 1 {
+		t.Errorf("expected 1 CRL download, got %d", fetches.Load())
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.CRL(fi.CRLDistributionPoint)) {
+		t.Error("expected CRL to be stored")
+	}
+	if len(fi.Issued()) != 2 {
+		t.Fatalf("expected certificate to be renewed, got %d issued", len(fi.Issued()))
+	}
+	renewed := cached()
+	if renewed.hash == cert.hash || renewed.Revoked() {
+		t.Error("expected revoked certificate to be replaced in cache")
+	}
+	eventsMu.Lock()
+	if len(events) != 1 || events[0]["reason"] != 4 {
+		t.Errorf("expected cert_crl_revoked event with reason, got %v", events)
+	}
+	eventsMu.Unlock()
+
+	// the fresh CRL is not downloaded again
+	cfg.certCache.updateOCSPStaples(ctx)
+	if fetches.Load() != 1 {
+		t.Errorf("expected cached CRL to be used, got %d downloads", fetches.Load())
+	}
+
+	// it is refreshed when its next update is due
+	faults.set(25*time.Hour, false)
+	cfg.certCache.updateOCSPStaples(ctx)
+	if fetches.Load() != 2 {
+		t.Errorf("expected stale CRL to be refreshed, got %d downloads", fetches.Load())
+	}
+	if cached().Revoked() {
+		t.Error("expected renewed certificate not to be revoked")
+	}
+}
+
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestLoadCRL(t *testing.T) {
+	ctx := context.Background()
+	fi, otherCA := new(FakeIssuer), new(FakeIssuer)
+	crlServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		crl, err := fi.CRL(24 * time.Hour)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(crl)
+	}))
+	t.Cleanup(crlServer.Close)
+	issuer, err := fi.CACertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := otherCA.CACertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// CRLs are downloaded with the client for OCSP requests,
+	// unless there is one for CRLs
+	ocspTransport, crlTransport := new(countingTransport), new(countingTransport)
+	ocspConfig := OCSPConfig{HTTPClient: &http.Client{Transport: ocspTransport}}
+	storage := &FileStorage{Path: t.TempDir()}
+	if _, err := loadCRL(ctx, CRLConfig{}, ocspConfig, storage, crlServer.URL+"/ocsp-client", issuer, defaultTestLogger); err != nil {
+		t.Fatal(err)
+	}
+	crlConfig := CRLConfig{HTTPClient: &http.Client{Transport: crlTransport}}
+	if _, err := loadCRL(ctx, crlConfig, ocspConfig, storage, crlServer.URL+"/crl-client", issuer, defaultTestLogger); err != nil {
+		t.Fatal(err)
+	}
+	if ocspTransport.requests.Load() != 1 || crlTransport.requests.Load() != 1 {
+		t.Errorf("expected one download with each client, got %d and %d",
+			ocspTransport.requests.Load(), crlTransport.requests.Load())
+	}
+
+	// a cached CRL is not used for another issuer with the same subject
+	if cachedCRLFor(crlServer.URL+"/crl-client", issuer) == nil {
+		t.Error("expected CRL to be cached for its issuer")
+	}
+	if string(other.RawSubject) != string(issuer.RawSubject) {
+		t.Fatal("expected CAs with the same subject")
+	}
+	if cachedCRLFor(crlServer.URL+"/crl-client", other) != nil {
+		t.Error("expected CRL not to be cached for another issuer")
+	}
+}
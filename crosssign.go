@@ -0,0 +1,121 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+// CrossSignPolicy chooses which of the cross-signed certificates that
+// can extend the chain of leaf to include for the client; they are
+// included in the order returned. It must not modify crossSigns.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CrossSignPolicy func(hello *tls.ClientHelloInfo, leaf *x509.Certificate, crossSigns []*x509.Certificate) []*x509.Certificate
+
+// CrossSignForLegacyClients is a CrossSignPolicy that includes the
+// cross-signed certificates only for clients that do not support
+// TLS 1.3, which are the most likely to only trust old roots; other
+// clients get the shorter chain.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func CrossSignForLegacyClients(hello *tls.ClientHelloInfo, _ *x509.Certificate, crossSigns []*x509.Certificate) []*x509.Certificate {
+	if slices.Contains(hello.SupportedVersions, tls.VersionTLS13) {
+		return nil
+	}
+	return crossSigns
+}
+
+// CrossSignByRootName returns a CrossSignPolicy that only includes
+// the cross-signed certificates issued by roots with the given common
+// names, for example to include only those of roots that are still
+// trusted by some clients.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func CrossSignByRootName(rootCommonNames ...string) CrossSignPolicy {
+	return func(_ *tls.ClientHelloInfo, _ *x509.Certificate, crossSigns []*x509.Certificate) []*x509.Certificate {
+		var included []*x509.Certificate
+		for _, crossSign := range crossSigns {
+			if slices.Contains(rootCommonNames, crossSign.Issuer.CommonName) {
+				included = append(included, crossSign)
+			}
+		}
+		return included
+	}
+}
+
+// withCrossSigns returns the certificate to serve to the client, with
+// the cross-signed certificates chosen by the policy appended to its
+// chain.
+func (cfg *Config) withCrossSigns(hello *tls.ClientHelloInfo, cert Certificate) *tls.Certificate {
+	crossSigns := cfg.crossSignsFor(cert)
+	if len(crossSigns) > 0 && cfg.CrossSignPolicy != nil {
+		crossSigns = cfg.CrossSignPolicy(hello, cert.Leaf, crossSigns)
+	}
+	if len(crossSigns) == 0 {
+		return &cert.Certificate
+	}
+	tlsCert := cert.Certificate
+	tlsCert.Certificate = slices.Clip(tlsCert.Certificate)
+	for _, crossSign := range crossSigns {
+		tlsCert.Certificate = append(tlsCert.Certificate, crossSign.Raw)
+	}
+	return &tlsCert
+}
+
+// crossSignsFor returns the cross-signed certificates that extend the
+// chain of cert, in chain order: each one signed the last certificate
+// of the chain or another one returned before it. Cross-signed
+// certificates already in the chain, and roots, are not returned.
+func (cfg *Config) crossSignsFor(cert Certificate) []*x509.Certificate {
+	chain := cert.Certificate.Certificate
+	if len(chain) == 0 {
+		return nil
+	}
+	last := cert.Leaf
+	if len(chain) > 1 || last == nil {
+		var err error
+		if last, err = x509.ParseCertificate(chain[len(chain)-1]); err != nil {
+			cfg.Logger.Error("parsing certificate chain", zap.Strings("identifiers", cert.Names), zap.Error(err))
+			return nil
+		}
+	}
+	var crossSigns []*x509.Certificate
+	included := func(crossSign *x509.Certificate) bool {
+		return slices.Contains(crossSigns, crossSign) ||
+			slices.ContainsFunc(chain, func(der []byte) bool { return bytes.Equal(der, crossSign.Raw) })
+	}
+	for signed := []*x509.Certificate{last}; len(signed) > 0; {
+		var next []*x509.Certificate
+		for _, crossSign := range cfg.CrossSignedCertificates {
+			if included(crossSign) || bytes.Equal(crossSign.RawSubject, crossSign.RawIssuer) {
+				continue // roots are never sent
+			}
+			if slices.ContainsFunc(signed, func(cert *x509.Certificate) bool {
+				return bytes.Equal(cert.RawIssuer, crossSign.RawSubject) && cert.CheckSignatureFrom(crossSign) == nil
+			}) {
+				crossSigns = append(crossSigns, crossSign)
+				next = append(next, crossSign)
+			}
+		}
+		signed = next
+	}
+	return crossSigns
+}
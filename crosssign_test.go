@@ -0,0 +1,116 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCrossSigns(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	oldCA := &InternalIssuer{Storage: storage, CA: "old"}
+	newCA := &InternalIssuer{Storage: storage, CA: "new"}
+
+	// cross-sign the new root with the old one
+	oldRoot, oldRootKey, err := oldCA.loadOrCreateRoot(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRoot, err := newCA.RootCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := randomSerialNumber()
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               newRoot.Subject,
+		NotBefore:             newRoot.NotBefore,
+		NotAfter:              oldRoot.NotAfter,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, oldRoot, newRoot.PublicKey, oldRootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crossSign, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued, err := newCA.Issue(ctx, newInternalTestCSR(t, "app.internal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := Certificate{Names: []string{"app.internal"}}
+	cert.Leaf = chain[0]
+	cert.Certificate.Certificate = [][]byte{chain[0].Raw, chain[1].Raw}
+
+	cfg := &Config{Logger: defaultTestLogger, CrossSignedCertificates: []*x509.Certificate{oldRoot, crossSign}} // roots are ignored
+	verifies := func(tlsCert *tls.Certificate, root *x509.Certificate) bool {
+		roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+		roots.AddCert(root)
+		for _, der := range tlsCert.Certificate[1:] {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			intermediates.AddCert(c)
+		}
+		_, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, CurrentTime: time.Now()})
+		return err == nil
+	}
+
+	legacyHello := &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS12}}
+	modernHello := &tls.ClientHelloInfo{SupportedVersions: []uint16{tls.VersionTLS13, tls.VersionTLS12}}
+
+	served := cfg.withCrossSigns(modernHello, cert)
+	if len(served.Certificate) != 3 {
+		t.Fatalf("expected cross-sign to be appended, got chain of %d", len(served.Certificate))
+	}
+	if !verifies(served, oldRoot) || !verifies(served, newRoot) {
+		t.Error("expected chain to verify with both roots")
+	}
+	if len(cert.Certificate.Certificate) != 2 {
+		t.Error("expected cached chain to be unchanged")
+	}
+
+	cfg.CrossSignPolicy = CrossSignForLegacyClients
+	if served := cfg.withCrossSigns(modernHello, cert); len(served.Certificate) != 2 || verifies(served, oldRoot) {
+		t.Errorf("expected short chain for modern client, got %d certificates", len(served.Certificate))
+	}
+	if served := cfg.withCrossSigns(legacyHello, cert); !verifies(served, oldRoot) {
+		t.Error("expected chain with cross-sign for legacy client")
+	}
+
+	cfg.CrossSignPolicy = CrossSignByRootName("Some Other Root")
+	if served := cfg.withCrossSigns(legacyHello, cert); len(served.Certificate) != 2 {
+		t.Errorf("expected no cross-sign from other root, got %d certificates", len(served.Certificate))
+	}
+	cfg.CrossSignPolicy = CrossSignByRootName(oldRoot.Subject.CommonName)
+	if served := cfg.withCrossSigns(legacyHello, cert); len(served.Certificate) != 3 {
+		t.Errorf("expected cross-sign from old root, got %d certificates", len(served.Certificate))
+	}
+}
@@ -29,9 +29,11 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
 	"io/fs"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/klauspost/cpuid/v2"
 	"github.com/zeebo/blake3"
@@ -40,8 +42,9 @@ import (
 )
 
 // PEMEncodePrivateKey marshals a private key into a PEM-encoded block.
-// The private key must be one of *ecdsa.PrivateKey, *rsa.PrivateKey, or
-// *ed25519.PrivateKey.
+// The private key must be one of *ecdsa.PrivateKey, *rsa.PrivateKey,
+// *ed25519.PrivateKey, *mldsa.PrivateKey (with Go 1.27 and newer),
+// or a PEMPrivateKey.
 func PEMEncodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
 	var pemType string
 	var keyBytes []byte
@@ -63,8 +66,22 @@ func PEMEncodePrivateKey(key crypto.PrivateKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case PEMPrivateKey:
+		block, err := key.MarshalPEM()
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(block), nil
 	default:
-		return nil, fmt.Errorf("unsupported key type: %T", key)
+		if !isMLDSAKey(key) {
+			return nil, fmt.Errorf("unsupported key type: %T", key)
+		}
+		// there is no other encoding for ML-DSA keys than PKCS#8
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
 	}
 	pemKey := pem.Block{Type: pemType + " PRIVATE KEY", Bytes: keyBytes}
 	return pem.EncodeToMemory(&pemKey), nil
@@ -83,6 +100,13 @@ func PEMDecodePrivateKey(keyPEMBytes []byte) (crypto.Signer, error) {
 		return nil, fmt.Errorf("failed to decode PEM block containing private key")
 	}
 
+	privateKeyDecodersMu.RLock()
+	decode, ok := privateKeyDecoders[keyBlockDER.Type]
+	privateKeyDecodersMu.RUnlock()
+	if ok {
+		return decode(keyBlockDER.Bytes)
+	}
+
 	if keyBlockDER.Type != "PRIVATE KEY" && !strings.HasSuffix(keyBlockDER.Type, " PRIVATE KEY") {
 		return nil, fmt.Errorf("unknown PEM header %q", keyBlockDER.Type)
 	}
@@ -96,6 +120,9 @@ func PEMDecodePrivateKey(keyPEMBytes []byte) (crypto.Signer, error) {
 		case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
 			return key.(crypto.Signer), nil
 		default:
+			if isMLDSAKey(key) {
+				return key.(crypto.Signer), nil
+			}
 			return nil, fmt.Errorf("found unknown private key type in PKCS#8 wrapping: %T", key)
 		}
 	}
@@ -107,6 +134,71 @@ func PEMDecodePrivateKey(keyPEMBytes []byte) (crypto.Signer, error) {
 	return nil, fmt.Errorf("unknown private key type")
 }
 
+// PEMPrivateKey is a private key that is not one of the standard
+// types, such as a key held by hardware, which encodes itself for
+// storage. Its PEM block type must be registered with
+// RegisterPrivateKeyDecoder so that it can be loaded again.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type PEMPrivateKey interface {
+	crypto.Signer
+	MarshalPEM() (*pem.Block, error)
+}
+
+var (
+	privateKeyDecoders   = make(map[string]func(der []byte) (crypto.Signer, error))
+	privateKeyDecodersMu sync.RWMutex
+)
+
+// RegisterPrivateKeyDecoder registers a function that decodes private
+// keys in PEM blocks of the given type, for keys that are not in a
+// standard format (see PEMPrivateKey). It must be called before any
+// certificates or accounts with such keys are loaded.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func RegisterPrivateKeyDecoder(pemType string, decode func(der []byte) (crypto.Signer, error)) {
+	privateKeyDecodersMu.Lock()
+	defer privateKeyDecodersMu.Unlock()
+	privateKeyDecoders[pemType] = decode
+}
+
+// x509KeyPair is like tls.X509KeyPair, but also supports private
+// keys with a registered decoder.
+func x509KeyPair(certPEMBlock, keyPEMBlock []byte) (tls.Certificate, error) {
+	keyBlock, _ := pem.Decode(keyPEMBlock)
+	if keyBlock != nil {
+		privateKeyDecodersMu.RLock()
+		_, ok := privateKeyDecoders[keyBlock.Type]
+		privateKeyDecodersMu.RUnlock()
+		if ok {
+			return x509KeyPairWithSigner(certPEMBlock, keyPEMBlock)
+		}
+	}
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+}
+
+func x509KeyPairWithSigner(certPEMBlock, keyPEMBlock []byte) (tls.Certificate, error) {
+	var cert tls.Certificate
+	certs, err := parseCertsFromPEMBundle(certPEMBlock)
+	if err != nil {
+		return cert, err
+	}
+	key, err := PEMDecodePrivateKey(keyPEMBlock)
+	if err != nil {
+		return cert, err
+	}
+	pub, ok := certs[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(key.Public()) {
+		return cert, fmt.Errorf("private key does not match public key")
+	}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	cert.Leaf = certs[0]
+	cert.PrivateKey = key
+	return cert, nil
+}
+
 // parseCertsFromPEMBundle parses a certificate bundle from top to bottom and returns
 // a slice of x509 certificates. This function will error if no certificates are found.
 func parseCertsFromPEMBundle(bundle []byte) ([]*x509.Certificate, error) {
@@ -152,6 +244,15 @@ func (cfg *Config) saveCertResource(ctx context.Context, issuer Issuer, cert Cer
 	issuerKey := issuer.IssuerKey()
 	certKey := cert.NamesKey()
 
+	if cfg.CertificateHistory > 0 {
+		// keeping the previous version is not worth failing over
+		if err := cfg.archiveCertResource(ctx, issuer, certKey, cert); err != nil {
+			cfg.Logger.Error("unable to keep previous version of certificate",
+				zap.Strings("identifiers", cert.SANs),
+				zap.Error(err))
+		}
+	}
+
 	all := []keyValue{
 		{
 			key:   StorageKeys.SitePrivateKey(issuerKey, certKey),
@@ -167,7 +268,20 @@ func (cfg *Config) saveCertResource(ctx context.Context, issuer Issuer, cert Cer
 		},
 	}
 
-	return storeTx(ctx, cfg.Storage, all)
+	if err := storeTx(ctx, cfg.Storage, all); err != nil {
+		return err
+	}
+
+	// the index is only for lookups, so it's not worth failing over
+	certPEMKey := StorageKeys.SiteCert(issuerKey, certKey)
+	if err := cfg.indexCertificate(ctx, issuerKey, certPEMKey, cert.CertificatePEM); err != nil {
+		cfg.Logger.Error("unable to add certificate to index",
+			zap.Strings("identifiers", cert.SANs),
+			zap.String("cert_key", certPEMKey),
+			zap.Error(err))
+	}
+
+	return nil
 }
 
 // loadCertResourceAnyIssuer loads and returns the certificate resource from any
@@ -263,6 +377,10 @@ func (cfg *Config) loadCertResource(ctx context.Context, issuer Issuer, certName
 	if err != nil {
 		return CertificateResource{}, fmt.Errorf("decoding certificate metadata: %v", err)
 	}
+	if len(certRes.SANs) > 1 {
+		// may be the certificate of a group of names
+		certRes.namesKey = normalizedName
+	}
 
 	return certRes, nil
 }
@@ -293,6 +411,7 @@ func namesFromCSR(csr *x509.CertificateRequest) []string {
 	for _, v := range csr.URIs {
 		nameSet = append(nameSet, v.String())
 	}
+	nameSet = append(nameSet, otherNamesFromExtensions(csr.Extensions)...)
 	return nameSet
 }
 
@@ -332,10 +451,19 @@ var (
 type StandardKeyGenerator struct {
 	// The type of keys to generate.
 	KeyType KeyType
+
+	// Optional source of randomness to use instead of
+	// crypto/rand, such as NewDeterministicRand for
+	// reproducible keys. RSA keys are not supported.
+	// EXPERIMENTAL: Subject to change or removal.
+	Rand io.Reader
 }
 
 // GenerateKey generates a new private key according to kg.KeyType.
 func (kg StandardKeyGenerator) GenerateKey() (crypto.PrivateKey, error) {
+	if kg.Rand != nil {
+		return generateKeyFromRand(kg.KeyType, kg.Rand)
+	}
 	switch kg.KeyType {
 	case ED25519:
 		_, priv, err := ed25519.GenerateKey(rand.Reader)
@@ -350,6 +478,8 @@ func (kg StandardKeyGenerator) GenerateKey() (crypto.PrivateKey, error) {
 		return rsa.GenerateKey(rand.Reader, 4096)
 	case RSA8192:
 		return rsa.GenerateKey(rand.Reader, 8192)
+	case MLDSA44, MLDSA65, MLDSA87:
+		return generateMLDSAKey(kg.KeyType, nil)
 	}
 	return nil, fmt.Errorf("unrecognized or unsupported key type: %s", kg.KeyType)
 }
@@ -368,4 +498,11 @@ const (
 	RSA2048 = KeyType("rsa2048")
 	RSA4096 = KeyType("rsa4096")
 	RSA8192 = KeyType("rsa8192")
+
+	// Post-quantum ML-DSA keys (FIPS 204) require Go 1.27 or
+	// newer, and only few clients and CAs support them yet.
+	// EXPERIMENTAL: Subject to change or removal.
+	MLDSA44 = KeyType("mldsa44")
+	MLDSA65 = KeyType("mldsa65")
+	MLDSA87 = KeyType("mldsa87")
 )
@@ -0,0 +1,276 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CSIFileOutput writes managed certificates to files in the layout of the
+// cert-manager CSI driver and of Kubernetes secret volumes, for apps and
+// sidecars in container environments that only read certificates from
+// files. Each name gets a directory in Dir with these files:
+//
+//   - tls.crt: the certificate chain
+//   - tls.key: the private key
+//   - ca.crt: the certificate of the CA, if known; for SVIDs of the
+//     SPIFFEIssuer, it is the trust bundle
+//
+// Updates are atomic, as with the atomic writer of Kubernetes: the files
+// are written to a new, hidden directory, and the "..data" symlink is
+// switched to it with a rename, so that readers never see a mix of old
+// and new files. The files themselves are symlinks into "..data". Apps
+// that watch for changes with inotify should watch the directory for
+// the creation of "..data".
+//
+// To write certificates as they are obtained and renewed, and remove them
+// when they are decommissioned, call HandleEvent from
+// Config.OnEvent. On Windows, creating symlinks may require privileges.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CSIFileOutput struct {
+	// The storage from which to load certificates and
+	// keys when handling events. Required for HandleEvent.
+	Storage Storage
+
+	// The directory in which to make the directories
+	// of the names. Required.
+	Dir string
+
+	// Optionally, returns the name of the directory for the
+	// certificate for name. Default: the name, sanitized as
+	// a storage key.
+	DirName func(name string) string
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+}
+
+// Files of CSIFileOutput directories.
+const (
+	CSICertFile = "tls.crt"
+	CSIKeyFile  = "tls.key"
+	CSICAFile   = "ca.crt"
+
+	csiDataLink = "..data"
+)
+
+// HandleEvent writes the certificate of each "cert_obtained" event, and
+// removes the files of each "cert_decommissioned" event; other events
+// are ignored. It can be called from Config.OnEvent.
+func (out *CSIFileOutput) HandleEvent(ctx context.Context, event string, data map[string]any) error {
+	switch event {
+	case "cert_obtained":
+	case "cert_decommissioned":
+		name, _ := data["identifier"].(string)
+		if name == "" {
+			return fmt.Errorf("event is missing identifier")
+		}
+		return out.Remove(name)
+	default:
+		return nil
+	}
+
+	name, _ := data["identifier"].(string)
+	certPath, _ := data["certificate_path"].(string)
+	keyPath, _ := data["private_key_path"].(string)
+	if name == "" || certPath == "" || keyPath == "" {
+		return fmt.Errorf("event is missing certificate information")
+	}
+	certPEM, err := out.Storage.Load(ctx, certPath)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+	keyPEM, err := out.Storage.Load(ctx, keyPath)
+	if err != nil {
+		return fmt.Errorf("loading private key: %v", err)
+	}
+	var caPEM []byte
+	if metaPath, _ := data["metadata_path"].(string); metaPath != "" {
+		caPEM = out.loadBundle(ctx, metaPath)
+	}
+	if caPEM == nil {
+		caPEM = caFromChain(certPEM)
+	}
+	if err := out.Write(name, certPEM, keyPEM, caPEM); err != nil {
+		out.logger().Error("unable to write certificate files",
+			zap.String("identifier", name),
+			zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// loadBundle returns the trust bundle from the issuer metadata
+// of the certificate resource stored at metaPath, if any.
+func (out *CSIFileOutput) loadBundle(ctx context.Context, metaPath string) []byte {
+	metaJSON, err := out.Storage.Load(ctx, metaPath)
+	if err != nil {
+		return nil
+	}
+	var certRes CertificateResource
+	if err := json.Unmarshal(metaJSON, &certRes); err != nil {
+		return nil
+	}
+	var meta SPIFFEMetadata
+	if err := json.Unmarshal(certRes.IssuerData, &meta); err != nil || meta.BundlePEM == "" {
+		return nil
+	}
+	return []byte(meta.BundlePEM)
+}
+
+// caFromChain returns the PEM-encoded top-most certificate of the
+// chain certPEM, if it has any besides the leaf.
+func caFromChain(certPEM []byte) []byte {
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil || len(certs) < 2 {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certs[len(certs)-1].Raw})
+}
+
+// Write atomically replaces the files for name with the given PEM-encoded
+// certificate chain, private key, and CA certificate, which may be nil.
+func (out *CSIFileOutput) Write(name string, certPEM, keyPEM, caPEM []byte) error {
+	dir := out.dir(name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	// write the files into a new directory
+	dataDir, err := os.MkdirTemp(dir, ".."+time.Now().UTC().Format("2006_01_02_15_04_05."))
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(dataDir, 0o755); err != nil {
+		os.RemoveAll(dataDir)
+		return err
+	}
+	files := []struct {
+		name    string
+		content []byte
+		mode    os.FileMode
+	}{
+		{CSICertFile, certPEM, 0o644},
+		{CSIKeyFile, keyPEM, 0o600},
+		{CSICAFile, caPEM, 0o644},
+	}
+	for _, file := range files {
+		if file.content == nil {
+			continue
+		}
+		if err := writeFileSync(filepath.Join(dataDir, file.name), file.content, file.mode); err != nil {
+			os.RemoveAll(dataDir)
+			return err
+		}
+	}
+
+	// switch the data link over to the new directory, atomically
+	oldDataDir, _ := os.Readlink(filepath.Join(dir, csiDataLink))
+	tmpLink := filepath.Join(dir, csiDataLink+"_tmp")
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(dataDir), tmpLink); err != nil {
+		os.RemoveAll(dataDir)
+		return err
+	}
+	if err := os.Rename(tmpLink, filepath.Join(dir, csiDataLink)); err != nil {
+		os.Remove(tmpLink)
+		os.RemoveAll(dataDir)
+		return err
+	}
+
+	// make sure the files link into the data directory
+	for _, file := range files {
+		link := filepath.Join(dir, file.name)
+		if file.content == nil {
+			os.Remove(link)
+			continue
+		}
+		if target, err := os.Readlink(link); err == nil && target == filepath.Join(csiDataLink, file.name) {
+			continue
+		}
+		os.Remove(link)
+		if err := os.Symlink(filepath.Join(csiDataLink, file.name), link); err != nil {
+			return err
+		}
+	}
+
+	if oldDataDir != "" && oldDataDir != filepath.Base(dataDir) && strings.HasPrefix(oldDataDir, "..") {
+		if err := os.RemoveAll(filepath.Join(dir, oldDataDir)); err != nil {
+			out.logger().Warn("unable to remove old certificate files",
+				zap.String("identifier", name),
+				zap.String("dir", oldDataDir),
+				zap.Error(err))
+		}
+	}
+
+	out.logger().Info("wrote certificate files",
+		zap.String("identifier", name),
+		zap.String("dir", dir))
+	return nil
+}
+
+// Remove removes the directory of the files for name.
+func (out *CSIFileOutput) Remove(name string) error {
+	err := os.RemoveAll(out.dir(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (out *CSIFileOutput) dir(name string) string {
+	dirName := StorageKeys.safeSite(name)
+	if out.DirName != nil {
+		dirName = out.DirName(name)
+	}
+	return filepath.Join(out.Dir, dirName)
+}
+
+func (out *CSIFileOutput) logger() *zap.Logger {
+	if out.Logger == nil {
+		return zap.NewNop()
+	}
+	return out.Logger
+}
+
+// writeFileSync writes data to a new file with the given mode,
+// and syncs it to disk.
+func writeFileSync(name string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,114 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCSIFileOutputWrite(t *testing.T) {
+	out := &CSIFileOutput{Dir: t.TempDir()}
+	dir := filepath.Join(out.Dir, "example.com")
+
+	if err := out.Write("example.com", []byte("cert 1"), []byte("key 1"), []byte("ca 1")); err != nil {
+		t.Fatal(err)
+	}
+	firstData, err := os.Readlink(filepath.Join(dir, csiDataLink))
+	if err != nil {
+		t.Fatalf("expected data link: %v", err)
+	}
+	for file, expected := range map[string]string{CSICertFile: "cert 1", CSIKeyFile: "key 1", CSICAFile: "ca 1"} {
+		if target, _ := os.Readlink(filepath.Join(dir, file)); target != filepath.Join(csiDataLink, file) {
+			t.Errorf("expected %s to link into data directory, got %q", file, target)
+		}
+		if content, _ := os.ReadFile(filepath.Join(dir, file)); string(content) != expected {
+			t.Errorf("expected %s to contain %q, got %q", file, expected, content)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, CSIKeyFile)); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("expected private key to be private, got %v (err=%v)", info.Mode(), err)
+	}
+
+	// updates switch the data link and remove the old files
+	if err := out.Write("example.com", []byte("cert 2"), []byte("key 2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if secondData, _ := os.Readlink(filepath.Join(dir, csiDataLink)); secondData == firstData {
+		t.Error("expected data link to point to new directory")
+	}
+	if _, err := os.Stat(filepath.Join(dir, firstData)); !os.IsNotExist(err) {
+		t.Errorf("expected old data directory to be removed, got %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, CSICertFile)); string(content) != "cert 2" {
+		t.Errorf("expected updated certificate, got %q", content)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, CSICAFile)); !os.IsNotExist(err) {
+		t.Errorf("expected CA file to be removed without CA, got %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 4 {
+		t.Errorf("expected data directory, data link, and 2 files, got %v", entries)
+	}
+
+	if err := out.Remove("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected directory to be removed, got %v", err)
+	}
+}
+
+func TestCSIFileOutputHandleEvent(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	out := &CSIFileOutput{Storage: cfg.Storage, Dir: t.TempDir()}
+	var handleErr error
+	cfg.OnEvent = func(ctx context.Context, event string, data map[string]any) error {
+		if err := out.HandleEvent(ctx, event, data); err != nil {
+			handleErr = err
+		}
+		return nil
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if handleErr != nil {
+		t.Fatalf("handling event: %v", handleErr)
+	}
+	dir := filepath.Join(out.Dir, "example.com")
+	certPEM, _ := cfg.Storage.Load(ctx, StorageKeys.SiteCert("fake", "example.com"))
+	if content, _ := os.ReadFile(filepath.Join(dir, CSICertFile)); len(certPEM) == 0 || !bytes.Equal(content, certPEM) {
+		t.Errorf("expected certificate file to contain stored certificate, got %q", content)
+	}
+	keyPEM, _ := cfg.Storage.Load(ctx, StorageKeys.SitePrivateKey("fake", "example.com"))
+	if content, _ := os.ReadFile(filepath.Join(dir, CSIKeyFile)); len(keyPEM) == 0 || !bytes.Equal(content, keyPEM) {
+		t.Errorf("expected key file to contain stored private key, got %q", content)
+	}
+
+	if err := out.HandleEvent(ctx, "cert_decommissioned", map[string]any{"identifier": "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected directory to be removed, got %v", err)
+	}
+	if err := out.HandleEvent(ctx, "cert_obtained", map[string]any{"identifier": "example.com"}); err == nil {
+		t.Error("expected error for event without certificate paths")
+	}
+}
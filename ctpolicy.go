@@ -0,0 +1,177 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// CTPolicy is a Certificate Transparency policy that issued certificates
+// must comply with, like the CT policies of browsers: each certificate
+// must have Signed Certificate Timestamps (SCTs) embedded by the CA from
+// a minimum number of logs, run by a minimum number of distinct log
+// operators. Certificates that do not comply are rejected right after
+// they are issued: they are not stored or served, and issuance is tried
+// with the next issuer, and retried later like other failed issuances.
+// See Config.CTPolicy.
+//
+// Only the SCTs embedded in certificates are counted, not those delivered
+// in TLS extensions or OCSP responses, and their signatures are not
+// verified, so the policy guards against CAs that do not log certificates
+// (enough), not against forged SCTs.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CTPolicy struct {
+	// The minimum number of SCTs from distinct logs. Default:
+	// 2 for certificates valid for up to 180 days, and 3 for
+	// longer-lived certificates, as required by Chrome.
+	MinSCTs int
+
+	// The minimum number of distinct operators of the logs
+	// of the SCTs. Default: 2.
+	MinOperators int
+
+	// The operators of the known logs, by the base64-encoded
+	// log ID (the SHA-256 hash of the log's public key), as
+	// listed in the log lists of browsers. If set, SCTs from
+	// logs that are not in the map are not counted. If nil,
+	// all SCTs are counted, and each log is assumed to be
+	// run by a distinct operator.
+	LogOperators map[string]string
+}
+
+// SignedCertificateTimestamp is an SCT (RFC 6962 §3.2) that is embedded
+// in a certificate.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SignedCertificateTimestamp struct {
+	// The ID of the log, which is the SHA-256
+	// hash of the log's public key.
+	LogID [32]byte
+
+	// When the log promised to include the certificate.
+	Timestamp time.Time
+}
+
+// Check returns an error if leaf does not comply with the policy.
+func (p CTPolicy) Check(leaf *x509.Certificate) error {
+	scts, err := EmbeddedSCTs(leaf)
+	if err != nil {
+		return err
+	}
+
+	minSCTs := p.MinSCTs
+	if minSCTs <= 0 {
+		minSCTs = 2
+		if leaf.NotAfter.Sub(leaf.NotBefore) > 180*24*time.Hour {
+			minSCTs = 3
+		}
+	}
+	minOperators := p.MinOperators
+	if minOperators <= 0 {
+		minOperators = 2
+	}
+
+	logs := make(map[string]struct{})
+	operators := make(map[string]struct{})
+	for _, sct := range scts {
+		logID := base64.StdEncoding.EncodeToString(sct.LogID[:])
+		operator := logID
+		if p.LogOperators != nil {
+			var ok bool
+			operator, ok = p.LogOperators[logID]
+			if !ok {
+				continue
+			}
+		}
+		logs[logID] = struct{}{}
+		operators[operator] = struct{}{}
+	}
+
+	if len(logs) < minSCTs || len(operators) < minOperators {
+		return fmt.Errorf("certificate %x does not comply with CT policy: it has SCTs from %d accepted logs "+
+			"of %d operators, but %d logs of %d operators are required",
+			leaf.SerialNumber, len(logs), len(operators), minSCTs, minOperators)
+	}
+	return nil
+}
+
+// EmbeddedSCTs returns the SCTs that are embedded in cert.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func EmbeddedSCTs(cert *x509.Certificate) ([]SignedCertificateTimestamp, error) {
+	var list []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSCTList) {
+			if _, err := asn1.Unmarshal(ext.Value, &list); err != nil {
+				return nil, fmt.Errorf("decoding SCT list extension: %v", err)
+			}
+			break
+		}
+	}
+	if list == nil {
+		return nil, nil
+	}
+
+	// the list and its SCTs are TLS-encoded (RFC 6962 §3.3)
+	var scts []SignedCertificateTimestamp
+	input := cryptobyte.String(list)
+	var sctList cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&sctList) || !input.Empty() {
+		return nil, fmt.Errorf("malformed SCT list")
+	}
+	for !sctList.Empty() {
+		var sctBytes cryptobyte.String
+		var version uint8
+		var logID []byte
+		var timestamp uint64
+		if !sctList.ReadUint16LengthPrefixed(&sctBytes) ||
+			!sctBytes.ReadUint8(&version) {
+			return nil, fmt.Errorf("malformed SCT")
+		}
+		if version != 0 {
+			continue // unknown versions are ignored (RFC 6962 §3.2)
+		}
+		if !sctBytes.ReadBytes(&logID, 32) || !sctBytes.ReadUint64(&timestamp) {
+			return nil, fmt.Errorf("malformed SCT")
+		}
+		sct := SignedCertificateTimestamp{Timestamp: time.UnixMilli(int64(timestamp))}
+		copy(sct.LogID[:], logID)
+		scts = append(scts, sct)
+	}
+	return scts, nil
+}
+
+// oidSCTList is the embedded SCT list extension (RFC 6962 §3.3).
+var oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+// checkCTPolicy returns an error if the issued certificate does not
+// comply with cfg's CT policy, if any.
+func (cfg *Config) checkCTPolicy(issued *IssuedCertificate) error {
+	if cfg.CTPolicy == nil {
+		return nil
+	}
+	chain, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		return fmt.Errorf("parsing issued certificate: %v", err)
+	}
+	return cfg.CTPolicy.Check(chain[0])
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCTPolicyCheck(t *testing.T) {
+	logA1, logA2, logB := [32]byte{1}, [32]byte{2}, [32]byte{3}
+	operators := map[string]string{
+		base64.StdEncoding.EncodeToString(logA1[:]): "A",
+		base64.StdEncoding.EncodeToString(logA2[:]): "A",
+		base64.StdEncoding.EncodeToString(logB[:]):  "B",
+	}
+
+	for i, tc := range []struct {
+		logIDs    [][32]byte
+		lifetime  time.Duration
+		policy    CTPolicy
+		expectErr bool
+	}{
+		{logIDs: nil, expectErr: true},
+		{logIDs: [][32]byte{logA1}, expectErr: true},
+		{logIDs: [][32]byte{logA1, logB}, expectErr: false},
+		{logIDs: [][32]byte{logA1, logA1}, expectErr: true}, // same log twice
+		{logIDs: [][32]byte{logA1, logA2}, policy: CTPolicy{LogOperators: operators}, expectErr: true},
+		{logIDs: [][32]byte{logA1, logB}, policy: CTPolicy{LogOperators: operators}, expectErr: false},
+		{logIDs: [][32]byte{logA1, {9}}, policy: CTPolicy{LogOperators: operators}, expectErr: true}, // unknown log
+		{logIDs: [][32]byte{logA1, logB}, lifetime: 365 * 24 * time.Hour, expectErr: true},
+		{logIDs: [][32]byte{logA1, logA2, logB}, lifetime: 365 * 24 * time.Hour, expectErr: false},
+		{logIDs: [][32]byte{logA1, logA2}, policy: CTPolicy{MinSCTs: 1, MinOperators: 1}, expectErr: false},
+	} {
+		fi := &FakeIssuer{SCTLogIDs: tc.logIDs, Lifetime: tc.lifetime}
+		cert, _ := issueFakeCertificate(t, fi, "example.com")
+		err := tc.policy.Check(cert.Leaf)
+		if tc.expectErr && err == nil {
+			t.Errorf("test %d: expected certificate to violate policy", i)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("test %d: expected certificate to comply with policy, got: %v", i, err)
+		}
+	}
+}
+
+func TestEmbeddedSCTs(t *testing.T) {
+	fi := &FakeIssuer{SCTLogIDs: [][32]byte{{1}, {2}}}
+	cert, _ := issueFakeCertificate(t, fi, "example.com")
+	scts, err := EmbeddedSCTs(cert.Leaf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scts) != 2 || scts[0].LogID != [32]byte{1} || scts[1].LogID != [32]byte{2} {
+		t.Fatalf("expected SCTs from logs 1 and 2, got %+v", scts)
+	}
+	if !scts[0].Timestamp.Equal(cert.Leaf.NotBefore) {
+		t.Errorf("expected SCT timestamp %s, got %s", cert.Leaf.NotBefore, scts[0].Timestamp)
+	}
+
+	cert, _ = issueFakeCertificate(t, new(FakeIssuer), "example.com")
+	if scts, err := EmbeddedSCTs(cert.Leaf); err != nil || len(scts) != 0 {
+		t.Errorf("expected no SCTs, got %v (error: %v)", scts, err)
+	}
+}
+
+func TestConfigCTPolicy(t *testing.T) {
+	ctx := context.Background()
+	notLogging := &FakeIssuer{Key: "not-logging", SCTLogIDs: [][32]byte{{1}}}
+	logging := &FakeIssuer{Key: "logging", SCTLogIDs: [][32]byte{{1}, {2}}}
+	cfg := newOnDemandTestConfig(t, notLogging)
+	cfg.OnDemand = nil
+	cfg.CTPolicy = new(CTPolicy)
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err == nil {
+		t.Fatal("expected certificate without enough SCTs to be rejected")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert(notLogging.IssuerKey(), "example.com")) {
+		t.Error("expected rejected certificate not to be stored")
+	}
+
+	cfg.Issuers = []Issuer{notLogging, logging}
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatalf("expected certificate from next issuer, got: %v", err)
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(logging.IssuerKey(), "example.com")) {
+		t.Error("expected compliant certificate to be stored")
+	}
+}
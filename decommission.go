@@ -0,0 +1,218 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/libdns/libdns"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// DecommissionOptions configures Config.Decommission.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type DecommissionOptions struct {
+	// Whether to revoke the certificates before deleting
+	// them. If revocation fails, the certificate assets
+	// are kept, so that revocation can be retried.
+	Revoke bool
+
+	// The reason for revocation; see RFC 5280 §5.3.1.
+	// Default: 0 (unspecified).
+	RevocationReason int
+
+	// Whether to delete leftover ACME DNS challenge records
+	// for the name. This requires the DNS provider of the
+	// issuer's DNS01Solver to implement libdns.RecordGetter.
+	CleanUpDNS bool
+}
+
+// Decommission stops managing the certificate for name and removes
+// everything related to it: for each of cfg's issuers, the certificate
+// is revoked (if opts.Revoke is set), and its assets are deleted from
+// storage, including its OCSP staple, previous versions (see
+// CertificateHistory), and any leftover challenge info.
+// The certificate is evicted from the cache, and if opts.CleanUpDNS is
+// set, leftover DNS challenge records are deleted. Finally, a
+// cert_decommissioned event is emitted.
+//
+// Decommission does not prevent the certificate from being obtained
+// again; to offboard a name, it must also be removed from the names
+// passed to ManageSync/ManageAsync or be denied by the on-demand
+// DecisionFunc. Decommissioning a name that has no certificate is
+// not an error.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) Decommission(ctx context.Context, name string, opts DecommissionOptions) error {
+	log := cfg.Logger.Named("decommission").With(zap.String("identifier", name))
+	name = normalizedName(name)
+
+	// make sure the certificate isn't renewed while we're at it
+	lockKey := cfg.lockKey(certIssueLockOp, name)
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			log.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	var errs []error
+	var revoked, deleted []string
+	for i, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+
+		if err := cfg.deleteChallengeInfo(ctx, issuerKey, name); err != nil {
+			errs = append(errs, fmt.Errorf("issuer %d (%s): deleting challenge info: %v", i, issuerKey, err))
+		}
+		if opts.CleanUpDNS {
+			if err := cfg.cleanUpDNSChallengeRecords(ctx, issuer, name); err != nil {
+				errs = append(errs, fmt.Errorf("issuer %d (%s): cleaning up DNS records: %v", i, issuerKey, err))
+			}
+		}
+
+		if err := cfg.Storage.Delete(ctx, StorageKeys.CertHistoryPrefix(issuerKey, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("issuer %d (%s): deleting previous versions: %v", i, issuerKey, err))
+		}
+
+		certRes, err := cfg.loadCertResource(ctx, issuer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("issuer %d (%s): loading certificate: %v", i, issuerKey, err))
+			continue
+		}
+
+		if opts.Revoke {
+			rev, ok := issuer.(Revoker)
+			if !ok {
+				errs = append(errs, fmt.Errorf("issuer %d (%s) is not a Revoker", i, issuerKey))
+				continue
+			}
+			if err := rev.Revoke(ctx, certRes, opts.RevocationReason); err != nil {
+				errs = append(errs, fmt.Errorf("issuer %d (%s): revoking certificate: %v", i, issuerKey, err))
+				continue
+			}
+			revoked = append(revoked, issuerKey)
+			log.Info("revoked certificate", zap.String("issuer", issuerKey))
+		}
+
+		if err := cfg.deleteOCSPStaple(ctx, certRes); err != nil {
+			errs = append(errs, fmt.Errorf("issuer %d (%s): deleting OCSP staple: %v", i, issuerKey, err))
+		}
+		if err := cfg.deleteSiteAssets(ctx, issuerKey, name); err != nil {
+			errs = append(errs, fmt.Errorf("issuer %d (%s): %v", i, issuerKey, err))
+			continue
+		}
+		deleted = append(deleted, issuerKey)
+		log.Info("deleted certificate assets", zap.String("issuer", issuerKey))
+	}
+
+	cfg.certCache.RemoveManaged([]SubjectIssuer{{Subject: name}})
+
+	cfg.emit(ctx, "cert_decommissioned", map[string]any{
+		"identifier": name,
+		"revoked":    revoked,
+		"deleted":    deleted,
+	})
+
+	return errors.Join(errs...)
+}
+
+// deleteOCSPStaple deletes the OCSP staple of certRes from storage, if any.
+func (cfg *Config) deleteOCSPStaple(ctx context.Context, certRes CertificateResource) error {
+	certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		return err
+	}
+	var cert Certificate
+	if err := fillCertFromLeaf(&cert, tls.Certificate{Certificate: [][]byte{certs[0].Raw}, Leaf: certs[0]}); err != nil {
+		return err
+	}
+	err = cfg.Storage.Delete(ctx, StorageKeys.OCSPStaple(&cert, certRes.CertificatePEM))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// deleteChallengeInfo deletes the challenge info for name that
+// was stored by the distributed solver for the given issuer, if
+// any; it is usually left over from an interrupted challenge.
+func (cfg *Config) deleteChallengeInfo(ctx context.Context, issuerKey, name string) error {
+	ds := distributedSolver{
+		storage:                cfg.Storage,
+		storageKeyIssuerPrefix: storageKeyACMECAPrefix(issuerKey),
+	}
+	err := cfg.Storage.Delete(ctx, ds.challengeTokensKey(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// cleanUpDNSChallengeRecords deletes the ACME DNS challenge records for
+// name, if issuer is an ACMEIssuer that uses a DNS01Solver.
+func (cfg *Config) cleanUpDNSChallengeRecords(ctx context.Context, issuer Issuer, name string) error {
+	am, ok := issuer.(*ACMEIssuer)
+	if !ok {
+		return nil
+	}
+	solver, ok := am.DNS01Solver.(*DNS01Solver)
+	if !ok {
+		return nil
+	}
+	dnsName := acme.Challenge{Identifier: acme.Identifier{Value: name}}.DNS01TXTRecordName()
+	if solver.OverrideDomain != "" {
+		dnsName = solver.OverrideDomain
+	}
+	return solver.DNSManager.deleteRecords(ctx, dnsName, "TXT")
+}
+
+// deleteRecords deletes all DNS records of the given type with the
+// given name, which requires the DNS provider to be able to list
+// the records of the zone.
+func (m *DNSManager) deleteRecords(ctx context.Context, dnsName, recordType string) error {
+	getter, ok := m.DNSProvider.(libdns.RecordGetter)
+	if !ok {
+		return fmt.Errorf("DNS provider %T cannot list records", m.DNSProvider)
+	}
+	zone, err := findZoneByFQDN(m.logger(), dnsName, recursiveNameservers(m.Resolvers))
+	if err != nil {
+		return fmt.Errorf("could not determine zone for domain %q: %v", dnsName, err)
+	}
+	recs, err := getter.GetRecords(ctx, zone)
+	if err != nil {
+		return fmt.Errorf("listing records in zone %q: %w", zone, err)
+	}
+	relName := libdns.RelativeName(dnsName+".", zone)
+	for _, rec := range recs {
+		if rec.Type != recordType || rec.Name != relName {
+			continue
+		}
+		if err := m.cleanUpRecord(ctx, zoneRecord{zone: zone, record: rec}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"golang.org/x/crypto/ocsp"
+)
+
+type memDNSProvider struct {
+	mu      sync.Mutex
+	records map[string][]libdns.Record // by zone
+}
+
+func (p *memDNSProvider) GetRecords(_ context.Context, zone string) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]libdns.Record(nil), p.records[zone]...), nil
+}
+
+func (p *memDNSProvider) AppendRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.records == nil {
+		p.records = make(map[string][]libdns.Record)
+	}
+	p.records[zone] = append(p.records[zone], recs...)
+	return recs, nil
+}
+
+func (p *memDNSProvider) DeleteRecords(_ context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var deleted []libdns.Record
+	for _, del := range recs {
+		kept := p.records[zone][:0]
+		for _, rec := range p.records[zone] {
+			if rec.Type == del.Type && rec.Name == del.Name && rec.Value == del.Value {
+				deleted = append(deleted, rec)
+				continue
+			}
+			kept = append(kept, rec)
+		}
+		p.records[zone] = kept
+	}
+	return deleted, nil
+}
+
+func TestDecommission(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+
+	dns := new(memDNSProvider)
+	am := NewACMEIssuer(cfg, ACMEIssuer{
+		CA:          "https://acme.example/directory",
+		DNS01Solver: &DNS01Solver{DNSManager: DNSManager{DNSProvider: dns}},
+	})
+	cfg.Issuers = append(cfg.Issuers, am)
+
+	var events []map[string]any
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "cert_decommissioned" {
+			events = append(events, data)
+		}
+		return nil
+	}
+
+	// avoid DNS lookups for the zone
+	fqdnSOACacheMu.Lock()
+	fqdnSOACache["_acme-challenge.example.com."] = &soaCacheEntry{zone: "example.com.", expires: time.Now().Add(time.Hour)}
+	fqdnSOACacheMu.Unlock()
+	t.Cleanup(func() {
+		fqdnSOACacheMu.Lock()
+		delete(fqdnSOACache, "_acme-challenge.example.com.")
+		fqdnSOACacheMu.Unlock()
+	})
+	_, _ = dns.AppendRecords(ctx, "example.com.", []libdns.Record{
+		{Type: "TXT", Name: "_acme-challenge", Value: "leftover"},
+		{Type: "TXT", Name: "@", Value: "unrelated"},
+	})
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds := distributedSolver{storage: cfg.Storage, storageKeyIssuerPrefix: storageKeyACMECAPrefix(am.IssuerKey())}
+	if err := cfg.Storage.Store(ctx, ds.challengeTokensKey("example.com"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	err = cfg.Decommission(ctx, "Example.com", DecommissionOptions{Revoke: true, CleanUpDNS: true})
+	if err != nil {
+		t.Fatalf("decommissioning: %v", err)
+	}
+
+	respDER, err := fi.OCSPResponse(cert.Leaf, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ocsp.ParseResponse(respDER, nil); err != nil || resp.Status != ocsp.Revoked {
+		t.Errorf("expected certificate to be revoked, got %v (err=%v)", resp, err)
+	}
+	if cfg.storageHasCertResourcesAnyIssuer(ctx, "example.com") {
+		t.Error("expected certificate assets to be deleted")
+	}
+	if cfg.Storage.Exists(ctx, ds.challengeTokensKey("example.com")) {
+		t.Error("expected challenge info to be deleted")
+	}
+	if len(cfg.certCache.AllMatchingCertificates("example.com")) != 0 {
+		t.Error("expected certificate to be evicted from cache")
+	}
+	if recs, _ := dns.GetRecords(ctx, "example.com."); len(recs) != 1 || recs[0].Value != "unrelated" {
+		t.Errorf("expected only the challenge record to be deleted, got %v", recs)
+	}
+	if len(events) != 1 || len(events[0]["revoked"].([]string)) != 1 {
+		t.Errorf("expected one cert_decommissioned event with one revocation, got %v", events)
+	}
+
+	// decommissioning again is not an error
+	if err := cfg.Decommission(ctx, "example.com", DecommissionOptions{Revoke: true}); err != nil {
+		t.Errorf("expected no error when there is nothing to decommission, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// PropagationCheck is the result of one check of whether a DNS record
+// has propagated, as reported to DNSManager.OnPropagationCheck. It helps
+// to tune PropagationDelay and PropagationTimeout for slow DNS providers.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type PropagationCheck struct {
+	// The name of the record that was checked,
+	// after following any CNAME.
+	FQDN string
+
+	// The number of the check, starting at 1.
+	Attempt int
+
+	// How long after the record was created the
+	// check started.
+	Elapsed time.Duration
+
+	// How long the check took.
+	Duration time.Duration
+
+	// The results of querying each nameserver.
+	Nameservers []NameserverCheck
+
+	// Whether the record has propagated.
+	Ready bool
+
+	// The error that ended the checks, if any.
+	Err error
+}
+
+// NameserverCheck is the result of querying one nameserver for a record.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type NameserverCheck struct {
+	// The address of the nameserver.
+	Nameserver string
+
+	// How long the nameserver took to answer.
+	RTT time.Duration
+
+	// Whether the answer contained the record.
+	Found bool
+
+	// Why the nameserver could not be queried,
+	// or returned an error, if it did.
+	Err error
+}
+
+// checkNameservers queries each of the nameservers for the record with
+// the expected value, concurrently, and returns the results in the order
+// of nameservers. Queries to authoritative nameservers do not ask for
+// recursion.
+func checkNameservers(fqdn string, recType uint16, expectedValue string, nameservers []string, authoritative bool) []NameserverCheck {
+	checks := make([]NameserverCheck, len(nameservers))
+	var wg sync.WaitGroup
+	for i, ns := range nameservers {
+		wg.Add(1)
+		go func(check *NameserverCheck, ns string) {
+			defer wg.Done()
+			check.Nameserver = ns
+			start := time.Now()
+			r, err := sendDNSQuery(createDNSMsg(fqdn, recType, !authoritative), ns)
+			check.RTT = time.Since(start)
+			if err != nil {
+				check.Err = err
+				return
+			}
+			check.Found, check.Err = answerHasRecord(r, recType, expectedValue)
+		}(&checks[i], ns)
+	}
+	wg.Wait()
+	return checks
+}
+
+// answerHasRecord returns true if r contains the record with the
+// expected value.
+func answerHasRecord(r *dns.Msg, recType uint16, expectedValue string) (bool, error) {
+	if r.Rcode != dns.RcodeSuccess {
+		if r.Rcode == dns.RcodeNameError || r.Rcode == dns.RcodeServerFailure {
+			// if Present() succeeded, then it must show up eventually, or else
+			// something is really broken in the DNS provider or their API;
+			// no need for error here, simply have the caller try again
+			return false, nil
+		}
+		return false, fmt.Errorf("returned %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		switch recType {
+		case dns.TypeTXT:
+			if txt, ok := rr.(*dns.TXT); ok {
+				if strings.Join(txt.Txt, "") == expectedValue {
+					return true, nil
+				}
+			}
+		case dns.TypeCNAME:
+			if cname, ok := rr.(*dns.CNAME); ok {
+				// TODO: whether a DNS provider assumes a trailing dot or not varies, and we may have to standardize this in libdns packages
+				if strings.TrimSuffix(cname.Target, ".") == strings.TrimSuffix(expectedValue, ".") {
+					return true, nil
+				}
+			}
+		default:
+			return false, fmt.Errorf("unsupported record type: %d", recType)
+		}
+	}
+	return false, nil
+}
+
+// nameserverAddresses returns the addresses of all IP addresses of the
+// nameservers with the given names, as found with the resolvers, so that
+// each of them can be checked: providers often serve a name from several
+// servers behind round-robin addresses, which may not all be up to date.
+// Nameservers whose addresses cannot be found are returned by name.
+func nameserverAddresses(names []string, resolvers []string) []string {
+	var addrs []string
+	for _, name := range names {
+		var ips []string
+		for _, rtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			r, err := dnsQuery(dns.Fqdn(name), rtype, resolvers, true)
+			if err != nil || r.Rcode != dns.RcodeSuccess {
+				continue
+			}
+			for _, rr := range r.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A.String())
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA.String())
+				}
+			}
+		}
+		if len(ips) == 0 {
+			ips = []string{strings.TrimSuffix(name, ".")}
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, nameserverPort))
+		}
+	}
+	return addrs
+}
+
+// nameserverPort is the port that authoritative
+// nameservers are queried on; changed in tests.
+var nameserverPort = "53"
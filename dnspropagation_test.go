@@ -0,0 +1,147 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+// newTestNameserver starts a UDP nameserver on addr that answers
+// questions with the records returned by answer.
+func newTestNameserver(t *testing.T, addr string, answer func(q dns.Question) []dns.RR) string {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("unable to listen on %s: %v", addr, err)
+	}
+	srv := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			resp := new(dns.Msg)
+			resp.SetReply(r)
+			resp.Answer = answer(r.Question[0])
+			w.WriteMsg(resp)
+		}),
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestCheckNameservers(t *testing.T) {
+	const fqdn = "_acme-challenge.example.com."
+	txt := testRR(t, fqdn+" 60 IN TXT token")
+	withRecord := newTestNameserver(t, "127.0.0.1:0", func(q dns.Question) []dns.RR {
+		return []dns.RR{txt}
+	})
+	withoutRecord := newTestNameserver(t, "127.0.0.1:0", func(q dns.Question) []dns.RR {
+		return nil
+	})
+
+	checks := checkNameservers(fqdn, dns.TypeTXT, "token", []string{withRecord, withoutRecord}, true)
+	if len(checks) != 2 {
+		t.Fatalf("expected 2 checks, got %d", len(checks))
+	}
+	if checks[0].Nameserver != withRecord || !checks[0].Found || checks[0].Err != nil || checks[0].RTT <= 0 {
+		t.Errorf("expected record to be found at %s, got %+v", withRecord, checks[0])
+	}
+	if checks[1].Nameserver != withoutRecord || checks[1].Found || checks[1].Err != nil {
+		t.Errorf("expected record not to be found at %s, got %+v", withoutRecord, checks[1])
+	}
+	if checks := checkNameservers(fqdn, dns.TypeTXT, "other", []string{withRecord}, true); checks[0].Found {
+		t.Error("expected record with other value not to be found")
+	}
+}
+
+func TestDNSManagerWaitAuthoritative(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only Linux routes all of 127.0.0.0/8 to the loopback interface")
+	}
+	const zone = "propagation.test."
+	const fqdn = "_acme-challenge." + zone
+
+	// two addresses of the same authoritative nameserver, one of
+	// which only serves the record after a few queries
+	var lagging atomic.Int32
+	upToDate := newTestNameserver(t, "127.0.0.1:0", func(q dns.Question) []dns.RR {
+		return []dns.RR{testRR(t, fqdn+" 60 IN TXT token")}
+	})
+	_, port, _ := net.SplitHostPort(upToDate)
+	newTestNameserver(t, net.JoinHostPort("127.0.0.2", port), func(q dns.Question) []dns.RR {
+		if lagging.Add(1) <= 2 {
+			return nil
+		}
+		return []dns.RR{testRR(t, fqdn+" 60 IN TXT token")}
+	})
+	defer func(port string) { nameserverPort = port }(nameserverPort)
+	nameserverPort = port
+
+	resolver := newTestNameserver(t, "127.0.0.1:0", func(q dns.Question) []dns.RR {
+		switch {
+		case q.Qtype == dns.TypeSOA && q.Name == zone:
+			return []dns.RR{testRR(t, zone+" 60 IN SOA ns1."+zone+" admin."+zone+" 1 60 60 60 60")}
+		case q.Qtype == dns.TypeNS && q.Name == zone:
+			return []dns.RR{testRR(t, zone+" 60 IN NS ns1."+zone)}
+		case q.Qtype == dns.TypeA && q.Name == "ns1."+zone:
+			return []dns.RR{testRR(t, q.Name+" 60 IN A 127.0.0.1"), testRR(t, q.Name+" 60 IN A 127.0.0.2")}
+		}
+		return nil
+	})
+
+	var checks []PropagationCheck
+	m := &DNSManager{
+		Resolvers:                     []string{resolver},
+		CheckAuthoritativeNameservers: true,
+		PropagationInterval:           10 * time.Millisecond,
+		PropagationTimeout:            5 * time.Second,
+		OnPropagationCheck: func(check PropagationCheck) {
+			checks = append(checks, check)
+		},
+	}
+	zrec := zoneRecord{zone: zone, record: libdns.Record{Type: "TXT", Name: "_acme-challenge", Value: "token"}}
+	if err := m.wait(context.Background(), zrec); err != nil {
+		t.Fatalf("waiting for propagation: %v", err)
+	}
+
+	if len(checks) != 3 {
+		t.Fatalf("expected propagation after 3 checks, got %d: %+v", len(checks), checks)
+	}
+	for i, check := range checks {
+		if check.Attempt != i+1 || check.FQDN != fqdn || check.Ready != (i == 2) || len(check.Nameservers) != 2 {
+			t.Errorf("unexpected check %d: %+v", i, check)
+		}
+		if i > 0 && check.Elapsed <= checks[i-1].Elapsed {
+			t.Errorf("expected elapsed time of check %d to increase, got %s after %s", i, check.Elapsed, checks[i-1].Elapsed)
+		}
+	}
+	if ns := checks[0].Nameservers[1]; ns.Nameserver != net.JoinHostPort("127.0.0.2", port) || ns.Found {
+		t.Errorf("expected record to be missing from lagging nameserver at first, got %+v", ns)
+	}
+}
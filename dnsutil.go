@@ -215,8 +215,12 @@ func populateNameserverPorts(servers []string) {
 	}
 }
 
-// checkDNSPropagation checks if the expected record has been propagated to all authoritative nameservers.
-func checkDNSPropagation(logger *zap.Logger, fqdn string, recType uint16, expectedValue string, checkAuthoritativeServers bool, resolvers []string) (bool, error) {
+// checkDNSPropagation checks if the expected record has been propagated.
+// If checkAuthoritativeServers is true, the record must be served by all
+// addresses of all authoritative nameservers of its zone, which are found
+// with the resolvers; otherwise, it must be served by any of the resolvers.
+// It returns the result of the check of each nameserver.
+func checkDNSPropagation(logger *zap.Logger, fqdn string, recType uint16, expectedValue string, checkAuthoritativeServers bool, resolvers []string) ([]NameserverCheck, bool, error) {
 	logger = logger.Named("propagation")
 
 	if !strings.HasSuffix(fqdn, ".") {
@@ -229,67 +233,39 @@ func checkDNSPropagation(logger *zap.Logger, fqdn string, recType uint16, expect
 	if recType != dns.TypeCNAME {
 		r, err := dnsQuery(fqdn, recType, resolvers, true)
 		if err != nil {
-			return false, fmt.Errorf("CNAME dns query: %v", err)
+			return nil, false, fmt.Errorf("CNAME dns query: %v", err)
 		}
 		if r.Rcode == dns.RcodeSuccess {
 			fqdn = updateDomainWithCName(r, fqdn)
 		}
 	}
 
-	if checkAuthoritativeServers {
-		authoritativeServers, err := lookupNameservers(logger, fqdn, resolvers)
-		if err != nil {
-			return false, fmt.Errorf("looking up authoritative nameservers: %v", err)
-		}
-		populateNameserverPorts(authoritativeServers)
-		resolvers = authoritativeServers
-	}
-	logger.Debug("checking authoritative nameservers", zap.Strings("resolvers", resolvers))
-
-	return checkAuthoritativeNss(fqdn, recType, expectedValue, resolvers)
-}
-
-// checkAuthoritativeNss queries each of the given nameservers for the expected record.
-func checkAuthoritativeNss(fqdn string, recType uint16, expectedValue string, nameservers []string) (bool, error) {
-	for _, ns := range nameservers {
-		r, err := dnsQuery(fqdn, recType, []string{ns}, true)
-		if err != nil {
-			return false, fmt.Errorf("querying authoritative nameservers: %v", err)
-		}
-
-		if r.Rcode != dns.RcodeSuccess {
-			if r.Rcode == dns.RcodeNameError || r.Rcode == dns.RcodeServerFailure {
-				// if Present() succeeded, then it must show up eventually, or else
-				// something is really broken in the DNS provider or their API;
-				// no need for error here, simply have the caller try again
-				return false, nil
+	if !checkAuthoritativeServers {
+		checks := checkNameservers(fqdn, recType, expectedValue, resolvers, false)
+		for _, check := range checks {
+			if check.Found {
+				return checks, true, nil
 			}
-			return false, fmt.Errorf("NS %s returned %s for %s", ns, dns.RcodeToString[r.Rcode], fqdn)
 		}
+		return checks, false, nil
+	}
 
-		for _, rr := range r.Answer {
-			switch recType {
-			case dns.TypeTXT:
-				if txt, ok := rr.(*dns.TXT); ok {
-					record := strings.Join(txt.Txt, "")
-					if record == expectedValue {
-						return true, nil
-					}
-				}
-			case dns.TypeCNAME:
-				if cname, ok := rr.(*dns.CNAME); ok {
-					// TODO: whether a DNS provider assumes a trailing dot or not varies, and we may have to standardize this in libdns packages
-					if strings.TrimSuffix(cname.Target, ".") == strings.TrimSuffix(expectedValue, ".") {
-						return true, nil
-					}
-				}
-			default:
-				return false, fmt.Errorf("unsupported record type: %d", recType)
-			}
+	authoritativeServers, err := lookupNameservers(logger, fqdn, resolvers)
+	if err != nil {
+		return nil, false, fmt.Errorf("looking up authoritative nameservers: %v", err)
+	}
+	addrs := nameserverAddresses(authoritativeServers, resolvers)
+	logger.Debug("checking authoritative nameservers",
+		zap.Strings("nameservers", authoritativeServers),
+		zap.Strings("addresses", addrs))
+
+	checks := checkNameservers(fqdn, recType, expectedValue, addrs, true)
+	for _, check := range checks {
+		if !check.Found {
+			return checks, false, nil
 		}
 	}
-
-	return false, nil
+	return checks, len(checks) > 0, nil
 }
 
 // lookupNameservers returns the authoritative nameservers for the given fqdn.
@@ -0,0 +1,328 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DuplicateCertPolicy enumerates how to choose which of several
+// certificates for the same names to keep, when there are duplicates
+// in storage or in the cache, such as those left behind by instances
+// that raced to obtain a certificate for several names.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type DuplicateCertPolicy string
+
+// Supported duplicate certificate policies.
+const (
+	// KeepLatestExpiringCert keeps the certificate that
+	// expires last. This is the default.
+	KeepLatestExpiringCert DuplicateCertPolicy = "latest_expiring"
+
+	// KeepNewestCert keeps the certificate that was
+	// issued last.
+	KeepNewestCert DuplicateCertPolicy = "newest"
+
+	// KeepPreferredIssuerCert keeps the certificate of the
+	// issuer that comes first in the Config's Issuers, and
+	// among those, the one that expires last.
+	KeepPreferredIssuerCert DuplicateCertPolicy = "preferred_issuer"
+)
+
+// DuplicateCertificates is a set of certificates in storage
+// with exactly the same names.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type DuplicateCertificates struct {
+	// The names on the certificates, sorted.
+	Names []string
+
+	// The certificate to keep, according to
+	// the Config's DuplicateCertPolicy.
+	Keep CertificateIndexEntry
+
+	// The other certificates.
+	Remove []CertificateIndexEntry
+}
+
+// FindDuplicateCertificates returns the sets of certificates in storage
+// that have exactly the same names, with the certificate to keep chosen
+// by cfg.DuplicateCertPolicy. Certificates of issuers that are not
+// configured are considered, too.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) FindDuplicateCertificates(ctx context.Context) ([]DuplicateCertificates, error) {
+	issuerPrefixes, err := cfg.Storage.List(ctx, prefixCerts, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	byNames := make(map[string][]CertificateIndexEntry)
+	for _, issuerPrefix := range issuerPrefixes {
+		sitePrefixes, err := cfg.Storage.List(ctx, issuerPrefix, false)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %v", issuerPrefix, err)
+		}
+		for _, sitePrefix := range sitePrefixes {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			entry, err := cfg.loadStoredCertEntry(ctx, path.Base(issuerPrefix), sitePrefix)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				cfg.Logger.Error("unable to load certificate", zap.String("site_key", sitePrefix), zap.Error(err))
+				continue
+			}
+			namesKey := strings.Join(entry.Names, ",")
+			byNames[namesKey] = append(byNames[namesKey], entry)
+		}
+	}
+
+	var duplicates []DuplicateCertificates
+	for _, entries := range byNames {
+		if len(entries) < 2 {
+			continue
+		}
+		sort.SliceStable(entries, func(i, j int) bool {
+			return cfg.preferCert(entries[i].IssuerKey, entries[i].NotBefore, entries[i].NotAfter,
+				entries[j].IssuerKey, entries[j].NotBefore, entries[j].NotAfter)
+		})
+		duplicates = append(duplicates, DuplicateCertificates{
+			Names:  entries[0].Names,
+			Keep:   entries[0],
+			Remove: entries[1:],
+		})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		return strings.Join(duplicates[i].Names, ",") < strings.Join(duplicates[j].Names, ",")
+	})
+	return duplicates, nil
+}
+
+// RemoveDuplicateCertificates deletes the certificates that
+// FindDuplicateCertificates would remove from storage and evicts
+// them from the cache, emitting a "cert_duplicate_removed" event for
+// each; certificates that changed in the meantime, e.g. because they
+// were renewed, are kept. It returns the duplicates that were found.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) RemoveDuplicateCertificates(ctx context.Context) ([]DuplicateCertificates, error) {
+	duplicates, err := cfg.FindDuplicateCertificates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, dup := range duplicates {
+		for _, entry := range dup.Remove {
+			if err := cfg.removeDuplicateCert(ctx, dup.Keep, entry); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", entry.CertKey, err))
+			}
+		}
+	}
+	return duplicates, errors.Join(errs...)
+}
+
+// removeDuplicateCert deletes the certificate of entry from
+// storage and the cache, since it duplicates the one of keep.
+func (cfg *Config) removeDuplicateCert(ctx context.Context, keep, entry CertificateIndexEntry) error {
+	sitePrefix := path.Dir(entry.CertKey)
+	siteName := path.Base(sitePrefix)
+
+	// make sure the certificate isn't renewed while we're at it; the
+	// lock is on the name it is managed under, not the name of its
+	// folder, which is sanitized
+	certRes := CertificateResource{SANs: slices.Clone(entry.Names)}
+	lockKey := cfg.lockKey(certIssueLockOp, storedCertName(certRes, siteName))
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			cfg.Logger.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	current, err := cfg.loadStoredCertEntry(ctx, entry.IssuerKey, sitePrefix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if current.SHA256 != entry.SHA256 {
+		cfg.Logger.Info("duplicate certificate changed since it was found; keeping it",
+			zap.String("certificate_path", entry.CertKey))
+		return nil
+	}
+
+	cfg.Logger.Info("removing duplicate certificate",
+		zap.Strings("identifiers", entry.Names),
+		zap.String("certificate_path", entry.CertKey),
+		zap.String("kept_certificate_path", keep.CertKey))
+	if err := cfg.deleteSiteAssets(ctx, entry.IssuerKey, siteName); err != nil {
+		return err
+	}
+
+	certCache := cfg.certCache
+	certCache.mu.Lock()
+	for _, cert := range certCache.cache {
+		if cert.Leaf != nil && certFingerprint(cert.Leaf) == entry.SHA256 {
+			certCache.removeCertificate(cert)
+		}
+	}
+	certCache.mu.Unlock()
+
+	cfg.emit(ctx, "cert_duplicate_removed", map[string]any{
+		"identifiers":           entry.Names,
+		"issuer":                entry.IssuerKey,
+		"certificate_path":      entry.CertKey,
+		"kept_issuer":           keep.IssuerKey,
+		"kept_certificate_path": keep.CertKey,
+	})
+	return nil
+}
+
+// loadStoredCertEntry describes the certificate in the
+// folder sitePrefix of the issuer with issuerKey. The
+// names are normalized and sorted, for comparison.
+func (cfg *Config) loadStoredCertEntry(ctx context.Context, issuerKey, sitePrefix string) (CertificateIndexEntry, error) {
+	certKey := path.Join(sitePrefix, path.Base(sitePrefix)+".crt")
+	certPEM, err := cfg.Storage.Load(ctx, certKey)
+	if err != nil {
+		return CertificateIndexEntry{}, err
+	}
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return CertificateIndexEntry{}, err
+	}
+	leaf := certs[0]
+	return CertificateIndexEntry{
+		Serial:    leaf.SerialNumber.Text(16),
+		SHA256:    certFingerprint(leaf),
+		Names:     sortedNames(certNames(leaf)),
+		IssuerKey: issuerKey,
+		CertKey:   certKey,
+		NotBefore: leaf.NotBefore,
+		NotAfter:  expiresAt(leaf),
+	}, nil
+}
+
+// evictCachedDuplicates evicts the managed certificates in the cache
+// that have exactly the same names as cert, keeping the one preferred
+// by cfg.DuplicateCertPolicy, so that they are not served and renewed
+// in turn. If there were any, the duplicates in storage are removed
+// in the background.
+func (cfg *Config) evictCachedDuplicates(ctx context.Context, cert Certificate) {
+	if !cert.managed || cert.Leaf == nil || len(cert.Names) == 0 {
+		return
+	}
+	names := strings.Join(sortedNames(cert.Names), ",")
+	var dups []Certificate
+	for _, other := range cfg.certCache.getAllMatchingCerts(cert.Names[0]) {
+		if other.managed && other.Leaf != nil && other.hash != cert.hash &&
+			strings.Join(sortedNames(other.Names), ",") == names {
+			dups = append(dups, other)
+		}
+	}
+	if len(dups) == 0 {
+		return
+	}
+
+	keep := cert
+	for _, other := range dups {
+		if cfg.preferCert(other.issuerKey, other.Leaf.NotBefore, expiresAt(other.Leaf),
+			keep.issuerKey, keep.Leaf.NotBefore, expiresAt(keep.Leaf)) {
+			keep = other
+		}
+	}
+	certCache := cfg.certCache
+	certCache.mu.Lock()
+	for _, other := range append(dups, cert) {
+		if other.hash != keep.hash {
+			certCache.removeCertificate(other)
+		}
+	}
+	certCache.mu.Unlock()
+
+	cfg.Logger.Warn("evicted duplicate certificates from cache",
+		zap.Strings("identifiers", keep.Names),
+		zap.Int("evicted", len(dups)),
+		zap.String("kept_issuer", keep.issuerKey),
+		zap.Time("kept_expiration", expiresAt(keep.Leaf)))
+	cfg.emit(ctx, "cert_duplicate_evicted", map[string]any{
+		"identifiers": keep.Names,
+		"evicted":     len(dups),
+		"kept_issuer": keep.issuerKey,
+	})
+
+	jm.Submit(cfg.Logger, "remove_duplicate_certs", func() (err error) {
+		ctx := context.WithoutCancel(ctx)
+		defer cfg.recoverPanic(ctx, "removing duplicate certificates", &err)
+		_, err = cfg.RemoveDuplicateCertificates(ctx)
+		return err
+	})
+}
+
+// preferCert reports whether the certificate described by the first
+// three arguments is preferred over the other one by
+// cfg.DuplicateCertPolicy.
+func (cfg *Config) preferCert(issuerKey string, notBefore, notAfter time.Time, otherIssuerKey string, otherNotBefore, otherNotAfter time.Time) bool {
+	switch cfg.DuplicateCertPolicy {
+	case KeepNewestCert:
+		return notBefore.After(otherNotBefore)
+	case KeepPreferredIssuerCert:
+		rank, otherRank := cfg.issuerRank(issuerKey), cfg.issuerRank(otherIssuerKey)
+		if rank != otherRank {
+			return rank < otherRank
+		}
+	}
+	return notAfter.After(otherNotAfter)
+}
+
+// issuerRank returns the position of the issuer with issuerKey
+// in cfg.Issuers, or the number of issuers if it is not configured.
+func (cfg *Config) issuerRank(issuerKey string) int {
+	for i, issuer := range cfg.Issuers {
+		if issuer.IssuerKey() == issuerKey {
+			return i
+		}
+	}
+	return len(cfg.Issuers)
+}
+
+// sortedNames returns a sorted copy of names, in lower case.
+func sortedNames(names []string) []string {
+	sorted := make([]string, len(names))
+	for i, name := range names {
+		sorted[i] = strings.ToLower(name)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
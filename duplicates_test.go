@@ -0,0 +1,209 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeFakeCertificate issues a certificate for names with fi, and
+// stores it in the folder of the first name, as another instance or
+// an earlier version could have.
+func storeFakeCertificate(t *testing.T, cfg *Config, fi *FakeIssuer, names ...string) CertificateResource {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: names}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := fi.Issue(context.Background(), csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRes := CertificateResource{
+		SANs:           append([]string(nil), names...),
+		CertificatePEM: issued.Certificate,
+		PrivateKeyPEM:  keyPEM,
+		issuerKey:      fi.IssuerKey(),
+		namesKey:       names[0],
+	}
+	if err := cfg.saveCertResource(context.Background(), fi, certRes); err != nil {
+		t.Fatal(err)
+	}
+	return certRes
+}
+
+// recordEvents records the events of cfg with the given name.
+func recordEvents(cfg *Config, name string) func() []map[string]any {
+	var mu sync.Mutex
+	var events []map[string]any
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == name {
+			mu.Lock()
+			events = append(events, data)
+			mu.Unlock()
+		}
+		return nil
+	}
+	return func() []map[string]any {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]any(nil), events...)
+	}
+}
+
+func TestRemoveDuplicateCertificates(t *testing.T) {
+	ctx := context.Background()
+	a := &FakeIssuer{Key: "a", Lifetime: 24 * time.Hour}
+	b := &FakeIssuer{Key: "b", Lifetime: 48 * time.Hour}
+	cfg := newOnDemandTestConfig(t, a)
+	cfg.Issuers = []Issuer{a, b}
+	removed := recordEvents(cfg, "cert_duplicate_removed")
+
+	storeFakeCertificate(t, cfg, a, "x.example.com", "y.example.com")
+	storeFakeCertificate(t, cfg, a, "Y.example.com", "x.example.com")
+	storeFakeCertificate(t, cfg, b, "x.example.com", "y.example.com")
+	storeFakeCertificate(t, cfg, a, "z.example.com")
+	storeFakeCertificate(t, cfg, b, "w.example.com", "x.example.com")
+
+	duplicates, err := cfg.FindDuplicateCertificates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 1 || len(duplicates[0].Remove) != 2 {
+		t.Fatalf("expected one set of 3 duplicates, got %+v", duplicates)
+	}
+	if keep := duplicates[0].Keep; keep.IssuerKey != "b" || keep.CertKey != StorageKeys.SiteCert("b", "x.example.com") {
+		t.Errorf("expected latest expiring certificate to be kept, got %+v", keep)
+	}
+	cfg.DuplicateCertPolicy = KeepPreferredIssuerCert
+	duplicates, err = cfg.FindDuplicateCertificates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keep := duplicates[0].Keep; keep.IssuerKey != "a" {
+		t.Errorf("expected certificate of preferred issuer to be kept, got %+v", keep)
+	}
+
+	cfg.DuplicateCertPolicy = KeepLatestExpiringCert
+	if _, err := cfg.RemoveDuplicateCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		StorageKeys.SiteCert("a", "x.example.com"): false,
+		StorageKeys.SiteCert("a", "y.example.com"): false,
+		StorageKeys.SiteCert("b", "x.example.com"): true,
+		StorageKeys.SiteCert("a", "z.example.com"): true,
+	} {
+		if got := cfg.Storage.Exists(ctx, key); got != want {
+			t.Errorf("expected existence of %s to be %t, got %t", key, want, got)
+		}
+	}
+	if events := removed(); len(events) != 2 || events[0]["kept_issuer"] != "b" {
+		t.Errorf("expected 2 events for removed duplicates, got %v", events)
+	}
+	if duplicates, _ := cfg.FindDuplicateCertificates(ctx); len(duplicates) != 0 {
+		t.Errorf("expected no duplicates left, got %+v", duplicates)
+	}
+}
+
+func TestRemoveDuplicateCertificateLocksManagedName(t *testing.T) {
+	ctx := context.Background()
+	a := &FakeIssuer{Key: "a", Lifetime: 24 * time.Hour}
+	b := &FakeIssuer{Key: "b", Lifetime: 48 * time.Hour}
+	cfg := newOnDemandTestConfig(t, a)
+	cfg.Issuers = []Issuer{a, b}
+	storeFakeCertificate(t, cfg, a, "*.example.com")
+	storeFakeCertificate(t, cfg, b, "*.example.com")
+
+	var locks []string
+	cfg.Storage = &FaultyStorage{
+		Storage: cfg.Storage,
+		Fault: func(op StorageOp, key string) error {
+			if op == StorageOpLock {
+				locks = append(locks, key)
+			}
+			return nil
+		},
+	}
+	if _, err := cfg.RemoveDuplicateCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// renewals lock the name the certificate is managed
+	// under, not the sanitized name of its folder
+	if want := cfg.lockKey(certIssueLockOp, "*.example.com"); len(locks) != 1 || locks[0] != want {
+		t.Errorf("expected lock %s, got %v", want, locks)
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert("a", "*.example.com")) {
+		t.Error("expected duplicate to be removed")
+	}
+}
+
+func TestEvictCachedDuplicates(t *testing.T) {
+	ctx := context.Background()
+	a := &FakeIssuer{Key: "a", Lifetime: 24 * time.Hour}
+	b := &FakeIssuer{Key: "b", Lifetime: 48 * time.Hour}
+	cfg := newOnDemandTestConfig(t, a)
+	cfg.Issuers = []Issuer{a, b}
+	evicted := recordEvents(cfg, "cert_duplicate_evicted")
+
+	storeFakeCertificate(t, cfg, b, "x.example.com", "y.example.com")
+	storeFakeCertificate(t, cfg, a, "y.example.com", "x.example.com")
+	if _, err := cfg.CacheManagedCertificate(ctx, "x.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, "y.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	certs := cfg.certCache.getAllMatchingCerts("x.example.com")
+	if len(certs) != 1 || certs[0].issuerKey != "b" {
+		t.Fatalf("expected only the latest expiring certificate in cache, got %d", len(certs))
+	}
+	if events := evicted(); len(events) != 1 {
+		t.Errorf("expected one eviction event, got %v", events)
+	}
+
+	// the duplicate is removed from storage in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for cfg.Storage.Exists(ctx, StorageKeys.SiteCert("a", "y.example.com")) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected duplicate to be removed from storage")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert("b", "x.example.com")) {
+		t.Error("expected kept certificate to remain in storage")
+	}
+}
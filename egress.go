@@ -0,0 +1,196 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Egress is an outbound network path for the ACME and OCSP requests
+// about certain certificates, such as the proxy or source address
+// through which the traffic of a tenant must leave the network.
+//
+// An egress can also pin the IP version of connections to CAs, which
+// helps on networks with a broken IPv6 (or IPv4) path to a CA, where
+// issuance fails intermittently depending on which address family the
+// dialer happens to connect with. To pin the IP version of all ACME,
+// OCSP, and AIA (issuer certificate) requests, set it as the default
+// route, e.g. EgressRoutes{Default: &Egress{Network: "tcp4"}}.
+//
+// An Egress must not be copied or modified after its first use.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type Egress struct {
+	// A name for the egress, used in logs.
+	Name string
+
+	// The proxy to use, like http.Transport.Proxy. Unlike the
+	// usual default, if nil, no proxy is used; set it to
+	// http.ProxyFromEnvironment to use the proxy configured
+	// by environment variables.
+	Proxy func(*http.Request) (*url.URL, error)
+
+	// The local (source) IP address of outgoing
+	// connections, including connections to the proxy.
+	// If nil, it is chosen by the operating system.
+	LocalAddr net.IP
+
+	// The network of outgoing connections: "tcp4" to
+	// connect only over IPv4, "tcp6" to connect only over
+	// IPv6, or "tcp" (the default) to connect over either.
+	Network string
+
+	// When connecting over either IP version, how long to
+	// wait for a connection over the preferred version before
+	// also trying the other ("Happy Eyeballs", RFC 6555),
+	// like net.Dialer.FallbackDelay. If negative, the other
+	// version is only tried after the preferred one fails.
+	// Default: 300ms.
+	FallbackDelay time.Duration
+
+	mu      sync.Mutex
+	clients map[*http.Transport]*http.Client
+}
+
+// client returns an HTTP client that makes requests like base, but
+// through the egress. Clients are cached by base, so that connections
+// to the same servers are reused.
+func (e *Egress) client(base *http.Transport, dialer net.Dialer, timeout time.Duration) *http.Client {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if client, ok := e.clients[base]; ok {
+		return client
+	}
+	if e.LocalAddr != nil {
+		dialer.LocalAddr = &net.TCPAddr{IP: e.LocalAddr}
+	}
+	dialer.FallbackDelay = e.FallbackDelay
+	transport := base.Clone()
+	transport.Proxy = e.Proxy
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch e.Network {
+		case "":
+		case "tcp", "tcp4", "tcp6":
+			network = e.Network
+		default:
+			return nil, fmt.Errorf("egress %s: unsupported network %q", e.Name, e.Network)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+	client := &http.Client{Transport: transport, Timeout: timeout}
+	if e.clients == nil {
+		e.clients = make(map[*http.Transport]*http.Client)
+	}
+	e.clients[base] = client
+	return client
+}
+
+// EgressRoutes selects the Egress for the ACME and OCSP requests about
+// a certificate by its names and tags. This allows multi-tenant
+// deployments to send the traffic for each tenant's certificates
+// through the tenant's own network path.
+//
+// Routes apply to the requests of ACMEIssuers (including ARI) and to
+// OCSP requests. Requests for which no route matches are made as usual.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type EgressRoutes struct {
+	// The egress by certificate name. Names may be wildcards
+	// such as "*.example.com", which match a single label;
+	// exact names take precedence. The names of a certificate
+	// are tried in order, and the first match is used.
+	Names map[string]*Egress
+
+	// The egress by certificate tag, for certificates
+	// without a name route. Since tags are attached when
+	// certificates are cached, they do not apply when
+	// certificates are obtained or renewed, only to the
+	// OCSP and ARI requests of cached certificates.
+	Tags map[string]*Egress
+
+	// The egress for certificates without a route.
+	// If nil, their requests are made as usual.
+	Default *Egress
+}
+
+// Route returns the egress for a certificate with the
+// given names and tags, or nil if there is none.
+func (er *EgressRoutes) Route(names, tags []string) *Egress {
+	if er == nil {
+		return nil
+	}
+	for _, name := range names {
+		name = normalizedName(strings.TrimSuffix(name, "."))
+		if egress, ok := er.Names[name]; ok {
+			return egress
+		}
+		if i := strings.Index(name, "."); i > 0 {
+			if egress, ok := er.Names["*"+name[i:]]; ok {
+				return egress
+			}
+		}
+	}
+	for _, tag := range tags {
+		if egress, ok := er.Tags[tag]; ok {
+			return egress
+		}
+	}
+	return er.Default
+}
+
+// egressContext returns ctx with the egress for the requests
+// about a certificate with the given names and tags, if any.
+func (cfg *Config) egressContext(ctx context.Context, names, tags []string) context.Context {
+	egress := cfg.Egress.Route(names, tags)
+	if egress == nil {
+		return ctx
+	}
+	cfg.Logger.Debug("routing requests through egress",
+		zap.Strings("identifiers", names),
+		zap.String("egress", egress.Name))
+	return context.WithValue(ctx, egressCtxKey{}, egress)
+}
+
+// egressFromContext returns the egress set by
+// Config.egressContext, or nil if there is none.
+func egressFromContext(ctx context.Context) *Egress {
+	egress, _ := ctx.Value(egressCtxKey{}).(*Egress)
+	return egress
+}
+
+type egressCtxKey struct{}
+
+// httpClientFor returns the HTTP client for the requests
+// made with ctx, which goes through the egress of ctx, if any.
+func (iss *ACMEIssuer) httpClientFor(ctx context.Context) *http.Client {
+	egress := egressFromContext(ctx)
+	if egress == nil || iss.httpClient == nil || iss.dialer == nil {
+		return iss.httpClient
+	}
+	transport, ok := iss.httpClient.Transport.(*http.Transport)
+	if !ok {
+		return iss.httpClient
+	}
+	return egress.client(transport, *iss.dialer, iss.httpClient.Timeout)
+}
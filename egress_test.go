@@ -0,0 +1,225 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTestProxy starts an HTTP forward proxy, and returns
+// its URL and the number of requests it forwarded.
+func newTestProxy(t *testing.T) (*url.URL, *atomic.Int32) {
+	var forwarded atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded.Add(1)
+		r.RequestURI = ""
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	t.Cleanup(proxy.Close)
+	proxyURL, _ := url.Parse(proxy.URL)
+	return proxyURL, &forwarded
+}
+
+func TestEgressRoutesRoute(t *testing.T) {
+	tenantA, tenantB, fallback := &Egress{Name: "a"}, &Egress{Name: "b"}, &Egress{Name: "default"}
+	routes := &EgressRoutes{
+		Names: map[string]*Egress{
+			"a.example.com":   tenantA,
+			"*.a.example.com": tenantA,
+			"b.example.com":   tenantB,
+		},
+		Tags: map[string]*Egress{"tenant-b": tenantB},
+	}
+	for i, tc := range []struct {
+		names, tags []string
+		expect      *Egress
+	}{
+		{names: []string{"A.example.com"}, expect: tenantA},
+		{names: []string{"www.a.example.com"}, expect: tenantA},
+		{names: []string{"x.www.a.example.com"}, expect: nil},
+		{names: []string{"other.example.com", "b.example.com"}, expect: tenantB},
+		{names: []string{"other.example.com"}, tags: []string{"unknown", "tenant-b"}, expect: tenantB},
+		{names: []string{"b.example.com"}, tags: []string{"tenant-a"}, expect: tenantB},
+		{names: []string{"other.example.com"}, expect: nil},
+	} {
+		if got := routes.Route(tc.names, tc.tags); got != tc.expect {
+			t.Errorf("test %d: expected egress %v for %v, got %v", i, tc.expect, tc.names, got)
+		}
+	}
+	routes.Default = fallback
+	if got := routes.Route([]string{"other.example.com"}, nil); got != fallback {
+		t.Errorf("expected default egress, got %v", got)
+	}
+	if got := (*EgressRoutes)(nil).Route([]string{"a.example.com"}, nil); got != nil {
+		t.Errorf("expected no egress without routes, got %v", got)
+	}
+}
+
+func TestEgressOCSP(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	var sources []string
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		sources = append(sources, host)
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("parsing OCSP request: %v", err)
+			return
+		}
+		for _, leaf := range fi.Issued() {
+			if leaf.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				resp, _ := fi.OCSPResponse(leaf, 24*time.Hour)
+				w.Write(resp)
+				return
+			}
+		}
+		w.Write(ocsp.UnauthorizedErrorResponse)
+	}))
+	defer responder.Close()
+	fi.OCSPServer = responder.URL
+
+	proxyURL, forwarded := newTestProxy(t)
+	tenant := &Egress{Name: "tenant", Proxy: http.ProxyURL(proxyURL)}
+	source := &Egress{Name: "source", LocalAddr: net.ParseIP("127.0.0.2")}
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.Egress = &EgressRoutes{
+		Names: map[string]*Egress{"tenant.example.com": tenant},
+		Tags:  map[string]*Egress{"source": source},
+	}
+
+	for _, name := range []string{"tenant.example.com", "other.example.com"} {
+		cert, bundle := issueFakeCertificate(t, fi, name)
+		if err := cfg.stapleOCSP(ctx, &cert, bundle); err != nil {
+			t.Fatal(err)
+		}
+		if cert.ocsp == nil || cert.ocsp.Status != ocsp.Good {
+			t.Errorf("%s: expected good OCSP staple, got %v", name, cert.ocsp)
+		}
+	}
+	if n := forwarded.Load(); n != 1 {
+		t.Errorf("expected only the tenant's OCSP request to be proxied, got %d requests", n)
+	}
+
+	if runtime.GOOS != "linux" {
+		// only Linux routes all of 127.0.0.0/8 to the loopback interface
+		return
+	}
+	sources = nil
+	cert, bundle := issueFakeCertificate(t, fi, "tagged.example.com")
+	cert.Tags = []string{"source"}
+	if err := cfg.stapleOCSP(ctx, &cert, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 1 || sources[0] != "127.0.0.2" {
+		t.Errorf("expected OCSP request from 127.0.0.2, got %v", sources)
+	}
+}
+
+func TestEgressACME(t *testing.T) {
+	ctx := context.Background()
+	var renewalInfoRequests int
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/directory" {
+			fmt.Fprintf(w, `{"newNonce":"%[1]s/nonce","newAccount":"%[1]s/account","newOrder":"%[1]s/order","renewalInfo":"%[1]s/renewal-info"}`, "http://"+r.Host)
+			return
+		}
+		renewalInfoRequests++
+		w.Header().Set("Retry-After", "21600")
+		start := time.Now().Add(24 * time.Hour).UTC().Format(time.RFC3339)
+		end := time.Now().Add(48 * time.Hour).UTC().Format(time.RFC3339)
+		fmt.Fprintf(w, `{"suggestedWindow":{"start":%q,"end":%q}}`, start, end)
+	}))
+	defer ca.Close()
+
+	proxyURL, forwarded := newTestProxy(t)
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.Egress = &EgressRoutes{Names: map[string]*Egress{
+		"tenant.example.com": {Name: "tenant", Proxy: http.ProxyURL(proxyURL)},
+	}}
+	am := NewACMEIssuer(cfg, ACMEIssuer{CA: ca.URL + "/directory", Logger: cfg.Logger})
+
+	fi := new(FakeIssuer)
+	other, _ := issueFakeCertificate(t, fi, "other.example.com")
+	if _, err := am.GetRenewalInfo(ctx, other); err != nil {
+		t.Fatalf("getting renewal info: %v", err)
+	}
+	if n := forwarded.Load(); n != 0 {
+		t.Errorf("expected requests for other certificates not to be proxied, got %d", n)
+	}
+	tenant, _ := issueFakeCertificate(t, fi, "tenant.example.com")
+	if _, err := am.GetRenewalInfo(ctx, tenant); err != nil {
+		t.Fatalf("getting renewal info: %v", err)
+	}
+	if n := forwarded.Load(); n == 0 {
+		t.Error("expected requests for the tenant's certificate to be proxied")
+	}
+	if renewalInfoRequests != 2 {
+		t.Errorf("expected 2 renewal info requests, got %d", renewalInfoRequests)
+	}
+}
+
+func TestEgressNetwork(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	base := http.DefaultTransport.(*http.Transport)
+
+	for i, tc := range []struct {
+		network   string
+		expectErr bool
+	}{
+		{network: "", expectErr: false},
+		{network: "tcp4", expectErr: false},
+		{network: "tcp6", expectErr: true}, // the server only listens on IPv4
+		{network: "udp", expectErr: true},
+	} {
+		egress := &Egress{Name: "test", Network: tc.network, FallbackDelay: -1}
+		client := egress.client(base, net.Dialer{Timeout: 5 * time.Second}, 5*time.Second)
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if tc.expectErr && err == nil {
+			t.Errorf("test %d: expected connection over %q to fail", i, tc.network)
+		}
+		if !tc.expectErr && err != nil {
+			t.Errorf("test %d: expected connection over %q to succeed, got: %v", i, tc.network, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Event is an event in certificate management that is delivered to
+// subscribers; see Config.Subscribe. Its Type and Data are the same
+// as those given to Config.OnEvent, such as "cert_obtaining",
+// "cert_obtained", "cert_renewed", "cert_failed", "ocsp_stapled", or
+// "warning", except for events of the cache that are only delivered
+// to subscribers, such as "cached_managed_cert_evicted".
+//
+// EXPERIMENTAL: Subject to change or removal.
+type Event struct {
+	// The type of event, e.g. "cert_obtained".
+	Type string
+
+	// When the event was emitted.
+	Time time.Time
+
+	// The event's data; it is shared by all subscribers,
+	// so it must not be modified.
+	Data map[string]any
+}
+
+// EventBufferSize is how many events can be pending for a subscriber
+// before further events to it are dropped.
+const EventBufferSize = 256
+
+// Subscribe returns a channel that receives the events of eventTypes,
+// or all events if none are given, that are emitted by cfg, by all other
+// configs associated with the same cache, and by the cache itself, until
+// ctx is canceled, at which point the channel is closed. Unlike OnEvent,
+// subscribers are notified asynchronously, so they cannot abort events,
+// and any number of them can fan events out to logging, metrics, or
+// webhooks independently. A subscriber that falls behind by more than
+// EventBufferSize events misses events, which is logged; it should
+// receive from the channel promptly.
+//
+// Events that were aborted by OnEvent are not delivered to subscribers.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) Subscribe(ctx context.Context, eventTypes ...string) <-chan Event {
+	return cfg.certCache.events.subscribe(ctx, cfg.certCache.logger, eventTypes)
+}
+
+// eventBus delivers events to subscribers.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[*subscription]struct{}
+
+	// number of subscriptions, to check cheaply
+	// whether there are any subscribers
+	count atomic.Int32
+}
+
+type subscription struct {
+	types    map[string]struct{} // nil for all types
+	ch       chan Event
+	logger   *zap.Logger
+	dropping bool // whether the last event was dropped
+}
+
+func (bus *eventBus) subscribe(ctx context.Context, logger *zap.Logger, eventTypes []string) <-chan Event {
+	sub := &subscription{
+		ch:     make(chan Event, EventBufferSize),
+		logger: logger,
+	}
+	if len(eventTypes) > 0 {
+		sub.types = make(map[string]struct{}, len(eventTypes))
+		for _, typ := range eventTypes {
+			sub.types[typ] = struct{}{}
+		}
+	}
+
+	bus.mu.Lock()
+	if bus.subs == nil {
+		bus.subs = make(map[*subscription]struct{})
+	}
+	bus.subs[sub] = struct{}{}
+	bus.count.Add(1)
+	bus.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		bus.mu.Lock()
+		delete(bus.subs, sub)
+		bus.count.Add(-1)
+		close(sub.ch)
+		bus.mu.Unlock()
+	}()
+
+	return sub.ch
+}
+
+// subscribed returns true if there are any subscribers.
+func (bus *eventBus) subscribed() bool {
+	return bus.count.Load() > 0
+}
+
+// publish delivers an event to the subscribers of its type without
+// blocking. It is safe to call while holding the cache's lock.
+func (bus *eventBus) publish(eventType string, data map[string]any) {
+	if !bus.subscribed() {
+		return
+	}
+	event := Event{Type: eventType, Time: time.Now(), Data: maps.Clone(data)}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for sub := range bus.subs {
+		if sub.types != nil {
+			if _, ok := sub.types[eventType]; !ok {
+				continue
+			}
+		}
+		select {
+		case sub.ch <- event:
+			sub.dropping = false
+		default:
+			if !sub.dropping {
+				sub.logger.Warn("event subscriber is falling behind; dropping events",
+					zap.String("event", eventType))
+			}
+			sub.dropping = true
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// nextEvent returns the next event from events, failing the test
+// if there is none within a second.
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("event channel was closed")
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	all := cfg.Subscribe(subCtx)
+	lifecycle := cfg.Subscribe(subCtx, "cert_obtained", "cert_renewed")
+
+	const name = "example.com"
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expect := range []struct {
+		typ     string
+		renewal bool
+	}{
+		{"cert_obtained", false},
+		{"cert_obtained", true},
+		{"cert_renewed", true},
+	} {
+		event := nextEvent(t, lifecycle)
+		if event.Type != expect.typ || event.Data["renewal"] != expect.renewal || event.Data["identifier"] != name {
+			t.Errorf("event %d: expected %s (renewal=%t) for %s, got %s %v", i, expect.typ, expect.renewal, name, event.Type, event.Data)
+		}
+		if event.Time.IsZero() {
+			t.Errorf("event %d: expected time to be set", i)
+		}
+	}
+	if event := nextEvent(t, all); event.Type != "cert_obtaining" {
+		t.Errorf("expected cert_obtaining first for unfiltered subscriber, got %s", event.Type)
+	}
+
+	cancel()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-lifecycle:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("expected channel to be closed after context was canceled")
+		}
+	}
+}
+
+func TestSubscribeAbortedEvent(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnEvent = func(ctx context.Context, event string, data map[string]any) error {
+		if event == "cert_obtaining" {
+			return fmt.Errorf("not now")
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := cfg.Subscribe(ctx)
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err == nil {
+		t.Fatal("expected obtain to be aborted")
+	}
+	for {
+		select {
+		case event := <-events:
+			if event.Type == "cert_obtaining" {
+				t.Fatal("aborted event was delivered to subscriber")
+			}
+		default:
+			return
+		}
+	}
+}
+
+func TestSubscribeEviction(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.certCache.SetOptions(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Capacity:         1,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := cfg.Subscribe(ctx, "cached_managed_cert_evicted")
+
+	first := Certificate{Names: []string{"a.example.com"}, hash: "a", managed: true}
+	cfg.certCache.cacheCertificate(first)
+	cfg.certCache.cacheCertificate(Certificate{Names: []string{"b.example.com"}, hash: "b", managed: true})
+
+	event := nextEvent(t, events)
+	if sans, _ := event.Data["sans"].([]string); len(sans) != 1 || sans[0] != "a.example.com" || event.Data["reason"] != "capacity" {
+		t.Errorf("unexpected eviction event: %v", event.Data)
+	}
+}
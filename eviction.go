@@ -0,0 +1,344 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"container/heap"
+	"container/list"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	weakrand "math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// EvictionPolicy determines which certificate is evicted from a full
+// cache to make room for a new one; see CacheOptions.EvictionPolicy.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type EvictionPolicy string
+
+// Eviction policies.
+const (
+	// Evict a random certificate. This is the default.
+	EvictRandom EvictionPolicy = "random"
+
+	// Evict the certificate that was least recently served
+	// in a TLS handshake; certificates that have not been
+	// served yet count as served when they were cached.
+	EvictLeastRecentlyUsed EvictionPolicy = "lru"
+
+	// Evict the certificate that expires soonest.
+	EvictSoonestExpiring EvictionPolicy = "soonest_expiring"
+)
+
+// CacheStats describes the occupancy of a cache and how well it
+// serves TLS handshakes.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CacheStats struct {
+	// The number of certificates in the cache,
+	// and how many of them are managed.
+	Certificates int
+	Managed      int
+
+	// The approximate memory used by the certificates
+	// in the cache; see CacheOptions.MaxBytes.
+	Bytes int64
+
+	// The limits of the cache; 0 means unlimited.
+	Capacity int
+	MaxBytes int64
+
+	// The eviction policy of the cache.
+	EvictionPolicy EvictionPolicy
+
+	// How many TLS handshakes were served a certificate
+	// from the cache, and how many did not find one in it.
+	Hits, Misses uint64
+
+	// How many certificates were evicted to make room
+	// or to relieve memory pressure.
+	Evictions uint64
+}
+
+// Stats returns the current occupancy and statistics of the cache.
+// The counters start at zero when the cache is created.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (certCache *Cache) Stats() CacheStats {
+	certCache.optionsMu.RLock()
+	stats := CacheStats{
+		Capacity:       certCache.options.Capacity,
+		MaxBytes:       certCache.options.MaxBytes,
+		EvictionPolicy: certCache.options.EvictionPolicy,
+	}
+	certCache.optionsMu.RUnlock()
+	if stats.EvictionPolicy == "" {
+		stats.EvictionPolicy = EvictRandom
+	}
+
+	certCache.mu.RLock()
+	stats.Certificates = len(certCache.cache)
+	stats.Managed = certCache.managedCount
+	stats.Bytes = certCache.bytes
+	certCache.mu.RUnlock()
+
+	stats.Hits = certCache.hits.Load()
+	stats.Misses = certCache.misses.Load()
+	stats.Evictions = certCache.evictions.Load()
+	return stats
+}
+
+// makeRoom evicts certificates until cert fits in the cache without
+// exceeding its capacity or memory budget.
+//
+// This function is NOT safe for concurrent use; callers
+// MUST first acquire a write lock on certCache.mu.
+func (certCache *Cache) makeRoom(cert Certificate) {
+	certCache.optionsMu.RLock()
+	capacity, maxBytes := certCache.options.Capacity, certCache.options.MaxBytes
+	policy := certCache.options.EvictionPolicy
+	certCache.optionsMu.RUnlock()
+
+	size := certMemorySize(cert)
+	for len(certCache.cache) > 0 {
+		var reason string
+		switch {
+		case capacity > 0 && len(certCache.cache) >= capacity:
+			reason = "capacity"
+		case maxBytes > 0 && certCache.bytes+size > maxBytes:
+			reason = "max_bytes"
+		default:
+			return
+		}
+
+		victim := certCache.evictionCandidate(policy)
+		certCache.logger.Debug("cache full; evicting certificate",
+			zap.String("policy", string(policy)),
+			zap.String("reason", reason),
+			zap.Strings("removing_subjects", victim.Names),
+			zap.String("removing_hash", victim.hash),
+			zap.Strings("inserting_subjects", cert.Names),
+			zap.String("inserting_hash", cert.hash))
+		certCache.removeCertificate(victim)
+		certCache.evictions.Add(1)
+		if victim.managed {
+			certCache.events.publish("cached_managed_cert_evicted", map[string]any{
+				"sans":   victim.Names,
+				"reason": reason,
+			})
+		}
+	}
+}
+
+// evictionCandidate returns the certificate in the cache to evict
+// according to policy. The cache must not be empty.
+//
+// This function is NOT safe for concurrent use; callers
+// MUST first acquire a read lock on certCache.mu.
+func (certCache *Cache) evictionCandidate(policy EvictionPolicy) Certificate {
+	var hash string
+	var found bool
+	switch policy {
+	case EvictLeastRecentlyUsed:
+		hash, found = certCache.evictionOrder.leastRecentlyUsed()
+	case EvictSoonestExpiring:
+		hash, found = certCache.evictionOrder.soonestExpiring()
+	}
+	if found {
+		if cert, ok := certCache.cache[hash]; ok {
+			return cert
+		}
+	}
+
+	// Go maps are "nondeterministic" but not actually random,
+	// so although we could just chop off the "front" of the
+	// map with less code, that is a heavily skewed eviction
+	// strategy; generating random numbers is cheap and
+	// ensures a much better distribution.
+	rnd := weakrand.Intn(len(certCache.cache))
+	i := 0
+	for _, cert := range certCache.cache {
+		if i == rnd {
+			return cert
+		}
+		i++
+	}
+	return Certificate{}
+}
+
+// evictionOrder keeps the certificates in a cache in the orders of the
+// eviction policies, so that a candidate for eviction can be found
+// without scanning the whole cache: a list ordered by when they were
+// last used, and a heap ordered by when they expire. Its methods are
+// safe for concurrent use, since handshakes touch certificates while
+// holding only a read lock on the cache.
+type evictionOrder struct {
+	mu       sync.Mutex
+	lru      list.List                // cert hashes, least recently used first
+	used     map[string]*list.Element // cert hash -> element in lru
+	expiring expiringCerts
+	expiry   map[string]*expiringCert // cert hash -> element in expiring
+}
+
+// add adds cert to the orders, if it is not in them already.
+func (eo *evictionOrder) add(cert Certificate) {
+	eo.mu.Lock()
+	defer eo.mu.Unlock()
+	if eo.used == nil {
+		eo.used = make(map[string]*list.Element)
+		eo.expiry = make(map[string]*expiringCert)
+	}
+	if _, ok := eo.used[cert.hash]; ok {
+		return
+	}
+
+	// new certificates were just used, so they usually go to the back;
+	// only a certificate that brings its usage along may go elsewhere
+	lastUsed := cert.usage.lastUsed()
+	mark := eo.lru.Back()
+	for mark != nil && eo.lruLastUsed(mark) > lastUsed {
+		mark = mark.Prev()
+	}
+	if mark == nil {
+		eo.used[cert.hash] = eo.lru.PushFront(lruEntry{cert.hash, cert.usage})
+	} else {
+		eo.used[cert.hash] = eo.lru.InsertAfter(lruEntry{cert.hash, cert.usage}, mark)
+	}
+
+	ec := &expiringCert{hash: cert.hash, notAfter: expiresAt(cert.Leaf)}
+	heap.Push(&eo.expiring, ec)
+	eo.expiry[cert.hash] = ec
+}
+
+// remove removes the certificate with the given hash from the orders.
+func (eo *evictionOrder) remove(hash string) {
+	eo.mu.Lock()
+	defer eo.mu.Unlock()
+	if el, ok := eo.used[hash]; ok {
+		eo.lru.Remove(el)
+		delete(eo.used, hash)
+	}
+	if ec, ok := eo.expiry[hash]; ok {
+		heap.Remove(&eo.expiring, ec.index)
+		delete(eo.expiry, hash)
+	}
+}
+
+// touch marks the certificate with the given hash as most recently used.
+func (eo *evictionOrder) touch(hash string) {
+	eo.mu.Lock()
+	defer eo.mu.Unlock()
+	if el, ok := eo.used[hash]; ok {
+		eo.lru.MoveToBack(el)
+	}
+}
+
+// leastRecentlyUsed returns the hash of the certificate
+// that was used least recently, if there is one.
+func (eo *evictionOrder) leastRecentlyUsed() (string, bool) {
+	eo.mu.Lock()
+	defer eo.mu.Unlock()
+	if el := eo.lru.Front(); el != nil {
+		return el.Value.(lruEntry).hash, true
+	}
+	return "", false
+}
+
+// soonestExpiring returns the hash of the certificate
+// that expires soonest, if there is one.
+func (eo *evictionOrder) soonestExpiring() (string, bool) {
+	eo.mu.Lock()
+	defer eo.mu.Unlock()
+	if len(eo.expiring) > 0 {
+		return eo.expiring[0].hash, true
+	}
+	return "", false
+}
+
+func (eo *evictionOrder) lruLastUsed(el *list.Element) int64 {
+	return el.Value.(lruEntry).usage.lastUsed()
+}
+
+type lruEntry struct {
+	hash  string
+	usage *certUsage
+}
+
+type expiringCert struct {
+	hash     string
+	notAfter time.Time
+	index    int // in expiringCerts
+}
+
+// expiringCerts implements heap.Interface, ordered by expiration.
+type expiringCerts []*expiringCert
+
+func (ec expiringCerts) Len() int           { return len(ec) }
+func (ec expiringCerts) Less(i, j int) bool { return ec[i].notAfter.Before(ec[j].notAfter) }
+func (ec expiringCerts) Swap(i, j int) {
+	ec[i], ec[j] = ec[j], ec[i]
+	ec[i].index, ec[j].index = i, j
+}
+
+func (ec *expiringCerts) Push(x any) {
+	cert := x.(*expiringCert)
+	cert.index = len(*ec)
+	*ec = append(*ec, cert)
+}
+
+func (ec *expiringCerts) Pop() any {
+	old := *ec
+	n := len(old)
+	cert := old[n-1]
+	old[n-1] = nil
+	*ec = old[:n-1]
+	return cert
+}
+
+// certMemorySize returns approximately how much memory cert uses in the
+// cache: its chain in DER and parsed form, its private key, and its names.
+// It depends only on what does not change while cert is cached, so it is
+// the same when cert is added and removed; OCSP staples are not counted.
+func certMemorySize(cert Certificate) int64 {
+	const overhead = 512 // the Certificate value, index entries, usage, etc.
+	size := int64(overhead)
+	for _, der := range cert.Certificate.Certificate {
+		size += int64(len(der))
+	}
+	if len(cert.Certificate.Certificate) > 0 {
+		// the parsed leaf holds about as much as its encoding
+		size += int64(len(cert.Certificate.Certificate[0]))
+	}
+	for _, name := range cert.Names {
+		size += int64(len(name)) * 2 // in the certificate and in the index
+	}
+	switch key := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		// modulus, exponent, primes, and CRT values
+		size += int64(key.N.BitLen()/8) * 5
+	case *ecdsa.PrivateKey:
+		size += int64((key.Curve.Params().BitSize+7)/8) * 3
+	case ed25519.PrivateKey:
+		size += int64(len(key))
+	default:
+		size += mldsaKeySize(key)
+	}
+	return size
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func newEvictionTestCache(opts CacheOptions) *Cache {
+	return &Cache{
+		options:    opts,
+		cache:      make(map[string]Certificate),
+		cacheIndex: make(map[string][]string),
+		logger:     defaultTestLogger,
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	now := time.Now()
+	served := func(ago time.Duration) *certUsage {
+		u := new(certUsage)
+		u.lastServed.Store(now.Add(-ago).UnixNano())
+		return u
+	}
+	cached := func(ago time.Duration) *certUsage {
+		u := new(certUsage)
+		u.cached.Store(now.Add(-ago).UnixNano())
+		return u
+	}
+	certs := []Certificate{
+		{Names: []string{"a.example.com"}, hash: "a", usage: served(time.Minute), Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(48 * time.Hour)}}},
+		{Names: []string{"b.example.com"}, hash: "b", usage: cached(time.Hour), Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(72 * time.Hour)}}},
+		{Names: []string{"c.example.com"}, hash: "c", usage: served(time.Second), Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(24 * time.Hour)}}},
+	}
+
+	for _, tc := range []struct {
+		policy  EvictionPolicy
+		evicted string
+	}{
+		{policy: EvictLeastRecentlyUsed, evicted: "b"},
+		{policy: EvictSoonestExpiring, evicted: "c"},
+	} {
+		c := newEvictionTestCache(CacheOptions{Capacity: len(certs), EvictionPolicy: tc.policy})
+		for _, cert := range certs {
+			c.cacheCertificate(cert)
+		}
+		c.cacheCertificate(Certificate{Names: []string{"d.example.com"}, hash: "d"})
+
+		if _, ok := c.cache[tc.evicted]; ok || len(c.cache) != len(certs) {
+			t.Errorf("policy %s: expected %s to be evicted, got %d certificates: %v", tc.policy, tc.evicted, len(c.cache), c.cache)
+		}
+		if _, ok := c.cache["d"]; !ok {
+			t.Errorf("policy %s: expected new certificate to be cached", tc.policy)
+		}
+		if evictions := c.Stats().Evictions; evictions != 1 {
+			t.Errorf("policy %s: expected 1 eviction, got %d", tc.policy, evictions)
+		}
+	}
+}
+
+func TestEvictLeastRecentlyServed(t *testing.T) {
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.certCache.optionsMu.Lock()
+	cfg.certCache.options.Capacity = 2
+	cfg.certCache.options.EvictionPolicy = EvictLeastRecentlyUsed
+	cfg.certCache.optionsMu.Unlock()
+
+	a, _ := issueFakeCertificate(t, fi, "a.example.com")
+	b, _ := issueFakeCertificate(t, fi, "b.example.com")
+	cfg.certCache.cacheCertificate(a)
+	cfg.certCache.cacheCertificate(b)
+
+	// serving a makes b the least recently used
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	c, _ := issueFakeCertificate(t, fi, "c.example.com")
+	cfg.certCache.cacheCertificate(c)
+	if _, ok := cfg.certCache.cache[b.hash]; ok {
+		t.Error("expected least recently served certificate to be evicted")
+	}
+	if _, ok := cfg.certCache.cache[a.hash]; !ok {
+		t.Error("expected recently served certificate to stay cached")
+	}
+}
+
+func TestEvictionOrder(t *testing.T) {
+	now := time.Now()
+	var eo evictionOrder
+	for i, hash := range []string{"a", "b", "c", "d", "e"} {
+		eo.add(Certificate{hash: hash, Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: now.Add(time.Duration(5-i) * time.Hour)}}})
+	}
+	eo.remove("e")
+	eo.remove("b")
+	eo.remove("a")
+	if hash, _ := eo.soonestExpiring(); hash != "d" {
+		t.Errorf("expected d to expire soonest, got %s", hash)
+	}
+	eo.remove("d")
+	if hash, _ := eo.soonestExpiring(); hash != "c" {
+		t.Errorf("expected c to expire soonest, got %s", hash)
+	}
+	if hash, _ := eo.leastRecentlyUsed(); hash != "c" {
+		t.Errorf("expected c to be least recently used, got %s", hash)
+	}
+	eo.remove("c")
+	if _, ok := eo.soonestExpiring(); ok {
+		t.Error("expected no certificates to be left")
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	fi := new(FakeIssuer)
+	cert, _ := issueFakeCertificate(t, fi, "a.example.com")
+	size := certMemorySize(cert)
+	if size < 1000 || size > 10000 {
+		t.Errorf("unexpected memory size of certificate: %d", size)
+	}
+
+	c := newEvictionTestCache(CacheOptions{MaxBytes: 2*size + size/2, EvictionPolicy: EvictLeastRecentlyUsed})
+	c.cacheCertificate(cert)
+	second, _ := issueFakeCertificate(t, fi, "b.example.com")
+	c.cacheCertificate(second)
+	if stats := c.Stats(); stats.Certificates != 2 || stats.Bytes != certMemorySize(cert)+certMemorySize(second) {
+		t.Errorf("unexpected stats after caching 2 certificates: %+v", stats)
+	}
+
+	third, _ := issueFakeCertificate(t, fi, "c.example.com")
+	c.cacheCertificate(third)
+	stats := c.Stats()
+	if stats.Certificates != 2 || stats.Bytes > stats.MaxBytes || stats.Evictions != 1 {
+		t.Errorf("expected eviction to stay within memory budget, got %+v", stats)
+	}
+	if _, ok := c.cache[cert.hash]; ok {
+		t.Error("expected least recently used certificate to be evicted")
+	}
+
+	c.Remove([]string{second.hash, third.hash})
+	if stats := c.Stats(); stats.Certificates != 0 || stats.Bytes != 0 {
+		t.Errorf("expected empty cache to use no memory, got %+v", stats)
+	}
+}
+
+func TestCacheStatsHits(t *testing.T) {
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cert, _ := issueFakeCertificate(t, fi, "example.com")
+	cfg.certCache.cacheCertificate(cert)
+
+	for _, name := range []string{"example.com", "example.com", "other.example.net"} {
+		hello := &tls.ClientHelloInfo{ServerName: name, Conn: remoteConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}}}
+		cfg.GetCertificate(hello)
+	}
+	stats := cfg.certCache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("expected 2 hits and 1 miss, got %+v", stats)
+	}
+	if stats.Certificates != 1 || stats.EvictionPolicy != EvictRandom {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"time"
+)
+
+// maxCertReviewInterval is the longest a managed certificate goes
+// without being examined by maintenance, even if nothing about it is
+// expected to be due, so that changes to its configuration (such as
+// its renewal window ratio) are noticed eventually.
+const maxCertReviewInterval = 24 * time.Hour
+
+// expiryBuckets schedules the managed certificates in a cache for
+// examination by maintenance. Rather than examining every certificate
+// in every renewal pass, which is costly with many certificates, each
+// certificate is put into the bucket of the next time it might need
+// attention (renewal, an ARI refresh, or garbage collection), and
+// each pass only examines the buckets that are due.
+//
+// Buckets are as wide as the renewal check interval. Its methods
+// are not safe for concurrent use; callers must hold the lock of
+// the cache.
+type expiryBuckets struct {
+	width     time.Duration
+	buckets   map[int64]map[string]struct{} // bucket -> cert hashes
+	scheduled map[string]int64              // cert hash -> bucket
+}
+
+// schedule (re)schedules the certificate with the given hash for
+// examination at or soon after t.
+func (eb *expiryBuckets) schedule(hash string, t time.Time) {
+	if eb.buckets == nil {
+		eb.buckets = make(map[int64]map[string]struct{})
+		eb.scheduled = make(map[string]int64)
+	}
+	eb.unschedule(hash)
+	bucket := eb.bucket(t)
+	if eb.buckets[bucket] == nil {
+		eb.buckets[bucket] = make(map[string]struct{})
+	}
+	eb.buckets[bucket][hash] = struct{}{}
+	eb.scheduled[hash] = bucket
+}
+
+// unschedule removes the certificate with the given hash.
+func (eb *expiryBuckets) unschedule(hash string) {
+	bucket, ok := eb.scheduled[hash]
+	if !ok {
+		return
+	}
+	delete(eb.scheduled, hash)
+	delete(eb.buckets[bucket], hash)
+	if len(eb.buckets[bucket]) == 0 {
+		delete(eb.buckets, bucket)
+	}
+}
+
+// due returns the hashes of the certificates that are scheduled
+// for examination at or before now. They stay scheduled until
+// they are rescheduled or unscheduled.
+func (eb *expiryBuckets) due(now time.Time) []string {
+	current := eb.bucket(now)
+	var hashes []string
+	for bucket, certs := range eb.buckets {
+		if bucket > current {
+			continue
+		}
+		for hash := range certs {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// len returns the number of scheduled certificates.
+func (eb *expiryBuckets) len() int { return len(eb.scheduled) }
+
+func (eb *expiryBuckets) bucket(t time.Time) int64 {
+	width := eb.width
+	if width <= 0 {
+		width = DefaultRenewCheckInterval
+	}
+	return t.UnixNano() / int64(width)
+}
+
+// nextReview returns the next time maintenance should examine cert:
+// the earliest time at which it might need renewal, an ARI refresh,
+// or garbage collection, and no later than maxCertReviewInterval from
+// now. If any of these is due already, a time in the past is returned.
+// It errs on the side of examining certificates early, since the
+// examination decides what to actually do.
+func (cfg *Config) nextReview(cert Certificate) time.Time {
+	now := timeNow()
+	next := now.Add(maxCertReviewInterval)
+	earliest := func(t time.Time) {
+		if t.Before(next) {
+			next = t
+		}
+	}
+	if cert.Leaf == nil {
+		return next
+	}
+	expiration := expiresAt(cert.Leaf)
+	lifetime := expiration.Sub(cert.Leaf.NotBefore)
+
+	if cfg.ExpiredCertGC != nil {
+		earliest(expiration.Add(cfg.ExpiredCertGC.gracePeriod()))
+	}
+	if cfg.OnDemand != nil {
+		// on-demand certificates are renewed during handshakes
+		return next
+	}
+
+	cfg.certCache.optionsMu.RLock()
+	interval := cfg.certCache.options.RenewCheckInterval
+	cfg.certCache.optionsMu.RUnlock()
+
+	// the renewal windows of certNeedsRenewal
+	ratio := cfg.RenewalWindowRatio
+	if ratio == 0 {
+		ratio = DefaultRenewalWindowRatio
+	}
+	for _, r := range []float64{ratio, 1.0 / 20.0, 1.0 / 50.0} {
+		earliest(expiration.Add(-time.Duration(float64(lifetime) * r)))
+	}
+	earliest(expiration.Add(-interval * 5))
+
+	if !cfg.DisableARI {
+		if !cert.ari.SelectedTime.IsZero() {
+			earliest(cert.ari.SelectedTime.Add(-interval))
+		} else if !cert.ari.SuggestedWindow.Start.IsZero() {
+			earliest(cert.ari.SuggestedWindow.Start.Add(-interval))
+		}
+		if cert.ari.HasWindow() {
+			if cert.ari.RetryAfter == nil {
+				earliest(now)
+			} else {
+				earliest(*cert.ari.RetryAfter)
+			}
+		}
+	}
+
+	return next
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpiryBuckets(t *testing.T) {
+	now := time.Now()
+	eb := expiryBuckets{width: 10 * time.Minute}
+	eb.schedule("a", now.Add(-time.Hour))
+	eb.schedule("b", now)
+	eb.schedule("c", now.Add(time.Hour))
+	if due := eb.due(now); len(due) != 2 {
+		t.Errorf("expected 2 certificates due, got %v", due)
+	}
+
+	// rescheduling moves the certificate
+	eb.schedule("a", now.Add(2*time.Hour))
+	if due := eb.due(now); len(due) != 1 || due[0] != "b" {
+		t.Errorf("expected only b due, got %v", due)
+	}
+	if due := eb.due(now.Add(2 * time.Hour)); len(due) != 3 {
+		t.Errorf("expected all certificates due later, got %v", due)
+	}
+
+	eb.unschedule("b")
+	eb.unschedule("unknown")
+	if due := eb.due(now); len(due) != 0 {
+		t.Errorf("expected no certificates due, got %v", due)
+	}
+	if eb.len() != 2 {
+		t.Errorf("expected 2 scheduled certificates, got %d", eb.len())
+	}
+}
+
+func TestRenewalPassExaminesDueCertificates(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certCache := cfg.certCache
+
+	// new certificates are due right away
+	certCache.mu.RLock()
+	due := certCache.reviews.due(timeNow())
+	certCache.mu.RUnlock()
+	if len(due) != 1 {
+		t.Fatalf("expected new certificate to be due, got %v", due)
+	}
+
+	// after being examined, it is scheduled for later
+	if err := certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	certCache.mu.RLock()
+	due = certCache.reviews.due(timeNow())
+	certCache.mu.RUnlock()
+	if len(due) != 0 {
+		t.Errorf("expected no certificates due after examination, got %v", due)
+	}
+
+	// it is due again at the latest after maxCertReviewInterval, and
+	// then, since it is not yet in its renewal window, rescheduled
+	faults.set(maxCertReviewInterval, false)
+	certCache.mu.RLock()
+	due = certCache.reviews.due(timeNow())
+	certCache.mu.RUnlock()
+	if len(due) != 1 {
+		t.Errorf("expected certificate to be due after review interval, got %v", due)
+	}
+	if err := certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if issued := len(fi.Issued()); issued != 1 {
+		t.Errorf("expected no renewal, got %d issuances", issued)
+	}
+
+	// the next examination is no later than the start of the renewal window
+	next := cfg.nextReview(cert)
+	lifetime := cert.Lifetime()
+	windowStart := expiresAt(cert.Leaf).Add(-time.Duration(float64(lifetime) * cfg.RenewalWindowRatio))
+	if next.After(windowStart) {
+		t.Errorf("expected next review %s no later than renewal window start %s", next, windowStart)
+	}
+
+	// removed certificates are unscheduled
+	certCache.mu.Lock()
+	certCache.removeCertificate(cert)
+	scheduled := certCache.reviews.len()
+	certCache.mu.Unlock()
+	if scheduled != 0 {
+		t.Errorf("expected removed certificate to be unscheduled, got %d scheduled", scheduled)
+	}
+}
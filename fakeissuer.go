@@ -0,0 +1,338 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/ocsp"
+)
+
+// FakeIssuer is an Issuer for testing that signs certificates with its
+// own throwaway CA, without contacting any server. Its latency and errors
+// can be programmed, so that applications can test how their integration
+// handles issuance failures without a real CA. It also implements Revoker.
+//
+// A FakeIssuer must not be copied after first use.
+type FakeIssuer struct {
+	// The issuer key. Default: "fake".
+	Key string
+
+	// How long each issuance takes. Issuance is
+	// aborted early if the context is canceled.
+	Latency time.Duration
+
+	// The validity period of issued certificates, unless the
+	// config requests a lifetime (see RequestedLifetime).
+	// Default: 90 days.
+	Lifetime time.Duration
+
+	// If set, the OCSP responder URL to put into issued
+	// certificates. Use OCSPResponse to make responses.
+	OCSPServer string
+
+	// If set, the CRL distribution point URL to put into
+	// issued certificates. Use CRL to make CRLs.
+	CRLDistributionPoint string
+
+	// If set, SCTs from logs with these IDs are embedded
+	// into issued certificates, e.g. to test a CTPolicy.
+	// The SCTs are not validly signed.
+	SCTLogIDs [][32]byte
+
+	// If set, Fail is called before each issuance (after the
+	// latency elapses), with the number of the attempt starting
+	// at 1; if it returns an error, issuance fails with it.
+	Fail func(ctx context.Context, csr *x509.CertificateRequest, attempt int) error
+
+	mu       sync.Mutex
+	ca       *x509.Certificate
+	caKey    crypto.Signer
+	serial   int64
+	attempts int
+	issued   []*x509.Certificate
+	revoked  map[string]int // serial -> reason
+}
+
+// Issue implements Issuer.
+func (fi *FakeIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	fi.mu.Lock()
+	fi.attempts++
+	attempt := fi.attempts
+	fi.mu.Unlock()
+
+	if fi.Latency > 0 {
+		timer := time.NewTimer(fi.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if fi.Fail != nil {
+		if err := fi.Fail(ctx, csr, attempt); err != nil {
+			return nil, err
+		}
+	}
+
+	lifetime := fi.Lifetime
+	if lifetime <= 0 {
+		lifetime = 90 * 24 * time.Hour
+	}
+	if requested, ok := RequestedLifetime(ctx); ok {
+		lifetime = requested
+	}
+
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.initCA(); err != nil {
+		return nil, err
+	}
+	fi.serial++
+	notBefore := time.Now().Add(-time.Minute).Truncate(time.Second)
+	tpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(fi.serial),
+		Subject:        pkix.Name{CommonName: firstName(csr)},
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      notBefore,
+		NotAfter:       notBefore.Add(lifetime),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	// otherName SANs are only in the extension
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) && len(otherNamesFromExtensions([]pkix.Extension{ext})) > 0 {
+			tpl.ExtraExtensions = append(tpl.ExtraExtensions, ext)
+		}
+	}
+	if fi.OCSPServer != "" {
+		tpl.OCSPServer = []string{fi.OCSPServer}
+	}
+	if fi.CRLDistributionPoint != "" {
+		tpl.CRLDistributionPoints = []string{fi.CRLDistributionPoint}
+	}
+	if len(fi.SCTLogIDs) > 0 {
+		ext, err := fakeSCTListExtension(fi.SCTLogIDs, notBefore)
+		if err != nil {
+			return nil, err
+		}
+		tpl.ExtraExtensions = append(tpl.ExtraExtensions, ext)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, fi.ca, csr.PublicKey, fi.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	fi.issued = append(fi.issued, leaf)
+
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: fi.ca.Raw})...)
+	return &IssuedCertificate{Certificate: chain}, nil
+}
+
+// fakeSCTListExtension returns an embedded SCT list extension with an
+// SCT from each of the logs with the given IDs, with a dummy signature.
+func fakeSCTListExtension(logIDs [][32]byte, timestamp time.Time) (pkix.Extension, error) {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(list *cryptobyte.Builder) {
+		for _, logID := range logIDs {
+			list.AddUint16LengthPrefixed(func(sct *cryptobyte.Builder) {
+				sct.AddUint8(0) // v1
+				sct.AddBytes(logID[:])
+				sct.AddUint64(uint64(timestamp.UnixMilli()))
+				sct.AddUint16(0) // no extensions
+				sct.AddUint8(4)  // SHA-256
+				sct.AddUint8(3)  // ECDSA
+				sct.AddUint16LengthPrefixed(func(sig *cryptobyte.Builder) {
+					sig.AddBytes([]byte("fake"))
+				})
+			})
+		}
+	})
+	list, err := b.Bytes()
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	value, err := asn1.Marshal(list)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidSCTList, Value: value}, nil
+}
+
+// IssuerKey implements Issuer.
+func (fi *FakeIssuer) IssuerKey() string {
+	if fi.Key == "" {
+		return "fake"
+	}
+	return fi.Key
+}
+
+// Revoke implements Revoker. Revoked certificates are reported
+// as such by OCSPResponse.
+func (fi *FakeIssuer) Revoke(_ context.Context, cert CertificateResource, reason int) error {
+	certs, err := parseCertsFromPEMBundle(cert.CertificatePEM)
+	if err != nil {
+		return err
+	}
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if fi.revoked == nil {
+		fi.revoked = make(map[string]int)
+	}
+	fi.revoked[certs[0].SerialNumber.String()] = reason
+	return nil
+}
+
+// Attempts returns how many times issuance was attempted.
+func (fi *FakeIssuer) Attempts() int {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return fi.attempts
+}
+
+// Issued returns the certificates that were issued successfully.
+func (fi *FakeIssuer) Issued() []*x509.Certificate {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	return append([]*x509.Certificate(nil), fi.issued...)
+}
+
+// CACertificate returns the certificate of the fake CA.
+func (fi *FakeIssuer) CACertificate() (*x509.Certificate, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.initCA(); err != nil {
+		return nil, err
+	}
+	return fi.ca, nil
+}
+
+// OCSPResponse returns a DER-encoded OCSP response for leaf, signed by
+// the fake CA, that is valid for the given duration. The status is Good
+// unless the certificate was revoked with Revoke.
+func (fi *FakeIssuer) OCSPResponse(leaf *x509.Certificate, validFor time.Duration) ([]byte, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.initCA(); err != nil {
+		return nil, err
+	}
+	now := time.Now().Truncate(time.Second)
+	tpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.SerialNumber,
+		ThisUpdate:   now.Add(-time.Minute),
+		NextUpdate:   now.Add(validFor),
+	}
+	if reason, ok := fi.revoked[leaf.SerialNumber.String()]; ok {
+		tpl.Status = ocsp.Revoked
+		tpl.RevokedAt = now.Add(-time.Minute)
+		tpl.RevocationReason = reason
+	}
+	return ocsp.CreateResponse(fi.ca, fi.ca, tpl, fi.caKey)
+}
+
+// CRL returns a DER-encoded CRL, signed by the fake CA, that is valid
+// for the given duration and lists the certificates revoked with Revoke.
+func (fi *FakeIssuer) CRL(validFor time.Duration) ([]byte, error) {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
+	if err := fi.initCA(); err != nil {
+		return nil, err
+	}
+	now := time.Now().Truncate(time.Second)
+	tpl := &x509.RevocationList{
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now.Add(-time.Minute),
+		NextUpdate: now.Add(validFor),
+	}
+	for serial, reason := range fi.revoked {
+		sn, _ := new(big.Int).SetString(serial, 10)
+		tpl.RevokedCertificateEntries = append(tpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   sn,
+			RevocationTime: now.Add(-time.Minute),
+			ReasonCode:     reason,
+		})
+	}
+	return x509.CreateRevocationList(rand.Reader, tpl, fi.ca, fi.caKey)
+}
+
+// initCA creates the fake CA if it does not exist yet. fi.mu must be held.
+func (fi *FakeIssuer) initCA() error {
+	if fi.ca != nil {
+		return nil
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake Issuer CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, key.Public(), key)
+	if err != nil {
+		return fmt.Errorf("creating fake CA: %v", err)
+	}
+	fi.ca, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	fi.caKey = key
+	fi.serial = 1
+	return nil
+}
+
+func firstName(csr *x509.CertificateRequest) string {
+	if len(csr.DNSNames) > 0 {
+		return csr.DNSNames[0]
+	}
+	if len(csr.IPAddresses) > 0 {
+		return csr.IPAddresses[0].String()
+	}
+	return csr.Subject.CommonName
+}
+
+// Interface guards
+var (
+	_ Issuer  = (*FakeIssuer)(nil)
+	_ Revoker = (*FakeIssuer)(nil)
+)
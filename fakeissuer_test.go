@@ -0,0 +1,202 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestFakeIssuer(t *testing.T) {
+	ctx := context.Background()
+	fi := &FakeIssuer{
+		Fail: func(_ context.Context, _ *x509.CertificateRequest, attempt int) error {
+			if attempt == 1 {
+				return errors.New("transient failure")
+			}
+			return nil
+		},
+	}
+	cfg := newOnDemandTestConfig(t, fi)
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err == nil {
+		t.Fatal("expected first attempt to fail")
+	}
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatalf("expected second attempt to succeed: %v", err)
+	}
+	if attempts, issued := fi.Attempts(), len(fi.Issued()); attempts != 2 || issued != 1 {
+		t.Errorf("expected 2 attempts and 1 issuance, got %d and %d", attempts, issued)
+	}
+
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("loading certificate: %v", err)
+	}
+	ca, _ := fi.CACertificate()
+	if err := cert.Leaf.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("expected certificate to be signed by fake CA: %v", err)
+	}
+	if cert.issuerKey != "fake" {
+		t.Errorf("expected issuer key 'fake', got %q", cert.issuerKey)
+	}
+}
+
+func TestStapleOCSPEdgeCases(t *testing.T) {
+	ctx := context.Background()
+
+	var responderErrors bool
+	fi := new(FakeIssuer)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if responderErrors {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("parsing OCSP request: %v", err)
+			return
+		}
+		for _, leaf := range fi.Issued() {
+			if leaf.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				resp, err := fi.OCSPResponse(leaf, 24*time.Hour)
+				if err != nil {
+					t.Errorf("making OCSP response: %v", err)
+				}
+				w.Write(resp)
+				return
+			}
+		}
+		w.Write(ocsp.UnauthorizedErrorResponse)
+	}))
+	defer responder.Close()
+	fi.OCSPServer = responder.URL
+
+	storage := &FaultyStorage{Storage: &FileStorage{Path: t.TempDir()}}
+
+	t.Run("staple write fails", func(t *testing.T) {
+		cert, bundle := issueFakeCertificate(t, fi, "write.example.com")
+		storage.Fault = func(op StorageOp, key string) error {
+			if op == StorageOpStore {
+				return errors.New("disk full")
+			}
+			return nil
+		}
+		defer func() { storage.Fault = nil }()
+
+		err := stapleOCSP(ctx, OCSPConfig{}, storage, &cert, bundle)
+		if err == nil || !strings.Contains(err.Error(), "disk full") {
+			t.Errorf("expected storage error, got %v", err)
+		}
+		// the fresh response should still be used even though it couldn't be persisted
+		if cert.Certificate.OCSPStaple == nil || cert.ocsp == nil {
+			t.Error("expected OCSP response to be stapled despite storage failure")
+		}
+	})
+
+	t.Run("corrupt staple in storage is replaced", func(t *testing.T) {
+		cert, bundle := issueFakeCertificate(t, fi, "corrupt.example.com")
+		key := StorageKeys.OCSPStaple(&cert, bundle)
+		if err := storage.Store(ctx, key, []byte("garbage")); err != nil {
+			t.Fatal(err)
+		}
+		if err := stapleOCSP(ctx, OCSPConfig{}, storage, &cert, bundle); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		stored, err := storage.Load(ctx, key)
+		if err != nil || !bytes.Equal(stored, cert.Certificate.OCSPStaple) {
+			t.Errorf("expected corrupt staple to be replaced with fresh response (err=%v)", err)
+		}
+	})
+
+	t.Run("cached staple survives responder outage", func(t *testing.T) {
+		cert, bundle := issueFakeCertificate(t, fi, "outage.example.com")
+		if err := stapleOCSP(ctx, OCSPConfig{}, storage, &cert, bundle); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		responderErrors = true
+		defer func() { responderErrors = false }()
+
+		fresh := cert
+		fresh.Certificate.OCSPStaple, fresh.ocsp = nil, nil
+		if err := stapleOCSP(ctx, OCSPConfig{}, storage, &fresh, bundle); err != nil {
+			t.Fatalf("expected cached staple to be used, got error: %v", err)
+		}
+		if !bytes.Equal(fresh.Certificate.OCSPStaple, cert.Certificate.OCSPStaple) {
+			t.Error("expected cached staple to be stapled")
+		}
+	})
+
+	t.Run("revoked", func(t *testing.T) {
+		cert, bundle := issueFakeCertificate(t, fi, "revoked.example.com")
+		if err := fi.Revoke(ctx, CertificateResource{CertificatePEM: bundle}, ocsp.KeyCompromise); err != nil {
+			t.Fatal(err)
+		}
+		if err := stapleOCSP(ctx, OCSPConfig{}, storage, &cert, bundle); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if cert.Certificate.OCSPStaple != nil {
+			t.Error("revoked response should not be stapled")
+		}
+		if status, ok := cert.OCSPStatus(); !ok || status.Status != ocsp.Revoked || status.RevocationReason != ocsp.KeyCompromise {
+			t.Errorf("expected revoked status to be recorded, got %+v", status)
+		}
+	})
+}
+
+// issueFakeCertificate issues a certificate for name from fi and
+// returns it along with its PEM-encoded chain.
+func issueFakeCertificate(t *testing.T, fi *FakeIssuer, name string) (Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{name}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := fi.Issue(context.Background(), csr)
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := makeCertificate(issued.Certificate, keyPEM)
+	if err != nil {
+		t.Fatalf("making certificate: %v", err)
+	}
+	return cert, issued.Certificate
+}
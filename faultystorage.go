@@ -0,0 +1,155 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"time"
+)
+
+// StorageOp is the name of a Storage method, used by FaultyStorage.
+type StorageOp string
+
+// Storage operations.
+const (
+	StorageOpLock   StorageOp = "lock"
+	StorageOpUnlock StorageOp = "unlock"
+	StorageOpStore  StorageOp = "store"
+	StorageOpLoad   StorageOp = "load"
+	StorageOpDelete StorageOp = "delete"
+	StorageOpExists StorageOp = "exists"
+	StorageOpList   StorageOp = "list"
+	StorageOpStat   StorageOp = "stat"
+)
+
+// FaultyStorage is a Storage for testing that wraps another Storage
+// and injects latency, errors, and corruption into its operations, so
+// that applications can test how their integration handles storage
+// failures.
+type FaultyStorage struct {
+	// The underlying storage. Required.
+	Storage
+
+	// How long each operation takes, in addition to the
+	// underlying storage. Operations are aborted early
+	// if the context is canceled.
+	Latency time.Duration
+
+	// If set, Fault is called before each operation; if
+	// it returns an error, the operation fails with it.
+	// For Exists, an error makes the key appear to not
+	// exist.
+	Fault func(op StorageOp, key string) error
+
+	// If true, a Store that fails because of Fault first
+	// writes the first half of the value, as if the write
+	// was interrupted.
+	PartialWrites bool
+
+	// If set, values returned by Load are passed through
+	// Corrupt, which can modify them to simulate corrupted
+	// storage.
+	Corrupt func(key string, value []byte) []byte
+}
+
+func (s *FaultyStorage) fault(ctx context.Context, op StorageOp, key string) error {
+	if s.Latency > 0 {
+		timer := time.NewTimer(s.Latency)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if s.Fault != nil {
+		return s.Fault(op, key)
+	}
+	return nil
+}
+
+// Lock implements Locker.
+func (s *FaultyStorage) Lock(ctx context.Context, name string) error {
+	if err := s.fault(ctx, StorageOpLock, name); err != nil {
+		return err
+	}
+	return s.Storage.Lock(ctx, name)
+}
+
+// Unlock implements Locker.
+func (s *FaultyStorage) Unlock(ctx context.Context, name string) error {
+	if err := s.fault(ctx, StorageOpUnlock, name); err != nil {
+		return err
+	}
+	return s.Storage.Unlock(ctx, name)
+}
+
+// Store implements Storage.
+func (s *FaultyStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := s.fault(ctx, StorageOpStore, key); err != nil {
+		if s.PartialWrites {
+			_ = s.Storage.Store(ctx, key, value[:len(value)/2])
+		}
+		return err
+	}
+	return s.Storage.Store(ctx, key, value)
+}
+
+// Load implements Storage.
+func (s *FaultyStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	if err := s.fault(ctx, StorageOpLoad, key); err != nil {
+		return nil, err
+	}
+	value, err := s.Storage.Load(ctx, key)
+	if err == nil && s.Corrupt != nil {
+		value = s.Corrupt(key, value)
+	}
+	return value, err
+}
+
+// Delete implements Storage.
+func (s *FaultyStorage) Delete(ctx context.Context, key string) error {
+	if err := s.fault(ctx, StorageOpDelete, key); err != nil {
+		return err
+	}
+	return s.Storage.Delete(ctx, key)
+}
+
+// Exists implements Storage.
+func (s *FaultyStorage) Exists(ctx context.Context, key string) bool {
+	if err := s.fault(ctx, StorageOpExists, key); err != nil {
+		return false
+	}
+	return s.Storage.Exists(ctx, key)
+}
+
+// List implements Storage.
+func (s *FaultyStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	if err := s.fault(ctx, StorageOpList, path); err != nil {
+		return nil, err
+	}
+	return s.Storage.List(ctx, path, recursive)
+}
+
+// Stat implements Storage.
+func (s *FaultyStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	if err := s.fault(ctx, StorageOpStat, key); err != nil {
+		return KeyInfo{}, err
+	}
+	return s.Storage.Stat(ctx, key)
+}
+
+// Interface guard
+var _ Storage = (*FaultyStorage)(nil)
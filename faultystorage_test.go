@@ -0,0 +1,117 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFaultyStorage(t *testing.T) {
+	ctx := context.Background()
+	errFault := errors.New("injected fault")
+	storage := &FaultyStorage{
+		Storage:       &FileStorage{Path: t.TempDir()},
+		PartialWrites: true,
+		Fault: func(op StorageOp, key string) error {
+			if op == StorageOpStore && key == "bad" {
+				return errFault
+			}
+			return nil
+		},
+		Corrupt: func(key string, value []byte) []byte {
+			if key == "corrupt" {
+				return []byte("corrupted")
+			}
+			return value
+		},
+	}
+
+	if err := storage.Store(ctx, "good", []byte("hello world")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := storage.Store(ctx, "bad", []byte("hello world")); !errors.Is(err, errFault) {
+		t.Fatalf("expected injected fault, got %v", err)
+	}
+	if value, _ := storage.Load(ctx, "bad"); string(value) != "hello" {
+		t.Errorf("expected partial write, got %q", value)
+	}
+	if err := storage.Store(ctx, "corrupt", []byte("hello world")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value, _ := storage.Load(ctx, "corrupt"); string(value) != "corrupted" {
+		t.Errorf("expected corrupted value, got %q", value)
+	}
+
+	// latency is subject to context cancellation
+	storage.Latency = time.Hour
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := storage.Load(canceled, "good"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context error, got %v", err)
+	}
+}
+
+func TestDeleteOldOCSPStaplesWithFaults(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	storage := &FaultyStorage{Storage: &FileStorage{Path: t.TempDir()}}
+
+	cert, _ := issueFakeCertificate(t, fi, "example.com")
+	expired, err := fi.OCSPResponse(cert.Leaf, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := fi.OCSPResponse(cert.Leaf, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range map[string][]byte{
+		"expired":    expired,
+		"valid":      valid,
+		"corrupt":    []byte("garbage"),
+		"unreadable": expired,
+	} {
+		if err := storage.Store(ctx, path.Join(prefixOCSP, key), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// one staple can't be loaded; cleanup should carry on with the others
+	storage.Fault = func(op StorageOp, key string) error {
+		if op == StorageOpLoad && path.Base(key) == "unreadable" {
+			return errors.New("I/O error")
+		}
+		return nil
+	}
+	if err := deleteOldOCSPStaples(ctx, storage, defaultTestLogger); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	storage.Fault = nil
+
+	for key, shouldExist := range map[string]bool{
+		"expired":    false,
+		"valid":      true,
+		"corrupt":    false,
+		"unreadable": true,
+	} {
+		if exists := storage.Exists(ctx, path.Join(prefixOCSP, key)); exists != shouldExist {
+			t.Errorf("%s: expected exists=%t, got %t", key, shouldExist, exists)
+		}
+	}
+}
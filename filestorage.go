@@ -214,6 +214,7 @@ func (s *FileStorage) Lock(ctx context.Context, name string) error {
 					// caused them to be unable to fully acquire or retain the lock, therefore
 					// we should treat it as if the lockfile did not exist
 					log.Printf("[INFO][%s] %s: Empty lockfile (%v) - likely previous process crashed or storage medium failure; treating as stale", s, filename, err2)
+					ReportStaleLockTakeover(ctx, name)
 				}
 			} else if err2 != nil {
 				return fmt.Errorf("decoding lockfile contents: %w", err2)
@@ -237,6 +238,7 @@ func (s *FileStorage) Lock(ctx context.Context, name string) error {
 			// so we prefer the simpler solution that avoids infinite loops)
 			log.Printf("[INFO][%s] Lock for '%s' is stale (created: %s, last update: %s); removing then retrying: %s",
 				s, name, meta.Created, meta.Updated, filename)
+			ReportStaleLockTakeover(ctx, name)
 			if err = os.Remove(filename); err != nil { // hopefully we can replace the lock file quickly!
 				if !errors.Is(err, fs.ErrNotExist) {
 					return fmt.Errorf("unable to delete stale lockfile; deadlocked: %w", err)
@@ -271,7 +273,7 @@ func (s *FileStorage) lockFilename(name string) string {
 }
 
 func (s *FileStorage) lockDir() string {
-	return filepath.Join(s.Path, "locks")
+	return filepath.Join(s.Path, prefixLocks)
 }
 
 func fileLockIsStale(meta lockMeta) bool {
@@ -0,0 +1,162 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ExpiredCertGC configures the automatic removal of expired
+// certificates that are no longer needed. During maintenance,
+// managed certificates that expired more than GracePeriod ago
+// are evicted from the cache and deleted from storage if their
+// names are no longer managed, or if they keep failing the
+// on-demand permission checks.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ExpiredCertGC struct {
+	// How long to keep certificates after they
+	// expire. Default: DefaultExpiredCertGracePeriod.
+	GracePeriod time.Duration
+
+	// Optional function that reports whether certificates
+	// for name are still managed. If not set, only the
+	// permission checks of on-demand configs are used to
+	// determine whether a certificate is still needed.
+	IsManaged func(ctx context.Context, name string) bool
+
+	// How many consecutive maintenance runs an on-demand
+	// certificate must fail its permission checks before
+	// it is removed. Default: 3.
+	PermissionFailures int
+}
+
+// DefaultExpiredCertGracePeriod is how long expired certificates
+// are kept before they can be removed by ExpiredCertGC.
+const DefaultExpiredCertGracePeriod = 7 * 24 * time.Hour
+
+func (gc *ExpiredCertGC) gracePeriod() time.Duration {
+	if gc.GracePeriod > 0 {
+		return gc.GracePeriod
+	}
+	return DefaultExpiredCertGracePeriod
+}
+
+func (gc *ExpiredCertGC) permissionFailures() int {
+	if gc.PermissionFailures > 0 {
+		return gc.PermissionFailures
+	}
+	return 3
+}
+
+// expiredBeyondGracePeriod returns true if cfg has garbage
+// collection enabled and cert expired more than its grace
+// period ago, making it a candidate for removal.
+func (cfg *Config) expiredBeyondGracePeriod(cert Certificate) bool {
+	if cfg.ExpiredCertGC == nil || cert.Leaf == nil {
+		return false
+	}
+	return timeNow().Sub(expiresAt(cert.Leaf)) > cfg.ExpiredCertGC.gracePeriod()
+}
+
+// certIsAbandoned returns the reason cert, which expired beyond the
+// grace period, is no longer needed, or an empty string if it is
+// still needed. It must not be called while holding a lock on the
+// cache, since it may call user code.
+func (certCache *Cache) certIsAbandoned(ctx context.Context, cfg *Config, cert Certificate) string {
+	gc := cfg.ExpiredCertGC
+	if gc.IsManaged != nil {
+		managed := false
+		for _, name := range cert.Names {
+			if gc.IsManaged(ctx, name) {
+				managed = true
+				break
+			}
+		}
+		if !managed {
+			return "no longer managed"
+		}
+	}
+	if cfg.OnDemand == nil {
+		return ""
+	}
+
+	// the permission check may fail temporarily (for example, if
+	// it depends on a remote service), so give it a few chances
+	var permitted bool
+	for _, name := range cert.Names {
+		if err := cfg.checkIfCertShouldBeObtained(ctx, name, false); err == nil {
+			permitted = true
+			break
+		}
+	}
+	certCache.gcMu.Lock()
+	defer certCache.gcMu.Unlock()
+	if permitted {
+		delete(certCache.gcPermissionFailures, cert.hash)
+		return ""
+	}
+	if certCache.gcPermissionFailures == nil {
+		certCache.gcPermissionFailures = make(map[string]int)
+	}
+	certCache.gcPermissionFailures[cert.hash]++
+	if certCache.gcPermissionFailures[cert.hash] < gc.permissionFailures() {
+		return ""
+	}
+	delete(certCache.gcPermissionFailures, cert.hash)
+	return "failing permission checks"
+}
+
+// storageNamesKey returns the key that the assets of the managed
+// certificate cert are stored under, which is not necessarily one of
+// its names, for example for certificates of groups of names.
+func (cert Certificate) storageNamesKey() string {
+	if cert.namesKey != "" {
+		return cert.namesKey
+	}
+	certRes := CertificateResource{SANs: slices.Clone(cert.Names)}
+	return certRes.NamesKey()
+}
+
+// collectExpiredCert evicts cert from the cache and deletes its
+// assets from storage, since it expired and is no longer needed.
+func (certCache *Cache) collectExpiredCert(ctx context.Context, log *zap.Logger, cfg *Config, cert Certificate, reason string) {
+	log.Info("removing expired certificate that is no longer needed",
+		zap.Strings("identifiers", cert.Names),
+		zap.Time("expiration", expiresAt(cert.Leaf)),
+		zap.String("reason", reason))
+
+	certCache.mu.Lock()
+	certCache.removeCertificate(cert)
+	certCache.mu.Unlock()
+
+	if err := cfg.deleteSiteAssets(ctx, cert.issuerKey, cert.storageNamesKey()); err != nil {
+		log.Error("deleting assets of expired certificate",
+			zap.Strings("identifiers", cert.Names),
+			zap.String("issuer", cert.issuerKey),
+			zap.Error(err))
+	}
+
+	cfg.emit(ctx, "cert_removed", map[string]any{
+		"identifiers": cert.Names,
+		"issuer":      cert.issuerKey,
+		"expiration":  expiresAt(cert.Leaf),
+		"reason":      reason,
+	})
+}
@@ -0,0 +1,199 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpiredCertGCPermissionFailures(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.ExpiredCertGC = &ExpiredCertGC{GracePeriod: 24 * time.Hour, PermissionFailures: 2}
+	var removed []string
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "cert_removed" {
+			removed = append(removed, data["reason"].(string))
+		}
+		return nil
+	}
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// expired, but within the grace period
+	faults.set(91*24*time.Hour, false)
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.certCache.AllMatchingCertificates("example.com")) != 1 {
+		t.Fatal("expected certificate within grace period to stay cached")
+	}
+
+	// expired beyond the grace period, but still permitted
+	faults.set(100*24*time.Hour, false)
+	for i := 0; i < 3; i++ {
+		if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(cfg.certCache.AllMatchingCertificates("example.com")) != 1 {
+		t.Fatal("expected permitted certificate to stay cached")
+	}
+
+	// no longer permitted; removed after the second failure
+	cfg.OnDemand.DecisionFunc = func(context.Context, string) error { return fmt.Errorf("denied") }
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.certCache.AllMatchingCertificates("example.com")) != 1 {
+		t.Fatal("expected certificate to stay cached after first permission failure")
+	}
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.certCache.AllMatchingCertificates("example.com")) != 0 {
+		t.Error("expected certificate to be removed from cache")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "example.com")) {
+		t.Error("expected certificate to be deleted from storage")
+	}
+	if len(removed) != 1 || removed[0] != "failing permission checks" {
+		t.Errorf("expected one cert_removed event, got %v", removed)
+	}
+}
+
+func TestExpiredCertGCUnmanaged(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	managed := map[string]bool{"managed.example.com": true}
+	cfg.ExpiredCertGC = &ExpiredCertGC{IsManaged: func(_ context.Context, name string) bool { return managed[name] }}
+	for _, name := range []string{"managed.example.com", "unmanaged.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	faults.set(91*24*time.Hour+DefaultExpiredCertGracePeriod, false)
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if certs := cfg.certCache.getAllMatchingCerts("managed.example.com"); len(certs) != 1 {
+		t.Error("expected managed certificate to stay cached")
+	}
+	if certs := cfg.certCache.getAllMatchingCerts("unmanaged.example.com"); len(certs) != 0 {
+		t.Error("expected unmanaged certificate to be removed from cache")
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "managed.example.com")) {
+		t.Error("expected managed certificate to stay in storage")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "unmanaged.example.com")) {
+		t.Error("expected unmanaged certificate to be deleted from storage")
+	}
+}
+
+func TestExpiredCertGCGroupCertificate(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.SubjectAltNames = func(_ context.Context, name string) ([]string, error) {
+		if name == "192.0.2.1" {
+			return []string{"example.com"}, nil
+		}
+		return nil, nil
+	}
+	cfg.ExpiredCertGC = &ExpiredCertGC{IsManaged: func(_ context.Context, name string) bool { return false }}
+	if err := cfg.ObtainCertSync(ctx, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, "192.0.2.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leaf lists example.com first, but it also has a
+	// certificate of its own, issued later
+	faults.set(30*24*time.Hour, false)
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	faults.set(91*24*time.Hour+DefaultExpiredCertGracePeriod, false)
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if certs := cfg.certCache.getAllMatchingCerts("192.0.2.1"); len(certs) != 0 {
+		t.Error("expected group certificate to be removed from cache")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "192.0.2.1")) {
+		t.Error("expected group certificate to be deleted from storage")
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "example.com")) {
+		t.Error("expected certificate of another site not to be deleted")
+	}
+}
+
+func TestCleanStorageExpiredCertIsManaged(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	for _, name := range []string{"managed.example.com", "unmanaged.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	faults.set(100*24*time.Hour, false)
+	err := CleanStorage(ctx, cfg.Storage, CleanStorageOptions{
+		Logger:                 cfg.Logger,
+		ExpiredCerts:           true,
+		ExpiredCertGracePeriod: 24 * time.Hour,
+		ExpiredCertIsManaged: func(_ context.Context, name string) bool {
+			return name == "managed.example.com"
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "managed.example.com")) {
+		t.Error("expected managed certificate to stay in storage")
+	}
+	if cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "unmanaged.example.com")) {
+		t.Error("expected unmanaged certificate to be deleted from storage")
+	}
+}
@@ -27,7 +27,6 @@ import (
 
 	"github.com/mholt/acmez/v3"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/ocsp"
 )
 
 // GetCertificate gets a certificate to satisfy clientHello. In getting
@@ -50,12 +49,15 @@ func (cfg *Config) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certif
 }
 
 func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if err := cfg.emit(ctx, "tls_get_certificate", map[string]any{"client_hello": clientHelloWithoutConn(clientHello)}); err != nil {
-		cfg.Logger.Error("TLS handshake aborted by event handler",
-			zap.String("server_name", clientHello.ServerName),
-			zap.String("remote", clientHello.Conn.RemoteAddr().String()),
-			zap.Error(err))
-		return nil, fmt.Errorf("handshake aborted by event handler: %w", err)
+	// avoid building the event payload on every handshake if nobody is listening
+	if cfg.OnEvent != nil || cfg.certCache.events.subscribed() {
+		if err := cfg.emit(ctx, "tls_get_certificate", map[string]any{"client_hello": clientHelloWithoutConn(clientHello)}); err != nil {
+			cfg.Logger.Error("TLS handshake aborted by event handler",
+				zap.String("server_name", clientHello.ServerName),
+				zap.String("remote", clientHello.Conn.RemoteAddr().String()),
+				zap.Error(err))
+			return nil, fmt.Errorf("handshake aborted by event handler: %w", err)
+		}
 	}
 
 	if ctx == nil {
@@ -69,19 +71,25 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 	// "The ACME server MUST provide an ALPN extension with the single protocol
 	// name "acme-tls/1" and an SNI extension containing only the domain name
 	// being validated during the TLS handshake."
-	if clientHello.ServerName != "" &&
-		len(clientHello.SupportedProtos) == 1 &&
-		clientHello.SupportedProtos[0] == acmez.ACMETLS1Protocol {
-		challengeCert, distributed, err := cfg.getTLSALPNChallengeCert(clientHello)
+	// For IP identifiers, the SNI contains the reverse mapping of the IP address,
+	// but some validation servers send no SNI at all (RFC 8738 §6).
+	var challengeName string
+	if len(clientHello.SupportedProtos) == 1 && clientHello.SupportedProtos[0] == acmez.ACMETLS1Protocol {
+		challengeName = tlsALPNChallengeName(clientHello)
+	}
+	if challengeName != "" {
+		challengeCert, distributed, err := cfg.getTLSALPNChallengeCert(ctx, challengeName)
 		if err != nil {
 			cfg.Logger.Error("tls-alpn challenge",
 				zap.String("remote_addr", clientHello.Conn.RemoteAddr().String()),
 				zap.String("server_name", clientHello.ServerName),
+				zap.String("challenge_name", challengeName),
 				zap.Error(err))
 			return nil, err
 		}
 		cfg.Logger.Info("served key authentication certificate",
 			zap.String("server_name", clientHello.ServerName),
+			zap.String("challenge_name", challengeName),
 			zap.String("challenge", "tls-alpn-01"),
 			zap.String("remote", clientHello.Conn.RemoteAddr().String()),
 			zap.Bool("distributed", distributed))
@@ -90,10 +98,116 @@ func (cfg *Config) GetCertificateWithContext(ctx context.Context, clientHello *t
 
 	// get the certificate and serve it up
 	cert, err := cfg.getCertDuringHandshake(ctx, clientHello, true)
+	if err == nil && cfg.MinServingValidity > 0 {
+		cert, err = cfg.checkServingValidity(ctx, clientHello, cert)
+	}
+	if err == nil && cert.usage.record() {
+		cfg.certCache.evictionOrder.touch(cert.hash)
+	}
+	if err == nil && len(cfg.CrossSignedCertificates) > 0 {
+		return cfg.withCrossSigns(clientHello, cert), nil
+	}
 
 	return &cert.Certificate, err
 }
 
+// LowValidityAction is what to do when a certificate that would be
+// served has less remaining validity than Config.MinServingValidity.
+type LowValidityAction string
+
+// Actions for certificates with low remaining validity.
+const (
+	// Serve the certificate, but log a warning and
+	// emit a cert_validity_low event.
+	LowValidityWarn LowValidityAction = "warn"
+
+	// Like LowValidityWarn, but fail the handshake
+	// instead of serving the certificate.
+	LowValidityRefuse LowValidityAction = "refuse"
+
+	// Like LowValidityWarn, but serve the certificate
+	// for FallbackServerName instead, if there is one
+	// with enough remaining validity; otherwise, fail
+	// the handshake.
+	LowValidityFallback LowValidityAction = "fallback"
+)
+
+// checkServingValidity returns the certificate to serve in place of
+// cert, according to cfg.MinServingValidity and cfg.LowValidityAction.
+func (cfg *Config) checkServingValidity(ctx context.Context, hello *tls.ClientHelloInfo, cert Certificate) (Certificate, error) {
+	if cert.Leaf == nil {
+		return cert, nil
+	}
+	remaining := expiresAt(cert.Leaf).Sub(timeNow())
+	if remaining >= cfg.MinServingValidity {
+		return cert, nil
+	}
+
+	action := cfg.LowValidityAction
+	if action == "" {
+		action = LowValidityWarn
+	}
+
+	// warnings are throttled since they would otherwise happen at every handshake
+	if shouldWarnLowValidity(cert.hash) {
+		cfg.Logger.Warn("certificate has low remaining validity",
+			zap.String("server_name", hello.ServerName),
+			zap.Strings("identifiers", cert.Names),
+			zap.Time("expiration", expiresAt(cert.Leaf)),
+			zap.Duration("remaining", remaining),
+			zap.Duration("min_serving_validity", cfg.MinServingValidity),
+			zap.String("action", string(action)))
+		cfg.emit(ctx, "cert_validity_low", map[string]any{
+			"identifiers": cert.Names,
+			"expiration":  expiresAt(cert.Leaf),
+			"remaining":   remaining,
+			"action":      string(action),
+		})
+	}
+
+	switch action {
+	case LowValidityWarn:
+		return cert, nil
+	case LowValidityFallback:
+		if cfg.FallbackServerName != "" {
+			fallback, ok := cfg.selectCert(hello, normalizedName(cfg.FallbackServerName))
+			if ok && fallback.Leaf != nil && expiresAt(fallback.Leaf).Sub(timeNow()) >= cfg.MinServingValidity {
+				return fallback, nil
+			}
+		}
+	}
+	return Certificate{}, fmt.Errorf("certificate for %v has only %s of validity remaining", cert.Names, remaining.Round(time.Second))
+}
+
+// lowValidityWarnInterval is how often to warn about
+// each certificate with low remaining validity.
+const lowValidityWarnInterval = time.Minute
+
+var (
+	lowValidityWarnings   = make(map[string]time.Time) // cert hash -> last warning
+	lowValidityWarningsMu sync.Mutex
+)
+
+// shouldWarnLowValidity returns true if it is time to warn
+// about the low validity of the certificate with the given hash.
+func shouldWarnLowValidity(certHash string) bool {
+	lowValidityWarningsMu.Lock()
+	defer lowValidityWarningsMu.Unlock()
+	now := timeNow()
+	if last, ok := lowValidityWarnings[certHash]; ok && now.Sub(last) < lowValidityWarnInterval {
+		return false
+	}
+	// forget about certificates that have not been warned about in a while,
+	// since they have likely been renewed or removed
+	for hash, last := range lowValidityWarnings {
+		if now.Sub(last) > 10*lowValidityWarnInterval {
+			delete(lowValidityWarnings, hash)
+		}
+	}
+	lowValidityWarnings[certHash] = now
+	return true
+}
+
 // getCertificateFromCache gets a certificate that matches name from the in-memory
 // cache, according to the lookup table associated with cfg. The lookup then
 // points to a certificate in the Instance certificate cache.
@@ -138,12 +252,15 @@ func (cfg *Config) getCertificateFromCache(hello *tls.ClientHelloInfo) (cert Cer
 			return
 		}
 
-		// try replacing labels in the name with
-		// wildcards until we get a match
-		labels := strings.Split(name, ".")
-		for i := range labels {
-			labels[i] = "*"
-			candidate := strings.Join(labels, ".")
+		// try replacing labels in the name with wildcards until
+		// we get a match; the cache indexes wildcard names by
+		// suffix so we don't have to build each candidate name
+		for stars, rest, more := 1, name, true; more; stars++ {
+			rest, more = trimFirstLabel(rest)
+			candidate, ok := cfg.certCache.lookupWildcard(rest, stars)
+			if !ok {
+				continue
+			}
 			cert, matched = cfg.selectCert(hello, candidate)
 			if matched {
 				return
@@ -183,44 +300,61 @@ func (cfg *Config) getCertificateFromCache(hello *tls.ClientHelloInfo) (cert Cer
 // then all certificates in the cache will be passed in
 // for the cfg.CertSelection to make the final decision.
 func (cfg *Config) selectCert(hello *tls.ClientHelloInfo, name string) (Certificate, bool) {
-	logger := cfg.Logger.Named("handshake")
+	// this is called multiple times per handshake, so only pay
+	// for the named logger and log fields if they will be used
+	debug := cfg.Logger.Core().Enabled(zap.DebugLevel)
+	var logger *zap.Logger
+	if debug {
+		logger = cfg.Logger.Named("handshake")
+	}
+
 	choices := cfg.certCache.getAllMatchingCerts(name)
 
 	if len(choices) == 0 {
 		if cfg.CertSelection == nil {
-			logger.Debug("no matching certificates and no custom selection logic", zap.String("identifier", name))
+			if debug {
+				logger.Debug("no matching certificates and no custom selection logic", zap.String("identifier", name))
+			}
 			return Certificate{}, false
 		}
-		logger.Debug("no matching certificate; will choose from all certificates", zap.String("identifier", name))
+		if debug {
+			logger.Debug("no matching certificate; will choose from all certificates", zap.String("identifier", name))
+		}
 		choices = cfg.certCache.getAllCerts()
 	}
 
-	logger.Debug("choosing certificate",
-		zap.String("identifier", name),
-		zap.Int("num_choices", len(choices)))
+	if debug {
+		logger.Debug("choosing certificate",
+			zap.String("identifier", name),
+			zap.Int("num_choices", len(choices)))
+	}
 
 	if cfg.CertSelection == nil {
 		cert, err := DefaultCertificateSelector(hello, choices)
-		logger.Debug("default certificate selection results",
+		if debug {
+			logger.Debug("default certificate selection results",
+				zap.Error(err),
+				zap.String("identifier", name),
+				zap.Strings("subjects", cert.Names),
+				zap.Bool("managed", cert.managed),
+				zap.String("issuer_key", cert.issuerKey),
+				zap.String("hash", cert.hash))
+		}
+		return cert, err == nil
+	}
+
+	cert, err := cfg.CertSelection.SelectCertificate(hello, choices)
+
+	if debug {
+		logger.Debug("custom certificate selection results",
 			zap.Error(err),
 			zap.String("identifier", name),
 			zap.Strings("subjects", cert.Names),
 			zap.Bool("managed", cert.managed),
 			zap.String("issuer_key", cert.issuerKey),
 			zap.String("hash", cert.hash))
-		return cert, err == nil
 	}
 
-	cert, err := cfg.CertSelection.SelectCertificate(hello, choices)
-
-	logger.Debug("custom certificate selection results",
-		zap.Error(err),
-		zap.String("identifier", name),
-		zap.Strings("subjects", cert.Names),
-		zap.Bool("managed", cert.managed),
-		zap.String("issuer_key", cert.issuerKey),
-		zap.String("hash", cert.hash))
-
 	return cert, err == nil
 }
 
@@ -241,7 +375,7 @@ func DefaultCertificateSelector(hello *tls.ClientHelloInfo, choices []Certificat
 	}
 
 	// Slow path: There are choices, so we need to check each of them.
-	now := time.Now()
+	now := timeNow()
 	best := choices[0]
 	for _, choice := range choices {
 		if err := hello.SupportsCertificate(&choice.Certificate); err != nil {
@@ -268,11 +402,25 @@ func DefaultCertificateSelector(hello *tls.ClientHelloInfo, choices []Certificat
 // An error will be returned if and only if no certificate is available.
 //
 // This function is safe for concurrent use.
-func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.ClientHelloInfo, loadOrObtainIfNecessary bool) (Certificate, error) {
-	logger := logWithRemote(cfg.Logger.Named("handshake"), hello)
-
+func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.ClientHelloInfo, loadOrObtainIfNecessary bool) (_ Certificate, err error) {
 	// First check our in-memory cache to see if we've already loaded it
 	cert, matched, defaulted := cfg.getCertificateFromCache(hello)
+	if matched {
+		cfg.certCache.hits.Add(1)
+	} else {
+		cfg.certCache.misses.Add(1)
+	}
+
+	// this is the hot path, so avoid building a logger we won't use
+	if matched && !cfg.Logger.Core().Enabled(zap.DebugLevel) {
+		if cert.managed && cfg.OnDemand != nil && loadOrObtainIfNecessary {
+			return cfg.optionalMaintenance(ctx, cfg.Logger.Named("on_demand"), cert, hello)
+		}
+		return cert, nil
+	}
+
+	logger := logWithRemote(cfg.Logger.Named("handshake"), hello)
+
 	if matched {
 		logger.Debug("matched certificate in cache",
 			zap.Strings("subjects", cert.Names),
@@ -294,7 +442,7 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 	// domain, avoid pounding manager or storage thousands of times simultaneously. We use a similar sync
 	// strategy for obtaining certificate during handshake.
 	certLoadWaitChansMu.Lock()
-	wait, ok := certLoadWaitChans[name]
+	call, ok := certLoadWaitChans[name]
 	if ok {
 		// another goroutine is already loading the cert; just wait and we'll get it from the in-memory cache
 		certLoadWaitChansMu.Unlock()
@@ -306,21 +454,28 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 		case <-ctx.Done():
 			timeout.Stop()
 			return Certificate{}, ctx.Err()
-		case <-wait:
+		case <-call.done:
 			timeout.Stop()
 		}
 
-		return cfg.getCertDuringHandshake(ctx, hello, false)
+		// if it is not in the cache, share the error of
+		// the goroutine that tried to load or obtain it
+		cert, err := cfg.getCertDuringHandshake(ctx, hello, false)
+		if err != nil && call.err != nil {
+			return Certificate{}, call.err
+		}
+		return cert, err
 	} else {
 		// no other goroutine is currently trying to load this cert
-		wait = make(chan struct{})
-		certLoadWaitChans[name] = wait
+		call = &issuanceCall{done: make(chan struct{})}
+		certLoadWaitChans[name] = call
 		certLoadWaitChansMu.Unlock()
 
 		// unblock others and clean up when we're done
 		defer func() {
 			certLoadWaitChansMu.Lock()
-			close(wait)
+			call.err = err
+			close(call.done)
 			delete(certLoadWaitChans, name)
 			certLoadWaitChansMu.Unlock()
 		}()
@@ -338,7 +493,9 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 
 	// Make sure a certificate is allowed for the given name. If not, it doesn't make sense
 	// to try loading one from storage (issue #185) or obtaining one from an issuer.
-	if err := cfg.checkIfCertShouldBeObtained(ctx, name, false); err != nil {
+	err = cfg.checkIfCertShouldBeObtained(ctx, name, false)
+	cfg.addOnDemandDecision(err)
+	if err != nil {
 		return Certificate{}, fmt.Errorf("certificate is not allowed for server name %s: %w", name, err)
 	}
 
@@ -347,6 +504,7 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 	// a statically-managed cert was evicted from a full cache.
 	cfg.certCache.mu.RLock()
 	cacheSize := len(cfg.certCache.cache)
+	cacheBytes := cfg.certCache.bytes
 	cfg.certCache.mu.RUnlock()
 
 	// A cert might have still been evicted from the cache even if the cache
@@ -358,8 +516,10 @@ func (cfg *Config) getCertDuringHandshake(ctx context.Context, hello *tls.Client
 	// and caddyserver/caddy#4320.
 	cfg.certCache.optionsMu.RLock()
 	cacheCapacity := float64(cfg.certCache.options.Capacity)
+	cacheMaxBytes := float64(cfg.certCache.options.MaxBytes)
 	cfg.certCache.optionsMu.RUnlock()
-	cacheAlmostFull := cacheCapacity > 0 && float64(cacheSize) >= cacheCapacity*.9
+	cacheAlmostFull := (cacheCapacity > 0 && float64(cacheSize) >= cacheCapacity*.9) ||
+		(cacheMaxBytes > 0 && float64(cacheBytes) >= cacheMaxBytes*.9)
 	loadDynamically := cfg.OnDemand != nil || cacheAlmostFull
 
 	if loadDynamically && loadOrObtainIfNecessary {
@@ -461,9 +621,16 @@ func (cfg *Config) checkIfCertShouldBeObtained(ctx context.Context, name string,
 		return fmt.Errorf("subject name does not qualify for certificate: %s", name)
 	}
 	if cfg.OnDemand != nil {
-		if cfg.OnDemand.DecisionFunc != nil {
-			if err := cfg.OnDemand.DecisionFunc(ctx, name); err != nil {
-				return fmt.Errorf("decision func: %w", err)
+		if cfg.OnDemand.DecisionFunc != nil || cfg.OnDemand.Permission != nil {
+			if cfg.OnDemand.DecisionFunc != nil {
+				if err := cfg.OnDemand.DecisionFunc(ctx, name); err != nil {
+					return fmt.Errorf("decision func: %w", err)
+				}
+			}
+			if cfg.OnDemand.Permission != nil {
+				if err := cfg.OnDemand.Permission.CertificateAllowed(ctx, name); err != nil {
+					return fmt.Errorf("permission: %w", err)
+				}
 			}
 			return nil
 		}
@@ -488,7 +655,7 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 
 	// We must protect this process from happening concurrently, so synchronize.
 	obtainCertWaitChansMu.Lock()
-	wait, ok := obtainCertWaitChans[name]
+	call, ok := obtainCertWaitChans[name]
 	if ok {
 		// lucky us -- another goroutine is already obtaining the certificate.
 		// wait for it to finish obtaining the cert and then we'll use it.
@@ -497,33 +664,36 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 		log.Debug("new certificate is needed, but is already being obtained; waiting for that issuance to complete",
 			zap.String("subject", name))
 
-		// TODO: see if we can get a proper context in here, for true cancellation
-		timeout := time.NewTimer(2 * time.Minute)
-		select {
-		case <-timeout.C:
-			return Certificate{}, fmt.Errorf("timed out waiting to obtain certificate for %s", name)
-		case <-wait:
-			timeout.Stop()
-		}
-
-		// it should now be loaded in the cache, ready to go; if not,
-		// the goroutine in charge of that probably had an error
-		return cfg.getCertDuringHandshake(ctx, hello, false)
+		return cfg.waitForIssuance(ctx, hello, call, fmt.Sprintf("timed out waiting to obtain certificate for %s", name))
 	}
 
 	// looks like it's up to us to do all the work and obtain the cert.
-	// make a chan others can wait on if needed
-	wait = make(chan struct{})
-	obtainCertWaitChans[name] = wait
+	// make a call others can wait on if needed
+	call = &issuanceCall{done: make(chan struct{})}
+	obtainCertWaitChans[name] = call
 	obtainCertWaitChansMu.Unlock()
 
-	unblockWaiters := func() {
+	unblockWaiters := func(cert Certificate, err error) {
 		obtainCertWaitChansMu.Lock()
-		close(wait)
+		call.cert, call.err = cert, err
+		close(call.done)
 		delete(obtainCertWaitChans, name)
 		obtainCertWaitChansMu.Unlock()
 	}
 
+	var limiter OnDemandObtainLimiter
+	if cfg.OnDemand != nil {
+		limiter, _ = cfg.OnDemand.Permission.(OnDemandObtainLimiter)
+	}
+	if limiter != nil {
+		if err := limiter.AllowObtain(ctx, name); err != nil {
+			log.Warn("not obtaining new certificate", zap.String("server_name", name), zap.Error(err))
+			err = fmt.Errorf("obtaining certificate for %s: %w", name, err)
+			unblockWaiters(Certificate{}, err)
+			return Certificate{}, err
+		}
+	}
+
 	log.Info("obtaining new certificate", zap.String("server_name", name))
 
 	// set a timeout so we don't inadvertently hold a client handshake open too long
@@ -533,9 +703,10 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 	defer cancel()
 
 	// obtain the certificate (this puts it in storage) and if successful,
-	// load it from storage so we and any other waiting goroutine can use it
+	// load it from storage so we and any other waiting goroutine can use it;
+	// a client is waiting on this, so it does not wait behind background work
 	var cert Certificate
-	err := cfg.ObtainCertAsync(ctx, name)
+	err := jm.Run(ctx, log, cfg.guard(ctx, "on-demand issuance", func() error { return cfg.ObtainCertAsync(ctx, name) }))
 	if err == nil {
 		// load from storage while others wait to make the op as atomic as possible
 		cert, err = cfg.loadCertFromStorage(ctx, log, hello)
@@ -545,11 +716,41 @@ func (cfg *Config) obtainOnDemandCertificate(ctx context.Context, hello *tls.Cli
 	}
 
 	// immediately unblock anyone waiting for it
-	unblockWaiters()
+	unblockWaiters(cert, err)
 
 	return cert, err
 }
 
+// waitForIssuance waits for the in-flight issuance represented by call to
+// finish, and returns its result. If the issuance failed, the certificate
+// cache is consulted again in case a fallback certificate is available;
+// otherwise the error from the issuance is returned, so that all waiters
+// share the same outcome.
+func (cfg *Config) waitForIssuance(ctx context.Context, hello *tls.ClientHelloInfo, call *issuanceCall, timeoutMsg string) (Certificate, error) {
+	timeout := time.NewTimer(2 * time.Minute)
+	defer timeout.Stop()
+	select {
+	case <-timeout.C:
+		return Certificate{}, errors.New(timeoutMsg)
+	case <-ctx.Done():
+		return Certificate{}, ctx.Err()
+	case <-call.done:
+	}
+
+	if call.err == nil && !call.cert.Empty() {
+		return call.cert, nil
+	}
+
+	// it should now be loaded in the cache, ready to go; if not,
+	// the goroutine in charge of that probably had an error, but
+	// there may still be a fallback or default certificate to use
+	cert, err := cfg.getCertDuringHandshake(ctx, hello, false)
+	if err != nil && call.err != nil {
+		return Certificate{}, call.err
+	}
+	return cert, err
+}
+
 // handshakeMaintenance performs a check on cert for expiration and OCSP validity.
 // If necessary, it will renew the certificate and/or refresh the OCSP staple.
 // OCSP stapling errors are not returned, only logged.
@@ -565,6 +766,11 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 			return cert, fmt.Errorf("leaf certificate is unexpectedly nil: either the Certificate got replaced by an empty value, or it was not properly initialized")
 		}
 		if cfg.certNeedsRenewal(cert.Leaf, cert.ari, true) {
+			if until := cfg.renewalDeferredUntil(cert); !until.IsZero() {
+				logger.Debug("renewal blackout is in effect; serving current certificate",
+					zap.Time("deferred_until", until))
+				return cert, nil
+			}
 			// Check if the certificate still exists on disk. If not, we need to obtain a new one.
 			// This can happen if the certificate was cleaned up by the storage cleaner, but still
 			// remains in the in-memory cache.
@@ -585,11 +791,11 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 			zap.Time("this_update", cert.ocsp.ThisUpdate),
 			zap.Time("next_update", cert.ocsp.NextUpdate))
 
-		err := stapleOCSP(ctx, cfg.OCSP, cfg.Storage, &cert, nil)
+		err := cfg.stapleOCSP(ctx, &cert, nil)
 		if err != nil {
 			// An error with OCSP stapling is not the end of the world, and in fact, is
 			// quite common considering not all certs have issuer URLs that support it.
-			logger.Warn("stapling OCSP", zap.Error(err))
+			cfg.warnStapling(ctx, cert, err)
 		} else {
 			logger.Debug("successfully stapled new OCSP response",
 				zap.Int("ocsp_status", cert.ocsp.Status),
@@ -618,6 +824,7 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 			// (for now, use an unusual timeout to help recognize it in log patterns, if needed)
 			ctx, cancel := context.WithTimeout(context.Background(), 8*time.Minute)
 			defer cancel()
+			defer cfg.recoverPanic(ctx, "ARI update", nil)
 
 			var err error
 			// we ignore the second return value here because we check renewal status below regardless
@@ -635,11 +842,11 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 	// We attempt to replace any certificates that were revoked.
 	// Crucially, this happens OUTSIDE a lock on the certCache.
 	if certShouldBeForceRenewed(cert) {
-		logger.Warn("on-demand certificate's OCSP status is REVOKED; will try to forcefully renew",
-			zap.Int("ocsp_status", cert.ocsp.Status),
-			zap.Time("revoked_at", cert.ocsp.RevokedAt),
-			zap.Time("this_update", cert.ocsp.ThisUpdate),
-			zap.Time("next_update", cert.ocsp.NextUpdate))
+		revokedAt, reason, _ := cert.revocation()
+		logger.Warn("on-demand certificate is REVOKED; will try to forcefully renew",
+			zap.Time("revoked_at", revokedAt),
+			zap.Int("reason", reason),
+			zap.Bool("by_crl", cert.crl != nil))
 		return cfg.renewDynamicCertificate(ctx, hello, cert)
 	}
 
@@ -654,7 +861,7 @@ func (cfg *Config) handshakeMaintenance(ctx context.Context, hello *tls.ClientHe
 // and the renewal will happen in the background; otherwise this blocks until the
 // certificate has been renewed, and returns the renewed certificate.
 //
-// If the certificate's OCSP status (currentCert.ocsp) is Revoked, it will be forcefully
+// If the certificate is revoked according to its OCSP status or CRL, it will be forcefully
 // renewed even if it is not expiring.
 //
 // This function is safe for use by multiple concurrent goroutines.
@@ -663,11 +870,11 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 
 	name := cfg.getNameFromClientHello(hello)
 	timeLeft := time.Until(expiresAt(currentCert.Leaf))
-	revoked := currentCert.ocsp != nil && currentCert.ocsp.Status == ocsp.Revoked
+	revoked := currentCert.Revoked()
 
 	// see if another goroutine is already working on this certificate
 	obtainCertWaitChansMu.Lock()
-	wait, ok := obtainCertWaitChans[name]
+	call, ok := obtainCertWaitChans[name]
 	if ok {
 		// lucky us -- another goroutine is already renewing the certificate
 		obtainCertWaitChansMu.Unlock()
@@ -690,31 +897,27 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 			zap.Time("expired", expiresAt(currentCert.Leaf)),
 			zap.Bool("revoked", revoked))
 
-		// TODO: see if we can get a proper context in here, for true cancellation
-		timeout := time.NewTimer(2 * time.Minute)
-		select {
-		case <-timeout.C:
-			return Certificate{}, fmt.Errorf("timed out waiting for certificate renewal of %s", name)
-		case <-wait:
-			timeout.Stop()
-		}
-
-		// it should now be loaded in the cache, ready to go; if not,
-		// the goroutine in charge of that probably had an error
-		return cfg.getCertDuringHandshake(ctx, hello, false)
+		return cfg.waitForIssuance(ctx, hello, call, fmt.Sprintf("timed out waiting for certificate renewal of %s", name))
 	}
 
 	// looks like it's up to us to do all the work and renew the cert
-	wait = make(chan struct{})
-	obtainCertWaitChans[name] = wait
+	call = &issuanceCall{done: make(chan struct{})}
+	obtainCertWaitChans[name] = call
 	obtainCertWaitChansMu.Unlock()
 
-	unblockWaiters := func() {
-		obtainCertWaitChansMu.Lock()
-		close(wait)
-		delete(obtainCertWaitChans, name)
-		obtainCertWaitChansMu.Unlock()
+	// waiters must be unblocked exactly once, even if the renewal is
+	// dropped or panics before it gets the chance to do so itself
+	var unblockOnce sync.Once
+	unblockWaiters := func(cert Certificate, err error) {
+		unblockOnce.Do(func() {
+			obtainCertWaitChansMu.Lock()
+			call.cert, call.err = cert, err
+			close(call.done)
+			delete(obtainCertWaitChans, name)
+			obtainCertWaitChansMu.Unlock()
+		})
 	}
+	incomplete := fmt.Errorf("renewal of certificate for %s did not complete", name)
 
 	logger = logger.With(
 		zap.String("server_name", name),
@@ -730,12 +933,13 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 
 		// Make sure a certificate for this name should be renewed on-demand
 		err := cfg.checkIfCertShouldBeObtained(ctx, name, true)
+		cfg.addOnDemandDecision(err)
 		if err != nil {
 			// if not, remove from cache (it will be deleted from storage later)
 			cfg.certCache.mu.Lock()
 			cfg.certCache.removeCertificate(currentCert)
 			cfg.certCache.mu.Unlock()
-			unblockWaiters()
+			unblockWaiters(Certificate{}, err)
 
 			if logger != nil {
 				logger.Error("certificate should not be obtained", zap.Error(err))
@@ -761,7 +965,7 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 		// immediately unblock anyone waiting for it; doing this in
 		// a defer would risk deadlock because of the recursive call
 		// to getCertDuringHandshake below when we return!
-		unblockWaiters()
+		unblockWaiters(newCert, err)
 
 		if err != nil {
 			logger.Error("renewing and reloading certificate", zap.String("server_name", name), zap.Error(err))
@@ -772,14 +976,32 @@ func (cfg *Config) renewDynamicCertificate(ctx context.Context, hello *tls.Clien
 
 	// if the certificate hasn't expired, we can serve what we have and renew in the background
 	if timeLeft > 0 {
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
-		go renewAndReload(ctx, cancel)
+		submitted := jm.SubmitPriority(logger, "", jobPriority{deadline: expiresAt(currentCert.Leaf)}, cfg.guard(ctx, "on-demand renewal", func() error {
+			defer unblockWaiters(Certificate{}, incomplete)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+			_, err := renewAndReload(ctx, cancel)
+			return err
+		}))
+		if !submitted {
+			// the queue is full; let the next handshake try again
+			unblockWaiters(currentCert, nil)
+		}
 		return currentCert, nil
 	}
 
 	// otherwise, we have to block while we renew an expired certificate
 	ctx, cancel := context.WithTimeout(ctx, 90*time.Second)
-	return renewAndReload(ctx, cancel)
+	result := make(chan Certificate, 1)
+	err := jm.Run(ctx, logger, cfg.guard(ctx, "on-demand renewal", func() error {
+		defer unblockWaiters(Certificate{}, incomplete)
+		newCert, err := renewAndReload(ctx, cancel)
+		result <- newCert
+		return err
+	}))
+	if err != nil {
+		return Certificate{}, err
+	}
+	return <-result, nil
 }
 
 // getCertFromAnyCertManager gets a certificate from cfg's Managers. If there are no Managers defined, this is
@@ -831,12 +1053,12 @@ func (cfg *Config) getCertFromAnyCertManager(ctx context.Context, hello *tls.Cli
 
 // getTLSALPNChallengeCert is to be called when the clientHello pertains to
 // a TLS-ALPN challenge and a certificate is required to solve it. This method gets
-// the relevant challenge info and then returns the associated certificate (if any)
-// or generates it anew if it's not available (as is the case when distributed
-// solving). True is returned if the challenge is being solved distributed (there
+// the info of the challenge keyed by challengeName (see tlsALPNChallengeName) and
+// then returns the associated certificate (if any) or generates it anew if it's not
+// available (as is the case when distributed solving). True is returned if the challenge is being solved distributed (there
 // is no semantic difference with distributed solving; it is mainly for logging).
-func (cfg *Config) getTLSALPNChallengeCert(clientHello *tls.ClientHelloInfo) (*tls.Certificate, bool, error) {
-	chalData, distributed, err := cfg.getChallengeInfo(clientHello.Context(), clientHello.ServerName)
+func (cfg *Config) getTLSALPNChallengeCert(ctx context.Context, challengeName string) (*tls.Certificate, bool, error) {
+	chalData, distributed, err := cfg.getChallengeInfo(ctx, challengeName)
 	if err != nil {
 		return nil, distributed, err
 	}
@@ -848,7 +1070,7 @@ func (cfg *Config) getTLSALPNChallengeCert(clientHello *tls.ClientHelloInfo) (*t
 	}
 
 	// otherwise, we can re-create the solution certificate, but it takes a few cycles
-	cert, err := acmez.TLSALPN01ChallengeCert(chalData.Challenge)
+	cert, err := tlsALPNChallengeCert(chalData.Challenge)
 	if err != nil {
 		return nil, distributed, fmt.Errorf("making TLS-ALPN challenge certificate: %v", err)
 	}
@@ -910,18 +1132,32 @@ func localIPFromConn(c net.Conn) string {
 // normalizedName returns a cleaned form of serverName that is
 // used for consistency when referring to a SNI value.
 func normalizedName(serverName string) string {
-	return strings.ToLower(strings.TrimSpace(serverName))
+	serverName = strings.TrimSpace(serverName)
+	// hostnames never contain colons, so only check for other kinds of names if necessary
+	if strings.Contains(serverName, ":") && subjectIsIdentity(serverName) {
+		return normalizedIdentity(serverName)
+	}
+	return strings.ToLower(serverName)
+}
+
+// issuanceCall is an in-flight load, obtain, or renewal of a
+// certificate during a handshake, which concurrent handshakes for
+// the same name can wait on and share the result of.
+type issuanceCall struct {
+	done chan struct{} // closed when cert and err are set
+	cert Certificate
+	err  error
 }
 
 // obtainCertWaitChans is used to coordinate obtaining certs for each hostname.
 var (
-	obtainCertWaitChans   = make(map[string]chan struct{})
+	obtainCertWaitChans   = make(map[string]*issuanceCall)
 	obtainCertWaitChansMu sync.Mutex
 )
 
 // TODO: this lockset should probably be per-cache
 var (
-	certLoadWaitChans   = make(map[string]chan struct{})
+	certLoadWaitChans   = make(map[string]*issuanceCall)
 	certLoadWaitChansMu sync.Mutex
 )
 
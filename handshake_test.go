@@ -14,10 +14,28 @@
 package certmagic
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
 	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
 )
 
 func TestGetCertificate(t *testing.T) {
@@ -106,3 +124,429 @@ func TestGetCertificate(t *testing.T) {
 		t.Errorf("Expected IP cert, got: %v", cert)
 	}
 }
+
+// countingIssuer issues self-signed certificates and counts how many
+// times it was asked to issue one.
+type countingIssuer struct {
+	issued atomic.Int32
+	delay  time.Duration
+	err    error // if set, returned instead of a certificate
+}
+
+func (iss *countingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	iss.issued.Add(1)
+	select {
+	case <-time.After(iss.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if iss.err != nil {
+		return nil, iss.err
+	}
+	signer, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	lifetime := 90 * 24 * time.Hour
+	if requested, ok := RequestedLifetime(ctx); ok {
+		lifetime = requested
+	}
+	notBefore := time.Now().Add(-time.Minute)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "counting issuer"},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    notBefore,
+		NotAfter:     notBefore.Add(lifetime),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, csr.PublicKey, signer)
+	if err != nil {
+		return nil, err
+	}
+	return &IssuedCertificate{Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+func (iss *countingIssuer) IssuerKey() string { return "counting" }
+
+func newOnDemandTestConfig(t testing.TB, iss Issuer) *Config {
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           zap.NewNop(),
+	})
+	t.Cleanup(cache.Stop)
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{iss},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnDemand:  &OnDemandConfig{DecisionFunc: func(context.Context, string) error { return nil }},
+		Logger:    zap.NewNop(),
+	})
+	return cfg
+}
+
+func TestOnDemandIssuanceIsCoalesced(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	iss := &countingIssuer{delay: 200 * time.Millisecond}
+	cfg := newOnDemandTestConfig(t, iss)
+
+	const handshakes = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, handshakes)
+	for i := 0; i < handshakes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "coalesce.example.com", Conn: conn})
+			if err == nil && (cert == nil || cert.Leaf == nil) {
+				err = fmt.Errorf("got empty certificate")
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("handshake failed: %v", err)
+		}
+	}
+	if n := iss.issued.Load(); n != 1 {
+		t.Errorf("expected exactly 1 issuance, got %d", n)
+	}
+}
+
+func TestOnDemandIssuanceErrorIsShared(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	iss := &countingIssuer{delay: 200 * time.Millisecond, err: ErrNoRetry{errors.New("failing on purpose")}}
+	cfg := newOnDemandTestConfig(t, iss)
+
+	const handshakes = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, handshakes)
+	for i := 0; i < handshakes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err := cfg.GetCertificateWithContext(ctx, &tls.ClientHelloInfo{ServerName: "fail.example.com", Conn: conn})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "failing on purpose") {
+			t.Errorf("expected error of issuer, got %v", err)
+		}
+	}
+	if n := iss.issued.Load(); n != 1 {
+		t.Errorf("expected exactly 1 issuance attempt, got %d", n)
+	}
+}
+
+type panickingIssuer struct{}
+
+func (panickingIssuer) Issue(context.Context, *x509.CertificateRequest) (*IssuedCertificate, error) {
+	panic("issuer panicked")
+}
+
+// panickingIssuer shares its key with countingIssuer, so it renews its certificates
+func (panickingIssuer) IssuerKey() string { return "counting" }
+
+func TestRenewDynamicCertificateUnblocksWaiters(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, &countingIssuer{})
+	waiting := func(name string) bool {
+		obtainCertWaitChansMu.Lock()
+		defer obtainCertWaitChansMu.Unlock()
+		_, ok := obtainCertWaitChans[name]
+		return ok
+	}
+
+	// a background renewal dropped because the queue is full
+	defer func(orig *jobManager) { jm = orig }(jm)
+	jm = &jobManager{maxConcurrentJobs: 1, maxQueuedJobs: 1}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	jm.Submit(zap.NewNop(), "", func() error { close(started); <-release; return nil })
+	<-started
+	jm.Submit(zap.NewNop(), "", func() error { return nil })
+
+	expiring := Certificate{
+		Names:       []string{"full.example.com"},
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(time.Hour)}},
+	}
+	if cert, err := cfg.renewDynamicCertificate(ctx, &tls.ClientHelloInfo{ServerName: "full.example.com"}, expiring); err != nil || cert.Leaf != expiring.Leaf {
+		t.Errorf("expected current certificate to be served, got %v (err=%v)", cert, err)
+	}
+	if waiting("full.example.com") {
+		t.Error("expected waiters to be unblocked when renewal is dropped")
+	}
+
+	// a renewal that panics
+	jm = &jobManager{maxConcurrentJobs: 1}
+	if err := cfg.ObtainCertSync(ctx, "panic.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Issuers = []Issuer{panickingIssuer{}}
+	revoked := Certificate{
+		Names:       []string{"panic.example.com"},
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{NotAfter: time.Now().Add(-time.Hour)}},
+		ocsp:        &ocsp.Response{Status: ocsp.Revoked},
+	}
+	if _, err := cfg.renewDynamicCertificate(ctx, &tls.ClientHelloInfo{ServerName: "panic.example.com"}, revoked); err == nil {
+		t.Error("expected error from panicking renewal")
+	}
+	if waiting("panic.example.com") {
+		t.Error("expected waiters to be unblocked when renewal panics")
+	}
+}
+
+func BenchmarkOnDemandIssuanceCoalesced(b *testing.B) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	for i := 0; i < b.N; i++ {
+		iss := &countingIssuer{}
+		cfg := newOnDemandTestConfig(b, iss)
+		name := fmt.Sprintf("bench%d.example.com", i)
+
+		var wg sync.WaitGroup
+		for j := 0; j < 50; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _ = cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: name, Conn: conn})
+			}()
+		}
+		wg.Wait()
+		if n := iss.issued.Load(); n != 1 {
+			b.Fatalf("expected exactly 1 issuance, got %d", n)
+		}
+	}
+}
+
+// newBenchmarkConfig returns a config whose cache holds numCerts certificates
+// for distinct names, plus a wildcard certificate for *.wild.example.com.
+func newBenchmarkConfig(numCerts int) *Config {
+	c := &Cache{
+		cache:      make(map[string]Certificate, numCerts+1),
+		cacheIndex: make(map[string][]string, numCerts+1),
+		logger:     zap.NewNop(),
+	}
+	cfg := &Config{Logger: zap.NewNop(), certCache: c}
+	leaf := &x509.Certificate{NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour)}
+	for i := 0; i < numCerts; i++ {
+		name := fmt.Sprintf("host%d.example.com", i)
+		c.unsyncedCacheCertificate(Certificate{
+			Names:       []string{name},
+			hash:        name,
+			Certificate: tls.Certificate{Leaf: leaf},
+		})
+	}
+	c.unsyncedCacheCertificate(Certificate{
+		Names:       []string{"*.wild.example.com"},
+		hash:        "wildcard",
+		Certificate: tls.Certificate{Leaf: leaf},
+	})
+	return cfg
+}
+
+func BenchmarkGetCertificate(b *testing.B) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	for _, numCerts := range []int{100, 100000} {
+		cfg := newBenchmarkConfig(numCerts)
+		for _, tc := range []struct {
+			name       string
+			serverName string
+		}{
+			{name: "exact", serverName: "host42.example.com"},
+			{name: "mixed_case", serverName: "Host42.Example.com"},
+			{name: "wildcard", serverName: "sub.wild.example.com"},
+			{name: "miss", serverName: "nomatch.example.net"},
+		} {
+			hello := &tls.ClientHelloInfo{ServerName: tc.serverName, Conn: conn}
+			b.Run(fmt.Sprintf("%s/certs=%d", tc.name, numCerts), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					_, _ = cfg.GetCertificate(hello)
+				}
+			})
+		}
+	}
+}
+
+// TestGetCertificateAllocations enforces an allocation budget for
+// the handshake path, so that regressions are caught in tests.
+func TestGetCertificateAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	conn, _ := net.Pipe()
+	defer conn.Close()
+
+	cfg := newBenchmarkConfig(1000)
+	for _, tc := range []struct {
+		serverName string
+		budget     float64
+	}{
+		{serverName: "host42.example.com", budget: 3},
+		{serverName: "sub.wild.example.com", budget: 3},
+	} {
+		hello := &tls.ClientHelloInfo{ServerName: tc.serverName, Conn: conn}
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := cfg.GetCertificate(hello); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs > tc.budget {
+			t.Errorf("%s: expected at most %.0f allocations per handshake, got %.0f", tc.serverName, tc.budget, allocs)
+		}
+	}
+}
+
+func TestGetCertificateTLSALPNChallengeIP(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeTLSALPN01,
+		Identifier:       acme.Identifier{Type: "ip", Value: "127.0.0.1"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	activeChallengesMu.Lock()
+	activeChallenges[challengeKey(chal)] = Challenge{Challenge: chal}
+	activeChallengesMu.Unlock()
+	defer func() {
+		activeChallengesMu.Lock()
+		delete(activeChallenges, challengeKey(chal))
+		activeChallengesMu.Unlock()
+	}()
+
+	for _, serverName := range []string{"1.0.0.127.in-addr.arpa", "1.0.0.127.IN-ADDR.ARPA.", ""} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:      serverName,
+			SupportedProtos: []string{acmez.ACMETLS1Protocol},
+			Conn:            conn,
+		}
+		cert, err := cfg.GetCertificate(hello)
+		if err != nil {
+			t.Errorf("SNI %q: unexpected error: %v", serverName, err)
+			continue
+		}
+		if len(cert.Leaf.IPAddresses) != 1 || !cert.Leaf.IPAddresses[0].Equal(net.ParseIP("127.0.0.1")) {
+			t.Errorf("SNI %q: expected challenge certificate for IP, got IPs %v", serverName, cert.Leaf.IPAddresses)
+		}
+	}
+}
+
+func TestGetCertificateMinServingValidity(t *testing.T) {
+	c := &Cache{
+		cache:      make(map[string]Certificate),
+		cacheIndex: make(map[string][]string),
+		logger:     defaultTestLogger,
+	}
+	var events []string
+	cfg := &Config{
+		Logger:             defaultTestLogger,
+		certCache:          c,
+		MinServingValidity: 24 * time.Hour,
+		FallbackServerName: "fallback.example.com",
+		OnEvent: func(_ context.Context, event string, _ map[string]any) error {
+			if event == "cert_validity_low" {
+				events = append(events, event)
+			}
+			return nil
+		},
+	}
+
+	expiring := Certificate{
+		Names: []string{"example.com"},
+		hash:  "expiring",
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{
+			DNSNames: []string{"example.com"},
+			NotAfter: time.Now().Add(time.Hour),
+		}},
+	}
+	fallback := Certificate{
+		Names: []string{"fallback.example.com"},
+		hash:  "fallback",
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{
+			DNSNames: []string{"fallback.example.com"},
+			NotAfter: time.Now().Add(30 * 24 * time.Hour),
+		}},
+	}
+	c.cacheCertificate(expiring)
+	c.cacheCertificate(fallback)
+	hello := &tls.ClientHelloInfo{ServerName: "example.com"}
+	t.Cleanup(func() {
+		lowValidityWarningsMu.Lock()
+		delete(lowValidityWarnings, expiring.hash)
+		lowValidityWarningsMu.Unlock()
+	})
+
+	// by default, the certificate is served with a warning
+	if cert, err := cfg.GetCertificate(hello); err != nil || cert.Leaf.DNSNames[0] != "example.com" {
+		t.Errorf("expected expiring certificate to be served, got %v (err=%v)", cert, err)
+	}
+	if len(events) != 1 {
+		t.Errorf("expected one cert_validity_low event, got %v", events)
+	}
+	// warnings are throttled
+	if _, err := cfg.GetCertificate(hello); err != nil {
+		t.Error(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("expected warning to be throttled, got events %v", events)
+	}
+	// until the interval passed
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	faults.set(lowValidityWarnInterval, false)
+	if _, err := cfg.GetCertificate(hello); err != nil {
+		t.Error(err)
+	}
+	if len(events) != 2 {
+		t.Errorf("expected another warning after the interval, got events %v", events)
+	}
+	faults.set(0, false)
+
+	cfg.LowValidityAction = LowValidityRefuse
+	if cert, err := cfg.GetCertificate(hello); err == nil {
+		t.Errorf("expected handshake to be refused, got %v", cert)
+	}
+
+	cfg.LowValidityAction = LowValidityFallback
+	if cert, err := cfg.GetCertificate(hello); err != nil || cert.Leaf.DNSNames[0] != "fallback.example.com" {
+		t.Errorf("expected fallback certificate, got %v (err=%v)", cert, err)
+	}
+
+	// the fallback certificate must have enough validity, too
+	cfg.MinServingValidity = 60 * 24 * time.Hour
+	if cert, err := cfg.GetCertificate(hello); err == nil {
+		t.Errorf("expected handshake to be refused when fallback certificate has low validity, got %v", cert)
+	}
+
+	// certificates with enough validity are served normally
+	cfg.MinServingValidity = time.Minute
+	if cert, err := cfg.GetCertificate(hello); err != nil || cert.Leaf.DNSNames[0] != "example.com" {
+		t.Errorf("expected certificate to be served, got %v (err=%v)", cert, err)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HealthOptions configures Readiness and Liveness.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HealthOptions struct {
+	// The names that must have a certificate in the cache
+	// for readiness, such as the names passed to ManageSync.
+	// If empty, only the other checks are performed.
+	Names []string
+
+	// Managed certificates with less remaining validity than
+	// this are critical, which fails readiness. Default:
+	// the Config's MinServingValidity if set, otherwise
+	// DefaultCriticalValidity.
+	CriticalValidity time.Duration
+
+	// How late maintenance may be in addition to the renewal
+	// check interval of the cache before it is considered
+	// stalled, which fails liveness.
+	// Default: DefaultMaintenanceGracePeriod.
+	MaintenanceGracePeriod time.Duration
+
+	// How long checking storage may take.
+	// Default: DefaultHealthCheckTimeout.
+	Timeout time.Duration
+}
+
+// Defaults for HealthOptions.
+const (
+	DefaultCriticalValidity       = 72 * time.Hour
+	DefaultMaintenanceGracePeriod = 30 * time.Minute
+	DefaultHealthCheckTimeout     = 10 * time.Second
+)
+
+// HealthReport is the result of Readiness or Liveness.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HealthReport struct {
+	// Whether all checks passed.
+	Healthy bool `json:"healthy"`
+
+	// The checks that were performed, in order.
+	Checks []HealthCheck `json:"checks"`
+}
+
+// HealthCheck is the result of one check of a HealthReport.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HealthCheck struct {
+	// What was checked: "cache", "storage", "expiration",
+	// or "maintenance".
+	Check string `json:"check"`
+
+	Healthy bool `json:"healthy"`
+
+	// What is wrong, if the check failed.
+	Detail string `json:"detail,omitempty"`
+}
+
+func (r *HealthReport) add(check string, problem string) {
+	r.Checks = append(r.Checks, HealthCheck{Check: check, Healthy: problem == "", Detail: problem})
+	r.Healthy = r.Healthy && problem == ""
+}
+
+// Readiness reports whether cfg is ready to serve: the certificates
+// of opts.Names are in the cache, storage can be written to and read
+// from, and no managed certificate in the cache is critically close to
+// expiring. It is meant for readiness probes of Kubernetes and health
+// checks of load balancers, to only send traffic to instances that can
+// serve valid certificates. See also ReadinessHandler.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) Readiness(ctx context.Context, opts HealthOptions) HealthReport {
+	report := HealthReport{Healthy: true}
+
+	var missing []string
+	for _, name := range opts.Names {
+		if len(cfg.certCache.AllMatchingCertificates(cfg.transformSubject(ctx, nil, name))) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	var problem string
+	if len(missing) > 0 {
+		problem = fmt.Sprintf("no certificate in cache for %s", strings.Join(missing, ", "))
+	}
+	report.add("cache", problem)
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+	storageCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	problem = ""
+	if err := cfg.storageRoundTrip(storageCtx); err != nil {
+		problem = fmt.Sprintf("storage: %v", err)
+	}
+	report.add("storage", problem)
+
+	critical := opts.CriticalValidity
+	if critical <= 0 {
+		critical = cfg.MinServingValidity
+	}
+	if critical <= 0 {
+		critical = DefaultCriticalValidity
+	}
+	var expiring []string
+	for _, cert := range cfg.certCache.getAllCerts() {
+		if !cert.managed || cert.Leaf == nil {
+			continue
+		}
+		if expiresAt(cert.Leaf).Sub(timeNow()) < critical {
+			expiring = append(expiring, cert.Names...)
+		}
+	}
+	problem = ""
+	if len(expiring) > 0 {
+		sort.Strings(expiring)
+		problem = fmt.Sprintf("certificates expire within %s: %s", critical, strings.Join(expiring, ", "))
+	}
+	report.add("expiration", problem)
+
+	return report
+}
+
+// Liveness reports whether the certificate maintenance of cfg's cache,
+// which renews certificates and refreshes OCSP staples, is running and
+// not stalled. It is meant for liveness probes of Kubernetes, to restart
+// instances that would otherwise let their certificates expire. See also
+// LivenessHandler.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) Liveness(opts HealthOptions) HealthReport {
+	report := HealthReport{Healthy: true}
+	certCache := cfg.certCache
+
+	grace := opts.MaintenanceGracePeriod
+	if grace <= 0 {
+		grace = DefaultMaintenanceGracePeriod
+	}
+	certCache.optionsMu.RLock()
+	interval := certCache.options.RenewCheckInterval
+	certCache.optionsMu.RUnlock()
+
+	var problem string
+	if !certCache.maintenanceRunning.Load() {
+		problem = "maintenance is not running"
+	} else if beat := time.Unix(0, certCache.maintenanceBeat.Load()); timeNow().Sub(beat) > interval+grace {
+		problem = fmt.Sprintf("maintenance has been stalled since %s", beat.Format(time.RFC3339))
+	}
+	report.add("maintenance", problem)
+
+	return report
+}
+
+// ReadinessHandler returns an HTTP handler for readiness probes that
+// responds with the Readiness report in JSON, and status 200 if it is
+// healthy or 503 otherwise.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) ReadinessHandler(opts HealthOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, cfg.Readiness(r.Context(), opts))
+	})
+}
+
+// LivenessHandler returns an HTTP handler for liveness probes that
+// responds with the Liveness report in JSON, and status 200 if it is
+// healthy or 503 otherwise.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) LivenessHandler(opts HealthOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeHealthReport(w, cfg.Liveness(opts))
+	})
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !report.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestReadiness(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+	opts := HealthOptions{Names: []string{"example.com"}}
+
+	failed := func(report HealthReport) map[string]bool {
+		failed := make(map[string]bool)
+		for _, check := range report.Checks {
+			failed[check.Check] = !check.Healthy
+		}
+		return failed
+	}
+
+	report := cfg.Readiness(ctx, opts)
+	if report.Healthy || !failed(report)["cache"] {
+		t.Errorf("expected readiness to fail without certificate in cache, got %+v", report)
+	}
+	rec := httptest.NewRecorder()
+	cfg.ReadinessHandler(opts).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var decoded HealthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &decoded); err != nil || rec.Code != http.StatusServiceUnavailable || decoded.Healthy {
+		t.Errorf("expected 503 with unhealthy report, got %d: %s (err=%v)", rec.Code, rec.Body, err)
+	}
+
+	if err := cfg.ManageSync(ctx, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if report := cfg.Readiness(ctx, opts); !report.Healthy || len(report.Checks) != 3 {
+		t.Errorf("expected readiness with certificate in cache, got %+v", report)
+	}
+	rec = httptest.NewRecorder()
+	cfg.ReadinessHandler(opts).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// a certificate that is about to expire fails readiness
+	faults.set(89*24*time.Hour, false)
+	if report := cfg.Readiness(ctx, opts); report.Healthy || !failed(report)["expiration"] || failed(report)["cache"] {
+		t.Errorf("expected readiness to fail with expiring certificate, got %+v", report)
+	}
+	if report := cfg.Readiness(ctx, HealthOptions{CriticalValidity: time.Hour}); !report.Healthy {
+		t.Errorf("expected readiness with custom critical validity, got %+v", report)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Logger:           zap.NewNop(),
+	})
+	cfg = New(cache, Config{Logger: zap.NewNop()})
+
+	for i := 0; i < 100 && !cache.maintenanceRunning.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if report := cfg.Liveness(HealthOptions{}); !report.Healthy {
+		t.Errorf("expected liveness while maintenance is running, got %+v", report)
+	}
+
+	faults.set(DefaultRenewCheckInterval+DefaultMaintenanceGracePeriod+time.Minute, false)
+	if report := cfg.Liveness(HealthOptions{}); report.Healthy {
+		t.Errorf("expected liveness to fail when maintenance is stalled, got %+v", report)
+	}
+	faults.set(0, false)
+
+	cache.Stop()
+	rec := httptest.NewRecorder()
+	cfg.LivenessHandler(HealthOptions{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/live", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 after maintenance stopped, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// HSM is a hardware security module or key management service that
+// holds keys which never leave it, such as a PKCS#11 token, AWS KMS, or
+// Google Cloud KMS. It is typically implemented with a PKCS#11 library
+// such as crypto11, or the SDK of the service, which certmagic does not
+// depend on; they already provide crypto.Signers for their keys.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HSM interface {
+	// CreateKey creates a new key of the given type and returns
+	// its ID, which identifies the key in the HSM, such as a
+	// PKCS#11 URI or the resource name of a KMS key version.
+	CreateKey(ctx context.Context, keyType KeyType) (keyID string, err error)
+
+	// Signer returns a signer for the key with the given ID,
+	// which signs with the key inside the HSM.
+	Signer(ctx context.Context, keyID string) (crypto.Signer, error)
+}
+
+// HSMKeyPEMType is the PEM block type of keys held by an HSM; the
+// block contains the name the HSM is registered with, and the key ID.
+const HSMKeyPEMType = "CERTMAGIC HSM KEY"
+
+// HSMKeySource is a KeyGenerator that generates keys inside an HSM. It
+// can be used as a Config's KeySource, and as an ACMEIssuer's
+// AccountKeySource; like for TPMKeySource, only the IDs of the keys are
+// stored, so the cache holds signers that use the HSM rather than the
+// private keys themselves. To load the keys, the HSM must be registered
+// under the same name with RegisterHSM before certificates or accounts
+// are loaded.
+//
+// Keys are not deleted from the HSM when their certificates are
+// replaced or deleted.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HSMKeySource struct {
+	// The HSM in which to generate keys. Required.
+	HSM HSM
+
+	// The name the HSM is registered with.
+	// Default: "default".
+	Name string
+
+	// The type of keys to generate. Default: P256.
+	KeyType KeyType
+}
+
+// GenerateKey generates a new *HSMKey.
+func (ks HSMKeySource) GenerateKey() (crypto.PrivateKey, error) {
+	keyType := ks.KeyType
+	if keyType == "" {
+		keyType = P256
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	keyID, err := ks.HSM.CreateKey(ctx, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("creating key in HSM: %v", err)
+	}
+	return NewHSMKey(ctx, ks.HSM, hsmName(ks.Name), keyID)
+}
+
+var (
+	hsms           = make(map[string]HSM)
+	hsmsMu         sync.RWMutex
+	hsmDecoderOnce sync.Once
+)
+
+// RegisterHSM registers hsm under name, for loading the keys of
+// HSMKeySources with the same name from storage. Several HSMs can
+// be registered under different names; an empty name is "default".
+//
+// EXPERIMENTAL: Subject to change or removal.
+func RegisterHSM(name string, hsm HSM) {
+	hsmsMu.Lock()
+	hsms[hsmName(name)] = hsm
+	hsmsMu.Unlock()
+	hsmDecoderOnce.Do(func() {
+		RegisterPrivateKeyDecoder(HSMKeyPEMType, func(der []byte) (crypto.Signer, error) {
+			return ParseHSMKey(der)
+		})
+	})
+}
+
+func hsmName(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return name
+}
+
+// HSMKey is a private key held by an HSM. It implements
+// crypto.Signer and PEMPrivateKey.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type HSMKey struct {
+	signer crypto.Signer
+	name   string
+	id     string
+}
+
+// NewHSMKey returns the key with the given ID in hsm, which
+// is registered under name.
+func NewHSMKey(ctx context.Context, hsm HSM, name, keyID string) (*HSMKey, error) {
+	signer, err := hsm.Signer(ctx, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("loading key %s from HSM %s: %v", keyID, name, err)
+	}
+	return &HSMKey{signer: signer, name: name, id: keyID}, nil
+}
+
+// ParseHSMKey parses the contents of a HSMKeyPEMType PEM block,
+// using the registered HSM it names.
+func ParseHSMKey(der []byte) (*HSMKey, error) {
+	var ref hsmKeyRef
+	rest, err := asn1.Unmarshal(der, &ref)
+	if err != nil {
+		return nil, fmt.Errorf("decoding HSM key: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("decoding HSM key: trailing data")
+	}
+	hsmsMu.RLock()
+	hsm, ok := hsms[ref.HSM]
+	hsmsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("HSM %s of key %s is not registered", ref.HSM, ref.KeyID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return NewHSMKey(ctx, hsm, ref.HSM, ref.KeyID)
+}
+
+// Public implements crypto.Signer.
+func (k *HSMKey) Public() crypto.PublicKey { return k.signer.Public() }
+
+// Sign implements crypto.Signer. Whether the rand argument
+// is used depends on the HSM.
+func (k *HSMKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.signer.Sign(rand, digest, opts)
+}
+
+// HSM returns the name the HSM of the key is registered with.
+func (k *HSMKey) HSM() string { return k.name }
+
+// ID returns the key ID of the key.
+func (k *HSMKey) ID() string { return k.id }
+
+// MarshalPEM implements PEMPrivateKey.
+func (k *HSMKey) MarshalPEM() (*pem.Block, error) {
+	der, err := asn1.Marshal(hsmKeyRef{HSM: k.name, KeyID: k.id})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: HSMKeyPEMType, Bytes: der}, nil
+}
+
+// hsmKeyRef is the ASN.1 structure of HSMKeyPEMType blocks.
+type hsmKeyRef struct {
+	HSM   string `asn1:"utf8"`
+	KeyID string `asn1:"utf8"`
+}
+
+// Interface guards
+var (
+	_ KeyGenerator  = HSMKeySource{}
+	_ PEMPrivateKey = (*HSMKey)(nil)
+)
@@ -0,0 +1,158 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// softHSM is an HSM that keeps its keys in memory.
+type softHSM struct {
+	mu   sync.Mutex
+	keys map[string]crypto.Signer
+}
+
+func (sh *softHSM) CreateKey(_ context.Context, keyType KeyType) (string, error) {
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if sh.keys == nil {
+		sh.keys = make(map[string]crypto.Signer)
+	}
+	id := fmt.Sprintf("pkcs11:object=key-%d", len(sh.keys)+1)
+	sh.keys[id] = key.(crypto.Signer)
+	return id, nil
+}
+
+func (sh *softHSM) Signer(_ context.Context, keyID string) (crypto.Signer, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	key, ok := sh.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("no key with ID %s", keyID)
+	}
+	return key, nil
+}
+
+func TestHSMKey(t *testing.T) {
+	hsm1, hsm2 := new(softHSM), new(softHSM)
+	RegisterHSM("", hsm1)
+	RegisterHSM("second", hsm2)
+
+	privKey, err := HSMKeySource{HSM: hsm1}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := privKey.(*HSMKey)
+	if key.HSM() != "default" || key.ID() != "pkcs11:object=key-1" {
+		t.Errorf("expected key-1 in default HSM, got %s in %s", key.ID(), key.HSM())
+	}
+	if _, ok := key.Public().(*ecdsa.PublicKey); !ok {
+		t.Errorf("expected P-256 key by default, got %T", key.Public())
+	}
+
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(keyPEM); block == nil || block.Type != HSMKeyPEMType {
+		t.Fatalf("expected %s PEM block, got %q", HSMKeyPEMType, keyPEM)
+	}
+	decoded, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("decoding HSM key: %v", err)
+	}
+	loaded := decoded.(*HSMKey)
+	if loaded.ID() != key.ID() || loaded.HSM() != key.HSM() {
+		t.Errorf("expected decoded key to be %s in %s, got %s in %s", key.ID(), key.HSM(), loaded.ID(), loaded.HSM())
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := loaded.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(key.Public().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Error("expected valid signature")
+	}
+
+	// keys are loaded from the HSM they were created in
+	rsaKey, err := HSMKeySource{HSM: hsm2, Name: "second", KeyType: RSA2048}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err = PEMEncodePrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(keyPEM, []byte("RSA PRIVATE KEY")) {
+		t.Error("expected only the key ID to be encoded")
+	}
+	decoded, err = PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("decoding HSM key: %v", err)
+	}
+	if _, ok := decoded.Public().(*rsa.PublicKey); !ok || decoded.(*HSMKey).HSM() != "second" {
+		t.Errorf("expected RSA key from second HSM, got %T", decoded.Public())
+	}
+
+	unregistered, err := (&HSMKey{name: "unregistered", id: "key"}).MarshalPEM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PEMDecodePrivateKey(pem.EncodeToMemory(unregistered)); err == nil {
+		t.Error("expected error for key of unregistered HSM")
+	}
+}
+
+func TestHSMKeyManagedCertificate(t *testing.T) {
+	ctx := context.Background()
+	hsm := new(softHSM)
+	RegisterHSM("managed", hsm)
+
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.KeySource = HSMKeySource{HSM: hsm, Name: "managed"}
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatalf("obtaining certificate: %v", err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("loading certificate: %v", err)
+	}
+	if _, ok := cert.Certificate.PrivateKey.(*HSMKey); !ok {
+		t.Errorf("expected HSM key, got %T", cert.Certificate.PrivateKey)
+	}
+
+	am := &ACMEIssuer{AccountKeySource: HSMKeySource{HSM: hsm, Name: "managed"}}
+	account, err := am.newAccount("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := account.PrivateKey.(*HSMKey); !ok {
+		t.Errorf("expected HSM account key, got %T", account.PrivateKey)
+	}
+}
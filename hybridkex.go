@@ -0,0 +1,23 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.24
+
+package certmagic
+
+import "crypto/tls"
+
+// hybridCurvePreferences are the post-quantum hybrid key
+// exchanges that are preferred over the classical ones.
+var hybridCurvePreferences = []tls.CurveID{tls.X25519MLKEM768}
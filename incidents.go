@@ -0,0 +1,250 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IncidentFeed is a source of notices about CA incidents, such as mass
+// revocations, which FollowIncidentFeed polls to flag or automatically
+// reissue the affected certificates.
+//
+// By default, the feed is a JSON object with an "incidents" array of
+// IncidentNotice objects, typically served by an endpoint the operator
+// controls. Other feeds, such as the status API of a CA, can be used
+// by setting Parse.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type IncidentFeed struct {
+	// The URL of the feed. Required.
+	URL string
+
+	// How often to poll the feed.
+	// Default: DefaultIncidentFeedPollInterval.
+	PollInterval time.Duration
+
+	// The HTTP client to poll the feed with.
+	// Default: a client with a 30s timeout.
+	HTTPClient *http.Client
+
+	// Optionally, parses the body of the feed into notices,
+	// for feeds that are not in the default format.
+	Parse func(body []byte) ([]IncidentNotice, error)
+
+	// If true, affected certificates are reissued with
+	// MassReissue; otherwise, they are only flagged by
+	// logging and emitting the ca_incident event.
+	AutoReissue bool
+
+	// Options for reissuing the affected certificates of each
+	// notice with AutoReissue. ID and Criteria are overridden
+	// by the notice.
+	ReissueOptions MassReissueOptions
+}
+
+// IncidentNotice is a CA incident as reported by an IncidentFeed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type IncidentNotice struct {
+	// The unique ID of the incident. Required.
+	ID string `json:"id"`
+
+	// A description of the incident, and where to find out more.
+	Title string `json:"title,omitempty"`
+	URL   string `json:"url,omitempty"`
+
+	// Which certificates are affected.
+	Criteria ReissueCriteria `json:"criteria"`
+}
+
+// incidentFeedResponse is the default format of incident feeds.
+type incidentFeedResponse struct {
+	Incidents []IncidentNotice `json:"incidents"`
+}
+
+// FollowIncidentFeed polls feed until ctx is canceled, and handles each
+// new notice: if any managed certificates in the cache are affected,
+// they are flagged, and, if feed.AutoReissue is enabled, reissued with
+// MassReissue under the ID "incident_" plus the ID of the notice. The
+// notices that were handled are recorded in storage so that, after a
+// restart, they are not handled again, except that reissuances which
+// did not finish are continued. It blocks, so it is typically run in
+// its own goroutine; errors polling the feed are logged, not returned.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) FollowIncidentFeed(ctx context.Context, feed IncidentFeed) error {
+	interval := feed.PollInterval
+	if interval <= 0 {
+		interval = DefaultIncidentFeedPollInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := cfg.PollIncidentFeed(ctx, feed); err != nil {
+			cfg.Logger.Error("polling CA incident feed",
+				zap.String("url", feed.URL),
+				zap.Error(err))
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// PollIncidentFeed polls feed once and handles its new notices,
+// as FollowIncidentFeed does.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) PollIncidentFeed(ctx context.Context, feed IncidentFeed) error {
+	notices, err := feed.fetch(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, notice := range notices {
+		if err := cfg.handleIncidentNotice(ctx, feed, notice); err != nil {
+			errs = append(errs, fmt.Errorf("incident %s: %w", notice.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (feed IncidentFeed) fetch(ctx context.Context) ([]IncidentNotice, error) {
+	client := feed.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return nil, err
+	}
+	if feed.Parse != nil {
+		return feed.Parse(body)
+	}
+	var feedResp incidentFeedResponse
+	if err := json.Unmarshal(body, &feedResp); err != nil {
+		return nil, fmt.Errorf("decoding incident feed: %v", err)
+	}
+	return feedResp.Incidents, nil
+}
+
+func (cfg *Config) handleIncidentNotice(ctx context.Context, feed IncidentFeed, notice IncidentNotice) error {
+	if notice.ID == "" {
+		return fmt.Errorf("missing ID")
+	}
+	if notice.Criteria.empty() {
+		return fmt.Errorf("no criteria")
+	}
+	reissueID := "incident_" + notice.ID
+
+	seen := cfg.Storage.Exists(ctx, StorageKeys.Incident(notice.ID))
+	if seen {
+		if !feed.AutoReissue {
+			return nil
+		}
+		// continue a reissuance that was interrupted or had failures
+		status, err := cfg.LoadMassReissueStatus(ctx, reissueID)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // no certificates were affected
+		}
+		if err != nil {
+			return err
+		}
+		if status.Done() {
+			return nil
+		}
+	}
+
+	var affected []string
+	for _, cert := range cfg.certCache.getAllCerts() {
+		if cert.managed && len(cert.Names) > 0 && notice.Criteria.Matches(cert) {
+			affected = append(affected, cert.Names[0])
+		}
+	}
+	if !seen && len(affected) > 0 {
+		cfg.Logger.Warn("certificates are affected by CA incident",
+			zap.String("incident", notice.ID),
+			zap.String("title", notice.Title),
+			zap.String("url", notice.URL),
+			zap.Strings("identifiers", affected),
+			zap.Bool("reissue", feed.AutoReissue))
+		cfg.emit(ctx, "ca_incident", map[string]any{
+			"id":          notice.ID,
+			"title":       notice.Title,
+			"url":         notice.URL,
+			"identifiers": affected,
+			"reissue":     feed.AutoReissue,
+		})
+	}
+
+	var err error
+	if feed.AutoReissue && len(affected) > 0 {
+		opts := feed.ReissueOptions
+		opts.ID = reissueID
+		opts.Criteria = notice.Criteria
+		_, err = cfg.MassReissue(ctx, opts)
+	}
+
+	// record the notice once the reissuance, if any, has persisted its
+	// progress, so that it is continued if it did not finish
+	if !seen && (err == nil || cfg.Storage.Exists(ctx, StorageKeys.MassReissue(reissueID))) {
+		noticeJSON, jsonErr := json.MarshalIndent(notice, "", "\t")
+		if jsonErr != nil {
+			return errors.Join(err, jsonErr)
+		}
+		if storeErr := cfg.Storage.Store(context.WithoutCancel(ctx), StorageKeys.Incident(notice.ID), noticeJSON); storeErr != nil {
+			return errors.Join(err, fmt.Errorf("recording incident: %v", storeErr))
+		}
+	}
+	return err
+}
+
+// Incident returns the storage key for the record of
+// the CA incident notice with the given ID.
+func (keys KeyBuilder) Incident(id string) string {
+	return path.Join(prefixIncidents, keys.Safe(id)+".json")
+}
+
+const prefixIncidents = "incidents"
+
+// DefaultIncidentFeedPollInterval is how often
+// FollowIncidentFeed polls feeds by default.
+const DefaultIncidentFeedPollInterval = time.Hour
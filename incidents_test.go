@@ -0,0 +1,128 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestPollIncidentFeed(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+	var (
+		mu        sync.Mutex
+		incidents []map[string]any
+	)
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "ca_incident" {
+			mu.Lock()
+			incidents = append(incidents, data)
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	original := make(map[string]Certificate)
+	for _, name := range []string{"a.example.com", "b.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := cfg.CacheManagedCertificate(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original[name] = cert
+	}
+
+	var notices []IncidentNotice
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"incidents": notices})
+	}))
+	defer srv.Close()
+
+	// without AutoReissue, affected certificates are only flagged, once
+	notices = []IncidentNotice{{
+		ID:       "flagged",
+		Title:    "Mis-issuance",
+		Criteria: ReissueCriteria{Serials: []string{original["a.example.com"].Leaf.SerialNumber.Text(16)}},
+	}}
+	feed := IncidentFeed{URL: srv.URL}
+	for i := 0; i < 2; i++ {
+		if err := cfg.PollIncidentFeed(ctx, feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(incidents) != 1 || incidents[0]["id"] != "flagged" ||
+		!slices.Equal(incidents[0]["identifiers"].([]string), []string{"a.example.com"}) {
+		t.Errorf("expected a.example.com to be flagged once, got %v", incidents)
+	}
+	if cert := cfg.certCache.AllMatchingCertificates("a.example.com")[0]; cert.hash != original["a.example.com"].hash {
+		t.Error("expected flagged certificate not to be reissued")
+	}
+
+	// with AutoReissue, affected certificates are reissued, once
+	notices = append(notices, IncidentNotice{
+		ID:       "revoked",
+		Criteria: ReissueCriteria{Serials: []string{original["b.example.com"].Leaf.SerialNumber.Text(16)}},
+	})
+	var reissued []string
+	feed.AutoReissue = true
+	feed.ReissueOptions.Progress = func(p MassReissueProgress) { reissued = append(reissued, p.Name) }
+	for i := 0; i < 2; i++ {
+		if err := cfg.PollIncidentFeed(ctx, feed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !slices.Equal(reissued, []string{"b.example.com"}) {
+		t.Errorf("expected b.example.com to be reissued once, got %v", reissued)
+	}
+	if cert := cfg.certCache.AllMatchingCertificates("b.example.com")[0]; cert.hash == original["b.example.com"].hash {
+		t.Error("expected affected certificate to be reissued")
+	}
+	if status, err := cfg.LoadMassReissueStatus(ctx, "incident_revoked"); err != nil || !status.Done() {
+		t.Errorf("expected finished reissuance, got %+v (err=%v)", status, err)
+	}
+	if len(incidents) != 2 {
+		t.Errorf("expected 2 incidents to be flagged, got %d", len(incidents))
+	}
+}
+
+func TestIncidentFeedParse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("custom"))
+	}))
+	defer srv.Close()
+
+	feed := IncidentFeed{
+		URL: srv.URL,
+		Parse: func(body []byte) ([]IncidentNotice, error) {
+			return []IncidentNotice{{ID: string(body)}}, nil
+		},
+	}
+	notices, err := feed.fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notices) != 1 || notices[0].ID != "custom" {
+		t.Errorf("expected notice from custom parser, got %v", notices)
+	}
+}
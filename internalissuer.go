@@ -0,0 +1,538 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InternalIssuer is an Issuer that signs certificates with its own
+// private CA, for internal names and for mTLS between services, where
+// publicly-trusted certificates are not needed or not possible. The CA
+// has a root, which clients must trust, and an intermediate, which signs
+// certificates and is renewed automatically; both are kept in Storage,
+// so that all instances sharing it use the same CA.
+//
+// With NameConstraints, the intermediate is constrained to the permitted
+// names, so that clients reject certificates for other names even if
+// the CA is misused, and requests for other names are refused.
+//
+// The root can be rotated without a flag day with RotateRoot; the
+// consumers of the CA get the roots to trust with InternalTrust.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type InternalIssuer struct {
+	// The storage in which the CA is kept. Required.
+	Storage Storage
+
+	// The name of the CA, so that several CAs can share
+	// the same storage. Default: "local".
+	CA string
+
+	// The validity period of issued certificates, unless
+	// the config requests a lifetime (see RequestedLifetime)
+	// or the certificate template defines one.
+	// Default: DefaultInternalCertLifetime.
+	Lifetime time.Duration
+
+	// The validity periods of the root and intermediate
+	// certificates of the CA; the intermediate is renewed
+	// when a third of its validity period remains.
+	// Default: DefaultInternalRootLifetime and
+	// DefaultInternalIntermediateLifetime.
+	RootLifetime         time.Duration
+	IntermediateLifetime time.Duration
+
+	// If set, only certificates for these names are issued,
+	// and the intermediate is constrained to them.
+	NameConstraints *NameConstraints
+
+	// Templates for certificates, by name. The template of an
+	// issuance is the one selected by WithCertificateTemplate,
+	// else the one returned by SelectTemplate, else
+	// DefaultTemplate. If no template is selected, certificates
+	// are for server and client authentication.
+	Templates       map[string]*CertificateTemplate
+	DefaultTemplate string
+
+	// Optionally selects the name of the template for a
+	// certificate for names; if it returns "", the default
+	// template is used.
+	SelectTemplate func(ctx context.Context, names []string) string
+
+	mu           sync.Mutex
+	root         *x509.Certificate
+	intermediate *x509.Certificate
+	signer       crypto.Signer // the key of the intermediate
+
+	nextActivation time.Time // when the next root activates, if scheduled
+}
+
+// Defaults for InternalIssuer.
+const (
+	DefaultInternalCertLifetime         = 12 * time.Hour
+	DefaultInternalIntermediateLifetime = 7 * 24 * time.Hour
+	DefaultInternalRootLifetime         = 10 * 365 * 24 * time.Hour
+)
+
+// NameConstraints restrict the names for which a CA can issue
+// certificates, as defined by RFC 5280 §4.2.1.10. Domains permit
+// themselves and their subdomains, unless they begin with a dot,
+// in which case they only permit their subdomains. Email constraints
+// are mailboxes, or domains of mailboxes; URI constraints are domains
+// of URI hosts.
+//
+// Names of a type are permitted if there are no permitted subtrees
+// of that type, or if they are within one; excluded subtrees take
+// precedence.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type NameConstraints struct {
+	PermittedDNSDomains     []string     `json:"permitted_dns_domains,omitempty"`
+	ExcludedDNSDomains      []string     `json:"excluded_dns_domains,omitempty"`
+	PermittedIPRanges       []*net.IPNet `json:"-"`
+	ExcludedIPRanges        []*net.IPNet `json:"-"`
+	PermittedEmailAddresses []string     `json:"permitted_email_addresses,omitempty"`
+	ExcludedEmailAddresses  []string     `json:"excluded_email_addresses,omitempty"`
+	PermittedURIDomains     []string     `json:"permitted_uri_domains,omitempty"`
+	ExcludedURIDomains      []string     `json:"excluded_uri_domains,omitempty"`
+}
+
+// Check returns an error if any of names is not permitted. Names are
+// subjects as managed by certmagic: hostnames, IP addresses, email
+// addresses, and URIs; otherName subjects are not constrained.
+func (nc *NameConstraints) Check(names []string) error {
+	if nc == nil {
+		return nil
+	}
+	for _, name := range names {
+		if err := nc.check(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nc *NameConstraints) check(name string) error {
+	notPermitted := func(kind string) error {
+		return fmt.Errorf("%s %s is not permitted by the name constraints of the CA", kind, name)
+	}
+	if _, _, ok := ParseOtherNameSubject(name); ok {
+		return nil
+	}
+	if SubjectIsURI(name) {
+		u, err := url.Parse(name)
+		if err != nil {
+			return err
+		}
+		host := strings.ToLower(u.Hostname())
+		if (host == "" && len(nc.PermittedURIDomains) > 0) ||
+			!subtreesPermit(nc.PermittedURIDomains, nc.ExcludedURIDomains, host, matchDomainConstraint) {
+			return notPermitted("URI")
+		}
+		return nil
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		matchIP := func(ipNet *net.IPNet) bool { return ipNet.Contains(ip) }
+		if len(nc.PermittedIPRanges) > 0 && !slices.ContainsFunc(nc.PermittedIPRanges, matchIP) ||
+			slices.ContainsFunc(nc.ExcludedIPRanges, matchIP) {
+			return notPermitted("IP address")
+		}
+		return nil
+	}
+	if strings.Contains(name, "@") {
+		if !subtreesPermit(nc.PermittedEmailAddresses, nc.ExcludedEmailAddresses, strings.ToLower(name), matchEmailConstraint) {
+			return notPermitted("email address")
+		}
+		return nil
+	}
+	// a wildcard covers subdomains, which must all be permitted
+	host := strings.ToLower(strings.TrimSuffix(name, "."))
+	if !subtreesPermit(nc.PermittedDNSDomains, nc.ExcludedDNSDomains, host, matchDomainConstraint) ||
+		(strings.HasPrefix(host, "*.") && slices.ContainsFunc(nc.ExcludedDNSDomains, func(excluded string) bool {
+			return matchDomainConstraint(strings.TrimPrefix(strings.ToLower(excluded), "."), strings.TrimPrefix(host, "*."))
+		})) {
+		return notPermitted("name")
+	}
+	return nil
+}
+
+// subtreesPermit returns true if name is within one of the permitted
+// subtrees, if there are any, and within none of the excluded ones.
+func subtreesPermit(permitted, excluded []string, name string, match func(name, constraint string) bool) bool {
+	matches := func(constraint string) bool { return match(name, strings.ToLower(constraint)) }
+	return (len(permitted) == 0 || slices.ContainsFunc(permitted, matches)) && !slices.ContainsFunc(excluded, matches)
+}
+
+// matchDomainConstraint returns true if the domain name is within
+// the subtree of the domain constraint.
+func matchDomainConstraint(name, constraint string) bool {
+	if constraint == "" {
+		return true
+	}
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// matchEmailConstraint returns true if the email address is
+// within the subtree of the email constraint.
+func matchEmailConstraint(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return email == constraint
+	}
+	_, domain, _ := strings.Cut(email, "@")
+	return matchDomainConstraint(domain, constraint)
+}
+
+// apply sets the name constraints on the template of a CA certificate.
+func (nc *NameConstraints) apply(tpl *x509.Certificate) {
+	if nc == nil {
+		return
+	}
+	// RFC 5280: conforming CAs MUST mark this extension as critical
+	tpl.PermittedDNSDomainsCritical = true
+	tpl.PermittedDNSDomains = nc.PermittedDNSDomains
+	tpl.ExcludedDNSDomains = nc.ExcludedDNSDomains
+	tpl.PermittedIPRanges = nc.PermittedIPRanges
+	tpl.ExcludedIPRanges = nc.ExcludedIPRanges
+	tpl.PermittedEmailAddresses = nc.PermittedEmailAddresses
+	tpl.ExcludedEmailAddresses = nc.ExcludedEmailAddresses
+	tpl.PermittedURIDomains = nc.PermittedURIDomains
+	tpl.ExcludedURIDomains = nc.ExcludedURIDomains
+}
+
+// appliedTo returns true if cert has exactly these name constraints.
+func (nc *NameConstraints) appliedTo(cert *x509.Certificate) bool {
+	var want x509.Certificate
+	nc.apply(&want)
+	ipNetStrings := func(ipNets []*net.IPNet) []string {
+		var s []string
+		for _, ipNet := range ipNets {
+			s = append(s, ipNet.String())
+		}
+		return s
+	}
+	return slices.Equal(want.PermittedDNSDomains, cert.PermittedDNSDomains) &&
+		slices.Equal(want.ExcludedDNSDomains, cert.ExcludedDNSDomains) &&
+		slices.Equal(ipNetStrings(want.PermittedIPRanges), ipNetStrings(cert.PermittedIPRanges)) &&
+		slices.Equal(ipNetStrings(want.ExcludedIPRanges), ipNetStrings(cert.ExcludedIPRanges)) &&
+		slices.Equal(want.PermittedEmailAddresses, cert.PermittedEmailAddresses) &&
+		slices.Equal(want.ExcludedEmailAddresses, cert.ExcludedEmailAddresses) &&
+		slices.Equal(want.PermittedURIDomains, cert.PermittedURIDomains) &&
+		slices.Equal(want.ExcludedURIDomains, cert.ExcludedURIDomains)
+}
+
+// IssuerKey returns the unique issuer key for the CA.
+func (iss *InternalIssuer) IssuerKey() string {
+	if iss.CA != "" {
+		return "internal_" + StorageKeys.Safe(iss.CA)
+	}
+	return "internal"
+}
+
+// PreCheck returns an error if any of names is not permitted by
+// the name constraints of the CA or by the certificate template.
+func (iss *InternalIssuer) PreCheck(ctx context.Context, names []string, _ bool) error {
+	_, err := iss.checkNames(ctx, names)
+	return err
+}
+
+// checkNames returns the certificate template for names, or an
+// error if they are not permitted.
+func (iss *InternalIssuer) checkNames(ctx context.Context, names []string) (*CertificateTemplate, error) {
+	if err := iss.NameConstraints.Check(names); err != nil {
+		return nil, err
+	}
+	certTpl, err := iss.template(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	if err := certTpl.check(names); err != nil {
+		return nil, err
+	}
+	return certTpl, nil
+}
+
+// Issue signs a certificate for the names in csr with the intermediate
+// of the CA, and returns it with the intermediate. Requests for names
+// that are not permitted by the name constraints or by the certificate
+// template are refused.
+func (iss *InternalIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	names := namesFromCSR(csr)
+	if csr.Subject.CommonName != "" {
+		// the common name comes first, and is not copied to the certificate
+		names = names[1:]
+	}
+	certTpl, err := iss.checkNames(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+	intermediate, signer, err := iss.loadCA(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lifetime := iss.certLifetime()
+	if requested, ok := RequestedLifetime(ctx); ok {
+		lifetime = requested
+	}
+	if certTpl.Lifetime > 0 {
+		lifetime = certTpl.Lifetime
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	notBefore := timeNow().Add(-time.Minute).Truncate(time.Second)
+	notAfter := notBefore.Add(lifetime)
+	if notAfter.After(intermediate.NotAfter) {
+		notAfter = intermediate.NotAfter
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:   serial,
+		DNSNames:       csr.DNSNames,
+		IPAddresses:    csr.IPAddresses,
+		EmailAddresses: csr.EmailAddresses,
+		URIs:           csr.URIs,
+		NotBefore:      notBefore,
+		NotAfter:       notAfter,
+	}
+	certTpl.apply(tpl, names, csr.PublicKey)
+	// otherName SANs are only in the extension
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) && len(otherNamesFromExtensions([]pkix.Extension{ext})) > 0 {
+			tpl.ExtraExtensions = append(tpl.ExtraExtensions, ext)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, intermediate, csr.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("signing certificate: %v", err)
+	}
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Raw})...)
+	return &IssuedCertificate{Certificate: chain}, nil
+}
+
+// RootCertificate returns the root certificate of the CA, which
+// clients must trust. The CA is created if it does not exist.
+func (iss *InternalIssuer) RootCertificate(ctx context.Context) (*x509.Certificate, error) {
+	if _, _, err := iss.loadCA(ctx); err != nil {
+		return nil, err
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	return iss.root, nil
+}
+
+// loadCA returns the current intermediate of the CA and its key,
+// loading them from storage, or creating or renewing them as needed.
+func (iss *InternalIssuer) loadCA(ctx context.Context) (*x509.Certificate, crypto.Signer, error) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	if iss.intermediate != nil && !iss.intermediateDue(iss.intermediate) &&
+		(iss.nextActivation.IsZero() || timeNow().Before(iss.nextActivation)) {
+		return iss.intermediate, iss.signer, nil
+	}
+
+	lockKey := "internal_ca_" + iss.caName()
+	if err := acquireLock(ctx, iss.Storage, lockKey); err != nil {
+		return nil, nil, fmt.Errorf("acquiring CA lock: %v", err)
+	}
+	defer releaseLock(ctx, iss.Storage, lockKey)
+
+	root, rootKey, nextActivation, err := iss.activeRoot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	intermediate, signer, err := iss.loadKeyPair(ctx, "intermediate")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	if intermediate == nil || iss.intermediateDue(intermediate) || intermediate.CheckSignatureFrom(root) != nil {
+		tpl := &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "Certmagic " + iss.caName() + " Intermediate CA"},
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			MaxPathLenZero:        true,
+		}
+		iss.NameConstraints.apply(tpl)
+		intermediate, signer, err = iss.createCA(ctx, "intermediate", tpl, iss.intermediateLifetime(), root, rootKey)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	iss.root, iss.intermediate, iss.signer = root, intermediate, signer
+	iss.nextActivation = nextActivation
+	return intermediate, signer, nil
+}
+
+// intermediateDue returns true if the intermediate must be replaced,
+// because a third of its validity period remains or because its
+// name constraints do not match the configured ones.
+func (iss *InternalIssuer) intermediateDue(intermediate *x509.Certificate) bool {
+	lifetime := intermediate.NotAfter.Sub(intermediate.NotBefore)
+	return timeNow().After(intermediate.NotAfter.Add(-lifetime/3)) || !iss.NameConstraints.appliedTo(intermediate)
+}
+
+func (iss *InternalIssuer) loadOrCreateRoot(ctx context.Context) (*x509.Certificate, crypto.Signer, error) {
+	root, rootKey, err := iss.loadKeyPair(ctx, "root")
+	if err == nil {
+		return root, rootKey, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, err
+	}
+	return iss.createRoot(ctx, "root", "Certmagic "+iss.caName()+" Root CA")
+}
+
+// createRoot creates and stores a root certificate with the given name.
+func (iss *InternalIssuer) createRoot(ctx context.Context, name, commonName string) (*x509.Certificate, crypto.Signer, error) {
+	lifetime := iss.RootLifetime
+	if lifetime <= 0 {
+		lifetime = DefaultInternalRootLifetime
+	}
+	tpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return iss.createCA(ctx, name, tpl, lifetime, nil, nil)
+}
+
+// createCA creates and stores a CA certificate from tpl, signed by
+// parent; if parent is nil, the certificate is self-signed.
+func (iss *InternalIssuer) createCA(ctx context.Context, kind string, tpl *x509.Certificate, lifetime time.Duration,
+	parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, error) {
+	privKey, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	key := privKey.(crypto.Signer)
+	if tpl.SerialNumber, err = randomSerialNumber(); err != nil {
+		return nil, nil, err
+	}
+	tpl.NotBefore = timeNow().Add(-time.Minute).Truncate(time.Second)
+	tpl.NotAfter = tpl.NotBefore.Add(lifetime)
+	if parent == nil {
+		parent, parentKey = tpl, key
+	} else if tpl.NotAfter.After(parent.NotAfter) {
+		tpl.NotAfter = parent.NotAfter
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating %s certificate: %v", kind, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = storeTx(ctx, iss.Storage, []keyValue{
+		{key: StorageKeys.InternalCA(iss.caName(), kind+".key"), value: keyPEM},
+		{key: StorageKeys.InternalCA(iss.caName(), kind+".crt"), value: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})},
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("storing %s certificate: %v", kind, err)
+	}
+	return cert, key, nil
+}
+
+// loadKeyPair loads the CA certificate of the given kind and its key.
+func (iss *InternalIssuer) loadKeyPair(ctx context.Context, kind string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := iss.Storage.Load(ctx, StorageKeys.InternalCA(iss.caName(), kind+".crt"))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := iss.Storage.Load(ctx, StorageKeys.InternalCA(iss.caName(), kind+".key"))
+	if err != nil {
+		return nil, nil, err
+	}
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding %s certificate: %v", kind, err)
+	}
+	key, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding %s key: %v", kind, err)
+	}
+	return certs[0], key, nil
+}
+
+func (iss *InternalIssuer) certLifetime() time.Duration {
+	if iss.Lifetime > 0 {
+		return iss.Lifetime
+	}
+	return DefaultInternalCertLifetime
+}
+
+func (iss *InternalIssuer) intermediateLifetime() time.Duration {
+	if iss.IntermediateLifetime > 0 {
+		return iss.IntermediateLifetime
+	}
+	return DefaultInternalIntermediateLifetime
+}
+
+func (iss *InternalIssuer) caName() string {
+	if iss.CA != "" {
+		return iss.CA
+	}
+	return "local"
+}
+
+// randomSerialNumber returns a random 128-bit serial number.
+func randomSerialNumber() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %v", err)
+	}
+	return serial, nil
+}
+
+// InternalCA returns the storage key for a file
+// of the internal CA with the given name.
+func (keys KeyBuilder) InternalCA(ca, file string) string {
+	return path.Join(prefixInternalCA, keys.Safe(ca), file)
+}
+
+const prefixInternalCA = "pki/authorities"
+
+// Interface guards
+var (
+	_ Issuer     = (*InternalIssuer)(nil)
+	_ PreChecker = (*InternalIssuer)(nil)
+)
@@ -0,0 +1,164 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"slices"
+	"testing"
+)
+
+func newInternalTestCSR(t *testing.T, names ...string) *x509.CertificateRequest {
+	t.Helper()
+	key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: names[0]}}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tpl.IPAddresses = append(tpl.IPAddresses, ip)
+		} else {
+			tpl.DNSNames = append(tpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tpl, key.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestInternalIssuer(t *testing.T) {
+	ctx := context.Background()
+	_, ipNet, _ := net.ParseCIDR("10.0.0.0/8")
+	iss := &InternalIssuer{
+		Storage: &FileStorage{Path: t.TempDir()},
+		NameConstraints: &NameConstraints{
+			PermittedDNSDomains: []string{"internal.example"},
+			ExcludedDNSDomains:  []string{"secret.internal.example"},
+			PermittedIPRanges:   []*net.IPNet{ipNet},
+		},
+	}
+
+	issued, err := iss.Issue(ctx, newInternalTestCSR(t, "app.internal.example", "10.1.2.3"))
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+	chain, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("expected leaf and intermediate, got %d certificates", len(chain))
+	}
+	root, err := iss.RootCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates.AddCert(chain[1])
+	if _, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates, DNSName: "app.internal.example"}); err != nil {
+		t.Errorf("expected certificate to verify: %v", err)
+	}
+	if !chain[1].PermittedDNSDomainsCritical || !slices.Equal(chain[1].PermittedDNSDomains, []string{"internal.example"}) {
+		t.Errorf("expected critical name constraints on intermediate, got %v", chain[1].PermittedDNSDomains)
+	}
+	if lifetime := chain[0].NotAfter.Sub(chain[0].NotBefore); lifetime != DefaultInternalCertLifetime {
+		t.Errorf("expected default lifetime, got %s", lifetime)
+	}
+
+	for _, names := range [][]string{
+		{"app.example.com"},
+		{"app.internal.example", "x.secret.internal.example"},
+		{"*.internal.example"}, // would cover secret.internal.example
+		{"192.168.1.1"},
+	} {
+		if _, err := iss.Issue(ctx, newInternalTestCSR(t, names...)); err == nil {
+			t.Errorf("expected error issuing for %v", names)
+		}
+		if err := iss.PreCheck(ctx, names, false); err == nil {
+			t.Errorf("expected pre-check error for %v", names)
+		}
+	}
+
+	// another instance sharing the storage uses the same CA
+	other := &InternalIssuer{Storage: iss.Storage, NameConstraints: iss.NameConstraints}
+	otherRoot, err := other.RootCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !otherRoot.Equal(root) || !other.intermediate.Equal(chain[1]) {
+		t.Error("expected same root and intermediate from shared storage")
+	}
+
+	// changing the constraints replaces the intermediate, but not the root
+	other.NameConstraints = &NameConstraints{PermittedDNSDomains: []string{"other.example"}}
+	other.intermediate = nil
+	issued, err = other.Issue(ctx, newInternalTestCSR(t, "app.other.example"))
+	if err != nil {
+		t.Fatalf("issuing certificate with new constraints: %v", err)
+	}
+	chain, _ = parseCertsFromPEMBundle(issued.Certificate)
+	if chain[1].Equal(other.root) || !slices.Equal(chain[1].PermittedDNSDomains, []string{"other.example"}) {
+		t.Errorf("expected new intermediate with new constraints, got %v", chain[1].PermittedDNSDomains)
+	}
+	if !other.root.Equal(root) {
+		t.Error("expected root to be kept")
+	}
+}
+
+func TestNameConstraintsCheck(t *testing.T) {
+	nc := &NameConstraints{
+		PermittedDNSDomains:     []string{".example.com", "example.net"},
+		PermittedEmailAddresses: []string{"admin@example.org", "example.com"},
+		PermittedURIDomains:     []string{"example.com"},
+	}
+	for i, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"a.example.com", true},
+		{"example.com", false},
+		{"example.net", true},
+		{"a.b.example.net", true},
+		{"badexample.net", false},
+		{"*.example.net", true},
+		{"admin@example.org", true},
+		{"other@example.org", false},
+		{"someone@example.com", true},
+		{"spiffe://example.com/service", true},
+		{"spiffe://example.org/service", false},
+		{"urn:uuid:1234", false},
+		{"127.0.0.1", true}, // no IP constraints
+	} {
+		if err := nc.Check([]string{tc.name}); (err == nil) != tc.ok {
+			t.Errorf("test %d (%s): expected permitted=%t, got error %v", i, tc.name, tc.ok, err)
+		}
+	}
+	if err := (*NameConstraints)(nil).Check([]string{"anything.example"}); err != nil {
+		t.Errorf("expected nil constraints to permit everything, got %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// InternalRoot is a root of the CA of an InternalIssuer, as distributed
+// to the consumers of the CA through storage. When the CA's root is
+// rotated, the new root is distributed before it becomes active, and
+// the old root is retired only after an overlap period, so consumers
+// always trust the roots of all valid certificates.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type InternalRoot struct {
+	// The name of the root in the storage of the CA.
+	Name string `json:"name"`
+
+	// The DER-encoded root certificate.
+	Certificate []byte `json:"certificate"`
+
+	// When the root starts signing intermediates.
+	Activates time.Time `json:"activates"`
+
+	// When consumers stop trusting the root, if ever.
+	Retires time.Time `json:"retires,omitempty"`
+}
+
+// trusted returns true if the root is trusted at time t.
+func (r InternalRoot) trusted(t time.Time) bool {
+	return r.Retires.IsZero() || t.Before(r.Retires)
+}
+
+// RotateRoot creates a new root for the CA, which replaces the current
+// root as the signer of intermediates at activates, and distributes it
+// to consumers immediately. The current root is retired overlap after
+// activates; the overlap must cover the lifetime of the intermediate
+// and of the certificates signed by it, which is also the default.
+//
+// Consumers should refresh their roots (see InternalTrust) well
+// before activates.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (iss *InternalIssuer) RotateRoot(ctx context.Context, activates time.Time, overlap time.Duration) error {
+	if overlap <= 0 {
+		overlap = iss.intermediateLifetime() + iss.certLifetime()
+	}
+
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	lockKey := "internal_ca_" + iss.caName()
+	if err := acquireLock(ctx, iss.Storage, lockKey); err != nil {
+		return fmt.Errorf("acquiring CA lock: %v", err)
+	}
+	defer releaseLock(ctx, iss.Storage, lockKey)
+
+	roots, err := iss.loadRoots(ctx)
+	if err != nil {
+		return err
+	}
+	if last := roots[len(roots)-1]; !activates.After(last.Activates) {
+		return fmt.Errorf("new root must activate after the current one (%s)", last.Activates)
+	}
+	name := "root-" + strconv.Itoa(len(roots)+1)
+	root, _, err := iss.createRoot(ctx, name, "Certmagic "+iss.caName()+" Root CA "+strconv.Itoa(len(roots)+1))
+	if err != nil {
+		return err
+	}
+	for i := range roots {
+		if r := activates.Add(overlap); roots[i].Retires.IsZero() || roots[i].Retires.After(r) {
+			roots[i].Retires = r
+		}
+	}
+	roots = append(roots, InternalRoot{Name: name, Certificate: root.Raw, Activates: activates})
+	if err := iss.storeRoots(ctx, roots); err != nil {
+		return err
+	}
+	// have the next issuance check the activation time of the new root
+	iss.intermediate = nil
+	return nil
+}
+
+// Roots returns the roots of the CA, including those that are not
+// active yet and those that are retired, ordered by activation time.
+// The CA is created if it does not exist.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (iss *InternalIssuer) Roots(ctx context.Context) ([]InternalRoot, error) {
+	roots, err := loadInternalRoots(ctx, iss.Storage, iss.caName())
+	if err == nil {
+		return roots, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if _, _, err := iss.loadCA(ctx); err != nil {
+		return nil, err
+	}
+	return loadInternalRoots(ctx, iss.Storage, iss.caName())
+}
+
+// activeRoot returns the root that signs intermediates now, and when
+// the next root activates, if one is scheduled. It must be called with
+// the CA lock held.
+func (iss *InternalIssuer) activeRoot(ctx context.Context) (*x509.Certificate, crypto.Signer, time.Time, error) {
+	roots, err := iss.loadRoots(ctx)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	now := timeNow()
+	active, next := roots[0], time.Time{}
+	for _, r := range roots[1:] {
+		if now.Before(r.Activates) {
+			next = r.Activates
+			break
+		}
+		active = r
+	}
+	root, rootKey, err := iss.loadKeyPair(ctx, active.Name)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("loading root %s: %v", active.Name, err)
+	}
+	return root, rootKey, next, nil
+}
+
+// loadRoots loads the roots of the CA, creating the first root if the
+// CA does not exist. It must be called with the CA lock held.
+func (iss *InternalIssuer) loadRoots(ctx context.Context) ([]InternalRoot, error) {
+	roots, err := loadInternalRoots(ctx, iss.Storage, iss.caName())
+	if err == nil {
+		return roots, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	root, _, err := iss.loadOrCreateRoot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	roots = []InternalRoot{{Name: "root", Certificate: root.Raw, Activates: root.NotBefore}}
+	if err := iss.storeRoots(ctx, roots); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+func (iss *InternalIssuer) storeRoots(ctx context.Context, roots []InternalRoot) error {
+	rootsJSON, err := json.Marshal(roots)
+	if err != nil {
+		return err
+	}
+	if err := iss.Storage.Store(ctx, StorageKeys.InternalCA(iss.caName(), "roots.json"), rootsJSON); err != nil {
+		return fmt.Errorf("storing roots: %v", err)
+	}
+	return nil
+}
+
+func loadInternalRoots(ctx context.Context, storage Storage, ca string) ([]InternalRoot, error) {
+	rootsJSON, err := storage.Load(ctx, StorageKeys.InternalCA(ca, "roots.json"))
+	if err != nil {
+		return nil, err
+	}
+	var roots []InternalRoot
+	if err := json.Unmarshal(rootsJSON, &roots); err != nil {
+		return nil, fmt.Errorf("decoding roots: %v", err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("no roots for CA %s", ca)
+	}
+	sort.SliceStable(roots, func(i, j int) bool { return roots[i].Activates.Before(roots[j].Activates) })
+	return roots, nil
+}
+
+// InternalTrust provides the roots of the CA of an InternalIssuer to its
+// consumers, such as the clients and servers of an mTLS fleet, from the
+// storage of the CA. The roots are refreshed periodically, so consumers
+// trust new roots before they activate and stop trusting retired ones,
+// without restarting.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type InternalTrust struct {
+	// The storage of the CA. Required.
+	Storage Storage
+
+	// The name of the CA. Default: "local".
+	CA string
+
+	// How often to reload the roots from storage.
+	// Default: DefaultInternalTrustRefreshInterval.
+	RefreshInterval time.Duration
+
+	mu       sync.Mutex
+	pool     *x509.CertPool
+	loadedAt time.Time
+}
+
+// DefaultInternalTrustRefreshInterval is how often InternalTrust
+// reloads the roots from storage by default.
+const DefaultInternalTrustRefreshInterval = 5 * time.Minute
+
+// Roots returns the roots that are currently trusted.
+func (it *InternalTrust) Roots(ctx context.Context) ([]*x509.Certificate, error) {
+	ca := it.CA
+	if ca == "" {
+		ca = "local"
+	}
+	roots, err := loadInternalRoots(ctx, it.Storage, ca)
+	if err != nil {
+		return nil, fmt.Errorf("loading roots of CA %s: %w", ca, err)
+	}
+	now := timeNow()
+	var certs []*x509.Certificate
+	for _, r := range roots {
+		if !r.trusted(now) {
+			continue
+		}
+		cert, err := x509.ParseCertificate(r.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("parsing root %s: %v", r.Name, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// CertPool returns a pool of the roots that are currently trusted,
+// reloading them from storage if the refresh interval has passed. If
+// reloading fails, the previous pool is returned, if any.
+func (it *InternalTrust) CertPool(ctx context.Context) (*x509.CertPool, error) {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	interval := it.RefreshInterval
+	if interval <= 0 {
+		interval = DefaultInternalTrustRefreshInterval
+	}
+	if it.pool != nil && timeNow().Sub(it.loadedAt) < interval {
+		return it.pool, nil
+	}
+	roots, err := it.Roots(ctx)
+	if err != nil {
+		if it.pool != nil {
+			return it.pool, nil
+		}
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, root := range roots {
+		pool.AddCert(root)
+	}
+	it.pool, it.loadedAt = pool, timeNow()
+	return pool, nil
+}
+
+// VerifyServerConnection verifies the certificate chain of a server
+// against the currently trusted roots and the name of the server. It
+// can be used as the VerifyConnection callback of the tls.Config of a
+// client, with InsecureSkipVerify set, so that the roots are not fixed
+// when the config is created; the config must set ServerName.
+func (it *InternalTrust) VerifyServerConnection(cs tls.ConnectionState) error {
+	if cs.ServerName == "" {
+		return fmt.Errorf("no server name to verify")
+	}
+	return it.verify(cs, cs.ServerName, x509.ExtKeyUsageServerAuth)
+}
+
+// VerifyClientConnection verifies the certificate chain of a client
+// against the currently trusted roots. It can be used as the
+// VerifyConnection callback of the tls.Config of a server, with
+// ClientAuth set to tls.RequireAnyClientCert.
+func (it *InternalTrust) VerifyClientConnection(cs tls.ConnectionState) error {
+	return it.verify(cs, "", x509.ExtKeyUsageClientAuth)
+}
+
+func (it *InternalTrust) verify(cs tls.ConnectionState, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("no peer certificate")
+	}
+	pool, err := it.CertPool(context.Background())
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+		DNSName:       dnsName,
+		CurrentTime:   timeNow(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestInternalIssuerRotateRoot(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	iss := &InternalIssuer{Storage: &FileStorage{Path: t.TempDir()}}
+	trust := &InternalTrust{Storage: iss.Storage, RefreshInterval: time.Nanosecond}
+	issue := func() []*x509.Certificate {
+		issued, err := iss.Issue(ctx, newInternalTestCSR(t, "app.internal"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := parseCertsFromPEMBundle(issued.Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chain
+	}
+	issue()
+	oldRoot, err := iss.RootCertificate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	activates := timeNow().Add(time.Hour)
+	if err := iss.RotateRoot(ctx, activates, 0); err != nil {
+		t.Fatalf("rotating root: %v", err)
+	}
+	if err := iss.RotateRoot(ctx, activates, 0); err == nil {
+		t.Error("expected error for root that does not activate after the current one")
+	}
+	roots, err := trust.Roots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 || !roots[0].Equal(oldRoot) {
+		t.Fatalf("expected old and new root to be distributed, got %d roots", len(roots))
+	}
+	newRoot := roots[1]
+	if newRoot.Subject.CommonName == oldRoot.Subject.CommonName {
+		t.Error("expected new root to have a distinct name")
+	}
+
+	// before activation, the old root still signs
+	if chain := issue(); chain[1].CheckSignatureFrom(oldRoot) != nil {
+		t.Error("expected old root to sign before activation")
+	}
+
+	// after activation, the new root signs
+	faults.set(2*time.Hour, false)
+	chain := issue()
+	if chain[1].CheckSignatureFrom(newRoot) != nil {
+		t.Error("expected new root to sign after activation")
+	}
+	cs := tls.ConnectionState{ServerName: "app.internal", PeerCertificates: chain}
+	if err := trust.VerifyServerConnection(cs); err != nil {
+		t.Errorf("expected server to verify: %v", err)
+	}
+	if err := trust.VerifyClientConnection(cs); err != nil {
+		t.Errorf("expected client to verify: %v", err)
+	}
+	cs.ServerName = "other.internal"
+	if err := trust.VerifyServerConnection(cs); err == nil {
+		t.Error("expected error for wrong server name")
+	}
+
+	// after the overlap, the old root is retired
+	faults.set(time.Hour+DefaultInternalIntermediateLifetime+DefaultInternalCertLifetime+time.Minute, false)
+	roots, err = trust.Roots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || !roots[0].Equal(newRoot) {
+		t.Errorf("expected only new root to be trusted, got %d roots", len(roots))
+	}
+	all, err := iss.Roots(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Retires.IsZero() || !all[1].Activates.Equal(activates) {
+		t.Errorf("expected old root to be retired and new root active, got %+v", all)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// IssuanceRequest is a certificate request that is about to be
+// submitted to, or was just fulfilled by, an issuer; see
+// Config.BeforeIssuance and Config.AfterIssuance.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type IssuanceRequest struct {
+	// The CSR to submit. Before issuance, it may be
+	// replaced by a CSR for the same names that is
+	// signed by PrivateKey, for example to add
+	// extensions.
+	CSR *x509.CertificateRequest
+
+	// The names the certificate is for.
+	Names []string
+
+	// The issuer the CSR will be submitted to.
+	Issuer Issuer
+
+	// The private key of the certificate.
+	PrivateKey crypto.PrivateKey
+
+	// Whether the certificate is a renewal.
+	Renewal bool
+}
+
+// beforeIssuance runs cfg.BeforeIssuance, if set, for the CSR that is
+// about to be submitted to issuer, and returns the CSR to submit.
+func (cfg *Config) beforeIssuance(ctx context.Context, issuer Issuer, csr *x509.CertificateRequest, names []string, privateKey crypto.PrivateKey, renewal bool) (*x509.CertificateRequest, error) {
+	if cfg.BeforeIssuance == nil {
+		return csr, nil
+	}
+	req := &IssuanceRequest{
+		CSR:        csr,
+		Names:      names,
+		Issuer:     issuer,
+		PrivateKey: privateKey,
+		Renewal:    renewal,
+	}
+	if err := cfg.BeforeIssuance(ctx, req); err != nil {
+		return nil, fmt.Errorf("issuance vetoed: %w", err)
+	}
+	if req.CSR == csr {
+		return csr, nil
+	}
+
+	// the certificate is stored with the private key, so
+	// a replaced CSR must still be for the same key
+	if req.CSR == nil {
+		return nil, fmt.Errorf("BeforeIssuance removed the CSR")
+	}
+	if err := req.CSR.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("CSR from BeforeIssuance: invalid signature: %v", err)
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key is not a crypto.Signer")
+	}
+	if pub, ok := req.CSR.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(signer.Public()) {
+		return nil, fmt.Errorf("CSR from BeforeIssuance is not for the certificate's private key")
+	}
+	return req.CSR, nil
+}
+
+// afterIssuance runs cfg.AfterIssuance, if set, for the certificate that
+// issuer issued for csr, and returns the certificate to store and serve.
+func (cfg *Config) afterIssuance(ctx context.Context, issuer Issuer, csr *x509.CertificateRequest, names []string, privateKey crypto.PrivateKey, renewal bool, issued *IssuedCertificate) (*IssuedCertificate, error) {
+	if cfg.AfterIssuance == nil {
+		return issued, nil
+	}
+	chain, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issued certificate: %v", err)
+	}
+	leaf := chain[0]
+	req := &IssuanceRequest{
+		CSR:        csr,
+		Names:      names,
+		Issuer:     issuer,
+		PrivateKey: privateKey,
+		Renewal:    renewal,
+	}
+	chain, err = cfg.AfterIssuance(ctx, req, chain)
+	if err != nil {
+		return nil, fmt.Errorf("modifying issued certificate chain: %w", err)
+	}
+	if len(chain) == 0 || !bytes.Equal(chain[0].Raw, leaf.Raw) {
+		return nil, fmt.Errorf("chain from AfterIssuance does not start with the issued certificate")
+	}
+
+	var bundle []byte
+	for _, cert := range chain {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	modified := *issued
+	modified.Certificate = bundle
+	return &modified, nil
+}
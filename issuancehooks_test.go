@@ -0,0 +1,154 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"testing"
+)
+
+type csrRecordingIssuer struct {
+	*FakeIssuer
+	csrs []*x509.CertificateRequest
+}
+
+func (ri *csrRecordingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	ri.csrs = append(ri.csrs, csr)
+	return ri.FakeIssuer.Issue(ctx, csr)
+}
+
+func TestBeforeIssuance(t *testing.T) {
+	ctx := context.Background()
+	iss := &csrRecordingIssuer{FakeIssuer: new(FakeIssuer)}
+	cfg := newOnDemandTestConfig(t, iss)
+	cfg.OnDemand = nil
+
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	var requests []IssuanceRequest
+	var veto error
+	cfg.BeforeIssuance = func(ctx context.Context, req *IssuanceRequest) error {
+		requests = append(requests, *req)
+		if veto != nil {
+			return veto
+		}
+		tmpl := &x509.CertificateRequest{
+			DNSNames:        req.CSR.DNSNames,
+			ExtraExtensions: []pkix.Extension{{Id: oid, Value: []byte{0x05, 0x00}}},
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, req.PrivateKey)
+		if err != nil {
+			return err
+		}
+		req.CSR, err = x509.ParseCertificateRequest(der)
+		return err
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatalf("obtaining certificate: %v", err)
+	}
+	if len(requests) != 1 || requests[0].Renewal || requests[0].Issuer != Issuer(iss) {
+		t.Fatalf("expected one request for obtaining, got %+v", requests)
+	}
+	if len(iss.csrs) != 1 || !hasExtension(iss.csrs[0], oid) {
+		t.Error("expected issuer to get CSR from hook")
+	}
+
+	// vetoing a renewal keeps the issuer from being called
+	veto = ErrNoRetry{errors.New("change freeze")}
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err == nil {
+		t.Fatal("expected renewal to be vetoed")
+	}
+	if len(requests) != 2 || !requests[1].Renewal {
+		t.Errorf("expected renewal request, got %+v", requests)
+	}
+	if len(iss.csrs) != 1 || len(iss.Issued()) != 1 {
+		t.Errorf("expected no issuance after veto, got %d CSRs", len(iss.csrs))
+	}
+
+	// CSRs for other keys are rejected
+	veto = nil
+	cfg.BeforeIssuance = func(ctx context.Context, req *IssuanceRequest) error {
+		otherKey, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+		if err != nil {
+			return err
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: req.Names}, otherKey)
+		if err != nil {
+			return err
+		}
+		req.CSR, err = x509.ParseCertificateRequest(der)
+		return err
+	}
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err == nil {
+		t.Error("expected error for CSR with other key")
+	}
+	if len(iss.csrs) != 1 {
+		t.Errorf("expected issuer not to get CSR with other key, got %d CSRs", len(iss.csrs))
+	}
+}
+
+func hasExtension(csr *x509.CertificateRequest, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestAfterIssuance(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+
+	root, _ := issueFakeCertificate(t, new(FakeIssuer), "root.internal")
+	cfg.AfterIssuance = func(ctx context.Context, req *IssuanceRequest, chain []*x509.Certificate) ([]*x509.Certificate, error) {
+		// drop the intermediate and append a private root
+		return append(chain[:1], root.Leaf), nil
+	}
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatalf("obtaining certificate: %v", err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := cert.Certificate.Certificate
+	if len(chain) != 2 || !bytes.Equal(chain[0], fi.Issued()[0].Raw) || !bytes.Equal(chain[1], root.Leaf.Raw) {
+		t.Errorf("expected stored chain to be modified, got %d certificates", len(chain))
+	}
+
+	// the leaf must not be replaced
+	cfg.AfterIssuance = func(ctx context.Context, req *IssuanceRequest, chain []*x509.Certificate) ([]*x509.Certificate, error) {
+		return []*x509.Certificate{root.Leaf}, nil
+	}
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err == nil {
+		t.Error("expected error for chain without the issued certificate")
+	}
+	certRes, err := cfg.loadCertResource(ctx, fi, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := parseCertsFromPEMBundle(certRes.CertificatePEM); len(stored) != 2 || !bytes.Equal(stored[0].Raw, fi.Issued()[0].Raw) {
+		t.Error("expected previous certificate to remain stored")
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// IssuerHealthChecker is implemented by issuers that can check
+// whether they are able to issue certificates, e.g. whether their
+// CA is reachable. It is used to decide when an issuer that failed
+// has recovered (see Config.IssuerFailbackDelay).
+//
+// EXPERIMENTAL: Subject to change or removal.
+type IssuerHealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// IssuerStats are statistics about the issuances of an issuer
+// in this process, across all configs.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type IssuerStats struct {
+	// The number of certificates issued, and the
+	// number of times issuance failed.
+	Issued int64 `json:"issued"`
+	Failed int64 `json:"failed"`
+
+	// When the issuer last issued a certificate,
+	// and when it last failed to.
+	LastIssued  time.Time `json:"last_issued,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+
+	// The error of the last failure.
+	LastError string `json:"last_error,omitempty"`
+
+	// The number of times issuance failed since the
+	// issuer last issued a certificate.
+	ConsecutiveFailures int64 `json:"consecutive_failures"`
+
+	// Whether the issuer is considered healthy: it did
+	// not fail since it last issued a certificate or
+	// passed its health check.
+	Healthy bool `json:"healthy"`
+
+	// If the issuer is considered unhealthy, the time after
+	// which it is considered to have recovered, subject to its
+	// health check if it is an IssuerHealthChecker.
+	UnhealthyUntil time.Time `json:"unhealthy_until,omitempty"`
+}
+
+// IssuerStatistics returns the statistics of the issuers used in
+// this process, keyed by issuer key; these show which issuer served
+// each issuance, e.g. to see how often standby issuers are used.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func IssuerStatistics() map[string]IssuerStats {
+	issuerHealth.mu.Lock()
+	defer issuerHealth.mu.Unlock()
+	stats := make(map[string]IssuerStats, len(issuerHealth.issuers))
+	for key, st := range issuerHealth.issuers {
+		stats[key] = *st
+	}
+	return stats
+}
+
+// IssuerStatisticsHandler returns an HTTP handler that responds
+// with the IssuerStatistics in JSON, e.g. for dashboards that
+// show which issuers are failing during an outage of a CA.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func IssuerStatisticsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(IssuerStatistics())
+	})
+}
+
+// DefaultIssuerFailbackDelay is the default value of
+// Config.IssuerFailbackDelay.
+const DefaultIssuerFailbackDelay = 10 * time.Minute
+
+// issuerHealth tracks the health of issuers by issuer
+// key, across all configs in this process.
+var issuerHealth = &issuerHealthTracker{issuers: make(map[string]*IssuerStats)}
+
+type issuerHealthTracker struct {
+	mu      sync.Mutex
+	issuers map[string]*IssuerStats
+
+	// when the unhealthy issuers that are being probed, by
+	// a health check or by an issuance, started being probed
+	probes map[string]time.Time
+}
+
+func (ht *issuerHealthTracker) stats(issuerKey string) *IssuerStats {
+	st, ok := ht.issuers[issuerKey]
+	if !ok {
+		st = &IssuerStats{Healthy: true}
+		ht.issuers[issuerKey] = st
+	}
+	return st
+}
+
+func (ht *issuerHealthTracker) recordSuccess(issuerKey string) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	st := ht.stats(issuerKey)
+	st.Issued++
+	st.LastIssued = timeNow()
+	st.ConsecutiveFailures = 0
+	st.Healthy = true
+	st.UnhealthyUntil = time.Time{}
+	delete(ht.probes, issuerKey)
+}
+
+func (ht *issuerHealthTracker) recordFailure(issuerKey string, err error, failbackDelay time.Duration) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	st := ht.stats(issuerKey)
+	st.Failed++
+	st.LastFailure = timeNow()
+	st.LastError = err.Error()
+	st.ConsecutiveFailures++
+	st.Healthy = false
+	st.UnhealthyUntil = st.LastFailure.Add(failbackDelay)
+	delete(ht.probes, issuerKey)
+}
+
+// endProbe ends the probe of an issuer without a result,
+// so that the next caller of healthy can probe it again.
+func (ht *issuerHealthTracker) endProbe(issuerKey string) {
+	ht.mu.Lock()
+	defer ht.mu.Unlock()
+	delete(ht.probes, issuerKey)
+}
+
+// healthy returns whether the issuer is healthy: if it failed, the
+// failback delay must have passed, and if it is an IssuerHealthChecker,
+// its health check must pass; if it does not, the issuer remains
+// unhealthy for another failback delay.
+//
+// Only one caller at a time probes an issuer whose failback delay has
+// passed, with its health check or, if it has none, by being told that
+// the issuer is healthy so that it tries to issue; to other callers,
+// the issuer remains unhealthy until the probe has a result, so that
+// many concurrent issuances do not all try an issuer that is down.
+func (ht *issuerHealthTracker) healthy(ctx context.Context, issuer Issuer, failbackDelay time.Duration) bool {
+	issuerKey := issuer.IssuerKey()
+	ht.mu.Lock()
+	st, ok := ht.issuers[issuerKey]
+	if !ok || st.UnhealthyUntil.IsZero() {
+		ht.mu.Unlock()
+		return true
+	}
+	now := timeNow()
+	if now.Before(st.UnhealthyUntil) {
+		ht.mu.Unlock()
+		return false
+	}
+	if started, probing := ht.probes[issuerKey]; probing && now.Sub(started) < failbackDelay {
+		ht.mu.Unlock()
+		return false
+	}
+	if ht.probes == nil {
+		ht.probes = make(map[string]time.Time)
+	}
+	ht.probes[issuerKey] = now
+	unhealthyUntil := st.UnhealthyUntil
+	ht.mu.Unlock()
+
+	checker, ok := issuer.(IssuerHealthChecker)
+	if !ok {
+		// the issuance is the probe
+		return true
+	}
+	if err := checker.CheckHealth(ctx); err != nil {
+		if ctx.Err() != nil {
+			ht.endProbe(issuerKey)
+		} else {
+			ht.recordFailure(issuerKey, err, failbackDelay)
+		}
+		return false
+	}
+	ht.mu.Lock()
+	if st.UnhealthyUntil.Equal(unhealthyUntil) {
+		st.UnhealthyUntil = time.Time{}
+		st.Healthy = true
+	}
+	delete(ht.probes, issuerKey)
+	ht.mu.Unlock()
+	return true
+}
+
+// recordIssuance records the result of getting a
+// certificate from issuer for the health of issuers.
+func (cfg *Config) recordIssuance(ctx context.Context, issuer Issuer, err error) {
+	if err == nil {
+		issuerHealth.recordSuccess(issuer.IssuerKey())
+		return
+	}
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		// not the issuer's fault
+		issuerHealth.endProbe(issuer.IssuerKey())
+		return
+	}
+	issuerHealth.recordFailure(issuer.IssuerKey(), err, cfg.issuerFailbackDelay())
+}
+
+func (cfg *Config) issuerFailbackDelay() time.Duration {
+	if cfg.IssuerFailbackDelay > 0 {
+		return cfg.IssuerFailbackDelay
+	}
+	return DefaultIssuerFailbackDelay
+}
+
+// electIssuers orders issuers according to the health-aware issuer
+// policies, UsePrimaryIssuer and UseWeightedRandomIssuer: healthy
+// issuers first, and unhealthy issuers last, as a last resort. For
+// other policies, issuers is returned as-is.
+func (cfg *Config) electIssuers(ctx context.Context, issuers []Issuer) []Issuer {
+	if cfg.IssuerPolicy != UsePrimaryIssuer && cfg.IssuerPolicy != UseWeightedRandomIssuer {
+		return issuers
+	}
+	healthy := make([]Issuer, 0, len(issuers))
+	var unhealthy []Issuer
+	for _, issuer := range issuers {
+		if issuerHealth.healthy(ctx, issuer, cfg.issuerFailbackDelay()) {
+			healthy = append(healthy, issuer)
+		} else {
+			unhealthy = append(unhealthy, issuer)
+		}
+	}
+	if cfg.IssuerPolicy == UseWeightedRandomIssuer {
+		healthy = cfg.weightedShuffle(healthy)
+	}
+	if len(unhealthy) > 0 {
+		cfg.Logger.Debug("deprioritized unhealthy issuers",
+			zap.Strings("unhealthy", issuerKeysOf(unhealthy)),
+			zap.Strings("healthy", issuerKeysOf(healthy)))
+	}
+	return append(healthy, unhealthy...)
+}
+
+// weightedShuffle returns issuers in random order, where issuers with
+// greater weights in IssuerWeights are more likely to come first.
+func (cfg *Config) weightedShuffle(issuers []Issuer) []Issuer {
+	type weighted struct {
+		issuer Issuer
+		weight int64
+	}
+	remaining := make([]weighted, 0, len(issuers))
+	var total int64
+	for _, issuer := range issuers {
+		weight := int64(1)
+		if w, ok := cfg.IssuerWeights[issuer.IssuerKey()]; ok {
+			weight = int64(w)
+		}
+		if weight <= 0 {
+			continue
+		}
+		remaining = append(remaining, weighted{issuer, weight})
+		total += weight
+	}
+	shuffled := make([]Issuer, 0, len(issuers))
+	r := cfg.randReader()
+	for len(remaining) > 0 {
+		n := randInt63n(r, total)
+		i := 0
+		for ; n >= remaining[i].weight; i++ {
+			n -= remaining[i].weight
+		}
+		shuffled = append(shuffled, remaining[i].issuer)
+		total -= remaining[i].weight
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+
+	// issuers with a weight of 0 are only used if all others fail
+	for _, issuer := range issuers {
+		if w, ok := cfg.IssuerWeights[issuer.IssuerKey()]; ok && w <= 0 {
+			shuffled = append(shuffled, issuer)
+		}
+	}
+	return shuffled
+}
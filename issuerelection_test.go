@@ -0,0 +1,208 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type healthCheckedIssuer struct {
+	*FakeIssuer
+	healthErr error
+}
+
+func (hi healthCheckedIssuer) CheckHealth(ctx context.Context) error { return hi.healthErr }
+
+// resetIssuerHealth forgets the health of the issuers with the given
+// keys, which is shared by all tests, before and after the test.
+func resetIssuerHealth(t *testing.T, issuerKeys ...string) {
+	reset := func() {
+		issuerHealth.mu.Lock()
+		defer issuerHealth.mu.Unlock()
+		for _, key := range issuerKeys {
+			delete(issuerHealth.issuers, key)
+			delete(issuerHealth.probes, key)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestPrimaryIssuerFailover(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	primaryDown := true
+	primary := healthCheckedIssuer{FakeIssuer: &FakeIssuer{
+		Key: "primary_" + t.Name(),
+		Fail: func(ctx context.Context, csr *x509.CertificateRequest, attempt int) error {
+			if primaryDown {
+				return errors.New("primary is down")
+			}
+			return nil
+		},
+	}}
+	standby := &FakeIssuer{Key: "standby_" + t.Name()}
+	resetIssuerHealth(t, primary.Key, standby.Key)
+	cfg := newOnDemandTestConfig(t, primary)
+	cfg.Issuers = []Issuer{primary, standby}
+	cfg.IssuerPolicy = UsePrimaryIssuer
+
+	// the first failure fails over to the standby
+	if err := cfg.ObtainCertSync(ctx, "a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.storageHasCertResources(ctx, standby, "a.example.com") {
+		t.Error("expected certificate from standby")
+	}
+	stats := IssuerStatistics()
+	if st := stats[primary.Key]; st.Failed != 1 || st.Issued != 0 || st.UnhealthyUntil.IsZero() {
+		t.Errorf("expected primary to have failed once and be unhealthy, got %+v", st)
+	}
+	if st := stats[standby.Key]; st.Issued != 1 || st.LastIssued.IsZero() {
+		t.Errorf("expected standby to have issued once, got %+v", st)
+	}
+
+	// while the primary is unhealthy, the standby is tried first
+	if got := issuerKeysOf(cfg.electIssuers(ctx, cfg.Issuers)); got[0] != standby.Key || got[1] != primary.Key {
+		t.Errorf("expected standby first, got %v", got)
+	}
+	if err := cfg.ObtainCertSync(ctx, "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if st := IssuerStatistics()[primary.Key]; st.Failed != 1 {
+		t.Errorf("expected unhealthy primary not to be tried, got %+v", st)
+	}
+
+	// after the failback delay, the primary stays unhealthy if its health check fails
+	primary.healthErr = errors.New("still down")
+	cfg.Issuers[0] = primary
+	faults.set(DefaultIssuerFailbackDelay+time.Second, false)
+	if got := issuerKeysOf(cfg.electIssuers(ctx, cfg.Issuers)); got[0] != standby.Key {
+		t.Errorf("expected standby first while health check fails, got %v", got)
+	}
+
+	// once it recovers, it is used again
+	primaryDown = false
+	primary.healthErr = nil
+	cfg.Issuers[0] = primary
+	faults.set(2*DefaultIssuerFailbackDelay+2*time.Second, false)
+	if got := issuerKeysOf(cfg.electIssuers(ctx, cfg.Issuers)); got[0] != primary.Key {
+		t.Errorf("expected failback to primary, got %v", got)
+	}
+	if err := cfg.ObtainCertSync(ctx, "c.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.storageHasCertResources(ctx, primary, "c.example.com") {
+		t.Error("expected certificate from recovered primary")
+	}
+}
+
+func TestIssuerHealthProbe(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	primary := &FakeIssuer{Key: "primary_" + t.Name()}
+	standby := &FakeIssuer{Key: "standby_" + t.Name()}
+	resetIssuerHealth(t, primary.Key, standby.Key)
+	cfg := newOnDemandTestConfig(t, primary)
+	cfg.Issuers = []Issuer{primary, standby}
+	cfg.IssuerPolicy = UsePrimaryIssuer
+
+	for i := 0; i < 2; i++ {
+		cfg.recordIssuance(ctx, primary, errors.New("primary is down"))
+	}
+	if st := IssuerStatistics()[primary.Key]; st.Healthy || st.ConsecutiveFailures != 2 {
+		t.Errorf("expected primary to be unhealthy after 2 consecutive failures, got %+v", st)
+	}
+
+	// after the failback delay, only one of many concurrent
+	// issuances tries the primary, until it has a result
+	faults.set(DefaultIssuerFailbackDelay+time.Second, false)
+	const issuances = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var probes int
+	for i := 0; i < issuances; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cfg.electIssuers(ctx, cfg.Issuers)[0] == Issuer(primary) {
+				mu.Lock()
+				probes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if probes != 1 {
+		t.Errorf("expected primary to be probed once, got %d", probes)
+	}
+
+	// a probe that is canceled can be retried by the next issuance
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	cfg.recordIssuance(canceled, primary, context.Canceled)
+	if got := issuerKeysOf(cfg.electIssuers(ctx, cfg.Issuers)); got[0] != primary.Key {
+		t.Errorf("expected primary to be probed again after canceled probe, got %v", got)
+	}
+	cfg.recordIssuance(ctx, primary, nil)
+	if got := issuerKeysOf(cfg.electIssuers(ctx, cfg.Issuers)); got[0] != primary.Key {
+		t.Errorf("expected primary first after it recovered, got %v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	IssuerStatisticsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	var stats map[string]IssuerStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if st := stats[primary.Key]; !st.Healthy || st.ConsecutiveFailures != 0 || st.Failed != 2 || st.Issued != 1 {
+		t.Errorf("expected recovered primary in statistics, got %+v", st)
+	}
+}
+
+func TestWeightedRandomIssuer(t *testing.T) {
+	a := &FakeIssuer{Key: "a"}
+	b := &FakeIssuer{Key: "b"}
+	c := &FakeIssuer{Key: "c"}
+	cfg := &Config{
+		IssuerPolicy:  UseWeightedRandomIssuer,
+		IssuerWeights: map[string]int{"a": 3, "b": 1, "c": 0},
+		Rand:          NewDeterministicRand([]byte(t.Name())),
+		Logger:        defaultTestLogger,
+	}
+
+	first := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		got := issuerKeysOf(cfg.weightedShuffle([]Issuer{a, b, c}))
+		if len(got) != 3 || got[2] != "c" {
+			t.Fatalf("expected all issuers, with zero weight last, got %v", got)
+		}
+		first[got[0]]++
+	}
+	if first["a"] < 650 || first["a"] > 850 {
+		t.Errorf("expected a to be first about 3/4 of the time, got %d/1000", first["a"])
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// JobInfo describes a background certificate job (an obtain or
+// renewal) that is persisted in storage when Config.PersistJobs
+// is enabled.
+type JobInfo struct {
+	// The unique ID of the job, e.g. "renew_example.com".
+	ID string `json:"id"`
+
+	// The kind of job: "obtain" or "renew".
+	Kind string `json:"kind"`
+
+	// The identifier (subject) the job is for.
+	Identifier string `json:"identifier"`
+
+	// The status of the job.
+	Status JobStatus `json:"status"`
+
+	// How many attempts have been made so far.
+	Attempts int `json:"attempts,omitempty"`
+
+	// The error from the most recent attempt, if any.
+	LastError string `json:"last_error,omitempty"`
+
+	// When the next attempt is scheduled, if the
+	// job is waiting to be retried.
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+
+	// When the job was first created and last updated.
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// JobStatus is the status of a persisted job.
+type JobStatus string
+
+// Job statuses.
+const (
+	JobQueued   JobStatus = "queued"   // waiting to start
+	JobRunning  JobStatus = "running"  // an attempt is in progress
+	JobRetrying JobStatus = "retrying" // failed; waiting for next attempt
+	JobFailed   JobStatus = "failed"   // retries exhausted; will not be retried
+)
+
+// Jobs returns all jobs persisted in cfg's storage, including failed
+// jobs whose retries were exhausted. Successful jobs are removed from
+// storage when they complete.
+func (cfg *Config) Jobs(ctx context.Context) ([]JobInfo, error) {
+	keys, err := cfg.Storage.List(ctx, StorageKeys.JobsPrefix(), false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var jobs []JobInfo
+	for _, key := range keys {
+		if !strings.HasSuffix(key, ".json") {
+			continue
+		}
+		info, err := cfg.loadJob(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // completed while we were listing
+		}
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, info)
+	}
+	return jobs, nil
+}
+
+// CancelJob cancels the job with the given ID if it is running in this
+// process, and removes it from storage so that it will not be resumed.
+// Jobs running in other processes are not interrupted, but they stop
+// being tracked in storage.
+func (cfg *Config) CancelJob(ctx context.Context, id string) error {
+	runningJobsMu.Lock()
+	if cancel, ok := runningJobs[cfg.jobKey(id)]; ok {
+		cancel()
+	}
+	runningJobsMu.Unlock()
+
+	err := cfg.Storage.Delete(ctx, StorageKeys.Job(id))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting job %s: %v", id, err)
+	}
+	return nil
+}
+
+// ResumeJobs resumes all jobs persisted in storage that have not failed
+// permanently; for example, jobs that were interrupted by a restart. Each
+// job picks up its retry schedule where it left off. Typically this is
+// called once, at startup, after the config is ready to manage certificates.
+func (cfg *Config) ResumeJobs(ctx context.Context) error {
+	jobs, err := cfg.Jobs(ctx)
+	if err != nil {
+		return fmt.Errorf("listing jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if job.Status == JobFailed {
+			continue
+		}
+		cfg.Logger.Info("resuming job",
+			zap.String("job", job.ID),
+			zap.String("identifier", job.Identifier),
+			zap.Int("attempts", job.Attempts))
+		if err := cfg.manageOne(ctx, job.Identifier, true); err != nil {
+			cfg.Logger.Error("unable to resume job",
+				zap.String("job", job.ID),
+				zap.String("identifier", job.Identifier),
+				zap.Error(err))
+			continue
+		}
+
+		// if managing the name did not resubmit this job (for example, a
+		// certificate was obtained by another instance in the meantime),
+		// the job record is stale
+		current, err := cfg.loadJob(ctx, StorageKeys.Job(job.ID))
+		if err == nil && current.Updated.Equal(job.Updated) {
+			if err := cfg.Storage.Delete(ctx, StorageKeys.Job(job.ID)); err != nil {
+				cfg.Logger.Error("unable to delete stale job",
+					zap.String("job", job.ID),
+					zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// submitJob submits job to the job manager with the given name (which
+// may be empty to allow duplicates) and priority. If cfg.PersistJobs
+// is enabled, the job is also recorded in storage until it completes.
+func (cfg *Config) submitJob(ctx context.Context, name, kind, identifier string, priority jobPriority, job func(context.Context) error) {
+	unguarded := job
+	job = func(ctx context.Context) (err error) {
+		defer cfg.recoverPanic(ctx, kind+" job for "+identifier, &err)
+		return unguarded(ctx)
+	}
+
+	if !cfg.PersistJobs {
+		jm.SubmitPriority(cfg.Logger, name, priority, func() error { return job(ctx) })
+		return
+	}
+
+	pj := &persistentJob{cfg: cfg}
+	id := kind + "_" + identifier
+
+	// if we are resuming a previously-persisted job, keep its history
+	info, err := cfg.loadJob(ctx, StorageKeys.Job(id))
+	if err != nil {
+		now := time.Now()
+		info = JobInfo{
+			ID:         id,
+			Kind:       kind,
+			Identifier: identifier,
+			Created:    now,
+		}
+	}
+	info.Status = JobQueued
+	pj.info = info
+
+	// the job is only recorded if it is enqueued, not if it is a
+	// duplicate or dropped, and it must not start before it is
+	// recorded, since it would look like it was canceled
+	saved := make(chan struct{})
+	queued := jm.SubmitPriority(cfg.Logger, name, priority, func() error {
+		<-saved
+
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		jobKey := cfg.jobKey(id)
+		runningJobsMu.Lock()
+		runningJobs[jobKey] = cancel
+		runningJobsMu.Unlock()
+		defer func() {
+			runningJobsMu.Lock()
+			delete(runningJobs, jobKey)
+			runningJobsMu.Unlock()
+		}()
+
+		// the job may have been canceled while it was queued
+		if !cfg.Storage.Exists(ctx, StorageKeys.Job(id)) {
+			return nil
+		}
+
+		pj.update(ctx, func(info *JobInfo) { info.Status = JobRunning })
+
+		err := job(context.WithValue(ctx, persistentJobCtxKey{}, pj))
+
+		pj.mu.Lock()
+		failed := pj.info.Status == JobFailed
+		pj.mu.Unlock()
+		if err != nil && !errors.Is(err, context.Canceled) {
+			pj.update(ctx, func(info *JobInfo) {
+				info.Status = JobFailed
+				info.LastError = err.Error()
+				info.NextAttempt = time.Time{}
+			})
+			return err
+		}
+		if !failed && ctx.Err() == nil {
+			if err := cfg.Storage.Delete(ctx, StorageKeys.Job(id)); err != nil {
+				cfg.Logger.Error("unable to delete completed job from storage",
+					zap.String("job", id),
+					zap.Error(err))
+			}
+		}
+		return err
+	})
+	if queued {
+		pj.save(ctx)
+	}
+	close(saved)
+}
+
+func (cfg *Config) loadJob(ctx context.Context, key string) (JobInfo, error) {
+	data, err := cfg.Storage.Load(ctx, key)
+	if err != nil {
+		return JobInfo{}, err
+	}
+	var info JobInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return JobInfo{}, fmt.Errorf("decoding job %s: %v", key, err)
+	}
+	return info, nil
+}
+
+// jobKey returns a key that uniquely identifies the job with the given ID
+// among all configs in this process that may use different storage.
+func (cfg *Config) jobKey(id string) string {
+	return fmt.Sprintf("%p:%s", cfg.Storage, id)
+}
+
+// persistentJob tracks the persisted state of a job as it runs.
+type persistentJob struct {
+	cfg  *Config
+	mu   sync.Mutex
+	info JobInfo
+}
+
+// update applies fn to the job's info and saves it to storage.
+func (pj *persistentJob) update(ctx context.Context, fn func(*JobInfo)) {
+	if ctx.Err() != nil {
+		return // canceled; don't resurrect a job that was deleted
+	}
+	pj.mu.Lock()
+	fn(&pj.info)
+	pj.mu.Unlock()
+	pj.save(ctx)
+}
+
+func (pj *persistentJob) save(ctx context.Context) {
+	pj.mu.Lock()
+	pj.info.Updated = time.Now()
+	data, err := json.MarshalIndent(pj.info, "", "\t")
+	id := pj.info.ID
+	pj.mu.Unlock()
+	if err == nil {
+		err = pj.cfg.Storage.Store(context.WithoutCancel(ctx), StorageKeys.Job(id), data)
+	}
+	if err != nil {
+		pj.cfg.Logger.Error("unable to persist job",
+			zap.String("job", id),
+			zap.Error(err))
+	}
+}
+
+// resumePoint returns the number of attempts already made, when the
+// next attempt is due, and when the job was created, so that retries
+// can continue where they left off.
+func (pj *persistentJob) resumePoint() (attempts int, next, created time.Time) {
+	pj.mu.Lock()
+	defer pj.mu.Unlock()
+	return pj.info.Attempts, pj.info.NextAttempt, pj.info.Created
+}
+
+// recordAttempt records the outcome of an attempt. If retryIn is 0,
+// no further attempt will be made.
+func (pj *persistentJob) recordAttempt(ctx context.Context, attempts int, err error, retryIn time.Duration) {
+	pj.update(ctx, func(info *JobInfo) {
+		info.Attempts = attempts
+		info.LastError = ""
+		if err != nil {
+			info.LastError = err.Error()
+		}
+		switch {
+		case err == nil:
+			info.NextAttempt = time.Time{}
+		case retryIn > 0:
+			info.Status = JobRetrying
+			info.NextAttempt = time.Now().Add(retryIn)
+		default:
+			info.Status = JobFailed
+			info.NextAttempt = time.Time{}
+		}
+	})
+}
+
+type persistentJobCtxKey struct{}
+
+// runningJobs maps job keys to the cancel funcs of
+// jobs that are currently running in this process.
+var (
+	runningJobs   = make(map[string]context.CancelFunc)
+	runningJobsMu sync.Mutex
+)
+
+// JobsPrefix returns the storage key prefix for persisted jobs.
+func (keys KeyBuilder) JobsPrefix() string {
+	return prefixJobs
+}
+
+// Job returns the storage key for the persisted job with the given ID.
+func (keys KeyBuilder) Job(id string) string {
+	return path.Join(prefixJobs, keys.Safe(id)+".json")
+}
+
+const prefixJobs = "jobs"
@@ -0,0 +1,161 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPersistentJobs(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		Storage:     &FileStorage{Path: t.TempDir()},
+		Logger:      defaultTestLogger,
+		PersistJobs: true,
+	}
+
+	started, finish, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	cfg.submitJob(ctx, "renew_example.com", "renew", "example.com", jobPriority{}, func(ctx context.Context) error {
+		defer close(done)
+		close(started)
+		<-finish
+		return nil
+	})
+	<-started
+
+	jobs, err := cfg.Jobs(ctx)
+	if err != nil {
+		t.Fatalf("listing jobs: %v", err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("expected 1 job, got %d", len(jobs))
+	}
+	if jobs[0].ID != "renew_example.com" || jobs[0].Identifier != "example.com" || jobs[0].Status != JobRunning {
+		t.Errorf("unexpected job: %+v", jobs[0])
+	}
+
+	close(finish)
+	<-done
+	waitForJobRemoval(t, cfg, "renew_example.com")
+}
+
+func TestPersistentJobsNotEnqueued(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		Storage:     &FileStorage{Path: t.TempDir()},
+		Logger:      defaultTestLogger,
+		PersistJobs: true,
+	}
+
+	started, finish, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	cfg.submitJob(ctx, "test_job", "test", "first", jobPriority{}, func(ctx context.Context) error {
+		defer close(done)
+		close(started)
+		<-finish
+		return nil
+	})
+	<-started
+
+	// a job with the same name is already running, so this one is
+	// not enqueued and must not be recorded as queued
+	cfg.submitJob(ctx, "test_job", "test", "second", jobPriority{}, func(ctx context.Context) error {
+		t.Error("expected duplicate job not to run")
+		return nil
+	})
+	if cfg.Storage.Exists(ctx, StorageKeys.Job("test_second")) {
+		t.Error("expected duplicate job not to be persisted")
+	}
+
+	close(finish)
+	<-done
+	waitForJobRemoval(t, cfg, "test_first")
+}
+
+func TestCancelJob(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		Storage:     &FileStorage{Path: t.TempDir()},
+		Logger:      defaultTestLogger,
+		PersistJobs: true,
+	}
+
+	started, canceled := make(chan struct{}), make(chan struct{})
+	cfg.submitJob(ctx, "", "obtain", "example.com", jobPriority{}, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+	<-started
+
+	if err := cfg.CancelJob(ctx, "obtain_example.com"); err != nil {
+		t.Fatalf("canceling job: %v", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job was not canceled")
+	}
+	jobs, err := cfg.Jobs(ctx)
+	if err != nil {
+		t.Fatalf("listing jobs: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("expected no jobs after canceling, got %+v", jobs)
+	}
+}
+
+func TestDoWithRetryResumesPersistentJob(t *testing.T) {
+	ctx := context.Background()
+	cfg := &Config{
+		Storage: &FileStorage{Path: t.TempDir()},
+		Logger:  defaultTestLogger,
+	}
+	pj := &persistentJob{cfg: cfg, info: JobInfo{
+		ID:          "renew_example.com",
+		Attempts:    3,
+		NextAttempt: time.Now(),
+		Created:     time.Now().Add(-time.Hour),
+	}}
+
+	var attemptsSeen int
+	err := doWithRetry(context.WithValue(ctx, persistentJobCtxKey{}, pj), defaultTestLogger, nil, func(ctx context.Context) error {
+		attemptsSeen = *ctx.Value(AttemptsCtxKey).(*int)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attemptsSeen != 3 {
+		t.Errorf("expected attempt counter to resume at 3, got %d", attemptsSeen)
+	}
+	if pj.info.Attempts != 4 {
+		t.Errorf("expected 4 recorded attempts, got %d", pj.info.Attempts)
+	}
+}
+
+func waitForJobRemoval(t *testing.T, cfg *Config, id string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if !cfg.Storage.Exists(context.Background(), StorageKeys.Job(id)) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("job %s was not removed from storage", id)
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Keyring stores secrets in a facility of the operating system,
+// such as the macOS Keychain or the Linux kernel keyring.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type Keyring interface {
+	// Set stores secret under name, replacing
+	// any secret already stored under name.
+	Set(name string, secret []byte) error
+
+	// Get returns the secret stored under name. If there
+	// is none, the error must wrap fs.ErrNotExist.
+	Get(name string) ([]byte, error)
+
+	// Delete deletes the secret stored under name. If
+	// there is none, the error must wrap fs.ErrNotExist.
+	Delete(name string) error
+}
+
+// SystemKeyring is the Keyring of the operating system:
+//
+//   - On macOS, secrets are stored as generic passwords in the
+//     default Keychain of the user, using the security command.
+//   - On Linux, secrets are stored as "user" keys in the persistent
+//     kernel keyring of the user (or the user keyring, if the kernel
+//     does not support persistent keyrings). Note that the kernel
+//     keyring is never written to disk: the persistent keyring is
+//     discarded when it has not been accessed for a few days, and in
+//     any case when the system shuts down. Keys also count against a
+//     per-user quota of the kernel (see /proc/sys/kernel/keys). Hence
+//     it can only serve as a cache of keys, e.g. for KeyringSigner,
+//     and KeyringStorage refuses to store private keys in it.
+//
+// On other platforms, all operations fail with ErrKeyringUnsupported.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SystemKeyring struct {
+	// The name of the service under which secrets
+	// are stored. Default: "certmagic".
+	Service string
+}
+
+// ErrKeyringUnsupported is returned by SystemKeyring on platforms
+// that do not have a supported keyring.
+var ErrKeyringUnsupported = errors.New("keyring is not supported on this platform")
+
+func (sk SystemKeyring) service() string {
+	if sk.Service == "" {
+		return "certmagic"
+	}
+	return sk.Service
+}
+
+// KeyringStorage is a Storage that keeps private keys in a Keyring
+// instead of the wrapped Storage, so that they are protected by the
+// facilities of the operating system. All other values are stored
+// in the wrapped Storage as usual.
+//
+// The Keyring must keep its secrets across restarts of the system,
+// since the private keys are not stored anywhere else; Store fails
+// for keyrings that do not, such as SystemKeyring on Linux.
+//
+// Private keys are recognized by their storage key, which ends in
+// ".key" for both certificate and ACME account keys. In their place,
+// the wrapped Storage gets a placeholder, so that listing, locking,
+// and Stat work as before. Private keys that were stored before the
+// Keyring was used are still loaded from the wrapped Storage, and are
+// moved into the Keyring the next time they are stored.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type KeyringStorage struct {
+	// The storage for everything but private keys. Required.
+	Storage
+
+	// The keyring for private keys. Required.
+	Keyring Keyring
+}
+
+// volatileKeyring is implemented by keyrings
+// that lose their secrets when the system shuts down.
+type volatileKeyring interface {
+	volatile() bool
+}
+
+// keyringPlaceholder is stored in place of values that are in the keyring.
+var keyringPlaceholder = []byte("certmagic: stored in keyring\n")
+
+// Store implements Storage.
+func (ks *KeyringStorage) Store(ctx context.Context, key string, value []byte) error {
+	if !isPrivateKeyStorageKey(key) {
+		return ks.Storage.Store(ctx, key, value)
+	}
+	if vk, ok := ks.Keyring.(volatileKeyring); ok && vk.volatile() {
+		return fmt.Errorf("storing %s: keyring does not persist private keys across restarts", key)
+	}
+	if err := ks.Keyring.Set(key, value); err != nil {
+		return fmt.Errorf("storing %s in keyring: %w", key, err)
+	}
+	return ks.Storage.Store(ctx, key, keyringPlaceholder)
+}
+
+// Load implements Storage.
+func (ks *KeyringStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := ks.Storage.Load(ctx, key)
+	if err != nil || !isPrivateKeyStorageKey(key) || !bytes.Equal(value, keyringPlaceholder) {
+		return value, err
+	}
+	value, err = ks.Keyring.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s from keyring: %w", key, err)
+	}
+	return value, nil
+}
+
+// Delete implements Storage. When deleting a directory, the private
+// keys within it are deleted from the keyring, too.
+func (ks *KeyringStorage) Delete(ctx context.Context, key string) error {
+	keys := []string{key}
+	if !isPrivateKeyStorageKey(key) {
+		// may be a directory; listing fails if it is not
+		keys, _ = ks.Storage.List(ctx, key, true)
+	}
+	for _, k := range keys {
+		if !isPrivateKeyStorageKey(k) {
+			continue
+		}
+		if err := ks.Keyring.Delete(k); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleting %s from keyring: %w", k, err)
+		}
+	}
+	return ks.Storage.Delete(ctx, key)
+}
+
+func isPrivateKeyStorageKey(key string) bool {
+	return strings.HasSuffix(key, ".key")
+}
+
+// KeyringSigner returns a crypto.Signer for the PEM-encoded private key
+// stored in kr under name. Rather than keeping the private key in memory,
+// the signer retrieves it from the keyring for each signature; only the
+// public key is retained.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func KeyringSigner(kr Keyring, name string) (crypto.Signer, error) {
+	key, err := loadKeyringKey(kr, name)
+	if err != nil {
+		return nil, err
+	}
+	return keyringSigner{keyring: kr, name: name, public: key.Public()}, nil
+}
+
+type keyringSigner struct {
+	keyring Keyring
+	name    string
+	public  crypto.PublicKey
+}
+
+func (s keyringSigner) Public() crypto.PublicKey { return s.public }
+
+func (s keyringSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := loadKeyringKey(s.keyring, s.name)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(rand, digest, opts)
+}
+
+func loadKeyringKey(kr Keyring, name string) (crypto.Signer, error) {
+	keyPEM, err := kr.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("loading private key %s from keyring: %w", name, err)
+	}
+	key, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("decoding private key %s: %v", name, err)
+	}
+	return key, nil
+}
+
+// Interface guards
+var (
+	_ Storage       = (*KeyringStorage)(nil)
+	_ Keyring       = SystemKeyring{}
+	_ crypto.Signer = keyringSigner{}
+)
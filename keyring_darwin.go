@@ -0,0 +1,87 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// errSecItemNotFound is the exit status of the security
+// command when the item does not exist.
+const errSecItemNotFound = 44
+
+// Set implements Keyring.
+func (sk SystemKeyring) Set(name string, secret []byte) error {
+	// the secret is passed on stdin, in the security command's
+	// interactive mode, so that it does not show in the process list;
+	// it is base64-encoded so that it needs no quoting
+	cmd := "add-generic-password -U -s " + keychainQuote(sk.service()) +
+		" -a " + keychainQuote(name) +
+		" -w " + base64.StdEncoding.EncodeToString(secret) + "\n"
+	_, err := runSecurity(strings.NewReader(cmd), "-i")
+	return err
+}
+
+// Get implements Keyring.
+func (sk SystemKeyring) Get(name string) ([]byte, error) {
+	out, err := runSecurity(nil, "find-generic-password", "-s", sk.service(), "-a", name, "-w")
+	if err != nil {
+		return nil, keychainError(name, err)
+	}
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(out)))
+}
+
+// Delete implements Keyring.
+func (sk SystemKeyring) Delete(name string) error {
+	_, err := runSecurity(nil, "delete-generic-password", "-s", sk.service(), "-a", name)
+	return keychainError(name, err)
+}
+
+// volatile reports that the Keychain keeps its contents.
+func (SystemKeyring) volatile() bool { return false }
+
+func runSecurity(stdin *strings.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("/usr/bin/security", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func keychainError(name string, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == errSecItemNotFound {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return err
+}
+
+// keychainQuote quotes s for the security command's interactive mode.
+func keychainQuote(s string) string {
+	return strconv.Quote(s)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set implements Keyring.
+func (sk SystemKeyring) Set(name string, secret []byte) error {
+	// adding a key with the description of an existing key updates it
+	_, err := unix.AddKey("user", sk.description(name), secret, keyringID())
+	return err
+}
+
+// Get implements Keyring.
+func (sk SystemKeyring) Get(name string) ([]byte, error) {
+	id, err := sk.search(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := unix.KeyctlBuffer(unix.KEYCTL_READ, id, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		// the key may have been updated in between; if it grew, try again
+		if n <= size {
+			return buf[:n], nil
+		}
+	}
+}
+
+// Delete implements Keyring.
+func (sk SystemKeyring) Delete(name string) error {
+	id, err := sk.search(name)
+	if err != nil {
+		return err
+	}
+	_, err = unix.KeyctlInt(unix.KEYCTL_INVALIDATE, id, 0, 0, 0)
+	return err
+}
+
+func (sk SystemKeyring) search(name string) (int, error) {
+	id, err := unix.KeyctlSearch(keyringID(), "user", sk.description(name), 0)
+	if errors.Is(err, unix.ENOKEY) || errors.Is(err, unix.EKEYEXPIRED) || errors.Is(err, unix.EKEYREVOKED) {
+		return 0, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return id, err
+}
+
+func (sk SystemKeyring) description(name string) string {
+	return sk.service() + ":" + name
+}
+
+// volatile reports that the kernel keyring loses
+// its contents when the system shuts down.
+func (SystemKeyring) volatile() bool { return true }
+
+// keyringID returns the ID of the persistent keyring of the user,
+// which, unlike the user keyring, outlives the last process of the
+// user (until it has not been accessed for a few days, by default).
+// If the kernel does not support persistent keyrings, the user
+// keyring is used instead.
+func keyringID() int {
+	// linking it into the user keyring keeps it accessible
+	// to the other processes of the user
+	id, err := unix.KeyctlInt(unix.KEYCTL_GET_PERSISTENT, -1, unix.KEY_SPEC_USER_KEYRING, 0, 0)
+	if err != nil {
+		return unix.KEY_SPEC_USER_KEYRING
+	}
+	return id
+}
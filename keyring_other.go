@@ -0,0 +1,29 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux && !darwin
+
+package certmagic
+
+// Set implements Keyring.
+func (sk SystemKeyring) Set(_ string, _ []byte) error { return ErrKeyringUnsupported }
+
+// Get implements Keyring.
+func (sk SystemKeyring) Get(_ string) ([]byte, error) { return nil, ErrKeyringUnsupported }
+
+// Delete implements Keyring.
+func (sk SystemKeyring) Delete(_ string) error { return ErrKeyringUnsupported }
+
+// volatile reports that there is nothing to lose.
+func (SystemKeyring) volatile() bool { return false }
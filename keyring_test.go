@@ -0,0 +1,212 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+type memKeyring struct {
+	mu      sync.Mutex
+	secrets map[string][]byte
+}
+
+func (kr *memKeyring) Set(name string, secret []byte) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.secrets == nil {
+		kr.secrets = make(map[string][]byte)
+	}
+	kr.secrets[name] = append([]byte(nil), secret...)
+	return nil
+}
+
+func (kr *memKeyring) Get(name string) ([]byte, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	secret, ok := kr.secrets[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	return secret, nil
+}
+
+func (kr *memKeyring) Delete(name string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if _, ok := kr.secrets[name]; !ok {
+		return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	delete(kr.secrets, name)
+	return nil
+}
+
+func TestKeyringStorage(t *testing.T) {
+	ctx := context.Background()
+	kr := new(memKeyring)
+	underlying := &FileStorage{Path: t.TempDir()}
+	ks := &KeyringStorage{Storage: underlying, Keyring: kr}
+
+	keyKey := StorageKeys.SitePrivateKey("fake", "example.com")
+	certKey := StorageKeys.SiteCert("fake", "example.com")
+	if err := ks.Store(ctx, keyKey, []byte("private key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Store(ctx, certKey, []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, _ := underlying.Load(ctx, keyKey); !bytes.Equal(stored, keyringPlaceholder) {
+		t.Errorf("expected placeholder in underlying storage, got %q", stored)
+	}
+	if secret, _ := kr.Get(keyKey); string(secret) != "private key" {
+		t.Errorf("expected private key in keyring, got %q", secret)
+	}
+	if stored, _ := underlying.Load(ctx, certKey); string(stored) != "certificate" {
+		t.Errorf("expected certificate in underlying storage, got %q", stored)
+	}
+	if value, err := ks.Load(ctx, keyKey); err != nil || string(value) != "private key" {
+		t.Errorf("expected private key to be loaded from keyring, got %q (err=%v)", value, err)
+	}
+
+	// keys stored before the keyring was used still load
+	oldKey := StorageKeys.SitePrivateKey("fake", "old.example.com")
+	if err := underlying.Store(ctx, oldKey, []byte("old private key")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := ks.Load(ctx, oldKey); err != nil || string(value) != "old private key" {
+		t.Errorf("expected private key from underlying storage, got %q (err=%v)", value, err)
+	}
+
+	// deleting a directory deletes the keys in it from the keyring
+	if err := ks.Delete(ctx, StorageKeys.CertsSitePrefix("fake", "example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Get(keyKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected private key to be deleted from keyring, got %v", err)
+	}
+	if ks.Exists(ctx, certKey) {
+		t.Error("expected certificate to be deleted")
+	}
+}
+
+type volatileMemKeyring struct{ memKeyring }
+
+func (*volatileMemKeyring) volatile() bool { return true }
+
+func TestKeyringStorageVolatileKeyring(t *testing.T) {
+	ctx := context.Background()
+	kr := new(volatileMemKeyring)
+	underlying := &FileStorage{Path: t.TempDir()}
+	ks := &KeyringStorage{Storage: underlying, Keyring: kr}
+
+	keyKey := StorageKeys.SitePrivateKey("fake", "example.com")
+	if err := ks.Store(ctx, keyKey, []byte("private key")); err == nil {
+		t.Error("expected storing a private key in a volatile keyring to fail")
+	}
+	if _, err := kr.Get(keyKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected private key not to be in keyring, got %v", err)
+	}
+	if underlying.Exists(ctx, keyKey) {
+		t.Error("expected no placeholder in underlying storage")
+	}
+
+	// everything else is stored as usual
+	certKey := StorageKeys.SiteCert("fake", "example.com")
+	if err := ks.Store(ctx, certKey, []byte("certificate")); err != nil {
+		t.Errorf("storing certificate: %v", err)
+	}
+}
+
+func TestKeyringSigner(t *testing.T) {
+	kr := new(memKeyring)
+	key, err := StandardKeyGenerator{KeyType: P256}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Set("account.key", keyPEM); err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := KeyringSigner(kr, "account.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signer.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.(crypto.Signer).Public()) {
+		t.Error("expected public key of stored private key")
+	}
+	digest := sha256.Sum256([]byte("hello"))
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); err != nil {
+		t.Errorf("signing: %v", err)
+	}
+
+	// the key is retrieved for every signature
+	if err := kr.Delete("account.key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected error after key was deleted from keyring, got %v", err)
+	}
+}
+
+func TestSystemKeyring(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		// other platforms would modify the keychain of the user running the tests
+		t.Skip("only tested on linux")
+	}
+	kr := SystemKeyring{Service: "certmagic-test"}
+	name := fmt.Sprintf("test-%d.key", os.Getpid())
+	if err := kr.Set(name, []byte("secret")); err != nil {
+		t.Skipf("kernel keyring not available: %v", err)
+	}
+	defer kr.Delete(name)
+
+	if secret, err := kr.Get(name); err != nil || string(secret) != "secret" {
+		t.Errorf("expected secret, got %q (err=%v)", secret, err)
+	}
+	if err := kr.Set(name, []byte("updated secret")); err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := kr.Get(name); err != nil || string(secret) != "updated secret" {
+		t.Errorf("expected updated secret, got %q (err=%v)", secret, err)
+	}
+	if err := kr.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kr.Get(name); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error after delete, got %v", err)
+	}
+
+	// the kernel keyring does not survive a reboot
+	ks := &KeyringStorage{Storage: &FileStorage{Path: t.TempDir()}, Keyring: kr}
+	if err := ks.Store(context.Background(), name, []byte("secret")); err == nil {
+		t.Error("expected KeyringStorage to refuse the kernel keyring")
+	}
+}
@@ -0,0 +1,342 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LeaderElection elects one leader among the instances of a cluster
+// that share the same storage, so that only the leader renews
+// certificates and refreshes OCSP staples; the other instances, the
+// followers, reload what the leader renewed from storage. This avoids
+// redundant work and contention for locks in large clusters.
+//
+// The leader holds a lease in Storage, which it extends regularly; if
+// it stops doing so, e.g. because it exited or lost connectivity, the
+// lease expires and another instance takes over. Leases are recorded
+// in Storage using its locks, unless Storage implements LeaderElector,
+// in which case its native primitives are used. Since lease expiration
+// is based on time, the clocks of the instances must be synchronized.
+//
+// A LeaderElection must be used by only one Cache per process. It can
+// be combined with a LocalCoordinator, in which case only the local
+// leader on each host takes part in the election.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type LeaderElection struct {
+	// The storage shared by the cluster. Required.
+	Storage Storage
+
+	// The name of the election, so that several clusters
+	// can share the same storage. Default: "maintenance".
+	Name string
+
+	// The ID of this instance, which must be unique in the
+	// cluster. Default: the hostname, the process ID, and
+	// a random suffix.
+	ID string
+
+	// How long a lease lasts; the leader extends it at a third
+	// of this interval, and followers try to take over at the
+	// same interval. Default: DefaultLeaseDuration.
+	LeaseDuration time.Duration
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu     sync.Mutex
+	id     string
+	lease  LeaderLease // the last known lease
+	leader bool        // whether the last known lease is ours
+}
+
+// LeaderLease describes the lease of the leader of an election.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type LeaderLease struct {
+	// The ID of the leader.
+	ID string `json:"id"`
+
+	// When the leader acquired the lease.
+	Acquired time.Time `json:"acquired"`
+
+	// When the lease expires, unless extended.
+	Expires time.Time `json:"expires"`
+}
+
+// expired returns true if there is no valid lease.
+func (l LeaderLease) expired() bool {
+	return l.ID == "" || !timeNow().Before(l.Expires)
+}
+
+// LeaderElector is implemented by storage backends that have native
+// primitives for leader election, such as leases or sessions, to be
+// used by LeaderElection instead of locks.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type LeaderElector interface {
+	// Campaign makes id the leader of the election name with a
+	// lease for ttl, if there is no leader with a valid lease, or
+	// extends the lease by ttl if id is already the leader. It
+	// returns the lease of the leader, whether or not it is id.
+	Campaign(ctx context.Context, name, id string, ttl time.Duration) (LeaderLease, error)
+
+	// Resign ends the lease of id, if it is the leader of
+	// the election name, so that another leader can be elected.
+	Resign(ctx context.Context, name, id string) error
+
+	// Leader returns the lease of the leader of the election
+	// name. If there is none, the returned lease has no ID.
+	Leader(ctx context.Context, name string) (LeaderLease, error)
+}
+
+// DefaultLeaseDuration is the default duration of leader leases.
+const DefaultLeaseDuration = time.Minute
+
+func (le *LeaderElection) name() string {
+	if le.Name != "" {
+		return le.Name
+	}
+	return "maintenance"
+}
+
+func (le *LeaderElection) leaseDuration() time.Duration {
+	if le.LeaseDuration > 0 {
+		return le.LeaseDuration
+	}
+	return DefaultLeaseDuration
+}
+
+func (le *LeaderElection) logger() *zap.Logger {
+	if le.Logger == nil {
+		return zap.NewNop()
+	}
+	return le.Logger
+}
+
+func (le *LeaderElection) elector() LeaderElector {
+	if elector, ok := le.Storage.(LeaderElector); ok {
+		return elector
+	}
+	return storageLeaderElector{le.Storage}
+}
+
+// InstanceID returns the ID of this instance in the election.
+func (le *LeaderElection) InstanceID() string {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	if le.ID != "" {
+		return le.ID
+	}
+	if le.id == "" {
+		le.id = newInstanceID()
+	}
+	return le.id
+}
+
+// newInstanceID returns an ID for this instance that is unique in a
+// cluster: the hostname, the process ID, and a random suffix.
+func newInstanceID() string {
+	hostname, _ := os.Hostname()
+	random := make([]byte, 4)
+	_, _ = rand.Read(random)
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), hex.EncodeToString(random))
+}
+
+// IsLeader returns true if this instance is the leader, as of
+// the last time it campaigned, and its lease has not expired.
+func (le *LeaderElection) IsLeader() bool {
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	return le.leader && !le.lease.expired()
+}
+
+// Leader returns the lease of the current leader, as recorded
+// in storage. If there is none, the returned lease has no ID.
+func (le *LeaderElection) Leader(ctx context.Context) (LeaderLease, error) {
+	return le.elector().Leader(ctx, le.name())
+}
+
+// campaign tries to become or remain the leader, and
+// returns whether this instance is the leader.
+func (le *LeaderElection) campaign(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, le.leaseDuration()/2)
+	defer cancel()
+	id := le.InstanceID()
+	lease, err := le.elector().Campaign(ctx, le.name(), id, le.leaseDuration())
+
+	le.mu.Lock()
+	defer le.mu.Unlock()
+	wasLeader := le.leader && !le.lease.expired()
+	if err != nil {
+		// keep the last known lease; it is still valid until it expires
+		return wasLeader, err
+	}
+	le.lease = lease
+	le.leader = lease.ID == id
+	if le.leader != wasLeader {
+		if le.leader {
+			le.logger().Info("became leader", zap.String("election", le.name()), zap.String("id", id))
+		} else {
+			le.logger().Info("lost leadership",
+				zap.String("election", le.name()),
+				zap.String("id", id),
+				zap.String("leader", lease.ID))
+		}
+	}
+	return le.leader, nil
+}
+
+// resign gives up the leadership, if this instance is the leader.
+func (le *LeaderElection) resign(ctx context.Context) error {
+	le.mu.Lock()
+	leader := le.leader
+	le.leader = false
+	le.lease = LeaderLease{}
+	le.mu.Unlock()
+	if !leader {
+		return nil
+	}
+	return le.elector().Resign(ctx, le.name(), le.InstanceID())
+}
+
+// storageLeaderElector records leases in storage, using
+// its locks to make campaigns mutually exclusive.
+type storageLeaderElector struct {
+	storage Storage
+}
+
+func (se storageLeaderElector) Campaign(ctx context.Context, name, id string, ttl time.Duration) (LeaderLease, error) {
+	var lease LeaderLease
+	err := se.withLock(ctx, name, func() error {
+		var err error
+		lease, err = se.Leader(ctx, name)
+		if err != nil {
+			return err
+		}
+		now := timeNow()
+		switch {
+		case lease.ID == id && !lease.expired():
+			lease.Expires = now.Add(ttl)
+		case lease.expired():
+			lease = LeaderLease{ID: id, Acquired: now, Expires: now.Add(ttl)}
+		default:
+			return nil // someone else is the leader
+		}
+		leaseJSON, err := json.Marshal(lease)
+		if err != nil {
+			return err
+		}
+		return se.storage.Store(ctx, StorageKeys.LeaderLease(name), leaseJSON)
+	})
+	return lease, err
+}
+
+func (se storageLeaderElector) Resign(ctx context.Context, name, id string) error {
+	return se.withLock(ctx, name, func() error {
+		lease, err := se.Leader(ctx, name)
+		if err != nil || lease.ID != id {
+			return err
+		}
+		return se.storage.Delete(ctx, StorageKeys.LeaderLease(name))
+	})
+}
+
+func (se storageLeaderElector) Leader(ctx context.Context, name string) (LeaderLease, error) {
+	leaseJSON, err := se.storage.Load(ctx, StorageKeys.LeaderLease(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return LeaderLease{}, nil
+	}
+	if err != nil {
+		return LeaderLease{}, err
+	}
+	var lease LeaderLease
+	if err := json.Unmarshal(leaseJSON, &lease); err != nil {
+		return LeaderLease{}, fmt.Errorf("decoding leader lease: %v", err)
+	}
+	return lease, nil
+}
+
+func (se storageLeaderElector) withLock(ctx context.Context, name string, f func() error) error {
+	lockKey := "leader_election_" + name
+	if err := acquireLock(ctx, se.storage, lockKey); err != nil {
+		return fmt.Errorf("acquiring election lock: %v", err)
+	}
+	defer releaseLock(ctx, se.storage, lockKey)
+	return f()
+}
+
+// LeaderLease returns the storage key for
+// the lease of the leader of the election.
+func (keys KeyBuilder) LeaderLease(election string) string {
+	return path.Join(prefixLeader, keys.Safe(election)+".json")
+}
+
+const prefixLeader = "leader"
+
+// leaderElection returns the leader election of the cache, if any.
+func (certCache *Cache) leaderElection() *LeaderElection {
+	certCache.optionsMu.RLock()
+	defer certCache.optionsMu.RUnlock()
+	return certCache.options.LeaderElection
+}
+
+// campaignForLeadership campaigns in the leader election
+// of the cache, if any, to become or remain the leader.
+func (certCache *Cache) campaignForLeadership(ctx context.Context, log *zap.Logger) {
+	le := certCache.leaderElection()
+	if le == nil {
+		return
+	}
+	if lc := certCache.localCoordinator(); lc != nil {
+		// only the local leader of each host takes part
+		if leader, err := lc.leader(); err == nil && !leader {
+			return
+		}
+	}
+	if _, err := le.campaign(ctx); err != nil {
+		log.Error("campaigning for maintenance leadership",
+			zap.String("election", le.name()),
+			zap.Error(err))
+	}
+}
+
+// MaintenanceLeader returns the lease of the leader of the cache's
+// LeaderElection, which performs maintenance for the cluster.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (certCache *Cache) MaintenanceLeader(ctx context.Context) (LeaderLease, error) {
+	le := certCache.leaderElection()
+	if le == nil {
+		return LeaderLease{}, fmt.Errorf("cache has no leader election")
+	}
+	return le.Leader(ctx)
+}
+
+// Interface guards
+var _ LeaderElector = storageLeaderElector{}
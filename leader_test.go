@@ -0,0 +1,150 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	storage := &FileStorage{Path: t.TempDir()}
+	a := &LeaderElection{Storage: storage, ID: "a"}
+	b := &LeaderElection{Storage: storage, ID: "b"}
+
+	if leader, err := a.campaign(ctx); err != nil || !leader {
+		t.Fatalf("expected a to become leader, got %v (err=%v)", leader, err)
+	}
+	if leader, err := b.campaign(ctx); err != nil || leader {
+		t.Fatalf("expected b to follow, got %v (err=%v)", leader, err)
+	}
+	if !a.IsLeader() || b.IsLeader() {
+		t.Error("expected only a to be leader")
+	}
+	if lease, err := b.Leader(ctx); err != nil || lease.ID != "a" {
+		t.Errorf("expected a to be recorded as leader, got %+v (err=%v)", lease, err)
+	}
+
+	// the leader extends its lease
+	faults.set(DefaultLeaseDuration/2, false)
+	if leader, _ := a.campaign(ctx); !leader {
+		t.Error("expected a to remain leader")
+	}
+	faults.set(DefaultLeaseDuration, false)
+	if leader, _ := b.campaign(ctx); leader {
+		t.Error("expected b to follow while the lease of a is extended")
+	}
+
+	// when the leader stops extending its lease, a follower takes over
+	faults.set(2*DefaultLeaseDuration, false)
+	if a.IsLeader() {
+		t.Error("expected a not to be leader after its lease expired")
+	}
+	if leader, _ := b.campaign(ctx); !leader {
+		t.Error("expected b to take over after the lease of a expired")
+	}
+	if leader, _ := a.campaign(ctx); leader {
+		t.Error("expected a to follow after b took over")
+	}
+
+	// resigning lets another instance take over immediately
+	if err := b.resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if lease, _ := a.Leader(ctx); lease.ID != "" {
+		t.Errorf("expected no leader after resignation, got %+v", lease)
+	}
+	if leader, _ := a.campaign(ctx); !leader {
+		t.Error("expected a to become leader after b resigned")
+	}
+}
+
+type electingStorage struct {
+	*FileStorage
+	campaigns int
+}
+
+func (es *electingStorage) Campaign(ctx context.Context, name, id string, ttl time.Duration) (LeaderLease, error) {
+	es.campaigns++
+	return LeaderLease{ID: id, Expires: timeNow().Add(ttl)}, nil
+}
+
+func (es *electingStorage) Resign(ctx context.Context, name, id string) error { return nil }
+
+func (es *electingStorage) Leader(ctx context.Context, name string) (LeaderLease, error) {
+	return LeaderLease{ID: "native"}, nil
+}
+
+func TestLeaderElectionNative(t *testing.T) {
+	storage := &electingStorage{FileStorage: &FileStorage{Path: t.TempDir()}}
+	le := &LeaderElection{Storage: storage}
+	if leader, err := le.campaign(context.Background()); err != nil || !leader {
+		t.Fatalf("expected to become leader, got %v (err=%v)", leader, err)
+	}
+	if storage.campaigns != 1 {
+		t.Errorf("expected native election to be used, got %d campaigns", storage.campaigns)
+	}
+	if storage.Exists(context.Background(), StorageKeys.LeaderLease("maintenance")) {
+		t.Error("expected no lease to be recorded by the native election")
+	}
+}
+
+func TestCacheLeaderElection(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	other := &LeaderElection{Storage: storage, ID: "other"}
+	if leader, _ := other.campaign(ctx); !leader {
+		t.Fatal("expected other instance to become leader")
+	}
+
+	le := &LeaderElection{Storage: storage}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		LeaderElection:   le,
+		Logger:           zap.NewNop(),
+	})
+	for i := 0; i < 100 && !cache.maintenanceRunning.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cache.isMaintenanceLeader(zap.NewNop()) {
+		t.Error("expected cache to follow the other instance")
+	}
+	if lease, err := cache.MaintenanceLeader(ctx); err != nil || lease.ID != "other" {
+		t.Errorf("expected other instance to be maintenance leader, got %+v (err=%v)", lease, err)
+	}
+
+	if err := other.resign(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cache.campaignForLeadership(ctx, zap.NewNop())
+	if !cache.isMaintenanceLeader(zap.NewNop()) {
+		t.Error("expected cache to take over after the other instance resigned")
+	}
+	if lease, _ := cache.MaintenanceLeader(ctx); lease.ID != le.InstanceID() {
+		t.Errorf("expected cache to be maintenance leader, got %+v", lease)
+	}
+
+	// stopping the cache resigns
+	cache.Stop()
+	if lease, _ := other.Leader(ctx); lease.ID != "" {
+		t.Errorf("expected no leader after cache stopped, got %+v", lease)
+	}
+}
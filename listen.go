@@ -0,0 +1,176 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Addresses on which the convenience functions HTTPS and Listen
+// listen, instead of HTTPPort and HTTPSPort on all interfaces; see
+// ListenAddress for their format. They are useful when privileged
+// ports cannot be bound directly, for example behind a reverse proxy
+// that connects through a UNIX socket, or with systemd socket
+// activation.
+//
+// EXPERIMENTAL: Subject to change or removal.
+var (
+	HTTPAddress  string
+	HTTPSAddress string
+)
+
+// ListenAddress returns a listener for addr, which is one of:
+//
+//   - "unix:PATH" for a UNIX domain socket at PATH; a stale socket
+//     file that is left over from a previous run is replaced.
+//   - "fd:N" for the socket with file descriptor N, which has been
+//     opened by the parent process, such as systemd.
+//   - "fdname:NAME" for the socket named NAME by systemd socket
+//     activation (see FileDescriptorName= in systemd.socket(5)),
+//     or the unnamed socket at index NAME of the passed sockets.
+//   - a TCP address, such as ":443" or "127.0.0.1:8443".
+//
+// Sockets passed as file descriptors are not closed when the
+// returned listener is closed, so they can be listened on again.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func ListenAddress(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		socketPath := strings.TrimPrefix(addr, "unix:")
+		if info, err := os.Stat(socketPath); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", socketPath); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s: %w", socketPath, errSocketInUse)
+			}
+			os.Remove(socketPath)
+		}
+		return net.Listen("unix", socketPath)
+
+	case strings.HasPrefix(addr, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(addr, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid file descriptor in listen address %s", addr)
+		}
+		return listenFD(fd, addr)
+
+	case strings.HasPrefix(addr, "fdname:"):
+		fds, err := systemdSockets()
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(addr, "fdname:")
+		fd, ok := fds[name]
+		if !ok {
+			return nil, fmt.Errorf("no socket named %s was passed by systemd", name)
+		}
+		return listenFD(fd, addr)
+
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// errSocketInUse is returned by ListenAddress if
+// another process is listening on a UNIX socket.
+var errSocketInUse = errors.New("UNIX socket is in use")
+
+// isTCPListenAddress returns true if addr is a TCP address
+// for ListenAddress.
+func isTCPListenAddress(addr string) bool {
+	return !strings.HasPrefix(addr, "unix:") &&
+		!strings.HasPrefix(addr, "fd:") &&
+		!strings.HasPrefix(addr, "fdname:")
+}
+
+// listenFD returns a listener for the socket with the file descriptor
+// fd. The listener has its own duplicate of the file descriptor, so
+// closing it leaves fd open.
+func listenFD(fd int, addr string) (net.Listener, error) {
+	passedFilesMu.Lock()
+	f, ok := passedFiles[fd]
+	if !ok {
+		f = os.NewFile(uintptr(fd), addr)
+		if f == nil {
+			passedFilesMu.Unlock()
+			return nil, fmt.Errorf("invalid file descriptor in listen address %s", addr)
+		}
+		// keep the file, so that the descriptor is not
+		// closed when the file is garbage collected
+		passedFiles[fd] = f
+	}
+	passedFilesMu.Unlock()
+
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %v", addr, err)
+	}
+	return ln, nil
+}
+
+// systemdSockets returns the file descriptors of the sockets passed
+// by systemd socket activation, by their names; unnamed sockets are
+// named by their index.
+func systemdSockets() (map[string]int, error) {
+	return parseSystemdSockets(os.Getpid(), os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+}
+
+// parseSystemdSockets parses the environment variables of systemd
+// socket activation, as described in sd_listen_fds(3), for the
+// process with the given PID.
+func parseSystemdSockets(pid int, listenPID, listenFDs, listenFDNames string) (map[string]int, error) {
+	if listenPID == "" || listenFDs == "" {
+		return nil, fmt.Errorf("no sockets were passed by systemd (LISTEN_PID and LISTEN_FDS not set)")
+	}
+	if p, err := strconv.Atoi(listenPID); err != nil || p != pid {
+		return nil, fmt.Errorf("sockets passed by systemd are for process %s, not this one (%d)", listenPID, pid)
+	}
+	n, err := strconv.Atoi(listenFDs)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", listenFDs)
+	}
+	var names []string
+	if listenFDNames != "" {
+		names = strings.Split(listenFDNames, ":")
+	}
+	fds := make(map[string]int, n)
+	for i := 0; i < n; i++ {
+		fd := sdListenFDsStart + i
+		fds[strconv.Itoa(i)] = fd
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			if _, ok := fds[names[i]]; !ok {
+				fds[names[i]] = fd
+			}
+		}
+	}
+	return fds, nil
+}
+
+// sdListenFDsStart is the first file descriptor
+// passed by systemd socket activation.
+const sdListenFDsStart = 3
+
+// passedFiles holds the files of the file descriptors that
+// were passed to ListenAddress.
+var (
+	passedFiles   = make(map[int]*os.File)
+	passedFilesMu sync.Mutex
+)
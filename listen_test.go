@@ -0,0 +1,134 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestListenAddressUNIX(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("UNIX sockets are not tested on windows")
+	}
+	socketPath := filepath.Join(t.TempDir(), "https.sock")
+	ln, err := ListenAddress("unix:" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func(ln net.Listener) {
+		if conn, err := ln.Accept(); err == nil {
+			conn.Close()
+		}
+	}(ln)
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("connecting to UNIX socket: %v", err)
+	}
+	conn.Close()
+
+	// a socket in use is neither replaced nor used by challenge servers
+	if _, err := ListenAddress("unix:" + socketPath); !errors.Is(err, errSocketInUse) {
+		t.Errorf("expected error for socket in use, got %v", err)
+	}
+	if challengeLn, err := robustTryListen("unix:" + socketPath); challengeLn != nil || err != nil {
+		t.Errorf("expected challenge server to assume socket in use can solve challenges, got %v (err=%v)", challengeLn, err)
+	}
+	ln.Close()
+
+	// a stale socket file is replaced
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err = ListenAddress("unix:" + socketPath)
+	if err != nil {
+		t.Fatalf("expected stale socket to be replaced, got %v", err)
+	}
+	ln.Close()
+}
+
+func TestListenAddressFD(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("passed file descriptors are not tested on windows")
+	}
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	f, err := tcpLn.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("fd:%d", f.Fd())
+
+	// the passed socket stays open when its listeners are closed
+	for i := 0; i < 2; i++ {
+		ln, err := ListenAddress(addr)
+		if err != nil {
+			t.Fatalf("listening on %s: %v", addr, err)
+		}
+		if ln.Addr().String() != tcpLn.Addr().String() {
+			t.Errorf("expected listener on %s, got %s", tcpLn.Addr(), ln.Addr())
+		}
+		ln.Close()
+	}
+	passedFilesMu.Lock()
+	if _, ok := passedFiles[int(f.Fd())]; !ok {
+		t.Error("expected passed file to be retained")
+	}
+	passedFilesMu.Unlock()
+
+	if _, err := ListenAddress("fd:nope"); err == nil {
+		t.Error("expected error for invalid file descriptor")
+	}
+	if _, err := ListenAddress("fdname:https"); err == nil && os.Getenv("LISTEN_FDS") == "" {
+		t.Error("expected error for named socket without systemd")
+	}
+}
+
+func TestParseSystemdSockets(t *testing.T) {
+	fds, err := parseSystemdSockets(42, "42", "3", "http:https")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"0": 3, "1": 4, "2": 5, "http": 3, "https": 4}
+	if len(fds) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, fds)
+	}
+	for name, fd := range expected {
+		if fds[name] != fd {
+			t.Errorf("expected socket %s to have fd %d, got %d", name, fd, fds[name])
+		}
+	}
+
+	if _, err := parseSystemdSockets(42, "43", "1", ""); err == nil {
+		t.Error("expected error for sockets passed to another process")
+	}
+	if _, err := parseSystemdSockets(42, "", "", ""); err == nil {
+		t.Error("expected error without systemd environment")
+	}
+	if _, err := parseSystemdSockets(42, "42", "x", ""); err == nil {
+		t.Error("expected error for invalid LISTEN_FDS")
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LocalCoordinator coordinates the maintenance of certificates among
+// several processes on the same host that share the same storage, such
+// as worker processes listening with SO_REUSEPORT. Only one of the
+// processes, the leader, renews certificates and refreshes OCSP staples;
+// the others, the followers, reload renewed certificates and staples
+// from storage when the leader signals that it updated them.
+//
+// Coordination happens by way of an exclusive lock on LockFile, which
+// is released by the operating system when the leader exits, so that
+// one of the followers can take over. Processes on different hosts
+// are not coordinated; use a Storage that implements distributed locks
+// for that, as usual.
+//
+// A LocalCoordinator must be used by only one Cache per process, and
+// all processes must use the same LockFile.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type LocalCoordinator struct {
+	// The path of the lock file; it is created if it does
+	// not exist. Required.
+	LockFile string
+
+	// How often followers check whether the leader updated
+	// certificates, and whether they can take over as leader.
+	// Default: 10s.
+	PollInterval time.Duration
+
+	mu       sync.Mutex
+	file     *os.File // the locked file, while leader
+	lastSeen string   // the last update signaled by the leader that followers saw
+}
+
+func (lc *LocalCoordinator) pollInterval() time.Duration {
+	if lc.PollInterval > 0 {
+		return lc.PollInterval
+	}
+	return 10 * time.Second
+}
+
+// leader returns true if this process is the leader, trying
+// to become the leader if there is none.
+func (lc *LocalCoordinator) leader() (bool, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.file != nil {
+		return true, nil
+	}
+	f, err := os.OpenFile(lc.LockFile, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return false, fmt.Errorf("opening lock file: %v", err)
+	}
+	if err := tryLockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errFileLocked) {
+			return false, nil
+		}
+		return false, fmt.Errorf("locking %s: %v", lc.LockFile, err)
+	}
+	lc.file = f
+	return true, nil
+}
+
+// signalUpdate signals to the followers that the leader updated
+// certificates or staples in storage. It does nothing if this
+// process is not the leader.
+func (lc *LocalCoordinator) signalUpdate() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.file == nil {
+		return nil
+	}
+	update := []byte(time.Now().Format(time.RFC3339Nano))
+	if err := lc.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := lc.file.WriteAt(update, 0)
+	return err
+}
+
+// updated returns true if the leader signaled an update since
+// the last time this was called.
+func (lc *LocalCoordinator) updated() (bool, error) {
+	update, err := os.ReadFile(lc.LockFile)
+	if err != nil {
+		return false, err
+	}
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if string(update) == lc.lastSeen {
+		return false, nil
+	}
+	lc.lastSeen = string(update)
+	return true, nil
+}
+
+// release gives up the leadership, if this process is the leader.
+func (lc *LocalCoordinator) release() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.file == nil {
+		return nil
+	}
+	err := lc.file.Close() // also releases the lock
+	lc.file = nil
+	return err
+}
+
+// errFileLocked is returned by tryLockFile if another
+// process holds the lock.
+var errFileLocked = errors.New("file is locked by another process")
+
+// localCoordinator returns the local coordinator of the cache, if any.
+func (certCache *Cache) localCoordinator() *LocalCoordinator {
+	certCache.optionsMu.RLock()
+	defer certCache.optionsMu.RUnlock()
+	return certCache.options.LocalCoordinator
+}
+
+// isMaintenanceLeader returns true if this cache should perform
+// maintenance operations that change storage, such as renewals
+// and OCSP refreshes; this is always the case unless the cache
+// is a follower of a LocalCoordinator or of a LeaderElection.
+func (certCache *Cache) isMaintenanceLeader(log *zap.Logger) bool {
+	if lc := certCache.localCoordinator(); lc != nil {
+		leader, err := lc.leader()
+		if err != nil {
+			// better to do maintenance twice than never
+			log.Error("unable to determine maintenance leader; assuming leadership", zap.Error(err))
+		} else if !leader {
+			return false
+		}
+	}
+	if le := certCache.leaderElection(); le != nil {
+		return le.IsLeader()
+	}
+	return true
+}
+
+// signalLocalFollowers signals to the followers of the cache's
+// LocalCoordinator, if any, that certificates or staples
+// were updated in storage.
+func (certCache *Cache) signalLocalFollowers() {
+	lc := certCache.localCoordinator()
+	if lc == nil {
+		return
+	}
+	if err := lc.signalUpdate(); err != nil {
+		certCache.logger.Error("signaling update to local followers",
+			zap.String("lock_file", lc.LockFile),
+			zap.Error(err))
+	}
+}
+
+// followLocalLeader checks whether the leader of the cache's
+// LocalCoordinator updated certificates, and if so, reloads
+// them from storage. If there is no leader anymore, this
+// process takes over.
+func (certCache *Cache) followLocalLeader(ctx context.Context, log *zap.Logger) {
+	lc := certCache.localCoordinator()
+	if lc == nil {
+		return
+	}
+	if certCache.isMaintenanceLeader(log) {
+		return
+	}
+	updated, err := lc.updated()
+	if err != nil {
+		log.Error("checking for updates from local leader",
+			zap.String("lock_file", lc.LockFile),
+			zap.Error(err))
+		return
+	}
+	if updated {
+		certCache.reloadRenewedCertificates(ctx, log)
+		certCache.updateOCSPStaples(ctx)
+	}
+}
+
+// reloadRenewedCertificates reloads managed certificates
+// that were renewed in storage by another process.
+func (certCache *Cache) reloadRenewedCertificates(ctx context.Context, log *zap.Logger) {
+	for _, cert := range certCache.getAllCerts() {
+		if !cert.managed || len(cert.Names) == 0 {
+			continue
+		}
+		cfg, err := certCache.getConfig(cert)
+		if err != nil || cfg == nil {
+			continue
+		}
+		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, cert.Names[0])
+		if err != nil {
+			log.Debug("loading stored certificate to check for renewal",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+			continue
+		}
+		chain, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+		if err != nil {
+			continue
+		}
+		der := make([][]byte, len(chain))
+		for i, c := range chain {
+			der[i] = c.Raw
+		}
+		if hashCertificateChain(der) == cert.hash || expiresAt(chain[0]).Before(expiresAt(cert.Leaf)) {
+			continue
+		}
+		if _, err := cfg.reloadManagedCertificate(ctx, cert); err != nil {
+			log.Error("reloading certificate renewed by local leader",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+		}
+	}
+}
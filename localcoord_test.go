@@ -0,0 +1,121 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalCoordinatorLeadership(t *testing.T) {
+	lockFile := filepath.Join(t.TempDir(), "maintenance.lock")
+	first := &LocalCoordinator{LockFile: lockFile}
+	second := &LocalCoordinator{LockFile: lockFile}
+
+	if leader, err := first.leader(); err != nil || !leader {
+		t.Fatalf("expected first coordinator to become leader, got %v (err=%v)", leader, err)
+	}
+	if leader, err := second.leader(); err != nil || leader {
+		t.Fatalf("expected second coordinator to be follower, got %v (err=%v)", leader, err)
+	}
+	if updated, err := second.updated(); err != nil || updated {
+		t.Errorf("expected no update yet, got %v (err=%v)", updated, err)
+	}
+	if err := first.signalUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := second.updated(); err != nil || !updated {
+		t.Errorf("expected update, got %v (err=%v)", updated, err)
+	}
+	if updated, _ := second.updated(); updated {
+		t.Error("expected update to be seen only once")
+	}
+
+	// followers take over when the leader goes away
+	if err := first.release(); err != nil {
+		t.Fatal(err)
+	}
+	if leader, err := second.leader(); err != nil || !leader {
+		t.Errorf("expected second coordinator to take over, got %v (err=%v)", leader, err)
+	}
+	defer second.release()
+}
+
+func TestLocalCoordinatorFollowerReloads(t *testing.T) {
+	ctx := context.Background()
+	lockFile := filepath.Join(t.TempDir(), "maintenance.lock")
+	fi := new(FakeIssuer)
+
+	storage := &FileStorage{Path: t.TempDir()}
+	leaderCfg := newLocalCoordinatedTestConfig(t, fi, storage, lockFile)
+	followerCfg := newLocalCoordinatedTestConfig(t, fi, storage, lockFile)
+
+	log := defaultTestLogger
+	if !leaderCfg.certCache.isMaintenanceLeader(log) {
+		t.Fatal("expected first cache to be leader")
+	}
+	if followerCfg.certCache.isMaintenanceLeader(log) {
+		t.Fatal("expected second cache to be follower")
+	}
+
+	if err := leaderCfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	oldCert, err := leaderCfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := followerCfg.CacheManagedCertificate(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the leader renews the certificate and reloads it, which signals the follower
+	if err := leaderCfg.RenewCertSync(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	newCert, err := leaderCfg.reloadManagedCertificate(ctx, oldCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newCert.hash == oldCert.hash {
+		t.Fatal("expected renewed certificate")
+	}
+
+	followerCfg.certCache.followLocalLeader(ctx, log)
+	certs := followerCfg.certCache.AllMatchingCertificates("example.com")
+	if len(certs) != 1 || certs[0].hash != newCert.hash {
+		t.Errorf("expected follower to reload renewed certificate, got %d certificates", len(certs))
+	}
+}
+
+func newLocalCoordinatedTestConfig(t *testing.T, iss Issuer, storage Storage, lockFile string) *Config {
+	lc := &LocalCoordinator{LockFile: lockFile}
+	t.Cleanup(func() { lc.release() })
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		LocalCoordinator: lc,
+		Logger:           defaultTestLogger,
+	})
+	t.Cleanup(cache.Stop)
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{iss},
+		Storage:   storage,
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		Logger:    defaultTestLogger,
+	})
+	return cfg
+}
@@ -23,8 +23,10 @@ import (
 	"fmt"
 	"io/fs"
 	"path"
-	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mholt/acmez/v3/acme"
@@ -32,64 +34,190 @@ import (
 	"golang.org/x/crypto/ocsp"
 )
 
+// timeNow returns the current time, as used for maintenance
+// decisions. Tests replace it to simulate clock jumps.
+var timeNow = time.Now
+
 // maintainAssets is a permanently-blocking function
 // that loops indefinitely and, on a regular schedule, checks
 // certificates for expiration and initiates a renewal of certs
 // that are expiring soon. It also updates OCSP stapling. It
-// should only be called once per cache. Panics are recovered,
-// and if panicCount < 10, the function is called recursively,
-// incrementing panicCount each time. Initial invocation should
-// start panicCount at 0.
-func (certCache *Cache) maintainAssets(panicCount int) {
+// should only be called once per cache. Panics are recovered
+// and reported (see recoverPanic), and maintenance is restarted
+// after a delay that grows with each panic, until the cache
+// is stopped.
+func (certCache *Cache) maintainAssets() {
+	for panics := 1; ; panics++ {
+		if certCache.runMaintenance() {
+			return
+		}
+		select {
+		case <-time.After(maintenanceRestartDelay(panics)):
+		case <-certCache.stopChan:
+			certCache.maintenanceRunning.Store(false)
+			close(certCache.doneChan)
+			return
+		}
+	}
+}
+
+// runMaintenance runs maintenance until the cache is stopped,
+// in which case it returns true, or until it panics, in which
+// case it returns false.
+func (certCache *Cache) runMaintenance() (stopped bool) {
 	log := certCache.logger.Named("maintenance")
 	log = log.With(zap.String("cache", fmt.Sprintf("%p", certCache)))
 
-	defer func() {
-		if err := recover(); err != nil {
-			buf := make([]byte, stackTraceBufferSize)
-			buf = buf[:runtime.Stack(buf, false)]
-			log.Error("panic", zap.Any("error", err), zap.ByteString("stack", buf))
-			if panicCount < 10 {
-				certCache.maintainAssets(panicCount + 1)
-			}
-		}
-	}()
+	defer certCache.recoverPanic(context.Background(), log, "maintenance")
 
 	certCache.optionsMu.RLock()
 	renewalTicker := time.NewTicker(certCache.options.RenewCheckInterval)
 	ocspTicker := time.NewTicker(certCache.options.OCSPCheckInterval)
+	var followC <-chan time.Time
+	if lc := certCache.options.LocalCoordinator; lc != nil {
+		followTicker := time.NewTicker(lc.pollInterval())
+		defer followTicker.Stop()
+		followC = followTicker.C
+	}
+	var memoryC <-chan time.Time
+	if certCache.options.MemoryPressureThreshold > 0 {
+		memoryTicker := time.NewTicker(memoryPressureCheckInterval)
+		defer memoryTicker.Stop()
+		memoryC = memoryTicker.C
+	}
+	var unmanagedC <-chan time.Time
+	if interval := certCache.options.UnmanagedReloadInterval; interval > 0 {
+		unmanagedTicker := time.NewTicker(interval)
+		defer unmanagedTicker.Stop()
+		unmanagedC = unmanagedTicker.C
+	}
+	var shardC <-chan time.Time
+	if sh := certCache.options.Sharding; sh != nil {
+		shardTicker := time.NewTicker(sh.memberTTL() / 3)
+		defer shardTicker.Stop()
+		shardC = shardTicker.C
+	}
+	var electionC <-chan time.Time
+	if le := certCache.options.LeaderElection; le != nil {
+		electionTicker := time.NewTicker(le.leaseDuration() / 3)
+		defer electionTicker.Stop()
+		electionC = electionTicker.C
+	}
 	certCache.optionsMu.RUnlock()
+	defer renewalTicker.Stop()
+	defer ocspTicker.Stop()
 
 	log.Info("started background certificate maintenance")
+	certCache.maintenanceRunning.Store(true)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// renewal passes run in the background, so that a slow pass does
+	// not hold up OCSP updates and leadership; see startRenewalPass
+	var passes sync.WaitGroup
+
+	certCache.campaignForLeadership(ctx, log)
+	certCache.renewShardMembership(ctx, log)
+
 	for {
+		certCache.maintenanceBeat.Store(timeNow().UnixNano())
 		select {
 		case <-renewalTicker.C:
-			err := certCache.RenewManagedCertificates(ctx)
-			if err != nil {
-				log.Error("renewing managed certificates", zap.Error(err))
+			if !certCache.isMaintenanceLeader(log) {
+				// the local leader renews certificates; we only reload them
+				certCache.reloadRenewedCertificates(ctx, log)
+				continue
 			}
+			certCache.startRenewalPass(ctx, log, &passes)
 		case <-ocspTicker.C:
 			certCache.updateOCSPStaples(ctx)
+		case <-followC:
+			certCache.followLocalLeader(ctx, log)
+		case <-electionC:
+			certCache.campaignForLeadership(ctx, log)
+		case <-shardC:
+			certCache.renewShardMembership(ctx, log)
+		case <-memoryC:
+			certCache.checkMemoryPressure(ctx, log)
+		case <-unmanagedC:
+			certCache.checkUnmanagedFiles(ctx, log)
 		case <-certCache.stopChan:
-			renewalTicker.Stop()
-			ocspTicker.Stop()
+			cancel()
+			passes.Wait()
+			if le := certCache.leaderElection(); le != nil {
+				if err := le.resign(ctx); err != nil {
+					log.Error("resigning maintenance leadership", zap.Error(err))
+				}
+			}
+			if sh := certCache.sharding(); sh != nil {
+				if err := sh.leave(ctx); err != nil {
+					log.Error("leaving maintenance shards", zap.Error(err))
+				}
+			}
+			if lc := certCache.localCoordinator(); lc != nil {
+				if err := lc.release(); err != nil {
+					log.Error("releasing local maintenance leadership", zap.Error(err))
+				}
+			}
 			log.Info("stopped background certificate maintenance")
+			certCache.maintenanceRunning.Store(false)
 			close(certCache.doneChan)
-			return
+			return true
 		}
 	}
 }
 
+// startRenewalPass starts a renewal pass in the background. If the
+// previous pass is still running, because it took longer than the
+// renewal check interval, this pass is skipped rather than run
+// concurrently, and once the previous pass finishes, a catch-up pass
+// renews the most urgent certificates.
+func (certCache *Cache) startRenewalPass(ctx context.Context, log *zap.Logger, passes *sync.WaitGroup) {
+	if started := certCache.renewalPassStarted.Load(); started != 0 {
+		certCache.catchUpPending.Store(true)
+		log.Warn("renewal pass is taking longer than the renewal check interval; skipping the next pass",
+			zap.Duration("running_for", timeNow().Sub(time.Unix(0, started))))
+		return
+	}
+	certCache.renewalPassStarted.Store(timeNow().UnixNano())
+	certCache.catchUpPending.Store(false)
+
+	certCache.optionsMu.RLock()
+	catchUpLimit := certCache.options.CatchUpLimit
+	certCache.optionsMu.RUnlock()
+
+	passes.Add(1)
+	go func() {
+		defer passes.Done()
+		defer certCache.renewalPassStarted.Store(0)
+		defer certCache.recoverPanic(ctx, log, "renewal pass")
+
+		if err := certCache.RenewManagedCertificates(ctx); err != nil {
+			log.Error("renewing managed certificates", zap.Error(err))
+		}
+		if certCache.catchUpPending.Swap(false) && ctx.Err() == nil {
+			log.Info("running catch-up pass for the most urgent certificates", zap.Int("limit", catchUpLimit))
+			if err := certCache.renewManagedCertificates(ctx, catchUpLimit); err != nil {
+				log.Error("renewing most urgent certificates", zap.Error(err))
+			}
+		}
+	}()
+}
+
 // RenewManagedCertificates renews managed certificates,
 // including ones loaded on-demand. Note that this is done
 // automatically on a regular basis; normally you will not
 // need to call this. This method assumes non-interactive
 // mode (i.e. operating in the background).
 func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
+	return certCache.renewManagedCertificates(ctx, 0)
+}
+
+// renewManagedCertificates renews managed certificates. If urgentLimit
+// is positive, only the urgentLimit certificates that need renewal and
+// expire soonest are renewed, and the other maintenance is skipped.
+func (certCache *Cache) renewManagedCertificates(ctx context.Context, urgentLimit int) error {
 	log := certCache.logger.Named("maintenance")
 
 	// configs will hold a map of certificate hash to the config
@@ -102,75 +230,152 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 	// words, our first iteration through the certificate cache does NOT
 	// perform any operations--only queues them--so that more fine-grained
 	// write locks may be obtained during the actual operations.
-	var renewQueue, reloadQueue, deleteQueue, ariQueue certList
+	var renewQueue, reloadQueue, deleteQueue, ariQueue, gcQueue, urgentQueue certList
 
-	certCache.mu.RLock()
-	for certKey, cert := range certCache.cache {
-		if !cert.managed {
-			continue
-		}
+	// reviewed holds the config of each certificate examined in
+	// this pass, so it can be scheduled for its next examination
+	reviewed := make(map[string]*Config)
 
-		// the list of names on this cert should never be empty... programmer error?
-		if cert.Names == nil || len(cert.Names) == 0 {
-			log.Warn("certificate has no names; removing from cache", zap.String("cert_key", certKey))
-			deleteQueue = append(deleteQueue, cert)
-			continue
-		}
-
-		// get the config associated with this certificate
-		cfg, err := certCache.getConfig(cert)
-		if err != nil {
-			log.Error("unable to get configuration to manage certificate; unable to renew",
-				zap.Strings("identifiers", cert.Names),
-				zap.Error(err))
-			continue
-		}
-		if cfg == nil {
-			// this is bad if this happens, probably a programmer error (oops)
-			log.Error("no configuration associated with certificate; unable to manage",
-				zap.Strings("identifiers", cert.Names))
-			continue
-		}
-		if cfg.OnDemand != nil {
-			continue
-		}
-
-		// ACME-specific: see if if ACME Renewal Info (ARI) window needs refreshing
-		if !cfg.DisableARI && cert.ari.NeedsRefresh() {
-			configs[cert.hash] = cfg
-			ariQueue = append(ariQueue, cert)
-		}
+	// only the certificates that are due are examined; see expiryBuckets
+	certCache.mu.RLock()
+	due := certCache.reviews.due(timeNow())
+	log.Debug("examining managed certificates due for maintenance",
+		zap.Int("due", len(due)),
+		zap.Int("managed", certCache.reviews.len()))
+	for _, certKey := range due {
+		func() {
+			defer certCache.recoverPanic(ctx, log, "renewal check", zap.String("cert_key", certKey))
+
+			cert, ok := certCache.cache[certKey]
+			if !ok || !cert.managed {
+				return
+			}
 
-		// if time is up or expires soon, we need to try to renew it
-		if cert.NeedsRenewal(cfg) {
-			configs[cert.hash] = cfg
+			// the list of names on this cert should never be empty... programmer error?
+			if cert.Names == nil || len(cert.Names) == 0 {
+				log.Warn("certificate has no names; removing from cache", zap.String("cert_key", certKey))
+				deleteQueue = append(deleteQueue, cert)
+				return
+			}
 
-			// see if the certificate in storage has already been renewed, possibly by another
-			// instance that didn't coordinate with this one; if so, just load it (this
-			// might happen if another instance already renewed it - kinda sloppy but checking disk
-			// first is a simple way to possibly drastically reduce rate limit problems)
-			storedCertNeedsRenew, err := cfg.managedCertInStorageNeedsRenewal(ctx, cert)
+			// get the config associated with this certificate
+			cfg, err := certCache.getConfig(cert)
 			if err != nil {
-				// hmm, weird, but not a big deal, maybe it was deleted or something
-				log.Warn("error while checking if stored certificate is also expiring soon",
+				log.Error("unable to get configuration to manage certificate; unable to renew",
 					zap.Strings("identifiers", cert.Names),
 					zap.Error(err))
-			} else if !storedCertNeedsRenew {
-				// if the certificate does NOT need renewal and there was no error, then we
-				// are good to just reload the certificate from storage instead of repeating
-				// a likely-unnecessary renewal procedure
+				return
+			}
+			if cfg == nil {
+				// this is bad if this happens, probably a programmer error (oops)
+				log.Error("no configuration associated with certificate; unable to manage",
+					zap.Strings("identifiers", cert.Names))
+				return
+			}
+			reviewed[cert.hash] = cfg
+
+			if urgentLimit > 0 {
+				if cfg.OnDemand == nil && cert.NeedsRenewal(cfg) {
+					configs[cert.hash] = cfg
+					urgentQueue = append(urgentQueue, cert)
+				}
+				return
+			}
+
+			// expired certificates may no longer be needed, in which case
+			// they are removed; but that has to be determined outside the lock
+			if cfg.expiredBeyondGracePeriod(cert) {
+				configs[cert.hash] = cfg
+				gcQueue = append(gcQueue, cert)
+			}
+
+			if cfg.OnDemand != nil {
+				return
+			}
+
+			// certificates of other shards are renewed by their owners;
+			// we only reload them from storage once they are renewed
+			if !certCache.ownsCert(cert) {
+				if cert.NeedsRenewal(cfg) {
+					if renew, err := cfg.managedCertInStorageNeedsRenewal(ctx, cert); err == nil && !renew {
+						configs[cert.hash] = cfg
+						reloadQueue = append(reloadQueue, cert)
+					}
+				}
+				return
+			}
+
+			// ACME-specific: see if if ACME Renewal Info (ARI) window needs refreshing
+			if !cfg.DisableARI && cert.ari.NeedsRefresh() {
+				configs[cert.hash] = cfg
+				ariQueue = append(ariQueue, cert)
+			}
+
+			// if time is up or expires soon, we need to try to renew it
+			if cert.NeedsRenewal(cfg) {
+				configs[cert.hash] = cfg
+
+				// see if the certificate in storage has already been renewed, possibly by another
+				// instance that didn't coordinate with this one; if so, just load it (this
+				// might happen if another instance already renewed it - kinda sloppy but checking disk
+				// first is a simple way to possibly drastically reduce rate limit problems)
+				storedCertNeedsRenew, err := cfg.managedCertInStorageNeedsRenewal(ctx, cert)
+				if err != nil {
+					// hmm, weird, but not a big deal, maybe it was deleted or something
+					log.Warn("error while checking if stored certificate is also expiring soon",
+						zap.Strings("identifiers", cert.Names),
+						zap.Error(err))
+				} else if !storedCertNeedsRenew {
+					// if the certificate does NOT need renewal and there was no error, then we
+					// are good to just reload the certificate from storage instead of repeating
+					// a likely-unnecessary renewal procedure
+					reloadQueue = append(reloadQueue, cert)
+					return
+				}
+
+				// the certificate in storage has not been renewed yet, so we will do it
+				// NOTE: It is super-important to note that the TLS-ALPN challenge requires
+				// a write lock on the cache in order to complete its challenge, so it is extra
+				// vital that this renew operation does not happen inside our read lock!
+				renewQueue.insert(cert)
+			}
+		}()
+	}
+	certCache.mu.RUnlock()
+
+	// Only renew the most urgent certificates in a catch-up pass
+	if urgentLimit > 0 {
+		sort.Slice(urgentQueue, func(i, j int) bool {
+			return expiresAt(urgentQueue[i].Leaf).Before(expiresAt(urgentQueue[j].Leaf))
+		})
+		if len(urgentQueue) > urgentLimit {
+			urgentQueue = urgentQueue[:urgentLimit]
+		}
+		for _, cert := range urgentQueue {
+			storedCertNeedsRenew, err := configs[cert.hash].managedCertInStorageNeedsRenewal(ctx, cert)
+			if err == nil && !storedCertNeedsRenew {
 				reloadQueue = append(reloadQueue, cert)
-				continue
+			} else {
+				renewQueue = append(renewQueue, cert)
 			}
+		}
+	}
 
-			// the certificate in storage has not been renewed yet, so we will do it
-			// NOTE: It is super-important to note that the TLS-ALPN challenge requires
-			// a write lock on the cache in order to complete its challenge, so it is extra
-			// vital that this renew operation does not happen inside our read lock!
-			renewQueue.insert(cert)
+	// Remove expired certificates that are no longer needed, so
+	// that they are not renewed or reloaded
+	removed := make(map[string]bool)
+	for _, cert := range gcQueue {
+		cfg := configs[cert.hash]
+		if reason := certCache.certIsAbandoned(ctx, cfg, cert); reason != "" {
+			certCache.collectExpiredCert(ctx, log, cfg, cert, reason)
+			removed[cert.hash] = true
 		}
 	}
-	certCache.mu.RUnlock()
+	if len(removed) > 0 {
+		ariQueue = ariQueue.without(removed)
+		reloadQueue = reloadQueue.without(removed)
+		renewQueue = renewQueue.without(removed)
+	}
 
 	// Update ARI, and then for any certs where the ARI window changed,
 	// be sure to queue them for renewal if necessary
@@ -191,9 +396,31 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 		}
 	}
 
+	// Defer renewals and reloads during renewal blackouts; the
+	// certificates are examined again when the blackouts end
+	deferred := make(map[string]time.Time)
+	deferDuringBlackout := func(queue certList) certList {
+		kept := queue[:0]
+		for _, cert := range queue {
+			until := configs[cert.hash].renewalDeferredUntil(cert)
+			if until.IsZero() {
+				kept = append(kept, cert)
+				continue
+			}
+			log.Info("certificate expires soon, but renewal blackout is in effect; deferring",
+				zap.Strings("identifiers", cert.Names),
+				zap.Time("expiration", expiresAt(cert.Leaf)),
+				zap.Time("deferred_until", until))
+			deferred[cert.hash] = until
+		}
+		return kept
+	}
+	reloadQueue = deferDuringBlackout(reloadQueue)
+	renewQueue = deferDuringBlackout(renewQueue)
+
 	// Reload certificates that merely need to be updated in memory
 	for _, oldCert := range reloadQueue {
-		timeLeft := expiresAt(oldCert.Leaf).Sub(time.Now().UTC())
+		timeLeft := expiresAt(oldCert.Leaf).Sub(timeNow().UTC())
 		log.Info("certificate expires soon, but is already renewed in storage; reloading stored certificate",
 			zap.Strings("identifiers", oldCert.Names),
 			zap.Duration("remaining", timeLeft))
@@ -227,6 +454,20 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 	for _, cert := range deleteQueue {
 		certCache.removeCertificate(cert)
 	}
+
+	// Schedule the next examination of the certificates that were examined,
+	// except in a catch-up pass, which leaves them due for the next full pass
+	if urgentLimit <= 0 {
+		for hash, cfg := range reviewed {
+			if cert, ok := certCache.cache[hash]; ok {
+				if until, ok := deferred[hash]; ok {
+					certCache.reviews.schedule(hash, until)
+				} else {
+					certCache.reviews.schedule(hash, cfg.nextReview(cert))
+				}
+			}
+		}
+	}
 	certCache.mu.Unlock()
 
 	return nil
@@ -235,7 +476,7 @@ func (certCache *Cache) RenewManagedCertificates(ctx context.Context) error {
 func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificate, cfg *Config) error {
 	log := certCache.logger.Named("maintenance")
 
-	timeLeft := expiresAt(oldCert.Leaf).Sub(time.Now().UTC())
+	timeLeft := expiresAt(oldCert.Leaf).Sub(timeNow().UTC())
 	log.Info("certificate expires soon; queuing for renewal",
 		zap.Strings("identifiers", oldCert.Names),
 		zap.Duration("remaining", timeLeft))
@@ -246,8 +487,22 @@ func (certCache *Cache) queueRenewalTask(ctx context.Context, oldCert Certificat
 	renewName := oldCert.Names[0]
 
 	// queue up this renewal job (is a no-op if already active or queued)
-	jm.Submit(cfg.Logger, "renew_"+renewName, func() error {
-		timeLeft := expiresAt(oldCert.Leaf).Sub(time.Now().UTC())
+	cfg.submitJob(ctx, "renew_"+renewName, "renew", renewName, jobPriority{deadline: expiresAt(oldCert.Leaf)}, func(ctx context.Context) error {
+		// the job may have been queued before a renewal blackout began,
+		// in which case it is deferred until the blackout ends
+		if until := cfg.renewalDeferredUntil(oldCert); !until.IsZero() {
+			log.Info("renewal blackout is in effect; deferring queued renewal",
+				zap.Strings("identifiers", oldCert.Names),
+				zap.Time("deferred_until", until))
+			certCache.mu.Lock()
+			if _, ok := certCache.cache[oldCert.hash]; ok {
+				certCache.reviews.schedule(oldCert.hash, until)
+			}
+			certCache.mu.Unlock()
+			return nil
+		}
+
+		timeLeft := expiresAt(oldCert.Leaf).Sub(timeNow().UTC())
 		log.Info("attempting certificate renewal",
 			zap.Strings("identifiers", oldCert.Names),
 			zap.Duration("remaining", timeLeft))
@@ -296,52 +551,76 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 		certHash       string
 		lastNextUpdate time.Time
 		cfg            *Config
+		owned          bool // see ownsCert
 	}
 	type renewQueueEntry struct {
 		oldCert Certificate
 		cfg     *Config
 	}
 	updated := make(map[string]ocspUpdate)
+	crlRevoked := make(map[string]*x509.RevocationListEntry)
 	var updateQueue []updateQueueEntry // certs that need a refreshed staple
+	var crlQueue []updateQueueEntry    // certs whose CRL needs to be checked
 	var renewQueue []renewQueueEntry   // certs that need to be renewed (due to revocation)
 
+	// followers of a local leader only load staples from storage
+	leader := certCache.isMaintenanceLeader(logger)
+	if !leader {
+		ctx = context.WithValue(ctx, ctxKeyOCSPStorageOnly, true)
+	}
+
 	// obtain brief read lock during our scan to see which staples need updating
 	certCache.mu.RLock()
 	for certHash, cert := range certCache.cache {
-		// no point in updating OCSP for expired or "synthetic" certificates
-		if cert.Leaf == nil || cert.Expired() {
-			continue
-		}
-		cfg, err := certCache.getConfig(cert)
-		if err != nil {
-			logger.Error("unable to get automation config for certificate; maintenance for this certificate will likely fail",
-				zap.Strings("identifiers", cert.Names),
-				zap.Error(err))
-			continue
-		}
-		// always try to replace revoked certificates, even if OCSP response is still fresh
-		if certShouldBeForceRenewed(cert) {
-			renewQueue = append(renewQueue, renewQueueEntry{
-				oldCert: cert,
-				cfg:     cfg,
-			})
-			continue
-		}
-		// if the status is not fresh, get a new one
-		var lastNextUpdate time.Time
-		if cert.ocsp != nil {
-			lastNextUpdate = cert.ocsp.NextUpdate
-			if cert.ocsp.Status != ocsp.Unknown && freshOCSP(cert.ocsp) {
-				// no need to update our staple if still fresh and not Unknown
-				continue
+		func() {
+			defer certCache.recoverPanic(ctx, logger, "OCSP check", zap.Strings("identifiers", cert.Names))
+
+			// no point in updating OCSP for expired or "synthetic" certificates
+			if cert.Leaf == nil || cert.Expired() {
+				return
 			}
-		}
-		updateQueue = append(updateQueue, updateQueueEntry{cert, certHash, lastNextUpdate, cfg})
+			cfg, err := certCache.getConfig(cert)
+			if err != nil {
+				logger.Error("unable to get automation config for certificate; maintenance for this certificate will likely fail",
+					zap.Strings("identifiers", cert.Names),
+					zap.Error(err))
+				return
+			}
+			// certificates of other shards get their staples from storage
+			owned := leader && certCache.ownsCert(cert)
+
+			// always try to replace revoked certificates, even if OCSP response is still fresh
+			if owned && certShouldBeForceRenewed(cert) {
+				renewQueue = append(renewQueue, renewQueueEntry{
+					oldCert: cert,
+					cfg:     cfg,
+				})
+				return
+			}
+			if cfg.CRL.Enabled && !cert.Revoked() && crlDistributionPoint(cert.Leaf) != "" {
+				crlQueue = append(crlQueue, updateQueueEntry{cert: cert, certHash: certHash, cfg: cfg, owned: owned})
+			}
+			// if the status is not fresh, get a new one
+			var lastNextUpdate time.Time
+			if cert.ocsp != nil {
+				lastNextUpdate = cert.ocsp.NextUpdate
+				if cert.ocsp.Status != ocsp.Unknown && freshOCSP(cert.ocsp) {
+					// no need to update our staple if still fresh and not Unknown
+					return
+				}
+			}
+			updateQueue = append(updateQueue, updateQueueEntry{cert, certHash, lastNextUpdate, cfg, owned})
+		}()
 	}
 	certCache.mu.RUnlock()
 
-	// perform updates outside of any lock on certCache
-	for _, qe := range updateQueue {
+	// perform updates outside of any lock on certCache, a few at a time;
+	// mu protects the updates and the renew queue
+	var mu sync.Mutex
+	workers := certCache.ocspWorkers()
+	runConcurrently(len(updateQueue), workers, func(i int) {
+		qe := updateQueue[i]
+		defer certCache.recoverPanic(ctx, logger, "OCSP update", zap.Strings("identifiers", qe.cert.Names))
 		cert := qe.cert
 		certHash := qe.certHash
 		lastNextUpdate := qe.lastNextUpdate
@@ -350,18 +629,33 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 			// this is bad if this happens, probably a programmer error (oops)
 			logger.Error("no configuration associated with certificate; unable to manage OCSP staples",
 				zap.Strings("identifiers", cert.Names))
-			continue
+			return
 		}
 
-		err := stapleOCSP(ctx, qe.cfg.OCSP, qe.cfg.Storage, &cert, nil)
+		stapleCtx := ctx
+		if leader && !qe.owned {
+			stapleCtx = context.WithValue(ctx, ctxKeyOCSPStorageOnly, true)
+		}
+		err := qe.cfg.stapleOCSP(stapleCtx, &cert, nil)
 		if err != nil {
 			if cert.ocsp != nil {
-				// if there was no staple before, that's fine; otherwise we should log the error
-				logger.Error("stapling OCSP",
-					zap.Strings("identifiers", cert.Names),
-					zap.Error(err))
+				// if there was no staple before, that's fine; otherwise we should report the error
+				qe.cfg.warnStapling(ctx, cert, err)
+
+				// keeping the old staple is better than nothing, but only
+				// while it is valid; clients reject expired responses
+				if timeNow().After(cert.ocsp.NextUpdate) {
+					qe.cfg.warn(ctx, Warning{
+						Kind:        WarningStapleSkipped,
+						Message:     "removing expired OCSP staple",
+						Identifiers: cert.Names,
+					})
+					mu.Lock()
+					updated[certHash] = ocspUpdate{}
+					mu.Unlock()
+				}
 			}
-			continue
+			return
 		}
 
 		// By this point, we've obtained the latest OCSP response.
@@ -373,11 +667,13 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 				zap.Strings("identifiers", cert.Names),
 				zap.Time("from", lastNextUpdate),
 				zap.Time("to", cert.ocsp.NextUpdate))
+			mu.Lock()
 			updated[certHash] = ocspUpdate{rawBytes: cert.Certificate.OCSPStaple, parsed: cert.ocsp}
+			mu.Unlock()
 		}
 
 		// If the updated staple shows that the certificate was revoked, we should immediately renew it
-		if certShouldBeForceRenewed(cert) {
+		if qe.owned && certShouldBeForceRenewed(cert) {
 			qe.cfg.emit(ctx, "cert_ocsp_revoked", map[string]any{
 				"subjects":    cert.Names,
 				"certificate": cert,
@@ -385,12 +681,53 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 				"revoked_at":  cert.ocsp.RevokedAt,
 			})
 
+			mu.Lock()
 			renewQueue = append(renewQueue, renewQueueEntry{
 				oldCert: cert,
 				cfg:     qe.cfg,
 			})
+			mu.Unlock()
 		}
-	}
+	})
+
+	// check CRLs of certificates that are not known to be revoked yet;
+	// the CRLs are usually cached, so this is cheap
+	runConcurrently(len(crlQueue), workers, func(i int) {
+		qe := crlQueue[i]
+		defer certCache.recoverPanic(ctx, logger, "CRL check", zap.Strings("identifiers", qe.cert.Names))
+		cert := qe.cert
+		crlCtx := qe.cfg.egressContext(qe.cfg.withWarnings(ctx), cert.Names, cert.Tags)
+		entry, err := checkCRL(crlCtx, qe.cfg.CRL, qe.cfg.OCSP, qe.cfg.Storage, cert, logger)
+		if err != nil {
+			logger.Warn("unable to check CRL",
+				zap.Strings("identifiers", cert.Names),
+				zap.Error(err))
+			return
+		}
+		if entry == nil {
+			return
+		}
+		cert.crl = entry
+		mu.Lock()
+		crlRevoked[qe.certHash] = entry
+		mu.Unlock()
+
+		if qe.owned && certShouldBeForceRenewed(cert) {
+			qe.cfg.emit(ctx, "cert_crl_revoked", map[string]any{
+				"subjects":    cert.Names,
+				"certificate": cert,
+				"reason":      entry.ReasonCode,
+				"revoked_at":  entry.RevocationTime,
+			})
+
+			mu.Lock()
+			renewQueue = append(renewQueue, renewQueueEntry{
+				oldCert: cert,
+				cfg:     qe.cfg,
+			})
+			mu.Unlock()
+		}
+	})
 
 	// These write locks should be brief since we have all the info we need now.
 	for certKey, update := range updated {
@@ -402,6 +739,17 @@ func (certCache *Cache) updateOCSPStaples(ctx context.Context) {
 		}
 		certCache.mu.Unlock()
 	}
+	for certKey, entry := range crlRevoked {
+		certCache.mu.Lock()
+		if cert, ok := certCache.cache[certKey]; ok {
+			cert.crl = entry
+			certCache.cache[certKey] = cert
+		}
+		certCache.mu.Unlock()
+	}
+	if leader && len(updated)+len(crlRevoked) > 0 {
+		certCache.signalLocalFollowers()
+	}
 
 	// We attempt to replace any certificates that were revoked.
 	// Crucially, this happens OUTSIDE a lock on the certCache.
@@ -639,8 +987,38 @@ type CleanStorageOptions struct {
 	// how long to let them stay after they've expired.
 	ExpiredCerts           bool
 	ExpiredCertGracePeriod time.Duration
+
+	// Optional function that reports whether certificates
+	// for name are still managed. If set, expired certificates
+	// are only cleaned up if none of their names are managed.
+	// EXPERIMENTAL: Subject to change or removal.
+	ExpiredCertIsManaged func(ctx context.Context, name string) bool
+
+	// Whether to delete locks that have not been refreshed
+	// for StaleLockAge, such as those left behind by crashed
+	// instances. Only locks that are kept in the key space of
+	// the storage, as with FileStorage, can be found.
+	// Default age: DefaultStaleLockAge.
+	// EXPERIMENTAL: Subject to change or removal.
+	StaleLocks   bool
+	StaleLockAge time.Duration
+
+	// Whether to delete private keys and metadata of
+	// certificates whose certificate file is missing,
+	// such as those left behind by interrupted writes,
+	// once they have not been modified for OrphanedAssetAge.
+	// Default age: DefaultOrphanedAssetAge.
+	// EXPERIMENTAL: Subject to change or removal.
+	OrphanedAssets   bool
+	OrphanedAssetAge time.Duration
 }
 
+// Default retention periods of CleanStorage.
+const (
+	DefaultStaleLockAge     = time.Hour
+	DefaultOrphanedAssetAge = 24 * time.Hour
+)
+
 // CleanStorage removes assets which are no longer useful,
 // according to opts.
 func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions) error {
@@ -701,12 +1079,35 @@ func CleanStorage(ctx context.Context, storage Storage, opts CleanStorageOptions
 		}
 	}
 	if opts.ExpiredCerts {
-		err := deleteExpiredCerts(ctx, storage, opts.Logger, opts.ExpiredCertGracePeriod)
+		err := deleteExpiredCerts(ctx, storage, opts.Logger, opts.ExpiredCertGracePeriod, opts.ExpiredCertIsManaged)
 		if err != nil {
 			opts.Logger.Error("deleting expired certificates staples", zap.Error(err))
 		}
+		err = deleteExpiredIndexEntries(ctx, storage, opts.Logger, opts.ExpiredCertGracePeriod)
+		if err != nil {
+			opts.Logger.Error("deleting index entries of expired certificates", zap.Error(err))
+		}
+	}
+	if opts.StaleLocks {
+		age := opts.StaleLockAge
+		if age <= 0 {
+			age = DefaultStaleLockAge
+		}
+		err := deleteStaleLocks(ctx, storage, opts.Logger, age)
+		if err != nil {
+			opts.Logger.Error("deleting stale locks", zap.Error(err))
+		}
+	}
+	if opts.OrphanedAssets {
+		age := opts.OrphanedAssetAge
+		if age <= 0 {
+			age = DefaultOrphanedAssetAge
+		}
+		err := deleteOrphanedAssets(ctx, storage, opts.Logger, age)
+		if err != nil {
+			opts.Logger.Error("deleting orphaned assets", zap.Error(err))
+		}
 	}
-	// TODO: delete stale locks?
 
 	// update the last-clean time
 	lastCleanBytes, err := json.Marshal(lastCleanPayload{
@@ -759,7 +1160,7 @@ func deleteOldOCSPStaples(ctx context.Context, storage Storage, logger *zap.Logg
 			}
 			continue
 		}
-		if time.Now().After(resp.NextUpdate) {
+		if timeNow().After(resp.NextUpdate) {
 			// response has expired; delete it
 			err = storage.Delete(ctx, key)
 			if err != nil {
@@ -770,7 +1171,7 @@ func deleteOldOCSPStaples(ctx context.Context, storage Storage, logger *zap.Logg
 	return nil
 }
 
-func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger, gracePeriod time.Duration) error {
+func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger, gracePeriod time.Duration, isManaged func(context.Context, string) bool) error {
 	issuerKeys, err := storage.List(ctx, prefixCerts, false)
 	if err != nil {
 		// maybe just hasn't been created yet; no big deal
@@ -816,7 +1217,10 @@ func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger
 					return fmt.Errorf("certificate file %s is malformed; error parsing PEM: %v", assetKey, err)
 				}
 
-				if expiredTime := time.Since(expiresAt(cert)); expiredTime >= gracePeriod {
+				if expiredTime := timeNow().Sub(expiresAt(cert)); expiredTime >= gracePeriod {
+					if isManaged != nil && certNameIsManaged(ctx, cert, isManaged) {
+						continue
+					}
 					logger.Info("certificate expired beyond grace period; cleaning up",
 						zap.String("asset_key", assetKey),
 						zap.Duration("expired_for", expiredTime),
@@ -856,11 +1260,123 @@ func deleteExpiredCerts(ctx context.Context, storage Storage, logger *zap.Logger
 	return nil
 }
 
+func deleteStaleLocks(ctx context.Context, storage Storage, logger *zap.Logger, age time.Duration) error {
+	lockKeys, err := storage.List(ctx, prefixLocks, false)
+	if err != nil {
+		// storage may not keep its locks in its key space
+		return nil
+	}
+	for _, key := range lockKeys {
+		// if context was cancelled, quit early; otherwise proceed
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		info, err := storage.Stat(ctx, key)
+		if err != nil || !info.IsTerminal {
+			continue
+		}
+		if unused := timeNow().Sub(info.Modified); unused >= age {
+			logger.Info("deleting stale lock",
+				zap.String("storage_key", key),
+				zap.Duration("unused_for", unused))
+			if err := storage.Delete(ctx, key); err != nil {
+				logger.Error("could not delete stale lock", zap.String("storage_key", key), zap.Error(err))
+			}
+		}
+	}
+	return nil
+}
+
+// deleteOrphanedAssets deletes the private keys and metadata of
+// certificates that are not in storage, after they were unmodified
+// for age, to give writes that are in progress time to finish.
+func deleteOrphanedAssets(ctx context.Context, storage Storage, logger *zap.Logger, age time.Duration) error {
+	issuerKeys, err := storage.List(ctx, prefixCerts, false)
+	if err != nil {
+		// maybe just hasn't been created yet; no big deal
+		return nil
+	}
+
+	for _, issuerKey := range issuerKeys {
+		siteKeys, err := storage.List(ctx, issuerKey, false)
+		if err != nil {
+			logger.Error("listing contents", zap.String("issuer_key", issuerKey), zap.Error(err))
+			continue
+		}
+
+		for _, siteKey := range siteKeys {
+			// if context was cancelled, quit early; otherwise proceed
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+
+			siteAssets, err := storage.List(ctx, siteKey, false)
+			if err != nil {
+				logger.Error("listing site contents", zap.String("site_key", siteKey), zap.Error(err))
+				continue
+			}
+
+			var deleted int
+			for _, assetKey := range siteAssets {
+				ext := path.Ext(assetKey)
+				if ext != ".key" && ext != ".json" {
+					continue
+				}
+				if slices.Contains(siteAssets, strings.TrimSuffix(assetKey, ext)+".crt") {
+					continue
+				}
+				info, err := storage.Stat(ctx, assetKey)
+				if err != nil || timeNow().Sub(info.Modified) < age {
+					continue
+				}
+				logger.Info("deleting asset of missing certificate", zap.String("asset_key", assetKey))
+				if err := storage.Delete(ctx, assetKey); err != nil {
+					logger.Error("could not delete orphaned asset", zap.String("asset_key", assetKey), zap.Error(err))
+					continue
+				}
+				deleted++
+			}
+
+			if deleted > 0 && deleted == len(siteAssets) {
+				logger.Info("deleting site folder because key is empty", zap.String("site_key", siteKey))
+				if err := storage.Delete(ctx, siteKey); err != nil {
+					return fmt.Errorf("deleting empty site folder %s: %v", siteKey, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// certNameIsManaged returns true if isManaged reports any of the
+// subject names on cert as managed.
+func certNameIsManaged(ctx context.Context, cert *x509.Certificate, isManaged func(context.Context, string) bool) bool {
+	var names []string
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, name := range names {
+		if isManaged(ctx, strings.ToLower(name)) {
+			return true
+		}
+	}
+	return false
+}
+
 // forceRenew forcefully renews cert and replaces it in the cache, and returns the new certificate. It is intended
 // for use primarily in the case of cert revocation. This MUST NOT be called within a lock on cfg.certCacheMu.
 func (cfg *Config) forceRenew(ctx context.Context, logger *zap.Logger, cert Certificate) (Certificate, error) {
-	if cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
-		logger.Warn("OCSP status for managed certificate is REVOKED; attempting to replace with new certificate",
+	if cert.Revoked() {
+		logger.Warn("managed certificate is REVOKED; attempting to replace with new certificate",
+			zap.Bool("by_crl", cert.crl != nil),
 			zap.Strings("identifiers", cert.Names),
 			zap.Time("expiration", expiresAt(cert.Leaf)))
 	} else {
@@ -879,7 +1395,7 @@ func (cfg *Config) forceRenew(ctx context.Context, logger *zap.Logger, cert Cert
 	// of a prior key, we can't do a "renew" to replace the cert if we need a
 	// new key, so we'll have to do an obtain instead
 	var obtainInsteadOfRenew bool
-	if cert.ocsp != nil && cert.ocsp.RevocationReason == acme.ReasonKeyCompromise {
+	if _, reason, revoked := cert.revocation(); revoked && reason == acme.ReasonKeyCompromise {
 		err := cfg.moveCompromisedPrivateKey(ctx, cert, logger)
 		if err != nil {
 			logger.Error("could not remove compromised private key from use",
@@ -892,7 +1408,8 @@ func (cfg *Config) forceRenew(ctx context.Context, logger *zap.Logger, cert Cert
 
 	var err error
 	if obtainInsteadOfRenew {
-		err = cfg.ObtainCertAsync(ctx, renewName)
+		// the new certificate still replaces the old one, as far as ARI is concerned
+		err = cfg.ObtainCertAsync(context.WithValue(ctx, ctxKeyReplacedCert, cert), renewName)
 	} else {
 		// notice that we force renewal; otherwise, it might see that the
 		// certificate isn't close to expiring and return, but we really
@@ -900,9 +1417,9 @@ func (cfg *Config) forceRenew(ctx context.Context, logger *zap.Logger, cert Cert
 		err = cfg.RenewCertAsync(ctx, renewName, true)
 	}
 	if err != nil {
-		if cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
+		if cert.Revoked() {
 			// probably better to not serve a revoked certificate at all
-			logger.Error("unable to obtain new to certificate after OCSP status of REVOKED; removing from cache",
+			logger.Error("unable to obtain new to certificate after status of REVOKED; removing from cache",
 				zap.Strings("identifiers", cert.Names),
 				zap.Error(err))
 			cfg.certCache.mu.Lock()
@@ -947,12 +1464,11 @@ func (cfg *Config) moveCompromisedPrivateKey(ctx context.Context, cert Certifica
 }
 
 // certShouldBeForceRenewed returns true if cert should be forcefully renewed
-// (like if it is revoked according to its OCSP response).
+// (like if it is revoked according to its OCSP response or CRL).
 func certShouldBeForceRenewed(cert Certificate) bool {
 	return cert.managed &&
 		len(cert.Names) > 0 &&
-		cert.ocsp != nil &&
-		cert.ocsp.Status == ocsp.Revoked
+		cert.Revoked()
 }
 
 type certList []Certificate
@@ -968,6 +1484,17 @@ func (certs *certList) insert(cert Certificate) {
 	*certs = append(*certs, cert)
 }
 
+// without returns the certs in the list whose hashes are not in hashes.
+func (certs certList) without(hashes map[string]bool) certList {
+	var remaining certList
+	for _, c := range certs {
+		if !hashes[c.hash] {
+			remaining = append(remaining, c)
+		}
+	}
+	return remaining
+}
+
 const (
 	// DefaultRenewCheckInterval is how often to check certificates for expiration.
 	// Scans are very lightweight, so this can be semi-frequent. This default should
@@ -983,4 +1510,8 @@ const (
 
 	// DefaultOCSPCheckInterval is how often to check if OCSP stapling needs updating.
 	DefaultOCSPCheckInterval = 1 * time.Hour
+
+	// DefaultCatchUpLimit is how many of the most urgent certificates
+	// a catch-up pass renews by default (see CacheOptions.CatchUpLimit).
+	DefaultCatchUpLimit = 100
 )
@@ -0,0 +1,171 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestRenewalPassCatchUp(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.RenewalWindowRatio = 1 // always due
+	soon, later := testSubject(t, "soon"), testSubject(t, "later")
+	cfg.CertLifetimeFunc = func(_ context.Context, name string) time.Duration {
+		if name == soon {
+			return 10 * 24 * time.Hour
+		}
+		return 20 * 24 * time.Hour
+	}
+	for _, name := range []string{soon, later} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a tick while a pass is running is skipped, and a catch-up is queued
+	var passes sync.WaitGroup
+	cfg.certCache.renewalPassStarted.Store(timeNow().UnixNano())
+	cfg.certCache.startRenewalPass(ctx, zap.NewNop(), &passes)
+	passes.Wait()
+	if !cfg.certCache.catchUpPending.Load() {
+		t.Error("expected catch-up pass to be pending after skipped pass")
+	}
+	if issued := len(fi.Issued()); issued != 2 {
+		t.Errorf("expected skipped pass not to renew, got %d issuances", issued)
+	}
+	cfg.certCache.renewalPassStarted.Store(0)
+
+	// both certificates need renewal, but a catch-up pass
+	// only renews the ones that expire soonest
+	if err := cfg.certCache.renewManagedCertificates(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	waitForRenewal(t, cfg, fi, soon, 2)
+	time.Sleep(100 * time.Millisecond) // in case later was renewed too
+	issued := fi.Issued()
+	if len(issued) != 3 || len(issued[2].DNSNames) != 1 || issued[2].DNSNames[0] != soon {
+		t.Fatalf("expected only %s to be renewed, got %d issuances", soon, len(issued))
+	}
+
+	// a full pass renews the rest
+	if err := cfg.certCache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForRenewal(t, cfg, fi, soon, 3)
+	waitForRenewal(t, cfg, fi, later, 2)
+	if issued := fi.Issued(); len(issued) != 5 {
+		t.Errorf("expected full pass to renew both certificates, got %d issuances", len(issued))
+	}
+}
+
+// waitForIssuances waits until fi issued n certificates,
+// since renewals run as background jobs.
+func waitForIssuances(t *testing.T, fi *FakeIssuer, n int) []*x509.Certificate {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if issued := fi.Issued(); len(issued) >= n {
+			return issued
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fi.Issued()
+}
+
+// waitForRenewal waits until fi issued n certificates for name and the
+// last of them is in cfg's cache, since renewals run as background jobs
+// which, until they finish, prevent the same renewal from being queued
+// again.
+func waitForRenewal(t *testing.T, cfg *Config, fi *FakeIssuer, name string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var issued []*x509.Certificate
+		for _, leaf := range fi.Issued() {
+			if leaf.DNSNames[0] == name {
+				issued = append(issued, leaf)
+			}
+		}
+		if len(issued) >= n {
+			certs := cfg.certCache.getAllMatchingCerts(name)
+			if len(certs) > 0 && certs[0].Leaf.Equal(issued[len(issued)-1]) {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s was not renewed %d times in time", name, n)
+}
+
+// testSubject returns a subject name that is unique to the test, so
+// that its background jobs cannot collide with those of other tests.
+func testSubject(t *testing.T, label string) string {
+	return label + "." + strings.ToLower(t.Name()) + ".example.com"
+}
+
+type replacesRecordingIssuer struct {
+	*FakeIssuer
+	replaces []*x509.Certificate
+}
+
+func (ri *replacesRecordingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	replacing, _ := ctx.Value(ctxKeyARIReplaces).(*x509.Certificate)
+	ri.replaces = append(ri.replaces, replacing)
+	return ri.FakeIssuer.Issue(ctx, csr)
+}
+
+func TestForceRenewCompromisedKeyReplacesCertificate(t *testing.T) {
+	ctx := context.Background()
+	iss := &replacesRecordingIssuer{FakeIssuer: new(FakeIssuer)}
+	cfg := newOnDemandTestConfig(t, iss)
+	cfg.OnDemand = nil
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if iss.replaces[0] != nil {
+		t.Error("expected first certificate not to replace any")
+	}
+
+	// revoked for key compromise: a new certificate is obtained with a new key
+	cert.crl = &x509.RevocationListEntry{SerialNumber: cert.Leaf.SerialNumber, ReasonCode: 1}
+	renewed, err := cfg.forceRenew(ctx, zap.NewNop(), cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(iss.replaces) != 2 || iss.replaces[1] != cert.Leaf {
+		t.Errorf("expected new certificate to replace the compromised one, got %v", iss.replaces)
+	}
+	if renewed.Leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool }).Equal(cert.Leaf.PublicKey) {
+		t.Error("expected new private key")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"math"
+	"runtime/debug"
+	"runtime/metrics"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RelieveMemoryPressure frees memory held by the cache, for use when
+// the host is under memory pressure; for example, from a handler of
+// cgroup memory events. It drops the CRLs and the issuer certificates
+// (fetched for OCSP) held in memory, and evicts the given fraction
+// (between 0 and 1) of the certificates that can be evicted, least
+// recently served first. It returns the number of evicted certificates.
+//
+// The cache does not keep PEM bundles: a certificate is held only in
+// parsed form, with its chain, so evicting it frees its bundle, too.
+//
+// Only managed certificates of configs with on-demand TLS enabled
+// can be evicted, since they are loaded from storage again the next
+// time they are needed in a handshake; all other certificates would
+// no longer be served, so they stay in the cache.
+//
+// To have the cache relieve memory pressure on its own when the Go
+// runtime nears its memory limit, set CacheOptions.MemoryPressureThreshold.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (certCache *Cache) RelieveMemoryPressure(ctx context.Context, fraction float64) int {
+	crls := dropCRLCache()
+	issuers := dropIssuerCertCache()
+
+	evictable := certCache.evictableCerts()
+	n := int(math.Ceil(float64(len(evictable)) * min(max(fraction, 0), 1)))
+
+	// least recently served first; certificates that were never
+	// served have a zero last-served time, so they go first
+	sort.SliceStable(evictable, func(i, j int) bool {
+		a, b := evictable[i], evictable[j]
+		if !a.LastServed().Equal(b.LastServed()) {
+			return a.LastServed().Before(b.LastServed())
+		}
+		return a.Handshakes() < b.Handshakes()
+	})
+
+	var evicted int
+	certCache.mu.Lock()
+	for _, cert := range evictable[:n] {
+		if _, ok := certCache.cache[cert.hash]; ok {
+			certCache.removeCertificate(cert)
+			certCache.evictions.Add(1)
+			certCache.events.publish("cached_managed_cert_evicted", map[string]any{
+				"sans":   cert.Names,
+				"reason": "memory_pressure",
+			})
+			evicted++
+		}
+	}
+	certCache.mu.Unlock()
+
+	certCache.logger.Info("relieved memory pressure",
+		zap.Int("evicted_certificates", evicted),
+		zap.Int("dropped_crls", crls),
+		zap.Int("dropped_issuer_certs", issuers))
+
+	certCache.optionsMu.RLock()
+	onEvent := certCache.options.OnEvent
+	certCache.optionsMu.RUnlock()
+	if onEvent != nil {
+		_ = onEvent(ctx, "cache_memory_pressure", map[string]any{
+			"evicted":              evicted,
+			"dropped_crls":         crls,
+			"dropped_issuer_certs": issuers,
+		})
+	}
+
+	return evicted
+}
+
+// evictableCerts returns the cached certificates that are loaded
+// from storage on demand, so that they can be evicted safely.
+func (certCache *Cache) evictableCerts() []Certificate {
+	var candidates []Certificate
+	certCache.mu.RLock()
+	for _, cert := range certCache.cache {
+		if cert.managed {
+			candidates = append(candidates, cert)
+		}
+	}
+	certCache.mu.RUnlock()
+
+	// getting configs may be slow, so do it without the lock
+	evictable := candidates[:0]
+	for _, cert := range candidates {
+		cfg, err := certCache.getConfig(cert)
+		if err == nil && cfg.OnDemand != nil {
+			evictable = append(evictable, cert)
+		}
+	}
+	return evictable
+}
+
+// dropCRLCache removes all CRLs from memory and returns how
+// many there were; they are loaded from storage as needed.
+func dropCRLCache() int {
+	crlCacheMu.Lock()
+	defer crlCacheMu.Unlock()
+	n := len(crlCache)
+	clear(crlCache)
+	return n
+}
+
+// dropIssuerCertCache removes all issuer certificates from memory
+// and returns how many there were; they are fetched again as needed.
+func dropIssuerCertCache() int {
+	issuerCertsMu.Lock()
+	defer issuerCertsMu.Unlock()
+	n := len(issuerCerts)
+	clear(issuerCerts)
+	return n
+}
+
+// checkMemoryPressure relieves memory pressure if the memory used by
+// the Go runtime exceeds the cache's MemoryPressureThreshold of the
+// runtime's memory limit.
+func (certCache *Cache) checkMemoryPressure(ctx context.Context, logger *zap.Logger) {
+	certCache.optionsMu.RLock()
+	threshold := certCache.options.MemoryPressureThreshold
+	certCache.optionsMu.RUnlock()
+
+	used, limit := readMemoryUsage()
+	if threshold <= 0 || limit == math.MaxInt64 || float64(used) < threshold*float64(limit) {
+		return
+	}
+	logger.Warn("memory use is near the limit of the Go runtime",
+		zap.Uint64("used_bytes", used),
+		zap.Int64("limit_bytes", limit))
+	certCache.RelieveMemoryPressure(ctx, memoryPressureEvictFraction)
+}
+
+// readMemoryUsage returns the memory used by the Go runtime, as
+// counted against its memory limit, and the limit; the limit is
+// math.MaxInt64 if there is none. It is a variable for tests.
+var readMemoryUsage = func() (used uint64, limit int64) {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 || samples[1].Value.Kind() != metrics.KindUint64 {
+		return 0, math.MaxInt64
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64(), debug.SetMemoryLimit(-1)
+}
+
+// memoryPressureEvictFraction is the fraction of the evictable
+// certificates that are evicted when the memory use of the Go
+// runtime exceeds the MemoryPressureThreshold.
+const memoryPressureEvictFraction = 0.25
+
+// memoryPressureCheckInterval is how often the memory use of the Go
+// runtime is checked when a MemoryPressureThreshold is set.
+const memoryPressureCheckInterval = 15 * time.Second
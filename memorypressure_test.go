@@ -0,0 +1,138 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRelieveMemoryPressure(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cache := cfg.certCache
+
+	names := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com"}
+	for i, name := range names {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		// a and b were never served; d was served most
+		cert := cache.getAllMatchingCerts(name)[0]
+		for j := 0; j < i-1; j++ {
+			cert.usage.record()
+		}
+	}
+	unmanaged, _ := issueFakeCertificate(t, fi, "unmanaged.example.com")
+	cache.cacheCertificate(unmanaged)
+
+	crlCacheMu.Lock()
+	crlCache[crlCacheKey{url: "memory-pressure-test"}] = new(cachedCRL)
+	crlCacheMu.Unlock()
+	issuerCertsMu.Lock()
+	issuerCerts["memory-pressure-test"] = new(x509.Certificate)
+	issuerCertsMu.Unlock()
+
+	var events []map[string]any
+	cache.optionsMu.Lock()
+	cache.options.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "cache_memory_pressure" {
+			events = append(events, data)
+		}
+		return nil
+	}
+	cache.optionsMu.Unlock()
+
+	if evicted := cache.RelieveMemoryPressure(ctx, 0.5); evicted != 2 {
+		t.Errorf("expected 2 certificates to be evicted, got %d", evicted)
+	}
+	for _, name := range names {
+		cached := len(cache.getAllMatchingCerts(name)) > 0
+		if wantCached := name == "c.example.com" || name == "d.example.com"; cached != wantCached {
+			t.Errorf("expected %s to be cached: %t, got %t", name, wantCached, cached)
+		}
+	}
+	if len(cache.getAllMatchingCerts("unmanaged.example.com")) == 0 {
+		t.Error("expected unmanaged certificate to stay in the cache")
+	}
+	crlCacheMu.Lock()
+	_, crlCached := crlCache[crlCacheKey{url: "memory-pressure-test"}]
+	crlCacheMu.Unlock()
+	if crlCached {
+		t.Error("expected CRLs to be dropped from memory")
+	}
+	issuerCertsMu.Lock()
+	_, issuerCached := issuerCerts["memory-pressure-test"]
+	issuerCertsMu.Unlock()
+	if issuerCached {
+		t.Error("expected issuer certificates to be dropped from memory")
+	}
+	if len(events) != 1 || events[0]["evicted"] != 2 {
+		t.Errorf("expected one event for 2 evicted certificates, got %v", events)
+	}
+
+	// evicted certificates are loaded again when needed
+	cert, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	if err != nil || len(cert.Certificate) == 0 {
+		t.Errorf("expected evicted certificate to be loaded from storage, got error: %v", err)
+	}
+}
+
+func TestCheckMemoryPressure(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cache := cfg.certCache
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	used, limit := uint64(50), int64(100)
+	defer func(orig func() (uint64, int64)) { readMemoryUsage = orig }(readMemoryUsage)
+	readMemoryUsage = func() (uint64, int64) { return used, limit }
+	check := func() bool {
+		cache.checkMemoryPressure(ctx, zap.NewNop())
+		return len(cache.getAllMatchingCerts("example.com")) > 0
+	}
+
+	if !check() {
+		t.Error("expected no eviction without a threshold")
+	}
+	cache.optionsMu.Lock()
+	cache.options.MemoryPressureThreshold = 0.9
+	cache.optionsMu.Unlock()
+	if !check() {
+		t.Error("expected no eviction below the threshold")
+	}
+	used, limit = 95, math.MaxInt64
+	if !check() {
+		t.Error("expected no eviction without a memory limit")
+	}
+	limit = 100
+	if check() {
+		t.Error("expected eviction above the threshold")
+	}
+}
@@ -0,0 +1,503 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+// MetricsSink receives the metrics of certificate management, which
+// are described by MetricDescs. It is typically implemented with a
+// Prometheus registry using client_golang, which certmagic does not
+// depend on: register a collector of each metric's type with its
+// labels, and look them up by name in the sink's methods. Metrics is
+// a MetricsSink that does not need any other packages.
+//
+// Label values are given in the order of the metric's labels. The
+// methods are called concurrently, and often, so they must be fast.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type MetricsSink interface {
+	// AddCounter adds delta to a counter.
+	AddCounter(name string, delta float64, labelValues ...string)
+
+	// SetGauge sets the value of a gauge.
+	SetGauge(name string, value float64, labelValues ...string)
+
+	// ObserveHistogram adds value to a histogram.
+	ObserveHistogram(name string, value float64, labelValues ...string)
+}
+
+// MetricType is the type of a metric, as named by Prometheus.
+type MetricType string
+
+// Metric types.
+const (
+	CounterMetric   MetricType = "counter"
+	GaugeMetric     MetricType = "gauge"
+	HistogramMetric MetricType = "histogram"
+)
+
+// MetricDesc describes a metric.
+type MetricDesc struct {
+	Name   string
+	Help   string
+	Type   MetricType
+	Labels []string
+
+	// The upper bounds of the buckets of histograms.
+	Buckets []float64
+}
+
+// Names of metrics.
+const (
+	metricManagedCertificates  = "certmagic_managed_certificates"
+	metricRenewalAttempts      = "certmagic_renewal_attempts_total"
+	metricRenewals             = "certmagic_renewals_total"
+	metricOCSPFetchDuration    = "certmagic_ocsp_fetch_duration_seconds"
+	metricOCSPFetchFailures    = "certmagic_ocsp_fetch_failures_total"
+	metricStorageDuration      = "certmagic_storage_operation_duration_seconds"
+	metricStorageErrors        = "certmagic_storage_operation_errors_total"
+	metricOnDemandDecisions    = "certmagic_on_demand_decisions_total"
+	metricACMEChallengeResults = "certmagic_acme_challenges_total"
+)
+
+// MetricDescs describes the metrics that are given to MetricsSinks.
+//
+// EXPERIMENTAL: Subject to change or removal.
+var MetricDescs = []MetricDesc{
+	{
+		Name: metricManagedCertificates,
+		Help: "Number of managed certificates in the cache.",
+		Type: GaugeMetric,
+	},
+	{
+		Name: metricRenewalAttempts,
+		Help: "Attempts to renew a certificate, including retries.",
+		Type: CounterMetric,
+	},
+	{
+		Name:   metricRenewals,
+		Help:   "Finished renewal attempts by result (succeeded or failed).",
+		Type:   CounterMetric,
+		Labels: []string{"result"},
+	},
+	{
+		Name:    metricOCSPFetchDuration,
+		Help:    "Latency of fetching OCSP responses from responders.",
+		Type:    HistogramMetric,
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	},
+	{
+		Name: metricOCSPFetchFailures,
+		Help: "Failed fetches of OCSP responses from responders.",
+		Type: CounterMetric,
+	},
+	{
+		Name:    metricStorageDuration,
+		Help:    "Latency of storage operations of MeteredStorage by operation; Lock includes waiting for the lock.",
+		Type:    HistogramMetric,
+		Labels:  []string{"operation"},
+		Buckets: []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 5},
+	},
+	{
+		Name:   metricStorageErrors,
+		Help:   "Failed storage operations of MeteredStorage by operation; missing keys are not failures.",
+		Type:   CounterMetric,
+		Labels: []string{"operation"},
+	},
+	{
+		Name:   metricOnDemandDecisions,
+		Help:   "Decisions whether to obtain certificates on demand by result (allowed or denied).",
+		Type:   CounterMetric,
+		Labels: []string{"result"},
+	},
+	{
+		Name:   metricACMEChallengeResults,
+		Help:   "Validated ACME challenges by type and result (succeeded or failed).",
+		Type:   CounterMetric,
+		Labels: []string{"type", "result"},
+	},
+}
+
+// DefaultMetricBuckets are the histogram buckets used by
+// Metrics for histograms that are not in MetricDescs.
+var DefaultMetricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// addMetric adds delta to a counter of cfg.Metrics, if set.
+func (cfg *Config) addMetric(name string, delta float64, labelValues ...string) {
+	if cfg.Metrics != nil {
+		cfg.Metrics.AddCounter(name, delta, labelValues...)
+	}
+}
+
+// addOnDemandDecision counts a decision, made during a handshake,
+// whether to obtain a certificate on demand; err is the result of
+// checkIfCertShouldBeObtained. Without on-demand TLS, there is no
+// decision to count.
+func (cfg *Config) addOnDemandDecision(err error) {
+	if cfg.OnDemand == nil {
+		return
+	}
+	result := "allowed"
+	if err != nil {
+		result = "denied"
+	}
+	cfg.addMetric(metricOnDemandDecisions, 1, result)
+}
+
+// withMetrics returns ctx with the metrics sink for
+// functions that do not have access to the config.
+func withMetrics(ctx context.Context, sink MetricsSink) context.Context {
+	if sink == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, metricsCtxKey{}, sink)
+}
+
+// metricsFromContext returns the sink set by
+// withMetrics, or nil if there is none.
+func metricsFromContext(ctx context.Context) MetricsSink {
+	sink, _ := ctx.Value(metricsCtxKey{}).(MetricsSink)
+	return sink
+}
+
+type metricsCtxKey struct{}
+
+// observeOCSPFetch records a fetch of an OCSP response that started
+// at start in the sink of ctx, if any. Certificates without an OCSP
+// responder are not fetched, so they are not recorded.
+func observeOCSPFetch(ctx context.Context, start time.Time, err error) {
+	sink := metricsFromContext(ctx)
+	if sink == nil || errors.Is(err, ErrNoOCSPServerSpecified) {
+		return
+	}
+	sink.ObserveHistogram(metricOCSPFetchDuration, time.Since(start).Seconds())
+	if err != nil {
+		sink.AddCounter(metricOCSPFetchFailures, 1)
+	}
+}
+
+// Metrics is a MetricsSink that keeps metrics in memory and serves
+// them over HTTP in the Prometheus text exposition format, e.g. on
+// a /metrics endpoint that is scraped by Prometheus. Metrics that
+// are not in MetricDescs are served without help text.
+//
+// A Metrics must not be copied after first use.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type Metrics struct {
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	name        string
+	typ         MetricType
+	labelValues []string
+	value       float64 // or sum, for histograms
+	buckets     []float64
+	counts      []uint64 // by bucket, not cumulative
+	count       uint64
+}
+
+// AddCounter implements MetricsSink.
+func (m *Metrics) AddCounter(name string, delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(name, CounterMetric, labelValues).value += delta
+}
+
+// SetGauge implements MetricsSink.
+func (m *Metrics) SetGauge(name string, value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.seriesFor(name, GaugeMetric, labelValues).value = value
+}
+
+// ObserveHistogram implements MetricsSink.
+func (m *Metrics) ObserveHistogram(name string, value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.seriesFor(name, HistogramMetric, labelValues)
+	i := sort.SearchFloat64s(s.buckets, value)
+	if i < len(s.counts) {
+		s.counts[i]++
+	}
+	s.value += value
+	s.count++
+}
+
+// seriesFor returns the series with the given name and label
+// values, creating it if necessary. m.mu must be locked.
+func (m *Metrics) seriesFor(name string, typ MetricType, labelValues []string) *metricSeries {
+	key := name + "\x00" + strings.Join(labelValues, "\x00")
+	if s, ok := m.series[key]; ok {
+		return s
+	}
+	s := &metricSeries{name: name, typ: typ, labelValues: append([]string(nil), labelValues...)}
+	if typ == HistogramMetric {
+		s.buckets = DefaultMetricBuckets
+		if desc, ok := metricDesc(name); ok && len(desc.Buckets) > 0 {
+			s.buckets = desc.Buckets
+		}
+		s.counts = make([]uint64, len(s.buckets))
+	}
+	if m.series == nil {
+		m.series = make(map[string]*metricSeries)
+	}
+	m.series[key] = s
+	return s
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	series := make([]*metricSeries, 0, len(m.series))
+	for _, s := range m.series {
+		c := *s
+		c.counts = append([]uint64(nil), s.counts...)
+		series = append(series, &c)
+	}
+	m.mu.Unlock()
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return strings.Join(series[i].labelValues, "\x00") < strings.Join(series[j].labelValues, "\x00")
+	})
+
+	buf := new(bytes.Buffer)
+	for i, s := range series {
+		desc, _ := metricDesc(s.name)
+		if i == 0 || series[i-1].name != s.name {
+			if desc.Help != "" {
+				fmt.Fprintf(buf, "# HELP %s %s\n", s.name, desc.Help)
+			}
+			fmt.Fprintf(buf, "# TYPE %s %s\n", s.name, s.typ)
+		}
+		labels := formatMetricLabels(desc.Labels, s.labelValues)
+		if s.typ != HistogramMetric {
+			fmt.Fprintf(buf, "%s%s %s\n", s.name, labels, formatMetricValue(s.value))
+			continue
+		}
+		bucketLabels := append(slices.Clone(desc.Labels), "le")
+		bucketLabel := func(bound string) string {
+			return formatMetricLabels(bucketLabels, append(slices.Clone(s.labelValues), bound))
+		}
+		var cumulative uint64
+		for i, bound := range s.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", s.name, bucketLabel(formatMetricValue(bound)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", s.name, bucketLabel("+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", s.name, labels, formatMetricValue(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", s.name, labels, s.count)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+func metricDesc(name string) (MetricDesc, bool) {
+	for _, desc := range MetricDescs {
+		if desc.Name == name {
+			return desc, true
+		}
+	}
+	return MetricDesc{}, false
+}
+
+// formatMetricLabels formats the label pairs of a sample; label
+// values without a label name are named by their position.
+func formatMetricLabels(names, values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		name := "label" + strconv.Itoa(i)
+		if i < len(names) {
+			name = names[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs[i] = name + `="` + value + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// MeteredStorage is a Storage that records the latency and failures
+// of the operations of the wrapped Storage in a MetricsSink.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type MeteredStorage struct {
+	// The storage to measure. Required.
+	Storage
+
+	// The sink for the metrics. Required.
+	Metrics MetricsSink
+}
+
+// observe records an operation that started at start.
+func (ms *MeteredStorage) observe(op string, start time.Time, err error) {
+	ms.Metrics.ObserveHistogram(metricStorageDuration, time.Since(start).Seconds(), op)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ms.Metrics.AddCounter(metricStorageErrors, 1, op)
+	}
+}
+
+// Store implements Storage.
+func (ms *MeteredStorage) Store(ctx context.Context, key string, value []byte) error {
+	start := time.Now()
+	err := ms.Storage.Store(ctx, key, value)
+	ms.observe("store", start, err)
+	return err
+}
+
+// Load implements Storage.
+func (ms *MeteredStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	start := time.Now()
+	value, err := ms.Storage.Load(ctx, key)
+	ms.observe("load", start, err)
+	return value, err
+}
+
+// Delete implements Storage.
+func (ms *MeteredStorage) Delete(ctx context.Context, key string) error {
+	start := time.Now()
+	err := ms.Storage.Delete(ctx, key)
+	ms.observe("delete", start, err)
+	return err
+}
+
+// Exists implements Storage.
+func (ms *MeteredStorage) Exists(ctx context.Context, key string) bool {
+	start := time.Now()
+	exists := ms.Storage.Exists(ctx, key)
+	ms.observe("exists", start, nil)
+	return exists
+}
+
+// List implements Storage.
+func (ms *MeteredStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	start := time.Now()
+	keys, err := ms.Storage.List(ctx, path, recursive)
+	ms.observe("list", start, err)
+	return keys, err
+}
+
+// Stat implements Storage.
+func (ms *MeteredStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	start := time.Now()
+	info, err := ms.Storage.Stat(ctx, key)
+	ms.observe("stat", start, err)
+	return info, err
+}
+
+// Lock implements Storage.
+func (ms *MeteredStorage) Lock(ctx context.Context, name string) error {
+	start := time.Now()
+	err := ms.Storage.Lock(ctx, name)
+	ms.observe("lock", start, err)
+	return err
+}
+
+// Unlock implements Storage.
+func (ms *MeteredStorage) Unlock(ctx context.Context, name string) error {
+	start := time.Now()
+	err := ms.Storage.Unlock(ctx, name)
+	ms.observe("unlock", start, err)
+	return err
+}
+
+// challengeRecorder records the ACME challenges presented while
+// obtaining a certificate, so that their results can be counted
+// once the outcome of the order is known.
+type challengeRecorder struct {
+	mu        sync.Mutex
+	presented map[string][]string // identifier -> challenge types, in order
+}
+
+func withChallengeRecorder(ctx context.Context) (context.Context, *challengeRecorder) {
+	rec := new(challengeRecorder)
+	return context.WithValue(ctx, challengeRecorderCtxKey{}, rec), rec
+}
+
+func (rec *challengeRecorder) present(chal acme.Challenge) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.presented == nil {
+		rec.presented = make(map[string][]string)
+	}
+	id := chal.Identifier.Value
+	rec.presented[id] = append(rec.presented[id], chal.Type)
+}
+
+// record counts the results of the presented challenges, given the
+// error of the order. A challenge that was followed by another one
+// for the same identifier failed; the last one succeeded if the order
+// did, and failed if the order failed because of its authorization.
+// Otherwise, its result is unknown, and it is not counted.
+func (rec *challengeRecorder) record(sink MetricsSink, orderErr error) {
+	if sink == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var problem acme.Problem
+	isProblem := errors.As(orderErr, &problem)
+	for id, types := range rec.presented {
+		for i, typ := range types {
+			switch {
+			case i < len(types)-1:
+				sink.AddCounter(metricACMEChallengeResults, 1, typ, "failed")
+			case orderErr == nil:
+				sink.AddCounter(metricACMEChallengeResults, 1, typ, "succeeded")
+			case isProblem && strings.Contains(orderErr.Error(), "["+id+"]"):
+				sink.AddCounter(metricACMEChallengeResults, 1, typ, "failed")
+			}
+		}
+	}
+}
+
+type challengeRecorderCtxKey struct{}
+
+// Interface guards
+var (
+	_ MetricsSink  = (*Metrics)(nil)
+	_ http.Handler = (*Metrics)(nil)
+	_ Storage      = (*MeteredStorage)(nil)
+)
@@ -0,0 +1,190 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// scrapeMetrics returns the metrics served by m.
+func scrapeMetrics(t *testing.T, m *Metrics) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("expected text content type, got %q", ct)
+	}
+	return rec.Body.String()
+}
+
+func expectMetricLines(t *testing.T, body string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected line %q in metrics:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := new(Metrics)
+	m.AddCounter(metricRenewals, 1, "succeeded")
+	m.AddCounter(metricRenewals, 2, "failed")
+	m.AddCounter(metricRenewals, 1, "succeeded")
+	m.SetGauge(metricManagedCertificates, 3)
+	m.ObserveHistogram(metricOCSPFetchDuration, 0.2)
+	m.ObserveHistogram(metricOCSPFetchDuration, 60)
+	m.AddCounter("custom_total", 1, `quoted "value"`)
+
+	expectMetricLines(t, scrapeMetrics(t, m),
+		"# HELP certmagic_renewals_total Finished renewal attempts by result (succeeded or failed).",
+		"# TYPE certmagic_renewals_total counter",
+		`certmagic_renewals_total{result="failed"} 2`,
+		`certmagic_renewals_total{result="succeeded"} 2`,
+		"# TYPE certmagic_managed_certificates gauge",
+		"certmagic_managed_certificates 3",
+		"# TYPE certmagic_ocsp_fetch_duration_seconds histogram",
+		`certmagic_ocsp_fetch_duration_seconds_bucket{le="0.1"} 0`,
+		`certmagic_ocsp_fetch_duration_seconds_bucket{le="0.25"} 1`,
+		`certmagic_ocsp_fetch_duration_seconds_bucket{le="30"} 1`,
+		`certmagic_ocsp_fetch_duration_seconds_bucket{le="+Inf"} 2`,
+		"certmagic_ocsp_fetch_duration_seconds_sum 60.2",
+		"certmagic_ocsp_fetch_duration_seconds_count 2",
+		"# TYPE custom_total counter",
+		`custom_total{label0="quoted \"value\""} 1`,
+	)
+}
+
+func TestMetricsOnDemandDecisionsAndManagedCertificates(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	metrics := new(Metrics)
+	var cfg *Config
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return cfg, nil },
+		Metrics:          metrics,
+		Logger:           zap.NewNop(),
+	})
+	t.Cleanup(cache.Stop)
+	cfg = New(cache, Config{
+		Issuers:   []Issuer{&countingIssuer{}},
+		Storage:   &FileStorage{Path: t.TempDir()},
+		KeySource: StandardKeyGenerator{KeyType: P256},
+		OnDemand: &OnDemandConfig{DecisionFunc: func(_ context.Context, name string) error {
+			if name != "allowed.example.com" {
+				return fmt.Errorf("not allowed")
+			}
+			return nil
+		}},
+		Metrics: metrics,
+		Logger:  zap.NewNop(),
+	})
+
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "allowed.example.com", Conn: conn}); err != nil {
+		t.Fatalf("handshake failed: %v", err)
+	}
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "denied.example.com", Conn: conn}); err == nil {
+		t.Fatal("expected handshake to fail for denied name")
+	}
+
+	expectMetricLines(t, scrapeMetrics(t, metrics),
+		`certmagic_on_demand_decisions_total{result="allowed"} 1`,
+		`certmagic_on_demand_decisions_total{result="denied"} 1`,
+		"certmagic_managed_certificates 1",
+	)
+
+	cache.RemoveManaged([]SubjectIssuer{{Subject: "allowed.example.com"}})
+	expectMetricLines(t, scrapeMetrics(t, metrics), "certmagic_managed_certificates 0")
+}
+
+func TestMeteredStorage(t *testing.T) {
+	ctx := context.Background()
+	metrics := new(Metrics)
+	storage := &MeteredStorage{Storage: &FileStorage{Path: t.TempDir()}, Metrics: metrics}
+
+	if err := storage.Store(ctx, "a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Load(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.Load(ctx, "missing"); err == nil {
+		t.Fatal("expected error loading missing key")
+	}
+
+	body := scrapeMetrics(t, metrics)
+	expectMetricLines(t, body,
+		`certmagic_storage_operation_duration_seconds_count{operation="store"} 1`,
+		`certmagic_storage_operation_duration_seconds_count{operation="load"} 2`,
+	)
+	if strings.Contains(body, metricStorageErrors) {
+		t.Errorf("expected missing key not to count as error:\n%s", body)
+	}
+}
+
+func TestChallengeRecorder(t *testing.T) {
+	chal := func(id, typ string) acme.Challenge {
+		return acme.Challenge{Type: typ, Identifier: acme.Identifier{Type: "dns", Value: id}}
+	}
+	for i, tc := range []struct {
+		orderErr error
+		expect   []string
+		absent   []string
+	}{
+		{
+			orderErr: nil,
+			expect: []string{
+				`certmagic_acme_challenges_total{type="http-01",result="failed"} 1`,
+				`certmagic_acme_challenges_total{type="tls-alpn-01",result="succeeded"} 1`,
+				`certmagic_acme_challenges_total{type="dns-01",result="succeeded"} 1`,
+			},
+		},
+		{
+			orderErr: fmt.Errorf("[b.example.com] solving challenges: %w", acme.Problem{Type: "urn:ietf:params:acme:error:unauthorized"}),
+			expect: []string{
+				`certmagic_acme_challenges_total{type="http-01",result="failed"} 1`,
+				`certmagic_acme_challenges_total{type="dns-01",result="failed"} 1`,
+			},
+			absent: []string{`result="succeeded"`, `type="tls-alpn-01"`},
+		},
+	} {
+		ctx, rec := withChallengeRecorder(context.Background())
+		if r, ok := ctx.Value(challengeRecorderCtxKey{}).(*challengeRecorder); !ok || r != rec {
+			t.Fatalf("test %d: expected recorder in context", i)
+		}
+		rec.present(chal("a.example.com", acme.ChallengeTypeHTTP01))
+		rec.present(chal("a.example.com", acme.ChallengeTypeTLSALPN01))
+		rec.present(chal("b.example.com", acme.ChallengeTypeDNS01))
+
+		metrics := new(Metrics)
+		rec.record(metrics, tc.orderErr)
+		body := scrapeMetrics(t, metrics)
+		expectMetricLines(t, body, tc.expect...)
+		for _, s := range tc.absent {
+			if strings.Contains(body, s) {
+				t.Errorf("test %d: expected no %s in metrics:\n%s", i, s, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.27
+
+package certmagic
+
+import (
+	"crypto"
+	"crypto/mldsa"
+	"fmt"
+	"io"
+)
+
+// generateMLDSAKey generates an ML-DSA key of the given type, from the
+// randomness read from r if r is not nil.
+func generateMLDSAKey(keyType KeyType, r io.Reader) (crypto.PrivateKey, error) {
+	var params mldsa.Parameters
+	switch keyType {
+	case MLDSA44:
+		params = mldsa.MLDSA44()
+	case MLDSA65:
+		params = mldsa.MLDSA65()
+	case MLDSA87:
+		params = mldsa.MLDSA87()
+	default:
+		return nil, fmt.Errorf("not an ML-DSA key type: %s", keyType)
+	}
+	if r == nil {
+		return mldsa.GenerateKey(params)
+	}
+	seed := make([]byte, mldsa.PrivateKeySize)
+	if _, err := io.ReadFull(r, seed); err != nil {
+		return nil, err
+	}
+	return mldsa.NewPrivateKey(params, seed)
+}
+
+// isMLDSAKey returns true if key is an ML-DSA private key.
+func isMLDSAKey(key crypto.PrivateKey) bool {
+	_, ok := key.(*mldsa.PrivateKey)
+	return ok
+}
+
+// mldsaKeySize estimates how much memory key uses, or
+// returns 0 if it is not an ML-DSA private key.
+func mldsaKeySize(key crypto.PrivateKey) int64 {
+	k, ok := key.(*mldsa.PrivateKey)
+	if !ok {
+		return 0
+	}
+	// the seed is expanded into the secret vectors and the public
+	// matrix, which are several times as large as the public key
+	return int64(k.PublicKey().Parameters().PublicKeySize()) * 4
+}
@@ -0,0 +1,33 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !go1.27
+
+package certmagic
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+)
+
+// generateMLDSAKey always fails, since crypto/mldsa
+// is only available with Go 1.27 and newer.
+func generateMLDSAKey(keyType KeyType, _ io.Reader) (crypto.PrivateKey, error) {
+	return nil, fmt.Errorf("key type %s requires Go 1.27 or newer", keyType)
+}
+
+func isMLDSAKey(crypto.PrivateKey) bool { return false }
+
+func mldsaKeySize(crypto.PrivateKey) int64 { return 0 }
@@ -0,0 +1,114 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.27
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/mldsa"
+	"crypto/tls"
+	"testing"
+)
+
+func TestMLDSAKeys(t *testing.T) {
+	for _, keyType := range []KeyType{MLDSA44, MLDSA65, MLDSA87} {
+		key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+		if err != nil {
+			t.Fatalf("%s: %v", keyType, err)
+		}
+		if _, ok := key.(*mldsa.PrivateKey); !ok {
+			t.Fatalf("%s: expected ML-DSA key, got %T", keyType, key)
+		}
+
+		keyPEM, err := PEMEncodePrivateKey(key)
+		if err != nil {
+			t.Fatalf("%s: encoding key: %v", keyType, err)
+		}
+		decoded, err := PEMDecodePrivateKey(keyPEM)
+		if err != nil {
+			t.Fatalf("%s: decoding key: %v", keyType, err)
+		}
+		if !key.(*mldsa.PrivateKey).Equal(decoded) {
+			t.Errorf("%s: expected decoded key to equal original", keyType)
+		}
+
+		generate := func(seed string) crypto.PrivateKey {
+			key, err := StandardKeyGenerator{KeyType: keyType, Rand: NewDeterministicRand([]byte(seed))}.GenerateKey()
+			if err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+			return key
+		}
+		if !generate("seed").(*mldsa.PrivateKey).Equal(generate("seed")) {
+			t.Errorf("%s: expected same key for same seed", keyType)
+		}
+	}
+}
+
+func TestMLDSACertificates(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.KeySource = StandardKeyGenerator{KeyType: MLDSA65}
+
+	// the CSR is signed with the ML-DSA key
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	issued := fi.Issued()
+	if len(issued) != 1 {
+		t.Fatalf("expected 1 issuance, got %d", len(issued))
+	}
+	if _, ok := issued[0].PublicKey.(*mldsa.PublicKey); !ok {
+		t.Fatalf("expected certificate for ML-DSA key, got %T", issued[0].PublicKey)
+	}
+	if err := cfg.ManageSync(ctx, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// clients that do not support ML-DSA get a classical certificate
+	classical, _ := issueFakeCertificate(t, fi, "example.com")
+	cfg.certCache.cacheCertificate(classical)
+
+	for _, tc := range []struct {
+		scheme   tls.SignatureScheme
+		expectPQ bool
+	}{
+		{scheme: tls.MLDSA65, expectPQ: true},
+		{scheme: tls.ECDSAWithP256AndSHA256, expectPQ: false},
+	} {
+		hello := &tls.ClientHelloInfo{
+			ServerName:        "example.com",
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tc.scheme},
+			CipherSuites:      []uint16{tls.TLS_AES_128_GCM_SHA256},
+			Conn:              remoteConn{},
+		}
+		cert, err := cfg.GetCertificate(hello)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.scheme, err)
+		}
+		if _, isPQ := cert.Leaf.PublicKey.(*mldsa.PublicKey); isPQ != tc.expectPQ {
+			t.Errorf("%s: expected ML-DSA certificate: %t, got %T", tc.scheme, tc.expectPQ, cert.Leaf.PublicKey)
+		}
+	}
+
+	if prefs := cfg.TLSConfig().CurvePreferences; prefs[0] != tls.X25519MLKEM768 {
+		t.Errorf("expected hybrid key exchange to be preferred, got %v", prefs)
+	}
+}
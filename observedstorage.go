@@ -0,0 +1,283 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ObservedStorage is a Storage that wraps another Storage and measures
+// the latency of its operations and how long locks are waited for and
+// held, so that operators can see when slow storage (such as NFS) or
+// lock contention is about to cause renewals to be missed.
+//
+// Statistics are available from Stats; slow operations, locks that are
+// held for long, and takeovers of stale locks are also emitted as
+// events and logged.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ObservedStorage struct {
+	// The underlying storage. Required.
+	Storage
+
+	// Operations, including waiting for a lock, that take
+	// longer than this, and locks that are held for longer
+	// than this, are reported. Default: DefaultSlowStorageThreshold.
+	SlowThreshold time.Duration
+
+	// If set, receives the storage_slow, lock_held_long, and
+	// lock_stale_takeover events; typically Config.OnEvent.
+	OnEvent func(ctx context.Context, event string, data map[string]any) error
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu        sync.Mutex
+	ops       map[StorageOp]*latencySamples
+	lockWait  latencySamples
+	lockHold  latencySamples
+	acquired  map[string]time.Time
+	takeovers int64
+}
+
+// DefaultSlowStorageThreshold is the default value of
+// ObservedStorage.SlowThreshold.
+const DefaultSlowStorageThreshold = 5 * time.Second
+
+// StorageStats are the statistics of an ObservedStorage.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type StorageStats struct {
+	// The latency of each kind of operation. For locks, it
+	// includes the time spent waiting for the lock.
+	Operations map[StorageOp]LatencyStats `json:"operations"`
+
+	// How long locks were waited for, and held.
+	LockWait LatencyStats `json:"lock_wait"`
+	LockHold LatencyStats `json:"lock_hold"`
+
+	// How many stale locks were taken over.
+	StaleLockTakeovers int64 `json:"stale_lock_takeovers"`
+}
+
+// LatencyStats summarize durations. Percentiles are computed from the
+// most recent samples.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type LatencyStats struct {
+	Count int64         `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+// latencySampleSize is how many recent samples percentiles are computed from.
+const latencySampleSize = 1024
+
+// latencySamples keeps the most recent durations in a ring.
+type latencySamples struct {
+	count   int64
+	max     time.Duration
+	samples []time.Duration
+}
+
+func (ls *latencySamples) add(d time.Duration) {
+	if len(ls.samples) < latencySampleSize {
+		ls.samples = append(ls.samples, d)
+	} else {
+		ls.samples[ls.count%latencySampleSize] = d
+	}
+	ls.count++
+	ls.max = max(ls.max, d)
+}
+
+func (ls *latencySamples) stats() LatencyStats {
+	if len(ls.samples) == 0 {
+		return LatencyStats{}
+	}
+	sorted := slices.Clone(ls.samples)
+	slices.Sort(sorted)
+	percentile := func(p int) time.Duration { return sorted[(len(sorted)-1)*p/100] }
+	return LatencyStats{Count: ls.count, P50: percentile(50), P90: percentile(90), P99: percentile(99), Max: ls.max}
+}
+
+// Stats returns the statistics of the storage.
+func (s *ObservedStorage) Stats() StorageStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := StorageStats{
+		Operations:         make(map[StorageOp]LatencyStats, len(s.ops)),
+		LockWait:           s.lockWait.stats(),
+		LockHold:           s.lockHold.stats(),
+		StaleLockTakeovers: s.takeovers,
+	}
+	for op, samples := range s.ops {
+		stats.Operations[op] = samples.stats()
+	}
+	return stats
+}
+
+// observe records the latency of an operation that started at start.
+func (s *ObservedStorage) observe(ctx context.Context, op StorageOp, key string, start time.Time) {
+	d := time.Since(start)
+	s.mu.Lock()
+	if s.ops == nil {
+		s.ops = make(map[StorageOp]*latencySamples)
+	}
+	samples, ok := s.ops[op]
+	if !ok {
+		samples = new(latencySamples)
+		s.ops[op] = samples
+	}
+	samples.add(d)
+	if op == StorageOpLock {
+		s.lockWait.add(d)
+	}
+	s.mu.Unlock()
+	if d > s.slowThreshold() {
+		s.report(ctx, "storage_slow", "slow storage operation", map[string]any{
+			"operation": string(op),
+			"key":       key,
+			"duration":  d,
+		})
+	}
+}
+
+func (s *ObservedStorage) slowThreshold() time.Duration {
+	if s.SlowThreshold > 0 {
+		return s.SlowThreshold
+	}
+	return DefaultSlowStorageThreshold
+}
+
+// report logs msg with data, and emits the event with data.
+func (s *ObservedStorage) report(ctx context.Context, event, msg string, data map[string]any) {
+	if s.Logger != nil {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		fields := make([]zap.Field, 0, len(keys))
+		for _, k := range keys {
+			fields = append(fields, zap.Any(k, data[k]))
+		}
+		s.Logger.Warn(msg, fields...)
+	}
+	if s.OnEvent != nil {
+		_ = s.OnEvent(ctx, event, data)
+	}
+}
+
+// Lock implements Storage.
+func (s *ObservedStorage) Lock(ctx context.Context, name string) error {
+	start := time.Now()
+	ctx = context.WithValue(ctx, ctxKeyStaleLock, func(key string) {
+		s.mu.Lock()
+		s.takeovers++
+		s.mu.Unlock()
+		s.report(ctx, "lock_stale_takeover", "took over stale lock", map[string]any{"key": key})
+	})
+	err := s.Storage.Lock(ctx, name)
+	s.observe(ctx, StorageOpLock, name, start)
+	if err == nil {
+		s.mu.Lock()
+		if s.acquired == nil {
+			s.acquired = make(map[string]time.Time)
+		}
+		s.acquired[name] = time.Now()
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Unlock implements Storage.
+func (s *ObservedStorage) Unlock(ctx context.Context, name string) error {
+	start := time.Now()
+	err := s.Storage.Unlock(ctx, name)
+	s.observe(ctx, StorageOpUnlock, name, start)
+	s.mu.Lock()
+	acquired, ok := s.acquired[name]
+	delete(s.acquired, name)
+	var held time.Duration
+	if ok {
+		held = start.Sub(acquired)
+		s.lockHold.add(held)
+	}
+	s.mu.Unlock()
+	if held > s.slowThreshold() {
+		s.report(ctx, "lock_held_long", "lock was held for long", map[string]any{
+			"key":      name,
+			"duration": held,
+		})
+	}
+	return err
+}
+
+// Store implements Storage.
+func (s *ObservedStorage) Store(ctx context.Context, key string, value []byte) error {
+	defer s.observe(ctx, StorageOpStore, key, time.Now())
+	return s.Storage.Store(ctx, key, value)
+}
+
+// Load implements Storage.
+func (s *ObservedStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	defer s.observe(ctx, StorageOpLoad, key, time.Now())
+	return s.Storage.Load(ctx, key)
+}
+
+// Delete implements Storage.
+func (s *ObservedStorage) Delete(ctx context.Context, key string) error {
+	defer s.observe(ctx, StorageOpDelete, key, time.Now())
+	return s.Storage.Delete(ctx, key)
+}
+
+// Exists implements Storage.
+func (s *ObservedStorage) Exists(ctx context.Context, key string) bool {
+	defer s.observe(ctx, StorageOpExists, key, time.Now())
+	return s.Storage.Exists(ctx, key)
+}
+
+// List implements Storage.
+func (s *ObservedStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	defer s.observe(ctx, StorageOpList, path, time.Now())
+	return s.Storage.List(ctx, path, recursive)
+}
+
+// Stat implements Storage.
+func (s *ObservedStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	defer s.observe(ctx, StorageOpStat, key, time.Now())
+	return s.Storage.Stat(ctx, key)
+}
+
+// ReportStaleLockTakeover reports that the lock with the given name was
+// stale and was taken over, for ObservedStorage. Storage implementations
+// should call it from Lock when they take over a stale lock.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func ReportStaleLockTakeover(ctx context.Context, name string) {
+	if report, ok := ctx.Value(ctxKeyStaleLock).(func(string)); ok {
+		report(name)
+	}
+}
+
+// Interface guard
+var _ Storage = (*ObservedStorage)(nil)
@@ -0,0 +1,124 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObservedStorage(t *testing.T) {
+	ctx := context.Background()
+	fileStorage := &FileStorage{Path: t.TempDir()}
+	var mu sync.Mutex
+	events := make(map[string][]map[string]any)
+	s := &ObservedStorage{
+		Storage:       &FaultyStorage{Storage: fileStorage},
+		SlowThreshold: 20 * time.Millisecond,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			mu.Lock()
+			defer mu.Unlock()
+			events[event] = append(events[event], data)
+			return nil
+		},
+		Logger: defaultTestLogger,
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := s.Store(ctx, "key", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Load(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Storage.(*FaultyStorage).Latency = 30 * time.Millisecond
+	if _, err := s.Load(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	s.Storage.(*FaultyStorage).Latency = 0
+
+	if err := s.Lock(ctx, "lock"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if err := s.Unlock(ctx, "lock"); err != nil {
+		t.Fatal(err)
+	}
+
+	// take over a stale lock
+	staleMeta, _ := json.Marshal(lockMeta{Created: time.Now().Add(-time.Hour), Updated: time.Now().Add(-time.Hour)})
+	if err := os.MkdirAll(fileStorage.lockDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fileStorage.lockFilename("stale"), staleMeta, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Lock(ctx, "stale"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unlock(ctx, "stale"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := s.Stats()
+	if load := stats.Operations[StorageOpLoad]; load.Count != 11 || load.Max < 30*time.Millisecond || load.P50 >= 30*time.Millisecond {
+		t.Errorf("unexpected load stats: %+v", load)
+	}
+	if stats.Operations[StorageOpStore].Count != 10 {
+		t.Errorf("unexpected store stats: %+v", stats.Operations[StorageOpStore])
+	}
+	if stats.LockWait.Count != 2 || stats.LockHold.Count != 2 || stats.LockHold.Max < 30*time.Millisecond {
+		t.Errorf("unexpected lock stats: wait %+v, hold %+v", stats.LockWait, stats.LockHold)
+	}
+	if stats.StaleLockTakeovers != 1 {
+		t.Errorf("expected 1 stale lock takeover, got %d", stats.StaleLockTakeovers)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if slow := events["storage_slow"]; !slices.ContainsFunc(slow, func(data map[string]any) bool { return data["operation"] == "load" }) {
+		t.Errorf("expected slow load event, got %v", slow)
+	}
+	if held := events["lock_held_long"]; len(held) != 1 || held[0]["key"] != "lock" {
+		t.Errorf("expected lock held long event, got %v", held)
+	}
+	if stale := events["lock_stale_takeover"]; len(stale) != 1 || stale[0]["key"] != "stale" {
+		t.Errorf("expected stale lock takeover event, got %v", stale)
+	}
+}
+
+func TestLatencySamples(t *testing.T) {
+	var ls latencySamples
+	for i := 1; i <= 2*latencySampleSize; i++ {
+		ls.add(time.Duration(i) * time.Millisecond)
+	}
+	stats := ls.stats()
+	if stats.Count != 2*latencySampleSize || stats.Max != 2*latencySampleSize*time.Millisecond {
+		t.Errorf("unexpected count or max: %+v", stats)
+	}
+	// only the most recent samples are kept
+	if stats.P50 < latencySampleSize*time.Millisecond {
+		t.Errorf("expected percentiles of recent samples, got %+v", stats)
+	}
+	if stats.P99 < stats.P90 || stats.P90 < stats.P50 {
+		t.Errorf("expected ordered percentiles, got %+v", stats)
+	}
+}
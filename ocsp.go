@@ -18,14 +18,23 @@ import (
 	"bytes"
 	"context"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"mime"
+	"net"
 	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
+	"go.uber.org/zap"
 	"golang.org/x/crypto/ocsp"
 )
 
@@ -45,6 +54,7 @@ var ErrNoOCSPServerSpecified = errors.New("no OCSP server specified in certifica
 // Errors here are not necessarily fatal, it could just be that the
 // certificate doesn't have an issuer URL.
 func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cert *Certificate, pemBundle []byte) error {
+	ocspConfig = ocspConfig.forCert(*cert)
 	if ocspConfig.DisableStapling {
 		return nil
 	}
@@ -66,33 +76,31 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 	// First try to load OCSP staple from storage and see if
 	// we can still use it.
 	ocspStapleKey := StorageKeys.OCSPStaple(cert, pemBundle)
-	cachedOCSP, err := storage.Load(ctx, ocspStapleKey)
-	if err == nil {
-		resp, err := ocsp.ParseResponse(cachedOCSP, nil)
-		if err == nil {
-			if freshOCSP(resp) {
-				// staple is still fresh; use it
-				ocspBytes = cachedOCSP
-				ocspResp = resp
-			}
-		} else {
-			// invalid contents; delete the file
-			// (we do this independently of the maintenance routine because
-			// in this case we know for sure this should be a staple file
-			// because we loaded it by name, whereas the maintenance routine
-			// just iterates the list of files, even if somehow a non-staple
-			// file gets in the folder. in this case we are sure it is corrupt.)
-			err := storage.Delete(ctx, ocspStapleKey)
+	ocspBytes, ocspResp = loadStoredStaple(ctx, ocspConfig, storage, cert, pemBundle, ocspStapleKey)
+
+	// If we couldn't get a fresh staple by reading the cache,
+	// then we need to request it from the OCSP responder
+	if ocspResp == nil || len(ocspBytes) == 0 {
+		if storageOnly, _ := ctx.Value(ctxKeyOCSPStorageOnly).(bool); storageOnly {
+			// another process is responsible for getting new staples
+			return nil
+		}
+
+		// only one goroutine or instance sharing the storage fetches
+		// a staple at a time; the others use the staple it stores
+		if len(cert.Leaf.OCSPServer) > 0 {
+			unlock, err := lockOCSPFetch(ctx, storage, ocspStapleKey)
 			if err != nil {
-				log.Printf("[WARNING] Unable to delete invalid OCSP staple file: %v", err)
+				return fmt.Errorf("no OCSP stapling for %v: %v", cert.Names, err)
 			}
+			defer unlock()
+			ocspBytes, ocspResp = loadStoredStaple(ctx, ocspConfig, storage, cert, pemBundle, ocspStapleKey)
 		}
 	}
-
-	// If we couldn't get a fresh staple by reading the cache,
-	// then we need to request it from the OCSP responder
 	if ocspResp == nil || len(ocspBytes) == 0 {
-		ocspBytes, ocspResp, ocspErr = getOCSPForCert(ocspConfig, pemBundle)
+		fetchStart := time.Now()
+		ocspBytes, ocspResp, ocspErr = getOCSPForCert(ctx, ocspConfig, pemBundle)
+		observeOCSPFetch(ctx, fetchStart, ocspErr)
 		// An error here is not a problem because a certificate
 		// may simply not contain a link to an OCSP server.
 		if ocspErr != nil {
@@ -106,6 +114,14 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 			return fmt.Errorf("no OCSP stapling for %v: %w", cert.Names, ocspErr)
 		}
 		gotNewOCSP = true
+
+		if ahead := ocspResp.ThisUpdate.Sub(timeNow()); ahead > maxClockSkew {
+			warnCtx(ctx, Warning{
+				Kind:        WarningClockSkew,
+				Message:     fmt.Sprintf("OCSP response was produced %s in the future; the local clock may be behind", ahead.Round(time.Second)),
+				Identifiers: cert.Names,
+			})
+		}
 	}
 
 	if ocspResp.NextUpdate.After(expiresAt(cert.Leaf)) {
@@ -136,16 +152,181 @@ func stapleOCSP(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cer
 	return nil
 }
 
+// stapleOCSP staples OCSP information to cert using the config's OCSP
+// settings and storage, like the stapleOCSP function, and calls the
+// OnOCSPRevoked callback if the new response shows that cert was revoked
+// while the previous one, if any, did not. It emits an "ocsp_stapled"
+// event if a different staple was stapled to cert.
+func (cfg *Config) stapleOCSP(ctx context.Context, cert *Certificate, pemBundle []byte) error {
+	wasRevoked := cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked
+	prevStaple := cert.Certificate.OCSPStaple
+	err := stapleOCSP(withMetrics(cfg.egressContext(cfg.withWarnings(ctx), cert.Names, cert.Tags), cfg.Metrics), cfg.OCSP, cfg.Storage, cert, pemBundle)
+	if !wasRevoked && cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked {
+		if cfg.SessionPolicy != nil && cfg.SessionPolicy.InvalidateAllOnRevocation {
+			cfg.certCache.sessionEpoch.Add(1)
+			cfg.Logger.Info("invalidated all TLS sessions because a certificate was revoked",
+				zap.Strings("identifiers", cert.Names))
+		}
+		if cfg.OnOCSPRevoked != nil {
+			cfg.OnOCSPRevoked(ctx, *cert, cert.ocsp)
+		}
+	}
+	if err == nil && cert.ocsp != nil && len(cert.Certificate.OCSPStaple) > 0 && !bytes.Equal(prevStaple, cert.Certificate.OCSPStaple) {
+		cfg.emit(ctx, "ocsp_stapled", map[string]any{
+			"identifiers": cert.Names,
+			"this_update": cert.ocsp.ThisUpdate,
+			"next_update": cert.ocsp.NextUpdate,
+		})
+	}
+	return err
+}
+
+// loadStoredStaple loads the OCSP staple for cert from storage, and
+// returns it if it is still fresh. Invalid staples are deleted.
+func loadStoredStaple(ctx context.Context, ocspConfig OCSPConfig, storage Storage, cert *Certificate, pemBundle []byte, ocspStapleKey string) ([]byte, *ocsp.Response) {
+	cachedOCSP, err := storage.Load(ctx, ocspStapleKey)
+	if err != nil {
+		return nil, nil
+	}
+	stapleIssuer, verifiable := storedStapleIssuer(ctx, ocspConfig, pemBundle)
+	if !verifiable {
+		return nil, nil
+	}
+	resp, err := parseStoredStaple(ocspConfig, cachedOCSP, cert.Leaf, stapleIssuer)
+	if err != nil {
+		// invalid contents; delete the file
+		// (we do this independently of the maintenance routine because
+		// in this case we know for sure this should be a staple file
+		// because we loaded it by name, whereas the maintenance routine
+		// just iterates the list of files, even if somehow a non-staple
+		// file gets in the folder. in this case we are sure it is corrupt.)
+		warnCtx(ctx, Warning{
+			Kind:        WarningCorruptStorage,
+			Message:     "invalid OCSP staple in storage; deleting",
+			Identifiers: cert.Names,
+			StorageKey:  ocspStapleKey,
+			Err:         err,
+		})
+		if err := storage.Delete(ctx, ocspStapleKey); err != nil {
+			warnCtx(ctx, Warning{
+				Kind:        WarningCorruptStorage,
+				Message:     "unable to delete invalid OCSP staple",
+				Identifiers: cert.Names,
+				StorageKey:  ocspStapleKey,
+				Err:         err,
+			})
+		}
+		return nil, nil
+	}
+	if !freshOCSP(resp) {
+		return nil, nil
+	}
+	// staple is still fresh; use it
+	return cachedOCSP, resp
+}
+
+// lockOCSPFetch waits until no other goroutine, nor any other instance
+// sharing storage, is fetching the OCSP staple stored at ocspStapleKey,
+// and takes its turn. The returned function ends the turn.
+func lockOCSPFetch(ctx context.Context, storage Storage, ocspStapleKey string) (func(), error) {
+	return lockFetch(ctx, storage, ocspStapleKey, "ocsp_"+path.Base(ocspStapleKey))
+}
+
+// lockFetch waits until no other goroutine is fetching the asset stored
+// at storageKey, and no other instance sharing storage holds lockKey,
+// and takes its turn. The returned function ends the turn.
+func lockFetch(ctx context.Context, storage Storage, storageKey, lockKey string) (func(), error) {
+	for {
+		fetchWaitChansMu.Lock()
+		wait, ok := fetchWaitChans[storageKey]
+		if !ok {
+			break
+		}
+		fetchWaitChansMu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	wait := make(chan struct{})
+	fetchWaitChans[storageKey] = wait
+	fetchWaitChansMu.Unlock()
+
+	done := func() {
+		fetchWaitChansMu.Lock()
+		close(wait)
+		delete(fetchWaitChans, storageKey)
+		fetchWaitChansMu.Unlock()
+	}
+
+	if err := acquireLock(ctx, storage, lockKey); err != nil {
+		done()
+		return nil, fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	return func() {
+		releaseLock(ctx, storage, lockKey)
+		done()
+	}, nil
+}
+
+var (
+	fetchWaitChans   = make(map[string]chan struct{})
+	fetchWaitChansMu sync.Mutex
+)
+
+// storedStapleIssuer returns the issuer with which to verify OCSP
+// staples loaded from storage for the certificate bundle, and whether
+// they can be verified. The issuer is nil if verification is disabled.
+// If the bundle does not contain the issuer, it is fetched from the
+// IssuingCertificateURL of the leaf, like for new staples.
+func storedStapleIssuer(ctx context.Context, ocspConfig OCSPConfig, pemBundle []byte) (*x509.Certificate, bool) {
+	if ocspConfig.SkipStoredStapleVerification {
+		return nil, true
+	}
+	certificates, err := parseCertsFromPEMBundle(pemBundle)
+	if err != nil {
+		return nil, false
+	}
+	if len(certificates) > 1 {
+		return certificates[1], true
+	}
+	ctx, cancel := context.WithTimeout(ctx, ocspFetchTimeout)
+	defer cancel()
+	issuer, err := fetchIssuerCertificate(ctx, ocspConfig, ocspHTTPClient(ocspConfig.httpClient(ctx)), certificates[0])
+	if err != nil {
+		return nil, false
+	}
+	return issuer, true
+}
+
+// parseStoredStaple parses the OCSP response loaded from storage for
+// leaf. If issuer is not nil, the response must be for leaf and signed
+// by issuer, either directly or by a responder certificate it issued.
+func parseStoredStaple(ocspConfig OCSPConfig, ocspBytes []byte, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	if ocspConfig.SkipStoredStapleVerification {
+		return ocsp.ParseResponse(ocspBytes, nil)
+	}
+	return ocsp.ParseResponseForCert(ocspBytes, leaf, issuer)
+}
+
+// ocspHTTPClient returns the client to use for requests to OCSP
+// responders and issuer certificate URLs, given the configured one.
+// Tests replace it to simulate responder errors.
+var ocspHTTPClient = func(client *http.Client) *http.Client { return client }
+
 // getOCSPForCert takes a PEM encoded cert or cert bundle returning the raw OCSP response,
 // the parsed response, and an error, if any. The returned []byte can be passed directly
 // into the OCSPStaple property of a tls.Certificate. If the bundle only contains the
 // issued certificate, this function will try to get the issuer certificate from the
 // IssuingCertificateURL in the certificate. If the []byte and/or ocsp.Response return
-// values are nil, the OCSP status may be assumed OCSPUnknown.
+// values are nil, the OCSP status may be assumed OCSPUnknown. All requests are
+// bound to ctx, and together take no longer than ocspFetchTimeout.
 //
 // Borrowed from xenolf.
-func getOCSPForCert(ocspConfig OCSPConfig, bundle []byte) ([]byte, *ocsp.Response, error) {
-	// TODO: Perhaps this should be synchronized too, with a Locker?
+func getOCSPForCert(ctx context.Context, ocspConfig OCSPConfig, bundle []byte) ([]byte, *ocsp.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, ocspFetchTimeout)
+	defer cancel()
 
 	certificates, err := parseCertsFromPEMBundle(bundle)
 	if err != nil {
@@ -163,47 +344,18 @@ func getOCSPForCert(ocspConfig OCSPConfig, bundle []byte) ([]byte, *ocsp.Respons
 	}
 
 	// apply override for responder URL
-	respURL := issuedCert.OCSPServer[0]
-	if len(ocspConfig.ResponderOverrides) > 0 {
-		if override, ok := ocspConfig.ResponderOverrides[respURL]; ok {
-			respURL = override
-		}
-	}
+	respURL := ocspConfig.responderURL(issuedCert.OCSPServer[0])
 	if respURL == "" {
 		return nil, nil, fmt.Errorf("override disables querying OCSP responder: %v", issuedCert.OCSPServer[0])
 	}
 
-	// configure HTTP client if necessary
-	httpClient := http.DefaultClient
-	if ocspConfig.HTTPProxy != nil {
-		httpClient = &http.Client{
-			Transport: &http.Transport{
-				Proxy: ocspConfig.HTTPProxy,
-			},
-			Timeout: 30 * time.Second,
-		}
-	}
+	httpClient := ocspHTTPClient(ocspConfig.httpClient(ctx))
 
 	// get issuer certificate if needed
 	if len(certificates) == 1 {
-		if len(issuedCert.IssuingCertificateURL) == 0 {
-			return nil, nil, fmt.Errorf("no URL to issuing certificate")
-		}
-
-		resp, err := httpClient.Get(issuedCert.IssuingCertificateURL[0])
-		if err != nil {
-			return nil, nil, fmt.Errorf("getting issuer certificate: %v", err)
-		}
-		defer resp.Body.Close()
-
-		issuerBytes, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		issuerCert, err := fetchIssuerCertificate(ctx, ocspConfig, httpClient, issuedCert)
 		if err != nil {
-			return nil, nil, fmt.Errorf("reading issuer certificate: %v", err)
-		}
-
-		issuerCert, err := x509.ParseCertificate(issuerBytes)
-		if err != nil {
-			return nil, nil, fmt.Errorf("parsing issuer certificate: %v", err)
+			return nil, nil, err
 		}
 
 		// insert it into the slice on position 0;
@@ -218,16 +370,27 @@ func getOCSPForCert(ocspConfig OCSPConfig, bundle []byte) ([]byte, *ocsp.Respons
 		return nil, nil, fmt.Errorf("creating OCSP request: %v", err)
 	}
 
-	reader := bytes.NewReader(ocspReq)
-	req, err := httpClient.Post(respURL, "application/ocsp-request", reader)
+	var req *http.Request
+	if getURL, ok := ocspGETURL(respURL, ocspReq); ocspConfig.UseGET && ok {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, getURL, nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, respURL, bytes.NewReader(ocspReq))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/ocsp-request")
+		}
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("making OCSP request: %v", err)
+		return nil, nil, fmt.Errorf("creating OCSP request: %v", err)
 	}
-	defer req.Body.Close()
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("making OCSP request: %w", err)
+	}
+	defer resp.Body.Close()
 
-	ocspResBytes, err := io.ReadAll(io.LimitReader(req.Body, 1024*1024))
+	ocspResBytes, err := readOCSPFetch(resp, ocspConfig.maxResponseSize(), ocspResponseContentTypes)
 	if err != nil {
-		return nil, nil, fmt.Errorf("reading OCSP response: %v", err)
+		return nil, nil, fmt.Errorf("reading OCSP response: %w", err)
 	}
 
 	ocspRes, err := ocsp.ParseResponse(ocspResBytes, issuerCert)
@@ -238,6 +401,231 @@ func getOCSPForCert(ocspConfig OCSPConfig, bundle []byte) ([]byte, *ocsp.Respons
 	return ocspResBytes, ocspRes, nil
 }
 
+// fetchIssuerCertificate gets the issuer certificate of issuedCert from
+// its IssuingCertificateURL. Issuer certificates that signed issuedCert
+// are cached by URL, since they are shared by many certificates.
+func fetchIssuerCertificate(ctx context.Context, ocspConfig OCSPConfig, httpClient *http.Client, issuedCert *x509.Certificate) (*x509.Certificate, error) {
+	if len(issuedCert.IssuingCertificateURL) == 0 {
+		return nil, fmt.Errorf("no URL to issuing certificate")
+	}
+	issuerURL := issuedCert.IssuingCertificateURL[0]
+
+	issuerCertsMu.Lock()
+	cached, ok := issuerCerts[issuerURL]
+	issuerCertsMu.Unlock()
+	if ok && issuedCert.CheckSignatureFrom(cached) == nil {
+		return cached, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuerURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating issuer certificate request: %v", err)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("getting issuer certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	issuerBytes, err := readOCSPFetch(resp, ocspConfig.maxResponseSize(), issuerCertContentTypes)
+	if err != nil {
+		return nil, fmt.Errorf("reading issuer certificate: %w", err)
+	}
+
+	issuerCert, err := parseIssuerCertificate(issuedCert, resp.Header.Get("Content-Type"), issuerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer certificate: %v", err)
+	}
+
+	if issuedCert.CheckSignatureFrom(issuerCert) == nil {
+		issuerCertsMu.Lock()
+		if len(issuerCerts) >= maxCachedIssuerCerts {
+			clear(issuerCerts)
+		}
+		issuerCerts[issuerURL] = issuerCert
+		issuerCertsMu.Unlock()
+	}
+
+	return issuerCert, nil
+}
+
+// issuerCerts caches issuer certificates fetched
+// from IssuingCertificateURLs, keyed by URL.
+var (
+	issuerCerts   = make(map[string]*x509.Certificate)
+	issuerCertsMu sync.Mutex
+)
+
+// maxCachedIssuerCerts bounds the size of issuerCerts;
+// there are typically only a few issuers.
+const maxCachedIssuerCerts = 100
+
+// httpClient returns the HTTP client for OCSP-related requests
+// made with ctx, which goes through the egress of ctx, if any.
+func (ocspConfig OCSPConfig) httpClient(ctx context.Context) *http.Client {
+	if egress := egressFromContext(ctx); egress != nil {
+		base, timeout := http.DefaultTransport.(*http.Transport), 30*time.Second
+		if ocspConfig.HTTPClient != nil {
+			if transport, ok := ocspConfig.HTTPClient.Transport.(*http.Transport); ok {
+				base = transport
+			}
+			if ocspConfig.HTTPClient.Timeout > 0 {
+				timeout = ocspConfig.HTTPClient.Timeout
+			}
+		}
+		return egress.client(base, net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}, timeout)
+	}
+	if ocspConfig.HTTPClient != nil {
+		return ocspConfig.HTTPClient
+	}
+	if ocspConfig.HTTPProxy != nil {
+		return &http.Client{
+			Transport: &http.Transport{
+				Proxy: ocspConfig.HTTPProxy,
+			},
+			Timeout: 30 * time.Second,
+		}
+	}
+	return http.DefaultClient
+}
+
+// ocspGETURL returns the URL for making the DER-encoded OCSP request
+// ocspReq to the responder at respURL with the GET method (RFC 6960
+// Appendix A.1), and whether the request is small enough to do so:
+// like RFC 5019, only URLs of up to 255 bytes are used.
+func ocspGETURL(respURL string, ocspReq []byte) (string, bool) {
+	getURL := strings.TrimSuffix(respURL, "/") + "/" + ocspBase64Escaper.Replace(base64.StdEncoding.EncodeToString(ocspReq))
+	return getURL, len(getURL) <= maxOCSPGETURLLength
+}
+
+// ocspBase64Escaper URL-encodes the characters of base64 that have
+// special meaning in URLs, which url.PathEscape leaves alone ('+' and
+// '=') or which responders may mistake for path separators ('/').
+var ocspBase64Escaper = strings.NewReplacer("+", "%2B", "/", "%2F", "=", "%3D")
+
+// maxOCSPGETURLLength is the longest URL used for OCSP GET requests.
+const maxOCSPGETURLLength = 255
+
+// readOCSPFetch reads the body of resp, a response to a request for an OCSP
+// response or issuer certificate. The response must have a 200 status, and
+// a content type that is either one of contentTypes, or missing or generic
+// (application/octet-stream), since some servers are not specific; other
+// types, such as the HTML of a captive portal, are rejected. The body must
+// not be larger than maxSize.
+func readOCSPFetch(resp *http.Response, maxSize int64, contentTypes []string) ([]byte, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" {
+		mediaType, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content type %q: %v", ct, err)
+		}
+		if mediaType != "application/octet-stream" && !slices.Contains(contentTypes, mediaType) {
+			return nil, fmt.Errorf("unexpected content type %q", mediaType)
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, fmt.Errorf("response larger than %d bytes", maxSize)
+	}
+	return body, nil
+}
+
+// The content types of OCSP responses and issuer certificates. For issuer
+// certificates, RFC 5280 specifies DER (application/pkix-cert) or PKCS#7
+// (application/pkcs7-mime), but other types are seen in the wild.
+var (
+	ocspResponseContentTypes = []string{"application/ocsp-response"}
+	issuerCertContentTypes   = []string{
+		"application/pkix-cert",
+		"application/x-x509-ca-cert",
+		"application/pkcs7-mime",
+		"application/x-pkcs7-certificates",
+		"application/x-pem-file",
+		"application/pem-certificate-chain",
+		"text/plain",
+	}
+)
+
+// parseIssuerCertificate parses the issuer certificate of issuedCert as
+// served by its AIA endpoint, which may be DER-encoded, PEM-encoded, or a
+// "certs-only" PKCS#7 bundle, according to contentType or, if that is not
+// specific, the content itself. If the body contains several certificates,
+// the one that signed issuedCert is returned.
+func parseIssuerCertificate(issuedCert *x509.Certificate, contentType string, body []byte) (*x509.Certificate, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	var certs []*x509.Certificate
+	var err error
+	switch {
+	case bytes.HasPrefix(bytes.TrimSpace(body), []byte("-----BEGIN")):
+		certs, err = parseCertsFromPEMBundle(body)
+	case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-certificates":
+		certs, err = parsePKCS7Certificates(body)
+	default:
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(body)
+		if err != nil {
+			// not DER, but maybe PKCS#7 served with a generic type
+			if p7certs, p7err := parsePKCS7Certificates(body); p7err == nil {
+				certs, err = p7certs, nil
+			}
+		} else {
+			certs = []*x509.Certificate{cert}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	for _, cert := range certs {
+		if issuedCert.CheckSignatureFrom(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certs[0], nil
+}
+
+// parsePKCS7Certificates parses the certificates of a DER-encoded PKCS#7
+// SignedData structure (RFC 2315), as used for "certs-only" bundles.
+func parsePKCS7Certificates(der []byte) ([]*x509.Certificate, error) {
+	var contentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,tag:0"`
+	}
+	if _, err := asn1.Unmarshal(der, &contentInfo); err != nil {
+		return nil, fmt.Errorf("decoding PKCS#7: %v", err)
+	}
+	if !contentInfo.ContentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("unsupported PKCS#7 content type: %s", contentInfo.ContentType)
+	}
+	var signedData struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+		Rest             []asn1.RawValue `asn1:"optional"`
+	}
+	if _, err := asn1.Unmarshal(contentInfo.Content.Bytes, &signedData); err != nil {
+		return nil, fmt.Errorf("decoding PKCS#7 signed data: %v", err)
+	}
+	return x509.ParseCertificates(signedData.Certificates.Bytes)
+}
+
+// oidPKCS7SignedData is the content type of PKCS#7 SignedData.
+var oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+// ocspFetchTimeout is the longest getOCSPForCert may take,
+// including fetching the issuer certificate, if the context
+// does not have an earlier deadline.
+const ocspFetchTimeout = 30 * time.Second
+
 // freshOCSP returns true if resp is still fresh,
 // meaning that it is not expedient to get an
 // updated response from the OCSP server.
@@ -251,5 +639,60 @@ func freshOCSP(resp *ocsp.Response) bool {
 	}
 	// start checking OCSP staple about halfway through validity period for good measure
 	refreshTime := resp.ThisUpdate.Add(nextUpdate.Sub(resp.ThisUpdate) / 2)
-	return time.Now().Before(refreshTime)
+	return timeNow().Before(refreshTime)
+}
+
+// OCSPResponderRule rewrites OCSP responder URLs that match
+// a prefix or a regular expression. Exactly one of Prefix or
+// Regexp should be set.
+type OCSPResponderRule struct {
+	// Match responder URLs that begin with this prefix.
+	Prefix string
+
+	// Match responder URLs with this regular expression.
+	Regexp *regexp.Regexp
+
+	// The URL to use instead of the matched responder URL.
+	// For prefix rules, the matched prefix is replaced with
+	// Rewrite and the rest of the URL is kept. For regexp
+	// rules, Rewrite is a template that may refer to capture
+	// groups (e.g. "$1" or "${name}"), as with
+	// regexp.Regexp.Expand, and replaces the entire URL. An
+	// empty Rewrite disables OCSP from matching responders.
+	Rewrite string
+}
+
+// rewrite returns the rewritten URL and true if the rule matches respURL.
+func (rule OCSPResponderRule) rewrite(respURL string) (string, bool) {
+	if rule.Regexp != nil {
+		match := rule.Regexp.FindStringSubmatchIndex(respURL)
+		if match == nil {
+			return "", false
+		}
+		if rule.Rewrite == "" {
+			return "", true
+		}
+		return string(rule.Regexp.ExpandString(nil, rule.Rewrite, respURL, match)), true
+	}
+	if rule.Prefix != "" && strings.HasPrefix(respURL, rule.Prefix) {
+		if rule.Rewrite == "" {
+			return "", true
+		}
+		return rule.Rewrite + strings.TrimPrefix(respURL, rule.Prefix), true
+	}
+	return "", false
+}
+
+// responderURL returns the URL to query instead of respURL,
+// which is empty if querying the responder is disabled.
+func (ocspConfig OCSPConfig) responderURL(respURL string) string {
+	if override, ok := ocspConfig.ResponderOverrides[respURL]; ok {
+		return override
+	}
+	for _, rule := range ocspConfig.ResponderRules {
+		if rewritten, ok := rule.rewrite(respURL); ok {
+			return rewritten
+		}
+	}
+	return respURL
 }
@@ -4,11 +4,25 @@ import (
 	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
 	"errors"
 	"io"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ocsp"
 )
@@ -77,6 +91,19 @@ func TestStapleOCSP(t *testing.T) {
 			t.Error("unexpected OCSP staple")
 		}
 	})
+	t.Run("disabled by issuer override", func(t *testing.T) {
+		cert := mustMakeCertificate(t, certWithOCSPServer, certKey)
+		cert.issuerKey = "internal-ca"
+		config := OCSPConfig{IssuerOverrides: map[string]OCSPConfig{
+			"internal-ca": {DisableStapling: true},
+		}}
+		err := stapleOCSP(ctx, config, storage, &cert, nil)
+		if err != nil {
+			t.Error("unexpected error:", err)
+		} else if cert.Certificate.OCSPStaple != nil {
+			t.Error("unexpected OCSP staple")
+		}
+	})
 	t.Run("no OCSP server", func(t *testing.T) {
 		cert := mustMakeCertificate(t, certWithoutOCSPServer, certKey)
 		err := stapleOCSP(ctx, OCSPConfig{}, storage, &cert, nil)
@@ -180,3 +207,547 @@ func startOCSPResponder(
 	}
 	return httptest.NewServer(http.HandlerFunc(h))
 }
+
+func TestOCSPConfigForCert(t *testing.T) {
+	internal := OCSPConfig{ResponderOverrides: map[string]string{"ocsp.internal": "http://proxy.internal"}}
+	special := OCSPConfig{DisableStapling: true}
+	config := OCSPConfig{
+		IssuerOverrides: map[string]OCSPConfig{"internal-ca": internal},
+		CertificateOverride: func(cert Certificate) *OCSPConfig {
+			if cert.HasTag("special") {
+				return &special
+			}
+			return nil
+		},
+	}
+
+	for i, tc := range []struct {
+		cert   Certificate
+		expect OCSPConfig
+	}{
+		{cert: Certificate{}, expect: config},
+		{cert: Certificate{issuerKey: "public-ca"}, expect: config},
+		{cert: Certificate{issuerKey: "internal-ca"}, expect: internal},
+		{cert: Certificate{issuerKey: "internal-ca", Tags: []string{"special"}}, expect: special},
+	} {
+		actual := config.forCert(tc.cert)
+		if actual.DisableStapling != tc.expect.DisableStapling ||
+			len(actual.ResponderOverrides) != len(tc.expect.ResponderOverrides) ||
+			len(actual.IssuerOverrides) != len(tc.expect.IssuerOverrides) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, tc.expect, actual)
+		}
+	}
+
+	// overrides do not apply recursively
+	nested := OCSPConfig{IssuerOverrides: map[string]OCSPConfig{"internal-ca": {
+		IssuerOverrides: map[string]OCSPConfig{"internal-ca": special},
+	}}}
+	if actual := nested.forCert(Certificate{issuerKey: "internal-ca"}); actual.DisableStapling || actual.IssuerOverrides != nil {
+		t.Errorf("expected nested overrides to be ignored, got %+v", actual)
+	}
+}
+
+func TestOCSPResponderURL(t *testing.T) {
+	config := OCSPConfig{
+		ResponderOverrides: map[string]string{
+			"http://r3.o.lencr.org": "http://exact.internal",
+		},
+		ResponderRules: []OCSPResponderRule{
+			{Prefix: "http://disabled.example", Rewrite: ""},
+			{Prefix: "http://ocsp.digicert.com", Rewrite: "http://proxy.internal/digicert"},
+			{Regexp: regexp.MustCompile(`^https?://(?P<ca>[a-z0-9]+)\.o\.lencr\.org(/.*)?$`), Rewrite: "http://proxy.internal/le/${ca}$2"},
+		},
+	}
+	for i, tc := range []struct {
+		input, expect string
+	}{
+		{input: "http://r3.o.lencr.org", expect: "http://exact.internal"},
+		{input: "http://e5.o.lencr.org", expect: "http://proxy.internal/le/e5"},
+		{input: "http://e5.o.lencr.org/path", expect: "http://proxy.internal/le/e5/path"},
+		{input: "http://ocsp.digicert.com/abc", expect: "http://proxy.internal/digicert/abc"},
+		{input: "http://disabled.example/ocsp", expect: ""},
+		{input: "http://other.example/ocsp", expect: "http://other.example/ocsp"},
+	} {
+		if actual := config.responderURL(tc.input); actual != tc.expect {
+			t.Errorf("Test %d (%s): expected %q, got %q", i, tc.input, tc.expect, actual)
+		}
+	}
+}
+
+func TestGetOCSPForCertHonorsContext(t *testing.T) {
+	fi := new(FakeIssuer)
+	unblock := make(chan struct{})
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer responder.Close()
+	defer close(unblock)
+	fi.OCSPServer = responder.URL
+	_, bundle := issueFakeCertificate(t, fi, "example.com")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := getOCSPForCert(ctx, OCSPConfig{}, bundle)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected request to be canceled with the context, took %s", elapsed)
+	}
+}
+
+func TestReadOCSPFetch(t *testing.T) {
+	for i, tc := range []struct {
+		status      int
+		contentType string
+		body        string
+		expectErr   bool
+	}{
+		{status: http.StatusOK, contentType: "application/ocsp-response", body: "ok"},
+		{status: http.StatusOK, contentType: "application/ocsp-response; charset=binary", body: "ok"},
+		{status: http.StatusOK, contentType: "application/octet-stream", body: "ok"},
+		{status: http.StatusOK, body: "ok"},
+		{status: http.StatusOK, contentType: "text/html", body: "<html>", expectErr: true},
+		{status: http.StatusOK, contentType: "application/ocsp-response", body: "too large", expectErr: true},
+		{status: http.StatusServiceUnavailable, contentType: "application/ocsp-response", body: "ok", expectErr: true},
+	} {
+		resp := &http.Response{
+			StatusCode: tc.status,
+			Header:     http.Header{},
+			Body:       io.NopCloser(bytes.NewReader([]byte(tc.body))),
+		}
+		if tc.contentType != "" {
+			resp.Header.Set("Content-Type", tc.contentType)
+		}
+		body, err := readOCSPFetch(resp, 4, ocspResponseContentTypes)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error, got body %q", i, body)
+			}
+			continue
+		}
+		if err != nil || string(body) != tc.body {
+			t.Errorf("Test %d: expected body %q, got %q (err=%v)", i, tc.body, body, err)
+		}
+	}
+}
+
+func TestParseIssuerCertificate(t *testing.T) {
+	fi := new(FakeIssuer)
+	cert, _ := issueFakeCertificate(t, fi, "example.com")
+	ca, err := fi.CACertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := issueFakeCertificate(t, new(FakeIssuer), "other.example.com")
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	otherPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.Leaf.Raw})
+
+	// a degenerate "certs-only" PKCS#7 SignedData structure
+	emptySet := asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true}
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      struct{ ContentType asn1.ObjectIdentifier }
+		Certificates     asn1.RawValue
+		SignerInfos      asn1.RawValue
+	}{
+		Version:          1,
+		DigestAlgorithms: emptySet,
+		ContentInfo:      struct{ ContentType asn1.ObjectIdentifier }{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(append([]byte{}, other.Leaf.Raw...), ca.Raw...)},
+		SignerInfos:      emptySet,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs7, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{oidPKCS7SignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		contentType string
+		body        []byte
+	}{
+		{contentType: "application/pkix-cert", body: ca.Raw},
+		{contentType: "application/x-pem-file", body: caPEM},
+		{contentType: "application/octet-stream", body: append(otherPEM, caPEM...)},
+		{contentType: "application/pkcs7-mime", body: pkcs7},
+		{contentType: "", body: pkcs7},
+	} {
+		issuer, err := parseIssuerCertificate(cert.Leaf, tc.contentType, tc.body)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !issuer.Equal(ca) {
+			t.Errorf("Test %d: expected CA certificate, got %s", i, issuer.Subject)
+		}
+	}
+
+	if _, err := parseIssuerCertificate(cert.Leaf, "application/pkix-cert", []byte("garbage")); err == nil {
+		t.Error("expected error for garbage")
+	}
+}
+
+func TestGetOCSPForCertWithGET(t *testing.T) {
+	fi := new(FakeIssuer)
+	var methods []string
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		reqBytes, err := readOCSPRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req, err := ocsp.ParseRequest(reqBytes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, leaf := range fi.Issued() {
+			if leaf.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				resp, _ := fi.OCSPResponse(leaf, 24*time.Hour)
+				w.Header().Set("Content-Type", "application/ocsp-response")
+				w.Write(resp)
+				return
+			}
+		}
+		w.Write(ocsp.UnauthorizedErrorResponse)
+	}))
+	defer responder.Close()
+	fi.OCSPServer = responder.URL
+	_, bundle := issueFakeCertificate(t, fi, "example.com")
+
+	ctx := context.Background()
+	if _, resp, err := getOCSPForCert(ctx, OCSPConfig{UseGET: true}, bundle); err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("expected good OCSP response, got %v (err=%v)", resp, err)
+	}
+	if _, _, err := getOCSPForCert(ctx, OCSPConfig{}, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(methods) != 2 || methods[0] != http.MethodGet || methods[1] != http.MethodPost {
+		t.Errorf("expected GET and then POST request, got %v", methods)
+	}
+
+	// the base64 characters with special meaning in URLs are escaped
+	if getURL, _ := ocspGETURL("http://ocsp.example.com/", []byte{0xfb, 0xff}); getURL != "http://ocsp.example.com/%2B%2F8%3D" {
+		t.Errorf("expected '+', '/', and '=' to be escaped, got %s", getURL)
+	}
+
+	// requests too large for a GET URL are POSTed
+	if _, ok := ocspGETURL(responder.URL+"/"+strings.Repeat("x", maxOCSPGETURLLength), []byte("request")); ok {
+		t.Error("expected long URL not to be used for GET")
+	}
+}
+
+func TestGetOCSPForCertWithHTTPClient(t *testing.T) {
+	fi := new(FakeIssuer)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := fi.OCSPResponse(fi.Issued()[0], 24*time.Hour)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+	defer responder.Close()
+	responderURL, err := url.Parse(responder.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the responder's name only resolves through the custom transport
+	fi.OCSPServer = "http://ocsp.internal.invalid"
+	_, bundle := issueFakeCertificate(t, fi, "example.com")
+	var hosts []string
+	client := &http.Client{Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		hosts = append(hosts, req.URL.Host)
+		req = req.Clone(req.Context())
+		req.URL.Host = responderURL.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	proxy := func(*http.Request) (*url.URL, error) {
+		t.Error("expected HTTPProxy not to be used with HTTPClient")
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	_, resp, err := getOCSPForCert(ctx, OCSPConfig{HTTPClient: client, HTTPProxy: proxy}, bundle)
+	if err != nil || resp.Status != ocsp.Good {
+		t.Fatalf("expected good OCSP response, got %v (err=%v)", resp, err)
+	}
+	if len(hosts) != 1 || hosts[0] != "ocsp.internal.invalid" {
+		t.Errorf("expected request through custom client, got %v", hosts)
+	}
+}
+
+func TestStapleOCSPVerifiesStoredStaple(t *testing.T) {
+	ctx := context.Background()
+	responses := make(map[string][]byte)
+	responder := startOCSPResponder(t, responses)
+	t.Cleanup(responder.Close)
+
+	ca := mustMakeCertificate(t, caCert, caKey)
+	leaf := mustMakeCertificate(t, certWithOCSPServer, certKey)
+	bundle := []byte(certWithOCSPServer + "\n" + caCert)
+
+	// the test certificate has expired; go back to when it was valid
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	faults.set(time.Until(leaf.Leaf.NotBefore.Add(time.Hour)), false)
+
+	makeResponse := func(t *testing.T, serial *big.Int, signer Certificate) []byte {
+		t.Helper()
+		r, err := ocsp.CreateResponse(ca.Leaf, signer.Leaf, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: serial,
+			ThisUpdate:   timeNow().Add(-time.Hour),
+			NextUpdate:   timeNow().Add(10 * time.Hour),
+		}, signer.PrivateKey.(crypto.Signer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	fresh := makeResponse(t, leaf.Leaf.SerialNumber, ca)
+	responses[leaf.Leaf.SerialNumber.String()] = fresh
+
+	for _, tc := range []struct {
+		name   string
+		stored []byte
+		skip   bool
+		expect []byte
+	}{
+		{name: "valid", stored: fresh, expect: fresh},
+		{name: "wrong signer", stored: makeResponse(t, leaf.Leaf.SerialNumber, leaf), expect: fresh},
+		{name: "other certificate", stored: makeResponse(t, big.NewInt(42), ca), expect: fresh},
+		{name: "verification skipped", stored: makeResponse(t, leaf.Leaf.SerialNumber, leaf), skip: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := &FileStorage{Path: t.TempDir()}
+			cert := mustMakeCertificate(t, certWithOCSPServer, certKey)
+			if err := storage.Store(ctx, StorageKeys.OCSPStaple(&cert, bundle), tc.stored); err != nil {
+				t.Fatal(err)
+			}
+			config := OCSPConfig{
+				ResponderOverrides:           map[string]string{"ocsp.example.com": responder.URL},
+				SkipStoredStapleVerification: tc.skip,
+			}
+			if err := stapleOCSP(ctx, config, storage, &cert, bundle); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expect := tc.expect
+			if expect == nil {
+				expect = tc.stored
+			}
+			if !bytes.Equal(cert.Certificate.OCSPStaple, expect) {
+				t.Error("unexpected OCSP staple")
+			}
+		})
+	}
+}
+
+func TestStapleOCSPVerifiesStoredStapleWithoutIssuerInBundle(t *testing.T) {
+	ctx := context.Background()
+	ca := mustMakeCertificate(t, caCert, caKey)
+
+	var aiaRequests atomic.Int32
+	aia := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aiaRequests.Add(1)
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(ca.Leaf.Raw)
+	}))
+	t.Cleanup(aia.Close)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(responder.Close)
+
+	// the bundle only has the leaf, whose issuer is at aia
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(7),
+		Subject:               pkix.Name{CommonName: "aia.example.com"},
+		DNSNames:              []string{"aia.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(90 * 24 * time.Hour),
+		OCSPServer:            []string{responder.URL},
+		IssuingCertificateURL: []string{aia.URL},
+	}, ca.Leaf, key.Public(), ca.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	makeResponse := func(t *testing.T, signer Certificate) []byte {
+		t.Helper()
+		r, err := ocsp.CreateResponse(ca.Leaf, signer.Leaf, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: big.NewInt(7),
+			ThisUpdate:   time.Now().Add(-time.Hour),
+			NextUpdate:   time.Now().Add(24 * time.Hour),
+		}, signer.PrivateKey.(crypto.Signer))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	storage := &FileStorage{Path: t.TempDir()}
+	staple := func(stored []byte) (Certificate, error) {
+		t.Helper()
+		cert, err := makeCertificate(bundle, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Store(ctx, StorageKeys.OCSPStaple(&cert, bundle), stored); err != nil {
+			t.Fatal(err)
+		}
+		return cert, stapleOCSP(ctx, OCSPConfig{}, storage, &cert, bundle)
+	}
+
+	// a valid stored staple is used, even though the responder is down
+	valid := makeResponse(t, ca)
+	for i := 0; i < 2; i++ {
+		cert, err := staple(valid)
+		if err != nil {
+			t.Fatalf("expected stored staple to be used, got error: %v", err)
+		}
+		if !bytes.Equal(cert.Certificate.OCSPStaple, valid) {
+			t.Error("expected stored staple to be stapled")
+		}
+	}
+	if n := aiaRequests.Load(); n != 1 {
+		t.Errorf("expected issuer certificate to be fetched once, got %d requests", n)
+	}
+
+	// a stored staple that is not signed by the issuer is not
+	if cert, err := staple(makeResponse(t, mustMakeCertificate(t, certWithOCSPServer, certKey))); err == nil || cert.Certificate.OCSPStaple != nil {
+		t.Errorf("expected staple with wrong signer to be discarded, got error %v", err)
+	}
+}
+
+func TestStapleOCSPDeduplicatesFetches(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	ca := mustMakeCertificate(t, caCert, caKey)
+	leaf := mustMakeCertificate(t, certWithOCSPServer, certKey)
+	bundle := []byte(certWithOCSPServer + "\n" + caCert)
+
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	faults.set(time.Until(leaf.Leaf.NotBefore.Add(time.Hour)), false)
+
+	r, err := ocsp.CreateResponse(ca.Leaf, ca.Leaf, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: leaf.Leaf.SerialNumber,
+		ThisUpdate:   timeNow().Add(-time.Hour),
+		NextUpdate:   timeNow().Add(10 * time.Hour),
+	}, ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(r)
+	}))
+	t.Cleanup(responder.Close)
+	config := OCSPConfig{ResponderOverrides: map[string]string{"ocsp.example.com": responder.URL}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cert := mustMakeCertificate(t, certWithOCSPServer, certKey)
+			if err := stapleOCSP(ctx, config, storage, &cert, bundle); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if !bytes.Equal(cert.Certificate.OCSPStaple, r) {
+				t.Error("expected OCSP response to be stapled to certificate")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("expected 1 OCSP fetch, got %d", n)
+	}
+}
+
+func TestOnOCSPRevoked(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("parsing OCSP request: %v", err)
+			return
+		}
+		for _, leaf := range fi.Issued() {
+			if leaf.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				resp, err := fi.OCSPResponse(leaf, 24*time.Hour)
+				if err != nil {
+					t.Errorf("making OCSP response: %v", err)
+				}
+				w.Write(resp)
+				return
+			}
+		}
+		w.Write(ocsp.UnauthorizedErrorResponse)
+	}))
+	defer responder.Close()
+	fi.OCSPServer = responder.URL
+
+	cfg := newOnDemandTestConfig(t, fi)
+	var calls []*ocsp.Response
+	cfg.OnOCSPRevoked = func(_ context.Context, cert Certificate, resp *ocsp.Response) {
+		if len(cert.Names) != 1 || cert.Names[0] != "example.com" {
+			t.Errorf("expected revoked certificate, got %v", cert.Names)
+		}
+		calls = append(calls, resp)
+	}
+
+	cert, bundle := issueFakeCertificate(t, fi, "example.com")
+	if err := cfg.stapleOCSP(ctx, &cert, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 0 {
+		t.Fatalf("expected no call for good status, got %d", len(calls))
+	}
+
+	if err := fi.Revoke(ctx, CertificateResource{CertificatePEM: bundle}, ocsp.KeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	// the good staple is still fresh in storage; start over without it
+	cfg.Storage = &FileStorage{Path: t.TempDir()}
+	if err := cfg.stapleOCSP(ctx, &cert, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0].Status != ocsp.Revoked || calls[0].RevocationReason != ocsp.KeyCompromise {
+		t.Fatalf("expected one call for revoked status, got %+v", calls)
+	}
+
+	// the status did not change, so there is no new call
+	if err := cfg.stapleOCSP(ctx, &cert, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 {
+		t.Errorf("expected no call when the status stays revoked, got %d", len(calls))
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPProxy is an http.Handler that acts as a caching OCSP responder
+// for other systems: it answers OCSP requests (RFC 6960) with responses
+// cached in Storage, and fetches responses from the upstream responder
+// when the cached response is missing or due for a refresh. This lets
+// one deployment be the OCSP egress point for a private network, in the
+// same way that certmagic caches OCSP staples for its own certificates.
+//
+// Both POST requests and GET requests (with the base64-encoded request
+// as the final part of the path) are supported. When mounting the handler
+// under a path prefix, strip the prefix first (see http.StripPrefix).
+//
+// Responses are only served if they are signed by the issuer of the
+// certificate in question, or by a responder it delegated to.
+//
+// If a response cannot be fetched from upstream, a cached response is
+// served for as long as it is valid. Cached responses are stored with
+// other OCSP staples, so they are cleaned up by the cache's maintenance
+// routine when they expire.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type OCSPProxy struct {
+	// The storage in which to cache responses. Required.
+	Storage Storage
+
+	// Upstream returns the URL of the OCSP responder to which
+	// the given request should be forwarded. Required.
+	Upstream func(r *http.Request, req *ocsp.Request) (string, error)
+
+	// Issuer returns the certificate of the CA that issued the
+	// certificate in question, which responses must be signed by
+	// (directly or through a delegated responder). It is checked
+	// against the issuer hashes in req. Required.
+	Issuer func(r *http.Request, req *ocsp.Request) (*x509.Certificate, error)
+
+	// The HTTP client to use for upstream requests.
+	// Default: a client with a 30 second timeout.
+	HTTPClient *http.Client
+
+	// The maximum size of upstream responses, in bytes.
+	// Default: DefaultOCSPMaxResponseSize.
+	MaxResponseSize int64
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+}
+
+// ServeHTTP implements http.Handler.
+func (p *OCSPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reqBytes, err := readOCSPRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ocspReq, err := ocsp.ParseRequest(reqBytes)
+	if err != nil {
+		http.Error(w, "malformed OCSP request", http.StatusBadRequest)
+		return
+	}
+
+	respBytes, resp, err := p.response(r, reqBytes, ocspReq)
+	if err != nil {
+		p.logger().Error("unable to get OCSP response",
+			zap.String("serial", ocspReq.SerialNumber.Text(16)),
+			zap.Error(err))
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Header().Set("Last-Modified", resp.ThisUpdate.UTC().Format(http.TimeFormat))
+	if maxAge := time.Until(resp.NextUpdate); maxAge > 0 {
+		w.Header().Set("Expires", resp.NextUpdate.UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(maxAge.Seconds()))+", public, no-transform, must-revalidate")
+	}
+	w.Write(respBytes)
+}
+
+// response returns the response to ocspReq, from storage if possible.
+func (p *OCSPProxy) response(r *http.Request, reqBytes []byte, ocspReq *ocsp.Request) ([]byte, *ocsp.Response, error) {
+	ctx := r.Context()
+	key := StorageKeys.OCSPProxyResponse(ocspReq)
+
+	issuer, err := p.issuer(r, ocspReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cachedBytes []byte
+	var cached *ocsp.Response
+	if b, err := p.Storage.Load(ctx, key); err == nil {
+		if resp, err := parseProxiedOCSP(b, ocspReq, issuer); err == nil {
+			if freshOCSP(resp) {
+				return b, resp, nil
+			}
+			cachedBytes, cached = b, resp
+		}
+	}
+
+	respBytes, resp, err := p.fetch(r, reqBytes, ocspReq, issuer)
+	if err != nil {
+		if cached != nil && time.Now().Before(cached.NextUpdate) {
+			p.logger().Warn("unable to refresh OCSP response; serving cached response",
+				zap.String("serial", ocspReq.SerialNumber.Text(16)),
+				zap.Time("next_update", cached.NextUpdate),
+				zap.Error(err))
+			return cachedBytes, cached, nil
+		}
+		return nil, nil, err
+	}
+
+	if err := p.Storage.Store(ctx, key, respBytes); err != nil {
+		p.logger().Error("unable to cache OCSP response",
+			zap.String("storage_key", key),
+			zap.Error(err))
+	}
+	return respBytes, resp, nil
+}
+
+// fetch gets a fresh response to ocspReq from the upstream responder.
+func (p *OCSPProxy) fetch(r *http.Request, reqBytes []byte, ocspReq *ocsp.Request, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	upstream, err := p.Upstream(r, ocspReq)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting upstream responder: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream, bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating upstream request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	client := p.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("making upstream OCSP request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	maxSize := p.MaxResponseSize
+	if maxSize <= 0 {
+		maxSize = DefaultOCSPMaxResponseSize
+	}
+	respBytes, err := readOCSPFetch(resp, maxSize, ocspResponseContentTypes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading upstream OCSP response: %v", err)
+	}
+	ocspResp, err := parseProxiedOCSP(respBytes, ocspReq, issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("upstream OCSP response: %v", err)
+	}
+	return respBytes, ocspResp, nil
+}
+
+// issuer returns the issuer of the certificate in question,
+// after making sure that it is the one ocspReq refers to.
+func (p *OCSPProxy) issuer(r *http.Request, ocspReq *ocsp.Request) (*x509.Certificate, error) {
+	issuer, err := p.Issuer(r, ocspReq)
+	if err != nil {
+		return nil, fmt.Errorf("getting issuer certificate: %v", err)
+	}
+	// the request only needs the serial number of the certificate
+	der, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: ocspReq.SerialNumber}, issuer,
+		&ocsp.RequestOptions{Hash: ocspReq.HashAlgorithm})
+	if err != nil {
+		return nil, fmt.Errorf("hashing issuer certificate: %v", err)
+	}
+	issuerReq, err := ocsp.ParseRequest(der)
+	if err != nil {
+		return nil, fmt.Errorf("hashing issuer certificate: %v", err)
+	}
+	if !bytes.Equal(issuerReq.IssuerNameHash, ocspReq.IssuerNameHash) ||
+		!bytes.Equal(issuerReq.IssuerKeyHash, ocspReq.IssuerKeyHash) {
+		return nil, fmt.Errorf("issuer certificate %s does not match OCSP request", issuer.Subject)
+	}
+	return issuer, nil
+}
+
+// parseProxiedOCSP parses the OCSP response respBytes, and verifies
+// that it answers ocspReq and that it is signed by issuer.
+func parseProxiedOCSP(respBytes []byte, ocspReq *ocsp.Request, issuer *x509.Certificate) (*ocsp.Response, error) {
+	return ocsp.ParseResponseForCert(respBytes, &x509.Certificate{SerialNumber: ocspReq.SerialNumber}, issuer)
+}
+
+func (p *OCSPProxy) logger() *zap.Logger {
+	if p.Logger == nil {
+		return zap.NewNop()
+	}
+	return p.Logger
+}
+
+// readOCSPRequest returns the DER-encoded OCSP request in r.
+func readOCSPRequest(r *http.Request) ([]byte, error) {
+	switch r.Method {
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != "application/ocsp-request" {
+			return nil, fmt.Errorf("unsupported content type: %s", ct)
+		}
+		return io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	case http.MethodGet:
+		// the request is the rest of the path; base64 may itself contain slashes
+		encoded := strings.TrimPrefix(r.URL.Path, "/")
+		reqBytes, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("malformed OCSP request: %v", err)
+		}
+		return reqBytes, nil
+	default:
+		return nil, fmt.Errorf("method not allowed: %s", r.Method)
+	}
+}
+
+// OCSPProxyResponse returns the storage key for the OCSP
+// response cached by an OCSPProxy for the given request.
+func (keys KeyBuilder) OCSPProxyResponse(req *ocsp.Request) string {
+	return path.Join(prefixOCSP, "proxy-"+hex.EncodeToString(req.IssuerKeyHash)+"-"+req.SerialNumber.Text(16))
+}
+
+// Interface guard
+var _ http.Handler = (*OCSPProxy)(nil)
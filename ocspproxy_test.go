@@ -0,0 +1,175 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOCSPProxy(t *testing.T) {
+	cert := mustMakeCertificate(t, certWithOCSPServer, certKey)
+	ca := mustMakeCertificate(t, caCert, caKey)
+
+	now := time.Now()
+	tpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.Leaf.SerialNumber,
+		ThisUpdate:   now.Add(-time.Hour),
+		NextUpdate:   now.Add(24 * time.Hour),
+	}
+	ocspResp, err := ocsp.CreateResponse(ca.Leaf, ca.Leaf, tpl, ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal("couldn't create OCSP response", err)
+	}
+
+	// a response for another certificate that is not signed by the CA
+	forgedSerial := big.NewInt(4242)
+	forgerKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedTpl := tpl
+	forgedTpl.SerialNumber = forgedSerial
+	forgedResp, err := ocsp.CreateResponse(ca.Leaf, ca.Leaf, forgedTpl, forgerKey)
+	if err != nil {
+		t.Fatal("couldn't create OCSP response", err)
+	}
+
+	var upstreamRequests int
+	upstream := startOCSPResponder(t, map[string][]byte{
+		cert.Leaf.SerialNumber.String(): ocspResp,
+		forgedSerial.String():           forgedResp,
+	})
+	t.Cleanup(upstream.Close)
+
+	storage := &FileStorage{Path: t.TempDir()}
+	proxy := httptest.NewServer(&OCSPProxy{
+		Storage: storage,
+		Upstream: func(*http.Request, *ocsp.Request) (string, error) {
+			upstreamRequests++
+			return upstream.URL, nil
+		},
+		Issuer: func(*http.Request, *ocsp.Request) (*x509.Certificate, error) {
+			return ca.Leaf, nil
+		},
+		Logger: defaultTestLogger,
+	})
+	t.Cleanup(proxy.Close)
+
+	ocspReq, err := ocsp.CreateRequest(cert.Leaf, ca.Leaf, nil)
+	if err != nil {
+		t.Fatal("couldn't create OCSP request", err)
+	}
+
+	check := func(resp *http.Response, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected HTTP 200, got %d: %s", resp.StatusCode, body)
+		}
+		if !bytes.Equal(body, ocspResp) {
+			t.Errorf("expected upstream OCSP response to be served")
+		}
+		if resp.Header.Get("Cache-Control") == "" {
+			t.Errorf("expected Cache-Control header")
+		}
+	}
+
+	check(http.Post(proxy.URL, "application/ocsp-request", bytes.NewReader(ocspReq)))
+	if upstreamRequests != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", upstreamRequests)
+	}
+	if !storage.Exists(context.Background(), StorageKeys.OCSPProxyResponse(mustParseOCSPRequest(t, ocspReq))) {
+		t.Error("expected response to be cached in storage")
+	}
+
+	// subsequent requests, including GET requests, are served from storage
+	check(http.Post(proxy.URL, "application/ocsp-request", bytes.NewReader(ocspReq)))
+	check(http.Get(proxy.URL + "/" + base64.StdEncoding.EncodeToString(ocspReq)))
+	if upstreamRequests != 1 {
+		t.Errorf("expected cached responses to be served, but got %d upstream requests", upstreamRequests)
+	}
+
+	// responses that are not signed by the issuer are neither served nor cached
+	forgedReq, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: forgedSerial}, ca.Leaf, nil)
+	if err != nil {
+		t.Fatal("couldn't create OCSP request", err)
+	}
+	resp, err := http.Post(proxy.URL, "application/ocsp-request", bytes.NewReader(forgedReq))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, ocsp.InternalErrorErrorResponse) {
+		t.Errorf("expected internal error response for forged upstream response")
+	}
+	if storage.Exists(context.Background(), StorageKeys.OCSPProxyResponse(mustParseOCSPRequest(t, forgedReq))) {
+		t.Error("expected forged response not to be cached")
+	}
+
+	// requests for certificates of another issuer are rejected
+	otherReq, err := ocsp.CreateRequest(&x509.Certificate{SerialNumber: forgedSerial}, cert.Leaf, nil)
+	if err != nil {
+		t.Fatal("couldn't create OCSP request", err)
+	}
+	requestsBefore := upstreamRequests
+	resp, err = http.Post(proxy.URL, "application/ocsp-request", bytes.NewReader(otherReq))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, ocsp.InternalErrorErrorResponse) || upstreamRequests != requestsBefore {
+		t.Errorf("expected internal error response without upstream request for request of other issuer")
+	}
+
+	resp, err = http.Post(proxy.URL, "application/ocsp-request", bytes.NewReader([]byte("bogus")))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected HTTP 400 for malformed request, got %d", resp.StatusCode)
+	}
+}
+
+func mustParseOCSPRequest(t *testing.T, der []byte) *ocsp.Request {
+	t.Helper()
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		t.Fatal("couldn't parse OCSP request:", err)
+	}
+	return req
+}
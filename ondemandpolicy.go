@@ -0,0 +1,484 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/publicsuffix"
+)
+
+// OnDemandPermission decides whether certificates may be obtained or
+// renewed on demand for names; see OnDemandConfig.Permission.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type OnDemandPermission interface {
+	// CertificateAllowed returns an error if a certificate
+	// must not be obtained or renewed for name. It is called
+	// during TLS handshakes, so it should be fast.
+	CertificateAllowed(ctx context.Context, name string) error
+}
+
+// OnDemandObtainLimiter can be implemented by OnDemandPermissions to
+// limit how many new certificates are obtained during handshakes, as
+// opposed to loaded from storage or renewed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type OnDemandObtainLimiter interface {
+	// AllowObtain returns an error if a new certificate must
+	// not be obtained for name right now. The ClientHelloInfo
+	// of the handshake is in ctx (see ClientHelloInfoCtxKey).
+	AllowObtain(ctx context.Context, name string) error
+}
+
+// PermissionFunc is an OnDemandPermission that is a function,
+// like OnDemandConfig.DecisionFunc.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type PermissionFunc func(ctx context.Context, name string) error
+
+// CertificateAllowed implements OnDemandPermission.
+func (f PermissionFunc) CertificateAllowed(ctx context.Context, name string) error {
+	return f(ctx, name)
+}
+
+// OnDemandPolicy is an OnDemandPermission for services that obtain
+// certificates for the domains of their customers. It remembers the
+// decisions of another permission, such as a call to an API of the
+// service, rate-limits new certificates per client IP and per registered
+// domain, and denies names on a deny list that is persisted in storage,
+// such as names that were used for abuse.
+//
+// An OnDemandPolicy must not be copied after first use.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type OnDemandPolicy struct {
+	// Decides whether names are allowed that are not
+	// denied. If nil, all names that are not denied are
+	// allowed.
+	Permission OnDemandPermission
+
+	// How long to remember that Permission allowed or
+	// denied a name. If 0, Permission is asked every time.
+	AllowTTL time.Duration
+	DenyTTL  time.Duration
+
+	// The maximum number of new certificates to obtain
+	// within RateWindow for handshakes from the same
+	// client IP, or for names of the same registered
+	// domain (e.g. "example.co.uk" for "a.example.co.uk").
+	// If 0, there is no limit.
+	MaxObtainsPerIP     int
+	MaxObtainsPerDomain int
+
+	// The window of the rate limits. Default: 1 hour.
+	RateWindow time.Duration
+
+	// If true, registered domains that exceed
+	// MaxObtainsPerDomain are added to the deny list.
+	DenyRateLimitedDomains bool
+
+	// The storage of the deny list. If nil, the deny list
+	// is kept in memory only. Instances that share the
+	// storage share the deny list; changes by other
+	// instances take effect within DenyListRefresh.
+	Storage Storage
+
+	Logger *zap.Logger
+
+	mu         sync.Mutex
+	decisions  map[string]onDemandDecision
+	obtains    map[string][]time.Time // by "ip:..." or "domain:..."
+	denied     map[string]DeniedName
+	deniedLoad time.Time
+}
+
+// DeniedName is an entry of the deny list of an OnDemandPolicy.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type DeniedName struct {
+	// The denied name; its subdomains are denied as well.
+	Name string `json:"name"`
+
+	// Why the name was denied.
+	Reason string `json:"reason,omitempty"`
+
+	// When the name was denied.
+	Added time.Time `json:"added"`
+}
+
+// DenyListRefresh is how often an OnDemandPolicy loads its deny list
+// from storage again, to see changes made by other instances.
+var DenyListRefresh = time.Minute
+
+type onDemandDecision struct {
+	err     error
+	expires time.Time
+}
+
+// maxOnDemandPolicyEntries is how many remembered decisions or rate
+// limit keys trigger a sweep of expired ones. If too few of them
+// expired, arbitrary ones are evicted down to minOnDemandPolicyEvictions
+// below the maximum, so that the next sweep is not right away.
+const (
+	maxOnDemandPolicyEntries   = 10000
+	minOnDemandPolicyEvictions = maxOnDemandPolicyEntries / 10
+)
+
+// CertificateAllowed implements OnDemandPermission.
+func (p *OnDemandPolicy) CertificateAllowed(ctx context.Context, name string) error {
+	name = normalizedName(name)
+	if entry, ok := p.deniedEntry(ctx, name); ok {
+		return fmt.Errorf("%s is denied: %s", entry.Name, entry.Reason)
+	}
+	if p.Permission == nil {
+		return nil
+	}
+
+	now := timeNow()
+	p.mu.Lock()
+	decision, ok := p.decisions[name]
+	p.mu.Unlock()
+	if ok && now.Before(decision.expires) {
+		return decision.err
+	}
+
+	err := p.Permission.CertificateAllowed(ctx, name)
+	ttl := p.AllowTTL
+	if err != nil {
+		ttl = p.DenyTTL
+	}
+	if ttl > 0 && ctx.Err() == nil {
+		p.mu.Lock()
+		if p.decisions == nil || len(p.decisions) >= maxOnDemandPolicyEntries {
+			p.sweepDecisions(now)
+		}
+		p.decisions[name] = onDemandDecision{err: err, expires: now.Add(ttl)}
+		p.mu.Unlock()
+	}
+	return err
+}
+
+// sweepDecisions removes expired decisions. p.mu must be locked.
+func (p *OnDemandPolicy) sweepDecisions(now time.Time) {
+	if p.decisions == nil {
+		p.decisions = make(map[string]onDemandDecision)
+	}
+	for name, decision := range p.decisions {
+		if !now.Before(decision.expires) {
+			delete(p.decisions, name)
+		}
+	}
+	for name := range p.decisions {
+		if len(p.decisions) <= maxOnDemandPolicyEntries-minOnDemandPolicyEvictions {
+			break
+		}
+		delete(p.decisions, name) // asked again when needed
+	}
+}
+
+// AllowObtain implements OnDemandObtainLimiter. Obtains that are
+// allowed count towards the rate limits.
+func (p *OnDemandPolicy) AllowObtain(ctx context.Context, name string) error {
+	name = normalizedName(name)
+	if p.MaxObtainsPerIP <= 0 && p.MaxObtainsPerDomain <= 0 {
+		return nil
+	}
+	window := p.RateWindow
+	if window <= 0 {
+		window = time.Hour
+	}
+	now := timeNow()
+
+	var ipKey, domainKey, domain string
+	if hello, ok := ctx.Value(ClientHelloInfoCtxKey).(*tls.ClientHelloInfo); ok && hello.Conn != nil && p.MaxObtainsPerIP > 0 {
+		ip, _, err := net.SplitHostPort(hello.Conn.RemoteAddr().String())
+		if err == nil {
+			ipKey = "ip:" + ip
+		}
+	}
+	if p.MaxObtainsPerDomain > 0 {
+		domain = registeredDomain(name)
+		domainKey = "domain:" + domain
+	}
+
+	p.mu.Lock()
+	if p.obtains == nil || len(p.obtains) >= maxOnDemandPolicyEntries {
+		p.sweepObtains(now, window)
+	}
+	ipCount := p.recentObtains(ipKey, now, window)
+	domainCount := p.recentObtains(domainKey, now, window)
+	var err error
+	switch {
+	case ipKey != "" && ipCount >= p.MaxObtainsPerIP:
+		err = fmt.Errorf("rate limit exceeded: %d new certificates for client %s within %s", ipCount, strings.TrimPrefix(ipKey, "ip:"), window)
+	case domainKey != "" && domainCount >= p.MaxObtainsPerDomain:
+		err = fmt.Errorf("rate limit exceeded: %d new certificates for domain %s within %s", domainCount, domain, window)
+	default:
+		for _, key := range []string{ipKey, domainKey} {
+			if key != "" {
+				p.obtains[key] = append(p.obtains[key], now)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	if err != nil && domainKey != "" && domainCount >= p.MaxObtainsPerDomain && p.DenyRateLimitedDomains {
+		if denyErr := p.Deny(ctx, domain, "exceeded rate limit of new certificates"); denyErr != nil {
+			p.logger().Error("unable to deny rate-limited domain",
+				zap.String("domain", domain),
+				zap.Error(denyErr))
+		}
+	}
+	return err
+}
+
+// recentObtains returns the number of obtains for key within window,
+// and forgets older ones. p.mu must be locked.
+func (p *OnDemandPolicy) recentObtains(key string, now time.Time, window time.Duration) int {
+	if key == "" {
+		return 0
+	}
+	times := p.obtains[key]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= window {
+		i++
+	}
+	times = times[i:]
+	if len(times) == 0 {
+		delete(p.obtains, key)
+	} else {
+		p.obtains[key] = times
+	}
+	return len(times)
+}
+
+// sweepObtains forgets keys without obtains within window, and
+// then arbitrary keys if there are still too many. p.mu must be
+// locked.
+func (p *OnDemandPolicy) sweepObtains(now time.Time, window time.Duration) {
+	if p.obtains == nil {
+		p.obtains = make(map[string][]time.Time)
+	}
+	for key := range p.obtains {
+		p.recentObtains(key, now, window)
+	}
+	for key := range p.obtains {
+		if len(p.obtains) <= maxOnDemandPolicyEntries-minOnDemandPolicyEvictions {
+			break
+		}
+		delete(p.obtains, key)
+	}
+}
+
+// registeredDomain returns the registered domain of name, such as
+// "example.co.uk" for "a.example.co.uk", or name if there is none.
+func registeredDomain(name string) string {
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(name, "*."))
+	if err != nil {
+		return name
+	}
+	return domain
+}
+
+// Deny adds name, and thereby its subdomains, to the deny list. The
+// certificates that were already obtained for denied names are still
+// served until they need to be renewed; see Config.Decommission to
+// remove them right away.
+func (p *OnDemandPolicy) Deny(ctx context.Context, name, reason string) error {
+	entry := DeniedName{Name: normalizedName(name), Reason: reason, Added: timeNow()}
+	if p.Storage != nil {
+		entryJSON, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		if err := p.Storage.Store(ctx, StorageKeys.OnDemandDenied(entry.Name), entryJSON); err != nil {
+			return fmt.Errorf("storing denied name: %v", err)
+		}
+	}
+	p.mu.Lock()
+	if p.denied == nil {
+		p.denied = make(map[string]DeniedName)
+	}
+	p.denied[entry.Name] = entry
+	p.mu.Unlock()
+	p.logger().Warn("denied name for on-demand TLS",
+		zap.String("name", entry.Name),
+		zap.String("reason", reason))
+	return nil
+}
+
+// Undeny removes name from the deny list. Its subdomains are still
+// denied if they, or another parent domain, are on the list.
+func (p *OnDemandPolicy) Undeny(ctx context.Context, name string) error {
+	name = normalizedName(name)
+	if p.Storage != nil {
+		err := p.Storage.Delete(ctx, StorageKeys.OnDemandDenied(name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("deleting denied name: %v", err)
+		}
+	}
+	p.mu.Lock()
+	delete(p.denied, name)
+	p.mu.Unlock()
+	return nil
+}
+
+// DenyList returns the entries of the deny list.
+func (p *OnDemandPolicy) DenyList(ctx context.Context) ([]DeniedName, error) {
+	if err := p.loadDenyList(ctx, true); err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]DeniedName, 0, len(p.denied))
+	for _, entry := range p.denied {
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+// deniedEntry returns the entry of the deny list that denies
+// name, which is either name or one of its parent domains.
+func (p *OnDemandPolicy) deniedEntry(ctx context.Context, name string) (DeniedName, bool) {
+	p.mu.Lock()
+	loaded := !p.deniedLoad.IsZero()
+	p.mu.Unlock()
+	if !loaded {
+		// there is no list to use yet, so wait for it
+		if err := p.loadDenyList(ctx, false); err != nil {
+			p.logger().Error("unable to load deny list", zap.Error(err))
+		}
+	} else if p.claimDenyListLoad(false) {
+		// this is called during handshakes, so use the
+		// last known list while it is reloaded
+		go func() {
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), DenyListRefresh)
+			defer cancel()
+			if err := p.readDenyList(ctx); err != nil {
+				p.logger().Error("unable to reload deny list; using last known list", zap.Error(err))
+			}
+		}()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for candidate := strings.TrimPrefix(name, "*."); candidate != ""; {
+		if entry, ok := p.denied[candidate]; ok {
+			return entry, true
+		}
+		_, parent, found := strings.Cut(candidate, ".")
+		if !found {
+			break
+		}
+		candidate = parent
+	}
+	return DeniedName{}, false
+}
+
+// loadDenyList loads the deny list from storage, if it has not been
+// loaded within DenyListRefresh or force is true.
+func (p *OnDemandPolicy) loadDenyList(ctx context.Context, force bool) error {
+	if !p.claimDenyListLoad(force) {
+		return nil
+	}
+	return p.readDenyList(ctx)
+}
+
+// claimDenyListLoad returns true if the deny list should be loaded
+// from storage, because it has not been loaded within DenyListRefresh
+// or force is true. Only one caller gets to load it; the others use
+// the current list meanwhile.
+func (p *OnDemandPolicy) claimDenyListLoad(force bool) bool {
+	if p.Storage == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stale := force || p.deniedLoad.IsZero() || timeNow().Sub(p.deniedLoad) >= DenyListRefresh
+	if stale {
+		p.deniedLoad = timeNow()
+	}
+	return stale
+}
+
+// readDenyList reads the deny list from storage.
+func (p *OnDemandPolicy) readDenyList(ctx context.Context) error {
+	keys, err := p.Storage.List(ctx, StorageKeys.OnDemandDeniedPrefix(), false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("listing denied names: %v", err)
+	}
+	denied := make(map[string]DeniedName, len(keys))
+	for _, key := range keys {
+		entryJSON, err := p.Storage.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // undenied while we were listing
+		}
+		if err != nil {
+			return fmt.Errorf("loading denied name: %v", err)
+		}
+		var entry DeniedName
+		if err := json.Unmarshal(entryJSON, &entry); err != nil || entry.Name == "" {
+			p.logger().Error("ignoring corrupt entry of deny list",
+				zap.String("storage_key", key),
+				zap.Error(err))
+			continue
+		}
+		denied[entry.Name] = entry
+	}
+
+	p.mu.Lock()
+	p.denied = denied
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *OnDemandPolicy) logger() *zap.Logger {
+	if p.Logger == nil {
+		return zap.NewNop()
+	}
+	return p.Logger
+}
+
+// OnDemandDeniedPrefix returns the storage key prefix for
+// the deny list of OnDemandPolicy.
+func (keys KeyBuilder) OnDemandDeniedPrefix() string {
+	return prefixOnDemandDenied
+}
+
+// OnDemandDenied returns the storage key for the entry of
+// the deny list of OnDemandPolicy for name.
+func (keys KeyBuilder) OnDemandDenied(name string) string {
+	return path.Join(prefixOnDemandDenied, keys.Safe(name)+".json")
+}
+
+const prefixOnDemandDenied = "on_demand_denied"
+
+// Interface guards
+var (
+	_ OnDemandPermission    = (*OnDemandPolicy)(nil)
+	_ OnDemandObtainLimiter = (*OnDemandPolicy)(nil)
+	_ OnDemandPermission    = PermissionFunc(nil)
+)
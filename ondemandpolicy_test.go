@@ -0,0 +1,236 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// remoteConn is a net.Conn with the given remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// helloCtx returns a context with a ClientHelloInfo of a
+// connection from ip.
+func helloCtx(ip string) context.Context {
+	conn := remoteConn{remote: &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}}
+	return context.WithValue(context.Background(), ClientHelloInfoCtxKey, &tls.ClientHelloInfo{Conn: conn})
+}
+
+func TestOnDemandPolicyRemembersDecisions(t *testing.T) {
+	ctx := context.Background()
+	var asked atomic.Int32
+	p := &OnDemandPolicy{
+		Permission: PermissionFunc(func(_ context.Context, name string) error {
+			asked.Add(1)
+			if name == "denied.example.com" {
+				return fmt.Errorf("unknown customer")
+			}
+			return nil
+		}),
+		AllowTTL: time.Hour,
+	}
+	for i := 0; i < 3; i++ {
+		if err := p.CertificateAllowed(ctx, "Allowed.example.com"); err != nil {
+			t.Fatalf("expected name to be allowed: %v", err)
+		}
+		if err := p.CertificateAllowed(ctx, "denied.example.com"); err == nil {
+			t.Fatal("expected name to be denied")
+		}
+	}
+	// allowed decision remembered; denials asked every time since DenyTTL is 0
+	if n := asked.Load(); n != 4 {
+		t.Errorf("expected permission to be asked 4 times, got %d", n)
+	}
+}
+
+func TestOnDemandPolicyDenyList(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	p := &OnDemandPolicy{Storage: storage}
+
+	if err := p.Deny(ctx, "Example.com", "phishing"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"example.com", "www.example.com", "*.example.com"} {
+		if err := p.CertificateAllowed(ctx, name); err == nil {
+			t.Errorf("expected %s to be denied", name)
+		}
+	}
+	if err := p.CertificateAllowed(ctx, "example.net"); err != nil {
+		t.Errorf("expected other name to be allowed: %v", err)
+	}
+
+	// another instance sharing the storage sees the deny list
+	other := &OnDemandPolicy{Storage: storage}
+	if err := other.CertificateAllowed(ctx, "www.example.com"); err == nil {
+		t.Error("expected deny list to be loaded from storage")
+	}
+	list, err := other.DenyList(ctx)
+	if err != nil || len(list) != 1 || list[0].Name != "example.com" || list[0].Reason != "phishing" {
+		t.Errorf("unexpected deny list: %+v (err=%v)", list, err)
+	}
+
+	if err := p.Undeny(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.CertificateAllowed(ctx, "www.example.com"); err != nil {
+		t.Errorf("expected name to be allowed after undeny: %v", err)
+	}
+	if list, _ := other.DenyList(ctx); len(list) != 0 {
+		t.Errorf("expected empty deny list after undeny, got %+v", list)
+	}
+}
+
+func TestOnDemandPolicyRateLimits(t *testing.T) {
+	p := &OnDemandPolicy{
+		MaxObtainsPerIP:        2,
+		MaxObtainsPerDomain:    2,
+		DenyRateLimitedDomains: true,
+	}
+
+	if err := p.AllowObtain(helloCtx("192.0.2.1"), "a.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AllowObtain(helloCtx("192.0.2.1"), "b.example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AllowObtain(helloCtx("192.0.2.1"), "c.example.org"); err == nil {
+		t.Error("expected third obtain from same IP to be rate limited")
+	}
+
+	if err := p.AllowObtain(helloCtx("192.0.2.2"), "b.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AllowObtain(helloCtx("192.0.2.3"), "c.example.com"); err == nil {
+		t.Error("expected third obtain for same domain to be rate limited")
+	}
+	if err := p.CertificateAllowed(context.Background(), "d.example.com"); err == nil {
+		t.Error("expected rate-limited domain to be denied")
+	}
+
+	// obtains that were rate limited do not count
+	if err := p.AllowObtain(helloCtx("192.0.2.4"), "x.example.co.uk"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AllowObtain(helloCtx("192.0.2.5"), "y.example.co.uk"); err != nil {
+		t.Errorf("expected registered domains to be counted separately: %v", err)
+	}
+}
+
+func TestOnDemandPolicyDuringHandshake(t *testing.T) {
+	conn := remoteConn{remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 12345}}
+	iss := &countingIssuer{}
+	cfg := newOnDemandTestConfig(t, iss)
+	cfg.OnDemand = &OnDemandConfig{Permission: &OnDemandPolicy{MaxObtainsPerIP: 1}}
+
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com", Conn: conn}); err != nil {
+		t.Fatalf("expected first certificate to be obtained: %v", err)
+	}
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com", Conn: conn}); err == nil {
+		t.Error("expected second certificate to be rate limited")
+	}
+	// certificates that were already obtained are still served
+	if _, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com", Conn: conn}); err != nil {
+		t.Errorf("expected obtained certificate to be served: %v", err)
+	}
+	if n := iss.issued.Load(); n != 1 {
+		t.Errorf("expected 1 issuance, got %d", n)
+	}
+}
+
+func TestOnDemandPolicyReloadsDenyListInBackground(t *testing.T) {
+	ctx := context.Background()
+	var blocking atomic.Bool
+	listing, release := make(chan struct{}, 1), make(chan struct{})
+	storage := &FaultyStorage{
+		Storage: &FileStorage{Path: t.TempDir()},
+		Fault: func(op StorageOp, key string) error {
+			if op == StorageOpList && blocking.Load() {
+				listing <- struct{}{}
+				<-release
+			}
+			return nil
+		},
+	}
+	p := &OnDemandPolicy{Storage: storage}
+	if err := p.CertificateAllowed(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// another instance denies the name, and the list is due for a reload
+	if err := (&OnDemandPolicy{Storage: storage}).Deny(ctx, "example.com", "phishing"); err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.deniedLoad = timeNow().Add(-DenyListRefresh)
+	p.mu.Unlock()
+
+	// the last known list is used while it is reloaded
+	blocking.Store(true)
+	if err := p.CertificateAllowed(ctx, "example.com"); err != nil {
+		t.Errorf("expected last known deny list to be used: %v", err)
+	}
+	<-listing
+	blocking.Store(false)
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.CertificateAllowed(ctx, "example.com") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expected reloaded deny list to be used")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnDemandPolicyEvictsEntries(t *testing.T) {
+	now := timeNow()
+	p := &OnDemandPolicy{
+		Permission:      PermissionFunc(func(context.Context, string) error { return nil }),
+		AllowTTL:        time.Hour,
+		MaxObtainsPerIP: 1,
+		decisions:       make(map[string]onDemandDecision),
+		obtains:         make(map[string][]time.Time),
+	}
+	for i := 0; i < maxOnDemandPolicyEntries; i++ {
+		p.decisions[fmt.Sprintf("%d.example.com", i)] = onDemandDecision{expires: now.Add(time.Hour)}
+		p.obtains[fmt.Sprintf("ip:%d", i)] = []time.Time{now}
+	}
+
+	// when nothing expired, entries are evicted so that
+	// the next calls do not sweep all of them again
+	if err := p.CertificateAllowed(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AllowObtain(helloCtx("192.0.2.1"), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for kind, n := range map[string]int{"decisions": len(p.decisions), "obtains": len(p.obtains)} {
+		if n > maxOnDemandPolicyEntries-minOnDemandPolicyEvictions+1 {
+			t.Errorf("expected %s to be evicted, got %d", kind, n)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// recoverPanic recovers a panic in maintenance, so that it does not
+// take down the process. It logs the panic and emits a "panic_recovered"
+// event to the cache's OnEvent. worker names what panicked. It must
+// be deferred directly.
+func (certCache *Cache) recoverPanic(ctx context.Context, logger *zap.Logger, worker string, fields ...zap.Field) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	certCache.optionsMu.RLock()
+	onEvent := certCache.options.OnEvent
+	certCache.optionsMu.RUnlock()
+	reportPanic(ctx, logger, onEvent, worker, recovered, fields...)
+}
+
+// recoverPanic recovers a panic in a background job or goroutine of
+// cfg, such as an asynchronous issuance, so that it does not take down
+// the process. It logs the panic, emits a "panic_recovered" event, and,
+// if errp is not nil, sets *errp to an error describing the panic.
+// worker names what panicked. It must be deferred directly.
+func (cfg *Config) recoverPanic(ctx context.Context, worker string, errp *error) {
+	recovered := recover()
+	if recovered == nil {
+		return
+	}
+	err := reportPanic(ctx, cfg.Logger, cfg.emit, worker, recovered)
+	if errp != nil {
+		*errp = err
+	}
+}
+
+// guard returns job with panics recovered by cfg.recoverPanic.
+func (cfg *Config) guard(ctx context.Context, worker string, job func() error) func() error {
+	return func() (err error) {
+		defer cfg.recoverPanic(ctx, worker, &err)
+		return job()
+	}
+}
+
+// reportPanic logs the recovered value of a panic in worker along with
+// the stack trace, emits a "panic_recovered" event through onEvent if
+// it is not nil, and returns the panic as an error.
+func reportPanic(ctx context.Context, logger *zap.Logger, onEvent func(context.Context, string, map[string]any) error, worker string, recovered any, fields ...zap.Field) error {
+	buf := make([]byte, stackTraceBufferSize)
+	buf = buf[:runtime.Stack(buf, false)]
+	logger.Error("panic",
+		append([]zap.Field{
+			zap.String("worker", worker),
+			zap.Any("error", recovered),
+			zap.ByteString("stack", buf),
+		}, fields...)...)
+	if onEvent != nil {
+		// a panicking event handler must not undo the recovery
+		func() {
+			defer func() { _ = recover() }()
+			_ = onEvent(ctx, "panic_recovered", map[string]any{
+				"worker": worker,
+				"error":  fmt.Sprint(recovered),
+				"stack":  string(buf),
+			})
+		}()
+	}
+	return fmt.Errorf("panic in %s: %v", worker, recovered)
+}
+
+// maintenanceRestartDelay returns how long to wait before restarting
+// maintenance after it panicked for the given number of times, so that
+// a persistent panic does not spin.
+func maintenanceRestartDelay(panics int) time.Duration {
+	delay := time.Duration(panics) * time.Second
+	if delay > maxMaintenanceRestartDelay {
+		delay = maxMaintenanceRestartDelay
+	}
+	return delay
+}
+
+// maxMaintenanceRestartDelay is the longest maintenance
+// waits to be restarted after a panic.
+const maxMaintenanceRestartDelay = time.Minute
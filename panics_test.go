@@ -0,0 +1,149 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestPanickingJobs(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	var (
+		mu     sync.Mutex
+		events []map[string]any
+	)
+	cfg.OnEvent = func(_ context.Context, event string, data map[string]any) error {
+		if event == "panic_recovered" {
+			mu.Lock()
+			events = append(events, data)
+			mu.Unlock()
+		}
+		return nil
+	}
+
+	// a panicking job releases its name, so the job can run again
+	ran := make(chan struct{})
+	cfg.submitJob(ctx, "panic_example.com", "renew", "example.com", jobPriority{}, func(context.Context) error {
+		defer close(ran)
+		panic("malformed certificate")
+	})
+	<-ran
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reran := make(chan struct{})
+		cfg.submitJob(ctx, "panic_example.com", "renew", "example.com", jobPriority{}, func(context.Context) error {
+			close(reran)
+			return nil
+		})
+		select {
+		case <-reran:
+		case <-time.After(50 * time.Millisecond):
+			if time.Now().Before(deadline) {
+				continue
+			}
+			t.Fatal("expected job to run again after panic")
+		}
+		break
+	}
+	mu.Lock()
+	if len(events) != 1 || events[0]["worker"] != "renew job for example.com" || events[0]["error"] != "malformed certificate" {
+		t.Errorf("expected one panic_recovered event, got %v", events)
+	}
+	mu.Unlock()
+
+	// waiting on a panicking job returns an error
+	err := jm.Run(ctx, zap.NewNop(), cfg.guard(ctx, "on-demand issuance", func() error { panic("oops") }))
+	if err == nil || !strings.Contains(err.Error(), "panic in on-demand issuance: oops") {
+		t.Errorf("expected error from panicking job, got %v", err)
+	}
+	if err := jm.Run(ctx, zap.NewNop(), func() error { panic("unguarded") }); err == nil {
+		t.Error("expected error from unguarded panicking job")
+	}
+}
+
+func TestRenewalCheckPanicIsIsolated(t *testing.T) {
+	ctx := context.Background()
+	var (
+		cfg    *Config
+		events []map[string]any
+	)
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(cert Certificate) (*Config, error) {
+			if cert.Names[0] == "bad.example.com" {
+				panic("malformed certificate")
+			}
+			return cfg, nil
+		},
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "panic_recovered" {
+				events = append(events, data)
+			}
+			return nil
+		},
+		Logger: zap.NewNop(),
+	})
+	t.Cleanup(cache.Stop)
+	fi := new(FakeIssuer)
+	cfg = New(cache, Config{
+		Issuers:            []Issuer{fi},
+		Storage:            &FileStorage{Path: t.TempDir()},
+		KeySource:          StandardKeyGenerator{KeyType: P256},
+		RenewalWindowRatio: 1, // always due
+		Logger:             zap.NewNop(),
+	})
+	for _, name := range []string{"bad.example.com", "good.example.com"} {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := cache.RenewManagedCertificates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0]["worker"] != "renewal check" {
+		t.Errorf("expected one panic_recovered event, got %v", events)
+	}
+	// the lock was released, and the other certificate was still renewed
+	if !cache.mu.TryLock() {
+		t.Fatal("expected cache lock to be released after panic")
+	}
+	cache.mu.Unlock()
+	if issued := waitForIssuances(t, fi, 3); len(issued) != 3 || issued[2].DNSNames[0] != "good.example.com" {
+		t.Errorf("expected good.example.com to be renewed, got %d issuances", len(issued))
+	}
+}
+
+func TestReportPanicSurvivesPanickingHandler(t *testing.T) {
+	err := reportPanic(context.Background(), zap.NewNop(), func(context.Context, string, map[string]any) error {
+		panic("handler")
+	}, "test", errors.New("boom"))
+	if err == nil || err.Error() != "panic in test: boom" {
+		t.Errorf("expected panic error, got %v", err)
+	}
+	if d := maintenanceRestartDelay(1000); d != maxMaintenanceRestartDelay {
+		t.Errorf("expected restart delay to be capped, got %s", d)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// BindPrivilegedPorts binds the listeners for HTTPS and Listen, on
+// HTTPPort and HTTPSPort (or HTTPAddress and HTTPSAddress), and then,
+// if the process runs as root, permanently drops its privileges to
+// those of the named user, so that the rest of the program, including
+// the handlers of HTTPS, does not run as root. It must be called before
+// HTTPS or Listen, and before any other goroutines are started that
+// must not run as root.
+//
+// On Linux, root is not needed if the executable is allowed to bind
+// privileged ports with the cap_net_bind_service capability; if binding
+// the ports is not permitted, the returned error says how to allow it.
+// On platforms that do not support dropping privileges, such as
+// Windows, the ports are bound and username is ignored.
+//
+// Note that the default storage is in the home directory of the user
+// the process started as; when dropping privileges, set Default.Storage
+// to a location that the user can write to.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func BindPrivilegedPorts(username string) error {
+	boundLnMu.Lock()
+	defer boundLnMu.Unlock()
+	if boundHTTPLn != nil || boundHTTPSLn != nil {
+		return fmt.Errorf("ports are already bound")
+	}
+	if isRoot() && username == "" {
+		return fmt.Errorf("refusing to keep running as root: a user to drop privileges to is required")
+	}
+
+	httpLn, err := ListenAddress(httpListenAddress())
+	if err != nil {
+		return privilegedBindError(err)
+	}
+	httpsLn, err := ListenAddress(httpsListenAddress())
+	if err != nil {
+		httpLn.Close()
+		return privilegedBindError(err)
+	}
+
+	if isRoot() {
+		if err := dropPrivileges(username); err != nil {
+			httpLn.Close()
+			httpsLn.Close()
+			return fmt.Errorf("dropping privileges to %s: %v", username, err)
+		}
+	}
+	boundHTTPLn, boundHTTPSLn = httpLn, httpsLn
+	return nil
+}
+
+// privilegedBindError adds guidance on how to bind privileged
+// ports to err, if binding failed for lack of permission.
+func privilegedBindError(err error) error {
+	if !errors.Is(err, os.ErrPermission) {
+		return err
+	}
+	if runtime.GOOS == "linux" {
+		exe, exeErr := os.Executable()
+		if exeErr != nil {
+			exe = "<executable>"
+		}
+		return fmt.Errorf("%w (run as root to drop privileges once the ports are bound, "+
+			"or allow the executable to bind privileged ports: sudo setcap cap_net_bind_service=+ep %s)", err, exe)
+	}
+	return fmt.Errorf("%w (run as root to drop privileges once the ports are bound, "+
+		"or set HTTPAddress and HTTPSAddress to unprivileged ports and forward the standard ports to them)", err)
+}
+
+// takeBoundListener returns the listener that BindPrivilegedPorts
+// bound at *bound, if any, and otherwise listens on addr.
+func takeBoundListener(bound *net.Listener, addr string) (net.Listener, error) {
+	boundLnMu.Lock()
+	ln := *bound
+	*bound = nil
+	boundLnMu.Unlock()
+	if ln != nil {
+		return ln, nil
+	}
+	return ListenAddress(addr)
+}
+
+// The listeners bound by BindPrivilegedPorts, until
+// they are used by HTTPS or Listen.
+var (
+	boundHTTPLn, boundHTTPSLn net.Listener
+	boundLnMu                 sync.Mutex
+)
+
+// dropPrivileges permanently changes the user and groups
+// of the process; it is a variable for tests.
+var dropPrivileges = dropProcessPrivileges
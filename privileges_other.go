@@ -0,0 +1,30 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !unix
+
+package certmagic
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// isRoot returns false, since there is no root
+// to drop privileges from on this platform.
+func isRoot() bool { return false }
+
+func dropProcessPrivileges(string) error {
+	return fmt.Errorf("dropping privileges is not supported on %s", runtime.GOOS)
+}
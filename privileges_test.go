@@ -0,0 +1,96 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBindPrivilegedPorts(t *testing.T) {
+	defer func(h, hs string) { HTTPAddress, HTTPSAddress = h, hs }(HTTPAddress, HTTPSAddress)
+	HTTPAddress, HTTPSAddress = "127.0.0.1:0", "127.0.0.1:0"
+
+	var droppedTo []string
+	defer func(orig func(string) error) { dropPrivileges = orig }(dropPrivileges)
+	dropPrivileges = func(username string) error {
+		droppedTo = append(droppedTo, username)
+		return nil
+	}
+
+	if isRoot() {
+		if err := BindPrivilegedPorts(""); err == nil {
+			t.Fatal("expected error when running as root without a user")
+		}
+	}
+	if err := BindPrivilegedPorts("certmagic"); err != nil {
+		t.Fatal(err)
+	}
+	if isRoot() && (len(droppedTo) != 1 || droppedTo[0] != "certmagic") {
+		t.Errorf("expected privileges to be dropped to certmagic, got %v", droppedTo)
+	}
+	if err := BindPrivilegedPorts("certmagic"); err == nil {
+		t.Error("expected error when ports are already bound")
+	}
+
+	// the bound listeners are used once
+	boundHTTPS := boundHTTPSLn
+	ln, err := takeBoundListener(&boundHTTPSLn, HTTPSAddress)
+	if err != nil || ln != boundHTTPS {
+		t.Errorf("expected bound listener, got %v (err=%v)", ln, err)
+	}
+	ln.Close()
+	ln, err = takeBoundListener(&boundHTTPSLn, HTTPSAddress)
+	if err != nil || ln == boundHTTPS {
+		t.Errorf("expected new listener, got %v (err=%v)", ln, err)
+	}
+	ln.Close()
+	ln, _ = takeBoundListener(&boundHTTPLn, HTTPAddress)
+	ln.Close()
+
+	// failing to drop privileges releases the ports
+	if isRoot() {
+		dropPrivileges = func(string) error { return errors.New("nope") }
+		if err := BindPrivilegedPorts("certmagic"); err == nil {
+			t.Error("expected error when dropping privileges fails")
+		}
+		if boundHTTPLn != nil || boundHTTPSLn != nil {
+			t.Error("expected no bound listeners after failure")
+		}
+	}
+}
+
+func TestPrivilegedBindError(t *testing.T) {
+	err := privilegedBindError(fmt.Errorf("listen tcp :443: %w", os.ErrPermission))
+	if !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected permission error to be wrapped, got %v", err)
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(err.Error(), "setcap cap_net_bind_service=+ep") {
+		t.Errorf("expected setcap guidance, got %v", err)
+	}
+	other := errors.New("address in use")
+	if privilegedBindError(other) != other {
+		t.Error("expected other errors to be returned as they are")
+	}
+	if runtime.GOOS != "windows" {
+		if err := dropProcessPrivileges("no-such-user-certmagic"); err == nil {
+			t.Error("expected error for unknown user")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package certmagic
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// isRoot returns true if the process runs as root.
+func isRoot() bool { return os.Geteuid() == 0 }
+
+// dropProcessPrivileges changes the user and groups of the process,
+// including all its threads, to those of the named user.
+func dropProcessPrivileges(username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid user ID %s: %v", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid group ID %s: %v", u.Gid, err)
+	}
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		groupIDs = []string{u.Gid}
+	}
+	var gids []int
+	for _, id := range groupIDs {
+		if g, err := strconv.Atoi(id); err == nil {
+			gids = append(gids, g)
+		}
+	}
+
+	// groups first, since changing them requires root
+	if err := unix.Setgroups(gids); err != nil {
+		return fmt.Errorf("setting supplementary groups: %v", err)
+	}
+	if err := unix.Setgid(gid); err != nil {
+		return fmt.Errorf("setting group ID: %v", err)
+	}
+	if err := unix.Setuid(uid); err != nil {
+		return fmt.Errorf("setting user ID: %v", err)
+	}
+	if uid != 0 && unix.Setuid(0) == nil {
+		return fmt.Errorf("privileges were not dropped: root could be regained")
+	}
+	return nil
+}
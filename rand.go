@@ -0,0 +1,143 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	weakrand "math/rand"
+	"sync"
+)
+
+// NewDeterministicRand returns a source of randomness that produces
+// the same endless stream of bytes for the same seed. It can be used
+// as Config.Rand and StandardKeyGenerator.Rand to make integration
+// tests and audits reproducible.
+//
+// It is NOT secure: anyone who knows the seed can derive the
+// private keys generated with it. Never use it in production.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func NewDeterministicRand(seed []byte) io.Reader {
+	return &deterministicRand{seed: sha256.Sum256(seed)}
+}
+
+// deterministicRand is SHA-256 in counter mode.
+type deterministicRand struct {
+	mu      sync.Mutex
+	seed    [32]byte
+	counter uint64
+	buf     []byte
+}
+
+func (dr *deterministicRand) Read(p []byte) (int, error) {
+	dr.mu.Lock()
+	defer dr.mu.Unlock()
+	n := len(p)
+	for len(p) > 0 {
+		if len(dr.buf) == 0 {
+			block := make([]byte, len(dr.seed)+8)
+			copy(block, dr.seed[:])
+			binary.BigEndian.PutUint64(block[len(dr.seed):], dr.counter)
+			sum := sha256.Sum256(block)
+			dr.buf = sum[:]
+			dr.counter++
+		}
+		copied := copy(p, dr.buf)
+		p, dr.buf = p[copied:], dr.buf[copied:]
+	}
+	return n, nil
+}
+
+// randReader returns the source of randomness of cfg.
+func (cfg *Config) randReader() io.Reader {
+	if cfg.Rand != nil {
+		return cfg.Rand
+	}
+	return rand.Reader
+}
+
+// randInt63n returns a uniform random number in [0, n) from r.
+// If r fails, it falls back to math/rand, since the numbers are
+// only used for randomized decisions, not for secrets.
+func randInt63n(r io.Reader, n int64) int64 {
+	v, err := rand.Int(r, big.NewInt(n))
+	if err != nil {
+		return weakrand.Int63n(n)
+	}
+	return v.Int64()
+}
+
+// randShuffle shuffles n elements with the given swap function,
+// using randomness from r.
+func randShuffle(r io.Reader, n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, int(randInt63n(r, int64(i+1))))
+	}
+}
+
+// generateKeyFromRand generates a private key of the given type from
+// the bytes read from r, such that the same bytes result in the same
+// key. This is needed because since Go 1.26, the key generation
+// functions of the standard library ignore the given source of
+// randomness.
+func generateKeyFromRand(keyType KeyType, r io.Reader) (crypto.PrivateKey, error) {
+	var curve ecdh.Curve
+	var scalarLen int
+	switch keyType {
+	case ED25519:
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := io.ReadFull(r, seed); err != nil {
+			return nil, err
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	case "", P256:
+		curve, scalarLen = ecdh.P256(), 32
+	case P384:
+		curve, scalarLen = ecdh.P384(), 48
+	case MLDSA44, MLDSA65, MLDSA87:
+		return generateMLDSAKey(keyType, r)
+	case RSA2048, RSA4096, RSA8192:
+		return nil, fmt.Errorf("key type %s cannot be generated from a custom source of randomness", keyType)
+	default:
+		return nil, fmt.Errorf("unrecognized or unsupported key type: %s", keyType)
+	}
+
+	// rejection sampling: the scalar must be in [1, N-1]
+	scalar := make([]byte, scalarLen)
+	for {
+		if _, err := io.ReadFull(r, scalar); err != nil {
+			return nil, err
+		}
+		key, err := curve.NewPrivateKey(scalar)
+		if err != nil {
+			continue
+		}
+		// round-trip through PKCS#8 to get the equivalent *ecdsa.PrivateKey
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParsePKCS8PrivateKey(der)
+	}
+}
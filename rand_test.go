@@ -0,0 +1,100 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+func TestDeterministicRand(t *testing.T) {
+	read := func(r io.Reader, n int) []byte {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	a, b := NewDeterministicRand([]byte("seed")), NewDeterministicRand([]byte("seed"))
+	// reads of different sizes still result in the same stream
+	first := append(read(a, 10), read(a, 50)...)
+	if second := read(b, 60); !bytes.Equal(first, second) {
+		t.Error("expected same stream for same seed")
+	}
+	if other := read(NewDeterministicRand([]byte("other seed")), 60); bytes.Equal(first, other) {
+		t.Error("expected different stream for different seed")
+	}
+}
+
+func TestStandardKeyGeneratorRand(t *testing.T) {
+	for _, keyType := range []KeyType{P256, P384, ED25519} {
+		generate := func(seed string) crypto.Signer {
+			key, err := StandardKeyGenerator{KeyType: keyType, Rand: NewDeterministicRand([]byte(seed))}.GenerateKey()
+			if err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+			return key.(crypto.Signer)
+		}
+		equal := func(a, b crypto.Signer) bool {
+			return a.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(b.Public())
+		}
+
+		key := generate("seed")
+		if !equal(key, generate("seed")) {
+			t.Errorf("%s: expected same key for same seed", keyType)
+		}
+		if equal(key, generate("other seed")) {
+			t.Errorf("%s: expected different key for different seed", keyType)
+		}
+
+		// the keys must be usable
+		digest := sha256.Sum256([]byte("hello"))
+		switch k := key.(type) {
+		case *ecdsa.PrivateKey:
+			sig, err := ecdsa.SignASN1(rand.Reader, k, digest[:])
+			if err != nil || !ecdsa.VerifyASN1(&k.PublicKey, digest[:], sig) {
+				t.Errorf("%s: expected valid signature (err=%v)", keyType, err)
+			}
+		case ed25519.PrivateKey:
+			if !ed25519.Verify(k.Public().(ed25519.PublicKey), digest[:], ed25519.Sign(k, digest[:])) {
+				t.Errorf("%s: expected valid signature", keyType)
+			}
+		}
+	}
+
+	if _, err := (StandardKeyGenerator{KeyType: RSA2048, Rand: NewDeterministicRand(nil)}).GenerateKey(); err == nil {
+		t.Error("expected error for RSA keys with custom source of randomness")
+	}
+}
+
+func TestRandShuffleDeterministic(t *testing.T) {
+	shuffle := func(seed string) []int {
+		s := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		randShuffle(NewDeterministicRand([]byte(seed)), len(s), func(i, j int) { s[i], s[j] = s[j], s[i] })
+		return s
+	}
+	first, second := shuffle("seed"), shuffle("seed")
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("expected same order for same seed, got %v and %v", first, second)
+		}
+	}
+}
@@ -0,0 +1,517 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RedisStorage is a Storage that keeps its values in Redis, or a
+// compatible server such as Valkey or KeyDB, so that the instances of
+// a cluster can share certificates without a shared file system. It
+// speaks the Redis protocol itself, so it needs no client library.
+//
+// Each value is a hash with the value and its modification time.
+// Locks are keys created with SET NX and an expiry of LockTTL, which
+// the holder extends every third of LockTTL, so that the lock of an
+// instance that crashed expires on its own; they are released only
+// by their holder.
+//
+// Keys are directories only implicitly, as prefixes of other keys;
+// recursive listings contain only the keys of values.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type RedisStorage struct {
+	// The address of the server, such as
+	// "localhost:6379". Required.
+	Address string
+
+	// The credentials for the AUTH command, if needed.
+	// The username requires Redis 6 or newer.
+	Username string
+	Password string
+
+	// The number of the database to use. Default: 0.
+	DB int
+
+	// If set, the connection is secured with TLS.
+	TLSConfig *tls.Config
+
+	// The prefix of all Redis keys, so that several
+	// deployments can share a database. Default:
+	// "certmagic".
+	KeyPrefix string
+
+	// How long a lock lasts when its holder stops extending
+	// it, for example because it crashed. Default:
+	// DefaultRedisLockTTL.
+	LockTTL time.Duration
+
+	// The timeout for each command, unless the context
+	// has an earlier deadline. Default: 10 seconds.
+	Timeout time.Duration
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu    sync.Mutex
+	idle  []*redisConn
+	locks map[string]*redisLock
+}
+
+// DefaultRedisLockTTL is the default LockTTL of RedisStorage.
+const DefaultRedisLockTTL = time.Minute
+
+// redisLockPollInterval is how often RedisStorage checks
+// whether a lock held by another instance was released.
+const redisLockPollInterval = time.Second
+
+// redisMaxIdleConns is how many idle connections
+// RedisStorage keeps for reuse.
+const redisMaxIdleConns = 8
+
+// redisLock is a lock held by this instance.
+type redisLock struct {
+	token string
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// Scripts that change a lock only if it is still held by its holder,
+// identified by the token stored in the lock key.
+const (
+	redisExtendLockScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	redisUnlockScript     = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// Store implements Storage.
+func (s *RedisStorage) Store(ctx context.Context, key string, value []byte) error {
+	_, err := s.do(ctx, "HSET", s.valueKey(key),
+		"value", string(value),
+		"modified", strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err != nil {
+		return fmt.Errorf("storing %s in Redis: %v", key, err)
+	}
+	return nil
+}
+
+// Load implements Storage.
+func (s *RedisStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.do(ctx, "HGET", s.valueKey(key), "value")
+	if err != nil {
+		return nil, fmt.Errorf("loading %s from Redis: %v", key, err)
+	}
+	value, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return value, nil
+}
+
+// Delete implements Storage. Deleting a directory
+// deletes all values prefixed by it.
+func (s *RedisStorage) Delete(ctx context.Context, key string) error {
+	redisKeys, err := s.scan(ctx, redisEscapePattern(s.valueKey(key))+"/*")
+	if err != nil {
+		return fmt.Errorf("deleting %s from Redis: %v", key, err)
+	}
+	for _, k := range append(redisKeys, s.valueKey(key)) {
+		if _, err := s.do(ctx, "DEL", k); err != nil {
+			return fmt.Errorf("deleting %s from Redis: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// Exists implements Storage.
+func (s *RedisStorage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// List implements Storage.
+func (s *RedisStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	if prefix == "" {
+		dir = ""
+	}
+	redisKeys, err := s.scan(ctx, redisEscapePattern(s.valueKey(dir))+"*")
+	if err != nil {
+		return nil, fmt.Errorf("listing %s in Redis: %v", prefix, err)
+	}
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, k := range redisKeys {
+		key := strings.TrimPrefix(k, s.valueKey(""))
+		if !recursive {
+			rest := strings.TrimPrefix(key, dir)
+			if i := strings.Index(rest, "/"); i >= 0 {
+				key = dir + rest[:i]
+			}
+		}
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: %w", prefix, fs.ErrNotExist)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Stat implements Storage.
+func (s *RedisStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	modified, err := s.do(ctx, "HGET", s.valueKey(key), "modified")
+	if err != nil {
+		return KeyInfo{}, fmt.Errorf("stat %s in Redis: %v", key, err)
+	}
+	if modified, ok := modified.([]byte); ok {
+		size, err := s.do(ctx, "HSTRLEN", s.valueKey(key), "value")
+		if err != nil {
+			return KeyInfo{}, fmt.Errorf("stat %s in Redis: %v", key, err)
+		}
+		ns, _ := strconv.ParseInt(string(modified), 10, 64)
+		n, _ := size.(int64)
+		return KeyInfo{
+			Key:        key,
+			Modified:   time.Unix(0, ns),
+			Size:       n,
+			IsTerminal: true,
+		}, nil
+	}
+	// may be a directory
+	if _, err := s.List(ctx, key, false); err != nil {
+		return KeyInfo{}, err
+	}
+	return KeyInfo{Key: key, IsTerminal: false}, nil
+}
+
+// Lock implements Locker.
+func (s *RedisStorage) Lock(ctx context.Context, name string) error {
+	token := newLockToken()
+	ttl := strconv.FormatInt(s.lockTTL().Milliseconds(), 10)
+	for {
+		reply, err := s.do(ctx, "SET", s.lockKey(name), token, "NX", "PX", ttl)
+		if err != nil {
+			return fmt.Errorf("creating lock for %s in Redis: %v", name, err)
+		}
+		if reply == "OK" {
+			s.holdLock(name, token)
+			return nil
+		}
+		select {
+		case <-time.After(redisLockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// holdLock records that the lock for name is held,
+// and extends it until it is unlocked.
+func (s *RedisStorage) holdLock(name, token string) {
+	lock := &redisLock{token: token, stop: make(chan struct{}), done: make(chan struct{})}
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*redisLock)
+	}
+	s.locks[name] = lock
+	s.mu.Unlock()
+
+	go func() {
+		defer close(lock.done)
+		ticker := time.NewTicker(s.lockTTL() / 3)
+		defer ticker.Stop()
+		ttl := strconv.FormatInt(s.lockTTL().Milliseconds(), 10)
+		for {
+			select {
+			case <-ticker.C:
+			case <-lock.stop:
+				return
+			}
+			reply, err := s.do(context.Background(), "EVAL", redisExtendLockScript, "1", s.lockKey(name), token, ttl)
+			if err != nil || reply != int64(1) {
+				s.logger().Error("extending lock; terminating lock maintenance",
+					zap.String("name", name),
+					zap.Bool("lost", err == nil),
+					zap.Error(err))
+				return
+			}
+		}
+	}()
+}
+
+// Unlock implements Locker. The lock is deleted only
+// if it did not expire and was taken by another instance.
+func (s *RedisStorage) Unlock(ctx context.Context, name string) error {
+	s.mu.Lock()
+	lock, ok := s.locks[name]
+	delete(s.locks, name)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lock for %s is not held", name)
+	}
+	close(lock.stop)
+	<-lock.done
+	if _, err := s.do(ctx, "EVAL", redisUnlockScript, "1", s.lockKey(name), lock.token); err != nil {
+		return fmt.Errorf("releasing lock for %s in Redis: %v", name, err)
+	}
+	return nil
+}
+
+func (s *RedisStorage) String() string {
+	return "RedisStorage:" + s.Address + "/" + strconv.Itoa(s.DB) + "/" + s.keyPrefix()
+}
+
+func (s *RedisStorage) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
+}
+
+func (s *RedisStorage) keyPrefix() string {
+	if s.KeyPrefix == "" {
+		return "certmagic"
+	}
+	return s.KeyPrefix
+}
+
+func (s *RedisStorage) lockTTL() time.Duration {
+	if s.LockTTL <= 0 {
+		return DefaultRedisLockTTL
+	}
+	return s.LockTTL
+}
+
+// valueKey returns the Redis key of the value at key.
+func (s *RedisStorage) valueKey(key string) string {
+	return s.keyPrefix() + ":" + key
+}
+
+// lockKey returns the Redis key of the lock for name.
+func (s *RedisStorage) lockKey(name string) string {
+	return s.keyPrefix() + "-lock:" + name
+}
+
+// scan returns all Redis keys that match pattern.
+func (s *RedisStorage) scan(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := s.do(ctx, "SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		page, ok := reply.([]any)
+		if !ok || len(page) != 2 {
+			return nil, fmt.Errorf("unexpected SCAN reply: %v", reply)
+		}
+		next, _ := page[0].([]byte)
+		found, _ := page[1].([]any)
+		for _, k := range found {
+			if k, ok := k.([]byte); ok {
+				keys = append(keys, string(k))
+			}
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+// redisEscapePattern escapes the special characters
+// of glob-style patterns in s.
+func redisEscapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// do runs a command on a connection from the pool and returns its
+// reply, which is a string, int64, []byte, []any, or nil.
+func (s *RedisStorage) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := s.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	reply, err := conn.do(args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		// the connection is in an unknown state
+		conn.Close()
+		return nil, err
+	}
+	s.mu.Lock()
+	if len(s.idle) < redisMaxIdleConns {
+		s.idle = append(s.idle, conn)
+		conn = nil
+	}
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return reply, err
+}
+
+// conn returns an idle connection, or a new one.
+func (s *RedisStorage) conn(ctx context.Context) (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return conn, nil
+	}
+	s.mu.Unlock()
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", s.Address)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Redis: %v", err)
+	}
+	if s.TLSConfig != nil {
+		netConn = tls.Client(netConn, s.TLSConfig)
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	if d, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(d)
+	}
+
+	if s.Password != "" {
+		args := []string{"AUTH", s.Password}
+		if s.Username != "" {
+			args = []string{"AUTH", s.Username, s.Password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("authenticating to Redis: %v", err)
+		}
+	}
+	if s.DB != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(s.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("selecting Redis database %d: %v", s.DB, err)
+		}
+	}
+	return conn, nil
+}
+
+// redisConn is a connection to a Redis server.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(args ...string) (any, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// readRESP reads a reply of the Redis serialization protocol
+// (RESP2). Error replies are returned as redisError.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("invalid Redis reply: empty line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]any, n)
+		for i := range elems {
+			elem, err := readRESP(r)
+			var redisErr redisError
+			if err != nil && !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			elems[i] = elem
+		}
+		return elems, nil
+	default:
+		return nil, fmt.Errorf("invalid Redis reply: %q", line)
+	}
+}
+
+// redisError is an error reply of a Redis server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// Interface guard
+var _ Storage = (*RedisStorage)(nil)
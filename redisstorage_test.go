@@ -0,0 +1,356 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-memory server for the subset of
+// Redis commands used by RedisStorage.
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+
+	mu      sync.Mutex
+	hashes  map[string]map[string]string
+	strs    map[string]string
+	expires map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{
+		ln:       ln,
+		password: password,
+		hashes:   make(map[string]map[string]string),
+		strs:     make(map[string]string),
+		expires:  make(map[string]time.Time),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := fr.password == ""
+	for {
+		reply, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		elems, _ := reply.([]any)
+		args := make([]string, len(elems))
+		for i, elem := range elems {
+			b, _ := elem.([]byte)
+			args[i] = string(b)
+		}
+		if len(args) == 0 {
+			return
+		}
+		var out string
+		switch {
+		case strings.ToUpper(args[0]) == "AUTH":
+			authed = args[len(args)-1] == fr.password
+			out = "+OK\r\n"
+			if !authed {
+				out = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			out = "-NOAUTH Authentication required.\r\n"
+		default:
+			out = fr.exec(args)
+		}
+		if _, err := io.WriteString(conn, out); err != nil {
+			return
+		}
+	}
+}
+
+func respBulk(s string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s) }
+
+func (fr *fakeRedis) exec(args []string) string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	for k, exp := range fr.expires {
+		if time.Now().After(exp) {
+			delete(fr.strs, k)
+			delete(fr.expires, k)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "SELECT":
+		return "+OK\r\n"
+	case "HSET":
+		h := fr.hashes[args[1]]
+		if h == nil {
+			h = make(map[string]string)
+			fr.hashes[args[1]] = h
+		}
+		for i := 2; i+1 < len(args); i += 2 {
+			h[args[i]] = args[i+1]
+		}
+		return ":1\r\n"
+	case "HGET":
+		v, ok := fr.hashes[args[1]][args[2]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return respBulk(v)
+	case "HSTRLEN":
+		return fmt.Sprintf(":%d\r\n", len(fr.hashes[args[1]][args[2]]))
+	case "DEL":
+		_, inHashes := fr.hashes[args[1]]
+		_, inStrs := fr.strs[args[1]]
+		delete(fr.hashes, args[1])
+		delete(fr.strs, args[1])
+		delete(fr.expires, args[1])
+		if inHashes || inStrs {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "SCAN":
+		// returns one key per page, to exercise the cursor
+		var keys []string
+		for k := range fr.hashes {
+			if matchRedisPrefixPattern(args[3], k) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		cursor, _ := strconv.Atoi(args[1])
+		if cursor >= len(keys) {
+			return "*2\r\n" + respBulk("0") + "*0\r\n"
+		}
+		next := strconv.Itoa(cursor + 1)
+		if cursor+1 >= len(keys) {
+			next = "0"
+		}
+		return "*2\r\n" + respBulk(next) + "*1\r\n" + respBulk(keys[cursor])
+	case "SET":
+		key, value := args[1], args[2]
+		var nx bool
+		var px time.Duration
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				px = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, exists := fr.strs[key]; nx && exists {
+			return "$-1\r\n"
+		}
+		fr.strs[key] = value
+		if px > 0 {
+			fr.expires[key] = time.Now().Add(px)
+		}
+		return "+OK\r\n"
+	case "EVAL":
+		key, token := args[3], args[4]
+		if fr.strs[key] != token {
+			return ":0\r\n"
+		}
+		switch args[1] {
+		case redisExtendLockScript:
+			ms, _ := strconv.Atoi(args[5])
+			fr.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		case redisUnlockScript:
+			delete(fr.strs, key)
+			delete(fr.expires, key)
+		default:
+			return "-ERR unknown script\r\n"
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+// matchRedisPrefixPattern reports whether key matches pattern,
+// which must be an escaped prefix followed by "*".
+func matchRedisPrefixPattern(pattern, key string) bool {
+	var prefix strings.Builder
+	for i := 0; i < len(pattern)-1; i++ {
+		if pattern[i] == '\\' {
+			i++
+		}
+		prefix.WriteByte(pattern[i])
+	}
+	return strings.HasSuffix(pattern, "*") && strings.HasPrefix(key, prefix.String())
+}
+
+func (fr *fakeRedis) lockExpiry(key string) (time.Time, bool) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	exp, ok := fr.expires[key]
+	return exp, ok
+}
+
+func TestRedisStorage(t *testing.T) {
+	ctx := context.Background()
+	fr := newFakeRedis(t, "secret")
+	storage := &RedisStorage{Address: fr.ln.Addr().String(), Password: "secret", DB: 2}
+
+	if _, err := storage.Load(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	if _, err := storage.List(ctx, "certificates", true); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error for empty listing, got %v", err)
+	}
+
+	keys := []string{
+		"certificates/acme/example.com/example.com.crt",
+		"certificates/acme/example.com/example.com.key",
+		"certificates/acme/example.net/example.net.crt",
+		"acme/account.json",
+	}
+	for _, key := range keys {
+		if err := storage.Store(ctx, key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	value, err := storage.Load(ctx, keys[0])
+	if err != nil || string(value) != "value of "+keys[0] {
+		t.Errorf("expected stored value, got %q (err=%v)", value, err)
+	}
+	info, err := storage.Stat(ctx, keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsTerminal || info.Size != int64(len("value of "+keys[0])) || time.Since(info.Modified) > time.Minute {
+		t.Errorf("unexpected key info: %+v", info)
+	}
+	if info, err := storage.Stat(ctx, "certificates/acme"); err != nil || info.IsTerminal {
+		t.Errorf("expected directory, got %+v (err=%v)", info, err)
+	}
+	if !storage.Exists(ctx, "certificates") || storage.Exists(ctx, "certificates/acme/example.org") {
+		t.Error("unexpected existence of directories")
+	}
+
+	list, err := storage.List(ctx, "certificates/acme", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(list, ","); got != "certificates/acme/example.com,certificates/acme/example.net" {
+		t.Errorf("unexpected non-recursive listing: %s", got)
+	}
+	list, err = storage.List(ctx, "certificates/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(list, ","); got != strings.Join(keys[:3], ",") {
+		t.Errorf("unexpected recursive listing: %s", got)
+	}
+
+	if err := storage.Delete(ctx, "certificates/acme/example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(ctx, keys[0]) || storage.Exists(ctx, keys[1]) || !storage.Exists(ctx, keys[2]) {
+		t.Error("expected only the keys of the deleted directory to be deleted")
+	}
+
+	// the connection fails with the wrong password
+	badStorage := &RedisStorage{Address: fr.ln.Addr().String(), Password: "wrong"}
+	if _, err := badStorage.Load(ctx, keys[2]); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected authentication error, got %v", err)
+	}
+}
+
+func TestRedisStorageLock(t *testing.T) {
+	ctx := context.Background()
+	fr := newFakeRedis(t, "")
+	ttl := 300 * time.Millisecond
+	storage1 := &RedisStorage{Address: fr.ln.Addr().String(), LockTTL: ttl}
+	storage2 := &RedisStorage{Address: fr.ln.Addr().String(), LockTTL: ttl}
+
+	if err := storage1.Lock(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	lockKey := storage1.lockKey("example.com")
+	firstExpiry, ok := fr.lockExpiry(lockKey)
+	if !ok {
+		t.Fatal("expected lock key with expiry")
+	}
+
+	// the lock is held beyond its TTL while it is extended
+	shortCtx, cancel := context.WithTimeout(ctx, 2*ttl)
+	defer cancel()
+	if err := storage2.Lock(shortCtx, "example.com"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected lock to be held, got %v", err)
+	}
+	if expiry, _ := fr.lockExpiry(lockKey); !expiry.After(firstExpiry) {
+		t.Error("expected lock to be extended")
+	}
+
+	// another instance cannot release the lock
+	if err := storage2.Unlock(ctx, "example.com"); err == nil {
+		t.Error("expected error unlocking lock that is not held")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- storage2.Lock(ctx, "example.com") }()
+	time.Sleep(50 * time.Millisecond)
+	if err := storage1.Unlock(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for released lock")
+	}
+	if err := storage2.Unlock(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fr.lockExpiry(lockKey); ok {
+		t.Error("expected lock key to be deleted")
+	}
+}
+
+func TestRedisEscapePattern(t *testing.T) {
+	if got := redisEscapePattern(`a*b?c[d]e\f`); got != `a\*b\?c\[d\]e\\f` {
+		t.Errorf("unexpected escaped pattern: %s", got)
+	}
+}
@@ -0,0 +1,392 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReissueCriteria selects the certificates affected by an incident,
+// such as a mass revocation by a CA. A certificate is affected if it
+// matches all of the criteria that are set.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ReissueCriteria struct {
+	// The keys of the issuers whose certificates are affected.
+	Issuers []string `json:"issuers,omitempty"`
+
+	// The range of NotBefore times of affected certificates:
+	// NotBeforeStart is inclusive, and NotBeforeEnd is exclusive.
+	NotBeforeStart time.Time `json:"not_before_start,omitempty"`
+	NotBeforeEnd   time.Time `json:"not_before_end,omitempty"`
+
+	// The serial numbers of affected certificates, in hex as they
+	// are usually published in incident reports. Case, colons, and
+	// leading zeros do not matter.
+	Serials []string `json:"serials,omitempty"`
+
+	// Optionally, a custom criterion. It is not persisted.
+	Match func(Certificate) bool `json:"-"`
+}
+
+// Matches returns true if cert matches all of the criteria that are set.
+func (c ReissueCriteria) Matches(cert Certificate) bool {
+	if cert.Leaf == nil {
+		return false
+	}
+	if len(c.Issuers) > 0 && !slices.Contains(c.Issuers, cert.issuerKey) {
+		return false
+	}
+	if !c.NotBeforeStart.IsZero() && cert.Leaf.NotBefore.Before(c.NotBeforeStart) {
+		return false
+	}
+	if !c.NotBeforeEnd.IsZero() && !cert.Leaf.NotBefore.Before(c.NotBeforeEnd) {
+		return false
+	}
+	if len(c.Serials) > 0 {
+		serial := cert.Leaf.SerialNumber.Text(16)
+		if !slices.ContainsFunc(c.Serials, func(s string) bool { return normalizeSerial(s) == serial }) {
+			return false
+		}
+	}
+	if c.Match != nil && !c.Match(cert) {
+		return false
+	}
+	return true
+}
+
+func (c ReissueCriteria) empty() bool {
+	return len(c.Issuers) == 0 && c.NotBeforeStart.IsZero() && c.NotBeforeEnd.IsZero() &&
+		len(c.Serials) == 0 && c.Match == nil
+}
+
+// normalizeSerial returns the hex serial number s in the
+// form of big.Int.Text(16).
+func normalizeSerial(s string) string {
+	s = strings.ToLower(strings.ReplaceAll(s, ":", ""))
+	s = strings.TrimLeft(s, "0")
+	if s == "" {
+		return "0"
+	}
+	return s
+}
+
+// MassReissueOptions configures a call to MassReissue.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type MassReissueOptions struct {
+	// Identifies the reissuance, typically after the incident that
+	// made it necessary. Progress is persisted in storage under this
+	// ID, so that an interrupted reissuance can be continued by calling
+	// MassReissue again with the same ID. Required.
+	ID string
+
+	// Which certificates to reissue. Required.
+	Criteria ReissueCriteria
+
+	// The maximum number of certificates to reissue at once.
+	// Default: DefaultMassReissueConcurrency.
+	Concurrency int
+
+	// If set, at most RateLimit certificates are reissued
+	// per RateLimitWindow, to stay below the rate limits of
+	// the CA while it is busy with the incident too.
+	RateLimit       int
+	RateLimitWindow time.Duration
+
+	// Optionally, reports whether certificate a should be reissued
+	// before b. By default, the most used certificates come first
+	// (see Certificate.Handshakes), then the ones expiring soonest.
+	Prioritize func(a, b Certificate) bool
+
+	// If set, Progress is called after each certificate
+	// has been processed. Calls are serialized, but they
+	// block other reports, so they should return quickly.
+	Progress func(MassReissueProgress)
+}
+
+// MassReissueProgress describes the progress of a MassReissue
+// call after a single certificate was processed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type MassReissueProgress struct {
+	// The name of the certificate that was just processed.
+	Name string
+
+	// The error, if the certificate could not be reissued.
+	Err error
+
+	// How many certificates have been processed by this
+	// call so far, including this one, out of Total.
+	Completed int
+	Total     int
+}
+
+// MassReissueStatus is the persisted progress of a reissuance.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type MassReissueStatus struct {
+	// The ID of the reissuance.
+	ID string `json:"id"`
+
+	// The criteria of the most recent call.
+	Criteria ReissueCriteria `json:"criteria"`
+
+	// The names of the certificates that were reissued.
+	Reissued []string `json:"reissued,omitempty"`
+
+	// The names of the certificates that could not be
+	// reissued, mapped to the most recent error; they are
+	// retried when MassReissue is called again.
+	Failed map[string]string `json:"failed,omitempty"`
+
+	// When the reissuance was started and last updated, and
+	// when the most recent call processed all affected
+	// certificates (whether they succeeded or not).
+	Started  time.Time `json:"started"`
+	Updated  time.Time `json:"updated"`
+	Finished time.Time `json:"finished,omitempty"`
+}
+
+// Done returns true if every affected certificate was reissued
+// by the time the most recent call finished.
+func (s MassReissueStatus) Done() bool {
+	return !s.Finished.IsZero() && len(s.Failed) == 0
+}
+
+// MassReissue reissues the managed certificates in the cache that match
+// opts.Criteria, as is necessary after a mass revocation or another CA
+// incident. Certificates are reissued in order of priority, with up to
+// opts.Concurrency at once and no more than opts.RateLimit per window.
+// Each certificate is reissued only once: progress is persisted in
+// storage under opts.ID, so that if the process is interrupted, calling
+// MassReissue again with the same ID continues where it left off, and
+// retries the certificates that failed. This also holds for certificates
+// that still match the criteria after being reissued, for example when
+// they are selected by issuer. Only one instance sharing the storage
+// runs a given reissuance at a time.
+//
+// The returned error is only non-nil if the reissuance could not run,
+// or if ctx is canceled before it finished; failures for individual
+// certificates are recorded in the returned status.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) MassReissue(ctx context.Context, opts MassReissueOptions) (MassReissueStatus, error) {
+	if opts.ID == "" {
+		return MassReissueStatus{}, fmt.Errorf("mass reissue: missing ID")
+	}
+	if opts.Criteria.empty() {
+		return MassReissueStatus{}, fmt.Errorf("mass reissue %s: no criteria; refusing to reissue all certificates", opts.ID)
+	}
+	logger := cfg.Logger.Named("mass_reissue").With(zap.String("id", opts.ID))
+
+	lockKey := "mass_reissue_" + opts.ID
+	if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+		return MassReissueStatus{}, fmt.Errorf("unable to acquire lock '%s': %v", lockKey, err)
+	}
+	defer func() {
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			logger.Error("unable to unlock", zap.String("lock_key", lockKey), zap.Error(err))
+		}
+	}()
+
+	status, err := cfg.LoadMassReissueStatus(ctx, opts.ID)
+	if errors.Is(err, fs.ErrNotExist) {
+		status = MassReissueStatus{ID: opts.ID, Started: time.Now()}
+	} else if err != nil {
+		return MassReissueStatus{}, err
+	}
+	status.Criteria = opts.Criteria
+	status.Finished = time.Time{}
+
+	var affected []Certificate
+	for _, cert := range cfg.certCache.getAllCerts() {
+		if !cert.managed || len(cert.Names) == 0 || !opts.Criteria.Matches(cert) {
+			continue
+		}
+		if slices.Contains(status.Reissued, cert.Names[0]) {
+			continue
+		}
+		affected = append(affected, cert)
+	}
+	prioritize := opts.Prioritize
+	if prioritize == nil {
+		prioritize = defaultReissuePriority
+	}
+	sort.SliceStable(affected, func(i, j int) bool { return prioritize(affected[i], affected[j]) })
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultMassReissueConcurrency
+	}
+	var limiter *RingBufferRateLimiter
+	if opts.RateLimit > 0 && opts.RateLimitWindow > 0 {
+		limiter = NewRateLimiter(opts.RateLimit, opts.RateLimitWindow)
+		defer limiter.Stop()
+	}
+
+	logger.Warn("reissuing affected certificates",
+		zap.Int("affected", len(affected)),
+		zap.Int("already_reissued", len(status.Reissued)),
+		zap.Int("concurrency", concurrency))
+	if err := cfg.saveMassReissueStatus(ctx, &status); err != nil {
+		return status, err
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		completed int
+	)
+	certs := make(chan Certificate)
+	for w := 0; w < concurrency && w < len(affected); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for cert := range certs {
+				name := cert.Names[0]
+				err := cfg.reissueCertificate(ctx, logger, cert)
+				if ctx.Err() != nil {
+					continue // interrupted; not a failure of this certificate
+				}
+
+				mu.Lock()
+				if err == nil {
+					status.Reissued = append(status.Reissued, name)
+					delete(status.Failed, name)
+				} else {
+					if status.Failed == nil {
+						status.Failed = make(map[string]string)
+					}
+					status.Failed[name] = err.Error()
+					logger.Error("unable to reissue certificate", zap.String("identifier", name), zap.Error(err))
+				}
+				if err := cfg.saveMassReissueStatus(ctx, &status); err != nil {
+					logger.Error("unable to persist progress", zap.Error(err))
+				}
+				completed++
+				if opts.Progress != nil {
+					opts.Progress(MassReissueProgress{Name: name, Err: err, Completed: completed, Total: len(affected)})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, cert := range affected {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				break feed
+			}
+		}
+		select {
+		case certs <- cert:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(certs)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return status, err
+	}
+
+	status.Finished = time.Now()
+	if err := cfg.saveMassReissueStatus(ctx, &status); err != nil {
+		return status, err
+	}
+	logger.Warn("finished reissuing affected certificates",
+		zap.Int("reissued", len(status.Reissued)),
+		zap.Int("failed", len(status.Failed)))
+	cfg.emit(ctx, "mass_reissue_finished", map[string]any{
+		"id":       status.ID,
+		"reissued": status.Reissued,
+		"failed":   status.Failed,
+	})
+
+	return status, nil
+}
+
+// reissueCertificate replaces cert with a new certificate, using
+// the config for cert.
+func (cfg *Config) reissueCertificate(ctx context.Context, logger *zap.Logger, cert Certificate) error {
+	certCfg, err := cfg.certCache.getConfig(cert)
+	if err != nil {
+		return fmt.Errorf("getting config for certificate: %v", err)
+	}
+	_, err = certCfg.forceRenew(ctx, logger, cert)
+	return err
+}
+
+// defaultReissuePriority puts the certificates that serve the most
+// handshakes first, then the ones expiring soonest.
+func defaultReissuePriority(a, b Certificate) bool {
+	if a.Handshakes() != b.Handshakes() {
+		return a.Handshakes() > b.Handshakes()
+	}
+	return expiresAt(a.Leaf).Before(expiresAt(b.Leaf))
+}
+
+// LoadMassReissueStatus loads the persisted progress of the
+// reissuance with the given ID (see MassReissue). If there
+// is none, the error wraps fs.ErrNotExist.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) LoadMassReissueStatus(ctx context.Context, id string) (MassReissueStatus, error) {
+	data, err := cfg.Storage.Load(ctx, StorageKeys.MassReissue(id))
+	if err != nil {
+		return MassReissueStatus{}, err
+	}
+	var status MassReissueStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return MassReissueStatus{}, fmt.Errorf("decoding mass reissue status %s: %v", id, err)
+	}
+	return status, nil
+}
+
+func (cfg *Config) saveMassReissueStatus(ctx context.Context, status *MassReissueStatus) error {
+	status.Updated = time.Now()
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return fmt.Errorf("encoding mass reissue status: %v", err)
+	}
+	return cfg.Storage.Store(context.WithoutCancel(ctx), StorageKeys.MassReissue(status.ID), data)
+}
+
+// MassReissue returns the storage key for the persisted
+// progress of the reissuance with the given ID.
+func (keys KeyBuilder) MassReissue(id string) string {
+	return path.Join(prefixMassReissue, keys.Safe(id)+".json")
+}
+
+const prefixMassReissue = "reissue"
+
+// DefaultMassReissueConcurrency is the default number of
+// certificates that MassReissue reissues concurrently.
+const DefaultMassReissueConcurrency = 4
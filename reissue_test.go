@@ -0,0 +1,126 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReissueCriteriaMatches(t *testing.T) {
+	notBefore := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	cert := Certificate{issuerKey: "ca"}
+	cert.Leaf = &x509.Certificate{SerialNumber: big.NewInt(0xab12), NotBefore: notBefore}
+	for i, test := range []struct {
+		criteria ReissueCriteria
+		expect   bool
+	}{
+		{ReissueCriteria{Issuers: []string{"ca"}}, true},
+		{ReissueCriteria{Issuers: []string{"other"}}, false},
+		{ReissueCriteria{Serials: []string{"00:AB:12"}}, true},
+		{ReissueCriteria{Serials: []string{"ab13"}}, false},
+		{ReissueCriteria{NotBeforeStart: notBefore, NotBeforeEnd: notBefore.Add(time.Hour)}, true},
+		{ReissueCriteria{NotBeforeEnd: notBefore}, false},
+		{ReissueCriteria{Issuers: []string{"ca"}, NotBeforeStart: notBefore.Add(time.Second)}, false},
+		{ReissueCriteria{Match: func(Certificate) bool { return false }}, false},
+	} {
+		if actual := test.criteria.Matches(cert); actual != test.expect {
+			t.Errorf("test %d: expected %t, got %t", i, test.expect, actual)
+		}
+	}
+}
+
+func TestMassReissue(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+
+	names := []string{"a.example.com", "b.example.com", "c.example.com"}
+	original := make(map[string]Certificate)
+	for _, name := range names {
+		if err := cfg.ObtainCertSync(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		cert, err := cfg.CacheManagedCertificate(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		original[name] = cert
+	}
+
+	if _, err := cfg.MassReissue(ctx, MassReissueOptions{ID: "incident"}); err == nil {
+		t.Error("expected error without criteria")
+	}
+
+	// the CA revoked a and c; c is used more, so it goes first
+	cfg.certCache.AllMatchingCertificates("c.example.com")[0].usage.handshakes.Store(10)
+	var order []string
+	status, err := cfg.MassReissue(ctx, MassReissueOptions{
+		ID: "incident",
+		Criteria: ReissueCriteria{Serials: []string{
+			original["a.example.com"].Leaf.SerialNumber.Text(16),
+			original["c.example.com"].Leaf.SerialNumber.Text(16),
+		}},
+		Concurrency:     1,
+		RateLimit:       10,
+		RateLimitWindow: time.Minute,
+		Progress:        func(p MassReissueProgress) { order = append(order, p.Name) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(order, []string{"c.example.com", "a.example.com"}) {
+		t.Errorf("expected certificates to be reissued in priority order, got %v", order)
+	}
+	if !status.Done() || len(status.Reissued) != 2 {
+		t.Errorf("expected 2 certificates to be reissued, got %+v", status)
+	}
+	for _, name := range names {
+		certs := cfg.certCache.AllMatchingCertificates(name)
+		if len(certs) != 1 {
+			t.Fatalf("expected 1 certificate for %s, got %d", name, len(certs))
+		}
+		replaced := certs[0].hash != original[name].hash
+		if expect := name != "b.example.com"; replaced != expect {
+			t.Errorf("expected certificate for %s to be replaced: %t, got %t", name, expect, replaced)
+		}
+	}
+
+	// continuing the same reissuance skips the certificates that were
+	// reissued already, even if they still match the criteria
+	order = nil
+	status, err = cfg.MassReissue(ctx, MassReissueOptions{
+		ID:       "incident",
+		Criteria: ReissueCriteria{Issuers: []string{"fake"}},
+		Progress: func(p MassReissueProgress) { order = append(order, p.Name) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(order, []string{"b.example.com"}) {
+		t.Errorf("expected only the remaining certificate to be reissued, got %v", order)
+	}
+	persisted, err := cfg.LoadMassReissueStatus(ctx, "incident")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !persisted.Done() || len(persisted.Reissued) != 3 || !slices.Equal(persisted.Criteria.Issuers, []string{"fake"}) {
+		t.Errorf("expected persisted progress, got %+v", persisted)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RenewalPlanOptions configures a call to Cache.PlanRenewals.
+type RenewalPlanOptions struct {
+	// How far into the future to plan.
+	// Default: 30 days.
+	Horizon time.Duration
+
+	// Names that are not yet managed but would be (for
+	// example, domains about to be onboarded). They are
+	// planned as if obtained immediately using OnboardConfig.
+	Onboard []string
+
+	// The config that would manage the Onboard names.
+	// Required if Onboard is not empty.
+	OnboardConfig *Config
+
+	// The lifetime to assume for certificates that have not
+	// been issued yet (onboarded names), unless OnboardConfig
+	// requests a lifetime. Renewals of existing certificates
+	// assume the same lifetime as the current certificate.
+	// Default: 90 days.
+	AssumedLifetime time.Duration
+
+	// The length of the sliding window used to report peak
+	// issuance per issuer, which is helpful to compare with
+	// CA rate limits (which are commonly weekly).
+	// Default: 7 days.
+	RateLimitWindow time.Duration
+}
+
+// RenewalPlan describes what certificate maintenance would do over
+// a period of time, assuming every issuance succeeds on time.
+type RenewalPlan struct {
+	// The period of time covered by the plan.
+	Start, End time.Time
+
+	// Planned issuances, sorted by time.
+	Issuances []PlannedIssuance
+
+	// The total number of planned issuances per issuer key
+	// over the entire plan.
+	IssuerTotals map[string]int
+
+	// The greatest number of issuances per issuer key that
+	// fall within any one RateLimitWindow.
+	IssuerPeaks map[string]int
+}
+
+// PlannedIssuance is a single obtain or renewal in a RenewalPlan.
+type PlannedIssuance struct {
+	// The names on the certificate.
+	Names []string
+
+	// When the issuance would happen.
+	Time time.Time
+
+	// "obtain" for new certificates, "renew" otherwise.
+	Kind string
+
+	// Why the issuance would happen at this time: "ari"
+	// if the time was suggested by the CA, "window" if
+	// it is the start of the renewal window, "due" if the
+	// certificate is already due for renewal, "onboard"
+	// for names that are not managed yet.
+	Reason string
+
+	// The issuer key of the issuer that would be used, or
+	// empty if it would be chosen at random from Issuers.
+	Issuer string
+
+	// The issuers that would be used, in order of preference.
+	Issuers []string
+
+	// True if this issuance renews a certificate that is itself
+	// planned (i.e. not yet issued) earlier in the plan.
+	Projected bool
+}
+
+// PlanRenewals reports what maintenance would do for the managed certificates
+// in the cache (and optionally, names yet to be managed) over the planning
+// horizon, without performing any issuance. It reports which certificates
+// would be renewed when and by which issuer, and how many issuances each
+// issuer would perform, which is useful for capacity planning with respect
+// to CA rate limits.
+//
+// The plan assumes that every issuance succeeds on time and that renewed
+// certificates have the same lifetime as the ones they replace. Since
+// ARI windows of future certificates are not known, their renewals are
+// planned according to the renewal window ratio.
+func (certCache *Cache) PlanRenewals(opts RenewalPlanOptions) (RenewalPlan, error) {
+	if opts.Horizon <= 0 {
+		opts.Horizon = 30 * 24 * time.Hour
+	}
+	if opts.AssumedLifetime <= 0 {
+		opts.AssumedLifetime = 90 * 24 * time.Hour
+	}
+	if opts.RateLimitWindow <= 0 {
+		opts.RateLimitWindow = 7 * 24 * time.Hour
+	}
+	if len(opts.Onboard) > 0 && opts.OnboardConfig == nil {
+		return RenewalPlan{}, fmt.Errorf("onboard config is required to plan for new names")
+	}
+
+	now := time.Now()
+	plan := RenewalPlan{
+		Start:        now,
+		End:          now.Add(opts.Horizon),
+		IssuerTotals: make(map[string]int),
+		IssuerPeaks:  make(map[string]int),
+	}
+
+	for _, cert := range certCache.getAllCerts() {
+		if !cert.managed || cert.Leaf == nil {
+			continue
+		}
+		cfg, err := certCache.getConfig(cert)
+		if err != nil {
+			return plan, fmt.Errorf("getting config for certificate %v: %v", cert.Names, err)
+		}
+
+		renewAt, reason := cfg.plannedRenewalTime(cert, now)
+		plan.addIssuances(cfg, PlannedIssuance{
+			Names:  cert.Names,
+			Time:   renewAt,
+			Kind:   "renew",
+			Reason: reason,
+		}, cert.Lifetime())
+	}
+
+	for _, name := range opts.Onboard {
+		name = normalizedName(name)
+		lifetime := opts.AssumedLifetime
+		if requested, ok := RequestedLifetime(opts.OnboardConfig.withRequestedLifetime(context.Background(), name)); ok {
+			lifetime = requested
+		}
+		plan.addIssuances(opts.OnboardConfig, PlannedIssuance{
+			Names:  []string{name},
+			Time:   now,
+			Kind:   "obtain",
+			Reason: "onboard",
+		}, lifetime)
+	}
+
+	sort.SliceStable(plan.Issuances, func(i, j int) bool {
+		return plan.Issuances[i].Time.Before(plan.Issuances[j].Time)
+	})
+
+	// tally issuances per issuer, and find the busiest window for each
+	times := make(map[string][]time.Time)
+	for _, iss := range plan.Issuances {
+		keys := iss.Issuers
+		if iss.Issuer != "" {
+			keys = []string{iss.Issuer}
+		}
+		// when choosing randomly, count toward every candidate as an upper bound
+		for _, key := range keys {
+			plan.IssuerTotals[key]++
+			times[key] = append(times[key], iss.Time)
+		}
+	}
+	for key, ts := range times {
+		var peak, first int
+		for last := range ts {
+			for ts[last].Sub(ts[first]) >= opts.RateLimitWindow {
+				first++
+			}
+			peak = max(peak, last-first+1)
+		}
+		plan.IssuerPeaks[key] = peak
+	}
+
+	return plan, nil
+}
+
+// addIssuances adds first to the plan, along with every projected renewal
+// of it within the plan, given the lifetime of each issued certificate.
+func (plan *RenewalPlan) addIssuances(cfg *Config, first PlannedIssuance, lifetime time.Duration) {
+	var issuers []string
+	for _, iss := range cfg.Issuers {
+		issuers = append(issuers, iss.IssuerKey())
+	}
+	if len(issuers) > 0 && cfg.IssuerPolicy != UseFirstRandomIssuer {
+		first.Issuer = issuers[0]
+	}
+	first.Issuers = issuers
+
+	ratio := cfg.RenewalWindowRatio
+	if ratio == 0 {
+		ratio = DefaultRenewalWindowRatio
+	}
+	renewAfter := lifetime - time.Duration(float64(lifetime)*ratio)
+
+	for next := first; !next.Time.After(plan.End); {
+		plan.Issuances = append(plan.Issuances, next)
+		if renewAfter <= 0 {
+			break
+		}
+		next.Time = next.Time.Add(renewAfter)
+		next.Kind = "renew"
+		next.Reason = "window"
+		next.Projected = true
+	}
+}
+
+// plannedRenewalTime returns when cert would be renewed by maintenance,
+// and the reason for that time.
+func (cfg *Config) plannedRenewalTime(cert Certificate, now time.Time) (time.Time, string) {
+	if !cfg.DisableARI && !cert.ari.SelectedTime.IsZero() {
+		if cert.ari.SelectedTime.Before(now) {
+			return now, "due"
+		}
+		return cert.ari.SelectedTime, "ari"
+	}
+	ratio := cfg.RenewalWindowRatio
+	if ratio == 0 {
+		ratio = DefaultRenewalWindowRatio
+	}
+	notAfter := expiresAt(cert.Leaf)
+	windowStart := notAfter.Add(-time.Duration(float64(notAfter.Sub(cert.Leaf.NotBefore)) * ratio))
+	if windowStart.Before(now) {
+		return now, "due"
+	}
+	return windowStart, "window"
+}
@@ -0,0 +1,135 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestPlanRenewals(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+
+	certCache := &Cache{
+		cache:      make(map[string]Certificate),
+		cacheIndex: make(map[string][]string),
+		logger:     defaultTestLogger,
+	}
+	cfg := &Config{
+		Issuers:            []Issuer{&ACMEIssuer{CA: "https://example.com/acme/directory"}},
+		RenewalWindowRatio: DefaultRenewalWindowRatio,
+		Logger:             defaultTestLogger,
+		certCache:          certCache,
+	}
+	certCache.options.GetConfigForCert = func(Certificate) (*Config, error) { return cfg, nil }
+
+	// a 90-day cert issued 30 days ago enters its renewal window in 30 days
+	certCache.cacheCertificate(Certificate{
+		Names:   []string{"window.example.com"},
+		hash:    "window",
+		managed: true,
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{
+			NotBefore: now.Add(-30 * day),
+			NotAfter:  now.Add(60 * day),
+		}},
+	})
+	// a cert that is already in its renewal window is due now
+	certCache.cacheCertificate(Certificate{
+		Names:   []string{"due.example.com"},
+		hash:    "due",
+		managed: true,
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{
+			NotBefore: now.Add(-80 * day),
+			NotAfter:  now.Add(10 * day),
+		}},
+	})
+	// ARI takes precedence over the renewal window
+	certCache.cacheCertificate(Certificate{
+		Names:   []string{"ari.example.com"},
+		hash:    "ari",
+		managed: true,
+		ari:     acme.RenewalInfo{SelectedTime: now.Add(5 * day)},
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{
+			NotBefore: now.Add(-30 * day),
+			NotAfter:  now.Add(60 * day),
+		}},
+	})
+	// unmanaged certs are not planned
+	certCache.cacheCertificate(Certificate{
+		Names: []string{"unmanaged.example.com"},
+		hash:  "unmanaged",
+		Certificate: tls.Certificate{Leaf: &x509.Certificate{
+			NotBefore: now.Add(-80 * day),
+			NotAfter:  now.Add(10 * day),
+		}},
+	})
+
+	plan, err := certCache.PlanRenewals(RenewalPlanOptions{
+		Horizon:       45 * day,
+		Onboard:       []string{"new.example.com"},
+		OnboardConfig: cfg,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reasons := make(map[string]string)
+	for _, iss := range plan.Issuances {
+		if !iss.Projected {
+			reasons[iss.Names[0]] = iss.Reason
+		}
+		if iss.Issuer != cfg.Issuers[0].IssuerKey() {
+			t.Errorf("unexpected issuer for %v: %s", iss.Names, iss.Issuer)
+		}
+	}
+	expected := map[string]string{
+		"window.example.com": "window",
+		"due.example.com":    "due",
+		"ari.example.com":    "ari",
+		"new.example.com":    "onboard",
+	}
+	for name, reason := range expected {
+		if reasons[name] != reason {
+			t.Errorf("expected %s to be planned because of %q, got %q", name, reason, reasons[name])
+		}
+	}
+	if _, ok := reasons["unmanaged.example.com"]; ok {
+		t.Error("unmanaged certificate should not be planned")
+	}
+
+	// the due cert and the onboarded name are both renewed again 60 days after
+	// their (re)issuance, which is outside the horizon, so 4 issuances total
+	if len(plan.Issuances) != 4 {
+		t.Errorf("expected 4 issuances, got %d: %+v", len(plan.Issuances), plan.Issuances)
+	}
+	for i := 1; i < len(plan.Issuances); i++ {
+		if plan.Issuances[i].Time.Before(plan.Issuances[i-1].Time) {
+			t.Error("issuances are not sorted by time")
+		}
+	}
+	key := cfg.Issuers[0].IssuerKey()
+	if plan.IssuerTotals[key] != 4 {
+		t.Errorf("expected 4 issuances for %s, got %d", key, plan.IssuerTotals[key])
+	}
+	// due, onboard, and ari all fall within the first week; window does not
+	if plan.IssuerPeaks[key] != 3 {
+		t.Errorf("expected peak of 3 issuances per week for %s, got %d", key, plan.IssuerPeaks[key])
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+// RevocationImpact describes what would be affected by revoking the
+// certificate for a name with Config.RevokeCert.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type RevocationImpact struct {
+	// The name whose certificate would be revoked.
+	Identifier string
+
+	// The keys of the issuers that have a certificate
+	// for the name in storage, which would be revoked.
+	Issuers []string
+
+	// The keys of the issuers that have a certificate
+	// for the name but cannot revoke it; RevokeCert
+	// would fail for them.
+	NotRevokable []string
+
+	// The cached certificates that would be affected.
+	Certificates []AffectedCertificate
+
+	// The names that are served by the affected
+	// certificates and for which no other valid
+	// certificate is cached: once the certificates
+	// are revoked, TLS clients that check revocation
+	// would fail to connect to them.
+	Unserved []string
+}
+
+// AffectedCertificate is a cached certificate that would be affected by
+// revoking a certificate; see RevocationImpact.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type AffectedCertificate struct {
+	// The subject names on the certificate.
+	Names []string
+
+	// The hash of the certificate chain; see Certificate.Hash.
+	Hash string
+
+	// Whether the certificate is managed.
+	Managed bool
+
+	// The tags of the certificate.
+	Tags []string
+
+	// Whether the certificate is not one that would be
+	// revoked, but a different one with the same private
+	// key, for example an unmanaged copy that was loaded
+	// with a new chain. Such certificates are affected if
+	// the revocation reason is key compromise, since CAs
+	// then revoke all certificates for the key.
+	SharesKeyOnly bool
+
+	// See Certificate.Handshakes and Certificate.LastServed.
+	Handshakes uint64
+	LastServed time.Time
+
+	// The config that the cache uses for the certificate
+	// (see CacheOptions.GetConfigForCert), if any.
+	Config *Config
+}
+
+// RevocationImpact reports what revoking the certificate for name with
+// RevokeCert would affect, without revoking anything: which of cfg's
+// issuers would revoke a certificate, which cached certificates are
+// copies of those certificates or share their private key, and which
+// names would be left without a valid certificate. Operators can use
+// it before revoking to avoid taking down co-hosted services.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) RevocationImpact(ctx context.Context, name string) (RevocationImpact, error) {
+	impact := RevocationImpact{Identifier: name}
+
+	var leaves []*x509.Certificate
+	for i, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		certRes, err := cfg.loadCertResource(ctx, issuer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return impact, fmt.Errorf("issuer %d (%s): loading certificate: %v", i, issuerKey, err)
+		}
+		certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+		if err != nil {
+			return impact, fmt.Errorf("issuer %d (%s): parsing certificate: %v", i, issuerKey, err)
+		}
+		if _, ok := issuer.(Revoker); !ok {
+			impact.NotRevokable = append(impact.NotRevokable, issuerKey)
+			continue
+		}
+		impact.Issuers = append(impact.Issuers, issuerKey)
+		leaves = append(leaves, certs[0])
+	}
+	if len(leaves) == 0 {
+		return impact, nil
+	}
+
+	affected := make(map[string]bool)
+	names := make(map[string]struct{})
+	for _, cert := range cfg.certCache.getAllCerts() {
+		if cert.Leaf == nil {
+			continue
+		}
+		same, sharesKey := revocationAffects(cert.Leaf, leaves)
+		if !same && !sharesKey {
+			continue
+		}
+		affected[cert.hash] = true
+		for _, n := range cert.Names {
+			names[n] = struct{}{}
+		}
+		ac := AffectedCertificate{
+			Names:         cert.Names,
+			Hash:          cert.hash,
+			Managed:       cert.managed,
+			Tags:          cert.Tags,
+			SharesKeyOnly: !same,
+			Handshakes:    cert.Handshakes(),
+			LastServed:    cert.LastServed(),
+		}
+		if certCfg, err := cfg.certCache.getConfig(cert); err == nil {
+			ac.Config = certCfg
+		}
+		impact.Certificates = append(impact.Certificates, ac)
+	}
+	sort.Slice(impact.Certificates, func(i, j int) bool {
+		return impact.Certificates[i].Hash < impact.Certificates[j].Hash
+	})
+
+	for n := range names {
+		var served bool
+		for _, other := range cfg.certCache.AllMatchingCertificates(n) {
+			if !affected[other.hash] && !other.Expired() {
+				served = true
+				break
+			}
+		}
+		if !served {
+			impact.Unserved = append(impact.Unserved, n)
+		}
+	}
+	sort.Strings(impact.Unserved)
+
+	return impact, nil
+}
+
+// revocationAffects returns whether leaf is one of the certificates
+// to revoke, or whether it shares the private key of one of them.
+func revocationAffects(leaf *x509.Certificate, revoke []*x509.Certificate) (same, sharesKey bool) {
+	pub, ok := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	for _, r := range revoke {
+		if bytes.Equal(leaf.Raw, r.Raw) {
+			return true, false
+		}
+		if ok && pub.Equal(r.PublicKey) {
+			sharesKey = true
+		}
+	}
+	return false, sharesKey
+}
@@ -0,0 +1,107 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"reflect"
+	"testing"
+)
+
+func TestRevocationImpact(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+
+	if impact, err := cfg.RevocationImpact(ctx, "example.com"); err != nil || len(impact.Issuers) > 0 {
+		t.Fatalf("expected no impact without certificate, got %+v (err=%v)", impact, err)
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	managed, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRes, err := cfg.loadCertResource(ctx, fi, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an unmanaged copy with the same key for a co-hosted service
+	key, err := PEMDecodePrivateKey(certRes.PrivateKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"co.example.com"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := fi.Issue(ctx, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedHash, err := cfg.CacheUnmanagedCertificatePEMBytes(ctx, issued.Certificate, certRes.PrivateKeyPEM, []string{"co-hosted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unrelated certificates are not affected
+	unrelated, _ := issueFakeCertificate(t, fi, "other.example.com")
+	if _, err := cfg.CacheUnmanagedTLSCertificate(ctx, unrelated.Certificate, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	impact, err := cfg.RevocationImpact(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(impact.Issuers, []string{fi.IssuerKey()}) {
+		t.Errorf("expected issuer %s, got %v", fi.IssuerKey(), impact.Issuers)
+	}
+	if len(impact.Certificates) != 2 {
+		t.Fatalf("expected 2 affected certificates, got %+v", impact.Certificates)
+	}
+	for _, ac := range impact.Certificates {
+		switch ac.Hash {
+		case managed.hash:
+			if ac.SharesKeyOnly || !ac.Managed || ac.Config != cfg {
+				t.Errorf("unexpected impact on managed certificate: %+v", ac)
+			}
+		case sharedHash:
+			if !ac.SharesKeyOnly || ac.Managed || !reflect.DeepEqual(ac.Tags, []string{"co-hosted"}) {
+				t.Errorf("unexpected impact on co-hosted certificate: %+v", ac)
+			}
+		default:
+			t.Errorf("unexpected affected certificate: %v", ac.Names)
+		}
+	}
+	if !reflect.DeepEqual(impact.Unserved, []string{"co.example.com", "example.com"}) {
+		t.Errorf("expected co-hosted and managed names to be unserved, got %v", impact.Unserved)
+	}
+
+	// analysis does not revoke anything
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert(fi.IssuerKey(), "example.com")) {
+		t.Error("expected certificate to remain in storage")
+	}
+}
@@ -0,0 +1,367 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+// RFC2136Provider is a DNSProvider that adds and removes the TXT records
+// of DNS challenges with dynamic updates (RFC 2136) signed with TSIG
+// (RFC 8945), as supported by BIND, Knot, PowerDNS, and others. It is
+// used with DNS01Solver, e.g. DNSManager{DNSProvider: &RFC2136Provider{...}}.
+// It also implements the other libdns interfaces for records, so it can
+// manage records of any type, and so that leftover challenge records can
+// be cleaned up (see DecommissionOptions.CleanUpDNS). The values of
+// records other than TXT records are in zone file syntax.
+//
+// Since the provider holds a credential that can change the zone, it
+// should be restricted on the name server to the challenge records; in
+// BIND, for example, with:
+//
+//	update-policy { grant acme-key. name _acme-challenge.example.com. TXT; };
+//
+// With DNSManager.OverrideDomain, challenges can be delegated to a zone
+// that is used for nothing else, so that the key cannot change any
+// records that are served to clients.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type RFC2136Provider struct {
+	// The address of the primary name server of the zones, which
+	// accepts dynamic updates; the port defaults to 53. REQUIRED.
+	Server string
+
+	// The name of the TSIG key, e.g. "acme-key.". REQUIRED.
+	KeyName string
+
+	// The TSIG algorithm, e.g. "hmac-sha512."; the default is
+	// "hmac-sha256.".
+	KeyAlgorithm string
+
+	// The base64-encoded TSIG secret. Required, unless
+	// Signer is set.
+	Key string
+
+	// If set, signs and verifies updates instead of Key, e.g.
+	// for keys held in an HSM, or for GSS-TSIG.
+	Signer dns.TsigProvider
+
+	// The network to send updates over: "udp" or "tcp"
+	// (the default).
+	Network string
+
+	// How long to wait for the server to answer an update.
+	// Default: 10 seconds.
+	Timeout time.Duration
+}
+
+// GetRecords implements libdns.RecordGetter by transferring the zone
+// (AXFR) from the server, signed with the same TSIG key as updates, so
+// the server must also allow the key to transfer the zone; in BIND, for
+// example, with "allow-transfer { key acme-key.; };". The SOA record of
+// the zone is not included.
+func (p *RFC2136Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
+	keyName, algorithm, secret, err := p.tsig()
+	if err != nil {
+		return nil, err
+	}
+	zone = dns.Fqdn(zone)
+	msg := new(dns.Msg)
+	msg.SetAxfr(zone)
+	msg.SetTsig(keyName, algorithm, 300, time.Now().Unix())
+
+	// dial ourselves so that the transfer can be canceled with ctx
+	server := p.serverAddr()
+	dialer := &net.Dialer{Timeout: p.timeout()}
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("transferring zone %s: %w", zone, err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	transfer := &dns.Transfer{
+		Conn:         &dns.Conn{Conn: conn},
+		ReadTimeout:  p.timeout(),
+		WriteTimeout: p.timeout(),
+		TsigSecret:   secret,
+		TsigProvider: p.Signer,
+	}
+	envelopes, err := transfer.In(msg, server)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("transferring zone %s: %w", zone, err)
+	}
+	var recs []libdns.Record
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("transferring zone %s from server %s: %w", zone, server, envelope.Error)
+		}
+		for _, rr := range envelope.RR {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				continue
+			}
+			recs = append(recs, rfc2136Record(zone, rr))
+		}
+	}
+	return recs, nil
+}
+
+// AppendRecords implements libdns.RecordAppender.
+func (p *RFC2136Provider) AppendRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := rfc2136RRs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.Insert(rrs)
+	if err := p.update(ctx, msg); err != nil {
+		return nil, fmt.Errorf("adding records to zone %s: %w", zone, err)
+	}
+	return recs, nil
+}
+
+// SetRecords implements libdns.RecordSetter. All records with the names
+// and types of recs are replaced by recs, in a single update, so that
+// the zone never lacks records of those names and types.
+func (p *RFC2136Provider) SetRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	rrs, err := rfc2136RRs(zone, recs)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.RemoveRRset(rrs)
+	msg.Insert(rrs)
+	if err := p.update(ctx, msg); err != nil {
+		return nil, fmt.Errorf("setting records in zone %s: %w", zone, err)
+	}
+	return recs, nil
+}
+
+// DeleteRecords implements libdns.RecordDeleter. Records with the given
+// names, types, and values are deleted; if the value of a record is
+// empty, all records with its name and type are deleted.
+func (p *RFC2136Provider) DeleteRecords(ctx context.Context, zone string, recs []libdns.Record) ([]libdns.Record, error) {
+	var exact, rrsets []libdns.Record
+	for _, rec := range recs {
+		if rec.Value == "" {
+			rrsets = append(rrsets, rec)
+		} else {
+			exact = append(exact, rec)
+		}
+	}
+	exactRRs, err := rfc2136RRs(zone, exact)
+	if err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(zone))
+	msg.Remove(exactRRs)
+	for _, rec := range rrsets {
+		rrtype, ok := dns.StringToType[strings.ToUpper(rec.Type)]
+		if !ok {
+			return nil, fmt.Errorf("unknown record type %s", rec.Type)
+		}
+		msg.RemoveRRset([]dns.RR{&dns.ANY{Hdr: dns.RR_Header{
+			Name:   libdns.AbsoluteName(rec.Name, dns.Fqdn(zone)),
+			Rrtype: rrtype,
+		}}})
+	}
+	if err := p.update(ctx, msg); err != nil {
+		return nil, fmt.Errorf("deleting records from zone %s: %w", zone, err)
+	}
+	return recs, nil
+}
+
+// update signs msg and sends it to the server.
+func (p *RFC2136Provider) update(ctx context.Context, msg *dns.Msg) error {
+	keyName, algorithm, secret, err := p.tsig()
+	if err != nil {
+		return err
+	}
+	client := &dns.Client{
+		Net:          p.Network,
+		Timeout:      p.timeout(),
+		TsigSecret:   secret,
+		TsigProvider: p.Signer,
+	}
+	if client.Net == "" {
+		client.Net = "tcp"
+	}
+	msg.SetTsig(keyName, algorithm, 300, time.Now().Unix())
+
+	server := p.serverAddr()
+	resp, _, err := client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server %s refused update: %s", server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// tsig returns the canonical name and algorithm of the TSIG key, and
+// the secrets to sign messages with if there is no Signer.
+func (p *RFC2136Provider) tsig() (keyName, algorithm string, secret map[string]string, err error) {
+	if p.Server == "" || p.KeyName == "" {
+		return "", "", nil, fmt.Errorf("server and key name are required")
+	}
+	keyName = dns.CanonicalName(p.KeyName)
+	algorithm = dns.HmacSHA256
+	if p.KeyAlgorithm != "" {
+		algorithm = dns.CanonicalName(p.KeyAlgorithm)
+	}
+	if p.Signer == nil {
+		if _, err := base64.StdEncoding.DecodeString(p.Key); err != nil || p.Key == "" {
+			return "", "", nil, fmt.Errorf("invalid TSIG key %s: must be base64-encoded", keyName)
+		}
+		secret = map[string]string{keyName: p.Key}
+	}
+	return keyName, algorithm, secret, nil
+}
+
+func (p *RFC2136Provider) serverAddr() string {
+	if _, _, err := net.SplitHostPort(p.Server); err != nil {
+		return net.JoinHostPort(p.Server, "53")
+	}
+	return p.Server
+}
+
+func (p *RFC2136Provider) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
+
+// rfc2136PriorityFields maps the record types whose data starts
+// with the fields in Record.Priority (and Record.Weight) to the
+// number of those fields.
+var rfc2136PriorityFields = map[string]int{
+	"MX":    1,
+	"HTTPS": 1,
+	"SVCB":  1,
+	"SRV":   2,
+	"URI":   2,
+}
+
+// rfc2136RRs converts recs in zone to resource records. The values of
+// records other than TXT records are parsed in zone file syntax.
+func rfc2136RRs(zone string, recs []libdns.Record) ([]dns.RR, error) {
+	zone = dns.Fqdn(zone)
+	rrs := make([]dns.RR, 0, len(recs))
+	for _, rec := range recs {
+		name := libdns.AbsoluteName(rec.Name, zone)
+		rrtype := strings.ToUpper(rec.Type)
+		ttl := uint32(rec.TTL.Seconds())
+		if ttl == 0 {
+			ttl = 60
+		}
+		if rrtype == "TXT" {
+			rrs = append(rrs, &dns.TXT{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeTXT,
+					Class:  dns.ClassINET,
+					Ttl:    ttl,
+				},
+				Txt: splitTXTValue(rec.Value),
+			})
+			continue
+		}
+		rdata := rec.Value
+		switch rfc2136PriorityFields[rrtype] {
+		case 1:
+			rdata = fmt.Sprintf("%d %s", rec.Priority, rdata)
+		case 2:
+			rdata = fmt.Sprintf("%d %d %s", rec.Priority, rec.Weight, rdata)
+		}
+		// relative names in the data are relative to the zone
+		rr, err := dns.NewRR(fmt.Sprintf("$ORIGIN %s\n%s %d IN %s %s", zone, name, ttl, rrtype, rdata))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record %s: %v", rec.Type, rec.Name, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("invalid %s record %s: no data", rec.Type, rec.Name)
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs, nil
+}
+
+// rfc2136Record converts rr in zone to a record.
+func rfc2136Record(zone string, rr dns.RR) libdns.Record {
+	hdr := rr.Header()
+	rec := libdns.Record{
+		Type: dns.TypeToString[hdr.Rrtype],
+		Name: libdns.RelativeName(hdr.Name, zone),
+		TTL:  time.Duration(hdr.Ttl) * time.Second,
+	}
+	if rec.Name == "" {
+		rec.Name = "@"
+	}
+	if txt, ok := rr.(*dns.TXT); ok {
+		rec.Value = strings.Join(txt.Txt, "")
+		return rec
+	}
+	rdata := strings.TrimPrefix(rr.String(), hdr.String())
+	if n := rfc2136PriorityFields[rec.Type]; n > 0 {
+		fields := strings.SplitN(rdata, " ", n+1)
+		if len(fields) == n+1 {
+			priority, _ := strconv.ParseUint(fields[0], 10, 16)
+			rec.Priority = uint(priority)
+			if n == 2 {
+				weight, _ := strconv.ParseUint(fields[1], 10, 16)
+				rec.Weight = uint(weight)
+			}
+			rdata = fields[n]
+		}
+	}
+	rec.Value = rdata
+	return rec
+}
+
+// splitTXTValue splits value into the character strings of a TXT
+// record, which are at most 255 bytes long.
+func splitTXTValue(value string) []string {
+	var parts []string
+	for len(value) > 255 {
+		parts = append(parts, value[:255])
+		value = value[255:]
+	}
+	return append(parts, value)
+}
+
+// Interface guards
+var (
+	_ DNSProvider         = (*RFC2136Provider)(nil)
+	_ libdns.RecordGetter = (*RFC2136Provider)(nil)
+	_ libdns.RecordSetter = (*RFC2136Provider)(nil)
+)
@@ -0,0 +1,215 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+)
+
+const testTSIGKey = "c2VjcmV0LXNlY3JldC1zZWNyZXQtc2VjcmV0LXNlY3JldA=="
+
+// testUpdateServer is a name server that accepts dynamic updates and
+// zone transfers signed with testTSIGKey and keeps the records in memory.
+type testUpdateServer struct {
+	mu  sync.Mutex
+	rrs []dns.RR
+}
+
+func newTestUpdateServer(t *testing.T) (*testUpdateServer, string) {
+	ts := new(testUpdateServer)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{
+		Listener:   ln,
+		TsigSecret: map[string]string{"acme-key.": testTSIGKey},
+		Handler:    ts,
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction {
+			return dns.MsgAccept
+		},
+	}
+	go srv.ActivateAndServe()
+	t.Cleanup(func() { srv.Shutdown() })
+	return ts, ln.Addr().String()
+}
+
+func (ts *testUpdateServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		resp.Rcode = dns.RcodeRefused
+		w.WriteMsg(resp)
+		return
+	}
+	if r.Opcode == dns.OpcodeQuery && r.Question[0].Qtype == dns.TypeAXFR {
+		ts.transfer(w, r)
+		return
+	}
+	ts.mu.Lock()
+	for _, rr := range r.Ns {
+		hdr := rr.Header()
+		switch hdr.Class {
+		case dns.ClassANY: // delete RRset
+			ts.rrs = slices.DeleteFunc(ts.rrs, func(have dns.RR) bool {
+				return have.Header().Name == hdr.Name && have.Header().Rrtype == hdr.Rrtype
+			})
+		case dns.ClassNONE: // delete RR
+			ts.rrs = slices.DeleteFunc(ts.rrs, func(have dns.RR) bool {
+				return testRRData(have) == testRRData(rr)
+			})
+		default:
+			ts.rrs = append(ts.rrs, dns.Copy(rr))
+		}
+	}
+	ts.mu.Unlock()
+	resp.SetTsig(r.IsTsig().Hdr.Name, r.IsTsig().Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(resp)
+}
+
+func (ts *testUpdateServer) transfer(w dns.ResponseWriter, r *dns.Msg) {
+	zone := r.Question[0].Name
+	soa, _ := dns.NewRR(zone + " 3600 IN SOA ns1." + zone + " admin." + zone + " 1 3600 600 86400 60")
+	ts.mu.Lock()
+	rrs := append([]dns.RR{soa}, ts.rrs...)
+	ts.mu.Unlock()
+	rrs = append(rrs, soa)
+
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	resp.Answer = rrs
+	resp.SetTsig(r.IsTsig().Hdr.Name, r.IsTsig().Algorithm, 300, time.Now().Unix())
+	w.WriteMsg(resp)
+}
+
+// record returns the value of the TXT record with the given name.
+func (ts *testUpdateServer) record(name string) (string, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, rr := range ts.rrs {
+		if txt, ok := rr.(*dns.TXT); ok && txt.Hdr.Name == name {
+			return strings.Join(txt.Txt, ""), true
+		}
+	}
+	return "", false
+}
+
+// testRRData returns rr without its TTL and class, to compare RRs
+// for deletion.
+func testRRData(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Ttl = 0
+	rr.Header().Class = dns.ClassINET
+	return rr.String()
+}
+
+func TestRFC2136Provider(t *testing.T) {
+	ctx := context.Background()
+	ts, addr := newTestUpdateServer(t)
+	p := &RFC2136Provider{Server: addr, KeyName: "ACME-key", Key: testTSIGKey}
+
+	rec := libdns.Record{Type: "TXT", Name: "_acme-challenge", Value: "token", TTL: time.Minute}
+	if _, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{rec}); err != nil {
+		t.Fatalf("appending record: %v", err)
+	}
+	if value, ok := ts.record("_acme-challenge.example.com."); !ok || value != "token" {
+		t.Errorf("expected record with value 'token', got %q (exists=%t)", value, ok)
+	}
+	if _, err := p.DeleteRecords(ctx, "example.com.", []libdns.Record{rec}); err != nil {
+		t.Fatalf("deleting record: %v", err)
+	}
+	if _, ok := ts.record("_acme-challenge.example.com."); ok {
+		t.Error("expected record to be deleted")
+	}
+
+	wrongKey := &RFC2136Provider{Server: addr, KeyName: "acme-key.", Key: "d3Jvbmc="}
+	if _, err := wrongKey.AppendRecords(ctx, "example.com.", []libdns.Record{rec}); err == nil {
+		t.Error("expected update signed with wrong key to fail")
+	}
+	if _, err := p.AppendRecords(ctx, "example.com.", []libdns.Record{{Type: "A", Name: "www", Value: "not-an-ip"}}); err == nil {
+		t.Error("expected invalid record to be rejected")
+	}
+}
+
+func TestRFC2136ProviderRecords(t *testing.T) {
+	ctx := context.Background()
+	_, addr := newTestUpdateServer(t)
+	p := &RFC2136Provider{Server: addr, KeyName: "acme-key.", Key: testTSIGKey}
+	zone := "example.com."
+
+	recs := []libdns.Record{
+		{Type: "A", Name: "www", Value: "192.0.2.1", TTL: 5 * time.Minute},
+		{Type: "A", Name: "www", Value: "192.0.2.2", TTL: 5 * time.Minute},
+		{Type: "MX", Name: "@", Value: "mail", Priority: 10, TTL: time.Hour},
+		{Type: "SRV", Name: "_imap._tcp", Value: "143 mail.example.com.", Priority: 1, Weight: 5, TTL: time.Hour},
+		{Type: "TXT", Name: "@", Value: "v=spf1 -all", TTL: time.Hour},
+	}
+	if _, err := p.AppendRecords(ctx, zone, recs); err != nil {
+		t.Fatalf("appending records: %v", err)
+	}
+	got, err := p.GetRecords(ctx, zone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	// names in the data are made absolute
+	recs[2].Value = "mail.example.com."
+	if !reflect.DeepEqual(got, recs) {
+		t.Errorf("expected records:\n%+v\ngot:\n%+v", recs, got)
+	}
+
+	// setting replaces all records of the name and type
+	set := []libdns.Record{{Type: "A", Name: "www", Value: "192.0.2.3", TTL: time.Minute}}
+	if _, err := p.SetRecords(ctx, zone, set); err != nil {
+		t.Fatalf("setting records: %v", err)
+	}
+	// deleting without a value deletes all records of the name and type
+	if _, err := p.DeleteRecords(ctx, zone, []libdns.Record{{Type: "SRV", Name: "_imap._tcp"}}); err != nil {
+		t.Fatalf("deleting records: %v", err)
+	}
+	got, err = p.GetRecords(ctx, zone)
+	if err != nil {
+		t.Fatalf("getting records: %v", err)
+	}
+	expected := []libdns.Record{recs[2], recs[4], set[0]}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected records:\n%+v\ngot:\n%+v", expected, got)
+	}
+
+	wrongKey := &RFC2136Provider{Server: addr, KeyName: "acme-key.", Key: "d3Jvbmc="}
+	if _, err := wrongKey.GetRecords(ctx, zone); err == nil {
+		t.Error("expected transfer signed with wrong key to fail")
+	}
+}
+
+func TestSplitTXTValue(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	parts := splitTXTValue(long)
+	if len(parts) != 2 || len(parts[0]) != 255 || strings.Join(parts, "") != long {
+		t.Errorf("unexpected split of long value: %d parts", len(parts))
+	}
+	if parts := splitTXTValue("short"); len(parts) != 1 || parts[0] != "short" {
+		t.Errorf("unexpected split of short value: %v", parts)
+	}
+}
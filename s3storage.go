@@ -0,0 +1,646 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// S3Storage is a Storage that keeps its values as objects in a bucket
+// of Amazon S3 or an S3-compatible service, such as MinIO, Backblaze
+// B2, or Cloudflare R2, so that the instances of a cluster can share
+// certificates. Requests are signed with AWS Signature Version 4.
+//
+// Locks are lock objects. They are created with conditional writes
+// (If-None-Match) and deleted with conditional deletes (If-Match), so
+// the service must support them, which S3 and most compatible services
+// do. The holder of a lock rewrites its lock object every third of
+// LockTTL; a lock object that was not written for longer than LockTTL,
+// according to the clock of the service, is stale and may be taken over.
+//
+// Since object stores have no directories, keys are directories only
+// implicitly, as prefixes of other keys; recursive listings contain
+// only the keys of objects.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type S3Storage struct {
+	// The URL of the service, such as
+	// "https://s3.eu-central-1.amazonaws.com"
+	// or "http://localhost:9000". Required.
+	Endpoint string
+
+	// The name of the bucket. Required.
+	Bucket string
+
+	// The region of the bucket. Default: "us-east-1",
+	// which compatible services usually accept.
+	Region string
+
+	// An optional prefix for all keys, so that
+	// several deployments can share a bucket.
+	Prefix string
+
+	// The credentials to sign requests with. Default: the
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+	// AWS_SESSION_TOKEN environment variables.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Whether to address the bucket in the path of the URL
+	// rather than in the host name. Most compatible services,
+	// such as MinIO, require it.
+	PathStyle bool
+
+	// How long a lock lasts when its holder stops refreshing
+	// it, for example because it crashed. Default:
+	// DefaultS3LockTTL.
+	LockTTL time.Duration
+
+	// The client for requests to the service.
+	// Default: http.DefaultClient.
+	HTTPClient *http.Client
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu    sync.Mutex
+	locks map[string]*s3Lock
+}
+
+// DefaultS3LockTTL is the default LockTTL of S3Storage.
+const DefaultS3LockTTL = time.Minute
+
+// s3LockPollInterval is how often S3Storage checks
+// whether a lock held by another instance was released.
+const s3LockPollInterval = time.Second
+
+// s3Lock is a lock held by this instance.
+type s3Lock struct {
+	mu   sync.Mutex
+	etag string // of the last write of the lock object
+	stop chan struct{}
+	done chan struct{}
+}
+
+// s3LockMeta is the content of a lock object; the token sets apart
+// the lock objects (and so, their ETags) of different holders.
+type s3LockMeta struct {
+	Token   string    `json:"token"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+// Store implements Storage.
+func (s *S3Storage) Store(ctx context.Context, key string, value []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, s.objectKey(key), nil, nil, value)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp, http.MethodPut, key)
+	}
+	return nil
+}
+
+// Load implements Storage.
+func (s *S3Storage) Load(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(resp, http.MethodGet, key)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Delete implements Storage. Deleting a directory
+// deletes all objects prefixed by it.
+func (s *S3Storage) Delete(ctx context.Context, key string) error {
+	keys, err := s.List(ctx, key, true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for _, k := range append(keys, key) {
+		if err := s.deleteObject(ctx, s.objectKey(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) deleteObject(ctx context.Context, objectKey string) error {
+	resp, err := s.do(ctx, http.MethodDelete, objectKey, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp, http.MethodDelete, objectKey)
+	}
+	return nil
+}
+
+// Exists implements Storage.
+func (s *S3Storage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// List implements Storage.
+func (s *S3Storage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	objectPrefix := strings.TrimSuffix(s.objectKey(prefix), "/") + "/"
+	if prefix == "" {
+		objectPrefix = s.objectKey("")
+	}
+	query := url.Values{"list-type": {"2"}, "prefix": {objectPrefix}}
+	if !recursive {
+		query.Set("delimiter", "/")
+	}
+
+	var keys []string
+	for {
+		resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err := s3Error(resp, "list", prefix)
+			resp.Body.Close()
+			return nil, err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding S3 listing of %s: %v", prefix, err)
+		}
+		for _, obj := range result.Contents {
+			keys = append(keys, s.storageKey(obj.Key))
+		}
+		for _, p := range result.CommonPrefixes {
+			keys = append(keys, s.storageKey(strings.TrimSuffix(p.Prefix, "/")))
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: %w", prefix, fs.ErrNotExist)
+	}
+	return keys, nil
+}
+
+// Stat implements Storage.
+func (s *S3Storage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, s.objectKey(key), nil, nil, nil)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return KeyInfo{
+			Key:        key,
+			Modified:   modified,
+			Size:       resp.ContentLength,
+			IsTerminal: true,
+		}, nil
+	case http.StatusNotFound:
+		// may be a directory
+		if _, err := s.List(ctx, key, false); err != nil {
+			return KeyInfo{}, err
+		}
+		return KeyInfo{Key: key, IsTerminal: false}, nil
+	default:
+		return KeyInfo{}, s3Error(resp, http.MethodHead, key)
+	}
+}
+
+// Lock implements Locker.
+func (s *S3Storage) Lock(ctx context.Context, name string) error {
+	objectKey := s.lockObjectKey(name)
+	meta := s3LockMeta{Token: newLockToken(), Created: time.Now()}
+	meta.Updated = meta.Created
+
+	// the If-Match condition of a take-over of a stale lock
+	var takeOver string
+
+	for {
+		header := http.Header{"If-None-Match": {"*"}}
+		if takeOver != "" {
+			header = http.Header{"If-Match": {takeOver}}
+		}
+		etag, ok, err := s.writeLock(ctx, objectKey, meta, header)
+		if err != nil {
+			return fmt.Errorf("creating lock object for %s: %v", name, err)
+		}
+		if ok {
+			s.holdLock(name, objectKey, meta, etag)
+			return nil
+		}
+		takeOver = ""
+
+		// the lock is held; take it over if it is stale
+		resp, err := s.do(ctx, http.MethodHead, objectKey, nil, nil, nil)
+		if err != nil {
+			return fmt.Errorf("checking lock object for %s: %v", name, err)
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			// just released; try again right away
+			continue
+		case http.StatusOK:
+			if s.lockIsStale(resp.Header) {
+				s.logger().Info("lock is stale; taking over",
+					zap.String("name", name),
+					zap.String("last_modified", resp.Header.Get("Last-Modified")))
+				ReportStaleLockTakeover(ctx, name)
+				takeOver = resp.Header.Get("ETag")
+				continue
+			}
+		default:
+			return fmt.Errorf("checking lock object for %s: %w", name, s3Error(resp, http.MethodHead, objectKey))
+		}
+
+		select {
+		case <-time.After(s3LockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// writeLock writes meta to the lock object at objectKey under the
+// conditions in header. It returns the ETag of the lock object and
+// whether the conditions held.
+func (s *S3Storage) writeLock(ctx context.Context, objectKey string, meta s3LockMeta, header http.Header) (string, bool, error) {
+	body, err := json.Marshal(meta)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := s.do(ctx, http.MethodPut, objectKey, nil, header, body)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("ETag"), true, nil
+	case http.StatusPreconditionFailed, http.StatusConflict, http.StatusNotFound:
+		// a concurrent conditional write won (409), or the
+		// object changed or disappeared since we looked (412, 404)
+		return "", false, nil
+	default:
+		return "", false, s3Error(resp, http.MethodPut, objectKey)
+	}
+}
+
+// lockIsStale returns true if the lock object with the given
+// response headers has not been written for longer than LockTTL.
+// Both times are taken from the service, so that the clocks of the
+// instances do not matter.
+func (s *S3Storage) lockIsStale(header http.Header) bool {
+	modified, err := http.ParseTime(header.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	now, err := http.ParseTime(header.Get("Date"))
+	if err != nil {
+		now = time.Now()
+	}
+	return now.Sub(modified) > s.lockTTL()
+}
+
+// holdLock records that the lock for name is held, and keeps
+// its lock object fresh until it is unlocked.
+func (s *S3Storage) holdLock(name, objectKey string, meta s3LockMeta, etag string) {
+	lock := &s3Lock{etag: etag, stop: make(chan struct{}), done: make(chan struct{})}
+	s.mu.Lock()
+	if s.locks == nil {
+		s.locks = make(map[string]*s3Lock)
+	}
+	s.locks[name] = lock
+	s.mu.Unlock()
+
+	go func() {
+		defer close(lock.done)
+		ticker := time.NewTicker(s.lockTTL() / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-lock.stop:
+				return
+			}
+			lock.mu.Lock()
+			meta.Updated = time.Now()
+			etag, ok, err := s.writeLock(context.Background(), objectKey, meta, http.Header{"If-Match": {lock.etag}})
+			if ok {
+				lock.etag = etag
+			}
+			lock.mu.Unlock()
+			if err != nil || !ok {
+				s.logger().Error("keeping lock fresh; terminating lock maintenance",
+					zap.String("name", name),
+					zap.Bool("lost", err == nil),
+					zap.Error(err))
+				return
+			}
+		}
+	}()
+}
+
+// Unlock implements Locker. The lock object is deleted only
+// if it was not taken over by another instance.
+func (s *S3Storage) Unlock(ctx context.Context, name string) error {
+	s.mu.Lock()
+	lock, ok := s.locks[name]
+	delete(s.locks, name)
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("lock for %s is not held", name)
+	}
+	close(lock.stop)
+	<-lock.done
+
+	// deleting only if the lock object is still the one written last
+	// by us, so that a lock which was taken over in the meantime stays
+	objectKey := s.lockObjectKey(name)
+	resp, err := s.do(ctx, http.MethodDelete, objectKey, nil, http.Header{"If-Match": {lock.etag}}, nil)
+	if err != nil {
+		return fmt.Errorf("deleting lock object for %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusPreconditionFailed, http.StatusNotFound:
+		// no longer ours; nothing to release
+		return nil
+	}
+	return s3Error(resp, http.MethodDelete, objectKey)
+}
+
+func (s *S3Storage) String() string {
+	return "S3Storage:" + strings.TrimSuffix(s.Endpoint, "/") + "/" + path.Join(s.Bucket, s.Prefix)
+}
+
+func (s *S3Storage) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
+}
+
+func (s *S3Storage) lockTTL() time.Duration {
+	if s.LockTTL <= 0 {
+		return DefaultS3LockTTL
+	}
+	return s.LockTTL
+}
+
+// objectKey returns the name of the object for key.
+func (s *S3Storage) objectKey(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	if key == "" {
+		return strings.TrimSuffix(s.Prefix, "/") + "/"
+	}
+	return path.Join(s.Prefix, key)
+}
+
+// storageKey returns the key of the object named objectKey.
+func (s *S3Storage) storageKey(objectKey string) string {
+	if s.Prefix == "" {
+		return objectKey
+	}
+	return strings.TrimPrefix(objectKey, strings.TrimSuffix(s.Prefix, "/")+"/")
+}
+
+func (s *S3Storage) lockObjectKey(name string) string {
+	return s.objectKey(path.Join(prefixLocks, StorageKeys.Safe(name)+".lock"))
+}
+
+// do sends a signed request for the object named objectKey, or
+// for the bucket if objectKey is empty.
+func (s *S3Storage) do(ctx context.Context, method, objectKey string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint: %v", err)
+	}
+	u := *endpoint
+	objectPath := "/" + objectKey
+	if s.PathStyle {
+		objectPath = "/" + s.Bucket + objectPath
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = int64(len(body))
+	}
+	s.sign(req, body, time.Now())
+
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// sign signs req with AWS Signature Version 4.
+func (s *S3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	accessKeyID, secretAccessKey, sessionToken := s.AccessKeyID, s.SecretAccessKey, s.SessionToken
+	if accessKeyID == "" {
+		accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	region := s.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	// the host and all x-amz-* headers are signed
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		if k := strings.ToLower(k); strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := amzDate[:8] + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretAccessKey)
+	for _, part := range []string{amzDate[:8], region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3URIEncode encodes s as required by Signature Version 4: all
+// bytes except unreserved characters are percent-encoded, and so
+// are slashes if encodeSlash is true.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes query with sorted keys, as
+// required by Signature Version 4.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3ListResult is the result of ListObjectsV2.
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// s3Error returns an error for the failed operation on key described
+// by resp. Missing objects are reported with fs.ErrNotExist.
+func s3Error(resp *http.Response, op, key string) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	var body struct {
+		Code    string
+		Message string
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err := xml.Unmarshal(raw, &body); err != nil || body.Code == "" {
+		return fmt.Errorf("S3 %s %s: HTTP %d", op, key, resp.StatusCode)
+	}
+	return fmt.Errorf("S3 %s %s: HTTP %d: %s: %s", op, key, resp.StatusCode, body.Code, body.Message)
+}
+
+// newLockToken returns a random token that identifies the holder of a lock.
+func newLockToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Interface guard
+var _ Storage = (*S3Storage)(nil)
@@ -0,0 +1,186 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// DefaultMaxSANs is the default maximum number of names in each
+// certificate planned by PlanSANs, which is the limit of Let's Encrypt.
+const DefaultMaxSANs = 100
+
+// SANPlan is a plan of which names to coalesce into shared certificates,
+// so that fewer certificates have to be obtained and renewed for many
+// names, such as one certificate for example.com, *.example.com, and
+// www.example.com instead of three. Make plans with PlanSANs, and use
+// them like:
+//
+//	plan := certmagic.PlanSANs(names, 0)
+//	cfg.SubjectAltNames = plan.SubjectAltNames
+//	err := cfg.ManageSync(ctx, plan.Names())
+//
+// Each certificate is managed under the first of its names (see
+// Config.SubjectAltNames), and served for all of them.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SANPlan struct {
+	groups [][]string
+	byName map[string][]string // first name of group -> group
+}
+
+// PlanSANs coalesces names into as few certificates as possible with at
+// most maxSANs names each (DefaultMaxSANs if maxSANs <= 0). Only names
+// with the same registered domain are coalesced, so that a certificate
+// does not bundle the names of unrelated sites, which could belong to
+// different customers. Names that are covered by a wildcard name are
+// left out, since they are served with the wildcard's certificate, and
+// CAs reject such redundant names in the same certificate. IP addresses
+// and other identifiers get their own certificates.
+//
+// Names are grouped deterministically, with the registered domain (or
+// else the shortest name) first, so the same names yield the same plan.
+// Since adding names to a plan may move names to other certificates
+// when groups are full, use Config.ReissueIfSANsChanged to reissue the
+// affected certificates right away.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func PlanSANs(names []string, maxSANs int) *SANPlan {
+	if maxSANs <= 0 {
+		maxSANs = DefaultMaxSANs
+	}
+
+	plan := &SANPlan{byName: make(map[string][]string)}
+	byDomain := make(map[string][]string)
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		name = normalizedName(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		domain := coalescingDomain(name)
+		if domain == "" {
+			plan.add([]string{name})
+			continue
+		}
+		byDomain[domain] = append(byDomain[domain], name)
+	}
+
+	domains := make([]string, 0, len(byDomain))
+	for domain := range byDomain {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		group := withoutCoveredNames(byDomain[domain])
+		sort.Slice(group, func(i, j int) bool {
+			li, lj := strings.Count(group[i], "."), strings.Count(group[j], ".")
+			if li != lj {
+				return li < lj
+			}
+			return group[i] < group[j]
+		})
+		for len(group) > 0 {
+			chunk := group[:min(maxSANs, len(group))]
+			group = group[len(chunk):]
+			plan.add(chunk)
+		}
+	}
+	// the order of certificates follows their first names
+	sort.SliceStable(plan.groups, func(i, j int) bool {
+		return plan.groups[i][0] < plan.groups[j][0]
+	})
+	return plan
+}
+
+func (plan *SANPlan) add(group []string) {
+	plan.groups = append(plan.groups, group)
+	plan.byName[group[0]] = group
+}
+
+// Groups returns the names of each planned certificate,
+// the first of which it is managed under.
+func (plan *SANPlan) Groups() [][]string {
+	groups := make([][]string, len(plan.groups))
+	for i, group := range plan.groups {
+		groups[i] = slices.Clone(group)
+	}
+	return groups
+}
+
+// Names returns the names to manage, which is the first
+// name of each planned certificate.
+func (plan *SANPlan) Names() []string {
+	names := make([]string, len(plan.groups))
+	for i, group := range plan.groups {
+		names[i] = group[0]
+	}
+	return names
+}
+
+// SubjectAltNames returns the names of the planned certificate that is
+// managed under name, or only name if it is not planned. It is meant to
+// be used as Config.SubjectAltNames.
+func (plan *SANPlan) SubjectAltNames(_ context.Context, name string) ([]string, error) {
+	if group, ok := plan.byName[normalizedName(name)]; ok {
+		return slices.Clone(group), nil
+	}
+	return []string{name}, nil
+}
+
+// coalescingDomain returns the registered domain of name, by which it
+// may be coalesced with other names, or "" if it must not be coalesced.
+func coalescingDomain(name string) string {
+	if SubjectIsIP(name) || SubjectIsURI(name) || subjectIsIdentity(name) || strings.Contains(name, "@") {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(strings.TrimPrefix(name, "*."))
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// withoutCoveredNames returns names without the names that are
+// covered by a wildcard name among them.
+func withoutCoveredNames(names []string) []string {
+	wildcards := make(map[string]struct{})
+	for _, name := range names {
+		if strings.HasPrefix(name, "*.") {
+			wildcards[name] = struct{}{}
+		}
+	}
+	result := make([]string, 0, len(names))
+	for _, name := range names {
+		if !strings.HasPrefix(name, "*.") {
+			if parent, ok := trimFirstLabel(name); ok {
+				if _, covered := wildcards["*."+parent]; covered {
+					continue
+				}
+			}
+		}
+		result = append(result, name)
+	}
+	return result
+}
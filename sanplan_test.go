@@ -0,0 +1,106 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestPlanSANs(t *testing.T) {
+	for i, tc := range []struct {
+		names   []string
+		maxSANs int
+		expect  [][]string
+	}{
+		{
+			names: []string{"www.example.com", "*.example.com", "example.com", "api.example.com"},
+			expect: [][]string{
+				{"example.com", "*.example.com"},
+			},
+		},
+		{
+			names: []string{"a.example.com", "B.example.com", "example.net", "www.example.net", "a.example.com"},
+			expect: [][]string{
+				{"a.example.com", "b.example.com"},
+				{"example.net", "www.example.net"},
+			},
+		},
+		{
+			// different customers' names under a public suffix are not coalesced
+			names: []string{"alice.github.io", "bob.github.io"},
+			expect: [][]string{
+				{"alice.github.io"},
+				{"bob.github.io"},
+			},
+		},
+		{
+			names: []string{"192.0.2.1", "example.com", "x.y.example.com", "*.y.example.com"},
+			expect: [][]string{
+				{"192.0.2.1"},
+				{"example.com", "*.y.example.com"},
+			},
+		},
+		{
+			names:   []string{"example.com", "a.example.com", "b.example.com", "c.example.com", "d.example.com"},
+			maxSANs: 2,
+			expect: [][]string{
+				{"b.example.com", "c.example.com"},
+				{"d.example.com"},
+				{"example.com", "a.example.com"},
+			},
+		},
+	} {
+		plan := PlanSANs(tc.names, tc.maxSANs)
+		if got := plan.Groups(); !reflect.DeepEqual(got, tc.expect) {
+			t.Errorf("test %d: expected groups %v, got %v", i, tc.expect, got)
+		}
+	}
+}
+
+func TestSANPlanManage(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+
+	plan := PlanSANs([]string{"www.example.com", "example.com", "*.example.com", "example.net"}, 0)
+	if names := plan.Names(); !reflect.DeepEqual(names, []string{"example.com", "example.net"}) {
+		t.Fatalf("unexpected names to manage: %v", names)
+	}
+	if sans, _ := plan.SubjectAltNames(ctx, "other.example.org"); !reflect.DeepEqual(sans, []string{"other.example.org"}) {
+		t.Errorf("expected only the name for unplanned names, got %v", sans)
+	}
+
+	cfg.SubjectAltNames = plan.SubjectAltNames
+	if err := cfg.ManageSync(ctx, plan.Names()); err != nil {
+		t.Fatal(err)
+	}
+	issued := fi.Issued()
+	if len(issued) != 2 {
+		t.Fatalf("expected 2 certificates to be issued, got %d", len(issued))
+	}
+	for _, leaf := range issued {
+		if slices.Contains(leaf.DNSNames, "example.com") &&
+			(!slices.Contains(leaf.DNSNames, "*.example.com") || len(leaf.DNSNames) != 2) {
+			t.Errorf("expected certificate for example.com and *.example.com, got %v", leaf.DNSNames)
+		}
+	}
+	if certs := cfg.certCache.AllMatchingCertificates("www.example.com"); len(certs) != 1 {
+		t.Errorf("expected www.example.com to be served by the wildcard certificate, got %d certificates", len(certs))
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/idna"
+)
+
+// otherNameSubjectPrefix is the prefix of subjects that are otherName SANs.
+const otherNameSubjectPrefix = "othername:"
+
+// OtherNameSubject returns the subject name by which certificates for an
+// otherName SAN (RFC 5280 §4.2.1.6) with the given type and UTF8String
+// value are managed: "othername:" followed by the type in dotted form,
+// a colon, and the value. Like URIs, such as SPIFFE IDs, otherName SANs
+// identify workloads or users rather than servers; certificates for them
+// are typically issued by internal CAs, and they are not served by SNI.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func OtherNameSubject(typeID asn1.ObjectIdentifier, value string) string {
+	return otherNameSubjectPrefix + typeID.String() + ":" + value
+}
+
+// ParseOtherNameSubject returns the type and value of the otherName SAN
+// that subj is the subject name of (see OtherNameSubject). It returns
+// false if subj is not an otherName subject.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func ParseOtherNameSubject(subj string) (asn1.ObjectIdentifier, string, bool) {
+	if len(subj) < len(otherNameSubjectPrefix) || !strings.EqualFold(subj[:len(otherNameSubjectPrefix)], otherNameSubjectPrefix) {
+		return nil, "", false
+	}
+	typeStr, value, ok := strings.Cut(subj[len(otherNameSubjectPrefix):], ":")
+	if !ok || value == "" {
+		return nil, "", false
+	}
+	var typeID asn1.ObjectIdentifier
+	for _, arc := range strings.Split(typeStr, ".") {
+		n, err := strconv.Atoi(arc)
+		if err != nil || n < 0 || strconv.Itoa(n) != arc {
+			return nil, "", false
+		}
+		typeID = append(typeID, n)
+	}
+	if len(typeID) < 2 {
+		return nil, "", false
+	}
+	return typeID, value, true
+}
+
+// SubjectIsURI returns true if subj is an absolute URI, such as a
+// SPIFFE ID, rather than a hostname or address.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func SubjectIsURI(subj string) bool {
+	if _, _, ok := ParseOtherNameSubject(subj); ok {
+		return false
+	}
+	u, err := url.Parse(subj)
+	if err != nil || u.Scheme == "" {
+		return false
+	}
+	return strings.Contains(subj, "://") || strings.EqualFold(u.Scheme, "urn")
+}
+
+// subjectIsIdentity returns true if subj is a URI or otherName
+// subject, which are not hostnames or addresses.
+func subjectIsIdentity(subj string) bool {
+	_, _, isOtherName := ParseOtherNameSubject(subj)
+	return isOtherName || SubjectIsURI(subj)
+}
+
+// normalizedIdentity normalizes the URI or otherName subject subj:
+// only the parts that are case-insensitive are lowercased.
+func normalizedIdentity(subj string) string {
+	if typeID, value, ok := ParseOtherNameSubject(subj); ok {
+		return OtherNameSubject(typeID, value)
+	}
+	u, err := url.Parse(subj)
+	if err != nil {
+		return subj
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	return u.String()
+}
+
+// safeIdentityKey returns a storage key component for the URI or
+// otherName subject subj; since sanitizing these removes characters
+// which set them apart (e.g. "a/bc" and "ab/c"), a hash of subj
+// makes the key unique.
+func safeIdentityKey(keys KeyBuilder, subj string) string {
+	sum := sha256.Sum256([]byte(subj))
+	return keys.Safe(subj) + "_" + hex.EncodeToString(sum[:4])
+}
+
+// otherNameSAN is the OtherName of RFC 5280 §4.2.1.6, with
+// a UTF8String value.
+type otherNameSAN struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue
+}
+
+// marshalSANExtension returns the subjectAltName extension for the
+// given names, which is needed instead of the fields of x509 templates
+// for otherName SANs, which the x509 package does not support.
+func marshalSANExtension(dnsNames, emails []string, ips []net.IP, uris []*url.URL, otherNames []string) (pkix.Extension, error) {
+	var generalNames []asn1.RawValue
+	add := func(tag int, compound bool, value []byte) {
+		generalNames = append(generalNames, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: compound, Bytes: value})
+	}
+	for _, subj := range otherNames {
+		typeID, value, ok := ParseOtherNameSubject(subj)
+		if !ok {
+			return pkix.Extension{}, fmt.Errorf("invalid otherName subject: %s", subj)
+		}
+		utf8Value, err := asn1.MarshalWithParams(value, "utf8")
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		der, err := asn1.Marshal(otherNameSAN{
+			TypeID: typeID,
+			Value:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: utf8Value},
+		})
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		var seq asn1.RawValue
+		if _, err := asn1.Unmarshal(der, &seq); err != nil {
+			return pkix.Extension{}, err
+		}
+		add(0, true, seq.Bytes)
+	}
+	for _, email := range emails {
+		add(1, false, []byte(email))
+	}
+	for _, name := range dnsNames {
+		add(2, false, []byte(name))
+	}
+	for _, u := range uris {
+		add(6, false, []byte(u.String()))
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		add(7, false, ip)
+	}
+	value, err := asn1.Marshal(generalNames)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Value: value}, nil
+}
+
+// otherNamesFromExtensions returns the subjects of the otherName SANs
+// with string values in the subjectAltName extension among exts.
+func otherNamesFromExtensions(exts []pkix.Extension) []string {
+	var subjects []string
+	for _, ext := range exts {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var seq asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &seq); err != nil || len(rest) > 0 {
+			continue
+		}
+		for rest := seq.Bytes; len(rest) > 0; {
+			var generalName asn1.RawValue
+			var err error
+			rest, err = asn1.Unmarshal(rest, &generalName)
+			if err != nil {
+				break
+			}
+			if generalName.Class != asn1.ClassContextSpecific || generalName.Tag != 0 {
+				continue
+			}
+			var typeID asn1.ObjectIdentifier
+			valueBytes, err := asn1.Unmarshal(generalName.Bytes, &typeID)
+			if err != nil {
+				continue
+			}
+			var wrapped asn1.RawValue
+			if _, err := asn1.Unmarshal(valueBytes, &wrapped); err != nil {
+				continue
+			}
+			var value string
+			if _, err := asn1.Unmarshal(wrapped.Bytes, &value); err != nil {
+				continue // not a string value
+			}
+			subjects = append(subjects, OtherNameSubject(typeID, value))
+		}
+	}
+	return subjects
+}
+
+// oidExtensionSubjectAltName is the OID of the subjectAltName extension.
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// certificateSANs returns the names of the certificate managed under
+// name: name itself, followed by the other names of the service it is
+// the primary name of (see ManageService), if any, and the other names
+// returned by cfg.SubjectAltNames, if set.
+func (cfg *Config) certificateSANs(ctx context.Context, name string) ([]string, error) {
+	sans := []string{name}
+	var names []string
+	if cfg.certCache != nil {
+		names = cfg.certCache.serviceNames(name)
+	}
+	if cfg.SubjectAltNames != nil {
+		more, err := cfg.SubjectAltNames(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("getting names of certificate for %s: %w", name, err)
+		}
+		names = append(names, more...)
+	}
+	for _, san := range names {
+		san = normalizedName(san)
+		if san != "" && !slices.Contains(sans, san) {
+			sans = append(sans, san)
+		}
+	}
+	return sans, nil
+}
+
+// groupNamesKey returns the key under which the certificate for name
+// with the given SANs is stored if it covers a group of names, or an
+// empty string if it only has name, so that its SANs are its key.
+func groupNamesKey(name string, sans []string) string {
+	if len(sans) < 2 {
+		return ""
+	}
+	if asciiName, err := idna.ToASCII(name); err == nil {
+		return asciiName
+	}
+	return name
+}
+
+// SANChange describes how the names of a certificate in storage differ
+// from the names it should have, according to Config.SubjectAltNames.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SANChange struct {
+	Added   []string // names the certificate should have, but does not
+	Removed []string // names the certificate has, but should not
+}
+
+// Changed returns true if the names of the certificate differ.
+func (sc SANChange) Changed() bool {
+	return len(sc.Added) > 0 || len(sc.Removed) > 0
+}
+
+// CheckSANs compares the names of the certificate for name in storage
+// with the names it should have, according to Config.SubjectAltNames.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) CheckSANs(ctx context.Context, name string) (SANChange, error) {
+	name = cfg.transformSubject(ctx, nil, name)
+	certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+	if err != nil {
+		return SANChange{}, fmt.Errorf("loading certificate for %s: %w", name, err)
+	}
+	certs, err := parseCertsFromPEMBundle(certRes.CertificatePEM)
+	if err != nil {
+		return SANChange{}, err
+	}
+	var cert Certificate
+	if err := fillCertFromLeaf(&cert, tls.Certificate{Certificate: [][]byte{certs[0].Raw}, Leaf: certs[0]}); err != nil {
+		return SANChange{}, err
+	}
+	desired, err := cfg.certificateSANs(ctx, name)
+	if err != nil {
+		return SANChange{}, err
+	}
+
+	// compare the names in the form they have on certificates
+	var change SANChange
+	for i, san := range desired {
+		if !subjectIsIdentity(san) {
+			if asciiSAN, err := idna.ToASCII(san); err == nil {
+				san = strings.ToLower(asciiSAN)
+			}
+		}
+		desired[i] = san
+		if !slices.Contains(cert.Names, san) {
+			change.Added = append(change.Added, san)
+		}
+	}
+	for _, san := range cert.Names {
+		if !slices.Contains(desired, san) {
+			change.Removed = append(change.Removed, san)
+		}
+	}
+	return change, nil
+}
+
+// ReissueIfSANsChanged reissues the certificate for name right away if its
+// names differ from the names it should have (see CheckSANs), rather than
+// waiting for its renewal, and replaces it in the cache. It returns how the
+// names differed.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) ReissueIfSANsChanged(ctx context.Context, name string) (SANChange, error) {
+	name = cfg.transformSubject(ctx, nil, name)
+	change, err := cfg.CheckSANs(ctx, name)
+	if err != nil || !change.Changed() {
+		return change, err
+	}
+
+	cfg.Logger.Info("names of certificate changed; reissuing",
+		zap.String("identifier", name),
+		zap.Strings("added", change.Added),
+		zap.Strings("removed", change.Removed))
+	cfg.emit(ctx, "cert_sans_changed", map[string]any{
+		"identifier": name,
+		"added":      change.Added,
+		"removed":    change.Removed,
+	})
+
+	if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+		return change, err
+	}
+
+	// serve the reissued certificate right away
+	var newCert Certificate
+	for _, oldCert := range cfg.certCache.getAllMatchingCerts(name) {
+		if !oldCert.managed {
+			continue
+		}
+		if newCert.Empty() {
+			newCert, err = cfg.loadManagedCertificate(ctx, name)
+			if err != nil {
+				return change, fmt.Errorf("loading reissued certificate for %s: %v", name, err)
+			}
+		}
+		cfg.certCache.replaceCertificate(oldCert, newCert)
+	}
+	return change, nil
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/asn1"
+	"slices"
+	"testing"
+)
+
+var oidUserPrincipalName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+func TestOtherNameSubject(t *testing.T) {
+	subj := OtherNameSubject(oidUserPrincipalName, "alice@corp.example")
+	if subj != "othername:1.3.6.1.4.1.311.20.2.3:alice@corp.example" {
+		t.Errorf("unexpected subject: %s", subj)
+	}
+	typeID, value, ok := ParseOtherNameSubject(subj)
+	if !ok || !typeID.Equal(oidUserPrincipalName) || value != "alice@corp.example" {
+		t.Errorf("expected subject to round-trip, got %s %q %t", typeID, value, ok)
+	}
+	for _, invalid := range []string{"othername:1.3.6", "othername:1:value", "othername:1.x.3:value", "othername:1.03:value", "example.com"} {
+		if _, _, ok := ParseOtherNameSubject(invalid); ok {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestSubjectIsURI(t *testing.T) {
+	for subj, expect := range map[string]bool{
+		"spiffe://example.org/ns/prod/sa/web":           true,
+		"urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6": true,
+		"example.com":                    false,
+		"example.com:443":                false,
+		"2001:db8::1":                    false,
+		"fe80::1":                        false,
+		"othername:1.2.3:value":          false,
+		"https://example.com/some/path":  true,
+		"user@example.com":               false,
+		"not a uri://with spaces/anyway": false,
+	} {
+		if actual := SubjectIsURI(subj); actual != expect {
+			t.Errorf("%s: expected %t, got %t", subj, expect, actual)
+		}
+	}
+}
+
+func TestIdentitySubjects(t *testing.T) {
+	if actual := normalizedName(" SPIFFE://Example.ORG/ns/Prod "); actual != "spiffe://example.org/ns/Prod" {
+		t.Errorf("expected only scheme and host to be lowercased, got %s", actual)
+	}
+	upn := OtherNameSubject(oidUserPrincipalName, "Alice@corp.example")
+	if actual := normalizedName("OtherName" + upn[len("othername"):]); actual != upn {
+		t.Errorf("expected otherName value to keep its case, got %s", actual)
+	}
+	if !SubjectQualifiesForCert(upn) || !SubjectQualifiesForCert("spiffe://example.org/web") {
+		t.Error("expected identities to qualify for certificates")
+	}
+	if SubjectQualifiesForPublicCert(upn) || SubjectQualifiesForPublicCert("spiffe://example.org/web") {
+		t.Error("expected identities not to qualify for public certificates")
+	}
+	if a, b := StorageKeys.SiteCert("x", "spiffe://a/bc"), StorageKeys.SiteCert("x", "spiffe://ab/c"); a == b {
+		t.Errorf("expected distinct storage keys for distinct URIs, got %s", a)
+	}
+	if key := StorageKeys.SiteCert("x", "example.com"); key != "certificates/x/example.com/example.com.crt" {
+		t.Errorf("expected storage keys of hostnames to be unchanged, got %s", key)
+	}
+}
+
+func TestManageIdentityCertificates(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+
+	spiffeID := "spiffe://example.org/ns/prod/sa/Web"
+	upn := OtherNameSubject(oidUserPrincipalName, "alice@corp.example")
+	for _, name := range []string{spiffeID, upn} {
+		if err := cfg.ManageSync(ctx, []string{name}); err != nil {
+			t.Fatalf("managing %s: %v", name, err)
+		}
+		certs := cfg.certCache.AllMatchingCertificates(name)
+		if len(certs) != 1 || !slices.Equal(certs[0].Names, []string{name}) {
+			t.Fatalf("expected cached certificate for %s, got %v", name, certs)
+		}
+		if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert("fake", name)) {
+			t.Errorf("expected certificate for %s in storage", name)
+		}
+	}
+
+	leaf := cfg.certCache.AllMatchingCertificates(spiffeID)[0].Leaf
+	if len(leaf.URIs) != 1 || leaf.URIs[0].String() != spiffeID {
+		t.Errorf("expected URI SAN %s, got %v", spiffeID, leaf.URIs)
+	}
+}
+
+func TestReissueIfSANsChanged(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+	extraNames := []string{"www.example.com"}
+	cfg.SubjectAltNames = func(_ context.Context, name string) ([]string, error) {
+		return extraNames, nil
+	}
+
+	if err := cfg.ManageSync(ctx, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Storage.Exists(ctx, StorageKeys.SiteCert("fake", "example.com")) {
+		t.Fatal("expected certificate of group to be stored under its name")
+	}
+	certs := cfg.certCache.AllMatchingCertificates("www.example.com")
+	if len(certs) != 1 || !slices.Equal(certs[0].Names, []string{"example.com", "www.example.com"}) {
+		t.Fatalf("expected certificate to be served for all its names, got %v", certs)
+	}
+
+	change, err := cfg.ReissueIfSANsChanged(ctx, "example.com")
+	if err != nil || change.Changed() {
+		t.Fatalf("expected no change, got %+v (err=%v)", change, err)
+	}
+
+	// a customer added a subdomain and removed another
+	extraNames = []string{"shop.example.com"}
+	change, err = cfg.ReissueIfSANsChanged(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(change.Added, []string{"shop.example.com"}) || !slices.Equal(change.Removed, []string{"www.example.com"}) {
+		t.Errorf("unexpected change: %+v", change)
+	}
+	certs = cfg.certCache.AllMatchingCertificates("example.com")
+	if len(certs) != 1 || !slices.Equal(certs[0].Names, []string{"example.com", "shop.example.com"}) {
+		t.Fatalf("expected reissued certificate in cache, got %v", certs)
+	}
+	if certs := cfg.certCache.AllMatchingCertificates("www.example.com"); len(certs) != 0 {
+		t.Errorf("expected removed name to no longer be served, got %v", certs)
+	}
+	if change, err := cfg.CheckSANs(ctx, "example.com"); err != nil || change.Changed() {
+		t.Errorf("expected no change after reissue, got %+v (err=%v)", change, err)
+	}
+}
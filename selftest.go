@@ -0,0 +1,359 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// SelfTestStatus is the outcome of a check of SelfTest.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SelfTestStatus string
+
+// Outcomes of self-test checks.
+const (
+	SelfTestPassed  SelfTestStatus = "pass"
+	SelfTestFailed  SelfTestStatus = "fail"
+	SelfTestSkipped SelfTestStatus = "skip"
+)
+
+// SelfTestOptions configures SelfTest.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SelfTestOptions struct {
+	// The address at which the CA reaches this server to
+	// validate HTTP challenges. Default: the test name
+	// and port 80, as for the CA.
+	HTTPAddr string
+
+	// The address at which the CA reaches this server to
+	// validate TLS-ALPN challenges. Default: the test name
+	// and port 443, as for the CA.
+	TLSALPNAddr string
+
+	// How long each check may take.
+	// Default: DefaultSelfTestTimeout.
+	Timeout time.Duration
+}
+
+// DefaultSelfTestTimeout is the default timeout of self-test checks.
+const DefaultSelfTestTimeout = 30 * time.Second
+
+// SelfTestReport is the result of SelfTest.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SelfTestReport struct {
+	// The name that was tested.
+	Name string `json:"name"`
+
+	// When the self-test started.
+	Time time.Time `json:"time"`
+
+	// The checks that were performed, in order.
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// SelfTestCheck is the result of one check of SelfTest.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SelfTestCheck struct {
+	// What was checked: "storage", "lock", "ca", "dns-01",
+	// "http-01", "tls-alpn-01", or "ocsp".
+	Check string `json:"check"`
+
+	// What the check was performed against, such as
+	// an issuer key, an address, or a URL.
+	Target string `json:"target,omitempty"`
+
+	Status SelfTestStatus `json:"status"`
+
+	// Why the check was skipped, or what went wrong.
+	Detail string `json:"detail,omitempty"`
+
+	Duration time.Duration `json:"duration"`
+}
+
+// Passed returns true if no check failed.
+func (r SelfTestReport) Passed() bool {
+	return r.Err() == nil
+}
+
+// Err returns an error that describes the failed checks, if any.
+func (r SelfTestReport) Err() error {
+	var errs []error
+	for _, check := range r.Checks {
+		if check.Status == SelfTestFailed {
+			errs = append(errs, fmt.Errorf("%s check of %s failed: %s", check.Check, check.Target, check.Detail))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SelfTest checks that certificates can be obtained for name with cfg,
+// end to end, and returns a report of the checks and their outcomes. It
+// is meant to be called at startup, or from readiness probes, to find
+// problems in the environment before they make issuance fail. The checks
+// are:
+//
+//   - storage: storage can be written to and read from.
+//   - lock: a lock can be acquired in storage and released.
+//   - ca: each issuer that is an IssuerHealthChecker, such as
+//     ACMEIssuer, is healthy; for ACME, the CA can be reached.
+//   - dns-01: for each ACMEIssuer with a DNS01Solver, a TXT record can
+//     be created at the challenge name of name, and deleted; this does
+//     not wait for the record to propagate.
+//   - http-01 and tls-alpn-01: for each ACMEIssuer that can solve these
+//     challenges, a challenge made up for a reserved name is answered
+//     by the server at the address the CA would use, as for CheckTLSALPN.
+//     Since the address is that of name by default, name must resolve to
+//     this server.
+//   - ocsp: if a certificate for name is in storage, its OCSP responder
+//     answers for it, unless OCSP stapling is disabled.
+//
+// Checks that cannot be performed with cfg are skipped.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) SelfTest(ctx context.Context, name string, opts SelfTestOptions) SelfTestReport {
+	report := SelfTestReport{Name: name, Time: timeNow()}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSelfTestTimeout
+	}
+	run := func(check, target string, f func(ctx context.Context) (skipped string, err error)) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		start := time.Now()
+		skipped, err := f(ctx)
+		result := SelfTestCheck{Check: check, Target: target, Status: SelfTestPassed, Duration: time.Since(start)}
+		switch {
+		case err != nil:
+			result.Status = SelfTestFailed
+			result.Detail = err.Error()
+		case skipped != "":
+			result.Status = SelfTestSkipped
+			result.Detail = skipped
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	run("storage", storageName(cfg.Storage), func(ctx context.Context) (string, error) {
+		return "", cfg.storageRoundTrip(ctx)
+	})
+	run("lock", storageName(cfg.Storage), func(ctx context.Context) (string, error) {
+		lockKey := cfg.lockKey("self_test", name)
+		if err := acquireLock(ctx, cfg.Storage, lockKey); err != nil {
+			return "", fmt.Errorf("acquiring lock: %v", err)
+		}
+		if err := releaseLock(ctx, cfg.Storage, lockKey); err != nil {
+			return "", fmt.Errorf("releasing lock: %v", err)
+		}
+		return "", nil
+	})
+
+	checked := make(map[string]bool)
+	once := func(check, target string) bool {
+		if checked[check+" "+target] {
+			return false
+		}
+		checked[check+" "+target] = true
+		return true
+	}
+	for _, issuer := range cfg.Issuers {
+		run("ca", issuer.IssuerKey(), func(ctx context.Context) (string, error) {
+			checker, ok := issuer.(IssuerHealthChecker)
+			if !ok {
+				return "issuer cannot be checked", nil
+			}
+			return "", checker.CheckHealth(ctx)
+		})
+
+		am, ok := issuer.(*ACMEIssuer)
+		if !ok {
+			continue
+		}
+		if am.DNS01Solver != nil {
+			if dnsSolver, ok := am.DNS01Solver.(*DNS01Solver); ok && once("dns-01", am.IssuerKey()) {
+				run("dns-01", am.IssuerKey(), func(ctx context.Context) (string, error) {
+					return "", selfTestDNSProvider(ctx, dnsSolver, name)
+				})
+			}
+			continue
+		}
+		if !am.DisableHTTPChallenge {
+			addr := opts.HTTPAddr
+			if addr == "" {
+				addr = net.JoinHostPort(name, strconv.Itoa(HTTPChallengePort))
+			}
+			if once("http-01", addr) {
+				run("http-01", addr, func(ctx context.Context) (string, error) {
+					return "", selfTestHTTPChallenge(ctx, am, addr)
+				})
+			}
+		}
+		if !am.DisableTLSALPNChallenge {
+			addr := opts.TLSALPNAddr
+			if addr == "" {
+				addr = net.JoinHostPort(name, strconv.Itoa(TLSALPNChallengePort))
+			}
+			if once("tls-alpn-01", addr) {
+				run("tls-alpn-01", addr, func(ctx context.Context) (string, error) {
+					return "", cfg.selfTestTLSALPNChallenge(ctx, am, addr)
+				})
+			}
+		}
+	}
+
+	run("ocsp", name, func(ctx context.Context) (string, error) {
+		if cfg.OCSP.DisableStapling {
+			return "OCSP stapling is disabled", nil
+		}
+		certRes, err := cfg.loadCertResourceAnyIssuer(ctx, name)
+		if err != nil {
+			return "no certificate in storage", nil
+		}
+		_, _, err = getOCSPForCert(cfg.egressContext(ctx, certRes.SANs, nil), cfg.OCSP, certRes.CertificatePEM)
+		if errors.Is(err, ErrNoOCSPServerSpecified) {
+			return "certificate has no OCSP responder", nil
+		}
+		return "", err
+	})
+
+	failed := 0
+	for _, check := range report.Checks {
+		if check.Status == SelfTestFailed {
+			failed++
+		}
+	}
+	cfg.Logger.Info("self-test finished",
+		zap.String("identifier", name),
+		zap.Int("checks", len(report.Checks)),
+		zap.Int("failed", failed),
+		zap.Error(report.Err()))
+
+	return report
+}
+
+// storageName returns a description of storage for reports.
+func storageName(storage Storage) string {
+	if stringer, ok := storage.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", storage)
+}
+
+// selfTestDNSProvider creates a TXT record at the ACME challenge
+// name of name with the DNS provider of solver, and deletes it.
+func selfTestDNSProvider(ctx context.Context, solver *DNS01Solver, name string) error {
+	chal, err := newSelfTestChallenge(acme.ChallengeTypeDNS01)
+	if err != nil {
+		return err
+	}
+	dnsName := acme.Challenge{Identifier: acme.Identifier{Type: "dns", Value: strings.TrimPrefix(name, "*.")}}.DNS01TXTRecordName()
+	if solver.OverrideDomain != "" {
+		dnsName = solver.OverrideDomain
+	}
+	zrec, err := solver.DNSManager.createRecord(ctx, dnsName, "TXT", chal.KeyAuthorization)
+	if err != nil {
+		return err
+	}
+	return solver.DNSManager.cleanUpRecord(ctx, zrec)
+}
+
+// selfTestHTTPChallenge solves an HTTP challenge made up for a
+// reserved name as am would, and requests it from addr as the
+// CA would, to check that the challenge server is reachable.
+func selfTestHTTPChallenge(ctx context.Context, am *ACMEIssuer, addr string) error {
+	chal, err := newSelfTestChallenge(acme.ChallengeTypeHTTP01)
+	if err != nil {
+		return err
+	}
+	solver := solverWrapper{&httpSolver{
+		handler: am.HTTPChallengeHandler(http.NewServeMux()),
+		address: am.httpChallengeAddress(),
+	}}
+	if err := solver.Present(ctx, chal); err != nil {
+		return err
+	}
+	defer solver.CleanUp(ctx, chal)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+chal.HTTP01ResourcePath(), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = chal.Identifier.Value
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("requesting challenge: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return fmt.Errorf("challenge request was redirected to %s; challenge requests should be answered before redirecting",
+			resp.Header.Get("Location"))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("challenge request got HTTP %d; the server may not use certmagic's HTTP challenge handler", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return fmt.Errorf("reading challenge response: %w", err)
+	}
+	if strings.TrimSpace(string(body)) != chal.KeyAuthorization {
+		return fmt.Errorf("challenge response has the wrong key authorization; the address may be served " +
+			"by another process or instance which does not share challenges with this one")
+	}
+	return nil
+}
+
+// selfTestTLSALPNChallenge solves a TLS-ALPN challenge made up for a
+// reserved name as am would, and validates it at addr as the CA would.
+func (cfg *Config) selfTestTLSALPNChallenge(ctx context.Context, am *ACMEIssuer, addr string) error {
+	chal, err := newSelfTestChallenge(acme.ChallengeTypeTLSALPN01)
+	if err != nil {
+		return err
+	}
+	solverCfg := am.config
+	if solverCfg == nil {
+		solverCfg = cfg
+	}
+	var solver acmez.Solver = &tlsALPNSolver{
+		config:  solverCfg,
+		address: am.tlsALPNChallengeAddress(),
+	}
+	if am.TLSALPN01Solver != nil {
+		solver = am.TLSALPN01Solver
+	}
+	solver = solverWrapper{solver}
+	if err := solver.Present(ctx, chal); err != nil {
+		return err
+	}
+	defer solver.CleanUp(ctx, chal)
+	return verifyTLSALPNChallenge(ctx, addr, chal)
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+
+	report := cfg.SelfTest(ctx, "example.com", SelfTestOptions{})
+	if !report.Passed() {
+		t.Fatalf("expected self-test to pass, got %v", report.Err())
+	}
+	statuses := make(map[string]SelfTestStatus)
+	for _, check := range report.Checks {
+		statuses[check.Check] = check.Status
+	}
+	expected := map[string]SelfTestStatus{
+		"storage": SelfTestPassed,
+		"lock":    SelfTestPassed,
+		"ca":      SelfTestSkipped, // FakeIssuer has no health check
+		"ocsp":    SelfTestSkipped, // no certificate yet
+	}
+	for check, status := range expected {
+		if statuses[check] != status {
+			t.Errorf("expected %s check to be %s, got %q", check, status, statuses[check])
+		}
+	}
+}
+
+func TestSelfTestACME(t *testing.T) {
+	ctx := context.Background()
+	caDown := false
+	ca := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if caDown {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"newNonce":"n","newAccount":"a","newOrder":"o"}`))
+	}))
+	defer ca.Close()
+
+	httpPort, tlsPort := freePort(t), freePort(t)
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	am := NewACMEIssuer(cfg, ACMEIssuer{
+		CA:             ca.URL,
+		ListenHost:     "127.0.0.1",
+		AltHTTPPort:    httpPort,
+		AltTLSALPNPort: tlsPort,
+	})
+	cfg.Issuers = []Issuer{am}
+	opts := SelfTestOptions{
+		HTTPAddr:    net.JoinHostPort("127.0.0.1", strconv.Itoa(httpPort)),
+		TLSALPNAddr: net.JoinHostPort("127.0.0.1", strconv.Itoa(tlsPort)),
+	}
+
+	// the challenge servers are started as for real challenges
+	report := cfg.SelfTest(ctx, "example.com", opts)
+	if !report.Passed() {
+		t.Fatalf("expected self-test to pass, got %v", report.Err())
+	}
+	var passed []string
+	for _, check := range report.Checks {
+		if check.Status == SelfTestPassed {
+			passed = append(passed, check.Check)
+		}
+	}
+	if len(passed) != 5 {
+		t.Errorf("expected storage, lock, ca, http-01, and tls-alpn-01 checks to pass, got %v", passed)
+	}
+	activeChallengesMu.Lock()
+	remaining := len(activeChallenges)
+	activeChallengesMu.Unlock()
+	if remaining != 0 {
+		t.Errorf("expected self-test challenges to be removed, got %d active challenges", remaining)
+	}
+
+	// a server that does not answer challenges fails the HTTP check
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	opts.HTTPAddr = other.Listener.Addr().String()
+	caDown = true
+	failed := make(map[string]bool)
+	for _, check := range cfg.SelfTest(ctx, "example.com", opts).Checks {
+		failed[check.Check] = check.Status == SelfTestFailed
+	}
+	if !failed["http-01"] || !failed["ca"] || failed["tls-alpn-01"] {
+		t.Errorf("expected http-01 and ca checks to fail, got %v", failed)
+	}
+}
+
+// freePort returns a TCP port on the loopback
+// interface that is not in use at the moment.
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,270 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ServiceProtocol is a protocol offered by a service, from which
+// the host names that need certificates can be derived.
+type ServiceProtocol string
+
+// Supported service protocols.
+const (
+	ServiceSMTP         ServiceProtocol = "smtp"         // smtp.<domain>, MX hosts
+	ServiceSubmission   ServiceProtocol = "submission"   // _submission(s)._tcp SRV targets
+	ServiceIMAP         ServiceProtocol = "imap"         // imap.<domain>, _imap(s)._tcp SRV targets
+	ServicePOP3         ServiceProtocol = "pop3"         // pop3.<domain>, _pop3(s)._tcp SRV targets
+	ServiceXMPP         ServiceProtocol = "xmpp"         // <domain>, _xmpp-client/_xmpp-server._tcp SRV targets
+	ServiceAutodiscover ServiceProtocol = "autodiscover" // autodiscover.<domain>, _autodiscover._tcp SRV targets
+	ServiceAutoconfig   ServiceProtocol = "autoconfig"   // autoconfig.<domain>
+	ServiceMTASTS       ServiceProtocol = "mta-sts"      // mta-sts.<domain>
+)
+
+// ServiceDefinition describes a logical service, such as a mail or
+// XMPP server, that is reachable at a number of host names derived
+// from its domain.
+type ServiceDefinition struct {
+	// The domain of the service, e.g. "example.com". Required.
+	Domain string
+
+	// The protocols the service offers; the conventional host
+	// names for each protocol are included.
+	Protocols []ServiceProtocol
+
+	// Additional host names for the service. Names without
+	// a dot are treated as labels under Domain (e.g. "mail"
+	// becomes "mail.example.com").
+	Hosts []string
+
+	// If true, MX and SRV records of Domain are looked up
+	// for the protocols, and their targets are included if
+	// they are within Domain.
+	LookupDNS bool
+
+	// The resolver for DNS lookups. Default: net.DefaultResolver.
+	Resolver ServiceResolver
+
+	// If true, names exactly one label below Domain are
+	// covered by a wildcard name for Domain (which requires
+	// the DNS challenge) instead of being listed each.
+	Wildcard bool
+}
+
+// ServiceResolver looks up the DNS records used to derive a
+// service's host names. It is implemented by *net.Resolver.
+type ServiceResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// ServiceNames are the host names derived from a ServiceDefinition.
+type ServiceNames struct {
+	// The names to manage certificates for, sorted.
+	Names []string
+
+	// Targets of DNS records that are outside the service's
+	// domain, for which certificates cannot be managed here
+	// (for example, a hosted mail provider's MX hosts).
+	External []string
+}
+
+// Names returns the host names that the service needs certificates for.
+func (sd ServiceDefinition) Names(ctx context.Context) (ServiceNames, error) {
+	domain := strings.TrimSuffix(normalizedName(sd.Domain), ".")
+	if domain == "" {
+		return ServiceNames{}, fmt.Errorf("service domain is required")
+	}
+
+	names := make(map[string]struct{})
+	external := make(map[string]struct{})
+	add := func(name string) {
+		name = strings.TrimSuffix(normalizedName(name), ".")
+		if name == "" {
+			return
+		}
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			names[name] = struct{}{}
+		} else {
+			external[name] = struct{}{}
+		}
+	}
+
+	for _, host := range sd.Hosts {
+		if !strings.Contains(host, ".") {
+			host += "." + domain
+		}
+		add(host)
+	}
+
+	var resolver ServiceResolver = net.DefaultResolver
+	if sd.Resolver != nil {
+		resolver = sd.Resolver
+	}
+	lookupSRV := func(services ...string) error {
+		if !sd.LookupDNS {
+			return nil
+		}
+		for _, service := range services {
+			_, srvs, err := resolver.LookupSRV(ctx, service, "tcp", domain)
+			if err != nil && !isDNSNotFound(err) {
+				return fmt.Errorf("looking up _%s._tcp.%s: %w", service, domain, err)
+			}
+			for _, srv := range srvs {
+				// a target of "." means the service is not available (RFC 2782)
+				if srv.Target != "." {
+					add(srv.Target)
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, proto := range sd.Protocols {
+		var err error
+		switch proto {
+		case ServiceSMTP:
+			add("smtp." + domain)
+			if sd.LookupDNS {
+				var mxs []*net.MX
+				mxs, err = resolver.LookupMX(ctx, domain)
+				if err != nil && !isDNSNotFound(err) {
+					return ServiceNames{}, fmt.Errorf("looking up MX records of %s: %w", domain, err)
+				}
+				err = nil
+				for _, mx := range mxs {
+					// a host of "." means the domain does not accept mail (RFC 7505)
+					if mx.Host != "." {
+						add(mx.Host)
+					}
+				}
+			}
+		case ServiceSubmission:
+			err = lookupSRV("submission", "submissions")
+		case ServiceIMAP:
+			add("imap." + domain)
+			err = lookupSRV("imap", "imaps")
+		case ServicePOP3:
+			add("pop3." + domain)
+			err = lookupSRV("pop3", "pop3s")
+		case ServiceXMPP:
+			add(domain)
+			err = lookupSRV("xmpp-client", "xmpp-server")
+		case ServiceAutodiscover:
+			add("autodiscover." + domain)
+			err = lookupSRV("autodiscover")
+		case ServiceAutoconfig:
+			add("autoconfig." + domain)
+		case ServiceMTASTS:
+			add("mta-sts." + domain)
+		default:
+			return ServiceNames{}, fmt.Errorf("unknown service protocol: %s", proto)
+		}
+		if err != nil {
+			return ServiceNames{}, err
+		}
+	}
+
+	if sd.Wildcard {
+		for name := range names {
+			if strings.Count(strings.TrimSuffix(name, domain), ".") == 1 {
+				delete(names, name)
+				names["*."+domain] = struct{}{}
+			}
+		}
+	}
+
+	return ServiceNames{Names: sortedKeys(names), External: sortedKeys(external)}, nil
+}
+
+// ManageService derives the host names of the service described by sd
+// and manages a single certificate for all of them, synchronously or
+// asynchronously as with ManageSync and ManageAsync. It returns the
+// names that were derived.
+//
+// The certificate is managed, stored, and renewed under the primary name
+// of the service, which is its domain if that is among the names, and
+// otherwise the first of them; as with Config.SubjectAltNames, it is
+// served for all of its names. Calling ManageService again with changed
+// names updates the names of the certificate at its next renewal; to
+// reissue it right away, use ReissueIfSANsChanged with the primary name.
+func (cfg *Config) ManageService(ctx context.Context, sd ServiceDefinition, async bool) (ServiceNames, error) {
+	names, err := sd.Names(ctx)
+	if err != nil {
+		return names, err
+	}
+	if len(names.Names) == 0 {
+		return names, fmt.Errorf("service %s has no names to manage", sd.Domain)
+	}
+	primary := servicePrimaryName(sd.Domain, names.Names)
+	cfg.certCache.setServiceNames(primary, names.Names)
+	if async {
+		return names, cfg.ManageAsync(ctx, []string{primary})
+	}
+	return names, cfg.ManageSync(ctx, []string{primary})
+}
+
+// servicePrimaryName returns the name under which the certificate for
+// the names of the service with the given domain is managed.
+func servicePrimaryName(domain string, names []string) string {
+	domain = strings.TrimSuffix(normalizedName(domain), ".")
+	for _, primary := range []string{domain, "*." + domain} {
+		if slices.Contains(names, primary) {
+			return primary
+		}
+	}
+	return names[0]
+}
+
+// setServiceNames sets the names of the certificate of
+// the service whose primary name is primary.
+func (certCache *Cache) setServiceNames(primary string, names []string) {
+	certCache.serviceSANsMu.Lock()
+	defer certCache.serviceSANsMu.Unlock()
+	if certCache.serviceSANs == nil {
+		certCache.serviceSANs = make(map[string][]string)
+	}
+	certCache.serviceSANs[primary] = slices.Clone(names)
+}
+
+// serviceNames returns the names of the certificate of the service
+// whose primary name is name, or nil if there is no such service.
+func (certCache *Cache) serviceNames(name string) []string {
+	certCache.serviceSANsMu.RLock()
+	defer certCache.serviceSANsMu.RUnlock()
+	return slices.Clone(certCache.serviceSANs[name])
+}
+
+// isDNSNotFound returns true if err means that the records do not exist.
+func isDNSNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+type fakeServiceResolver struct {
+	mx  []*net.MX
+	srv map[string][]*net.SRV
+}
+
+func (r fakeServiceResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if r.mx == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return r.mx, nil
+}
+
+func (r fakeServiceResolver) LookupSRV(_ context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	srvs, ok := r.srv[service]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return "", srvs, nil
+}
+
+func TestServiceDefinitionNames(t *testing.T) {
+	ctx := context.Background()
+	resolver := fakeServiceResolver{
+		mx: []*net.MX{{Host: "mx1.example.com."}, {Host: "aspmx.l.google.com."}},
+		srv: map[string][]*net.SRV{
+			"imaps":       {{Target: "mail.example.com."}},
+			"submission":  {{Target: "."}},
+			"xmpp-client": {{Target: "chat.example.com."}},
+		},
+	}
+
+	for i, tc := range []struct {
+		sd     ServiceDefinition
+		expect ServiceNames
+	}{
+		{
+			sd: ServiceDefinition{
+				Domain:    "Example.com",
+				Protocols: []ServiceProtocol{ServiceSMTP, ServiceIMAP, ServiceAutodiscover},
+				Hosts:     []string{"mail"},
+			},
+			expect: ServiceNames{
+				Names:    []string{"autodiscover.example.com", "imap.example.com", "mail.example.com", "smtp.example.com"},
+				External: []string{},
+			},
+		},
+		{
+			sd: ServiceDefinition{
+				Domain:    "example.com",
+				Protocols: []ServiceProtocol{ServiceSMTP, ServiceSubmission, ServiceIMAP, ServiceXMPP},
+				LookupDNS: true,
+				Resolver:  resolver,
+			},
+			expect: ServiceNames{
+				Names:    []string{"chat.example.com", "example.com", "imap.example.com", "mail.example.com", "mx1.example.com", "smtp.example.com"},
+				External: []string{"aspmx.l.google.com"},
+			},
+		},
+		{
+			sd: ServiceDefinition{
+				Domain:    "example.com",
+				Protocols: []ServiceProtocol{ServiceXMPP, ServiceMTASTS, ServiceAutoconfig},
+				Hosts:     []string{"a.b.example.com"},
+				Wildcard:  true,
+			},
+			expect: ServiceNames{
+				Names:    []string{"*.example.com", "a.b.example.com", "example.com"},
+				External: []string{},
+			},
+		},
+	} {
+		actual, err := tc.sd.Names(ctx)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, tc.expect) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, tc.expect, actual)
+		}
+	}
+
+	if _, err := (ServiceDefinition{Domain: "example.com", Protocols: []ServiceProtocol{"gopher"}}).Names(ctx); err == nil {
+		t.Error("expected error for unknown protocol")
+	}
+	if _, err := (ServiceDefinition{}).Names(ctx); err == nil {
+		t.Error("expected error for missing domain")
+	}
+}
+
+func TestManageService(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+
+	sd := ServiceDefinition{
+		Domain:    "example.com",
+		Protocols: []ServiceProtocol{ServiceSMTP, ServiceIMAP, ServiceXMPP},
+		Hosts:     []string{"mail"},
+	}
+	names, err := cfg.ManageService(ctx, sd, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued := fi.Issued()
+	if len(issued) != 1 {
+		t.Fatalf("expected one certificate for the service, got %d", len(issued))
+	}
+	sans := slices.Clone(issued[0].DNSNames)
+	slices.Sort(sans)
+	if !reflect.DeepEqual(sans, names.Names) {
+		t.Errorf("expected certificate for %v, got %v", names.Names, sans)
+	}
+	for _, name := range names.Names {
+		if certs := cfg.certCache.getAllMatchingCerts(name); len(certs) != 1 {
+			t.Errorf("expected certificate to be served for %s, got %d certificates", name, len(certs))
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"strings"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// SessionPolicy controls the resumption of TLS sessions in the TLS
+// configurations of a Config, which is otherwise unaware of the
+// certificates that sessions were established with.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SessionPolicy struct {
+	// If true, sessions are bound to the certificates that
+	// were in the cache for their server name when they
+	// were created: they can no longer be resumed once one
+	// of these certificates was renewed, replaced, removed
+	// from the cache, or revoked, so that clients perform
+	// a full handshake and see the current certificate.
+	BindToCertificates bool
+
+	// If true, all sessions of the cache are invalidated when
+	// an OCSP response is the first to report a certificate
+	// as revoked, which has the effect of rotating the
+	// session ticket keys.
+	InvalidateAllOnRevocation bool
+
+	// Optionally report whether clients may send early
+	// data (0-RTT) when resuming sessions for a server
+	// name; if it returns false, early data is rejected.
+	// Go's TLS only supports early data with QUIC, where
+	// the QUIC implementation decides whether it is
+	// offered at all.
+	AllowEarlyData func(name string) bool
+}
+
+// sessionExtraPrefix starts the data that certmagic adds
+// to the Extra field of session states.
+var sessionExtraPrefix = []byte("certmagic-session\x00")
+
+// applySessionPolicy sets the session hooks of tlsConfig according
+// to cfg.SessionPolicy, unless tlsConfig already has its own hooks.
+// The session tickets are encrypted with the keys of tlsConfig.
+func (cfg *Config) applySessionPolicy(tlsConfig *tls.Config) {
+	if cfg.SessionPolicy == nil || tlsConfig.WrapSession != nil || tlsConfig.UnwrapSession != nil {
+		return
+	}
+	tlsConfig.WrapSession = func(cs tls.ConnectionState, ss *tls.SessionState) ([]byte, error) {
+		cfg.wrapSession(cs, ss)
+		return tlsConfig.EncryptTicket(cs, ss)
+	}
+	tlsConfig.UnwrapSession = func(identity []byte, cs tls.ConnectionState) (*tls.SessionState, error) {
+		ss, err := tlsConfig.DecryptTicket(identity, cs)
+		if err != nil || ss == nil {
+			return ss, err
+		}
+		if !cfg.unwrapSession(cs, ss) {
+			// resumption is declined; a full handshake follows
+			return nil, nil
+		}
+		return ss, nil
+	}
+}
+
+// wrapSession records in ss what is needed to decide whether
+// it may be resumed, and applies the early data policy.
+func (cfg *Config) wrapSession(cs tls.ConnectionState, ss *tls.SessionState) {
+	name := normalizedName(cs.ServerName)
+	extra := append([]byte(nil), sessionExtraPrefix...)
+	extra = binary.BigEndian.AppendUint64(extra, cfg.certCache.sessionEpoch.Load())
+	if cfg.SessionPolicy.BindToCertificates && name != "" {
+		hashes := make([]string, 0, 1)
+		for _, cert := range cfg.sessionCerts(name) {
+			hashes = append(hashes, cert.hash)
+		}
+		extra = append(extra, strings.Join(hashes, ",")...)
+	}
+	ss.Extra = append(ss.Extra, extra)
+	if ss.EarlyData && !cfg.allowEarlyData(name) {
+		ss.EarlyData = false
+	}
+}
+
+// unwrapSession returns whether the session ss may be resumed.
+func (cfg *Config) unwrapSession(cs tls.ConnectionState, ss *tls.SessionState) bool {
+	var extra []byte
+	for _, e := range ss.Extra {
+		if bytes.HasPrefix(e, sessionExtraPrefix) {
+			extra = e[len(sessionExtraPrefix):]
+			break
+		}
+	}
+	if len(extra) < 8 || binary.BigEndian.Uint64(extra) != cfg.certCache.sessionEpoch.Load() {
+		return false
+	}
+	name := normalizedName(cs.ServerName)
+	if cfg.SessionPolicy.BindToCertificates && len(extra) > 8 {
+		current := make(map[string]Certificate)
+		for _, cert := range cfg.sessionCerts(name) {
+			current[cert.hash] = cert
+		}
+		for _, hash := range strings.Split(string(extra[8:]), ",") {
+			cert, ok := current[hash]
+			if !ok || (cert.ocsp != nil && cert.ocsp.Status == ocsp.Revoked) {
+				return false
+			}
+		}
+	}
+	if ss.EarlyData && !cfg.allowEarlyData(name) {
+		ss.EarlyData = false
+	}
+	return true
+}
+
+// sessionCerts returns the certificates in the cache that
+// may be served for name, the same as for handshakes.
+func (cfg *Config) sessionCerts(name string) []Certificate {
+	certs := cfg.certCache.getAllMatchingCerts(name)
+	if len(certs) == 0 {
+		if i := strings.Index(name, "."); i > 0 {
+			certs = cfg.certCache.getAllMatchingCerts("*" + name[i:])
+		}
+	}
+	return certs
+}
+
+func (cfg *Config) allowEarlyData(name string) bool {
+	return cfg.SessionPolicy.AllowEarlyData == nil || cfg.SessionPolicy.AllowEarlyData(name)
+}
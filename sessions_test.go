@@ -0,0 +1,185 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// resumes performs a handshake with a server using tlsConfig,
+// and returns whether the client resumed a session.
+func resumes(t *testing.T, tlsConfig, clientConfig *tls.Config) bool {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("x"))
+	}()
+	conn, err := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// reading processes the session tickets sent after the handshake
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().DidResume
+}
+
+func TestSessionPolicyBindToCertificates(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil // handshakes must not renew the revoked certificate in the background
+	cfg.SessionPolicy = &SessionPolicy{BindToCertificates: true}
+	if err := cfg.ManageSync(ctx, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := cfg.TLSConfig()
+	clientConfig := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+
+	if resumes(t, tlsConfig, clientConfig) {
+		t.Fatal("expected first handshake not to resume")
+	}
+	if !resumes(t, tlsConfig, clientConfig) {
+		t.Fatal("expected second handshake to resume")
+	}
+
+	// sessions are not resumed after the certificate was renewed
+	oldCert := cfg.certCache.getAllMatchingCerts("example.com")[0]
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.reloadManagedCertificate(ctx, oldCert); err != nil {
+		t.Fatal(err)
+	}
+	if resumes(t, tlsConfig, clientConfig) {
+		t.Error("expected session of renewed certificate not to resume")
+	}
+	if !resumes(t, tlsConfig, clientConfig) {
+		t.Error("expected session of new certificate to resume")
+	}
+
+	// nor after it was revoked
+	cert := cfg.certCache.getAllMatchingCerts("example.com")[0]
+	cfg.certCache.mu.Lock()
+	cert.ocsp = &ocsp.Response{Status: ocsp.Revoked}
+	cfg.certCache.cache[cert.hash] = cert
+	cfg.certCache.mu.Unlock()
+	if resumes(t, tlsConfig, clientConfig) {
+		t.Error("expected session of revoked certificate not to resume")
+	}
+}
+
+func TestSessionPolicyInvalidateAllOnRevocation(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("parsing OCSP request: %v", err)
+			return
+		}
+		for _, leaf := range fi.Issued() {
+			if leaf.SerialNumber.Cmp(req.SerialNumber) == 0 {
+				resp, _ := fi.OCSPResponse(leaf, 24*time.Hour)
+				w.Write(resp)
+				return
+			}
+		}
+		w.Write(ocsp.UnauthorizedErrorResponse)
+	}))
+	defer responder.Close()
+	fi.OCSPServer = responder.URL
+
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.SessionPolicy = &SessionPolicy{InvalidateAllOnRevocation: true}
+	if err := cfg.ManageSync(ctx, []string{"example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := cfg.TLSConfig()
+	clientConfig := &tls.Config{
+		ServerName:         "example.com",
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	resumes(t, tlsConfig, clientConfig)
+	if !resumes(t, tlsConfig, clientConfig) {
+		t.Fatal("expected second handshake to resume")
+	}
+
+	// another certificate is revoked
+	cert, bundle := issueFakeCertificate(t, fi, "revoked.example.com")
+	if err := fi.Revoke(ctx, CertificateResource{CertificatePEM: bundle}, ocsp.KeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.stapleOCSP(ctx, &cert, bundle); err != nil {
+		t.Fatal(err)
+	}
+	if resumes(t, tlsConfig, clientConfig) {
+		t.Error("expected sessions to be invalidated by revocation")
+	}
+	if !resumes(t, tlsConfig, clientConfig) {
+		t.Error("expected new session to resume")
+	}
+}
+
+func TestSessionPolicyEarlyData(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.SessionPolicy = &SessionPolicy{
+		AllowEarlyData: func(name string) bool { return name != "no-0rtt.example.com" },
+	}
+	for name, want := range map[string]bool{"example.com": true, "NO-0RTT.example.com": false} {
+		cs := tls.ConnectionState{ServerName: name}
+		ss := &tls.SessionState{EarlyData: true}
+		cfg.wrapSession(cs, ss)
+		if ss.EarlyData != want {
+			t.Errorf("%s: expected early data %t when wrapping, got %t", name, want, ss.EarlyData)
+		}
+		ss.EarlyData = true
+		if !cfg.unwrapSession(cs, ss) {
+			t.Errorf("%s: expected session to be resumable", name)
+		}
+		if ss.EarlyData != want {
+			t.Errorf("%s: expected early data %t when unwrapping, got %t", name, want, ss.EarlyData)
+		}
+	}
+
+	// sessions without certmagic's data are not resumed
+	if cfg.unwrapSession(tls.ConnectionState{ServerName: "example.com"}, new(tls.SessionState)) {
+		t.Error("expected foreign session not to be resumable")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ShadowStorage is a Storage for staging upgrades: it reads from the
+// production storage but never writes to it, so that a new version of
+// an application (or of certmagic) can be run against the production
+// assets, and its behavior, such as renewals and changes to the storage
+// layout, validated before it is allowed to write to production.
+//
+// All writes go to the Shadow storage, which takes precedence over
+// Production when reading; in effect, the shadow namespace is seeded
+// from production, copy-on-write. Deletions are recorded as tombstones
+// in the shadow storage, so that deleted assets are not read from
+// production again. Locks are only taken in the shadow storage, so
+// instances using a ShadowStorage do not wait for, nor hold up, those
+// using production.
+//
+// Note that everything else happens for real: certificates that are
+// renewed in the shadow namespace are issued by the CA, and count
+// towards its rate limits. Once the upgrade is validated, point the
+// application at production again; use Changes to see what it would
+// write.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ShadowStorage struct {
+	// The production storage, which is only read from. Required.
+	Production Storage
+
+	// The storage of the shadow namespace, such as a separate
+	// directory, bucket, or key prefix. Required.
+	Shadow Storage
+}
+
+// ShadowChanges are the changes made in a shadow namespace
+// relative to production; see ShadowStorage.Changes.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ShadowChanges struct {
+	// The keys that were stored in the shadow namespace.
+	Written []string
+
+	// The keys of production that were deleted in the shadow
+	// namespace; if a directory was deleted, only the
+	// directory is listed.
+	Deleted []string
+}
+
+const (
+	// prefixShadowTombstones is where ShadowStorage records deleted keys.
+	prefixShadowTombstones = "shadow_tombstones"
+
+	// shadowTombstoneSuffix is appended to the keys of tombstones, so that
+	// a tombstone for a directory does not conflict with those within it.
+	shadowTombstoneSuffix = "~deleted"
+)
+
+func shadowTombstoneKey(key string) string {
+	return path.Join(prefixShadowTombstones, key) + shadowTombstoneSuffix
+}
+
+// deleted returns whether key, or a directory it is in, was deleted
+// in the shadow namespace.
+func (s *ShadowStorage) deleted(ctx context.Context, key string) bool {
+	for k := key; k != "." && k != "/" && k != ""; k = path.Dir(k) {
+		if s.Shadow.Exists(ctx, shadowTombstoneKey(k)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lock implements Locker. Locks are only taken in the shadow storage.
+func (s *ShadowStorage) Lock(ctx context.Context, name string) error {
+	return s.Shadow.Lock(ctx, name)
+}
+
+// Unlock implements Locker.
+func (s *ShadowStorage) Unlock(ctx context.Context, name string) error {
+	return s.Shadow.Unlock(ctx, name)
+}
+
+// Store implements Storage. The value is only stored in the shadow storage.
+func (s *ShadowStorage) Store(ctx context.Context, key string, value []byte) error {
+	if err := s.Shadow.Store(ctx, key, value); err != nil {
+		return err
+	}
+	// the key is no longer deleted
+	err := s.Shadow.Delete(ctx, shadowTombstoneKey(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Load implements Storage.
+func (s *ShadowStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.Shadow.Load(ctx, key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return value, err
+	}
+	if s.deleted(ctx, key) {
+		return nil, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return s.Production.Load(ctx, key)
+}
+
+// Delete implements Storage. The key is deleted from the shadow storage,
+// and if it exists in production, a tombstone is recorded instead.
+func (s *ShadowStorage) Delete(ctx context.Context, key string) error {
+	inShadow := s.Shadow.Exists(ctx, key)
+	if err := s.Shadow.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if s.deleted(ctx, key) || !s.Production.Exists(ctx, key) {
+		if !inShadow {
+			return fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+		}
+		return nil
+	}
+	return s.Shadow.Store(ctx, shadowTombstoneKey(key), nil)
+}
+
+// Exists implements Storage.
+func (s *ShadowStorage) Exists(ctx context.Context, key string) bool {
+	if s.Shadow.Exists(ctx, key) {
+		return true
+	}
+	return !s.deleted(ctx, key) && s.Production.Exists(ctx, key)
+}
+
+// List implements Storage. It lists the keys of both storages,
+// except those that were deleted in the shadow namespace.
+func (s *ShadowStorage) List(ctx context.Context, dir string, recursive bool) ([]string, error) {
+	shadowKeys, shadowErr := s.Shadow.List(ctx, dir, recursive)
+	if shadowErr != nil && !errors.Is(shadowErr, fs.ErrNotExist) {
+		return nil, shadowErr
+	}
+	var prodKeys []string
+	var prodErr error
+	if !s.deleted(ctx, dir) {
+		prodKeys, prodErr = s.Production.List(ctx, dir, recursive)
+		if prodErr != nil && !errors.Is(prodErr, fs.ErrNotExist) {
+			return nil, prodErr
+		}
+	}
+	if shadowErr != nil && (prodErr != nil || prodKeys == nil) {
+		return nil, shadowErr
+	}
+
+	tombstones, err := s.tombstones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]struct{}, len(shadowKeys)+len(prodKeys))
+	var keys []string
+	for _, key := range shadowKeys {
+		if key == prefixShadowTombstones || strings.HasPrefix(key, prefixShadowTombstones+"/") {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	for _, key := range prodKeys {
+		if _, ok := seen[key]; ok || isDeleted(tombstones, key) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Stat implements Storage.
+func (s *ShadowStorage) Stat(ctx context.Context, key string) (KeyInfo, error) {
+	info, err := s.Shadow.Stat(ctx, key)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return info, err
+	}
+	if s.deleted(ctx, key) {
+		return KeyInfo{}, fmt.Errorf("%s: %w", key, fs.ErrNotExist)
+	}
+	return s.Production.Stat(ctx, key)
+}
+
+// tombstones returns the keys that were deleted in the shadow namespace.
+func (s *ShadowStorage) tombstones(ctx context.Context) (map[string]struct{}, error) {
+	keys, err := s.Shadow.List(ctx, prefixShadowTombstones, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listing tombstones: %w", err)
+	}
+	tombstones := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, shadowTombstoneSuffix) {
+			continue
+		}
+		key = strings.TrimPrefix(key, prefixShadowTombstones+"/")
+		tombstones[strings.TrimSuffix(key, shadowTombstoneSuffix)] = struct{}{}
+	}
+	return tombstones, nil
+}
+
+// isDeleted returns whether key, or a directory it is in, is in tombstones.
+func isDeleted(tombstones map[string]struct{}, key string) bool {
+	for k := key; k != "." && k != "/" && k != ""; k = path.Dir(k) {
+		if _, ok := tombstones[k]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes returns the changes made in the shadow namespace relative to
+// production, sorted by key. It does not compare values: keys that were
+// stored are listed as written even if their value did not change.
+func (s *ShadowStorage) Changes(ctx context.Context) (ShadowChanges, error) {
+	var changes ShadowChanges
+	keys, err := s.Shadow.List(ctx, "", true)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return changes, fmt.Errorf("listing shadow storage: %w", err)
+	}
+	for _, key := range keys {
+		if key == prefixShadowTombstones || strings.HasPrefix(key, prefixShadowTombstones+"/") {
+			continue
+		}
+		info, err := s.Shadow.Stat(ctx, key)
+		if err != nil || !info.IsTerminal {
+			continue
+		}
+		changes.Written = append(changes.Written, key)
+	}
+	tombstones, err := s.tombstones(ctx)
+	if err != nil {
+		return changes, err
+	}
+	for key := range tombstones {
+		changes.Deleted = append(changes.Deleted, key)
+	}
+	sort.Strings(changes.Written)
+	sort.Strings(changes.Deleted)
+	return changes, nil
+}
+
+// Interface guard
+var _ Storage = (*ShadowStorage)(nil)
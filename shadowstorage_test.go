@@ -0,0 +1,111 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestShadowStorage(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	prodCfg := newOnDemandTestConfig(t, fi)
+	prodCfg.OnDemand = nil
+	if err := prodCfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	certKey := StorageKeys.SiteCert(fi.IssuerKey(), "example.com")
+	prodCert, err := prodCfg.Storage.Load(ctx, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prodKeys, err := prodCfg.Storage.List(ctx, "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the new version runs against a shadow namespace
+	shadow := &ShadowStorage{Production: prodCfg.Storage, Shadow: &FileStorage{Path: t.TempDir()}}
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.Storage = shadow
+	if _, err := cfg.CacheManagedCertificate(ctx, "example.com"); err != nil {
+		t.Fatalf("expected certificate to be read from production: %v", err)
+	}
+	if err := cfg.RenewCertSync(ctx, "example.com", true); err != nil {
+		t.Fatalf("renewing in shadow namespace: %v", err)
+	}
+
+	shadowCert, err := shadow.Load(ctx, certKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(shadowCert, prodCert) {
+		t.Error("expected renewed certificate in shadow namespace")
+	}
+	if stored, _ := prodCfg.Storage.Load(ctx, certKey); !bytes.Equal(stored, prodCert) {
+		t.Error("expected production certificate to be unchanged")
+	}
+	if keys, _ := prodCfg.Storage.List(ctx, "", true); !reflect.DeepEqual(keys, prodKeys) {
+		t.Errorf("expected no new keys in production, got %v", keys)
+	}
+
+	// deleting hides production assets without deleting them
+	metaKey := StorageKeys.SiteMeta(fi.IssuerKey(), "example.com")
+	keyKey := StorageKeys.SitePrivateKey(fi.IssuerKey(), "example.com")
+	if err := shadow.Delete(ctx, StorageKeys.CertsSitePrefix(fi.IssuerKey(), "example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shadow.Load(ctx, keyKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected deleted key to not exist, got %v", err)
+	}
+	if shadow.Exists(ctx, metaKey) {
+		t.Error("expected deleted metadata to not exist")
+	}
+	if keys, err := shadow.List(ctx, StorageKeys.CertsPrefix(fi.IssuerKey()), true); err != nil || len(keys) != 0 {
+		t.Errorf("expected deleted directory not to be listed, got %v (err=%v)", keys, err)
+	}
+	if !prodCfg.Storage.Exists(ctx, keyKey) {
+		t.Error("expected production key to be kept")
+	}
+	if err := shadow.Delete(ctx, "not/there"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+
+	// storing again after deleting is visible
+	if err := shadow.Store(ctx, certKey, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := shadow.Load(ctx, certKey); err != nil || string(value) != "new" {
+		t.Errorf("expected stored value, got %q (err=%v)", value, err)
+	}
+
+	changes, err := shadow.Changes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changes.Deleted, []string{StorageKeys.CertsSitePrefix(fi.IssuerKey(), "example.com")}) {
+		t.Errorf("unexpected deletions: %v", changes.Deleted)
+	}
+	if !slices.Contains(changes.Written, certKey) || slices.Contains(changes.Written, keyKey) {
+		t.Errorf("unexpected writes: %v", changes.Written)
+	}
+}
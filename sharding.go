@@ -0,0 +1,389 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sharding divides the maintenance of managed certificates among the
+// instances of a cluster that share the same storage, so that each
+// instance renews certificates and refreshes OCSP staples only for its
+// shard of the names, instead of every instance examining everything.
+// Other instances reload what the owner of a name renewed from storage.
+//
+// Each instance records its membership in Storage and renews it
+// regularly; names are assigned to the members by consistent hashing,
+// so when an instance joins or leaves, or stops renewing its membership,
+// only its share of the names moves to other instances. Since membership
+// expiration is based on time, the clocks of the instances must be
+// synchronized. During rebalancing, instances may briefly disagree on
+// ownership; storage locks keep them from renewing a certificate twice.
+//
+// A Sharding must be used by only one Cache per process. It is not meant
+// to be combined with a LeaderElection, which leaves all maintenance to
+// one instance. It can be combined with a LocalCoordinator, in which case
+// only the local leader on each host is a member.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type Sharding struct {
+	// The storage shared by the cluster. Required.
+	Storage Storage
+
+	// The name of the group of instances, so that several
+	// clusters can share the same storage. Default: "maintenance".
+	Name string
+
+	// The ID of this instance, which must be unique in the
+	// cluster. Default: the hostname, the process ID, and
+	// a random suffix.
+	ID string
+
+	// How long a membership lasts; members renew it at a
+	// third of this interval. Default: DefaultShardMemberTTL.
+	MemberTTL time.Duration
+
+	// How many points each member has on the hash ring; more
+	// points spread names more evenly. Default: 128.
+	VirtualNodes int
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+
+	mu      sync.Mutex
+	id      string
+	joined  time.Time
+	members []ShardMember // live members, sorted by ID
+	ring    []shardPoint  // sorted by hash
+}
+
+// ShardMember describes an instance that takes part in a Sharding.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ShardMember struct {
+	// The ID of the instance.
+	ID string `json:"id"`
+
+	// When the instance joined.
+	Joined time.Time `json:"joined"`
+
+	// When the membership expires, unless renewed.
+	Expires time.Time `json:"expires"`
+}
+
+// shardPoint is a point of a member on the hash ring.
+type shardPoint struct {
+	hash uint64
+	id   string
+}
+
+// DefaultShardMemberTTL is the default duration of shard memberships.
+const DefaultShardMemberTTL = time.Minute
+
+// shardMemberCleanupAge is how long after it expired the membership
+// of an instance that did not leave properly is deleted from storage.
+const shardMemberCleanupAge = 24 * time.Hour
+
+func (s *Sharding) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return "maintenance"
+}
+
+func (s *Sharding) memberTTL() time.Duration {
+	if s.MemberTTL > 0 {
+		return s.MemberTTL
+	}
+	return DefaultShardMemberTTL
+}
+
+func (s *Sharding) virtualNodes() int {
+	if s.VirtualNodes > 0 {
+		return s.VirtualNodes
+	}
+	return 128
+}
+
+func (s *Sharding) logger() *zap.Logger {
+	if s.Logger == nil {
+		return zap.NewNop()
+	}
+	return s.Logger
+}
+
+// InstanceID returns the ID of this instance.
+func (s *Sharding) InstanceID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.instanceID()
+}
+
+// instanceID is like InstanceID; s.mu must be held.
+func (s *Sharding) instanceID() string {
+	if s.ID != "" {
+		return s.ID
+	}
+	if s.id == "" {
+		s.id = newInstanceID()
+	}
+	return s.id
+}
+
+// Members returns the live members, as of the last
+// time this instance renewed its membership.
+func (s *Sharding) Members() []ShardMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.members)
+}
+
+// Owner returns the ID of the member that maintains the certificate
+// for name, or "" if no members are known yet.
+func (s *Sharding) Owner(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.owner(name)
+}
+
+func (s *Sharding) owner(name string) string {
+	if len(s.ring) == 0 {
+		return ""
+	}
+	h := shardHash(name)
+	i := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	if i == len(s.ring) {
+		i = 0
+	}
+	return s.ring[i].id
+}
+
+// Owns returns true if this instance maintains the certificate for
+// name. Until any members are known, every instance owns every name,
+// since it is better to do maintenance twice than never.
+func (s *Sharding) Owns(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	owner := s.owner(name)
+	return owner == "" || owner == s.instanceID()
+}
+
+// heartbeat renews the membership of this instance, and updates the
+// members and the hash ring from storage. It returns true if the
+// members changed.
+func (s *Sharding) heartbeat(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.memberTTL()/2)
+	defer cancel()
+
+	now := timeNow()
+	s.mu.Lock()
+	id := s.instanceID()
+	if s.joined.IsZero() {
+		s.joined = now
+	}
+	self := ShardMember{ID: id, Joined: s.joined, Expires: now.Add(s.memberTTL())}
+	s.mu.Unlock()
+
+	selfJSON, err := json.Marshal(self)
+	if err != nil {
+		return false, err
+	}
+	if err := s.Storage.Store(ctx, StorageKeys.ShardMember(s.name(), id), selfJSON); err != nil {
+		return false, fmt.Errorf("storing membership: %v", err)
+	}
+
+	members, err := s.loadMembers(ctx, now)
+	if err != nil {
+		return false, err
+	}
+	if !slices.ContainsFunc(members, func(m ShardMember) bool { return m.ID == id }) {
+		members = append(members, self) // in case listing is eventually consistent
+		sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := !slices.EqualFunc(members, s.members, func(a, b ShardMember) bool { return a.ID == b.ID })
+	s.members = members
+	if changed {
+		s.ring = buildShardRing(members, s.virtualNodes())
+	}
+	return changed, nil
+}
+
+// loadMembers loads the members whose memberships have not expired
+// by now, sorted by ID, and deletes long-expired memberships.
+func (s *Sharding) loadMembers(ctx context.Context, now time.Time) ([]ShardMember, error) {
+	keys, err := s.Storage.List(ctx, StorageKeys.ShardMembersPrefix(s.name()), false)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("listing members: %v", err)
+	}
+	var members []ShardMember
+	for _, key := range keys {
+		memberJSON, err := s.Storage.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // left in the meantime
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading member: %v", err)
+		}
+		var member ShardMember
+		if err := json.Unmarshal(memberJSON, &member); err != nil {
+			s.logger().Warn("ignoring invalid shard membership", zap.String("key", key), zap.Error(err))
+			continue
+		}
+		if now.Before(member.Expires) {
+			members = append(members, member)
+			continue
+		}
+		if now.Sub(member.Expires) > shardMemberCleanupAge {
+			if err := s.Storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				s.logger().Warn("deleting expired shard membership", zap.String("key", key), zap.Error(err))
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members, nil
+}
+
+// leave ends the membership of this instance, so that the
+// other members take over its share of the names right away.
+func (s *Sharding) leave(ctx context.Context) error {
+	s.mu.Lock()
+	id := s.instanceID()
+	s.members, s.ring, s.joined = nil, nil, time.Time{}
+	s.mu.Unlock()
+	err := s.Storage.Delete(ctx, StorageKeys.ShardMember(s.name(), id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// buildShardRing returns the hash ring of the members.
+func buildShardRing(members []ShardMember, virtualNodes int) []shardPoint {
+	ring := make([]shardPoint, 0, len(members)*virtualNodes)
+	for _, m := range members {
+		for i := 0; i < virtualNodes; i++ {
+			ring = append(ring, shardPoint{hash: shardHash(m.ID + "#" + strconv.Itoa(i)), id: m.ID})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		return ring[i].id < ring[j].id
+	})
+	return ring
+}
+
+func shardHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ShardMembersPrefix returns the storage key prefix for
+// the memberships of the instances of a sharding group.
+func (keys KeyBuilder) ShardMembersPrefix(group string) string {
+	return path.Join(prefixShards, keys.Safe(group))
+}
+
+// ShardMember returns the storage key for the membership
+// of an instance in a sharding group.
+func (keys KeyBuilder) ShardMember(group, id string) string {
+	return path.Join(keys.ShardMembersPrefix(group), keys.Safe(id)+".json")
+}
+
+const prefixShards = "shards"
+
+// sharding returns the sharding of the cache, if any.
+func (certCache *Cache) sharding() *Sharding {
+	certCache.optionsMu.RLock()
+	defer certCache.optionsMu.RUnlock()
+	return certCache.options.Sharding
+}
+
+// ownsCert returns true if this instance maintains cert, which is
+// the case unless cert is managed and owned by another shard.
+func (certCache *Cache) ownsCert(cert Certificate) bool {
+	s := certCache.sharding()
+	if s == nil || !cert.managed || len(cert.Names) == 0 {
+		return true
+	}
+	return s.Owns(cert.Names[0])
+}
+
+// renewShardMembership renews the membership of this instance in the
+// sharding of the cache, if any, and rebalances if the members changed.
+func (certCache *Cache) renewShardMembership(ctx context.Context, log *zap.Logger) {
+	s := certCache.sharding()
+	if s == nil {
+		return
+	}
+	if lc := certCache.localCoordinator(); lc != nil {
+		// only the local leader of each host is a member
+		if leader, err := lc.leader(); err == nil && !leader {
+			return
+		}
+	}
+	changed, err := s.heartbeat(ctx)
+	if err != nil {
+		log.Error("renewing shard membership",
+			zap.String("group", s.name()),
+			zap.Error(err))
+		return
+	}
+	if !changed {
+		return
+	}
+	members := s.Members()
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = m.ID
+	}
+	log.Info("shard members changed; rebalancing maintenance",
+		zap.String("group", s.name()),
+		zap.String("id", s.InstanceID()),
+		zap.Strings("members", ids))
+	certCache.events.publish("shards_rebalanced", map[string]any{
+		"group":   s.name(),
+		"members": ids,
+	})
+
+	// the certificates of this instance, some of which may have
+	// moved to it, are examined by the next renewal pass in case
+	// they need attention
+	certCache.mu.Lock()
+	for hash, cert := range certCache.cache {
+		if cert.managed && len(cert.Names) > 0 && s.Owns(cert.Names[0]) {
+			certCache.reviews.schedule(hash, timeNow())
+		}
+	}
+	certCache.mu.Unlock()
+}
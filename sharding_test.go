@@ -0,0 +1,166 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestShardingOwnership(t *testing.T) {
+	ctx := context.Background()
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	storage := &FileStorage{Path: t.TempDir()}
+
+	shards := []*Sharding{
+		{Storage: storage, ID: "a"},
+		{Storage: storage, ID: "b"},
+		{Storage: storage, ID: "c"},
+	}
+	if !shards[0].Owns("example.com") {
+		t.Error("expected instance to own every name before any members are known")
+	}
+	heartbeat := func(shards ...*Sharding) {
+		t.Helper()
+		for _, s := range shards {
+			if _, err := s.heartbeat(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// twice, so that the first ones see the later ones
+	heartbeat(shards...)
+	heartbeat(shards...)
+
+	names := make([]string, 300)
+	for i := range names {
+		names[i] = fmt.Sprintf("site%d.example.com", i)
+	}
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for _, name := range names {
+		owner := shards[0].Owner(name)
+		var n int
+		for _, s := range shards {
+			if s.Owner(name) != owner {
+				t.Fatalf("instances disagree on owner of %s", name)
+			}
+			if s.Owns(name) {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("expected exactly one owner of %s, got %d", name, n)
+		}
+		owners[name] = owner
+		counts[owner]++
+	}
+	for _, s := range shards {
+		if counts[s.ID] < len(names)/5 {
+			t.Errorf("expected names to be spread evenly, got %v", counts)
+			break
+		}
+	}
+
+	// when an instance leaves, only its names move
+	if err := shards[2].leave(ctx); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := shards[0].heartbeat(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expected members to change after instance left")
+	}
+	if members := shards[0].Members(); len(members) != 2 {
+		t.Fatalf("expected 2 members, got %d", len(members))
+	}
+	for _, name := range names {
+		owner := shards[0].Owner(name)
+		if owner == "c" {
+			t.Fatalf("expected no names to be owned by instance that left")
+		}
+		if owners[name] != "c" && owner != owners[name] {
+			t.Fatalf("expected %s to stay with %s, moved to %s", name, owners[name], owner)
+		}
+	}
+
+	// instances that stop renewing their membership expire
+	faults.set(2*DefaultShardMemberTTL, false)
+	if _, err := shards[0].heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if members := shards[0].Members(); len(members) != 1 || members[0].ID != "a" {
+		t.Fatalf("expected only instance a to be left, got %v", members)
+	}
+	for _, name := range names {
+		if !shards[0].Owns(name) {
+			t.Fatalf("expected last instance to own %s", name)
+		}
+	}
+}
+
+func TestCacheSharding(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	other := &Sharding{Storage: storage, ID: "b"}
+	if _, err := other.heartbeat(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	sharding := &Sharding{Storage: storage, ID: "a"}
+	cache := NewCache(CacheOptions{
+		GetConfigForCert: func(Certificate) (*Config, error) { return nil, nil },
+		Sharding:         sharding,
+		Logger:           zap.NewNop(),
+	})
+	for i := 0; i < 100 && len(sharding.Members()) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if members := sharding.Members(); len(members) != 2 {
+		t.Fatalf("expected cache to join the other instance, got %v", members)
+	}
+
+	var name string
+	for i := 0; name == ""; i++ {
+		if candidate := fmt.Sprintf("site%d.example.com", i); sharding.Owner(candidate) == "b" {
+			name = candidate
+		}
+	}
+	if cache.ownsCert(Certificate{Names: []string{name}, managed: true}) {
+		t.Error("expected managed certificate of another shard not to be maintained")
+	}
+	if !cache.ownsCert(Certificate{Names: []string{name}}) {
+		t.Error("expected unmanaged certificate to be maintained by every instance")
+	}
+
+	// stopping the cache leaves the group
+	cache.Stop()
+	for i := 0; i < 100 && len(other.Members()) != 1; i++ {
+		if _, err := other.heartbeat(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if members := other.Members(); len(members) != 1 || members[0].ID != "b" {
+		t.Errorf("expected stopped instance to leave the group, got %v", members)
+	}
+}
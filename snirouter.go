@@ -0,0 +1,125 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mholt/acmez/v3"
+)
+
+// SNIRouter selects a complete TLS configuration for each handshake by
+// the server name (SNI) of the client, so that a single listener can
+// apply different policies to different sites, for example requiring
+// client certificates for some names and TLS 1.3 for others. All
+// configurations get their certificates from the same Config, and
+// thus the same certificate cache.
+//
+// Use its TLSConfig method, or set its GetConfigForClient method on
+// a tls.Config.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SNIRouter struct {
+	// The Config that provides the certificates. Required.
+	Config *Config
+
+	// The TLS configurations by server name. Names may
+	// be wildcards such as "*.example.com", which match
+	// a single label; exact names take precedence.
+	//
+	// The configurations are templates: unless they set
+	// GetCertificate or Certificates, certificates are
+	// served by Config. Like any tls.Config, they must
+	// not be modified after their first use.
+	Policies map[string]*tls.Config
+
+	// The TLS configuration for names without a policy,
+	// and for clients that do not send a server name. It
+	// also serves tls-alpn-01 challenges, for which the
+	// protocol is added to NextProtos.
+	// Default: Config.TLSConfig().
+	Default *tls.Config
+
+	initOnce sync.Once
+	routes   map[string]*tls.Config
+	fallback *tls.Config
+}
+
+// TLSConfig returns a TLS configuration that routes
+// handshakes according to the router's policies.
+func (r *SNIRouter) TLSConfig() *tls.Config {
+	tlsConfig := r.Config.TLSConfig()
+	tlsConfig.GetConfigForClient = r.GetConfigForClient
+	return tlsConfig
+}
+
+// GetConfigForClient returns the TLS configuration for the
+// server name of hello. It implements
+// tls.Config.GetConfigForClient.
+//
+// The tls-alpn-01 challenge is always served with the default
+// configuration, since the CA's validation request would not
+// satisfy policies such as client authentication.
+func (r *SNIRouter) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	r.initOnce.Do(r.init)
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmez.ACMETLS1Protocol {
+		return r.fallback, nil
+	}
+	name := normalizedName(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return r.fallback, nil
+	}
+	if tlsConfig, ok := r.routes[name]; ok {
+		return tlsConfig, nil
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if tlsConfig, ok := r.routes["*"+name[i:]]; ok {
+			return tlsConfig, nil
+		}
+	}
+	return r.fallback, nil
+}
+
+// init prepares the configurations of all policies.
+func (r *SNIRouter) init() {
+	fallback := r.Default
+	if fallback == nil {
+		fallback = r.Config.TLSConfig()
+	}
+	r.fallback = r.prepare(fallback)
+	if !slices.Contains(r.fallback.NextProtos, acmez.ACMETLS1Protocol) {
+		r.fallback.NextProtos = append(r.fallback.NextProtos, acmez.ACMETLS1Protocol)
+	}
+	r.routes = make(map[string]*tls.Config, len(r.Policies))
+	for name, tlsConfig := range r.Policies {
+		r.routes[normalizedName(strings.TrimSuffix(name, "."))] = r.prepare(tlsConfig)
+	}
+}
+
+// prepare returns a copy of template that serves
+// the certificates of r.Config.
+func (r *SNIRouter) prepare(template *tls.Config) *tls.Config {
+	tlsConfig := template.Clone()
+	if tlsConfig.GetCertificate == nil && len(tlsConfig.Certificates) == 0 {
+		tlsConfig.GetCertificate = r.Config.GetCertificate
+	}
+	r.Config.applySessionPolicy(tlsConfig)
+	// the router must not be consulted again
+	tlsConfig.GetConfigForClient = nil
+	return tlsConfig
+}
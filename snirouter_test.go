@@ -0,0 +1,113 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	"github.com/mholt/acmez/v3"
+)
+
+// sniRouterHandshake performs a handshake with a server using
+// tlsConfig, and returns the error of the server, if any.
+func sniRouterHandshake(t *testing.T, tlsConfig *tls.Config, clientConfig *tls.Config) error {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	clientErr := make(chan error, 1)
+	go func() {
+		clientErr <- tls.Client(clientConn, clientConfig).Handshake()
+		clientConn.Close()
+	}()
+	err := tls.Server(serverConn, tlsConfig).Handshake()
+	<-clientErr
+	return err
+}
+
+func TestSNIRouter(t *testing.T) {
+	ctx := context.Background()
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	for _, name := range []string{"mtls.example.com", "a.example.net", "other.example.org"} {
+		if err := cfg.ManageSync(ctx, []string{name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := &SNIRouter{
+		Config: cfg,
+		Policies: map[string]*tls.Config{
+			"MTLS.example.com": {ClientAuth: tls.RequireAnyClientCert},
+			"*.example.net":    {MinVersion: tls.VersionTLS13},
+		},
+	}
+	tlsConfig := router.TLSConfig()
+
+	for _, test := range []struct {
+		serverName string
+		clientAuth tls.ClientAuthType
+		minVersion uint16
+	}{
+		{serverName: "mtls.example.com", clientAuth: tls.RequireAnyClientCert},
+		{serverName: "mtls.example.com.", clientAuth: tls.RequireAnyClientCert},
+		{serverName: "a.example.net", minVersion: tls.VersionTLS13},
+		{serverName: "b.a.example.net", minVersion: tls.VersionTLS12},
+		{serverName: "other.example.org", minVersion: tls.VersionTLS12},
+		{serverName: "", minVersion: tls.VersionTLS12},
+	} {
+		got, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{ServerName: test.serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ClientAuth != test.clientAuth || got.MinVersion != test.minVersion {
+			t.Errorf("%q: expected client auth %v and min version %x, got %v and %x",
+				test.serverName, test.clientAuth, test.minVersion, got.ClientAuth, got.MinVersion)
+		}
+		if got.GetCertificate == nil || got.GetConfigForClient != nil {
+			t.Errorf("%q: expected config that serves certificates without routing again", test.serverName)
+		}
+	}
+
+	// tls-alpn-01 challenges are not subject to the policies
+	got, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{
+		ServerName:      "mtls.example.com",
+		SupportedProtos: []string{acmez.ACMETLS1Protocol},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ClientAuth != tls.NoClientCert {
+		t.Error("expected tls-alpn-01 challenge to be served without client authentication")
+	}
+
+	// the policies apply to real handshakes, with certificates from the cache
+	clientConfig := func(name string, maxVersion uint16) *tls.Config {
+		return &tls.Config{ServerName: name, InsecureSkipVerify: true, MaxVersion: maxVersion}
+	}
+	if err := sniRouterHandshake(t, tlsConfig, clientConfig("other.example.org", 0)); err != nil {
+		t.Errorf("expected handshake to succeed, got %v", err)
+	}
+	if err := sniRouterHandshake(t, tlsConfig, clientConfig("mtls.example.com", 0)); err == nil {
+		t.Error("expected handshake without client certificate to fail")
+	}
+	if err := sniRouterHandshake(t, tlsConfig, clientConfig("a.example.net", tls.VersionTLS12)); err == nil {
+		t.Error("expected TLS 1.2 handshake to fail")
+	}
+	if err := sniRouterHandshake(t, tlsConfig, clientConfig("a.example.net", tls.VersionTLS13)); err != nil {
+		t.Errorf("expected TLS 1.3 handshake to succeed, got %v", err)
+	}
+}
@@ -16,10 +16,19 @@ package certmagic
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"path"
@@ -132,7 +141,7 @@ func (s *tlsALPNSolver) Present(ctx context.Context, chal acme.Challenge) error
 	// validation, so it only has to be done once (at least, by this instance;
 	// distributed solving does not have that luxury, oh well) - update the
 	// challenge data in memory to be the generated certificate
-	cert, err := acmez.TLSALPN01ChallengeCert(chal)
+	cert, err := tlsALPNChallengeCert(chal)
 	if err != nil {
 		return err
 	}
@@ -238,6 +247,86 @@ func (s *tlsALPNSolver) CleanUp(_ context.Context, chal acme.Challenge) error {
 	return nil
 }
 
+// tlsALPNChallengeCert makes the certificate that solves the tls-alpn-01
+// challenge chal. For DNS identifiers, this is done by acmez; for IP
+// identifiers, the certificate must contain the IP address as an
+// iPAddress SAN instead of a dNSName SAN (RFC 8738 §6).
+func tlsALPNChallengeCert(chal acme.Challenge) (*tls.Certificate, error) {
+	if chal.Identifier.Type != "ip" {
+		return acmez.TLSALPN01ChallengeCert(chal)
+	}
+	ip := net.ParseIP(chal.Identifier.Value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP identifier: %s", chal.Identifier.Value)
+	}
+
+	keyAuthSum := sha256.Sum256([]byte(chal.KeyAuthorization))
+	keyAuthSumASN1, err := asn1.Marshal(keyAuthSum[:])
+	if err != nil {
+		return nil, err
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: "ACME challenge"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(24 * time.Hour * 365),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{ip},
+		ExtraExtensions: []pkix.Extension{
+			{
+				Id:       idPEACMEIdentifierV1,
+				Critical: true,
+				Value:    keyAuthSumASN1,
+			},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &certKey.PublicKey, certKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  certKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+// idPEACMEIdentifierV1 is the acmeIdentifier extension (RFC 8737 §6.1).
+var idPEACMEIdentifierV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// tlsALPNChallengeName returns the name by which the tls-alpn-01
+// challenge being validated by hello is keyed (see challengeKey).
+// For IP identifiers, the name is the reverse mapping of the IP
+// address (RFC 8738 §6); if the validation server does not send
+// SNI, it is derived from the local address of the connection.
+func tlsALPNChallengeName(hello *tls.ClientHelloInfo) string {
+	if hello.ServerName != "" {
+		return strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	}
+	ip := localIPFromConn(hello.Conn)
+	if ip == "" {
+		return ""
+	}
+	reversed, err := dns.ReverseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(reversed, ".")
+}
+
 // DNS01Solver is a type that makes libdns providers usable as ACME dns-01
 // challenge solvers. See https://github.com/libdns/libdns
 //
@@ -350,9 +439,27 @@ type DNSManager struct {
 	// Default: 2 minutes.
 	PropagationTimeout time.Duration
 
+	// How long to wait between propagation checks.
+	// Default: 2 seconds.
+	PropagationInterval time.Duration
+
 	// Preferred DNS resolver(s) to use when doing DNS lookups.
 	Resolvers []string
 
+	// Whether to check that records have propagated to all
+	// authoritative nameservers of their zone, even when
+	// Resolvers are set; the resolvers are then only used
+	// to find the nameservers. Without Resolvers, the
+	// authoritative nameservers are always checked. Every
+	// address of every nameserver must serve the record.
+	CheckAuthoritativeNameservers bool
+
+	// Optionally called with the result of each propagation
+	// check, such as to record how long records take to
+	// propagate with the DNS provider.
+	// EXPERIMENTAL: Subject to change or removal.
+	OnPropagationCheck func(PropagationCheck)
+
 	// Override the domain to set the TXT record on. This is
 	// to delegate the challenge to a different domain. Note
 	// that the solver doesn't follow CNAME/NS record.
@@ -414,6 +521,7 @@ func (m *DNSManager) createRecord(ctx context.Context, dnsName, recordType, reco
 // timeout, whichever is first.
 func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 	logger := m.logger()
+	created := time.Now()
 
 	// if configured to, pause before doing propagation checks
 	// (even if they are disabled, the wait might be desirable on its own)
@@ -435,10 +543,13 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 	if timeout == 0 {
 		timeout = defaultDNSPropagationTimeout
 	}
-	const interval = 2 * time.Second
+	interval := m.PropagationInterval
+	if interval <= 0 {
+		interval = 2 * time.Second
+	}
 
 	// how we'll do the checks
-	checkAuthoritativeServers := len(m.Resolvers) == 0
+	checkAuthoritativeServers := len(m.Resolvers) == 0 || m.CheckAuthoritativeNameservers
 	resolvers := recursiveNameservers(m.Resolvers)
 
 	recType := dns.TypeTXT
@@ -448,9 +559,9 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 
 	absName := libdns.AbsoluteName(zrec.record.Name, zrec.zone)
 
-	var err error
+	var lastErr error
 	start := time.Now()
-	for time.Since(start) < timeout {
+	for attempt := 1; time.Since(start) < timeout; attempt++ {
 		select {
 		case <-time.After(interval):
 		case <-ctx.Done():
@@ -461,19 +572,47 @@ func (m *DNSManager) wait(ctx context.Context, zrec zoneRecord) error {
 			zap.String("fqdn", absName),
 			zap.String("record_type", zrec.record.Type),
 			zap.String("expected_value", zrec.record.Value),
-			zap.Strings("resolvers", resolvers))
-
-		var ready bool
-		ready, err = checkDNSPropagation(logger, absName, recType, zrec.record.Value, checkAuthoritativeServers, resolvers)
+			zap.Strings("resolvers", resolvers),
+			zap.Int("attempt", attempt))
+
+		checkStart := time.Now()
+		nameservers, ready, err := checkDNSPropagation(logger, absName, recType, zrec.record.Value, checkAuthoritativeServers, resolvers)
+		check := PropagationCheck{
+			FQDN:        absName,
+			Attempt:     attempt,
+			Elapsed:     checkStart.Sub(created),
+			Duration:    time.Since(checkStart),
+			Nameservers: nameservers,
+			Ready:       ready,
+			Err:         err,
+		}
+		for _, ns := range nameservers {
+			logger.Debug("checked nameserver",
+				zap.String("fqdn", absName),
+				zap.String("nameserver", ns.Nameserver),
+				zap.Duration("rtt", ns.RTT),
+				zap.Bool("found", ns.Found),
+				zap.Error(ns.Err))
+			if ns.Err != nil {
+				lastErr = fmt.Errorf("nameserver %s: %w", ns.Nameserver, ns.Err)
+			}
+		}
+		if m.OnPropagationCheck != nil {
+			m.OnPropagationCheck(check)
+		}
 		if err != nil {
 			return fmt.Errorf("checking DNS propagation of %q (relative=%s zone=%s resolvers=%v): %w", absName, zrec.record.Name, zrec.zone, resolvers, err)
 		}
 		if ready {
+			logger.Debug("DNS record propagated",
+				zap.String("fqdn", absName),
+				zap.Int("attempts", attempt),
+				zap.Duration("elapsed", time.Since(created)))
 			return nil
 		}
 	}
 
-	return fmt.Errorf("timed out waiting for record to fully propagate; verify DNS provider configuration is correct - last error: %v", err)
+	return fmt.Errorf("timed out waiting for record to fully propagate; verify DNS provider configuration is correct - last error: %v", lastErr)
 }
 
 type zoneRecord struct {
@@ -707,7 +846,19 @@ func getSolverInfo(address string) *solverInfo {
 // function ignores errors if the socket is already in use,
 // which is useful for our challenge servers, where we assume
 // that whatever is already listening can solve the challenges.
+//
+// Addresses that are not TCP addresses, such as UNIX sockets, are
+// listened on with ListenAddress; UNIX sockets that are in use are
+// assumed to answer the challenges, too.
 func robustTryListen(addr string) (net.Listener, error) {
+	if !isTCPListenAddress(addr) {
+		ln, err := ListenAddress(addr)
+		if errors.Is(err, errSocketInUse) {
+			log.Printf("[WARNING] %v - assuming its listener is correctly configured and continuing", err)
+			return nil, nil
+		}
+		return ln, err
+	}
 	var listenErr error
 	for i := 0; i < 2; i++ {
 		// doesn't hurt to sleep briefly before the second
@@ -825,6 +976,9 @@ func (sw solverWrapper) Present(ctx context.Context, chal acme.Challenge) error
 	activeChallengesMu.Lock()
 	activeChallenges[challengeKey(chal)] = Challenge{Challenge: chal}
 	activeChallengesMu.Unlock()
+	if rec, ok := ctx.Value(challengeRecorderCtxKey{}).(*challengeRecorder); ok {
+		rec.present(chal)
+	}
 	return sw.Solver.Present(ctx, chal)
 }
 
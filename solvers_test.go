@@ -15,6 +15,11 @@
 package certmagic
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"net"
 	"testing"
 
 	"github.com/mholt/acmez/v3/acme"
@@ -155,3 +160,50 @@ func Test_challengeKey(t *testing.T) {
 		})
 	}
 }
+
+func TestTLSALPNChallengeCertIP(t *testing.T) {
+	chal := acme.Challenge{
+		Type:             acme.ChallengeTypeTLSALPN01,
+		Identifier:       acme.Identifier{Type: "ip", Value: "2001:db8::1"},
+		KeyAuthorization: "token.thumbprint",
+	}
+	cert, err := tlsALPNChallengeCert(chal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := cert.Leaf
+	if len(leaf.DNSNames) != 0 || len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected only an iPAddress SAN, got DNS names %v and IPs %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+	var found bool
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(idPEACMEIdentifierV1) {
+			found = true
+			var digest []byte
+			if _, err := asn1.Unmarshal(ext.Value, &digest); err != nil {
+				t.Fatal(err)
+			}
+			want := sha256.Sum256([]byte(chal.KeyAuthorization))
+			if !ext.Critical || !bytes.Equal(digest, want[:]) {
+				t.Error("expected critical acmeIdentifier extension with key authorization digest")
+			}
+		}
+	}
+	if !found {
+		t.Error("expected acmeIdentifier extension")
+	}
+
+	// DNS identifiers still get a dNSName SAN
+	chal.Identifier = acme.Identifier{Type: "dns", Value: "example.com"}
+	cert, err = tlsALPNChallengeCert(chal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "example.com" || len(leaf.IPAddresses) != 0 {
+		t.Errorf("expected only a dNSName SAN, got DNS names %v and IPs %v", leaf.DNSNames, leaf.IPAddresses)
+	}
+}
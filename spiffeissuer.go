@@ -0,0 +1,172 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// WorkloadAPIClient is a client of the SPIFFE Workload API, as served by
+// the SPIRE agent. It is typically implemented with the workloadapi
+// package of go-spiffe, which certmagic does not depend on.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type WorkloadAPIClient interface {
+	// FetchX509SVIDs returns the current X.509 SVIDs
+	// of the workload.
+	FetchX509SVIDs(ctx context.Context) ([]X509SVID, error)
+}
+
+// X509SVID is an X.509 SPIFFE verifiable identity document.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type X509SVID struct {
+	// The SPIFFE ID, e.g. "spiffe://example.org/ns/prod/sa/web".
+	ID string
+
+	// The certificate chain, leaf first.
+	Certificates []*x509.Certificate
+
+	// The private key of the leaf certificate.
+	PrivateKey crypto.Signer
+
+	// The trust bundle of the SPIFFE ID's trust domain, if known.
+	Bundle []*x509.Certificate
+
+	// The hint of the SVID, if any.
+	Hint string
+}
+
+// SPIFFEIssuer is an Issuer that gets X.509 SVIDs from the SPIFFE
+// Workload API, so that services in a SPIRE-managed mesh can get their
+// SVIDs through the same cache, storage, and maintenance as other
+// certificates. Certificates are managed by SPIFFE ID (see SubjectIsURI).
+//
+// SVIDs are short-lived and rotated by the SPIRE agent, which generates
+// their keys, so the key of the CSR is not used. Since renewals happen
+// according to the lifetime of the current certificate, the rotation of
+// certificates follows the TTL of the SVIDs. The SPIRE agent rotates SVIDs
+// halfway through their TTL, before the default renewal window starts, so
+// renewals get the rotated SVIDs.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SPIFFEIssuer struct {
+	// The Workload API client. Required.
+	Client WorkloadAPIClient
+
+	// If set, only SPIFFE IDs in this trust domain
+	// (e.g. "example.org") can be issued.
+	TrustDomain string
+}
+
+// SPIFFEMetadata is the metadata of certificates issued by SPIFFEIssuer.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type SPIFFEMetadata struct {
+	// The SPIFFE ID of the SVID.
+	ID string `json:"spiffe_id"`
+
+	// The hint of the SVID, if any.
+	Hint string `json:"hint,omitempty"`
+
+	// The PEM-encoded trust bundle of the trust domain, if known.
+	BundlePEM string `json:"bundle_pem,omitempty"`
+}
+
+// IssuerKey returns the unique issuer key for SPIFFE SVIDs.
+func (iss *SPIFFEIssuer) IssuerKey() string {
+	if iss.TrustDomain != "" {
+		return "spiffe_" + strings.ToLower(iss.TrustDomain)
+	}
+	return "spiffe"
+}
+
+// PreCheck returns an error if any of names is not a
+// SPIFFE ID that can be issued by iss.
+func (iss *SPIFFEIssuer) PreCheck(_ context.Context, names []string, _ bool) error {
+	for _, name := range names {
+		if _, err := iss.spiffeID(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Issue returns the current SVID of the workload for the SPIFFE ID in the
+// URI SAN of csr. The workload must be entitled to that SVID by SPIRE.
+func (iss *SPIFFEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	if len(csr.URIs) != 1 || len(csr.DNSNames)+len(csr.IPAddresses)+len(csr.EmailAddresses) > 0 {
+		return nil, fmt.Errorf("SVIDs must have exactly one SPIFFE ID and no other names; got %v", namesFromCSR(csr))
+	}
+	id, err := iss.spiffeID(csr.URIs[0].String())
+	if err != nil {
+		return nil, err
+	}
+
+	svids, err := iss.Client.FetchX509SVIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching X.509 SVIDs from Workload API: %w", err)
+	}
+	for _, svid := range svids {
+		if svid.ID != id {
+			continue
+		}
+		if len(svid.Certificates) == 0 || svid.PrivateKey == nil {
+			return nil, fmt.Errorf("SVID for %s is incomplete", id)
+		}
+		var chain []byte
+		for _, cert := range svid.Certificates {
+			chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+		keyPEM, err := PEMEncodePrivateKey(svid.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("encoding private key of SVID for %s: %v", id, err)
+		}
+		meta := SPIFFEMetadata{ID: id, Hint: svid.Hint}
+		for _, cert := range svid.Bundle {
+			meta.BundlePEM += string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		}
+		return &IssuedCertificate{
+			Certificate:   chain,
+			PrivateKeyPEM: keyPEM,
+			Metadata:      meta,
+		}, nil
+	}
+	return nil, fmt.Errorf("workload is not entitled to an SVID for %s", id)
+}
+
+// spiffeID returns name if it is a SPIFFE ID that iss can issue.
+func (iss *SPIFFEIssuer) spiffeID(name string) (string, error) {
+	u, err := url.Parse(name)
+	if err != nil || !strings.EqualFold(u.Scheme, "spiffe") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return "", fmt.Errorf("not a SPIFFE ID: %s", name)
+	}
+	if iss.TrustDomain != "" && !strings.EqualFold(u.Host, iss.TrustDomain) {
+		return "", fmt.Errorf("SPIFFE ID %s is not in trust domain %s", name, iss.TrustDomain)
+	}
+	return name, nil
+}
+
+// Interface guards
+var (
+	_ Issuer     = (*SPIFFEIssuer)(nil)
+	_ PreChecker = (*SPIFFEIssuer)(nil)
+)
@@ -0,0 +1,132 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeWorkloadAPI makes a new SVID for each of its IDs
+// whenever SVIDs are fetched, as if they were rotated.
+type fakeWorkloadAPI struct {
+	ca  *FakeIssuer
+	ids []string
+}
+
+func (w *fakeWorkloadAPI) FetchX509SVIDs(ctx context.Context) ([]X509SVID, error) {
+	var svids []X509SVID
+	for _, id := range w.ids {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		u, err := url.Parse(id)
+		if err != nil {
+			return nil, err
+		}
+		csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{URIs: []*url.URL{u}}, key)
+		if err != nil {
+			return nil, err
+		}
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil {
+			return nil, err
+		}
+		issued, err := w.ca.Issue(ctx, csr)
+		if err != nil {
+			return nil, err
+		}
+		certs, err := parseCertsFromPEMBundle(issued.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		svids = append(svids, X509SVID{
+			ID:           id,
+			Certificates: certs[:1],
+			PrivateKey:   key,
+			Bundle:       certs[1:],
+		})
+	}
+	return svids, nil
+}
+
+func TestSPIFFEIssuer(t *testing.T) {
+	ctx := context.Background()
+	spiffeID := "spiffe://example.org/ns/prod/sa/web"
+	iss := &SPIFFEIssuer{
+		Client:      &fakeWorkloadAPI{ca: &FakeIssuer{Lifetime: time.Hour}, ids: []string{spiffeID}},
+		TrustDomain: "example.org",
+	}
+	cfg := newOnDemandTestConfig(t, iss)
+	cfg.OnDemand = nil
+
+	if err := iss.PreCheck(ctx, []string{"example.com"}, false); err == nil {
+		t.Error("expected error for a name that is not a SPIFFE ID")
+	}
+	if err := iss.PreCheck(ctx, []string{"spiffe://other.example/web"}, false); err == nil {
+		t.Error("expected error for a SPIFFE ID in another trust domain")
+	}
+	if err := cfg.ObtainCertSync(ctx, "spiffe://example.org/ns/prod/sa/db"); err == nil || !strings.Contains(err.Error(), "not entitled") {
+		t.Errorf("expected error for a SPIFFE ID the workload is not entitled to, got %v", err)
+	}
+
+	if err := cfg.ManageSync(ctx, []string{spiffeID}); err != nil {
+		t.Fatal(err)
+	}
+	certs := cfg.certCache.AllMatchingCertificates(spiffeID)
+	if len(certs) != 1 {
+		t.Fatalf("expected SVID to be cached, got %d certificates", len(certs))
+	}
+	svid := certs[0]
+	if lifetime := svid.Leaf.NotAfter.Sub(svid.Leaf.NotBefore); lifetime != time.Hour {
+		t.Errorf("expected SVID lifetime of 1h, got %s", lifetime)
+	}
+
+	certRes, err := cfg.loadCertResource(ctx, iss, spiffeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta SPIFFEMetadata
+	if err := json.Unmarshal(certRes.IssuerData, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.ID != spiffeID || !strings.Contains(meta.BundlePEM, "BEGIN CERTIFICATE") {
+		t.Errorf("expected SVID metadata with trust bundle, got %+v", meta)
+	}
+
+	// renewals get the rotated SVID, with its new key
+	if err := cfg.RenewCertSync(ctx, spiffeID, true); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := cfg.reloadManagedCertificate(ctx, svid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.hash == svid.hash {
+		t.Error("expected rotated SVID")
+	}
+	if renewed.Leaf.PublicKey.(*ecdsa.PublicKey).Equal(svid.Leaf.PublicKey) {
+		t.Error("expected rotated SVID to have a new key")
+	}
+}
@@ -16,6 +16,7 @@ package certmagic
 
 import (
 	"context"
+	"net/url"
 	"path"
 	"regexp"
 	"strings"
@@ -197,13 +198,13 @@ func (keys KeyBuilder) CertsPrefix(issuerKey string) string {
 // CertsSitePrefix returns a key prefix for items associated with
 // the site given by domain using the given issuer key.
 func (keys KeyBuilder) CertsSitePrefix(issuerKey, domain string) string {
-	return path.Join(keys.CertsPrefix(issuerKey), keys.Safe(domain))
+	return path.Join(keys.CertsPrefix(issuerKey), keys.safeSite(domain))
 }
 
 // SiteCert returns the path to the certificate file for domain
 // that is associated with the issuer with the given issuerKey.
 func (keys KeyBuilder) SiteCert(issuerKey, domain string) string {
-	safeDomain := keys.Safe(domain)
+	safeDomain := keys.safeSite(domain)
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".crt")
 }
 
@@ -211,7 +212,7 @@ func (keys KeyBuilder) SiteCert(issuerKey, domain string) string {
 // that is associated with the certificate from the given issuer with
 // the given issuerKey.
 func (keys KeyBuilder) SitePrivateKey(issuerKey, domain string) string {
-	safeDomain := keys.Safe(domain)
+	safeDomain := keys.safeSite(domain)
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".key")
 }
 
@@ -219,7 +220,7 @@ func (keys KeyBuilder) SitePrivateKey(issuerKey, domain string) string {
 // is associated with the certificate from the given issuer with
 // the given issuerKey.
 func (keys KeyBuilder) SiteMeta(issuerKey, domain string) string {
-	safeDomain := keys.Safe(domain)
+	safeDomain := keys.safeSite(domain)
 	return path.Join(keys.CertsSitePrefix(issuerKey, domain), safeDomain+".json")
 }
 
@@ -229,13 +230,38 @@ func (keys KeyBuilder) SiteMeta(issuerKey, domain string) string {
 func (keys KeyBuilder) OCSPStaple(cert *Certificate, pemBundle []byte) string {
 	var ocspFileName string
 	if len(cert.Names) > 0 {
-		firstName := keys.Safe(cert.Names[0])
+		firstName := keys.safeSite(cert.Names[0])
 		ocspFileName = firstName + "-"
 	}
 	ocspFileName += fastHash(pemBundle)
 	return path.Join(prefixOCSP, ocspFileName)
 }
 
+// CRL returns a key for the CRL downloaded from
+// the given distribution point URL.
+func (keys KeyBuilder) CRL(distributionPoint string) string {
+	var crlFileName string
+	if u, err := url.Parse(distributionPoint); err == nil && u.Host != "" {
+		crlFileName = keys.Safe(u.Hostname()) + "-"
+	}
+	crlFileName += fastHash([]byte(distributionPoint)) + ".crl"
+	return path.Join(prefixCRLs, crlFileName)
+}
+
+// safeSite is like Safe, but for the names of sites (subjects or
+// NamesKeys): if they have URIs or otherNames, the result is made
+// unique, since sanitizing them can make distinct names equal.
+func (keys KeyBuilder) safeSite(domain string) string {
+	if strings.Contains(domain, ":") {
+		for _, name := range strings.Split(domain, ",") {
+			if subjectIsIdentity(name) {
+				return safeIdentityKey(keys, domain)
+			}
+		}
+	}
+	return keys.Safe(domain)
+}
+
 // Safe standardizes and sanitizes str for use as
 // a single component of a storage key. This method
 // is idempotent.
@@ -314,6 +340,8 @@ var StorageKeys KeyBuilder
 const (
 	prefixCerts = "certificates"
 	prefixOCSP  = "ocsp"
+	prefixCRLs  = "crls"
+	prefixLocks = "locks" // used by FileStorage
 )
 
 // safeKeyRE matches any undesirable characters in storage keys.
@@ -0,0 +1,273 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// EnvelopeKey encrypts and decrypts data keys, for envelope
+// encryption with StorageEncryption. It is typically implemented
+// with a key management service (KMS) such as AWS KMS, Google Cloud
+// KMS, Azure Key Vault, or HashiCorp Vault's transit engine, which
+// certmagic does not depend on, so that the key that protects the
+// data keys never leaves the service.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type EnvelopeKey interface {
+	// WrapKey encrypts a data key.
+	WrapKey(ctx context.Context, key []byte) ([]byte, error)
+
+	// UnwrapKey decrypts a data key encrypted by WrapKey.
+	UnwrapKey(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// StorageEncryption is a Storage that encrypts private keys before
+// they are stored in the wrapped Storage, so that they are not stored
+// in plaintext by shared backends such as object stores. Optionally,
+// it encrypts all values.
+//
+// Values are encrypted with AES-256-GCM, bound to their storage key.
+// The encryption key is either derived from a passphrase with scrypt,
+// or a random data key that is encrypted with an EnvelopeKey and
+// stored with each value; each instance uses a single data key for
+// its lifetime, so the EnvelopeKey is only used once per instance,
+// and once per data key to load values.
+//
+// Values that are not encrypted, such as private keys stored before
+// the encryption was enabled, are loaded as they are, and encrypted
+// the next time they are stored. Listing, locking, and Stat work as
+// before, except that sizes are those of the encrypted values.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type StorageEncryption struct {
+	// The storage for the encrypted values. Required.
+	Storage
+
+	// The passphrase from which the encryption
+	// key is derived. Either Passphrase or
+	// EnvelopeKey is required.
+	Passphrase string
+
+	// The key that encrypts the data keys, for
+	// envelope encryption. If set, Passphrase is
+	// not used for new values, but still for
+	// loading values encrypted with it.
+	EnvelopeKey EnvelopeKey
+
+	// If true, all values are encrypted, not
+	// only private keys.
+	EncryptAll bool
+
+	mu      sync.Mutex
+	sealer  *storageSealer
+	openers map[string]cipher.AEAD
+}
+
+// storageSealer is the key with which values are encrypted.
+type storageSealer struct {
+	mode    byte
+	keyInfo []byte // salt or wrapped data key
+	aead    cipher.AEAD
+}
+
+// storageEncryptionMagic starts each encrypted value.
+var storageEncryptionMagic = []byte("certmagic-encrypted\x00")
+
+// How the encryption key of a value was obtained.
+const (
+	storageEncryptionPassphrase byte = 1
+	storageEncryptionEnvelope   byte = 2
+)
+
+// storageEncryptionScryptN is the scrypt cost parameter for deriving
+// keys from passphrases. The cost is only paid once per salt, since
+// derived keys are remembered.
+var storageEncryptionScryptN = 1 << 15
+
+// Store implements Storage.
+func (se *StorageEncryption) Store(ctx context.Context, key string, value []byte) error {
+	if !se.EncryptAll && !isPrivateKeyStorageKey(key) {
+		return se.Storage.Store(ctx, key, value)
+	}
+	sealer, err := se.getSealer(ctx)
+	if err != nil {
+		return fmt.Errorf("encrypting %s: %v", key, err)
+	}
+	nonce := make([]byte, sealer.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("encrypting %s: %v", key, err)
+	}
+	var buf bytes.Buffer
+	buf.Write(storageEncryptionMagic)
+	buf.WriteByte(sealer.mode)
+	buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(sealer.keyInfo))))
+	buf.Write(sealer.keyInfo)
+	buf.Write(nonce)
+	return se.Storage.Store(ctx, key, sealer.aead.Seal(buf.Bytes(), nonce, value, []byte(key)))
+}
+
+// Load implements Storage.
+func (se *StorageEncryption) Load(ctx context.Context, key string) ([]byte, error) {
+	value, err := se.Storage.Load(ctx, key)
+	if err != nil || !bytes.HasPrefix(value, storageEncryptionMagic) {
+		return value, err
+	}
+	rest := value[len(storageEncryptionMagic):]
+	if len(rest) < 3 {
+		return nil, fmt.Errorf("decrypting %s: truncated header", key)
+	}
+	mode, infoLen := rest[0], int(binary.BigEndian.Uint16(rest[1:3]))
+	rest = rest[3:]
+	if len(rest) < infoLen {
+		return nil, fmt.Errorf("decrypting %s: truncated header", key)
+	}
+	keyInfo, rest := rest[:infoLen], rest[infoLen:]
+	aead, err := se.getOpener(ctx, mode, keyInfo)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", key, err)
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("decrypting %s: truncated header", key)
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %s: %v", key, err)
+	}
+	return plaintext, nil
+}
+
+// getSealer returns the key for encrypting values,
+// creating it on first use.
+func (se *StorageEncryption) getSealer(ctx context.Context) (*storageSealer, error) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if se.sealer != nil {
+		return se.sealer, nil
+	}
+	var sealer storageSealer
+	var key []byte
+	switch {
+	case se.EnvelopeKey != nil:
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		wrapped, err := se.EnvelopeKey.WrapKey(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("wrapping data key: %v", err)
+		}
+		sealer.mode, sealer.keyInfo = storageEncryptionEnvelope, wrapped
+	case se.Passphrase != "":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		var err error
+		key, err = se.deriveKey(salt)
+		if err != nil {
+			return nil, err
+		}
+		sealer.mode, sealer.keyInfo = storageEncryptionPassphrase, salt
+	default:
+		return nil, fmt.Errorf("no passphrase or envelope key configured")
+	}
+	aead, err := newStorageAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	sealer.aead = aead
+	se.sealer = &sealer
+	se.rememberOpener(sealer.mode, sealer.keyInfo, aead)
+	return se.sealer, nil
+}
+
+// getOpener returns the key for decrypting values that were
+// encrypted in the given mode with the given key information.
+func (se *StorageEncryption) getOpener(ctx context.Context, mode byte, keyInfo []byte) (cipher.AEAD, error) {
+	se.mu.Lock()
+	defer se.mu.Unlock()
+	if aead, ok := se.openers[string(mode)+string(keyInfo)]; ok {
+		return aead, nil
+	}
+	var key []byte
+	switch mode {
+	case storageEncryptionEnvelope:
+		if se.EnvelopeKey == nil {
+			return nil, fmt.Errorf("value was encrypted with an envelope key, but none is configured")
+		}
+		var err error
+		key, err = se.EnvelopeKey.UnwrapKey(ctx, keyInfo)
+		if err != nil {
+			return nil, fmt.Errorf("unwrapping data key: %v", err)
+		}
+	case storageEncryptionPassphrase:
+		if se.Passphrase == "" {
+			return nil, fmt.Errorf("value was encrypted with a passphrase, but none is configured")
+		}
+		var err error
+		key, err = se.deriveKey(keyInfo)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown encryption mode %d", mode)
+	}
+	aead, err := newStorageAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	se.rememberOpener(mode, keyInfo, aead)
+	return aead, nil
+}
+
+// rememberOpener caches aead for decrypting values. se.mu must be locked.
+func (se *StorageEncryption) rememberOpener(mode byte, keyInfo []byte, aead cipher.AEAD) {
+	if se.openers == nil {
+		se.openers = make(map[string]cipher.AEAD)
+	}
+	se.openers[string(mode)+string(keyInfo)] = aead
+}
+
+func (se *StorageEncryption) deriveKey(salt []byte) ([]byte, error) {
+	key, err := scrypt.Key([]byte(se.Passphrase), salt, storageEncryptionScryptN, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("deriving key from passphrase: %v", err)
+	}
+	return key, nil
+}
+
+func newStorageAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("data key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Interface guard
+var _ Storage = (*StorageEncryption)(nil)
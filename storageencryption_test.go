@@ -0,0 +1,168 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"sync/atomic"
+	"testing"
+)
+
+// testEnvelopeKey wraps data keys with AES-GCM,
+// and counts how often it is used.
+type testEnvelopeKey struct {
+	aead           cipher.AEAD
+	wraps, unwraps atomic.Int32
+}
+
+func newTestEnvelopeKey(t *testing.T) *testEnvelopeKey {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testEnvelopeKey{aead: aead}
+}
+
+func (ek *testEnvelopeKey) WrapKey(_ context.Context, key []byte) ([]byte, error) {
+	ek.wraps.Add(1)
+	nonce := make([]byte, ek.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return ek.aead.Seal(nonce, nonce, key, nil), nil
+}
+
+func (ek *testEnvelopeKey) UnwrapKey(_ context.Context, wrapped []byte) ([]byte, error) {
+	ek.unwraps.Add(1)
+	if len(wrapped) < ek.aead.NonceSize() {
+		return nil, fmt.Errorf("invalid wrapped key")
+	}
+	return ek.aead.Open(nil, wrapped[:ek.aead.NonceSize()], wrapped[ek.aead.NonceSize():], nil)
+}
+
+func TestStorageEncryptionPassphrase(t *testing.T) {
+	defer func(n int) { storageEncryptionScryptN = n }(storageEncryptionScryptN)
+	storageEncryptionScryptN = 1 << 10
+
+	ctx := context.Background()
+	underlying := &FileStorage{Path: t.TempDir()}
+	se := &StorageEncryption{Storage: underlying, Passphrase: "correct horse battery staple"}
+
+	keyKey := StorageKeys.SitePrivateKey("fake", "example.com")
+	certKey := StorageKeys.SiteCert("fake", "example.com")
+	if err := se.Store(ctx, keyKey, []byte("private key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := se.Store(ctx, certKey, []byte("certificate")); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := underlying.Load(ctx, keyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, storageEncryptionMagic) || bytes.Contains(stored, []byte("private key")) {
+		t.Errorf("expected encrypted private key in underlying storage, got %q", stored)
+	}
+	if stored, _ := underlying.Load(ctx, certKey); string(stored) != "certificate" {
+		t.Errorf("expected plaintext certificate in underlying storage, got %q", stored)
+	}
+	if value, err := se.Load(ctx, keyKey); err != nil || string(value) != "private key" {
+		t.Errorf("expected decrypted private key, got %q (err=%v)", value, err)
+	}
+
+	// another instance with the same passphrase can decrypt it
+	other := &StorageEncryption{Storage: underlying, Passphrase: "correct horse battery staple"}
+	if value, err := other.Load(ctx, keyKey); err != nil || string(value) != "private key" {
+		t.Errorf("expected decrypted private key with same passphrase, got %q (err=%v)", value, err)
+	}
+	wrong := &StorageEncryption{Storage: underlying, Passphrase: "wrong"}
+	if _, err := wrong.Load(ctx, keyKey); err == nil {
+		t.Error("expected error decrypting with wrong passphrase")
+	}
+
+	// encrypted values cannot be moved to other keys
+	otherKey := StorageKeys.SitePrivateKey("fake", "example.net")
+	if err := underlying.Store(ctx, otherKey, stored); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := se.Load(ctx, otherKey); err == nil {
+		t.Error("expected error decrypting value stored under another key")
+	}
+
+	// values stored before encryption was enabled still load
+	oldKey := StorageKeys.SitePrivateKey("fake", "old.example.com")
+	if err := underlying.Store(ctx, oldKey, []byte("old private key")); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := se.Load(ctx, oldKey); err != nil || string(value) != "old private key" {
+		t.Errorf("expected plaintext private key, got %q (err=%v)", value, err)
+	}
+
+	if err := (&StorageEncryption{Storage: underlying}).Store(ctx, keyKey, []byte("private key")); err == nil {
+		t.Error("expected error storing without passphrase or envelope key")
+	}
+}
+
+func TestStorageEncryptionEnvelope(t *testing.T) {
+	ctx := context.Background()
+	underlying := &FileStorage{Path: t.TempDir()}
+	ek := newTestEnvelopeKey(t)
+	se := &StorageEncryption{Storage: underlying, EnvelopeKey: ek, EncryptAll: true}
+
+	keys := []string{
+		StorageKeys.SitePrivateKey("fake", "example.com"),
+		StorageKeys.SiteCert("fake", "example.com"),
+		StorageKeys.SiteMeta("fake", "example.com"),
+	}
+	for _, key := range keys {
+		if err := se.Store(ctx, key, []byte("value of "+key)); err != nil {
+			t.Fatal(err)
+		}
+		if stored, _ := underlying.Load(ctx, key); !bytes.HasPrefix(stored, storageEncryptionMagic) {
+			t.Errorf("expected %s to be encrypted, got %q", key, stored)
+		}
+	}
+	if n := ek.wraps.Load(); n != 1 {
+		t.Errorf("expected data key to be wrapped once, got %d", n)
+	}
+
+	other := &StorageEncryption{Storage: underlying, EnvelopeKey: ek}
+	for _, key := range keys {
+		if value, err := other.Load(ctx, key); err != nil || string(value) != "value of "+key {
+			t.Errorf("expected decrypted value of %s, got %q (err=%v)", key, value, err)
+		}
+	}
+	if n := ek.unwraps.Load(); n != 1 {
+		t.Errorf("expected data key to be unwrapped once, got %d", n)
+	}
+
+	if _, err := (&StorageEncryption{Storage: underlying, Passphrase: "passphrase"}).Load(ctx, keys[0]); err == nil {
+		t.Error("expected error decrypting without envelope key")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// StorageUsage is how much of a Storage is used, by category.
+// Private keys are counted as PrivateKeys wherever they are
+// stored, including the private keys of ACME accounts.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type StorageUsage struct {
+	Certificates StorageCategoryUsage // certificates and their metadata, including previous versions
+	PrivateKeys  StorageCategoryUsage
+	OCSPStaples  StorageCategoryUsage
+	CRLs         StorageCategoryUsage
+	Accounts     StorageCategoryUsage // ACME accounts
+	Locks        StorageCategoryUsage
+	Other        StorageCategoryUsage
+}
+
+// StorageCategoryUsage is the usage of a category of assets in storage.
+type StorageCategoryUsage struct {
+	Keys  int
+	Bytes int64
+}
+
+func (u *StorageCategoryUsage) add(info KeyInfo) {
+	u.Keys++
+	u.Bytes += info.Size
+}
+
+// Total returns the usage of all categories together.
+func (su StorageUsage) Total() StorageCategoryUsage {
+	var total StorageCategoryUsage
+	for _, u := range []StorageCategoryUsage{su.Certificates, su.PrivateKeys, su.OCSPStaples, su.CRLs, su.Accounts, su.Locks, su.Other} {
+		total.Keys += u.Keys
+		total.Bytes += u.Bytes
+	}
+	return total
+}
+
+// category returns the usage of the category of the asset at key.
+func (su *StorageUsage) category(key string) *StorageCategoryUsage {
+	switch {
+	case strings.HasPrefix(key, prefixLocks+"/"):
+		return &su.Locks
+	case isPrivateKeyStorageKey(key):
+		return &su.PrivateKeys
+	case strings.HasPrefix(key, prefixCerts+"/"), strings.HasPrefix(key, prefixCertHistory+"/"):
+		return &su.Certificates
+	case strings.HasPrefix(key, prefixOCSP+"/"):
+		return &su.OCSPStaples
+	case strings.HasPrefix(key, prefixCRLs+"/"):
+		return &su.CRLs
+	case strings.HasPrefix(key, prefixACME+"/"):
+		return &su.Accounts
+	default:
+		return &su.Other
+	}
+}
+
+// ReportStorageUsage lists all keys in storage and returns how much of it
+// is used, by category. This can be slow for large storage backends, since
+// every key is stat'ed. Locks are only counted if they are kept in the key
+// space of the storage, as with FileStorage.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func ReportStorageUsage(ctx context.Context, storage Storage) (StorageUsage, error) {
+	var usage StorageUsage
+	keys, err := storage.List(ctx, "", true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return usage, nil
+	}
+	if err != nil {
+		return usage, fmt.Errorf("listing storage: %w", err)
+	}
+	for _, key := range keys {
+		info, err := storage.Stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return usage, fmt.Errorf("stat %s: %w", key, err)
+		}
+		if !info.IsTerminal {
+			continue
+		}
+		usage.category(key).add(info)
+	}
+	return usage, nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReportStorageUsage(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	usage, err := ReportStorageUsage(ctx, &FileStorage{Path: t.TempDir() + "/missing"})
+	if err != nil || usage.Total().Keys != 0 {
+		t.Errorf("expected empty usage for missing storage, got %+v (err=%v)", usage, err)
+	}
+
+	for key, value := range map[string]string{
+		StorageKeys.SiteCert("ca", "example.com"):       "cert",
+		StorageKeys.SiteMeta("ca", "example.com"):       "{}",
+		StorageKeys.SitePrivateKey("ca", "example.com"): "key",
+		"ocsp/example.com-1234":                         "staple",
+		"acme/ca/users/me@example.com/me.json":          "account",
+		"acme/ca/users/me@example.com/me.key":           "account key",
+		"last_clean.json":                               "{}",
+	} {
+		if err := storage.Store(ctx, key, []byte(value)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Lock(ctx, "test"); err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Unlock(ctx, "test")
+
+	usage, err = ReportStorageUsage(ctx, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		usage  StorageCategoryUsage
+		expect StorageCategoryUsage
+	}{
+		{"certificates", usage.Certificates, StorageCategoryUsage{Keys: 2, Bytes: 6}},
+		{"private keys", usage.PrivateKeys, StorageCategoryUsage{Keys: 2, Bytes: 14}},
+		{"OCSP staples", usage.OCSPStaples, StorageCategoryUsage{Keys: 1, Bytes: 6}},
+		{"accounts", usage.Accounts, StorageCategoryUsage{Keys: 1, Bytes: 7}},
+		{"other", usage.Other, StorageCategoryUsage{Keys: 1, Bytes: 2}},
+	} {
+		if tc.usage != tc.expect {
+			t.Errorf("expected %s usage %+v, got %+v", tc.name, tc.expect, tc.usage)
+		}
+	}
+	if usage.Locks.Keys != 1 || usage.Locks.Bytes == 0 {
+		t.Errorf("expected 1 lock, got %+v", usage.Locks)
+	}
+	if total := usage.Total(); total.Keys != 8 {
+		t.Errorf("expected 8 keys in total, got %d", total.Keys)
+	}
+}
+
+func TestCleanStorageCompaction(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	orphanKey := StorageKeys.SitePrivateKey("ca", "orphan.example.com")
+	orphanMeta := StorageKeys.SiteMeta("ca", "orphan.example.com")
+	keptKey := StorageKeys.SitePrivateKey("ca", "example.com")
+	for _, key := range []string{orphanKey, orphanMeta, keptKey, StorageKeys.SiteCert("ca", "example.com")} {
+		if err := storage.Store(ctx, key, []byte("asset")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Store(ctx, "locks/crashed.lock", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := CleanStorageOptions{Logger: defaultTestLogger, StaleLocks: true, OrphanedAssets: true}
+
+	// nothing is old enough yet
+	if err := CleanStorage(ctx, storage, opts); err != nil {
+		t.Fatal(err)
+	}
+	if !storage.Exists(ctx, orphanKey) || !storage.Exists(ctx, "locks/crashed.lock") {
+		t.Fatal("expected recent assets to be retained")
+	}
+
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+	faults.set(DefaultOrphanedAssetAge+time.Hour, false)
+
+	if err := CleanStorage(ctx, storage, opts); err != nil {
+		t.Fatal(err)
+	}
+	if storage.Exists(ctx, "locks/crashed.lock") {
+		t.Error("expected stale lock to be deleted")
+	}
+	if storage.Exists(ctx, StorageKeys.CertsSitePrefix("ca", "orphan.example.com")) {
+		t.Error("expected orphaned assets and their folder to be deleted")
+	}
+	if !storage.Exists(ctx, keptKey) {
+		t.Error("expected private key of existing certificate to be retained")
+	}
+}
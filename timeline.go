@@ -0,0 +1,274 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// TimelineEvent is an event in the lifecycle of a certificate;
+// see Config.CertificateTimeline.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TimelineEvent struct {
+	// When the event happened, or will happen.
+	Time time.Time `json:"time"`
+
+	Kind TimelineEventKind `json:"kind"`
+
+	// The key of the issuer of the certificate, if any.
+	IssuerKey string `json:"issuer_key,omitempty"`
+
+	// The serial number of the certificate, in hex, if known.
+	Serial string `json:"serial,omitempty"`
+
+	// Details of the event, such as an error message.
+	Detail string `json:"detail,omitempty"`
+
+	// The storage key the event was derived from, if any.
+	StorageKey string `json:"storage_key,omitempty"`
+}
+
+// TimelineEventKind is the kind of a TimelineEvent.
+type TimelineEventKind string
+
+// Kinds of timeline events.
+const (
+	// The first known certificate was issued (its NotBefore time).
+	TimelineIssued TimelineEventKind = "issued"
+
+	// A certificate replaced a previous one (its NotBefore time).
+	TimelineRenewed TimelineEventKind = "renewed"
+
+	// The current certificate was written to storage, such as
+	// after issuance or a rollback.
+	TimelineStored TimelineEventKind = "stored"
+
+	// The metadata of the current certificate, such as its ARI,
+	// was updated after the certificate was stored.
+	TimelineMetadataUpdated TimelineEventKind = "metadata_updated"
+
+	// An OCSP response for the current certificate was stored.
+	TimelineOCSPStapled TimelineEventKind = "ocsp_stapled"
+
+	// The most recent attempt of a persisted obtain or renew job
+	// failed (see Config.Jobs).
+	TimelineFailed TimelineEventKind = "failed"
+
+	// The current certificate expires.
+	TimelineExpires TimelineEventKind = "expires"
+)
+
+// CertificateTimeline returns the events in the lifecycle of the
+// certificate for name, oldest first, as far as they can be
+// reconstructed from storage: the issuance of the current and previous
+// versions of the certificate (see Config.CertificateHistory) across all
+// of cfg's issuers, when the certificate, its metadata, and its OCSP
+// staple were last stored, and failed obtain and renew jobs. It is meant
+// to help with investigations, such as why a certificate changed at an
+// unexpected time; since only the latest state is kept in storage, the
+// timeline is not complete. Storage modification times are only included
+// if the storage reports them.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) CertificateTimeline(ctx context.Context, name string) ([]TimelineEvent, error) {
+	name = normalizedName(name)
+	var events, issuances []TimelineEvent
+
+	versions, err := cfg.CertificateVersions(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		issuances = append(issuances, TimelineEvent{
+			Time:      version.NotBefore,
+			IssuerKey: version.IssuerKey,
+			Detail:    "previous version " + version.ID,
+		})
+	}
+
+	for _, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		certRes, err := cfg.loadCertResource(ctx, issuer, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading certificate from issuer %s: %v", issuerKey, err)
+		}
+		current, err := timelineCertificate(certRes.CertificatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("decoding certificate from issuer %s: %v", issuerKey, err)
+		}
+		serial := current.Leaf.SerialNumber.Text(16)
+		issuances = append(issuances, TimelineEvent{
+			Time:      current.Leaf.NotBefore,
+			IssuerKey: issuerKey,
+			Serial:    serial,
+			Detail:    "current version",
+		})
+		events = append(events, TimelineEvent{
+			Time:      expiresAt(current.Leaf),
+			Kind:      TimelineExpires,
+			IssuerKey: issuerKey,
+			Serial:    serial,
+		})
+
+		certKey := StorageKeys.SiteCert(issuerKey, name)
+		certInfo, err := cfg.Storage.Stat(ctx, certKey)
+		if err == nil && !certInfo.Modified.IsZero() {
+			events = append(events, TimelineEvent{
+				Time:       certInfo.Modified,
+				Kind:       TimelineStored,
+				IssuerKey:  issuerKey,
+				Serial:     serial,
+				StorageKey: certKey,
+			})
+		}
+		metaKey := StorageKeys.SiteMeta(issuerKey, name)
+		metaInfo, err := cfg.Storage.Stat(ctx, metaKey)
+		if err == nil && metaInfo.Modified.After(certInfo.Modified.Add(time.Second)) {
+			events = append(events, TimelineEvent{
+				Time:       metaInfo.Modified,
+				Kind:       TimelineMetadataUpdated,
+				IssuerKey:  issuerKey,
+				Serial:     serial,
+				StorageKey: metaKey,
+			})
+		}
+
+		stapleKey := StorageKeys.OCSPStaple(&current, certRes.CertificatePEM)
+		stapleInfo, err := cfg.Storage.Stat(ctx, stapleKey)
+		if err == nil && !stapleInfo.Modified.IsZero() {
+			event := TimelineEvent{
+				Time:       stapleInfo.Modified,
+				Kind:       TimelineOCSPStapled,
+				IssuerKey:  issuerKey,
+				Serial:     serial,
+				StorageKey: stapleKey,
+			}
+			if stapleBytes, err := cfg.Storage.Load(ctx, stapleKey); err == nil {
+				if resp, err := ocsp.ParseResponse(stapleBytes, nil); err == nil {
+					event.Detail = "status: " + ocspStatusText(resp.Status)
+				}
+			}
+			events = append(events, event)
+		}
+	}
+
+	// the oldest issuance is the first one we know of; the others renewed it
+	sort.SliceStable(issuances, func(i, j int) bool {
+		return issuances[i].Time.Before(issuances[j].Time)
+	})
+	for i := range issuances {
+		issuances[i].Kind = TimelineRenewed
+		if i == 0 {
+			issuances[i].Kind = TimelineIssued
+		} else if prev := issuances[i-1].IssuerKey; prev != issuances[i].IssuerKey {
+			issuances[i].Detail += fmt.Sprintf("; issuer changed from %s", prev)
+		}
+	}
+	events = append(events, issuances...)
+
+	jobs, err := cfg.Jobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading jobs: %v", err)
+	}
+	for _, job := range jobs {
+		if normalizedName(job.Identifier) != name || job.LastError == "" {
+			continue
+		}
+		events = append(events, TimelineEvent{
+			Time:       job.Updated,
+			Kind:       TimelineFailed,
+			Detail:     fmt.Sprintf("%s attempt %d (%s): %s", job.Kind, job.Attempts, job.Status, job.LastError),
+			StorageKey: StorageKeys.Job(job.ID),
+		})
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	return events, nil
+}
+
+// timelineCertificate decodes the certificate chain in certPEM
+// without its private key, which is not needed for the timeline.
+func timelineCertificate(certPEM []byte) (Certificate, error) {
+	certs, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return Certificate{}, err
+	}
+	var tlsCert tls.Certificate
+	for _, cert := range certs {
+		tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+	}
+	tlsCert.Leaf = certs[0]
+	var cert Certificate
+	if err := fillCertFromLeaf(&cert, tlsCert); err != nil {
+		return Certificate{}, err
+	}
+	return cert, nil
+}
+
+func ocspStatusText(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	case ocsp.ServerFailed:
+		return "server failed"
+	default:
+		return "unknown"
+	}
+}
+
+// TimelineHandler returns an HTTP handler that responds with the
+// CertificateTimeline of the name in the "name" query parameter,
+// in JSON. It exposes details of certificates and their failures,
+// so it should only be served to operators.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cfg *Config) TimelineHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			http.Error(w, "missing name query parameter", http.StatusBadRequest)
+			return
+		}
+		events, err := cfg.CertificateTimeline(r.Context(), name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if events == nil {
+			events = []TimelineEvent{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(events)
+	})
+}
@@ -0,0 +1,108 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCertificateTimeline(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cfg.OnDemand = nil
+	cfg.CertificateHistory = 5
+
+	const name = "example.com"
+	if err := cfg.ObtainCertSync(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := cfg.RenewCertSync(ctx, name, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failedJob, _ := json.Marshal(JobInfo{
+		ID:         "renew_" + name,
+		Kind:       "renew",
+		Identifier: name,
+		Status:     JobRetrying,
+		Attempts:   3,
+		LastError:  "rate limited",
+		Updated:    time.Now().Add(time.Hour),
+	})
+	if err := cfg.Storage.Store(ctx, StorageKeys.Job("renew_"+name), failedJob); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := cfg.CertificateTimeline(ctx, "Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[TimelineEventKind]int)
+	for i, event := range events {
+		counts[event.Kind]++
+		if i > 0 && event.Time.Before(events[i-1].Time) {
+			t.Errorf("event %d is out of order: %+v", i, event)
+		}
+	}
+	for kind, expect := range map[TimelineEventKind]int{
+		TimelineIssued:  1,
+		TimelineRenewed: 2,
+		TimelineStored:  1,
+		TimelineFailed:  1,
+		TimelineExpires: 1,
+	} {
+		if counts[kind] != expect {
+			t.Errorf("expected %d %s events, got %d: %+v", expect, kind, counts[kind], events)
+		}
+	}
+	if last := events[len(events)-1]; last.Kind != TimelineExpires {
+		t.Errorf("expected expiration last, got %+v", last)
+	}
+	for _, event := range events {
+		if event.Kind == TimelineFailed && !strings.Contains(event.Detail, "rate limited") {
+			t.Errorf("expected job error in failure detail, got %q", event.Detail)
+		}
+	}
+
+	events, err = cfg.CertificateTimeline(ctx, "unknown.example.com")
+	if err != nil || len(events) != 0 {
+		t.Errorf("expected no events for unknown name, got %+v (err=%v)", events, err)
+	}
+}
+
+func TestTimelineHandler(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	handler := cfg.TimelineHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/timeline", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d without name, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/timeline?name=example.com", nil))
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("expected empty timeline, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+	"go.uber.org/zap"
+)
+
+// ExternalTLSALPNSolver solves the tls-alpn-01 challenge (RFC 8737) by
+// handing the challenge certificate to another process that terminates
+// TLS for the names, for deployments where certmagic runs in a sidecar
+// or agent that does not own the port that the CA connects to. The
+// other process serves the certificate with a TLSALPNChallengeReceiver.
+// It is used with ACMEIssuer.TLSALPN01Solver.
+//
+// The certificate is sent in an HTTP request to the receiver, which is
+// signed with Secret like the requests of WebhookIssuer. Since anyone
+// who can send requests to the receiver can solve challenges for its
+// names, the receiver should listen on a UNIX socket that is only
+// accessible to the sidecar, or Secret should be set.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type ExternalTLSALPNSolver struct {
+	// The address of the receiver: "unix:PATH" for a
+	// UNIX domain socket at PATH, or an HTTP(S) URL.
+	// REQUIRED.
+	Address string
+
+	// The secret shared with the receiver to sign
+	// requests with. Required unless the receiver
+	// has no secret.
+	Secret []byte
+
+	// How long to wait for the receiver to respond.
+	// Default: 10 seconds.
+	Timeout time.Duration
+}
+
+// tlsALPNChallengeMessage is sent by ExternalTLSALPNSolver
+// to TLSALPNChallengeReceiver.
+type tlsALPNChallengeMessage struct {
+	// "present" or "clean_up"
+	Action string `json:"action"`
+
+	// the key of the challenge (see challengeKey)
+	Identifier string `json:"identifier"`
+
+	// the PEM-encoded challenge certificate and
+	// its private key, for presenting only
+	Certificate string `json:"certificate,omitempty"`
+	PrivateKey  string `json:"private_key,omitempty"`
+}
+
+// Present implements acmez.Solver by sending the challenge certificate
+// to the receiver.
+func (s *ExternalTLSALPNSolver) Present(ctx context.Context, chal acme.Challenge) error {
+	cert, err := tlsALPNChallengeCert(chal)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := PEMEncodePrivateKey(cert.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("encoding challenge certificate key: %v", err)
+	}
+	var certPEM bytes.Buffer
+	for _, der := range cert.Certificate {
+		pem.Encode(&certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	}
+	return s.send(ctx, tlsALPNChallengeMessage{
+		Action:      "present",
+		Identifier:  challengeKey(chal),
+		Certificate: certPEM.String(),
+		PrivateKey:  string(keyPEM),
+	})
+}
+
+// CleanUp implements acmez.Solver by telling the receiver
+// to stop serving the challenge certificate.
+func (s *ExternalTLSALPNSolver) CleanUp(ctx context.Context, chal acme.Challenge) error {
+	return s.send(ctx, tlsALPNChallengeMessage{
+		Action:     "clean_up",
+		Identifier: challengeKey(chal),
+	})
+}
+
+func (s *ExternalTLSALPNSolver) send(ctx context.Context, msg tlsALPNChallengeMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	endpoint := s.Address
+	if socketPath, ok := strings.CutPrefix(s.Address, "unix:"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		endpoint = "http://localhost/"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.Secret) > 0 {
+		timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, webhookSignature(s.Secret, timestamp, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending tls-alpn-01 challenge %s to %s: %w", msg.Action, s.Address, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sending tls-alpn-01 challenge %s to %s: unexpected HTTP status %s: %s",
+			msg.Action, s.Address, resp.Status, bytes.TrimSpace(respBody))
+	}
+	return nil
+}
+
+// TLSALPNChallengeReceiver receives tls-alpn-01 challenge certificates
+// from an ExternalTLSALPNSolver in another process, and serves them in
+// TLS handshakes of the process that owns the port that the CA connects
+// to. It is an http.Handler for the solver's requests; for example, to
+// receive them on a UNIX socket:
+//
+//	ln, err := certmagic.ListenAddress("unix:/run/acme-tls.sock")
+//	...
+//	go http.Serve(ln, receiver)
+//
+// To serve the challenge certificates, call GetCertificate first in the
+// GetCertificate callback of the TLS config, and add "acme-tls/1" to its
+// NextProtos.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TLSALPNChallengeReceiver struct {
+	// The secret shared with the solver to verify
+	// requests with. If empty, requests are not
+	// verified, which is only safe if no untrusted
+	// process can make requests to the receiver.
+	Secret []byte
+
+	Logger *zap.Logger
+
+	mu    sync.RWMutex
+	certs map[string]*tls.Certificate
+}
+
+// ServeHTTP implements http.Handler.
+func (rcv *TLSALPNChallengeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rcv.Secret) > 0 {
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || timeNow().Sub(time.Unix(unix, 0)).Abs() > 5*time.Minute {
+			http.Error(w, "missing or stale timestamp", http.StatusUnauthorized)
+			return
+		}
+		expected := webhookSignature(rcv.Secret, timestamp, body)
+		if !hmac.Equal([]byte(r.Header.Get(webhookSignatureHeader)), []byte(expected)) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var msg tlsALPNChallengeMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	identifier := strings.ToLower(msg.Identifier)
+	if identifier == "" {
+		http.Error(w, "missing identifier", http.StatusBadRequest)
+		return
+	}
+
+	switch msg.Action {
+	case "present":
+		cert, err := tls.X509KeyPair([]byte(msg.Certificate), []byte(msg.PrivateKey))
+		if err != nil {
+			http.Error(w, "invalid challenge certificate: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rcv.mu.Lock()
+		if rcv.certs == nil {
+			rcv.certs = make(map[string]*tls.Certificate)
+		}
+		rcv.certs[identifier] = &cert
+		rcv.mu.Unlock()
+	case "clean_up":
+		rcv.mu.Lock()
+		delete(rcv.certs, identifier)
+		rcv.mu.Unlock()
+	default:
+		http.Error(w, "unknown action: "+msg.Action, http.StatusBadRequest)
+		return
+	}
+	rcv.logger().Info("received tls-alpn-01 challenge",
+		zap.String("action", msg.Action),
+		zap.String("identifier", identifier))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetCertificate returns the challenge certificate for hello if it is
+// from a CA validating a tls-alpn-01 challenge that was received, or
+// nil if it is not, in which case the handshake should proceed as usual.
+func (rcv *TLSALPNChallengeReceiver) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if len(hello.SupportedProtos) != 1 || hello.SupportedProtos[0] != acmez.ACMETLS1Protocol {
+		return nil, nil
+	}
+	name := tlsALPNChallengeName(hello)
+	rcv.mu.RLock()
+	cert, ok := rcv.certs[name]
+	rcv.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no tls-alpn-01 challenge certificate for %s", name)
+	}
+	return cert, nil
+}
+
+func (rcv *TLSALPNChallengeReceiver) logger() *zap.Logger {
+	if rcv.Logger == nil {
+		return zap.NewNop()
+	}
+	return rcv.Logger
+}
+
+// Interface guards
+var (
+	_ acmez.Solver = (*ExternalTLSALPNSolver)(nil)
+	_ http.Handler = (*TLSALPNChallengeReceiver)(nil)
+)
@@ -0,0 +1,119 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mholt/acmez/v3"
+	"github.com/mholt/acmez/v3/acme"
+)
+
+func TestExternalTLSALPNSolver(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("sidecar-secret")
+	receiver := &TLSALPNChallengeReceiver{Secret: secret}
+
+	socketPath := filepath.Join(t.TempDir(), "acme-tls.sock")
+	ln, err := ListenAddress("unix:" + socketPath)
+	if err != nil {
+		t.Skipf("unable to listen on UNIX socket: %v", err)
+	}
+	srv := &http.Server{Handler: receiver}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// the process that owns the TLS port
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		NextProtos: []string{"h2", acmez.ACMETLS1Protocol},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return receiver.GetCertificate(hello)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tlsLn.Close()
+	go func() {
+		for {
+			conn, err := tlsLn.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}()
+		}
+	}()
+
+	chal, err := newSelfTestChallenge(acme.ChallengeTypeTLSALPN01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := &ExternalTLSALPNSolver{Address: "unix:" + socketPath, Secret: secret}
+	if err := solver.Present(ctx, chal); err != nil {
+		t.Fatalf("presenting challenge: %v", err)
+	}
+	if err := verifyTLSALPNChallenge(ctx, tlsLn.Addr().String(), chal); err != nil {
+		t.Errorf("expected challenge to be served by the other process, got: %v", err)
+	}
+	if err := solver.CleanUp(ctx, chal); err != nil {
+		t.Fatalf("cleaning up challenge: %v", err)
+	}
+	if err := verifyTLSALPNChallenge(ctx, tlsLn.Addr().String(), chal); err == nil {
+		t.Error("expected challenge to no longer be served after clean up")
+	}
+
+	wrongSecret := &ExternalTLSALPNSolver{Address: "unix:" + socketPath, Secret: []byte("wrong")}
+	if err := wrongSecret.Present(ctx, chal); err == nil {
+		t.Error("expected challenge with wrong signature to be rejected")
+	}
+}
+
+func TestTLSALPNChallengeReceiverIgnoresOtherHandshakes(t *testing.T) {
+	receiver := new(TLSALPNChallengeReceiver)
+	cert, err := receiver.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{"h2", "http/1.1"},
+	})
+	if cert != nil || err != nil {
+		t.Errorf("expected no certificate and no error for regular handshake, got %v, %v", cert, err)
+	}
+
+	// an HTTP URL also works as the receiver's address
+	srv := httptest.NewServer(receiver)
+	defer srv.Close()
+	chal, err := newSelfTestChallenge(acme.ChallengeTypeTLSALPN01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	solver := &ExternalTLSALPNSolver{Address: srv.URL}
+	if err := solver.Present(context.Background(), chal); err != nil {
+		t.Fatalf("presenting challenge: %v", err)
+	}
+	cert, err = receiver.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      chal.Identifier.Value,
+		SupportedProtos: []string{acmez.ACMETLS1Protocol},
+	})
+	if cert == nil || err != nil {
+		t.Errorf("expected challenge certificate, got %v, %v", cert, err)
+	}
+}
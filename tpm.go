@@ -0,0 +1,228 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io"
+)
+
+// TPM is a TPM 2.0 device, as needed for TPM-backed keys. It is
+// typically implemented using a TPM library such as go-tpm, which
+// certmagic does not depend on.
+//
+// Keys are identified by their TPMKeyBlob, which contains the private
+// area of the key sealed by the TPM: it can only be loaded into the
+// TPM that created it, so it is safe to store.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TPM interface {
+	// CreateKey creates a new signing key of the given type
+	// as a child of the parent key. If the parent is a
+	// hierarchy handle such as TPMOwnerHierarchy, the parent
+	// is the storage primary key of that hierarchy, created
+	// with the standard template.
+	CreateKey(parent uint32, keyType KeyType) (TPMKeyBlob, error)
+
+	// PublicKey returns the public key of the key.
+	PublicKey(key TPMKeyBlob) (crypto.PublicKey, error)
+
+	// Sign loads the key and signs digest with it, with
+	// the same semantics as crypto.Signer.
+	Sign(key TPMKeyBlob, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// TPMAttester is implemented by TPMs that can attest their keys.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TPMAttester interface {
+	// Attest returns a statement, signed by the TPM's attestation
+	// key, that certifies that the key was created in the TPM and
+	// cannot leave it. The nonce must be covered by the statement;
+	// for the device-attest-01 challenge, it is derived from the
+	// challenge token, and the statement is the attestation object.
+	Attest(key TPMKeyBlob, nonce []byte) ([]byte, error)
+}
+
+// TPMKeyBlob identifies a key held by a TPM.
+type TPMKeyBlob struct {
+	// The handle of the parent key.
+	Parent uint32
+
+	// The marshaled TPM2B_PUBLIC area of the key.
+	Public []byte
+
+	// The marshaled TPM2B_PRIVATE area of the key,
+	// encrypted by the parent key.
+	Private []byte
+}
+
+// TPMOwnerHierarchy is the handle of the TPM's owner (storage) hierarchy.
+const TPMOwnerHierarchy uint32 = 0x40000001
+
+// TPMKeyPEMType is the PEM block type of TPM-backed keys, as used by
+// the OpenSSL TPM 2.0 provider and other TSS2 tools.
+const TPMKeyPEMType = "TSS2 PRIVATE KEY"
+
+// TPMKeySource is a KeyGenerator that generates keys inside a TPM.
+// It can be used as a Config's KeySource for certificate keys, and as
+// an ACMEIssuer's AccountKeySource for account keys.
+//
+// Since the private keys never leave the TPM, they are stored in the
+// TSS2 key format, and cannot be loaded without the TPM. To load them,
+// the TPM must be registered before certificates or accounts are
+// loaded, using RegisterTPM.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TPMKeySource struct {
+	// The TPM in which to generate keys. Required.
+	TPM TPM
+
+	// The type of keys to generate. Ed25519 and ML-DSA
+	// are not supported by TPMs. Default: P256.
+	KeyType KeyType
+
+	// The handle of the parent key under which keys
+	// are created. Default: TPMOwnerHierarchy.
+	Parent uint32
+}
+
+// GenerateKey generates a new *TPMKey.
+func (ks TPMKeySource) GenerateKey() (crypto.PrivateKey, error) {
+	keyType := ks.KeyType
+	switch keyType {
+	case "":
+		keyType = P256
+	case ED25519, MLDSA44, MLDSA65, MLDSA87:
+		return nil, fmt.Errorf("key type not supported by TPM: %s", keyType)
+	}
+	parent := ks.Parent
+	if parent == 0 {
+		parent = TPMOwnerHierarchy
+	}
+	blob, err := ks.TPM.CreateKey(parent, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("creating key in TPM: %v", err)
+	}
+	return NewTPMKey(ks.TPM, blob)
+}
+
+// RegisterTPM registers tpm for loading the TPM-backed keys of
+// TPMKeySource from storage. Only one TPM can be registered.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func RegisterTPM(tpm TPM) {
+	RegisterPrivateKeyDecoder(TPMKeyPEMType, func(der []byte) (crypto.Signer, error) {
+		return ParseTPMKey(tpm, der)
+	})
+}
+
+// TPMKey is a private key held by a TPM. It implements crypto.Signer
+// and PEMPrivateKey.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type TPMKey struct {
+	tpm    TPM
+	blob   TPMKeyBlob
+	public crypto.PublicKey
+}
+
+// NewTPMKey returns the key identified by blob in tpm.
+func NewTPMKey(tpm TPM, blob TPMKeyBlob) (*TPMKey, error) {
+	public, err := tpm.PublicKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("getting public key from TPM: %v", err)
+	}
+	return &TPMKey{tpm: tpm, blob: blob, public: public}, nil
+}
+
+// ParseTPMKey parses a DER-encoded key in the TSS2 key format
+// (the contents of a TPMKeyPEMType PEM block) for use with tpm.
+func ParseTPMKey(tpm TPM, der []byte) (*TPMKey, error) {
+	var key tss2Key
+	rest, err := asn1.Unmarshal(der, &key)
+	if err != nil {
+		return nil, fmt.Errorf("decoding TSS2 key: %v", err)
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("decoding TSS2 key: trailing data")
+	}
+	if !key.Type.Equal(oidTSS2LoadableKey) {
+		return nil, fmt.Errorf("unsupported TSS2 key type: %s", key.Type)
+	}
+	return NewTPMKey(tpm, TPMKeyBlob{
+		Parent:  uint32(key.Parent),
+		Public:  key.PublicKey,
+		Private: key.PrivateKey,
+	})
+}
+
+// Public implements crypto.Signer.
+func (k *TPMKey) Public() crypto.PublicKey { return k.public }
+
+// Sign implements crypto.Signer. The rand argument is ignored;
+// the TPM uses its own random number generator.
+func (k *TPMKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.tpm.Sign(k.blob, digest, opts)
+}
+
+// Blob returns the blob that identifies the key.
+func (k *TPMKey) Blob() TPMKeyBlob { return k.blob }
+
+// Attest returns an attestation statement for the key that covers
+// nonce, if the TPM implements TPMAttester. See TPMAttester.Attest.
+func (k *TPMKey) Attest(nonce []byte) ([]byte, error) {
+	attester, ok := k.tpm.(TPMAttester)
+	if !ok {
+		return nil, fmt.Errorf("TPM does not support attestation")
+	}
+	return attester.Attest(k.blob, nonce)
+}
+
+// MarshalPEM implements PEMPrivateKey.
+func (k *TPMKey) MarshalPEM() (*pem.Block, error) {
+	der, err := asn1.Marshal(tss2Key{
+		Type:       oidTSS2LoadableKey,
+		EmptyAuth:  true,
+		Parent:     int64(k.blob.Parent),
+		PublicKey:  k.blob.Public,
+		PrivateKey: k.blob.Private,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: TPMKeyPEMType, Bytes: der}, nil
+}
+
+// tss2Key is the ASN.1 structure of the TSS2 key format.
+type tss2Key struct {
+	Type       asn1.ObjectIdentifier
+	EmptyAuth  bool `asn1:"optional,explicit,tag:0"`
+	Parent     int64
+	PublicKey  []byte
+	PrivateKey []byte
+}
+
+// oidTSS2LoadableKey is id-loadablekey, for keys created under a parent.
+var oidTSS2LoadableKey = asn1.ObjectIdentifier{2, 23, 133, 10, 1, 3}
+
+// Interface guards
+var (
+	_ KeyGenerator  = TPMKeySource{}
+	_ PEMPrivateKey = (*TPMKey)(nil)
+)
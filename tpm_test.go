@@ -0,0 +1,170 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/pem"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// softTPM is a TPM that keeps its keys in memory; the "sealed"
+// private area is only a random handle to the key.
+type softTPM struct {
+	mu   sync.Mutex
+	keys map[string]crypto.Signer
+}
+
+func (st *softTPM) CreateKey(parent uint32, keyType KeyType) (TPMKeyBlob, error) {
+	key, err := StandardKeyGenerator{KeyType: keyType}.GenerateKey()
+	if err != nil {
+		return TPMKeyBlob{}, err
+	}
+	handle := make([]byte, 16)
+	if _, err := rand.Read(handle); err != nil {
+		return TPMKeyBlob{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.keys == nil {
+		st.keys = make(map[string]crypto.Signer)
+	}
+	st.keys[string(handle)] = key.(crypto.Signer)
+	return TPMKeyBlob{Parent: parent, Public: []byte("public"), Private: handle}, nil
+}
+
+func (st *softTPM) load(blob TPMKeyBlob) (crypto.Signer, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	key, ok := st.keys[string(blob.Private)]
+	if !ok {
+		return nil, fmt.Errorf("key not created by this TPM")
+	}
+	return key, nil
+}
+
+func (st *softTPM) PublicKey(blob TPMKeyBlob) (crypto.PublicKey, error) {
+	key, err := st.load(blob)
+	if err != nil {
+		return nil, err
+	}
+	return key.Public(), nil
+}
+
+func (st *softTPM) Sign(blob TPMKeyBlob, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := st.load(blob)
+	if err != nil {
+		return nil, err
+	}
+	return key.Sign(rand.Reader, digest, opts)
+}
+
+type attestingSoftTPM struct{ softTPM }
+
+func (st *attestingSoftTPM) Attest(blob TPMKeyBlob, nonce []byte) ([]byte, error) {
+	return append([]byte("attested:"), nonce...), nil
+}
+
+func TestTPMKey(t *testing.T) {
+	tpm := new(softTPM)
+	RegisterTPM(tpm)
+
+	privKey, err := TPMKeySource{TPM: tpm}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := privKey.(*TPMKey)
+	if key.Blob().Parent != TPMOwnerHierarchy {
+		t.Errorf("expected default parent, got %#x", key.Blob().Parent)
+	}
+	if _, ok := key.Public().(*ecdsa.PublicKey); !ok {
+		t.Errorf("expected P-256 key by default, got %T", key.Public())
+	}
+
+	keyPEM, err := PEMEncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(keyPEM); block == nil || block.Type != TPMKeyPEMType {
+		t.Fatalf("expected %s PEM block, got %q", TPMKeyPEMType, keyPEM)
+	}
+	decoded, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		t.Fatalf("decoding TPM key: %v", err)
+	}
+	loaded := decoded.(*TPMKey)
+	if !bytes.Equal(loaded.Blob().Private, key.Blob().Private) || loaded.Blob().Parent != key.Blob().Parent {
+		t.Error("expected decoded key to have the same blob")
+	}
+
+	digest := sha256.Sum256([]byte("hello"))
+	sig, err := loaded.Sign(nil, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(key.Public().(*ecdsa.PublicKey), digest[:], sig) {
+		t.Error("expected valid signature")
+	}
+
+	if _, err := key.Attest([]byte("nonce")); err == nil {
+		t.Error("expected error attesting without attester")
+	}
+	attestingKey, err := TPMKeySource{TPM: new(attestingSoftTPM)}.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt, err := attestingKey.(*TPMKey).Attest([]byte("nonce")); err != nil || string(stmt) != "attested:nonce" {
+		t.Errorf("expected attestation statement, got %q (err=%v)", stmt, err)
+	}
+
+	if _, err := (TPMKeySource{TPM: tpm, KeyType: ED25519}).GenerateKey(); err == nil {
+		t.Error("expected error for Ed25519 keys")
+	}
+}
+
+func TestTPMKeyManagedCertificate(t *testing.T) {
+	ctx := context.Background()
+	tpm := new(softTPM)
+	RegisterTPM(tpm)
+
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.KeySource = TPMKeySource{TPM: tpm}
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatalf("obtaining certificate: %v", err)
+	}
+	cert, err := cfg.CacheManagedCertificate(ctx, "example.com")
+	if err != nil {
+		t.Fatalf("loading certificate: %v", err)
+	}
+	if _, ok := cert.Certificate.PrivateKey.(*TPMKey); !ok {
+		t.Errorf("expected TPM key, got %T", cert.Certificate.PrivateKey)
+	}
+
+	am := &ACMEIssuer{AccountKeySource: TPMKeySource{TPM: tpm}}
+	account, err := am.newAccount("me@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := account.PrivateKey.(*TPMKey); !ok {
+		t.Errorf("expected TPM account key, got %T", account.PrivateKey)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// unmanagedFile is an unmanaged certificate that was loaded from
+// files, so that it can be reloaded when they change.
+type unmanagedFile struct {
+	certFile, keyFile string
+	cfg               *Config
+
+	// the hash of the cached certificate, and the
+	// state of the files when it was loaded
+	hash              string
+	certStat, keyStat fileStamp
+}
+
+// fileStamp is what is used to notice that a file changed.
+type fileStamp struct {
+	modTime int64 // Unix nanoseconds
+	size    int64
+}
+
+func statFile(name string) (fileStamp, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}, nil
+}
+
+// watchUnmanagedFiles remembers uf, so that its certificate
+// can be reloaded when its files change.
+func (certCache *Cache) watchUnmanagedFiles(uf *unmanagedFile) {
+	certCache.unmanagedMu.Lock()
+	defer certCache.unmanagedMu.Unlock()
+	if certCache.unmanagedFiles == nil {
+		certCache.unmanagedFiles = make(map[[2]string]*unmanagedFile)
+	}
+	certCache.unmanagedFiles[[2]string{uf.certFile, uf.keyFile}] = uf
+}
+
+// ReloadUnmanaged reads the files of all certificates that were loaded
+// with Config.CacheUnmanagedCertificatePEMFile again, and replaces the
+// certificates in the cache whose files changed, for example after they
+// were rotated by an external tool. Certificates whose files cannot be
+// loaded, for example because only one of them was written yet, keep
+// being served; the errors are returned, and loading them is tried again
+// the next time. To reload certificates automatically when their files
+// change, set CacheOptions.UnmanagedReloadInterval.
+//
+// Certificates that were removed from the cache are not reloaded.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (certCache *Cache) ReloadUnmanaged(ctx context.Context) error {
+	return certCache.reloadUnmanagedFiles(ctx, true)
+}
+
+// reloadUnmanagedFiles reloads the certificates of unmanagedFiles; if
+// force is false, only those whose files changed since they were loaded.
+func (certCache *Cache) reloadUnmanagedFiles(ctx context.Context, force bool) error {
+	certCache.unmanagedMu.Lock()
+	files := make([]*unmanagedFile, 0, len(certCache.unmanagedFiles))
+	for _, uf := range certCache.unmanagedFiles {
+		files = append(files, uf)
+	}
+	certCache.unmanagedMu.Unlock()
+
+	var errs []error
+	for _, uf := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := certCache.reloadUnmanagedFile(ctx, uf, force); err != nil {
+			errs = append(errs, fmt.Errorf("reloading certificate from %s and %s: %w", uf.certFile, uf.keyFile, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// reloadUnmanagedFile loads the certificate of uf from its files and
+// replaces the cached certificate with it, if it changed. The files are
+// loaded (and the OCSP staple fetched) without holding any locks, so the
+// certificate is only replaced if it is still cached afterwards; that
+// way, a certificate that was removed from the cache in the meantime is
+// not put back.
+func (certCache *Cache) reloadUnmanagedFile(ctx context.Context, uf *unmanagedFile, force bool) error {
+	certCache.unmanagedMu.Lock()
+	hash, oldCertStat, oldKeyStat := uf.hash, uf.certStat, uf.keyStat
+	certCache.unmanagedMu.Unlock()
+
+	certCache.mu.RLock()
+	oldCert, cached := certCache.cache[hash]
+	certCache.mu.RUnlock()
+	if !cached {
+		certCache.forgetUnmanagedFiles([]string{hash})
+		return nil
+	}
+
+	certStat, err := statFile(uf.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := statFile(uf.keyFile)
+	if err != nil {
+		return err
+	}
+	if !force && certStat == oldCertStat && keyStat == oldKeyStat {
+		return nil
+	}
+
+	newCert, err := uf.cfg.makeCertificateFromDiskWithOCSP(ctx, uf.certFile, uf.keyFile)
+	if err != nil {
+		return err
+	}
+	newCert.Tags = oldCert.Tags
+
+	certCache.unmanagedMu.Lock()
+	if uf.hash != hash {
+		// reloaded concurrently
+		certCache.unmanagedMu.Unlock()
+		return nil
+	}
+	uf.certStat, uf.keyStat = certStat, keyStat
+	if newCert.hash == oldCert.hash {
+		certCache.unmanagedMu.Unlock()
+		return nil
+	}
+	certCache.mu.Lock()
+	if _, ok := certCache.cache[oldCert.hash]; !ok {
+		// removed while the files were loaded
+		certCache.mu.Unlock()
+		certCache.unmanagedMu.Unlock()
+		return nil
+	}
+	certCache.removeCertificate(oldCert)
+	certCache.unsyncedCacheCertificate(newCert)
+	certCache.mu.Unlock()
+	uf.hash = newCert.hash
+	certCache.unmanagedMu.Unlock()
+
+	certCache.logger.Info("replaced certificate in cache",
+		zap.Strings("subjects", newCert.Names),
+		zap.Time("new_expiration", expiresAt(newCert.Leaf)))
+	certCache.signalLocalFollowers()
+	uf.cfg.emit(ctx, "unmanaged_cert_reloaded", map[string]any{
+		"sans":      newCert.Names,
+		"cert_file": uf.certFile,
+		"key_file":  uf.keyFile,
+		"old_hash":  oldCert.hash,
+		"hash":      newCert.hash,
+	})
+	return nil
+}
+
+// checkUnmanagedFiles reloads the unmanaged certificates
+// whose files changed since they were loaded.
+func (certCache *Cache) checkUnmanagedFiles(ctx context.Context, log *zap.Logger) {
+	if err := certCache.reloadUnmanagedFiles(ctx, false); err != nil {
+		log.Error("reloading unmanaged certificates from changed files", zap.Error(err))
+	}
+}
+
+// forgetUnmanagedFiles stops reloading the certificates with the
+// given hashes from their files.
+func (certCache *Cache) forgetUnmanagedFiles(hashes []string) {
+	certCache.unmanagedMu.Lock()
+	defer certCache.unmanagedMu.Unlock()
+	if len(certCache.unmanagedFiles) == 0 {
+		return
+	}
+	removed := make(map[string]bool, len(hashes))
+	for _, h := range hashes {
+		removed[h] = true
+	}
+	for key, uf := range certCache.unmanagedFiles {
+		if removed[uf.hash] {
+			delete(certCache.unmanagedFiles, key)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// writeFakeCertificateFiles issues a certificate for name and writes
+// it and its key to certFile and keyFile, and returns its hash.
+func writeFakeCertificateFiles(t *testing.T, fi *FakeIssuer, name, certFile, keyFile string) string {
+	t.Helper()
+	cert, certPEM := issueFakeCertificate(t, fi, name)
+	keyPEM, err := PEMEncodePrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cert.hash
+}
+
+func TestReloadUnmanaged(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cache := cfg.certCache
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	oldHash := writeFakeCertificateFiles(t, fi, "example.com", certFile, keyFile)
+	hash, err := cfg.CacheUnmanagedCertificatePEMFile(ctx, certFile, keyFile, []string{"external"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != oldHash {
+		t.Fatalf("expected hash %s, got %s", oldHash, hash)
+	}
+
+	// nothing changed
+	if err := cache.ReloadUnmanaged(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if certs := cache.getAllMatchingCerts("example.com"); len(certs) != 1 || certs[0].hash != oldHash {
+		t.Fatalf("expected unchanged certificate to stay cached, got %d certificates", len(certs))
+	}
+
+	// only the certificate was rotated so far; the old one keeps being served
+	newCert, newCertPEM := issueFakeCertificate(t, fi, "example.com")
+	if err := os.WriteFile(certFile, newCertPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.ReloadUnmanaged(ctx); err == nil {
+		t.Error("expected error reloading certificate with mismatched key")
+	}
+	if certs := cache.getAllMatchingCerts("example.com"); len(certs) != 1 || certs[0].hash != oldHash {
+		t.Fatal("expected old certificate to be served until its files are consistent")
+	}
+
+	// then the key, too
+	keyPEM, err := PEMEncodePrivateKey(newCert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.ReloadUnmanaged(ctx); err != nil {
+		t.Fatal(err)
+	}
+	certs := cache.getAllMatchingCerts("example.com")
+	if len(certs) != 1 || certs[0].hash != newCert.hash {
+		t.Fatalf("expected rotated certificate to replace old one, got %d certificates", len(certs))
+	}
+	if !certs[0].HasTag("external") {
+		t.Error("expected reloaded certificate to keep its tags")
+	}
+
+	// removed certificates are not reloaded
+	cache.Remove([]string{newCert.hash})
+	writeFakeCertificateFiles(t, fi, "example.com", certFile, keyFile)
+	if err := cache.ReloadUnmanaged(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if certs := cache.getAllMatchingCerts("example.com"); len(certs) != 0 {
+		t.Errorf("expected removed certificate not to be reloaded, got %d certificates", len(certs))
+	}
+}
+
+func TestCheckUnmanagedFiles(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cache := cfg.certCache
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	writeFakeCertificateFiles(t, fi, "example.com", certFile, keyFile)
+	if _, err := cfg.CacheUnmanagedCertificatePEMFile(ctx, certFile, keyFile, nil); err != nil {
+		t.Fatal(err)
+	}
+	newHash := writeFakeCertificateFiles(t, fi, "example.com", certFile, keyFile)
+	// make sure the change is noticed on file systems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, keyFile} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cache.checkUnmanagedFiles(ctx, zap.NewNop())
+	if certs := cache.getAllMatchingCerts("example.com"); len(certs) != 1 || certs[0].hash != newHash {
+		t.Errorf("expected changed files to be reloaded, got %d certificates", len(certs))
+	}
+}
+
+func TestReloadUnmanagedRemovedWhileLoading(t *testing.T) {
+	ctx := context.Background()
+	fi := new(FakeIssuer)
+	cfg := newOnDemandTestConfig(t, fi)
+	cache := cfg.certCache
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+
+	writeFakeCertificateFiles(t, fi, "example.com", certFile, keyFile)
+	hash, err := cfg.CacheUnmanagedCertificatePEMFile(ctx, certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFakeCertificateFiles(t, fi, "example.com", certFile, keyFile)
+
+	// block the reload while it looks for a stored OCSP staple
+	var once sync.Once
+	loading, release := make(chan struct{}), make(chan struct{})
+	cfg.Storage = &FaultyStorage{
+		Storage: cfg.Storage,
+		Fault: func(op StorageOp, key string) error {
+			if op == StorageOpLoad && strings.HasPrefix(key, "ocsp/") {
+				once.Do(func() { close(loading) })
+				<-release
+			}
+			return nil
+		},
+	}
+	reloaded := make(chan error, 1)
+	go func() { reloaded <- cache.ReloadUnmanaged(ctx) }()
+	<-loading
+
+	// removing the certificate does not wait for the reload...
+	removed := make(chan struct{})
+	go func() {
+		cache.Remove([]string{hash})
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected removal not to wait for reload")
+	}
+	close(release)
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+
+	// ...and the reload does not put it back
+	if certs := cache.getAllMatchingCerts("example.com"); len(certs) != 0 {
+		t.Errorf("expected removed certificate not to be reloaded, got %d certificates", len(certs))
+	}
+}
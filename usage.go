@@ -0,0 +1,137 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// certUsage tracks how often a cached certificate is served. It is
+// shared by all copies of the Certificate, so it is safe to update
+// from TLS handshakes without a lock on the cache.
+type certUsage struct {
+	handshakes atomic.Uint64
+	lastServed atomic.Int64 // Unix nanoseconds; sampled
+	cached     atomic.Int64 // Unix nanoseconds
+}
+
+// usageSampleInterval is how many handshakes may happen between updates
+// of a certificate's last-served time; the first handshake always updates
+// it. Getting the time is not free, and at high handshake rates, its
+// precision is not needed.
+const usageSampleInterval = 16
+
+// record records that the certificate was served in a handshake. It
+// returns true if it updated the last-served time.
+func (u *certUsage) record() bool {
+	if u == nil {
+		return false
+	}
+	if n := u.handshakes.Add(1); n == 1 || n%usageSampleInterval == 0 {
+		u.lastServed.Store(timeNow().UnixNano())
+		return true
+	}
+	return false
+}
+
+// lastUsed returns when the certificate was last served, or else
+// when it was cached, in Unix nanoseconds.
+func (u *certUsage) lastUsed() int64 {
+	if u == nil {
+		return 0
+	}
+	if ns := u.lastServed.Load(); ns != 0 {
+		return ns
+	}
+	return u.cached.Load()
+}
+
+// Handshakes returns the number of TLS handshakes in which the certificate
+// was served since it was added to the cache.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cert Certificate) Handshakes() uint64 {
+	if cert.usage == nil {
+		return 0
+	}
+	return cert.usage.handshakes.Load()
+}
+
+// LastServed returns approximately when the certificate was last served in
+// a TLS handshake, or the zero time if it has not been served since it was
+// added to the cache. Since it is sampled, it may lag behind by up to 15
+// handshakes.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (cert Certificate) LastServed() time.Time {
+	if cert.usage == nil {
+		return time.Time{}
+	}
+	if ns := cert.usage.lastServed.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// CertificateUsage describes how a cached certificate has been used.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type CertificateUsage struct {
+	// The subject names on the certificate.
+	Names []string
+
+	// The hash of the certificate chain; see Certificate.Hash.
+	Hash string
+
+	// Whether the certificate is managed.
+	Managed bool
+
+	// See Certificate.Handshakes.
+	Handshakes uint64
+
+	// See Certificate.LastServed.
+	LastServed time.Time
+}
+
+// Usage returns the usage of all certificates in the cache, least
+// recently served first; certificates that have never been served
+// come first. This can be used to find certificates that are not
+// needed anymore, for example to decommission them.
+//
+// EXPERIMENTAL: Subject to change or removal.
+func (certCache *Cache) Usage() []CertificateUsage {
+	certCache.mu.RLock()
+	usage := make([]CertificateUsage, 0, len(certCache.cache))
+	for _, cert := range certCache.cache {
+		usage = append(usage, CertificateUsage{
+			Names:      cert.Names,
+			Hash:       cert.hash,
+			Managed:    cert.managed,
+			Handshakes: cert.Handshakes(),
+			LastServed: cert.LastServed(),
+		})
+	}
+	certCache.mu.RUnlock()
+
+	sort.Slice(usage, func(i, j int) bool {
+		if !usage[i].LastServed.Equal(usage[j].LastServed) {
+			return usage[i].LastServed.Before(usage[j].LastServed)
+		}
+		return usage[i].Handshakes < usage[j].Handshakes
+	})
+	return usage
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestCertificateUsage(t *testing.T) {
+	faults := new(testFaults)
+	setFaultInjector(t, faults)
+
+	c := &Cache{
+		cache:      make(map[string]Certificate),
+		cacheIndex: make(map[string][]string),
+		logger:     defaultTestLogger,
+	}
+	cfg := &Config{Logger: defaultTestLogger, certCache: c}
+	for _, name := range []string{"busy.example.com", "idle.example.com"} {
+		c.cacheCertificate(Certificate{
+			Names:       []string{name},
+			hash:        name,
+			Certificate: tls.Certificate{Leaf: &x509.Certificate{DNSNames: []string{name}}},
+		})
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: "busy.example.com"}
+	if _, err := cfg.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+	first := c.cache["busy.example.com"].LastServed()
+	if first.IsZero() {
+		t.Fatal("expected first handshake to record last-served time")
+	}
+
+	// the time is only sampled
+	faults.set(time.Hour, false)
+	for i := 2; i < usageSampleInterval; i++ {
+		if _, err := cfg.GetCertificate(hello); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if last := c.cache["busy.example.com"].LastServed(); !last.Equal(first) {
+		t.Errorf("expected last-served time to be sampled, got %s", last)
+	}
+	if _, err := cfg.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+	if last := c.cache["busy.example.com"].LastServed(); last.Sub(first) < time.Hour {
+		t.Errorf("expected sampled last-served time to be updated, got %s", last)
+	}
+
+	usage := c.Usage()
+	if len(usage) != 2 {
+		t.Fatalf("expected usage of 2 certificates, got %d", len(usage))
+	}
+	if usage[0].Hash != "idle.example.com" || usage[0].Handshakes != 0 || !usage[0].LastServed.IsZero() {
+		t.Errorf("expected idle certificate first, got %+v", usage[0])
+	}
+	if usage[1].Hash != "busy.example.com" || usage[1].Handshakes != usageSampleInterval {
+		t.Errorf("expected %d handshakes for busy certificate, got %+v", usageSampleInterval, usage[1])
+	}
+}
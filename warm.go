@@ -0,0 +1,232 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WarmCacheOptions configures a call to WarmCache.
+type WarmCacheOptions struct {
+	// The names to load into the cache. If empty, all
+	// certificates in storage from the config's issuers
+	// are loaded.
+	Names []string
+
+	// The maximum number of certificates to load at once.
+	// Default: the cache's LoadWorkers option.
+	Concurrency int
+
+	// The maximum amount of time to spend warming the
+	// cache. Names that have not been loaded when the
+	// budget runs out are reported as skipped. Default: 0
+	// (no limit other than the context).
+	TimeBudget time.Duration
+}
+
+// WarmCacheResult reports the outcome of a call to WarmCache.
+type WarmCacheResult struct {
+	// Names whose certificates are now in the cache.
+	Warmed []string
+
+	// Names that could not be loaded, with the reason.
+	Failed map[string]error
+
+	// Names that were not attempted because the time
+	// budget ran out or the context was canceled.
+	Skipped []string
+
+	// How long warming took.
+	Duration time.Duration
+}
+
+// WarmCache preloads managed certificates from storage into the cache
+// using a pool of parallel loaders, so that the first handshakes after
+// startup do not have to wait on storage. Unlike ManageSync, it never
+// obtains or renews certificates; names without a certificate in storage
+// are reported as failed. Certificates that are already in the cache are
+// counted as warmed.
+//
+// Loading stops when opts.TimeBudget elapses or ctx is canceled, and the
+// names that were not loaded are reported as skipped; this is not an error.
+func (cfg *Config) WarmCache(ctx context.Context, opts WarmCacheOptions) (WarmCacheResult, error) {
+	start := time.Now()
+	result := WarmCacheResult{Failed: make(map[string]error)}
+
+	if opts.TimeBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.TimeBudget)
+		defer cancel()
+	}
+
+	names := opts.Names
+	if len(names) == 0 {
+		var err error
+		names, err = cfg.storedCertNames(ctx)
+		if err != nil {
+			return result, fmt.Errorf("listing certificates in storage: %v", err)
+		}
+	}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = cfg.certCache.loadWorkers()
+	}
+
+	logger := cfg.Logger.Named("warm_cache")
+	logger.Info("warming certificate cache",
+		zap.Int("count", len(names)),
+		zap.Int("concurrency", concurrency),
+		zap.Duration("time_budget", opts.TimeBudget))
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	queue := make(chan string)
+
+	for w := 0; w < concurrency && w < len(names); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				err := cfg.warmOne(ctx, normalizedName(name))
+				mu.Lock()
+				switch {
+				case err == nil:
+					result.Warmed = append(result.Warmed, name)
+				case ctx.Err() != nil:
+					result.Skipped = append(result.Skipped, name)
+				default:
+					result.Failed[name] = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var sent int
+feed:
+	for sent < len(names) {
+		select {
+		case queue <- names[sent]:
+			sent++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	result.Skipped = append(result.Skipped, names[sent:]...)
+	result.Duration = time.Since(start)
+
+	logger.Info("finished warming certificate cache",
+		zap.Int("warmed", len(result.Warmed)),
+		zap.Int("failed", len(result.Failed)),
+		zap.Int("skipped", len(result.Skipped)),
+		zap.Duration("duration", result.Duration))
+
+	return result, nil
+}
+
+// warmOne loads the managed certificate for name into the cache,
+// unless it is already there. The name may also be the key that a
+// certificate for several names is stored under (see storedCertNames).
+func (cfg *Config) warmOne(ctx context.Context, name string) error {
+	first, _, multiple := strings.Cut(name, ",")
+	for _, cert := range cfg.certCache.getAllMatchingCerts(first) {
+		if cert.managed && (!multiple || cert.storageNamesKey() == name) {
+			return nil
+		}
+	}
+	if _, err := cfg.CacheManagedCertificate(ctx, name); err != nil {
+		return err
+	}
+	return nil
+}
+
+// storedCertNames returns the names of all certificates in storage
+// that belong to any of cfg's issuers.
+func (cfg *Config) storedCertNames(ctx context.Context) ([]string, error) {
+	var names []string
+	seen := make(map[string]struct{})
+	for _, issuer := range cfg.Issuers {
+		issuerKey := issuer.IssuerKey()
+		siteKeys, err := cfg.Storage.List(ctx, StorageKeys.CertsPrefix(issuerKey), false)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, siteKey := range siteKeys {
+			// the site key is sanitized, so read the real name from the metadata
+			metaBytes, err := cfg.Storage.Load(ctx, StorageKeys.SiteMeta(issuerKey, path.Base(siteKey)))
+			if err != nil {
+				cfg.Logger.Warn("unable to read certificate metadata; skipping",
+					zap.String("site", siteKey),
+					zap.Error(err))
+				continue
+			}
+			var certRes CertificateResource
+			if err := json.Unmarshal(metaBytes, &certRes); err != nil || len(certRes.SANs) == 0 {
+				cfg.Logger.Warn("invalid certificate metadata; skipping",
+					zap.String("site", siteKey),
+					zap.Error(err))
+				continue
+			}
+			name := storedCertName(certRes, path.Base(siteKey))
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// DefaultWarmCacheConcurrency is the least number of
+// certificates that WarmCache loads concurrently by
+// default; see DefaultLoadWorkers.
+const DefaultWarmCacheConcurrency = 16
+
+// storedCertName returns the name under which the certificate of
+// certRes is stored at the given (sanitized) site key, and so is
+// loaded and cached: usually the key of all of its names, but the
+// certificate for a group of names is stored under its primary name.
+func storedCertName(certRes CertificateResource, site string) string {
+	namesKey := certRes.NamesKey()
+	if StorageKeys.Safe(namesKey) == site {
+		return namesKey
+	}
+	for _, san := range certRes.SANs {
+		if StorageKeys.Safe(san) == site {
+			return san
+		}
+	}
+	return namesKey
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWarmCache(t *testing.T) {
+	ctx := context.Background()
+	iss := new(countingIssuer)
+
+	// populate storage using one config...
+	populate := newOnDemandTestConfig(t, iss)
+	names := []string{"a.example.com", "b.example.com", "*.example.net"}
+	for _, name := range names {
+		if err := populate.ObtainCertSync(ctx, name); err != nil {
+			t.Fatalf("obtaining %s: %v", name, err)
+		}
+	}
+
+	// ...then warm a fresh cache that shares the same storage
+	cfg := newOnDemandTestConfig(t, iss)
+	cfg.Storage = populate.Storage
+
+	result, err := cfg.WarmCache(ctx, WarmCacheOptions{Concurrency: 2})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sort.Strings(result.Warmed)
+	expected := []string{"*.example.net", "a.example.com", "b.example.com"}
+	if len(result.Warmed) != len(expected) {
+		t.Fatalf("expected %v to be warmed, got %v (failed: %v)", expected, result.Warmed, result.Failed)
+	}
+	for i := range expected {
+		if result.Warmed[i] != expected[i] {
+			t.Errorf("expected %v to be warmed, got %v", expected, result.Warmed)
+			break
+		}
+	}
+	if count := len(cfg.certCache.getAllCerts()); count != len(names) {
+		t.Errorf("expected %d certificates in cache, got %d", len(names), count)
+	}
+
+	// explicit names are loaded only if they are in storage
+	result, err = cfg.WarmCache(ctx, WarmCacheOptions{Names: []string{"a.example.com", "missing.example.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Warmed) != 1 || result.Warmed[0] != "a.example.com" {
+		t.Errorf("expected only a.example.com to be warmed, got %v", result.Warmed)
+	}
+	if _, ok := result.Failed["missing.example.com"]; !ok || len(result.Failed) != 1 {
+		t.Errorf("expected only missing.example.com to fail, got %v", result.Failed)
+	}
+	if issued := iss.issued.Load(); issued != int32(len(names)) {
+		t.Errorf("warming should not issue certificates; expected %d issuances, got %d", len(names), issued)
+	}
+}
+
+func TestWarmCacheCanceled(t *testing.T) {
+	cfg := newOnDemandTestConfig(t, new(countingIssuer))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	names := []string{"a.example.com", "b.example.com"}
+	result, err := cfg.WarmCache(ctx, WarmCacheOptions{Names: names})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Warmed) != 0 || len(result.Failed) != 0 {
+		t.Errorf("expected nothing to be attempted, got warmed=%v failed=%v", result.Warmed, result.Failed)
+	}
+	if len(result.Skipped) != len(names) {
+		t.Errorf("expected %d names to be skipped, got %v", len(names), result.Skipped)
+	}
+}
+
+func TestWarmCacheGroupCertificate(t *testing.T) {
+	ctx := context.Background()
+	iss := new(countingIssuer)
+
+	populate := newOnDemandTestConfig(t, iss)
+	populate.SubjectAltNames = func(_ context.Context, name string) ([]string, error) {
+		return []string{"www." + name}, nil
+	}
+	if err := populate.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	var loads atomic.Int32
+	cfg := newOnDemandTestConfig(t, iss)
+	cfg.Storage = &FaultyStorage{
+		Storage: populate.Storage,
+		Fault: func(op StorageOp, key string) error {
+			if op == StorageOpLoad && key == StorageKeys.SiteCert(iss.IssuerKey(), "example.com") {
+				loads.Add(1)
+			}
+			return nil
+		},
+	}
+
+	// the certificate is stored under its primary name, not all of its names
+	for i := 0; i < 2; i++ {
+		result, err := cfg.WarmCache(ctx, WarmCacheOptions{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(result.Warmed) != 1 || result.Warmed[0] != "example.com" {
+			t.Errorf("expected example.com to be warmed, got %v (failed: %v)", result.Warmed, result.Failed)
+		}
+	}
+	if n := loads.Load(); n != 1 {
+		t.Errorf("expected cached certificate not to be loaded again, got %d loads", n)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Warning describes a non-fatal anomaly, such as a corrupt entry in
+// storage, that was worked around but may deserve attention. Warnings
+// are logged, and emitted to Config.OnEvent as "warning" events so that
+// they can be routed to alerting.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type Warning struct {
+	// What kind of anomaly this is.
+	Kind WarningKind
+
+	// A human-readable description.
+	Message string
+
+	// The names of the affected certificate, if any.
+	Identifiers []string
+
+	// The affected storage key, if any.
+	StorageKey string
+
+	// The underlying error, if any.
+	Err error
+}
+
+// WarningKind is the kind of a Warning.
+type WarningKind string
+
+// Kinds of warnings.
+const (
+	// An entry in storage could not be decoded.
+	WarningCorruptStorage WarningKind = "corrupt_storage"
+
+	// An OCSP staple could not be obtained or was removed,
+	// so a certificate is served without one.
+	WarningStapleSkipped WarningKind = "staple_skipped"
+
+	// The local clock appears to differ from that of a
+	// remote server, such as an OCSP responder.
+	WarningClockSkew WarningKind = "clock_skew"
+)
+
+// maxClockSkew is how far the time of a remote server may
+// appear to be ahead of ours before it is reported.
+const maxClockSkew = 5 * time.Minute
+
+// warn logs w and emits it as a "warning" event.
+func (cfg *Config) warn(ctx context.Context, w Warning) {
+	logWarning(cfg.Logger, w)
+	cfg.emit(ctx, "warning", map[string]any{
+		"kind":        string(w.Kind),
+		"message":     w.Message,
+		"identifiers": w.Identifiers,
+		"storage_key": w.StorageKey,
+		"error":       errorString(w.Err),
+		"warning":     w,
+	})
+}
+
+// withWarnings returns a context with which warnings raised by code that
+// has no access to cfg, such as stapleOCSP, are reported to cfg.
+func (cfg *Config) withWarnings(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyWarnings, cfg)
+}
+
+// warnCtx reports w to the config of ctx (see withWarnings), or
+// logs it with the default logger if there is none.
+func warnCtx(ctx context.Context, w Warning) {
+	if cfg, ok := ctx.Value(ctxKeyWarnings).(*Config); ok {
+		cfg.warn(ctx, w)
+		return
+	}
+	logWarning(defaultLogger, w)
+}
+
+// warnStapling reports err, returned by stapleOCSP for cert, as a
+// WarningStapleSkipped, unless the certificate does not support OCSP,
+// which is common and not an anomaly.
+func (cfg *Config) warnStapling(ctx context.Context, cert Certificate, err error) {
+	if errors.Is(err, ErrNoOCSPServerSpecified) {
+		cfg.Logger.Warn("stapling OCSP", zap.Strings("identifiers", cert.Names), zap.Error(err))
+		return
+	}
+	cfg.warn(ctx, Warning{
+		Kind:        WarningStapleSkipped,
+		Message:     "stapling OCSP",
+		Identifiers: cert.Names,
+		Err:         err,
+	})
+}
+
+func logWarning(logger *zap.Logger, w Warning) {
+	fields := []zap.Field{zap.String("kind", string(w.Kind))}
+	if len(w.Identifiers) > 0 {
+		fields = append(fields, zap.Strings("identifiers", w.Identifiers))
+	}
+	if w.StorageKey != "" {
+		fields = append(fields, zap.String("storage_key", w.StorageKey))
+	}
+	if w.Err != nil {
+		fields = append(fields, zap.Error(w.Err))
+	}
+	logger.Warn(w.Message, fields...)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestCorruptStapleWarning(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+
+	responses := make(map[string][]byte)
+	responder := startOCSPResponder(t, responses)
+	t.Cleanup(responder.Close)
+
+	ca := mustMakeCertificate(t, caCert, caKey)
+	cert := mustMakeCertificate(t, certWithOCSPServer, certKey)
+	r, err := ocsp.CreateResponse(ca.Leaf, ca.Leaf, ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: cert.Leaf.SerialNumber,
+	}, ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	responses[cert.Leaf.SerialNumber.String()] = r
+
+	bundle := []byte(certWithOCSPServer + "\n" + caCert)
+	stapleKey := StorageKeys.OCSPStaple(&cert, bundle)
+	if err := storage.Store(ctx, stapleKey, []byte("not an OCSP response")); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var warnings []Warning
+	cfg := &Config{
+		Logger: defaultTestLogger,
+		OnEvent: func(_ context.Context, event string, data map[string]any) error {
+			if event == "warning" {
+				mu.Lock()
+				warnings = append(warnings, data["warning"].(Warning))
+				mu.Unlock()
+			}
+			return nil
+		},
+	}
+	ocspConfig := OCSPConfig{ResponderOverrides: map[string]string{"ocsp.example.com": responder.URL}}
+	if err := stapleOCSP(cfg.withWarnings(ctx), ocspConfig, storage, &cert, bundle); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cert.Certificate.OCSPStaple == nil {
+		t.Error("expected a fresh staple to replace the corrupt one")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 1 {
+		t.Fatalf("expected 1 warning, got %d: %+v", len(warnings), warnings)
+	}
+	w := warnings[0]
+	if w.Kind != WarningCorruptStorage || w.StorageKey != stapleKey || w.Err == nil {
+		t.Errorf("unexpected warning: %+v", w)
+	}
+	if len(w.Identifiers) != 1 || w.Identifiers[0] != cert.Names[0] {
+		t.Errorf("expected identifiers %v, got %v", cert.Names, w.Identifiers)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WebhookIssuer is an Issuer that delegates signing to an HTTPS endpoint,
+// so that a CA with its own API can be used without writing an Issuer.
+// Requests and responses are authenticated with a shared secret.
+//
+// The issuer POSTs a JSON object to the URL:
+//
+//	{
+//		"csr": "<PEM-encoded CSR>",
+//		"names": ["<name>", ...],
+//		"lifetime": <requested lifetime in seconds, or 0>,
+//		"nonce": "<random hex string>"
+//	}
+//
+// with the headers:
+//
+//	Webhook-Timestamp: <Unix time in seconds>
+//	Webhook-Signature: v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// The endpoint must verify the signature and reject requests whose
+// timestamp is not recent, then respond with status 200 and a JSON
+// object:
+//
+//	{
+//		"certificate": "<PEM-encoded certificate chain, leaf first>",
+//		"metadata": <optional JSON value, stored with the certificate>
+//	}
+//
+// with the header:
+//
+//	Webhook-Signature: v1=<hex HMAC-SHA256 of "<nonce>.<body>">
+//
+// where nonce is the nonce of the request. The certificate must be for
+// the public key of the CSR. Other statuses are errors; 4xx statuses
+// other than 408 and 429 are not retried.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type WebhookIssuer struct {
+	// The HTTPS URL of the endpoint. Required.
+	URL string
+
+	// The secret shared with the endpoint. Required.
+	Secret []byte
+
+	// A name for the CA behind the endpoint, which keeps
+	// its certificates apart in storage. Default: the
+	// host of the URL.
+	Name string
+
+	// Optional headers to add to requests, such as
+	// for authenticating to a gateway.
+	Header http.Header
+
+	// The HTTP client to make requests with.
+	// Default: a client with a 2m timeout.
+	HTTPClient *http.Client
+
+	Logger *zap.Logger
+}
+
+// Headers of the webhook issuer protocol.
+const (
+	webhookTimestampHeader = "Webhook-Timestamp"
+	webhookSignatureHeader = "Webhook-Signature"
+)
+
+type webhookIssueRequest struct {
+	CSR      string   `json:"csr"`
+	Names    []string `json:"names"`
+	Lifetime int64    `json:"lifetime"`
+	Nonce    string   `json:"nonce"`
+}
+
+type webhookIssueResponse struct {
+	Certificate string          `json:"certificate"`
+	Metadata    json.RawMessage `json:"metadata,omitempty"`
+}
+
+// IssuerKey returns the unique issuer key for the endpoint.
+func (iss *WebhookIssuer) IssuerKey() string {
+	name := iss.Name
+	if name == "" {
+		if u, err := url.Parse(iss.URL); err == nil {
+			name = u.Host
+		}
+	}
+	return "webhook_" + StorageKeys.Safe(name)
+}
+
+// Issue sends csr to the endpoint and returns the certificate it signed.
+func (iss *WebhookIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	if len(iss.Secret) == 0 {
+		return nil, ErrNoRetry{fmt.Errorf("webhook issuer: no secret")}
+	}
+	if u, err := url.Parse(iss.URL); err != nil || u.Scheme != "https" {
+		return nil, ErrNoRetry{fmt.Errorf("webhook issuer: URL must be HTTPS: %s", iss.URL)}
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	issueReq := webhookIssueRequest{
+		CSR:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+		Names: namesFromCSR(csr),
+		Nonce: hex.EncodeToString(nonce),
+	}
+	if lifetime, ok := RequestedLifetime(ctx); ok {
+		issueReq.Lifetime = int64(lifetime.Seconds())
+	}
+	body, err := json.Marshal(issueReq)
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, iss.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range iss.Header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(iss.Secret, timestamp, body))
+
+	client := iss.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 2 * time.Minute}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("webhook issuer: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, fmt.Errorf("webhook issuer: reading response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("webhook issuer: unexpected HTTP status %s: %s", resp.Status, bytes.TrimSpace(respBody[:min(len(respBody), 512)]))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+			resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return nil, ErrNoRetry{err}
+		}
+		return nil, err
+	}
+	if !hmac.Equal([]byte(resp.Header.Get(webhookSignatureHeader)), []byte(webhookSignature(iss.Secret, issueReq.Nonce, respBody))) {
+		return nil, fmt.Errorf("webhook issuer: invalid response signature")
+	}
+
+	var issueResp webhookIssueResponse
+	if err := json.Unmarshal(respBody, &issueResp); err != nil {
+		return nil, fmt.Errorf("webhook issuer: decoding response: %v", err)
+	}
+	chain, err := parseCertsFromPEMBundle([]byte(issueResp.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("webhook issuer: decoding certificate: %v", err)
+	}
+	if pub, ok := chain[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(csr.PublicKey) {
+		return nil, fmt.Errorf("webhook issuer: certificate is not for the public key of the CSR")
+	}
+	if iss.Logger != nil {
+		iss.Logger.Debug("webhook issued certificate",
+			zap.Strings("identifiers", issueReq.Names),
+			zap.String("url", iss.URL),
+			zap.Time("not_after", chain[0].NotAfter))
+	}
+
+	issued := &IssuedCertificate{Certificate: []byte(issueResp.Certificate)}
+	if len(issueResp.Metadata) > 0 {
+		issued.Metadata = issueResp.Metadata
+	}
+	return issued, nil
+}
+
+// webhookSignature returns the value of the signature header for
+// the message "<prefix>.<body>".
+func webhookSignature(secret []byte, prefix string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(prefix + "."))
+	mac.Write(body)
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Interface guard
+var _ Issuer = (*WebhookIssuer)(nil)
@@ -0,0 +1,121 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookIssuer(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("shared secret")
+	ca := &InternalIssuer{Storage: &FileStorage{Path: t.TempDir()}}
+	var tamper atomic.Bool
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(webhookTimestampHeader)
+		if r.Header.Get(webhookSignatureHeader) != webhookSignature(secret, timestamp, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "missing custom header", http.StatusBadRequest)
+			return
+		}
+		var req webhookIssueRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Lifetime != 3600 || len(req.Nonce) != 32 {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		issued, err := ca.Issue(r.Context(), csr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respBody, _ := json.Marshal(webhookIssueResponse{Certificate: string(issued.Certificate), Metadata: json.RawMessage(`{"ticket":42}`)})
+		sig := webhookSignature(secret, req.Nonce, respBody)
+		if tamper.Load() {
+			sig = webhookSignature([]byte("wrong"), req.Nonce, respBody)
+		}
+		w.Header().Set(webhookSignatureHeader, sig)
+		w.Write(respBody)
+	}))
+	defer srv.Close()
+
+	iss := &WebhookIssuer{
+		URL:        srv.URL,
+		Secret:     secret,
+		Header:     http.Header{"Authorization": []string{"Bearer token"}},
+		HTTPClient: srv.Client(),
+	}
+	if !strings.HasPrefix(iss.IssuerKey(), "webhook_127.0.0.1") {
+		t.Errorf("expected issuer key from URL host, got %s", iss.IssuerKey())
+	}
+	cfg := &Config{CertLifetime: time.Hour}
+	issueCtx := cfg.withRequestedLifetime(ctx, "app.internal")
+
+	issued, err := iss.Issue(issueCtx, newInternalTestCSR(t, "app.internal"))
+	if err != nil {
+		t.Fatalf("issuing certificate: %v", err)
+	}
+	chain, err := parseCertsFromPEMBundle(issued.Certificate)
+	if err != nil || chain[0].DNSNames[0] != "app.internal" {
+		t.Errorf("expected certificate for app.internal, got %v (err=%v)", chain, err)
+	}
+	if metadata, _ := json.Marshal(issued.Metadata); string(metadata) != `{"ticket":42}` {
+		t.Errorf("expected metadata from endpoint, got %s", metadata)
+	}
+
+	tamper.Store(true)
+	if _, err := iss.Issue(issueCtx, newInternalTestCSR(t, "app.internal")); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("expected invalid response signature error, got %v", err)
+	}
+	tamper.Store(false)
+
+	// rejected requests are not retried
+	wrongSecret := *iss
+	wrongSecret.Secret = []byte("wrong")
+	var errNoRetry ErrNoRetry
+	if _, err := wrongSecret.Issue(issueCtx, newInternalTestCSR(t, "app.internal")); !errors.As(err, &errNoRetry) {
+		t.Errorf("expected no-retry error for rejected request, got %v", err)
+	}
+
+	insecure := *iss
+	insecure.URL = strings.Replace(srv.URL, "https://", "http://", 1)
+	if _, err := insecure.Issue(issueCtx, newInternalTestCSR(t, "app.internal")); err == nil {
+		t.Error("expected error for non-HTTPS URL")
+	}
+}
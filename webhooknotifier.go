@@ -0,0 +1,197 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// WebhookNotifier POSTs lifecycle events of certificates to an HTTP
+// endpoint, such as to notify a chat or paging system when certificates
+// are obtained, renewed, fail, or are found to be revoked. Each event is
+// a JSON object:
+//
+//	{
+//		"type": "<event type, e.g. cert_obtained>",
+//		"time": "<RFC 3339 time of the event>",
+//		"data": {<the event's data, as given to Config.OnEvent>}
+//	}
+//
+// signed like the requests of WebhookIssuer, with the headers:
+//
+//	Webhook-Timestamp: <Unix time in seconds>
+//	Webhook-Signature: v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// Any 2xx status is success. Failed deliveries are retried according to
+// RetryPolicy; 4xx statuses other than 408 and 429 are not retried.
+// Events are delivered one at a time, in order; see Run.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type WebhookNotifier struct {
+	// The URL of the endpoint. Required.
+	URL string
+
+	// The secret shared with the endpoint to sign
+	// events with. Required.
+	Secret []byte
+
+	// The types of events to deliver. Default:
+	// DefaultWebhookEvents.
+	Events []string
+
+	// Optional headers to add to requests, such as
+	// for authenticating to a gateway.
+	Header http.Header
+
+	// How to retry failed deliveries. Default: up to 5
+	// attempts with exponential backoff from 1 second.
+	RetryPolicy RetryPolicy
+
+	// The HTTP client to make requests with.
+	// Default: a client with a 30s timeout.
+	HTTPClient *http.Client
+
+	Logger *zap.Logger
+}
+
+// DefaultWebhookEvents are the events delivered by WebhookNotifier by
+// default: obtained and renewed certificates (cert_obtained, whose
+// "renewal" is true for renewals), failures to obtain or renew them,
+// and certificates found to be revoked by OCSP or CRLs.
+var DefaultWebhookEvents = []string{
+	"cert_obtained",
+	"cert_failed",
+	"cert_ocsp_revoked",
+	"cert_crl_revoked",
+}
+
+type webhookEvent struct {
+	Type string         `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+// Run delivers the events of cfg's cache (see Config.Subscribe) to the
+// endpoint until ctx is canceled. Since events are delivered in order,
+// an endpoint that is down for a long time delays later events, and
+// may cause events to be dropped if too many are pending.
+func (wn *WebhookNotifier) Run(ctx context.Context, cfg *Config) {
+	eventTypes := wn.Events
+	if len(eventTypes) == 0 {
+		eventTypes = DefaultWebhookEvents
+	}
+	for event := range cfg.Subscribe(ctx, eventTypes...) {
+		if err := wn.Notify(ctx, event); err != nil && ctx.Err() == nil {
+			wn.logger().Error("unable to deliver event to webhook",
+				zap.String("event", event.Type),
+				zap.String("url", wn.URL),
+				zap.Error(err))
+		}
+	}
+}
+
+// Notify delivers event to the endpoint, retrying according to the
+// retry policy, and returns the error of the last attempt, if any.
+func (wn *WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	if len(wn.Secret) == 0 {
+		return fmt.Errorf("webhook notifier: no secret")
+	}
+	body, err := json.Marshal(webhookEvent{Type: event.Type, Time: event.Time, Data: event.Data})
+	if err != nil {
+		return fmt.Errorf("webhook notifier: encoding %s event: %v", event.Type, err)
+	}
+	policy := wn.RetryPolicy
+	if policy == nil {
+		policy = ExponentialBackoff{Initial: time.Second, Max: time.Minute, MaxAttempts: 5}
+	}
+
+	start := time.Now()
+	for attempts := 1; ; attempts++ {
+		err = wn.post(ctx, body)
+		if err == nil {
+			return nil
+		}
+		var errNoRetry ErrNoRetry
+		if errors.As(err, &errNoRetry) {
+			return err
+		}
+		retryIn, retry := policy.RetryIn(attempts, time.Since(start))
+		if !retry {
+			return err
+		}
+		wn.logger().Warn("delivering event to webhook failed; retrying",
+			zap.String("event", event.Type),
+			zap.Int("attempt", attempts),
+			zap.Duration("retrying_in", retryIn),
+			zap.Error(err))
+		select {
+		case <-time.After(retryIn):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// post makes one attempt to deliver body.
+func (wn *WebhookNotifier) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return ErrNoRetry{err}
+	}
+	for name, values := range wn.Header {
+		req.Header[name] = values
+	}
+	timestamp := strconv.FormatInt(timeNow().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, webhookSignature(wn.Secret, timestamp, body))
+
+	client := wn.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook notifier: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("webhook notifier: unexpected HTTP status %s: %s", resp.Status, bytes.TrimSpace(respBody))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return ErrNoRetry{err}
+	}
+	return err
+}
+
+func (wn *WebhookNotifier) logger() *zap.Logger {
+	if wn.Logger == nil {
+		return zap.NewNop()
+	}
+	return wn.Logger
+}
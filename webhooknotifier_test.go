@@ -0,0 +1,96 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	secret := []byte("shared secret")
+	var requests atomic.Int32
+	received := make(chan webhookEvent, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhookSignatureHeader) != webhookSignature(secret, r.Header.Get(webhookTimestampHeader), body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		// fail the first attempt, so that it is retried
+		if requests.Add(1) == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		var event webhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- event
+	}))
+	defer srv.Close()
+
+	wn := &WebhookNotifier{
+		URL:         srv.URL,
+		Secret:      secret,
+		RetryPolicy: ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3},
+	}
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	cfg.OnDemand = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wn.Run(ctx, cfg)
+	for !cfg.certCache.events.subscribed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-received:
+		if event.Type != "cert_obtained" || event.Data["identifier"] != "example.com" || event.Time.IsZero() {
+			t.Errorf("unexpected event: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("expected 2 requests (one retry), got %d", n)
+	}
+
+	wrongSecret := &WebhookNotifier{
+		URL:         srv.URL,
+		Secret:      []byte("wrong"),
+		RetryPolicy: ExponentialBackoff{Initial: time.Millisecond, MaxAttempts: 3},
+	}
+	before := requests.Load()
+	err := wrongSecret.Notify(ctx, Event{Type: "cert_failed", Time: time.Now()})
+	var errNoRetry ErrNoRetry
+	if !errors.As(err, &errNoRetry) {
+		t.Errorf("expected rejected event not to be retried, got %v", err)
+	}
+	if requests.Load() != before {
+		t.Error("expected request with wrong signature not to be counted")
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// WindowsCertStore installs managed certificates into a Windows
+// certificate store, so that Windows services such as IIS or RDP
+// gateways can use certificates managed by certmagic directly.
+//
+// To install certificates as they are obtained and renewed, call
+// HandleEvent from Config.OnEvent. Installed certificates are given
+// a friendly name of "certmagic <name>", by which the certificates
+// they replace are found and removed; private keys are imported
+// into the Microsoft Software Key Storage Provider. Intermediate
+// certificates are added to the intermediate ("CA") store.
+//
+// It is only supported on Windows; elsewhere, installing fails
+// with ErrWindowsCertStoreUnsupported.
+//
+// EXPERIMENTAL: Subject to change or removal.
+type WindowsCertStore struct {
+	// The storage from which to load certificates and
+	// keys when handling events. Required for HandleEvent.
+	Storage Storage
+
+	// The name of the system store to install into.
+	// Default: "MY" (Personal).
+	StoreName string
+
+	// If true, the store of the local machine is used
+	// instead of the store of the current user. This
+	// usually requires administrator privileges, but is
+	// what services running as system accounts need.
+	LocalMachine bool
+
+	// If true, imported private keys can be exported again.
+	Exportable bool
+
+	// Set a logger to enable logging.
+	Logger *zap.Logger
+}
+
+// ErrWindowsCertStoreUnsupported is returned when installing into a
+// WindowsCertStore on a platform other than Windows.
+var ErrWindowsCertStoreUnsupported = errors.New("windows certificate store is not supported on this platform")
+
+// HandleEvent installs the certificate of each "cert_obtained" event
+// into the store; other events are ignored. It can be called from
+// Config.OnEvent.
+func (ws *WindowsCertStore) HandleEvent(ctx context.Context, event string, data map[string]any) error {
+	if event != "cert_obtained" {
+		return nil
+	}
+	name, _ := data["identifier"].(string)
+	certPath, _ := data["certificate_path"].(string)
+	keyPath, _ := data["private_key_path"].(string)
+	if name == "" || certPath == "" || keyPath == "" {
+		return fmt.Errorf("event is missing certificate information")
+	}
+	certPEM, err := ws.Storage.Load(ctx, certPath)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %v", err)
+	}
+	keyPEM, err := ws.Storage.Load(ctx, keyPath)
+	if err != nil {
+		return fmt.Errorf("loading private key: %v", err)
+	}
+	if err := ws.Install(name, certPEM, keyPEM); err != nil {
+		ws.logger().Error("unable to install certificate into Windows certificate store",
+			zap.String("identifier", name),
+			zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Install installs the PEM-encoded certificate chain and private key for
+// name into the store, then removes the certificates previously installed
+// for name.
+func (ws *WindowsCertStore) Install(name string, certPEM, keyPEM []byte) error {
+	chain, err := parseCertsFromPEMBundle(certPEM)
+	if err != nil {
+		return err
+	}
+	key, err := PEMDecodePrivateKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("decoding private key: %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding private key: %v", err)
+	}
+	if err := ws.install(windowsFriendlyName(name), chain, pkcs8); err != nil {
+		return err
+	}
+	ws.logger().Info("installed certificate into Windows certificate store",
+		zap.String("identifier", name),
+		zap.String("store", ws.storeName()),
+		zap.Bool("local_machine", ws.LocalMachine))
+	return nil
+}
+
+// Remove removes the certificates installed for name from the store,
+// along with their private keys.
+func (ws *WindowsCertStore) Remove(name string) error {
+	return ws.remove(windowsFriendlyName(name), nil)
+}
+
+func (ws *WindowsCertStore) storeName() string {
+	if ws.StoreName == "" {
+		return "MY"
+	}
+	return ws.StoreName
+}
+
+func (ws *WindowsCertStore) logger() *zap.Logger {
+	if ws.Logger == nil {
+		return zap.NewNop()
+	}
+	return ws.Logger
+}
+
+func windowsFriendlyName(name string) string {
+	return "certmagic " + name
+}
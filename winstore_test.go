@@ -0,0 +1,58 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestWindowsCertStoreHandleEvent(t *testing.T) {
+	ctx := context.Background()
+	storage := &FileStorage{Path: t.TempDir()}
+	ws := &WindowsCertStore{Storage: storage}
+
+	// other events are ignored, even without certificate information
+	if err := ws.HandleEvent(ctx, "cert_obtaining", map[string]any{"identifier": "example.com"}); err != nil {
+		t.Errorf("expected other events to be ignored, got %v", err)
+	}
+	if err := ws.HandleEvent(ctx, "cert_obtained", map[string]any{"identifier": "example.com"}); err == nil {
+		t.Error("expected error for event without certificate paths")
+	}
+
+	data := map[string]any{
+		"identifier":       "example.com",
+		"certificate_path": StorageKeys.SiteCert("fake", "example.com"),
+		"private_key_path": StorageKeys.SitePrivateKey("fake", "example.com"),
+	}
+	if err := ws.HandleEvent(ctx, "cert_obtained", data); err == nil {
+		t.Error("expected error when certificate is not in storage")
+	}
+
+	if runtime.GOOS == "windows" {
+		// installing would modify the store of the machine running the tests
+		return
+	}
+	cfg := newOnDemandTestConfig(t, new(FakeIssuer))
+	ws.Storage = cfg.Storage
+	if err := cfg.ObtainCertSync(ctx, "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ws.HandleEvent(ctx, "cert_obtained", data); !errors.Is(err, ErrWindowsCertStoreUnsupported) {
+		t.Errorf("expected unsupported error, got %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/windows"
+)
+
+// Functions and constants not (yet) provided by x/sys/windows.
+var (
+	modcrypt32 = windows.NewLazySystemDLL("crypt32.dll")
+	modncrypt  = windows.NewLazySystemDLL("ncrypt.dll")
+
+	procCertSetCertificateContextProperty = modcrypt32.NewProc("CertSetCertificateContextProperty")
+	procCertGetCertificateContextProperty = modcrypt32.NewProc("CertGetCertificateContextProperty")
+
+	procNCryptOpenStorageProvider = modncrypt.NewProc("NCryptOpenStorageProvider")
+	procNCryptImportKey           = modncrypt.NewProc("NCryptImportKey")
+	procNCryptOpenKey             = modncrypt.NewProc("NCryptOpenKey")
+	procNCryptSetProperty         = modncrypt.NewProc("NCryptSetProperty")
+	procNCryptFinalizeKey         = modncrypt.NewProc("NCryptFinalizeKey")
+	procNCryptDeleteKey           = modncrypt.NewProc("NCryptDeleteKey")
+	procNCryptFreeObject          = modncrypt.NewProc("NCryptFreeObject")
+)
+
+const (
+	certKeyProvInfoPropID  = 2
+	certFriendlyNamePropID = 11
+	certNCryptKeySpec      = 0xFFFFFFFF
+
+	ncryptMachineKeyFlag           = 0x00000020
+	ncryptOverwriteKeyFlag         = 0x00000080
+	ncryptDoNotFinalizeFlag        = 0x00000400
+	ncryptPersistFlag              = 0x80000000
+	ncryptAllowExportFlag          = 0x00000001
+	ncryptAllowPlaintextExportFlag = 0x00000002
+	ncryptBufferPKCSKeyName        = 45
+
+	windowsKeyStorageProvider = "Microsoft Software Key Storage Provider"
+)
+
+// cryptKeyProvInfo is a CRYPT_KEY_PROV_INFO.
+type cryptKeyProvInfo struct {
+	containerName  *uint16
+	provName       *uint16
+	provType       uint32
+	flags          uint32
+	provParamCount uint32
+	provParams     uintptr
+	keySpec        uint32
+}
+
+// ncryptBuffer is an NCryptBuffer.
+type ncryptBuffer struct {
+	size       uint32
+	bufferType uint32
+	buffer     unsafe.Pointer
+}
+
+// ncryptBufferDesc is an NCryptBufferDesc.
+type ncryptBufferDesc struct {
+	version uint32
+	count   uint32
+	buffers *ncryptBuffer
+}
+
+func (ws *WindowsCertStore) install(friendlyName string, chain []*x509.Certificate, pkcs8 []byte) error {
+	leaf := chain[0]
+	keyName := windowsKeyName(leaf.Raw)
+	if err := ws.importKey(keyName, pkcs8); err != nil {
+		return fmt.Errorf("importing private key: %v", err)
+	}
+
+	store, err := ws.openStore(ws.storeName())
+	if err != nil {
+		return err
+	}
+	defer windows.CertCloseStore(store, 0)
+
+	stored, err := addCertToStore(store, leaf.Raw, windows.CERT_STORE_ADD_REPLACE_EXISTING)
+	if err != nil {
+		return fmt.Errorf("adding certificate to store: %v", err)
+	}
+	defer windows.CertFreeCertificateContext(stored)
+
+	// associate the certificate with its private key
+	keyNamePtr, err := windows.UTF16PtrFromString(keyName)
+	if err != nil {
+		return err
+	}
+	provNamePtr, err := windows.UTF16PtrFromString(windowsKeyStorageProvider)
+	if err != nil {
+		return err
+	}
+	keyInfo := cryptKeyProvInfo{
+		containerName: keyNamePtr,
+		provName:      provNamePtr,
+		keySpec:       certNCryptKeySpec,
+	}
+	if ws.LocalMachine {
+		keyInfo.flags = windows.CRYPT_MACHINE_KEYSET
+	}
+	if err := setCertProperty(stored, certKeyProvInfoPropID, unsafe.Pointer(&keyInfo)); err != nil {
+		return fmt.Errorf("setting private key of certificate: %v", err)
+	}
+
+	friendlyNameUTF16, err := windows.UTF16FromString(friendlyName)
+	if err != nil {
+		return err
+	}
+	blob := windows.CryptDataBlob{
+		Size: uint32(len(friendlyNameUTF16) * 2),
+		Data: (*byte)(unsafe.Pointer(&friendlyNameUTF16[0])),
+	}
+	if err := setCertProperty(stored, certFriendlyNamePropID, unsafe.Pointer(&blob)); err != nil {
+		return fmt.Errorf("setting friendly name of certificate: %v", err)
+	}
+
+	// install intermediates so clients can be served the full chain
+	if len(chain) > 1 {
+		caStore, err := ws.openStore("CA")
+		if err != nil {
+			return err
+		}
+		defer windows.CertCloseStore(caStore, 0)
+		for _, intermediate := range chain[1:] {
+			ctx, err := addCertToStore(caStore, intermediate.Raw, windows.CERT_STORE_ADD_USE_EXISTING)
+			if err != nil {
+				return fmt.Errorf("adding intermediate certificate to store: %v", err)
+			}
+			windows.CertFreeCertificateContext(ctx)
+		}
+	}
+
+	return ws.remove(friendlyName, leaf.Raw)
+}
+
+// remove deletes the certificates with the given friendly name from
+// the store, along with their private keys, except for the certificate
+// with the DER encoding keep.
+func (ws *WindowsCertStore) remove(friendlyName string, keep []byte) error {
+	store, err := ws.openStore(ws.storeName())
+	if err != nil {
+		return err
+	}
+	defer windows.CertCloseStore(store, 0)
+
+	// collect first; deleting while enumerating is not allowed
+	var doomed []*windows.CertContext
+	var ctx *windows.CertContext
+	for {
+		ctx, _ = windows.CertEnumCertificatesInStore(store, ctx)
+		if ctx == nil {
+			break
+		}
+		if certFriendlyName(ctx) != friendlyName {
+			continue
+		}
+		if keep != nil && bytes.Equal(unsafe.Slice(ctx.EncodedCert, ctx.Length), keep) {
+			continue
+		}
+		doomed = append(doomed, windows.CertDuplicateCertificateContext(ctx))
+	}
+
+	var firstErr error
+	for _, ctx := range doomed {
+		keyName := windowsKeyName(unsafe.Slice(ctx.EncodedCert, ctx.Length))
+		// CertDeleteCertificateFromStore frees the context, even on failure
+		if err := windows.CertDeleteCertificateFromStore(ctx); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("deleting certificate from store: %v", err)
+			}
+			continue
+		}
+		if err := ws.deleteKey(keyName); err != nil {
+			ws.logger().Warn("unable to delete private key of removed certificate",
+				zap.String("key_name", keyName),
+				zap.Error(err))
+		}
+	}
+	return firstErr
+}
+
+func (ws *WindowsCertStore) openStore(name string) (windows.Handle, error) {
+	namePtr, err := windows.UTF16PtrFromString(name)
+	if err != nil {
+		return 0, err
+	}
+	var flags uint32 = windows.CERT_SYSTEM_STORE_CURRENT_USER
+	if ws.LocalMachine {
+		flags = windows.CERT_SYSTEM_STORE_LOCAL_MACHINE
+	}
+	store, err := windows.CertOpenStore(windows.CERT_STORE_PROV_SYSTEM, 0, 0, flags, uintptr(unsafe.Pointer(namePtr)))
+	if err != nil {
+		return 0, fmt.Errorf("opening certificate store %s: %v", name, err)
+	}
+	return store, nil
+}
+
+// importKey imports the PKCS#8-encoded private key into a persisted key
+// with the given name, replacing any key with that name.
+func (ws *WindowsCertStore) importKey(keyName string, pkcs8 []byte) error {
+	prov, err := openKeyStorageProvider()
+	if err != nil {
+		return err
+	}
+	defer procNCryptFreeObject.Call(prov)
+
+	keyNameUTF16, err := windows.UTF16FromString(keyName)
+	if err != nil {
+		return err
+	}
+	buf := ncryptBuffer{
+		size:       uint32(len(keyNameUTF16) * 2),
+		bufferType: ncryptBufferPKCSKeyName,
+		buffer:     unsafe.Pointer(&keyNameUTF16[0]),
+	}
+	desc := ncryptBufferDesc{count: 1, buffers: &buf}
+	blobType, err := windows.UTF16PtrFromString("PKCS8_PRIVATEKEY")
+	if err != nil {
+		return err
+	}
+
+	var key uintptr
+	err = ncryptCall(procNCryptImportKey, prov, 0,
+		uintptr(unsafe.Pointer(blobType)),
+		uintptr(unsafe.Pointer(&desc)),
+		uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(&pkcs8[0])),
+		uintptr(len(pkcs8)),
+		uintptr(ws.ncryptFlags()|ncryptOverwriteKeyFlag|ncryptDoNotFinalizeFlag))
+	if err != nil {
+		return err
+	}
+	defer procNCryptFreeObject.Call(key)
+
+	if ws.Exportable {
+		policyName, err := windows.UTF16PtrFromString("Export Policy")
+		if err != nil {
+			return err
+		}
+		policy := uint32(ncryptAllowExportFlag | ncryptAllowPlaintextExportFlag)
+		err = ncryptCall(procNCryptSetProperty, key,
+			uintptr(unsafe.Pointer(policyName)),
+			uintptr(unsafe.Pointer(&policy)),
+			unsafe.Sizeof(policy),
+			ncryptPersistFlag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return ncryptCall(procNCryptFinalizeKey, key, 0)
+}
+
+func (ws *WindowsCertStore) deleteKey(keyName string) error {
+	prov, err := openKeyStorageProvider()
+	if err != nil {
+		return err
+	}
+	defer procNCryptFreeObject.Call(prov)
+
+	keyNamePtr, err := windows.UTF16PtrFromString(keyName)
+	if err != nil {
+		return err
+	}
+	var key uintptr
+	err = ncryptCall(procNCryptOpenKey, prov,
+		uintptr(unsafe.Pointer(&key)),
+		uintptr(unsafe.Pointer(keyNamePtr)),
+		0,
+		uintptr(ws.ncryptFlags()))
+	if err != nil {
+		return err
+	}
+	// NCryptDeleteKey frees the key handle if successful
+	if err := ncryptCall(procNCryptDeleteKey, key, 0); err != nil {
+		procNCryptFreeObject.Call(key)
+		return err
+	}
+	return nil
+}
+
+func (ws *WindowsCertStore) ncryptFlags() uint32 {
+	if ws.LocalMachine {
+		return ncryptMachineKeyFlag
+	}
+	return 0
+}
+
+func openKeyStorageProvider() (uintptr, error) {
+	provName, err := windows.UTF16PtrFromString(windowsKeyStorageProvider)
+	if err != nil {
+		return 0, err
+	}
+	var prov uintptr
+	err = ncryptCall(procNCryptOpenStorageProvider,
+		uintptr(unsafe.Pointer(&prov)),
+		uintptr(unsafe.Pointer(provName)),
+		0)
+	return prov, err
+}
+
+// ncryptCall calls an NCrypt function, which returns a SECURITY_STATUS.
+func ncryptCall(proc *windows.LazyProc, args ...uintptr) error {
+	status, _, _ := proc.Call(args...)
+	if status != 0 {
+		return fmt.Errorf("%s: status 0x%08x", proc.Name, uint32(status))
+	}
+	return nil
+}
+
+func addCertToStore(store windows.Handle, der []byte, disposition uint32) (*windows.CertContext, error) {
+	ctx, err := windows.CertCreateCertificateContext(windows.X509_ASN_ENCODING|windows.PKCS_7_ASN_ENCODING, &der[0], uint32(len(der)))
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CertFreeCertificateContext(ctx)
+	var stored *windows.CertContext
+	if err := windows.CertAddCertificateContextToStore(store, ctx, disposition, &stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func setCertProperty(ctx *windows.CertContext, propID uint32, data unsafe.Pointer) error {
+	ok, _, err := procCertSetCertificateContextProperty.Call(uintptr(unsafe.Pointer(ctx)), uintptr(propID), 0, uintptr(data))
+	if ok == 0 {
+		return err
+	}
+	return nil
+}
+
+// certFriendlyName returns the friendly name of ctx, or "" if it has none.
+func certFriendlyName(ctx *windows.CertContext) string {
+	var size uint32
+	ok, _, _ := procCertGetCertificateContextProperty.Call(uintptr(unsafe.Pointer(ctx)), certFriendlyNamePropID, 0, uintptr(unsafe.Pointer(&size)))
+	if ok == 0 || size < 2 {
+		return ""
+	}
+	buf := make([]uint16, size/2)
+	ok, _, _ = procCertGetCertificateContextProperty.Call(uintptr(unsafe.Pointer(ctx)), certFriendlyNamePropID, uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if ok == 0 {
+		return ""
+	}
+	return windows.UTF16ToString(buf)
+}
+
+// windowsKeyName returns the name of the persisted private key
+// of the certificate with the given DER encoding.
+func windowsKeyName(certDER []byte) string {
+	thumbprint := sha1.Sum(certDER)
+	return "certmagic-" + hex.EncodeToString(thumbprint[:])
+}
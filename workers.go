@@ -0,0 +1,89 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"runtime"
+	"sync"
+)
+
+// DefaultOCSPWorkers returns the default number of certificates
+// whose OCSP staples and CRLs are refreshed concurrently during
+// maintenance, which is derived from the number of CPUs that may
+// run Go code at once (GOMAXPROCS). Refreshing is mostly waiting
+// on responders, so a few workers per CPU are used, within bounds
+// that keep small machines from being swamped and large ones
+// from flooding responders.
+func DefaultOCSPWorkers() int {
+	return min(max(4, 2*runtime.GOMAXPROCS(0)), 32)
+}
+
+// DefaultLoadWorkers returns the default number of certificates
+// that WarmCache loads from storage concurrently, which is derived
+// from GOMAXPROCS, but is at least DefaultWarmCacheConcurrency.
+func DefaultLoadWorkers() int {
+	return max(DefaultWarmCacheConcurrency, 2*runtime.GOMAXPROCS(0))
+}
+
+// ocspWorkers returns the number of OCSP workers of the cache.
+func (certCache *Cache) ocspWorkers() int {
+	certCache.optionsMu.RLock()
+	n := certCache.options.OCSPWorkers
+	certCache.optionsMu.RUnlock()
+	if n <= 0 {
+		return DefaultOCSPWorkers()
+	}
+	return n
+}
+
+// loadWorkers returns the number of load workers of the cache.
+func (certCache *Cache) loadWorkers() int {
+	certCache.optionsMu.RLock()
+	n := certCache.options.LoadWorkers
+	certCache.optionsMu.RUnlock()
+	if n <= 0 {
+		return DefaultLoadWorkers()
+	}
+	return n
+}
+
+// runConcurrently calls fn for each index in [0, n), with
+// at most workers calls running at once, and returns when
+// all calls have returned.
+func runConcurrently(n, workers int, fn func(i int)) {
+	workers = max(min(workers, n), 1)
+	if workers == 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,78 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestRunConcurrently(t *testing.T) {
+	var mu sync.Mutex
+	var running, peak int
+	seen := make([]bool, 50)
+	block := make(chan struct{})
+	go func() {
+		// let the workers pile up before releasing them
+		for i := 0; i < len(seen); i++ {
+			block <- struct{}{}
+		}
+	}()
+	runConcurrently(len(seen), 4, func(i int) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		seen[i] = true
+		mu.Unlock()
+		<-block
+		mu.Lock()
+		running--
+		mu.Unlock()
+	})
+	if peak > 4 {
+		t.Errorf("expected at most 4 concurrent calls, got %d", peak)
+	}
+	for i, ok := range seen {
+		if !ok {
+			t.Errorf("expected fn to be called for index %d", i)
+		}
+	}
+
+	// no work, and no workers, are fine
+	runConcurrently(0, 4, func(int) { t.Error("unexpected call") })
+	var calls int
+	runConcurrently(3, 0, func(int) { calls++ })
+	if calls != 3 {
+		t.Errorf("expected 3 calls with no workers configured, got %d", calls)
+	}
+}
+
+func TestCacheWorkers(t *testing.T) {
+	if n := DefaultOCSPWorkers(); n < 4 || n > 32 {
+		t.Errorf("expected default OCSP workers within [4, 32], got %d", n)
+	}
+	if n := DefaultLoadWorkers(); n < DefaultWarmCacheConcurrency {
+		t.Errorf("expected at least %d default load workers, got %d", DefaultWarmCacheConcurrency, n)
+	}
+
+	cache := &Cache{}
+	if cache.ocspWorkers() != DefaultOCSPWorkers() || cache.loadWorkers() != DefaultLoadWorkers() {
+		t.Error("expected defaults when options are unset")
+	}
+	cache.options = CacheOptions{OCSPWorkers: 1, LoadWorkers: 100}
+	if cache.ocspWorkers() != 1 || cache.loadWorkers() != 100 {
+		t.Errorf("expected configured workers, got %d and %d", cache.ocspWorkers(), cache.loadWorkers())
+	}
+}
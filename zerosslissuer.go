@@ -86,7 +86,12 @@ func (iss *ZeroSSLIssuer) Issue(ctx context.Context, csr *x509.CertificateReques
 
 	logger.Info("creating certificate")
 
-	cert, err := client.CreateCertificate(ctx, csr, iss.ValidityDays)
+	validityDays := iss.ValidityDays
+	if lifetime, ok := RequestedLifetime(ctx); ok {
+		validityDays = int((lifetime + 24*time.Hour - 1) / (24 * time.Hour))
+	}
+
+	cert, err := client.CreateCertificate(ctx, csr, validityDays)
 	if err != nil {
 		return nil, fmt.Errorf("creating certificate: %v", err)
 	}